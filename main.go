@@ -28,6 +28,7 @@ import (
 	"syscall"
 
 	"github.com/mitchellh/go-homedir"
+	"github.com/nats-io/nats-account-server/server/conf"
 	"github.com/nats-io/nats-account-server/server/core"
 )
 
@@ -51,6 +52,13 @@ func main() {
 	disabledNscFolder := ""
 	disabledReadOnly := false
 	dump := false
+	showVersion := false
+	printDefaults := false
+	verifyStore := false
+	quarantine := false
+	migrateNSC := ""
+	convertStore := false
+	convertTo := ""
 	flags := core.Flags{}
 	flag.StringVar(&flags.ConfigFile, "c", "", "configuration filepath, other flags take precedent over the config file")
 	flag.StringVar(&flags.Directory, "dir", "", "the directory to store/host accounts with, mututally exclusive from nsc")
@@ -65,8 +73,27 @@ func main() {
 	flag.StringVar(&disabledNscFolder, "nsc", "", core.NscError)
 	flag.BoolVar(&disabledReadOnly, "ro", false, core.RoError)
 	flag.BoolVar(&dump, "dump", false, "print config")
+	flag.BoolVar(&showVersion, "v", false, "print the version and build information and exit")
+	flag.BoolVar(&printDefaults, "print-defaults", false, "print every configuration option with its default value and exit")
+	flag.BoolVar(&verifyStore, "verify-store", false, "check every JWT in the configured store, print the report and exit, with 1 if bad JWTs were found")
+	flag.BoolVar(&quarantine, "quarantine", false, "with -verify-store, rename the bad JWT files of a directory store with a .quarantined suffix")
+	flag.StringVar(&migrateNSC, "migrate-nsc", "", "import the accounts of an nsc operator directory into the configured store, print a summary and exit")
+	flag.BoolVar(&convertStore, "convert", false, "move the files of the configured directory store to the layout of its shard setting, print a summary and exit")
+	flag.StringVar(&convertTo, "convert-to", "", "like -convert, but copy the files to this directory and leave the store as it is")
 	flag.Parse()
 
+	if showVersion {
+		fmt.Println(core.Build())
+		os.Exit(0)
+	}
+
+	if printDefaults {
+		if err := conf.WriteDefaults(os.Stdout); err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		os.Exit(0)
+	}
+
 	// resolve paths with dots/tildes
 	flags.ConfigFile = expandPath(flags.ConfigFile)
 	flags.Creds = expandPath(flags.Creds)
@@ -92,6 +119,49 @@ func main() {
 		logStopExit(server, fmt.Errorf(core.RoError))
 	}
 
+	if migrateNSC != "" {
+		report, err := server.MigrateNSC(expandPath(migrateNSC))
+		if report != nil {
+			if d, err := json.MarshalIndent(report, "", "  "); err == nil {
+				fmt.Println(string(d))
+			}
+		}
+		if err != nil {
+			logStopExit(server, err)
+		}
+		os.Exit(0)
+	}
+
+	if convertStore || convertTo != "" {
+		report, err := server.ConvertStore(expandPath(convertTo))
+		if report != nil {
+			if d, err := json.MarshalIndent(report, "", "  "); err == nil {
+				fmt.Println(string(d))
+			}
+		}
+		if err != nil {
+			logStopExit(server, err)
+		}
+		os.Exit(0)
+	}
+
+	if verifyStore {
+		report, err := server.VerifyStore(quarantine)
+		if err != nil && report == nil {
+			logStopExit(server, err)
+		}
+		if d, err := json.MarshalIndent(report, "", "  "); err == nil {
+			fmt.Println(string(d))
+		}
+		if err != nil {
+			logStopExit(server, err)
+		}
+		if report.Problems() > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGHUP)
@@ -5,6 +5,7 @@ mkdir cov
 go test -covermode=atomic -coverprofile=./cov/conf.out ./server/conf
 go test -covermode=atomic -coverprofile=./cov/core.out ./server/core
 go test -covermode=atomic -coverprofile=./cov/store.out ./server/store
+go test -covermode=atomic -coverprofile=./cov/testsupport.out ./server/testsupport
 
 gocovmerge ./cov/*.out > ./coverage.out
 rm -rf ./cov
@@ -0,0 +1,385 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package client talks to the /jwt/v1 API of an account server. Account JWTs are cached by ETag,
+// requests the server may complete later are retried, and failures are returned as *Error.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Subjects the account server publishes account updates on, see the notifications configuration
+const (
+	LegacyUpdates = "$SYS.ACCOUNT.*.CLAIMS.UPDATE"
+	NativeUpdates = "$SYS.REQ.ACCOUNT.*.CLAIMS.UPDATE"
+)
+
+// headers set by the account server
+const (
+	warningHeader    = "Account-Server-Warning"
+	serverNameHeader = "Account-Server-Name"
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = 250 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+)
+
+// ErrNotFound is matched, with errors.Is, by the *Error of a 404
+var ErrNotFound = errors.New("not found")
+
+// Error is returned when the account server answers with a failure status
+type Error struct {
+	StatusCode int
+	Message    string        // the body of the response, the server sends a one line description
+	RetryAfter time.Duration // set on a 429 or 503 if the server asked for a delay
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("account server returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("account server returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is matches ErrNotFound for a 404
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Option changes the defaults of a client
+type Option func(*Client)
+
+// WithHTTPClient sets the http client used for every request, i.e. to configure TLS
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the requests, i.e. to trust a private CA or to present a
+// client certificate. It replaces the http client of WithHTTPClient.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		c.http = &http.Client{Transport: transport}
+	}
+}
+
+// WithToken sets the bearer token sent with account and activation JWT posts
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithRetries sets how often a request is retried after a network error, a 429 or a 503, and the
+// first delay, which doubles on every attempt unless the server asks for a delay
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// cachedJWT is an account JWT with the ETag it was served with
+type cachedJWT struct {
+	etag string
+	jwt  string
+}
+
+// Client is safe for concurrent use
+type Client struct {
+	url     string
+	http    *http.Client
+	token   string
+	retries int
+	backoff time.Duration
+
+	sync.Mutex
+	cache map[string]cachedJWT
+}
+
+// New returns a client for the account server at url, i.e. http://localhost:9090
+func New(url string, opts ...Option) *Client {
+	c := &Client{
+		url:     strings.TrimSuffix(url, "/"),
+		http:    http.DefaultClient,
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+		cache:   map[string]cachedJWT{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// retryable returns true if the request can be sent again, the server didn't act on it
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// do sends the request, retrying on network errors and busy responses. The body of a failure
+// is read into an *Error, other responses are returned for the caller to close.
+func (c *Client) do(ctx context.Context, method string, path string, body string, header http.Header) (*http.Response, error) {
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.url+path, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := c.http.Do(req)
+		var delay time.Duration
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			return resp, nil
+		} else if err == nil {
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+			if retryable(resp.StatusCode) {
+				e.RetryAfter = retryAfter(resp.Header.Get("Retry-After"))
+				delay = e.RetryAfter
+			}
+			err = e
+			if !retryable(resp.StatusCode) {
+				return nil, err
+			}
+		}
+		if ctx.Err() != nil || attempt >= c.retries {
+			return nil, err
+		}
+		if delay < wait {
+			delay = wait
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if wait *= 2; wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an http date
+func retryAfter(v string) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func readBody(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return string(data), err
+}
+
+// GetAccount returns the account JWT. The JWT is cached with its ETag, a server answering 304
+// Not Modified costs no transfer.
+func (c *Client) GetAccount(ctx context.Context, pubKey string) (string, error) {
+	c.Lock()
+	cached, ok := c.cache[pubKey]
+	c.Unlock()
+	header := http.Header{}
+	if ok {
+		header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/jwt/v1/accounts/"+pubKey, "", header)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.forget(pubKey)
+		}
+		return "", err
+	}
+	if resp.StatusCode == http.StatusNotModified && ok {
+		resp.Body.Close()
+		return cached.jwt, nil
+	}
+	theJWT, err := readBody(resp)
+	if err != nil {
+		return "", err
+	}
+	if etag := resp.Header.Get("Etag"); etag != "" {
+		c.Lock()
+		c.cache[pubKey] = cachedJWT{etag: etag, jwt: theJWT}
+		c.Unlock()
+	}
+	return theJWT, nil
+}
+
+func (c *Client) forget(pubKey string) {
+	c.Lock()
+	delete(c.cache, pubKey)
+	c.Unlock()
+}
+
+// PutResult describes an accepted account JWT
+type PutResult struct {
+	Held     bool     // the server holds the JWT for an approval or canary check, it isn't served yet
+	Warnings []string // limits the JWT violates that are not enforced yet
+}
+
+// postHeader returns the headers of a JWT post
+func (c *Client) postHeader() http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", "application/jwt")
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+	return header
+}
+
+// PutAccount posts the account JWT, which has to be signed by the operator or one of its signing keys
+func (c *Client) PutAccount(ctx context.Context, pubKey string, theJWT string) (*PutResult, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/jwt/v1/accounts/"+pubKey, theJWT, c.postHeader())
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	c.forget(pubKey)
+	return &PutResult{Held: resp.StatusCode == http.StatusAccepted, Warnings: resp.Header.Values(warningHeader)}, nil
+}
+
+// GetActivation returns the activation JWT stored under the hash. Servers that don't serve
+// activations answer with a 404.
+func (c *Client) GetActivation(ctx context.Context, hash string) (string, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/jwt/v1/activations/"+hash, "", nil)
+	if err != nil {
+		return "", err
+	}
+	return readBody(resp)
+}
+
+// PutActivation posts the activation JWT, which the server stores under its hash. Servers that don't
+// store activations answer with a 404.
+func (c *Client) PutActivation(ctx context.Context, theJWT string) error {
+	resp, err := c.do(ctx, http.MethodPost, "/jwt/v1/activations", theJWT, c.postHeader())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Pack returns up to max account JWTs by public key, a negative max returns all the server allows
+func (c *Client) Pack(ctx context.Context, max int) (map[string]string, error) {
+	path := "/jwt/v1/pack"
+	if max >= 0 {
+		path = fmt.Sprintf("%s?max=%d", path, max)
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	pack, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	jwts := map[string]string{}
+	for _, line := range strings.Split(pack, "\n") {
+		if split := strings.SplitN(line, "|", 2); len(split) == 2 {
+			jwts[split[0]] = split[1]
+		}
+	}
+	return jwts, nil
+}
+
+// Health is the state reported by /healthz and /readyz
+type Health struct {
+	Live   bool   // the server answers
+	Ready  bool   // the server is synced and not draining
+	Reason string // why the server isn't ready
+}
+
+// Health checks the server once, without retries, a server that doesn't answer is not live
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	h := &Health{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/healthz", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return h, nil
+	}
+	resp.Body.Close()
+	h.Live = resp.StatusCode == http.StatusOK
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/readyz", nil); err != nil {
+		return nil, err
+	}
+	if resp, err = c.http.Do(req); err != nil {
+		return h, nil
+	}
+	defer resp.Body.Close()
+	var ready struct {
+		Ready  bool   `json:"ready"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+		return nil, err
+	}
+	h.Ready, h.Reason = ready.Ready, ready.Reason
+	return h, nil
+}
+
+// Update is an account JWT announced by an account server
+type Update struct {
+	Account string
+	JWT     string
+	Server  string // name of the announcing server, if the nats-server supports headers
+}
+
+// WatchUpdates calls fn for every account update published on subject, LegacyUpdates or NativeUpdates
+// depending on the server configuration. Updated accounts are dropped from the cache.
+func (c *Client) WatchUpdates(nc *nats.Conn, subject string, fn func(Update)) (*nats.Subscription, error) {
+	prefix, suffix, ok := strings.Cut(subject, "*")
+	if !ok {
+		return nil, fmt.Errorf("subject %q has no wildcard for the account", subject)
+	}
+	return nc.Subscribe(subject, func(m *nats.Msg) {
+		account := strings.TrimSuffix(strings.TrimPrefix(m.Subject, prefix), suffix)
+		c.forget(account)
+		u := Update{Account: account, JWT: string(m.Data)}
+		if m.Header != nil {
+			u.Server = m.Header.Get(serverNameHeader)
+		}
+		fn(u)
+	})
+}
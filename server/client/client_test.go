@@ -0,0 +1,162 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/testsupport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	ts, err := testsupport.Start(nil, true)
+	require.NoError(t, err)
+	defer ts.Cleanup()
+	ctx := context.Background()
+	c := New(ts.Server.URL(), WithHTTPClient(ts.HTTP))
+
+	health, err := c.Health(ctx)
+	require.NoError(t, err)
+	require.True(t, health.Live)
+	require.True(t, health.Ready)
+
+	acct, acctJWT, err := ts.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := acct.PublicKey()
+	require.NoError(t, err)
+
+	_, err = c.GetAccount(ctx, pubKey)
+	require.True(t, errors.Is(err, ErrNotFound), err)
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, http.StatusNotFound, e.StatusCode)
+
+	updates := make(chan Update, 1)
+	sub, err := c.WatchUpdates(ts.NC, LegacyUpdates, func(u Update) { updates <- u })
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, ts.NC.Flush())
+
+	result, err := c.PutAccount(ctx, pubKey, acctJWT)
+	require.NoError(t, err)
+	require.False(t, result.Held)
+	select {
+	case u := <-updates:
+		require.Equal(t, pubKey, u.Account)
+		require.Equal(t, acctJWT, u.JWT)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update")
+	}
+
+	theJWT, err := c.GetAccount(ctx, pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, theJWT)
+	claim, err := jwt.DecodeAccountClaims(acctJWT)
+	require.NoError(t, err)
+	require.Equal(t, `"`+claim.ID+`"`, c.cache[pubKey].etag)
+	// served from the cache on a 304
+	theJWT, err = c.GetAccount(ctx, pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, theJWT)
+
+	pack, err := c.Pack(ctx, -1)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, pack[pubKey])
+
+	_, err = c.PutAccount(ctx, pubKey, "not a jwt")
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, http.StatusBadRequest, e.StatusCode)
+}
+
+func TestClientPutActivation(t *testing.T) {
+	posted := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "the.jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		posted <- r
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithToken("secret"))
+	require.NoError(t, c.PutActivation(context.Background(), "the.jwt"))
+	r := <-posted
+	require.Equal(t, http.MethodPost, r.Method)
+	require.Equal(t, "/jwt/v1/activations", r.URL.Path)
+	require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+	err := c.PutActivation(context.Background(), "other.jwt")
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, http.StatusBadRequest, e.StatusCode)
+}
+
+func TestClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("the.jwt"))
+	}))
+	defer server.Close()
+
+	// the certificate of the test server isn't trusted by default
+	_, err := New(server.URL, WithRetries(0, 0)).GetActivation(context.Background(), "HASH")
+	require.Error(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	c := New(server.URL, WithTLSConfig(&tls.Config{RootCAs: roots}))
+	theJWT, err := c.GetActivation(context.Background(), "HASH")
+	require.NoError(t, err)
+	require.Equal(t, "the.jwt", theJWT)
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls int32
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("the.jwt"))
+	}))
+	defer busy.Close()
+
+	c := New(busy.URL, WithRetries(2, 10*time.Millisecond))
+	theJWT, err := c.GetActivation(context.Background(), "HASH")
+	require.NoError(t, err)
+	require.Equal(t, "the.jwt", theJWT)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, -10)
+	_, err = c.GetActivation(context.Background(), "HASH")
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, http.StatusServiceUnavailable, e.StatusCode)
+	require.Equal(t, int32(-7), atomic.LoadInt32(&calls))
+}
@@ -28,6 +28,12 @@ type LogConfig struct {
 	Colors bool
 	PID    bool
 	Custom natsserver.Logger
+
+	// ObfuscateKeys hides the nkeys in log lines, hash replaces all but a short prefix with a stable hash,
+	// redact drops all but the prefix, keys are logged as is if empty
+	ObfuscateKeys string
+	// KeyObfuscator is used instead of ObfuscateKeys when embedding, it is called with every key in a log line
+	KeyObfuscator func(key string) string
 }
 
 // AccountServerConfig is the root structure for an account server configuration file.
@@ -37,15 +43,145 @@ type AccountServerConfig struct {
 	HTTP    HTTPConfig
 	Store   StoreConfig
 
+	Notifications NotificationConfig
+	Subjects      SubjectConfig
+	Admin         AdminConfig
+	Mirror        MirrorConfig
+	Canary        CanaryConfig
+	Approval      ApprovalConfig
+	Metrics       MetricsConfig
+	Tracing       TracingConfig
+	NATSUpdates   NATSUpdateConfig
+	Consistency   ConsistencyConfig
+	Privacy       PrivacyConfig
+	Provisioning  ProvisioningConfig
+	Revoked       RevokedAccountsConfig
+	Expiration    ExpirationConfig
+	SoftLimits    SoftLimitConfig
+	Cache         ReadThroughConfig
+	Policy        AccountPolicyConfig
+	AccessStats   AccessStatsConfig `conf:"access_stats"`
+	Users         UserStoreConfig
+	Tenants       []TenantConfig // more stores, each with its own operator, served under /jwt/v1/<name>/
+
+	NotificationQueue NotificationQueueConfig `conf:"notification_queue"`
+	NotificationRetry NotificationRetryConfig `conf:"notification_retry"`
+
 	OperatorJWTPath      string
+	OperatorJWTPaths     []string // more operators, account JWTs signed by any of them are accepted
 	SystemAccountJWTPath string
-	SignRequestSubject   string
-	SignRequestTimeout   int //milliseconds
+	// SystemAccountWatchInterval is the milliseconds between checks of SystemAccountJWTPath for a new
+	// system account JWT, 0 doesn't check
+	SystemAccountWatchInterval int
+	Strict                     bool     // refuse to start without an operator JWT, unless AllowUnverified is set
+	AllowUnverified            bool     `conf:"allow_unverified"` // accept running without an operator JWT in strict mode
+	SeedSystemAccount          bool     // save the system account JWT into the store on startup
+	SeedAccountJWTPaths        []string // other account JWTs saved into the store on startup
+	SignRequestSubject         string
+	// ActivationHashVersions are the activation hash versions activations are stored and looked up
+	// under, the first one is current, list two during a migration
+	ActivationHashVersions []int
+	// VerifyActivations rejects posted activations with a 422 unless the exporting and importing accounts
+	// are stored and the exporter exports the subject, by default activations aren't checked
+	VerifyActivations    bool
+	SignRequestTimeout   int      //milliseconds
+	SignConcurrency      int      // maximum concurrent signing requests, 0 is unlimited
+	SignQueueDepth       int      // signing requests allowed to wait for a free slot
+	SignQueueTimeout     int      //milliseconds a signing request waits for a free slot
+	SignFallbackSubjects []string // tried in order when the signing service on SignRequestSubject fails
+	SignRetries          int      // retries of a failed signing request on each subject
+	SignRetryBackoff     int      //milliseconds before the first retry, doubled for each one after
+	SignBreakerFailures  int      // consecutive failures after which a subject is skipped, 0 never skips it
+	SignBreakerCooldown  int      //milliseconds a skipped subject waits before it is tried again
+	// SigningKey is a file holding an operator signing key seed, readable only by its owner, or a key in a
+	// key management service, vault://[mount/]key or awskms://<key id>. Self-signed account JWTs are signed
+	// by the server with it instead of a signing service on SignRequestSubject.
+	SigningKey string
+
+	// Optional identity reported in update responses, notification headers and heartbeats
+	ServerName        string
+	ServerID          string
+	ClusterName       string
+	HeartbeatInterval int    //milliseconds, 0 disables heartbeats
+	SequenceFile      string // optional durable sequence for update responses, can be shared by a cluster
+	SequenceStore     bool   // keep the sequence in the store instead, shared by the servers sharing the store
+
+	Lint []LintRule // custom rules evaluated against pushed account JWTs
+
+	TraceMerges bool // log and keep the per account decisions made when merging packs
+
+	JTIIndex bool `conf:"jti_index"` // index account JWTs by JTI, so they can be fetched on /jwt/v1/jti/<jti>
+	TagIndex bool `conf:"tag_index"` // index account JWTs by tag, otherwise /jwt/v1/accounts?tag= reads the whole store
+
+	// RejectStale refuses account JWT posts issued before the stored JWT, like the directory store does
+	// when merging, unless the post sets force=true to roll the account back
+	RejectStale bool `conf:"reject_stale"`
+
+	// ETags are computed from the JTI of the stored JWT, or with hash from its SHA-256, so the ETag changes
+	// whenever the stored JWT does, even if two JWTs share a JTI
+	ETags string `conf:"etags"`
+
+	Lookup []string // ordered sources for account lookups: store, nats, primary or none
+
+	// SyncInterval is the milliseconds between pack requests to the other account servers, 0 uses the
+	// NATS ReconnectWait. Up to SyncJitter milliseconds are added at random to every interval, so servers
+	// started together don't all sync at once.
+	SyncInterval int
+	SyncJitter   int
+	// SyncDivergence is the milliseconds the store may keep differing from the other account servers
+	// before a warning is logged and reported on /statusz, 0 is five minutes, negative never warns
+	SyncDivergence int
+
+	AcceptOverrides bool   // apply operator signed setting overrides sent on $SYS.REQ.ACCOUNT_SERVER.CONFIG
+	OverridesFile   string // where the last applied override is kept, so it can't be replayed after a restart
 
 	// Below options are only to copy jwt from an old account server for initialization
-	Primary            string
-	ReplicationTimeout int //milliseconds
-	MaxReplicationPack int // maximum number of JWTS to grab on startup
+	Primary                  string
+	Primaries                []string // more primaries, tried in order after Primary until one answers
+	ResolvePrimaries         bool     // try every address the host name of a primary resolves to, in order
+	ReplicationTimeout       int      //milliseconds, per attempt with each primary
+	ReplicationRetryDeadline int      //milliseconds, how long to keep retrying a busy or unavailable primary, 0 disables retries
+	ReplicationRetryInterval int      //milliseconds, after the deadline keep retrying on this interval until a primary answers, 0 gives up
+	MaxReplicationPack       int      // maximum number of JWTS to grab on startup
+}
+
+// SoftLimitConfig lets pushes that violate a limit or policy through until a deadline, they are flagged
+// in response headers, logs and metrics instead, so the impact can be found before enforcing
+type SoftLimitConfig struct {
+	Until    string   // RFC 3339 time at which enforcement starts, everything is enforced if empty
+	Features []string // lint and/or write_rate, all of them if empty
+}
+
+// AccountPolicyConfig limits what a pushed account JWT may grant, whoever signed it. Limits of 0 are
+// not checked, a JWT without a limit, i.e. -1, exceeds any configured one.
+type AccountPolicyConfig struct {
+	MaxConnections   int64    `conf:"max_connections"`
+	MaxLeafNodes     int64    `conf:"max_leafnodes"`
+	MaxSubscriptions int64    `conf:"max_subscriptions"`
+	MaxPayload       int64    `conf:"max_payload"`
+	MaxData          int64    `conf:"max_data"`
+	MaxImports       int64    `conf:"max_imports"`
+	MaxExports       int64    `conf:"max_exports"`
+	ExportTypes      []string `conf:"export_types"` // stream and/or service, every type is allowed if empty
+	DenyJetStream    bool     `conf:"deny_jetstream"`
+	DenyBearer       bool     `conf:"deny_bearer"` // require accounts to disallow bearer user JWTs
+}
+
+// ReadThroughConfig turns the server into an edge cache, account JWTs missing from the store are fetched
+// from the upstream sources of the lookup chain and kept in the store
+type ReadThroughConfig struct {
+	TTL        int //milliseconds, how long a fetched JWT is served without asking the upstream, 0 disables cache mode
+	MaxEntries int `conf:"max_entries"` // fetched JWTs kept in the store, the least recently used are deleted, 0 is unlimited
+}
+
+// LintRule is a custom check evaluated against the decoded claims of an account JWT on POST
+type LintRule struct {
+	Name     string
+	Field    string // dotted path into the claims, i.e. name, nats.exports.subject or nats.limits.mem_storage
+	Op       string // one of match, not_match, deny, max or min
+	Value    string // the regular expression, denied value or numeric limit used by the operation
+	Severity string // warn or reject, defaults to reject
+	Message  string // optional description returned when the rule is hit
 }
 
 // TLSConf holds the configuration for a TLS connection/server
@@ -53,6 +189,10 @@ type TLSConf struct {
 	Key  string
 	Cert string
 	Root string
+
+	// Client certificates, only used by the HTTP listener
+	ClientCA          string `conf:"client_ca"`           // CA file client certificates are verified with, they are optional unless required
+	RequireClientCert bool   `conf:"require_client_cert"` // refuse connections without a client certificate issued by ClientCA
 }
 
 // HTTPConfig is used to specify the host/port/tls for an HTTP server
@@ -62,6 +202,47 @@ type HTTPConfig struct {
 	TLS          TLSConf
 	ReadTimeout  int //milliseconds
 	WriteTimeout int //milliseconds
+
+	// Socket is the path of a unix socket to listen on instead of the host and port, a socket file left
+	// behind by a previous run is replaced. SocketMode is its octal file mode, the umask applies if empty.
+	Socket     string
+	SocketMode string `conf:"socket_mode"`
+	// Systemd listens on the socket passed by systemd socket activation instead of the host and port
+	Systemd bool
+
+	// Listener socket options
+	ReusePort bool // set SO_REUSEPORT so several processes can share the port
+	KeepAlive int  // milliseconds between TCP keepalive probes, 0 uses the go default, negative disables
+	Backlog   int  // length of the accept queue, 0 uses the system default
+
+	WriteRate int // account JWT posts accepted per second across all accounts, 0 is unlimited
+	// MaxBodySize is the most bytes read from the body of a posted JWT or proof, larger posts are
+	// rejected with 413, 0 is 256KB
+	MaxBodySize int `conf:"max_body_size"`
+
+	// TrustedProxies are the addresses or CIDR ranges of load balancers whose X-Forwarded-For and
+	// X-Real-IP headers are believed, the client address from them replaces the address of the proxy
+	TrustedProxies []string `conf:"trusted_proxies"`
+
+	// Middlewares are the names of the built in request_id and access_log middlewares, or of middlewares
+	// registered by an embedder, wrapped around every route in order, the first one sees requests first
+	Middlewares []string
+
+	Auth WriteAuthConfig // authorization required to post JWTs, writes are open if nothing is set
+}
+
+// WriteAuthConfig lists the credentials accepted in the Authorization header of requests that change the store
+type WriteAuthConfig struct {
+	Tokens []string // static bearer tokens
+	Signed bool     // accept an authorization JWT for the account, signed by the operator or the account
+	MaxAge int      //milliseconds, how long after it was issued a signed authorization is accepted, 0 is five minutes
+	// ClientCerts are the common names or DNS/email SANs of verified client certificates allowed to write
+	ClientCerts []string `conf:"client_certs"`
+}
+
+// Enabled returns true if any authorization is required to post JWTs
+func (c WriteAuthConfig) Enabled() bool {
+	return len(c.Tokens) > 0 || c.Signed || len(c.ClientCerts) > 0
 }
 
 // NATSConfig configuration for a NATS connection
@@ -74,6 +255,182 @@ type NATSConfig struct {
 
 	TLS             TLSConf
 	UserCredentials string
+
+	// one of UserCredentials, Nkey, NkeySeedFile, User with Password or Token authenticates the connection
+	Nkey         string // seed of the nkey user, for secrets handed over in the configuration
+	NkeySeedFile string // file holding the seed of the nkey user
+	User         string
+	Password     string
+	Token        string
+
+	PackResponder PackResponderConfig `conf:"pack_responder"`
+}
+
+// PackResponderConfig guards the responses to pack requests on $SYS.REQ.CLAIMS.PACK, 0 is unlimited
+type PackResponderConfig struct {
+	RequestsPerMinute int `conf:"requests_per_minute"` // of all requesters together, further requests are dropped
+	MaxBytes          int `conf:"max_bytes"`           // of one response, the rest of it is skipped
+	MaxChunks         int `conf:"max_chunks"`          // messages of one response, the rest of it is skipped
+	Timeout           int //milliseconds, time spent on one response, the rest of it is skipped
+}
+
+// NotificationConfig selects the subject schemes account notifications are published on,
+// enabling both allows resolvers on either scheme to stay in sync during a migration
+type NotificationConfig struct {
+	Legacy bool // $SYS.ACCOUNT.<pubkey>.CLAIMS.UPDATE, used by the nats-server URL resolver
+	Native bool // $SYS.REQ.ACCOUNT.<pubkey>.CLAIMS.UPDATE, used by the nats-server full/cache resolvers
+
+	ActivationTarget bool // also publish activations on $SYS.ACCOUNT.<issuer>.CLAIMS.ACTIVATE_TARGET.<target>.<hash>
+}
+
+// SubjectConfig overrides the subjects of account and activation notifications and of lookup and pack
+// requests, for a system account whose subject space is mapped. Each * token is filled in, with the
+// account, issuer or hash, when publishing and matched when subscribing. Empty keeps the default.
+type SubjectConfig struct {
+	AccountUpdate    string `conf:"account_update"`    // one * for the account, $SYS.ACCOUNT.*.CLAIMS.UPDATE by default
+	ActivationUpdate string `conf:"activation_update"` // one * for the issuer then one for the hash, $SYS.ACCOUNT.*.CLAIMS.ACTIVATE.* by default
+	AccountLookup    string `conf:"account_lookup"`    // one * for the account, $SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP by default
+	Pack             string // without wildcards, $SYS.REQ.CLAIMS.PACK by default
+	UserUpdate       string `conf:"user_update"`       // one * for the account then one for the user, $SYS.ACCOUNT.*.USER.*.UPDATE by default
+	ActivationDelete string `conf:"activation_delete"` // one * for the issuer then one for the hash, $SYS.ACCOUNT.*.CLAIMS.DEACTIVATE.* by default
+}
+
+// AdminConfig enables the administrative API under /admin/v1
+type AdminConfig struct {
+	Enabled     bool
+	Token       string // bearer token required on admin requests, the admin API isn't served without it
+	SnapshotDir string // where snapshots are persisted, if empty snapshots only live in memory
+
+	// RevocationWindow is the longest lifetime of user JWTs, revocations older than this only cover
+	// expired users and are suggested for compaction, 0 only compacts entries covered by the wildcard
+	RevocationWindow int //milliseconds
+}
+
+// MirrorConfig forwards a sample of accepted account JWT posts to another account server
+type MirrorConfig struct {
+	URL     string // base URL of the server receiving the copies, mirroring is off if empty
+	Percent int    // percentage of posts to forward
+	Timeout int    //milliseconds
+}
+
+// ProvisioningConfig enables the SCIM style API under /provisioning/v1, used by identity management
+// systems to create, update and delete accounts through the signing service
+type ProvisioningConfig struct {
+	Enabled bool
+	Token   string // bearer token required on provisioning requests, the server doesn't start without it
+	Index   string // file mapping external ids to account public keys, if empty the mapping only lives in memory
+}
+
+// RevokedAccountsConfig lists accounts that are no longer served, even though their JWT is stored
+type RevokedAccountsConfig struct {
+	Accounts []string // account public keys revoked by the configuration
+	File     string   // where accounts revoked on the admin API are persisted, if empty they only live in memory
+}
+
+// ExpirationConfig hides expired account JWTs from GET and NATS lookups, as if check=true was passed
+type ExpirationConfig struct {
+	Enforce bool // expired accounts are answered with 404 and lookups for them go unanswered, check=false opts out
+	Grace   int  //milliseconds an account is still handed out after it expired, also applies to check=true
+}
+
+// UserStoreConfig keeps the user JWTs posted to /jwt/v1/users, the nats-servers don't need them but it
+// gives one place to audit the users issued
+type UserStoreConfig struct {
+	Dir   string // where user JWTs are stored, the users API is off if empty
+	Shard bool   // spread the files over subdirectories, for many users
+}
+
+// TenantConfig is a store served next to the main one, so one server can hold the accounts of several
+// operators. Its API is the account API under /jwt/v1/<name>/ and its notifications are published with
+// the subject prefix in front of the usual subjects.
+type TenantConfig struct {
+	Name            string // the path segment of the tenant, letters, digits, - and _
+	OperatorJWTPath string // required, posts to the tenant must be signed by this operator
+	Store           StoreConfig
+	SubjectPrefix   string `conf:"subject_prefix"` // tokens put before the notification subjects, the name if empty
+}
+
+// AccessStatsConfig controls the lookup counts kept for every account JWT served, which tell the accounts
+// nothing fetches anymore
+type AccessStatsConfig struct {
+	File         string // where the counts are saved, if empty they start over when the server restarts
+	SaveInterval int    `conf:"save_interval"` //milliseconds between saves to the file
+}
+
+// NotificationQueueConfig keeps the account and activation notifications that can't be published while
+// NATS is down, and publishes them in order once it is connected again
+type NotificationQueueConfig struct {
+	File       string // where the queue is kept, across restarts, the queue is off if empty
+	MaxEntries int    `conf:"max_entries"` // notifications kept, the oldest is dropped once it is full
+}
+
+// NotificationRetryConfig publishes the notifications that failed again in the background, the request
+// that stored the JWT succeeds with a warning that the notification is pending. It isn't used with a
+// notification queue, which keeps failed notifications instead.
+type NotificationRetryConfig struct {
+	Attempts   int // retries of a notification before it is dropped, retrying is off if 0
+	Backoff    int //milliseconds before the first retry, doubled for each one after
+	MaxBackoff int `conf:"max_backoff"` //milliseconds between two retries at most
+}
+
+// CanaryConfig sends account JWTs to a canary nats-server, and validates them there, before they are
+// stored and announced to all resolvers
+type CanaryConfig struct {
+	Servers         []string // URLs of the canary nats-server, the canary is off if empty
+	UserCredentials string   // credentials of a system account user on the canary
+	Timeout         int      //milliseconds, for the update request and for the validation command
+	Validate        string   // optional command run once the canary accepted the JWT, it has to exit with 0
+	File            string   // where held JWTs are persisted, if empty they only live in memory
+}
+
+// ApprovalConfig holds posted account JWTs that are not signed by the operator until a second party approves them
+type ApprovalConfig struct {
+	Required bool
+	Tags     []string // if set, only accounts with one of these tags are held
+	File     string   // where pending JWTs are persisted, if empty they only live in memory
+}
+
+// NATSUpdateConfig controls the account and activation updates accepted over NATS
+type NATSUpdateConfig struct {
+	Ignore         bool     // only accept updates over HTTP
+	AllowedIssuers []string // if set, account JWTs received over NATS must be issued by one of these keys
+	Uploads        bool     // answer uploads on $SYS.REQ.ACCOUNT.*.CLAIMS.UPDATE with the checks of a POST
+	// Resolver answers $SYS.REQ.CLAIMS.UPDATE, DELETE and LIST like a nats-server full resolver, updates
+	// get the checks of a POST
+	Resolver bool
+}
+
+// ConsistencyConfig periodically compares the store with the nats-server full resolvers
+type ConsistencyConfig struct {
+	Interval int //milliseconds, 0 disables the check
+	Timeout  int //milliseconds to wait for the resolvers to answer
+}
+
+// PrivacyConfig hides account claim fields from decode output and logs, unless the admin token is presented
+type PrivacyConfig struct {
+	Fields  []string // dotted paths into the claims, i.e. name or nats.tags
+	KeyFile string   // optional file with a 32 byte hex key, hidden fields are sealed with it instead of redacted
+}
+
+// MetricsConfig pushes the metrics to systems that can't scrape the metrics endpoint
+type MetricsConfig struct {
+	PushGateway string // base URL of a prometheus push-gateway
+	Job         string // push-gateway job name, defaults to nats-account-server
+	StatsD      string // host:port of a StatsD or DogStatsD agent
+	DogStatsD   bool   // send labels as DogStatsD tags
+	Interval    int    //milliseconds
+	Prefix      string // prefix for pushed metric names, defaults to nats_account_server_
+}
+
+// TracingConfig sends OpenTelemetry spans of HTTP requests, store operations, signing and NATS messages to
+// a collector, in the OTLP/HTTP JSON encoding
+type TracingConfig struct {
+	Endpoint    string   // OTLP/HTTP traces URL, like http://localhost:4318/v1/traces, tracing is off if empty
+	Headers     []string // "name: value" headers sent with every export, like the API key of a hosted collector
+	ServiceName string   `conf:"service_name"` // service.name of the spans, defaults to nats-account-server
+	Sample      int      // percent of new traces recorded, traces continued from a sampled traceparent always are
+	Interval    int      //milliseconds between exports
+	MaxQueue    int      `conf:"max_queue"` // spans waiting for the next export, more are dropped
 }
 
 // StoreConfig is a catch-all for the store options, the store created
@@ -84,12 +441,67 @@ type NATSConfig struct {
 type StoreConfig struct {
 	Dir             string // the path to a folder for mutable storage
 	Shard           bool   // optional setting to shard the directory store, avoiding too many files in one folder
-	CleanupInterval int    // interval at which expiration is checked
+	CleanupInterval int    `conf:"cleanup_interval"` //milliseconds, interval at which expiration is checked, 0 is one minute
+	MaxJWTs         int    `conf:"max_jwts"`         // maximum number of JWTs in the store, 0 is unlimited
+	EvictionPolicy  string `conf:"eviction_policy"`  // lru or reject, what happens to a new JWT once MaxJWTs is reached
+	CacheSize       int    `conf:"cache_size"`       // number of account JWTs kept in the read cache, 0 disables it
+
+	DualWrite DualWriteConfig // optional second store written alongside this one, used for migrations
+
+	Type     string // dir, none or a registered backend such as postgres, mysql, s3, etcd or kv
+	CacheTTL int    `conf:"cache_ttl"` //milliseconds, how long a store of type none caches looked up JWTs, 0 is one minute
+	DSN      string // data source name passed to the database driver of a sql backend
+	Table    string // table used by a sql backend, defaults to account_jwts
+
+	// Object storage options, used by the s3 backend
+	Bucket    string
+	Prefix    string // prepended to the object names, i.e. jwts/
+	Endpoint  string // base URL of an S3 compatible service, defaults to AWS
+	Region    string // defaults to us-east-1
+	AccessKey string `conf:"access_key"` // defaults to $AWS_ACCESS_KEY_ID
+	SecretKey string `conf:"secret_key"` // defaults to $AWS_SECRET_ACCESS_KEY
+	PathStyle bool   `conf:"path_style"` // put the bucket in the path instead of the host name, as MinIO expects
+	Timeout   int    //milliseconds, for each request to the object store, etcd or JetStream, 0 is ten seconds
+
+	// etcd options, used by the etcd backend, Prefix defaults to /nats-account-server/accounts/
+	Endpoints []string // client URLs of the etcd cluster, i.e. http://etcd-1:2379
+	Username  string   // optional, with Password the store authenticates for a token
+	Password  string
+
+	// JetStream options, used by the kv backend, Endpoints are the NATS URLs, Bucket defaults to account_jwts
+	// and Username, Password and Timeout apply as well
+	Credentials string // optional NATS user credentials file
+	Replicas    int    // copies of the bucket the JetStream cluster keeps, 0 is one
 
 	NSC      string // removed support for this, keep so that we can warn when used
 	ReadOnly bool   // removed support for this, keep so that we can warn when used
 }
 
+// Store types
+const (
+	StoreDir  = "dir"  // JWTs are kept in a directory
+	StoreNone = "none" // JWTs are only cached in memory, lookups and updates go through NATS
+)
+
+// What ETags are computed from
+const (
+	ETagJTI  = "jti"  // the JTI of the stored JWT
+	ETagHash = "hash" // the SHA-256 of the stored JWT
+)
+
+// Eviction policies for a store with MaxJWTs set
+const (
+	EvictLRU    = "lru"    // remove the least recently used JWT to make room
+	EvictReject = "reject" // refuse to store new accounts
+)
+
+// DualWriteConfig describes the secondary store written to in dual-write mode
+type DualWriteConfig struct {
+	Type  string // dir or a registered backend, which takes its options from the store, the directory store ignores them
+	Dir   string // the path to a folder for the secondary directory store
+	Shard bool   // shard the secondary directory store
+}
+
 // DefaultServerConfig generates a default configuration with
 // logging set to colors, time, debug and trace
 func DefaultServerConfig() *AccountServerConfig {
@@ -114,9 +526,51 @@ func DefaultServerConfig() *AccountServerConfig {
 		Store: StoreConfig{
 			Dir:             ".",
 			CleanupInterval: 0,
+			EvictionPolicy:  EvictLRU,
 		}, // in memory store
-		ReplicationTimeout: 5000,
-		MaxReplicationPack: 10000,
-		SignRequestTimeout: 1000,
+		Notifications: NotificationConfig{
+			Legacy: true,
+		},
+		Metrics: MetricsConfig{
+			Interval: 10000,
+		},
+		Tracing: TracingConfig{
+			Sample:   100,
+			Interval: 5000,
+			MaxQueue: 2048,
+		},
+		Consistency: ConsistencyConfig{
+			Timeout: 2000,
+		},
+		AccessStats: AccessStatsConfig{
+			SaveInterval: 60000,
+		},
+		NotificationQueue: NotificationQueueConfig{
+			MaxEntries: 10000,
+		},
+		NotificationRetry: NotificationRetryConfig{
+			Backoff:    500,
+			MaxBackoff: 30000,
+		},
+		Mirror: MirrorConfig{
+			Percent: 100,
+			Timeout: 5000,
+		},
+		Canary: CanaryConfig{
+			Timeout: 5000,
+		},
+		RejectStale:              true,
+		ETags:                    ETagJTI,
+		SyncInterval:             1000,
+		ReplicationTimeout:       5000,
+		ReplicationRetryDeadline: 60000,
+		MaxReplicationPack:       10000,
+		SignRequestTimeout:       1000,
+		SignConcurrency:          10,
+		SignQueueDepth:           100,
+		SignQueueTimeout:         5000,
+		SignRetryBackoff:         100,
+		SignBreakerFailures:      5,
+		SignBreakerCooldown:      30000,
 	}
 }
@@ -152,12 +152,12 @@ func get(data map[string]interface{}, key string, confTag string) interface{} {
 		return nil
 	}
 
+	// the tag takes precedence, the field name still works for tags added to existing fields
 	if confTag != "" {
 		val, ok := data[confTag]
 		if ok {
 			return val
 		}
-		return nil
 	}
 
 	val, ok := data[key]
@@ -705,3 +705,17 @@ func TestEmptyGet(t *testing.T) {
 	val = get(map[string]interface{}{}, "", "")
 	require.Nil(t, val)
 }
+
+func TestTagFallsBackToFieldName(t *testing.T) {
+	configString := `
+	  name: "stephen"
+	  optout: true
+	  `
+
+	config := SimpleWTags{}
+
+	err := LoadConfigFromString(configString, &config, false)
+	require.NoError(t, err)
+	require.Equal(t, "stephen", config.Name)
+	require.Equal(t, true, config.OptOut)
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package conf
+
+import (
+	_ "embed"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// the comments of the configuration structs are the documentation of the options
+//
+//go:embed conf.go
+var confSource string
+
+// redacted replaces secrets in Redacted
+const redacted = "[REDACTED]"
+
+// RedactURL hides the user and password a URL may embed, a URL that can't be parsed is hidden entirely
+func RedactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	if u.User == nil {
+		return s
+	}
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//"+redacted+"@", 1)
+}
+
+// RedactURLs returns a copy of urls with the credentials hidden
+func RedactURLs(urls []string) []string {
+	if urls == nil {
+		return nil
+	}
+	r := make([]string, len(urls))
+	for i, u := range urls {
+		r[i] = RedactURL(u)
+	}
+	return r
+}
+
+// Redacted returns a copy of the configuration without tokens, passwords, keys, data source names and
+// the credentials of URLs
+func (c *AccountServerConfig) Redacted() *AccountServerConfig {
+	r := *c
+	hide := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	if len(c.HTTP.Auth.Tokens) > 0 {
+		r.HTTP.Auth.Tokens = []string{redacted}
+	}
+	if len(c.Tracing.Headers) > 0 {
+		r.Tracing.Headers = []string{redacted}
+	}
+	hide(&r.Admin.Token)
+	hide(&r.Provisioning.Token)
+	hide(&r.Store.DSN)
+	hide(&r.Store.AccessKey)
+	hide(&r.Store.SecretKey)
+	hide(&r.Store.Password)
+	hide(&r.NATS.Nkey)
+	hide(&r.NATS.Password)
+	hide(&r.NATS.Token)
+	r.Primary = RedactURL(c.Primary)
+	r.Primaries = RedactURLs(c.Primaries)
+	r.NATS.Servers = RedactURLs(c.NATS.Servers)
+	return &r
+}
+
+// optionKey returns the name of an option in a configuration file
+func optionKey(f reflect.StructField) string {
+	if tag := f.Tag.Get("conf"); tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// settable reports whether a configuration file can set the field, functions and interfaces can only
+// be set when embedding
+func settable(f reflect.StructField) bool {
+	if f.PkgPath != "" {
+		return false
+	}
+	switch f.Type.Kind() {
+	case reflect.Func, reflect.Interface, reflect.Chan, reflect.Ptr:
+		return false
+	}
+	return true
+}
+
+// Options returns the configuration keyed by option names, as they are written in a configuration file
+func Options(config interface{}) map[string]interface{} {
+	return optionMap(reflect.Indirect(reflect.ValueOf(config)))
+}
+
+func optionMap(v reflect.Value) map[string]interface{} {
+	m := map[string]interface{}{}
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); settable(f) {
+			m[optionKey(f)] = optionValue(v.Field(i))
+		}
+	}
+	return m
+}
+
+func optionValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Struct:
+		return optionMap(v)
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			list = append(list, optionValue(v.Index(i)))
+		}
+		return list
+	default:
+		return v.Interface()
+	}
+}
+
+// structDocs maps the configuration struct names to their declarations in conf.go
+func structDocs() (map[string]*ast.TypeSpec, map[string]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "conf.go", confSource, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+	specs := map[string]*ast.TypeSpec{}
+	docs := map[string]string{}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			specs[ts.Name.Name] = ts
+			docs[ts.Name.Name] = gen.Doc.Text()
+		}
+	}
+	return specs, docs, nil
+}
+
+// fieldDoc returns the comments of a field, above it and at the end of its line
+func fieldDoc(spec *ast.TypeSpec, name string) string {
+	if spec == nil {
+		return ""
+	}
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		return ""
+	}
+	for _, f := range st.Fields.List {
+		for _, n := range f.Names {
+			if n.Name == name {
+				return strings.TrimSpace(f.Doc.Text() + " " + f.Comment.Text())
+			}
+		}
+	}
+	return ""
+}
+
+// WriteDefaults writes the default configuration as a configuration file, every option is listed with
+// its default value and its description
+func WriteDefaults(w io.Writer) error {
+	specs, docs, err := structDocs()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "# nats-account-server configuration, every option with its default value")
+	writeOptions(w, reflect.ValueOf(DefaultServerConfig()).Elem(), specs, docs, "")
+	return nil
+}
+
+func writeOptions(w io.Writer, v reflect.Value, specs map[string]*ast.TypeSpec, docs map[string]string, indent string) {
+	spec := specs[v.Type().Name()]
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !settable(f) {
+			continue
+		}
+		doc := fieldDoc(spec, f.Name)
+		if f.Type.Kind() == reflect.Struct {
+			doc = strings.TrimSpace(docs[f.Type.Name()] + " " + doc)
+		}
+		if doc != "" {
+			fmt.Fprintln(w)
+			writeComment(w, doc, indent)
+		}
+		key := optionKey(f)
+		field := v.Field(i)
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			fmt.Fprintf(w, "%s%s: {\n", indent, key)
+			writeOptions(w, field, specs, docs, indent+"  ")
+			fmt.Fprintf(w, "%s}\n", indent)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+			elem := f.Type.Elem()
+			var names []string
+			for j := 0; j < elem.NumField(); j++ {
+				if ef := elem.Field(j); settable(ef) {
+					names = append(names, optionKey(ef))
+				}
+			}
+			writeComment(w, "each element has the options "+strings.Join(names, ", "), indent)
+			fmt.Fprintf(w, "%s%s: %s\n", indent, key, formatOption(optionValue(field)))
+		default:
+			fmt.Fprintf(w, "%s%s: %s\n", indent, key, formatOption(optionValue(field)))
+		}
+	}
+}
+
+func writeComment(w io.Writer, doc string, indent string) {
+	for _, line := range strings.Split(doc, "\n") {
+		if line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "//")); line != "" {
+			fmt.Fprintf(w, "%s# %s\n", indent, line)
+		}
+	}
+}
+
+func formatOption(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, formatOption(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+)
+
+// ways an account JWT is served
+const (
+	accessHTTP = "http"
+	accessNATS = "nats"
+)
+
+// accountAccess counts how often an account JWT was served
+type accountAccess struct {
+	Lookups    int64     `json:"lookups"`
+	HTTP       int64     `json:"http"`
+	NATS       int64     `json:"nats"`
+	LastServed time.Time `json:"last_served"`
+}
+
+// accessFile is the content of the statistics file
+type accessFile struct {
+	Since    time.Time                 `json:"since"`
+	Accounts map[string]*accountAccess `json:"accounts"`
+}
+
+// accessStats keeps the lookups of every account JWT served, to find the accounts nothing fetches.
+// All methods are safe to call on a nil value.
+type accessStats struct {
+	sync.Mutex
+	path     string
+	since    time.Time // when tracking started, carried over in the file
+	accounts map[string]*accountAccess
+	dirty    bool // changed since the last save
+}
+
+// loadAccessStats reads the statistics from the file, a missing file starts them over
+func loadAccessStats(config conf.AccessStatsConfig) (*accessStats, error) {
+	a := &accessStats{path: config.File, since: time.Now().UTC(), accounts: map[string]*accountAccess{}}
+	if config.File == "" {
+		return a, nil
+	}
+	if config.SaveInterval <= 0 {
+		return nil, fmt.Errorf("access statistics save interval must be positive")
+	}
+	data, err := os.ReadFile(config.File)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f accessFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("error reading access statistics %s: %v", config.File, err)
+	}
+	if !f.Since.IsZero() {
+		a.since = f.Since
+	}
+	for k, v := range f.Accounts {
+		a.accounts[k] = v
+	}
+	return a, nil
+}
+
+// served records a lookup of the account
+func (a *accessStats) served(pubKey string, via string) {
+	if a == nil || pubKey == "" {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	acc, ok := a.accounts[pubKey]
+	if !ok {
+		acc = &accountAccess{}
+		a.accounts[pubKey] = acc
+	}
+	acc.Lookups++
+	switch via {
+	case accessHTTP:
+		acc.HTTP++
+	case accessNATS:
+		acc.NATS++
+	}
+	acc.LastServed = time.Now().UTC()
+	a.dirty = true
+}
+
+// get returns the lookups of the account, false if it was never served
+func (a *accessStats) get(pubKey string) (accountAccess, time.Time, bool) {
+	if a == nil {
+		return accountAccess{}, time.Time{}, false
+	}
+	a.Lock()
+	defer a.Unlock()
+	acc, ok := a.accounts[pubKey]
+	if !ok {
+		return accountAccess{}, a.since, false
+	}
+	return *acc, a.since, true
+}
+
+// save writes the statistics to the file if they changed
+func (a *accessStats) save() error {
+	if a == nil || a.path == "" {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	if !a.dirty {
+		return nil
+	}
+	data, err := json.Marshal(accessFile{Since: a.since, Accounts: a.accounts})
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+// startAccessStats saves the statistics periodically, if they are kept in a file, assumes the lock is held
+func (server *AccountServer) startAccessStats() {
+	a := server.jwt.access
+	if a == nil || a.path == "" {
+		return
+	}
+	quit := make(chan struct{})
+	server.stopAccessStats = quit
+	interval := time.Duration(server.config.AccessStats.SaveInterval) * time.Millisecond
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			if err := a.save(); err != nil {
+				server.logger.Errorf("unable to save access statistics, %v", err)
+			}
+		}
+	}()
+}
+
+// accessReport is the response of GET /admin/v1/accounts/:pubkey/stats
+type accessReport struct {
+	Account      string     `json:"account"`
+	Stored       bool       `json:"stored"`
+	Lookups      int64      `json:"lookups"`
+	HTTP         int64      `json:"http"`
+	NATS         int64      `json:"nats"`
+	LastServed   *time.Time `json:"last_served"` // null if the account wasn't served since tracked_since
+	TrackedSince time.Time  `json:"tracked_since"`
+}
+
+// getAccountStats handles GET /admin/v1/accounts/:pubkey/stats
+func (server *AccountServer) getAccountStats(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pubKey := params.ByName("pubkey")
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		server.jwt.sendErrorResponse(http.StatusBadRequest, "bad account public key", "", nil, w)
+		return
+	}
+	server.Lock()
+	stats := server.jwt.access
+	jwtStore := server.JWTStore
+	server.Unlock()
+	access, since, served := stats.get(pubKey)
+	theJWT, err := jwtStore.LoadAcc(pubKey)
+	stored := err == nil && theJWT != ""
+	if !stored && !served {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no matching account", ShortKey(pubKey), err, w)
+		return
+	}
+	report := accessReport{
+		Account:      pubKey,
+		Stored:       stored,
+		Lookups:      access.Lookups,
+		HTTP:         access.HTTP,
+		NATS:         access.NATS,
+		TrackedSince: since,
+	}
+	if served {
+		report.LastServed = &access.LastServed
+	}
+	server.writeJSON(w, http.StatusOK, report)
+}
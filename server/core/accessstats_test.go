@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountAccessStats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "access")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.AccessStats.File = filepath.Join(dir, "access.json")
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	stats := func(pubKey string) (int, accessReport) {
+		status, body := adminRequest(t, testEnv, http.MethodGet, fmt.Sprintf("/admin/v1/accounts/%s/stats", pubKey), testAdminToken, "")
+		var report accessReport
+		if status == http.StatusOK {
+			require.NoError(t, json.Unmarshal([]byte(body), &report))
+		}
+		return status, report
+	}
+
+	pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+	status, _ := stats(pubKey)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = stats("nope")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+	status, report := stats(pubKey)
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, report.Stored)
+	require.Zero(t, report.Lookups)
+	require.Nil(t, report.LastServed)
+
+	before := time.Now().UTC()
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	req, err := http.NewRequest(http.MethodGet, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", resp.Header.Get("Etag"))
+	resp, err = testEnv.HTTP.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	msg, err := testEnv.NC.Request(fmt.Sprintf(accountLookupRequest, pubKey), nil, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, theJWT, string(msg.Data))
+
+	_, report = stats(pubKey)
+	require.Equal(t, int64(2), report.HTTP)
+	require.Equal(t, int64(1), report.NATS)
+	require.Equal(t, int64(3), report.Lookups)
+	require.NotNil(t, report.LastServed)
+	require.False(t, report.LastServed.Before(before.Truncate(time.Second)))
+
+	// the counts are saved on stop, and read back on start
+	testEnv.Server.Stop()
+	loaded, err := loadAccessStats(config.AccessStats)
+	require.NoError(t, err)
+	access, since, served := loaded.get(pubKey)
+	require.True(t, served)
+	require.Equal(t, report.Lookups, access.Lookups)
+	require.Equal(t, report.TrackedSince.Unix(), since.Unix())
+}
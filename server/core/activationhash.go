@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+)
+
+// currentActivationHash is the version used when none is configured
+const currentActivationHash = 1
+
+const activationHashVersionHeader = "Activation-Hash-Version"
+
+// activationHasher is one version of the activation hash. The algorithms are pinned here rather than
+// taken from the jwt library, so a library update can't silently change the keys of stored activations.
+type activationHasher struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+	hash      func(claim *jwt.ActivationClaims) (string, error)
+}
+
+var activationHashers = map[int]activationHasher{
+	1: {Version: 1, Algorithm: "sha256-base32", hash: hashActivationV1},
+}
+
+// hashActivationV1 is the hash of jwt v2.0 to v2.7, sha256 of issuer.subject.import subject, the import
+// subject cut before its first wildcard
+func hashActivationV1(claim *jwt.ActivationClaims) (string, error) {
+	if claim.Issuer == "" || claim.Subject == "" || claim.ImportSubject == "" {
+		return "", errors.New("not enough data in the activation claims to create a hash")
+	}
+	subject := string(claim.ImportSubject)
+	tokens := strings.Split(subject, ".")
+	for i, tok := range tokens {
+		if tok == "*" || tok == ">" {
+			if i == 0 {
+				subject = "_"
+			} else {
+				subject = strings.Join(tokens[:i], ".")
+			}
+			break
+		}
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s.%s.%s", claim.Issuer, claim.Subject, subject)))
+	return base32.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// activationKey is the store key of an activation, version 1 keys are the bare hash so activations
+// stored before versioning are still found
+func activationKey(version int, hash string) string {
+	if version == 1 {
+		return hash
+	}
+	return fmt.Sprintf("v%d.%s", version, hash)
+}
+
+// checkActivationHashes validates the configured versions, returning the defaults if none are configured
+func checkActivationHashes(versions []int) ([]int, error) {
+	if len(versions) == 0 {
+		return []int{currentActivationHash}, nil
+	}
+	for _, v := range versions {
+		if _, ok := activationHashers[v]; !ok {
+			return nil, fmt.Errorf("unknown activation hash version %d", v)
+		}
+	}
+	return versions, nil
+}
+
+// activationHashes returns the configured versions, the first one is current
+func (h *JwtHandler) activationHashes() []int {
+	if len(h.activationVersions) == 0 {
+		return []int{currentActivationHash}
+	}
+	return h.activationVersions
+}
+
+// saveActivation stores the activation under its hash for every configured version and returns the
+// hash of the current version
+func (h *JwtHandler) saveActivation(claim *jwt.ActivationClaims, theJWT string, save func(key string, theJWT string) error) (string, error) {
+	current := ""
+	for i, v := range h.activationHashes() {
+		hash, err := activationHashers[v].hash(claim)
+		if err != nil {
+			return "", err
+		}
+		if err := save(activationKey(v, hash), theJWT); err != nil {
+			return "", err
+		}
+		if i == 0 {
+			current = hash
+		}
+	}
+	return current, nil
+}
+
+// loadActivation looks the hash up under every configured version, returning the version that had it
+func (h *JwtHandler) loadActivation(hash string, load func(key string) (string, error)) (string, int, error) {
+	var lastErr error
+	for _, v := range h.activationHashes() {
+		theJWT, err := load(activationKey(v, hash))
+		if err == nil && theJWT != "" {
+			return theJWT, v, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no matching activation")
+	}
+	return "", 0, lastErr
+}
+
+// libraryActivationHash returns the version matching the hash of the linked jwt library, 0 if none does
+func libraryActivationHash() int {
+	claim := jwt.NewActivationClaims("ADTQS7ZCFVJNW5736GOYGB2ESOIYSOOYJ5CWQ7VK5KFTCDM7YAHHDK5S")
+	claim.Issuer = "AAWGUOFYOZWHQ3GKMHYUPWXOFYNQKMEERGC6JZ66F3SXHBHP5VMPDSVA"
+	claim.ImportSubject = "foo.bar.*"
+	lib, err := claim.HashID()
+	if err != nil {
+		return 0
+	}
+	for v, hasher := range activationHashers {
+		if hash, err := hasher.hash(claim); err == nil && hash == lib {
+			return v
+		}
+	}
+	return 0
+}
+
+// jwtInfo is returned by /jwt/v1/info
+type jwtInfo struct {
+	Server         BuildInfo          `json:"server"`
+	ActivationHash activationHashInfo `json:"activation_hash"`
+}
+
+type activationHashInfo struct {
+	Current   int                `json:"current"`
+	Stored    []int              `json:"stored"`            // activations are stored under each of these versions
+	Library   int                `json:"library,omitempty"` // version of the linked jwt library, if it is known
+	Supported []activationHasher `json:"supported"`
+}
+
+// GetInfo describes the versions of the server and of the algorithms it depends on
+func (h *JwtHandler) GetInfo(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	versions := h.activationHashes()
+	info := jwtInfo{
+		Server: Build(),
+		ActivationHash: activationHashInfo{
+			Current: versions[0],
+			Stored:  versions,
+			Library: libraryActivationHash(),
+		},
+	}
+	for v := 1; v <= len(activationHashers); v++ {
+		info.ActivationHash.Supported = append(info.ActivationHash.Supported, activationHashers[v])
+	}
+	data, err := unescapedIndentedMarshal(info, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", "", err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
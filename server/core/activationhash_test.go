@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivationHashV1MatchesLibrary(t *testing.T) {
+	require.Equal(t, 1, libraryActivationHash())
+
+	for _, subject := range []string{"foo", "foo.bar", "foo.*.bar", ">"} {
+		claim := jwt.NewActivationClaims("ADTQS7ZCFVJNW5736GOYGB2ESOIYSOOYJ5CWQ7VK5KFTCDM7YAHHDK5S")
+		claim.Issuer = "AAWGUOFYOZWHQ3GKMHYUPWXOFYNQKMEERGC6JZ66F3SXHBHP5VMPDSVA"
+		claim.ImportSubject = jwt.Subject(subject)
+		lib, err := claim.HashID()
+		require.NoError(t, err)
+		v1, err := hashActivationV1(claim)
+		require.NoError(t, err)
+		require.Equal(t, lib, v1, subject)
+	}
+}
+
+func TestActivationHashMigration(t *testing.T) {
+	// a made up second version, so activations are stored under two hashes
+	activationHashers[2] = activationHasher{Version: 2, Algorithm: "test", hash: func(claim *jwt.ActivationClaims) (string, error) {
+		hash, err := hashActivationV1(claim)
+		return strings.ToLower(hash), err
+	}}
+	defer delete(activationHashers, 2)
+
+	config := conf.DefaultServerConfig()
+	config.ActivationHashVersions = []int{2, 1}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	server := testEnv.Server
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importerPubKey, err := importer.PublicKey()
+	require.NoError(t, err)
+	act := jwt.NewActivationClaims(importerPubKey)
+	act.ImportSubject = "times.*"
+	actJWT, err := act.Encode(accountKey)
+	require.NoError(t, err)
+	act, err = jwt.DecodeActivationClaims(actJWT)
+	require.NoError(t, err)
+	v1, err := act.HashID()
+	require.NoError(t, err)
+
+	stored := map[string]string{}
+	save := func(key string, theJWT string) error {
+		stored[key] = theJWT
+		return nil
+	}
+	load := func(key string) (string, error) {
+		if theJWT, ok := stored[key]; ok {
+			return theJWT, nil
+		}
+		return "", errors.New("not found")
+	}
+	hash, err := server.jwt.saveActivation(act, actJWT, save)
+	require.NoError(t, err)
+	require.Equal(t, strings.ToLower(v1), hash)
+	require.Equal(t, actJWT, stored[v1])
+	require.Equal(t, actJWT, stored[activationKey(2, hash)])
+
+	// lookups find the activation under either hash
+	theJWT, version, err := server.jwt.loadActivation(v1, load)
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+	require.Equal(t, actJWT, theJWT)
+	_, version, err = server.jwt.loadActivation(hash, load)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+	_, _, err = server.jwt.loadActivation("nope", load)
+	require.Error(t, err)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/info"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	info := jwtInfo{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	require.Equal(t, 2, info.ActivationHash.Current)
+	require.Equal(t, []int{2, 1}, info.ActivationHash.Stored)
+	require.Equal(t, 1, info.ActivationHash.Library)
+	require.Len(t, info.ActivationHash.Supported, 2)
+	require.Equal(t, "sha256-base32", info.ActivationHash.Supported[0].Algorithm)
+}
+
+func TestUnknownActivationHashVersion(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.ActivationHashVersions = []int{7}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// initAdminRouter adds the admin API routes if the admin API is enabled with a token
+func (server *AccountServer) initAdminRouter(r *httprouter.Router) {
+	if !server.config.Admin.Enabled {
+		return
+	}
+	if server.config.Admin.Token == "" {
+		server.logger.Errorf("the admin API requires a token, it is not served")
+		return
+	}
+	r.GET("/admin/v1/snapshots", server.adminAuth(server.listSnapshots))
+	r.POST("/admin/v1/snapshots", server.adminAuth(server.createSnapshot))
+	r.DELETE("/admin/v1/snapshots/:name", server.adminAuth(server.deleteSnapshot))
+	r.GET("/admin/v1/merges/last", server.adminAuth(server.getLastMerge))
+	r.POST("/admin/v1/resync", server.adminAuth(server.postResync))
+	r.POST("/admin/v1/notify", server.adminAuth(server.postNotify))
+	r.GET("/admin/v1/approvals", server.adminAuth(server.listApprovals))
+	r.POST("/admin/v1/approvals/:pubkey", server.adminAuth(server.approveAccount))
+	r.DELETE("/admin/v1/approvals/:pubkey", server.adminAuth(server.rejectAccount))
+	r.GET("/admin/v1/revoked", server.adminAuth(server.listRevoked))
+	r.PUT("/admin/v1/revoked/:pubkey", server.adminAuth(server.revokeAccount))
+	r.DELETE("/admin/v1/revoked/:pubkey", server.adminAuth(server.unrevokeAccount))
+	r.GET("/admin/v1/canary", server.adminAuth(server.listCanaryHeld))
+	r.POST("/admin/v1/canary/:pubkey", server.adminAuth(server.releaseCanaryHeld))
+	r.DELETE("/admin/v1/canary/:pubkey", server.adminAuth(server.dropCanaryHeld))
+	r.GET("/admin/v1/store", server.adminAuth(server.getStoreStats))
+	r.GET("/admin/v1/store/parity", server.adminAuth(server.getStoreParity))
+	r.GET("/admin/v1/verify", server.adminAuth(server.getVerify))
+	r.POST("/admin/v1/verify", server.adminAuth(server.postVerify))
+	r.GET("/admin/v1/consistency", server.adminAuth(server.getConsistency))
+	r.GET("/admin/v1/uploads", server.adminAuth(server.getUploads))
+	r.GET("/admin/v1/accounts/:pubkey/stats", server.adminAuth(server.getAccountStats))
+	r.GET("/admin/v1/revocations/:pubkey", server.adminAuth(server.getRevocations))
+	r.POST("/admin/v1/revocations/:pubkey", server.adminAuth(server.applyRevocations))
+	r.GET("/admin/v1/config", server.adminAuth(server.getConfig))
+	r.GET("/admin/v1/snapshot", server.adminAuth(server.getBackup))
+	r.POST("/admin/v1/snapshot", server.adminAuth(server.restoreBackup))
+	// the status reports the configuration and walks the store, so it needs the admin token too
+	r.GET("/varz", server.adminAuth(server.getVarz))
+
+	// snapshots are served read-only, like the live store, so a nats-server can resolve from them
+	r.GET("/snapshots/:name/jwt/v1/accounts/:pubkey", server.getSnapshotJWT)
+	r.GET("/snapshots/:name/jwt/v1/accounts/", server.getSnapshotJWT)
+}
+
+// adminAuth requires the configured bearer token before calling next
+func (server *AccountServer) adminAuth(next httprouter.Handle) httprouter.Handle {
+	return server.tokenAuth(server.config.Admin.Token, "admin token required", next)
+}
+
+// tokenAuth requires the bearer token, unless it is empty, before calling next
+func (server *AccountServer) tokenAuth(token string, failure string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		server.logger.Tracef("%s: %s %s", r.RemoteAddr, r.Method, r.URL.String())
+		if token != "" {
+			expected := []byte("Bearer " + token)
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				server.jwt.sendErrorResponse(http.StatusUnauthorized, failure, "", nil, w)
+				return
+			}
+		}
+		next(w, r, params)
+	}
+}
+
+// hasAdminToken returns true if the admin API is enabled with a token and the request carries it
+func (server *AccountServer) hasAdminToken(r *http.Request) bool {
+	token := server.config.Admin.Token
+	if !server.config.Admin.Enabled || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// writeJSON writes v as the json body of the response
+func (server *AccountServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error encoding response", "", err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// getConfig handles GET /admin/v1/config, returning the configuration in use, defaults included, keyed
+// by the option names of the configuration file. Tokens, passwords and keys are redacted.
+func (server *AccountServer) getConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.writeJSON(w, http.StatusOK, conf.Options(server.config.Redacted()))
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// testAdminToken is the admin token of the test servers that enable the admin API
+const testAdminToken = "admin-secret"
+
+// adminRequest sends a request to the admin API, returning the status and body
+func adminRequest(t *testing.T, testEnv *TestSetup, method string, path string, token string, body string) (int, string) {
+	req, err := http.NewRequest(method, testEnv.URLForPath(path), strings.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := testEnv.HTTP.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func TestAdminDisabled(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, _ := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/snapshots", "", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, _ := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/snapshots", "", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestAdminToken(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = "secret"
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, _ := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/snapshots", "", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = adminRequest(t, testEnv, http.MethodGet, "/admin/v1/snapshots", "wrong", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = adminRequest(t, testEnv, http.MethodGet, "/admin/v1/snapshots", "secret", "")
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestAdminConfig(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = "s3cr3t"
+	config.HTTP.Auth.Tokens = []string{"t0k3n"}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/config", "s3cr3t", "")
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, body, "s3cr3t")
+	require.NotContains(t, body, "t0k3n")
+
+	var options map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(body), &options))
+	admin := options["admin"].(map[string]interface{})
+	require.Equal(t, "[REDACTED]", admin["token"])
+	require.Equal(t, true, admin["enabled"])
+	require.Equal(t, float64(10000), options["maxreplicationpack"])
+	require.Contains(t, options["nats"], "pack_responder")
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// maxNotifyAccounts limits the accounts listed in the body of POST /admin/v1/notify
+const maxNotifyAccounts = 10000
+
+// notifyRequest is the body of POST /admin/v1/notify
+type notifyRequest struct {
+	Accounts []string `json:"accounts"`
+}
+
+// notifyResult lists the accounts whose notifications were published again
+type notifyResult struct {
+	Notified []string          `json:"notified"`
+	Missing  []string          `json:"missing"` // not stored, or revoked
+	Failed   map[string]string `json:"failed"`  // the error publishing the notification, by account
+}
+
+// notifyAccounts returns the accounts listed in the body, or every stored account with all=true, on
+// failure the error response is sent
+func (server *AccountServer) notifyAccounts(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	h := &server.jwt
+	var accounts []string
+	if strings.ToLower(r.URL.Query().Get("all")) == "true" {
+		packer, ok := server.JWTStore.(store.PackableJWTStore)
+		if !ok {
+			h.sendErrorResponse(http.StatusNotImplemented, "the store can't list its accounts", "", nil, w)
+			return nil, false
+		}
+		pack, err := packer.Pack(-1)
+		if err != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "error reading JWTs", "", err, w)
+			return nil, false
+		}
+		for _, line := range strings.Split(pack, "\n") {
+			if key, _, ok := strings.Cut(line, "|"); ok && nkeys.IsValidPublicAccountKey(key) {
+				accounts = append(accounts, key)
+			}
+		}
+	} else {
+		body, ok := h.readBody(w, r, "bad notify request", "")
+		if !ok {
+			return nil, false
+		}
+		var req notifyRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			h.sendErrorResponse(http.StatusBadRequest, "bad notify request", "", err, w)
+			return nil, false
+		}
+		if len(req.Accounts) == 0 || len(req.Accounts) > maxNotifyAccounts {
+			h.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("list between 1 and %d accounts, or pass all=true", maxNotifyAccounts), "", nil, w)
+			return nil, false
+		}
+		seen := map[string]bool{}
+		for _, key := range req.Accounts {
+			if !nkeys.IsValidPublicAccountKey(key) {
+				h.sendErrorResponse(http.StatusBadRequest, "accounts must be account public keys", key, nil, w)
+				return nil, false
+			}
+			if !seen[key] {
+				seen[key] = true
+				accounts = append(accounts, key)
+			}
+		}
+	}
+	sort.Strings(accounts)
+	return accounts, true
+}
+
+// postNotify handles POST /admin/v1/notify?all=true, publishing the update notifications of the stored
+// accounts again, those listed in the body or all of them, so nats-servers that lost their resolver
+// state get every JWT back
+func (server *AccountServer) postNotify(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h := &server.jwt
+	if server.getNatsConnection() == nil && server.notifyQueue == nil {
+		h.sendErrorResponse(http.StatusServiceUnavailable, "notifications require a NATS connection", "", nil, w)
+		return
+	}
+	accounts, ok := server.notifyAccounts(w, r)
+	if !ok {
+		return
+	}
+
+	result := notifyResult{Notified: []string{}, Missing: []string{}, Failed: map[string]string{}}
+	for _, pubKey := range accounts {
+		if h.revoked.has(pubKey) {
+			result.Missing = append(result.Missing, pubKey)
+			continue
+		}
+		theJWT, err := server.JWTStore.LoadAcc(pubKey)
+		if err != nil || theJWT == "" {
+			result.Missing = append(result.Missing, pubKey)
+			continue
+		}
+		if err := h.sendAccountNotification(pubKey, []byte(theJWT)); err != nil {
+			result.Failed[pubKey] = err.Error()
+			continue
+		}
+		result.Notified = append(result.Notified, pubKey)
+	}
+	server.logger.Noticef("notified %d accounts again, %d missing, %d failed", len(result.Notified), len(result.Missing), len(result.Failed))
+	server.writeJSON(w, http.StatusOK, result)
+}
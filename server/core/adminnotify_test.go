@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminNotify(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	first, firstJWT := newAccountJWT(t, testEnv.OperatorKey)
+	second, secondJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(first, firstJWT))
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(second, secondJWT))
+	unknown, _ := newAccountJWT(t, testEnv.OperatorKey)
+
+	sub, err := testEnv.NC.SubscribeSync(fmt.Sprintf(accountNotificationFormat, "*"))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+	received := func(n int) map[string]string {
+		jwts := map[string]string{}
+		for i := 0; i < n; i++ {
+			msg, err := sub.NextMsg(2 * time.Second)
+			require.NoError(t, err)
+			jwts[msg.Subject] = string(msg.Data)
+		}
+		_, err := sub.NextMsg(100 * time.Millisecond)
+		require.Equal(t, nats.ErrTimeout, err)
+		return jwts
+	}
+
+	body := fmt.Sprintf(`{"accounts": ["%s", "%s", "%s"]}`, first, unknown, first)
+	status, resp := adminRequest(t, testEnv, http.MethodPost, "/admin/v1/notify", testAdminToken, body)
+	require.Equal(t, http.StatusOK, status, resp)
+	var result notifyResult
+	require.NoError(t, json.Unmarshal([]byte(resp), &result))
+	require.Equal(t, []string{first}, result.Notified)
+	require.Equal(t, []string{unknown}, result.Missing)
+	require.Empty(t, result.Failed)
+	require.Equal(t, map[string]string{fmt.Sprintf(accountNotificationFormat, first): firstJWT}, received(1))
+
+	status, resp = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/notify?all=true", testAdminToken, "")
+	require.Equal(t, http.StatusOK, status, resp)
+	result = notifyResult{}
+	require.NoError(t, json.Unmarshal([]byte(resp), &result))
+	require.ElementsMatch(t, []string{first, second}, result.Notified)
+	require.Equal(t, map[string]string{
+		fmt.Sprintf(accountNotificationFormat, first):  firstJWT,
+		fmt.Sprintf(accountNotificationFormat, second): secondJWT,
+	}, received(2))
+
+	for _, body := range []string{"", `{"accounts": []}`, `{"accounts": ["nope"]}`} {
+		status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/notify", testAdminToken, body)
+		require.Equal(t, http.StatusBadRequest, status, body)
+	}
+}
+
+func TestAdminNotifyWithoutNATS(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, _ := adminRequest(t, testEnv, http.MethodPost, "/admin/v1/notify?all=true", testAdminToken, "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+}
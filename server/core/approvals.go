@@ -0,0 +1,383 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+)
+
+// approvalRequest is the subject operator signed approvals can be sent to
+const approvalRequest = "$SYS.REQ.ACCOUNT_SERVER.APPROVE"
+
+var (
+	errNoPendingJWT     = errors.New("no pending JWT for account")
+	errPendingMismatch  = errors.New("pending JWT has a different jti")
+	errSameParty        = errors.New("approver is the party that posted the JWT")
+	errPendingOutdated  = errors.New("the stored account JWT was issued after the pending one")
+	errPendingUnmatched = errors.New("the stored account JWT does not match the If-Match of the pending one")
+)
+
+// pendingJWT is an account JWT waiting for a second party to approve it
+type pendingJWT struct {
+	Account   string    `json:"account"`
+	ID        string    `json:"jti"`
+	Issuer    string    `json:"issuer"`           // the issuer of the posted JWT, before any signing service
+	Poster    string    `json:"poster,omitempty"` // the credential the JWT was posted with, see writeCredential
+	Submitted time.Time `json:"submitted"`
+	JWT       string    `json:"jwt"`
+	IfMatch   string    `json:"if_match,omitempty"` // checked again when the JWT is approved
+	Force     bool      `json:"force,omitempty"`
+	Reason    string    `json:"reason,omitempty"` // why the JWT is held, if not for approval
+}
+
+// approvals holds posted JWTs until they are approved, only the latest post per account is kept
+type approvals struct {
+	sync.Mutex
+	tags    []string
+	path    string
+	pending map[string]*pendingJWT
+}
+
+// newApprovals returns nil if approvals are not required, pending JWTs are read from the file, a missing file is empty
+func newApprovals(config conf.ApprovalConfig) (*approvals, error) {
+	if !config.Required {
+		return nil, nil
+	}
+	a, err := loadPending(config.File)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pending approvals %s: %v", config.File, err)
+	}
+	a.tags = config.Tags
+	return a, nil
+}
+
+// loadPending reads the pending JWTs saved at path, without a path they only live in memory
+func loadPending(path string) (*approvals, error) {
+	a := &approvals{path: path, pending: map[string]*pendingJWT{}}
+	if path == "" {
+		return a, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var pending []*pendingJWT
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, err
+	}
+	for _, p := range pending {
+		a.pending[p.Account] = p
+	}
+	return a, nil
+}
+
+// required returns true if the claim has to be approved, an account is matched by the tags
+// on the stored and on the new JWT so removing a tag needs approval too
+func (a *approvals) required(existingTags jwt.TagList, claim *jwt.AccountClaims) bool {
+	if a == nil {
+		return false
+	}
+	if len(a.tags) == 0 {
+		return true
+	}
+	for _, t := range a.tags {
+		if existingTags.Contains(t) || claim.Tags.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *approvals) hold(claim *jwt.AccountClaims, theJWT []byte, issuer string, u *accountUpdate) error {
+	return a.put(&pendingJWT{
+		Account:   claim.Subject,
+		ID:        claim.ID,
+		Issuer:    issuer,
+		Poster:    u.poster,
+		Submitted: time.Now().UTC(),
+		JWT:       string(theJWT),
+		IfMatch:   u.ifMatch,
+		Force:     u.force,
+	})
+}
+
+// writeCredential identifies the credential of a request, the name of a verified client certificate,
+// the issuer of a signed authorization or a hash of the bearer token. It is empty without one.
+func writeCredential(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert " + r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	header := r.Header.Get("Authorization")
+	bearer := strings.TrimPrefix(header, "Bearer ")
+	if header == "" || bearer == header {
+		return ""
+	}
+	if claim, err := jwt.DecodeGeneric(bearer); err == nil {
+		return "key " + claim.Issuer
+	}
+	sum := sha256.Sum256([]byte(bearer))
+	return "token " + hex.EncodeToString(sum[:8])
+}
+
+// save writes the pending JWTs to the file, assumes the lock is held
+func (a *approvals) save() error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(a.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// put replaces the pending JWT of the account, the previous one is kept if the file can't be written
+func (a *approvals) put(p *pendingJWT) error {
+	a.Lock()
+	defer a.Unlock()
+	old, existed := a.pending[p.Account]
+	a.pending[p.Account] = p
+	if err := a.save(); err != nil {
+		if existed {
+			a.pending[p.Account] = old
+		} else {
+			delete(a.pending, p.Account)
+		}
+		return err
+	}
+	return nil
+}
+
+// take removes the pending JWT for the account, if id is set it has to match
+func (a *approvals) take(account string, id string) (*pendingJWT, error) {
+	a.Lock()
+	defer a.Unlock()
+	p, ok := a.pending[account]
+	if !ok {
+		return nil, errNoPendingJWT
+	}
+	if id != "" && p.ID != id {
+		return nil, errPendingMismatch
+	}
+	delete(a.pending, account)
+	if err := a.save(); err != nil {
+		a.pending[account] = p
+		return nil, err
+	}
+	return p, nil
+}
+
+// restore puts a pending JWT back if nothing newer was posted in the meantime, if the file can't be
+// written it is only held in memory until the next change is saved
+func (a *approvals) restore(p *pendingJWT) {
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.pending[p.Account]; !ok {
+		a.pending[p.Account] = p
+		a.save()
+	}
+}
+
+func (a *approvals) list() []*pendingJWT {
+	a.Lock()
+	defer a.Unlock()
+	return a.sorted()
+}
+
+// sorted returns the pending JWTs, oldest first, assumes the lock is held
+func (a *approvals) sorted() []*pendingJWT {
+	list := make([]*pendingJWT, 0, len(a.pending))
+	for _, p := range a.pending {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Submitted.Before(list[j].Submitted)
+	})
+	return list
+}
+
+// approve saves and announces the pending JWT for the account. The approver is the key that signed
+// an approval and the credential that of an admin request, neither can be the party that posted the
+// JWT. The If-Match of the post and the issue time of the stored JWT are checked again, under the
+// write lock of the account, a pending JWT that fails them is dropped.
+func (h *JwtHandler) approve(account string, id string, approver string, credential string) (string, error) {
+	unlock := h.writeLocks.lock(account)
+	defer unlock()
+	p, err := h.approvals.take(account, id)
+	if err == errNoPendingJWT || err == errPendingMismatch {
+		return "no matching pending JWT", err
+	} else if err != nil {
+		return "unable to save the pending JWTs", err
+	}
+	if approver != "" && approver == p.Issuer {
+		h.approvals.restore(p)
+		return "a JWT can't be approved by its issuer", errSameParty
+	}
+	if credential != "" && credential == p.Poster {
+		h.approvals.restore(p)
+		return "a JWT can't be approved with the credential it was posted with", errSameParty
+	}
+	claim, err := jwt.DecodeAccountClaims(p.JWT)
+	if err != nil {
+		return "the pending JWT can't be decoded", err
+	}
+	if _, ok := h.ifMatch(p.IfMatch, account); !ok {
+		return "the pending JWT is dropped", errPendingUnmatched
+	}
+	if err := h.checkAccountOperator(account, claim.Issuer); err != nil {
+		return "the pending JWT is dropped", err
+	}
+	if stored := h.staleUpload(p.Force, claim); stored != nil {
+		return "the pending JWT is dropped", errPendingOutdated
+	}
+	if failure, err := h.saveAccount(context.Background(), p.Account, []byte(p.JWT), nil); err != nil && !notificationPending(err) {
+		if !errors.Is(err, errCanaryHeld) {
+			h.approvals.restore(p)
+		}
+		return failure, err
+	}
+	h.logger.Noticef("updated JWT for account - %s - %s - approved", ShortKey(p.Account), p.ID)
+	return "", nil
+}
+
+// listApprovals handles GET /admin/v1/approvals
+func (server *AccountServer) listApprovals(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if server.jwt.approvals == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "approvals are not required", "", nil, w)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, server.jwt.approvals.list())
+}
+
+// approveAccount handles POST /admin/v1/approvals/:pubkey, the optional jti query parameter
+// guards against approving a JWT that was replaced after it was reviewed
+func (server *AccountServer) approveAccount(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if server.jwt.approvals == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "approvals are not required", "", nil, w)
+		return
+	}
+	account := params.ByName("pubkey")
+	if failure, err := server.jwt.approve(account, r.URL.Query().Get("jti"), "", writeCredential(r)); err != nil {
+		server.jwt.sendErrorResponse(approvalStatus(err), failure, account, err, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func approvalStatus(err error) int {
+	switch err {
+	case errNoPendingJWT:
+		return http.StatusNotFound
+	case errPendingMismatch, errPendingOutdated:
+		return http.StatusConflict
+	case errSameParty, errOtherOperator:
+		return http.StatusForbidden
+	case errPendingUnmatched:
+		return http.StatusPreconditionFailed
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// rejectAccount handles DELETE /admin/v1/approvals/:pubkey
+func (server *AccountServer) rejectAccount(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if server.jwt.approvals == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "approvals are not required", "", nil, w)
+		return
+	}
+	account := params.ByName("pubkey")
+	p, err := server.jwt.approvals.take(account, r.URL.Query().Get("jti"))
+	if err == errNoPendingJWT || err == errPendingMismatch {
+		server.jwt.sendErrorResponse(approvalStatus(err), "no matching pending JWT", account, err, w)
+		return
+	} else if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "unable to save the pending JWTs", account, err, w)
+		return
+	}
+	server.logger.Noticef("%s - JWT %s was rejected", ShortKey(account), p.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleApproval accepts a generic JWT, signed by the operator or one of its signing keys, whose
+// subject is the account and whose data contains the jti of the pending JWT. The issuer of the
+// approval has to differ from the issuer of the pending JWT.
+func (server *AccountServer) handleApproval(msg *nats.Msg) {
+	h := &server.jwt
+	respond := func(account string, failure string, err error) {
+		if msg.Reply == "" {
+			return
+		}
+		resp := map[string]interface{}{"account": account, "approved": err == nil}
+		if err != nil {
+			resp["error"] = fmt.Sprintf("%s - %v", failure, err)
+		}
+		if data, err := json.Marshal(resp); err == nil {
+			msg.Respond(data)
+		}
+	}
+	if h.approvals == nil {
+		respond("", "approvals are not required", errors.New("approvals disabled"))
+		return
+	}
+	claim, err := jwt.DecodeGeneric(string(msg.Data))
+	if err != nil {
+		respond("", "bad approval", err)
+		return
+	}
+	if _, ok := h.trustedKeys[claim.Issuer]; !ok {
+		respond(claim.Subject, "bad approval", errors.New("approval is not signed by the operator"))
+		return
+	}
+	vr := &jwt.ValidationResults{}
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		respond(claim.Subject, "bad approval", errors.New("approval failed validation"))
+		return
+	}
+	id, _ := claim.Data["jti"].(string)
+	if failure, err := h.approve(claim.Subject, id, claim.Issuer, ""); err != nil {
+		server.logger.Errorf("%s - %s - %v", ShortKey(claim.Subject), failure, err)
+		respond(claim.Subject, failure, err)
+		return
+	}
+	respond(claim.Subject, "", nil)
+}
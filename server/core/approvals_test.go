@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// setupApprovalServer runs a server with a signing service that signs with the operator key
+func setupApprovalServer(t *testing.T, tags ...string) *TestSetup {
+	config := conf.DefaultServerConfig()
+	config.SignRequestSubject = "sign"
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Approval.Required = true
+	config.Approval.Tags = tags
+	testEnv, err := SetupTestServer(config, false, true)
+	require.NoError(t, err)
+
+	_, err = testEnv.NC.Subscribe("sign", func(msg *nats.Msg) {
+		claim, err := jwt.DecodeAccountClaims(string(msg.Data))
+		require.NoError(t, err)
+		token, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		msg.Respond([]byte(token))
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+	return testEnv
+}
+
+func postJWT(t *testing.T, testEnv *TestSetup, pubKey string, theJWT []byte) int {
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer(theJWT))
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestApprovalViaAdmin(t *testing.T) {
+	testEnv := setupApprovalServer(t)
+	defer testEnv.Cleanup()
+
+	// operator signed JWTs don't need approval
+	initAndPostNAccounts(t, testEnv, 1)
+
+	pubKey, _, acctJWT := selfSignedAcctJWT(t)
+	require.Equal(t, http.StatusAccepted, postJWT(t, testEnv, pubKey, acctJWT))
+	_, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+
+	status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/approvals", testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	var pending []pendingJWT
+	require.NoError(t, json.Unmarshal([]byte(body), &pending))
+	require.Len(t, pending, 1)
+	require.Equal(t, pubKey, pending[0].Account)
+	require.Equal(t, pubKey, pending[0].Issuer)
+
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/approvals/"+pubKey+"?jti=other", testAdminToken, "")
+	require.Equal(t, http.StatusConflict, status)
+
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/approvals/"+pubKey+"?jti="+pending[0].ID, testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	claim, err := jwt.DecodeAccountClaims(stored)
+	require.NoError(t, err)
+	require.Equal(t, testEnv.OperatorPubKey, claim.Issuer)
+
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/approvals/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// rejected JWTs are dropped
+	pubKey, _, acctJWT = selfSignedAcctJWT(t)
+	require.Equal(t, http.StatusAccepted, postJWT(t, testEnv, pubKey, acctJWT))
+	status, _ = adminRequest(t, testEnv, http.MethodDelete, "/admin/v1/approvals/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, status)
+	_, err = testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+}
+
+func TestApprovalRechecks(t *testing.T) {
+	testEnv := setupApprovalServer(t)
+	defer testEnv.Cleanup()
+
+	// approving with the credential of the post is refused
+	pubKey, _, acctJWT := selfSignedAcctJWT(t)
+	req, err := http.NewRequest(http.MethodPost, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), bytes.NewBuffer(acctJWT))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := testEnv.HTTP.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	status, _ := adminRequest(t, testEnv, http.MethodPost, "/admin/v1/approvals/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusForbidden, status)
+	require.Len(t, testEnv.Server.jwt.approvals.list(), 1)
+
+	// a JWT stored after the pending one was posted wins
+	pubKey, _, acctJWT = selfSignedAcctJWT(t)
+	require.Equal(t, http.StatusAccepted, postJWT(t, testEnv, pubKey, acctJWT))
+	time.Sleep(1100 * time.Millisecond) // issued at has a resolution of seconds
+	newerJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(newerJWT)))
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/approvals/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusConflict, status)
+	require.Len(t, testEnv.Server.jwt.approvals.list(), 1)
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, newerJWT, stored)
+}
+
+func TestApprovalsFile(t *testing.T) {
+	config := conf.ApprovalConfig{Required: true, File: filepath.Join(t.TempDir(), "approvals.json")}
+	a, err := newApprovals(config)
+	require.NoError(t, err)
+
+	pubKey, _, acctJWT := selfSignedAcctJWT(t)
+	claim, err := jwt.DecodeAccountClaims(string(acctJWT))
+	require.NoError(t, err)
+	require.NoError(t, a.hold(claim, acctJWT, pubKey, &accountUpdate{}))
+
+	// pending JWTs survive restarts
+	reloaded, err := newApprovals(config)
+	require.NoError(t, err)
+	pending := reloaded.list()
+	require.Len(t, pending, 1)
+	require.Equal(t, claim.ID, pending[0].ID)
+	require.Equal(t, string(acctJWT), pending[0].JWT)
+
+	_, err = a.take(pubKey, claim.ID)
+	require.NoError(t, err)
+	reloaded, err = newApprovals(config)
+	require.NoError(t, err)
+	require.Empty(t, reloaded.list())
+}
+
+func TestApprovalViaNATS(t *testing.T) {
+	testEnv := setupApprovalServer(t)
+	defer testEnv.Cleanup()
+
+	pubKey, accountKey, acctJWT := selfSignedAcctJWT(t)
+	require.Equal(t, http.StatusAccepted, postJWT(t, testEnv, pubKey, acctJWT))
+	pending := testEnv.Server.jwt.approvals.list()
+	require.Len(t, pending, 1)
+
+	request := func(signer nkeys.KeyPair) map[string]interface{} {
+		approval := jwt.NewGenericClaims(pubKey)
+		approval.Data["jti"] = pending[0].ID
+		token, err := approval.Encode(signer)
+		require.NoError(t, err)
+		msg, err := testEnv.NC.Request(approvalRequest, []byte(token), time.Second)
+		require.NoError(t, err)
+		resp := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(msg.Data, &resp))
+		return resp
+	}
+
+	// the account can't approve its own JWT
+	require.Equal(t, false, request(accountKey)["approved"])
+	require.Equal(t, true, request(testEnv.OperatorKey)["approved"])
+
+	_, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+}
+
+func TestApprovalByTag(t *testing.T) {
+	testEnv := setupApprovalServer(t, "prod")
+	defer testEnv.Cleanup()
+
+	pubKey, _, acctJWT := selfSignedAcctJWT(t)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, acctJWT))
+
+	pubKey, accountKey, _ := selfSignedAcctJWT(t)
+	require.Equal(t, http.StatusAccepted, postJWT(t, testEnv, pubKey, selfSignAccount(t, accountKey, "prod")))
+}
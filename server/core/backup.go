@@ -0,0 +1,207 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// maxBackupBytes limits the size of the archive, compressed, and of each JWT in it, when restoring
+const (
+	maxBackupBytes    = 512 << 20
+	maxBackupJWTBytes = 1 << 20
+)
+
+// restoreResult is the response to POST /admin/v1/snapshot
+type restoreResult struct {
+	Accounts    int  `json:"accounts"`
+	Activations int  `json:"activations"`
+	Notified    bool `json:"notified"`
+}
+
+// getBackup handles GET /admin/v1/snapshot, streaming every JWT in the store, accounts and activations,
+// as a gzipped tar with one <key>.jwt file per JWT
+func (server *AccountServer) getBackup(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	packer, ok := server.JWTStore.(store.PackableJWTStore)
+	if !ok {
+		server.jwt.sendErrorResponse(http.StatusNotImplemented, "store does not support backups", "", nil, w)
+		return
+	}
+	pack, err := packer.Pack(-1)
+	if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error reading the store", "", err, w)
+		return
+	}
+	now := time.Now().UTC()
+	w.Header().Set(ContentType, "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="nats-account-server-%s.tar.gz"`, now.Format("20060102T150405Z")))
+	w.WriteHeader(http.StatusOK)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	count := 0
+	for _, line := range strings.Split(pack, "\n") {
+		split := strings.SplitN(line, "|", 2)
+		if len(split) != 2 {
+			continue
+		}
+		hdr := &tar.Header{Name: split[0] + ".jwt", Mode: 0644, Size: int64(len(split[1])), ModTime: now}
+		if err = tw.WriteHeader(hdr); err == nil {
+			_, err = io.WriteString(tw, split[1])
+		}
+		if err != nil {
+			// the status is sent, the client sees a broken archive
+			server.logger.Errorf("error writing backup: %v", err)
+			return
+		}
+		count++
+	}
+	if err = tw.Close(); err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		server.logger.Errorf("error writing backup: %v", err)
+		return
+	}
+	server.logger.Noticef("backup of %d JWTs sent to %s", count, r.RemoteAddr)
+}
+
+// readBackup reads the JWTs of a backup archive by key, every JWT is decoded and checked against its key
+func readBackup(body io.Reader) (map[string]string, []string, error) {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	jwts := map[string]string{}
+	var problems []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		key := strings.TrimSuffix(path.Base(hdr.Name), ".jwt")
+		if !strings.HasSuffix(hdr.Name, ".jwt") || key == "" {
+			problems = append(problems, fmt.Sprintf("%s: not a JWT file", hdr.Name))
+			continue
+		}
+		if hdr.Size > maxBackupJWTBytes {
+			problems = append(problems, fmt.Sprintf("%s: larger than %d bytes", hdr.Name, maxBackupJWTBytes))
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		theJWT := strings.TrimSpace(string(data))
+		if nkeys.IsValidPublicAccountKey(key) {
+			if claim, err := jwt.DecodeAccountClaims(theJWT); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: bad account JWT, %v", hdr.Name, err))
+				continue
+			} else if claim.Subject != key {
+				problems = append(problems, fmt.Sprintf("%s: JWT is for %s", hdr.Name, claim.Subject))
+				continue
+			}
+		} else if _, err := jwt.DecodeActivationClaims(theJWT); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: bad activation JWT, %v", hdr.Name, err))
+			continue
+		}
+		jwts[key] = theJWT
+	}
+	return jwts, problems, nil
+}
+
+// restoreBackup handles POST /admin/v1/snapshot?notify=true, saving every JWT of an archive made by
+// GET /admin/v1/snapshot. Nothing is saved if one of the JWTs is bad. Restored accounts are announced
+// to the nats-servers with notify.
+func (server *AccountServer) restoreBackup(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	defer r.Body.Close()
+	h := &server.jwt
+	if server.JWTStore.IsReadOnly() {
+		h.sendErrorResponse(http.StatusConflict, "store is read only", "", nil, w)
+		return
+	}
+	jwts, problems, err := readBackup(http.MaxBytesReader(w, r.Body, maxBackupBytes))
+	if err != nil {
+		h.sendErrorResponse(http.StatusBadRequest, "bad backup archive", "", err, w)
+		return
+	}
+	if len(problems) > 0 {
+		lines := append([]string{"The server was unable to restore the backup. One or more JWTs were rejected."}, problems...)
+		server.logger.Errorf("restore of %d JWTs rejected", len(jwts)+len(problems))
+		http.Error(w, strings.Join(lines, "\n\t - "), http.StatusBadRequest)
+		return
+	}
+
+	keys := make([]string, 0, len(jwts))
+	for key := range jwts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := restoreResult{Notified: strings.ToLower(r.URL.Query().Get("notify")) == "true"}
+	if tx, ok := server.JWTStore.(store.TransactionalJWTStore); ok {
+		err = tx.ApplyAccs(jwts)
+	} else {
+		for _, key := range keys {
+			if err = server.JWTStore.SaveAcc(key, jwts[key]); err != nil {
+				err = fmt.Errorf("saving %s: %v", ShortKey(key), err)
+				break
+			}
+		}
+	}
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error restoring the backup", "", err, w)
+		return
+	}
+	for _, key := range keys {
+		if !nkeys.IsValidPublicAccountKey(key) {
+			result.Activations++
+			continue
+		}
+		result.Accounts++
+		h.jtis.add(jwts[key])
+		h.tags.add(jwts[key])
+		if result.Notified && h.sendAccountNotification != nil {
+			if err := h.sendAccountNotification(key, []byte(jwts[key])); err != nil && !notificationPending(err) {
+				h.sendErrorResponse(http.StatusInternalServerError, "backup restored, error sending notification of change", key, err, w)
+				return
+			}
+		}
+		h.refreshSystemAccount(key, jwts[key])
+		h.accountSaved(key, jwts[key])
+	}
+	server.logger.Noticef("restored %d accounts and %d activations", result.Accounts, result.Activations)
+	server.writeJSON(w, http.StatusOK, result)
+}
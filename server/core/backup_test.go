@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Store = conf.StoreConfig{Type: "sqltest", DSN: "TestBackupAndRestoreSource"}
+	source, err := SetupTestServer(config, false, false)
+	defer source.Cleanup()
+	require.NoError(t, err)
+
+	accounts := initAndPostNAccounts(t, source, 2)
+	exporterKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, _ := newAccountJWT(t, source.OperatorKey)
+	act := jwt.NewActivationClaims(importer)
+	act.ImportSubject = "svc.a"
+	actJWT, err := act.Encode(exporterKey)
+	require.NoError(t, err)
+	act, err = jwt.DecodeActivationClaims(actJWT)
+	require.NoError(t, err)
+	hash, err := source.Server.jwt.saveActivation(act, actJWT, source.Server.JWTStore.SaveAcc)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, source.URLForPath("/admin/v1/snapshot"), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := source.HTTP.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/gzip", resp.Header.Get(ContentType))
+	archive, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	config = conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Store = conf.StoreConfig{Type: "sqltest", DSN: "TestBackupAndRestore"}
+	target, err := SetupTestServer(config, false, false)
+	defer target.Cleanup()
+	require.NoError(t, err)
+
+	restore := func(body []byte) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, target.URLForPath("/admin/v1/snapshot"), bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(ContentType, "application/gzip")
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		resp, err := target.HTTP.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	status, body := restore(archive)
+	require.Equal(t, http.StatusOK, status, body)
+	var result restoreResult
+	require.NoError(t, json.Unmarshal([]byte(body), &result))
+	require.Equal(t, restoreResult{Accounts: 2, Activations: 1}, result)
+	for pubKey, theJWT := range accounts {
+		stored, err := target.Server.JWTStore.LoadAcc(pubKey)
+		require.NoError(t, err)
+		require.Equal(t, theJWT, stored)
+	}
+	stored, err := target.Server.JWTStore.LoadAcc(hash)
+	require.NoError(t, err)
+	require.Equal(t, actJWT, stored)
+
+	// an archive with a bad JWT is rejected as a whole
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	pubKey, theJWT := newAccountJWT(t, source.OperatorKey)
+	other, _ := newAccountJWT(t, source.OperatorKey)
+	for name, data := range map[string]string{pubKey + ".jwt": theJWT, other + ".jwt": "garbage"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}))
+		_, err = tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	status, body = restore(buf.Bytes())
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, other)
+	_, err = target.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+
+	status, _ = restore([]byte("not an archive"))
+	require.Equal(t, http.StatusBadRequest, status)
+}
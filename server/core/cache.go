@@ -0,0 +1,155 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"container/list"
+	"sync"
+)
+
+// jwtCache is a size bounded, least recently used, read cache in front of the store.
+// All methods are safe to call on a nil cache, which caches nothing.
+type jwtCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // most recently used at the front
+	version uint64     // changed by every removal, so a JWT read before one isn't cached after it
+	metrics *metrics
+}
+
+type cacheEntry struct {
+	key string
+	jwt string
+}
+
+// newJWTCache returns nil if size isn't positive
+func newJWTCache(size int, m *metrics) *jwtCache {
+	if size <= 0 {
+		return nil
+	}
+	c := &jwtCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		metrics: m,
+	}
+	m.describe("store_cache_requests_total", "counter", "Number of store reads by cache result, hit or miss")
+	m.gaugeFunc("store_cache_entries", "Number of JWTs in the store read cache", func() float64 {
+		return float64(c.len())
+	})
+	return c
+}
+
+func (c *jwtCache) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.order.MoveToFront(e)
+	}
+	c.Unlock()
+	if !ok {
+		c.metrics.inc("store_cache_requests_total", "result", "miss")
+		return "", false
+	}
+	c.metrics.inc("store_cache_requests_total", "result", "hit")
+	return e.Value.(*cacheEntry).jwt, true
+}
+
+// current returns the version to pass to putIfCurrent, taken before the JWT is read from the store
+func (c *jwtCache) current() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.version
+}
+
+// putIfCurrent caches a JWT read from the store unless an entry was removed since version was taken,
+// a JWT read while it was being replaced may be the old one
+func (c *jwtCache) putIfCurrent(key string, theJWT string, version uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.version == version {
+		c.putLocked(key, theJWT)
+	}
+}
+
+func (c *jwtCache) put(key string, theJWT string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.putLocked(key, theJWT)
+}
+
+// putLocked assumes the lock is held
+func (c *jwtCache) putLocked(key string, theJWT string) {
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).jwt = theJWT
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, jwt: theJWT})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *jwtCache) remove(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.version++
+	for _, key := range keys {
+		if e, ok := c.entries[key]; ok {
+			c.order.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *jwtCache) clear() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.version++
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+func (c *jwtCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTCacheEviction(t *testing.T) {
+	c := newJWTCache(2, newMetrics())
+	c.put("a", "1")
+	c.put("b", "2")
+	_, ok := c.get("a") // b is now the least recently used
+	require.True(t, ok)
+	c.put("c", "3")
+	require.Equal(t, 2, c.len())
+	_, ok = c.get("b")
+	require.False(t, ok)
+	v, ok := c.get("a")
+	require.True(t, ok)
+	require.Equal(t, "1", v)
+
+	c.remove("a")
+	_, ok = c.get("a")
+	require.False(t, ok)
+
+	// a JWT read before an entry was removed isn't cached, it may be the replaced one
+	version := c.current()
+	c.remove("a")
+	c.putIfCurrent("a", "old", version)
+	_, ok = c.get("a")
+	require.False(t, ok)
+	c.putIfCurrent("a", "new", c.current())
+	v, ok = c.get("a")
+	require.True(t, ok)
+	require.Equal(t, "new", v)
+
+	var nilCache *jwtCache
+	nilCache.put("a", "1")
+	_, ok = nilCache.get("a")
+	require.False(t, ok)
+	require.Nil(t, newJWTCache(0, nil))
+}
+
+func TestStoreCacheSharedByHTTPAndNATS(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store.CacheSize = 10
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	ds, ok := testEnv.Server.JWTStore.(*dirStore)
+	require.True(t, ok)
+
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the http lookup fills the cache, the nats lookup is served from it
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, ds.cache.len())
+	msg, err := testEnv.NC.Request(fmt.Sprintf(accountLookupRequest, pubKey), nil, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, string(msg.Data))
+
+	var out bytes.Buffer
+	testEnv.Server.metrics.write(&out)
+	require.Contains(t, out.String(), `nats_account_server_store_cache_requests_total{result="hit"}`)
+	require.Contains(t, out.String(), "nats_account_server_store_cache_entries 1")
+
+	// saving invalidates the cached JWT
+	claims := jwt.NewAccountClaims(pubKey)
+	claims.Name = "updated"
+	updated, err := claims.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	sendUpdate(t, testEnv, pubKey, updated)
+	require.Eventually(t, func() bool {
+		theJWT, err := ds.LoadAcc(pubKey)
+		return err == nil && theJWT == updated
+	}, 2*time.Second, 20*time.Millisecond)
+}
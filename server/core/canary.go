@@ -0,0 +1,264 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// canaryUpdateRequest is answered by the full resolver of the canary nats-server
+const canaryUpdateRequest = "$SYS.REQ.CLAIMS.UPDATE"
+
+// errCanaryHeld is returned when saving a JWT that failed canary validation, the JWT is held
+var errCanaryHeld = errors.New("canary validation failed, the JWT is held")
+
+// canary validates account JWTs on a canary nats-server before they are stored, JWTs that fail
+// are held until an operator releases or drops them
+type canary struct {
+	sync.Mutex
+	config  conf.CanaryConfig
+	logger  natsserver.Logger
+	metrics *metrics
+	nc      *nats.Conn
+	held    *approvals
+}
+
+// newCanary returns nil if the canary is not configured
+func newCanary(config conf.CanaryConfig, logger natsserver.Logger, m *metrics) (*canary, error) {
+	if len(config.Servers) == 0 {
+		return nil, nil
+	}
+	if config.Timeout <= 0 {
+		return nil, fmt.Errorf("canary timeout must be positive")
+	}
+	if config.Validate != "" && len(strings.Fields(config.Validate)) == 0 {
+		return nil, fmt.Errorf("canary validate command is blank")
+	}
+	held, err := loadPending(config.File)
+	if err != nil {
+		return nil, fmt.Errorf("error reading held JWTs %s: %v", config.File, err)
+	}
+	c := &canary{
+		config:  config,
+		logger:  logger,
+		metrics: m,
+		held:    held,
+	}
+	m.describe("canary_checks_total", "counter", "Number of account JWTs validated on the canary, by result")
+	m.gaugeFunc("canary_held", "Number of account JWTs held after failing canary validation", func() float64 {
+		c.held.Lock()
+		defer c.held.Unlock()
+		return float64(len(c.held.pending))
+	})
+	return c, nil
+}
+
+// connect returns the connection to the canary, connecting on first use
+func (c *canary) connect() (*nats.Conn, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.nc != nil && !c.nc.IsClosed() {
+		return c.nc, nil
+	}
+	options := []nats.Option{
+		nats.Name("nats-account-server canary"),
+		nats.Timeout(time.Duration(c.config.Timeout) * time.Millisecond),
+	}
+	if c.config.UserCredentials != "" {
+		options = append(options, nats.UserCredentials(c.config.UserCredentials))
+	}
+	nc, err := nats.Connect(strings.Join(c.config.Servers, ","), options...)
+	if err != nil {
+		return nil, err
+	}
+	c.nc = nc
+	return nc, nil
+}
+
+// claimUpdateResponse is the reply of a nats-server resolver to an update request
+type claimUpdateResponse struct {
+	Data *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"data"`
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// validate sends the JWT to the canary and runs the validation command
+func (c *canary) validate(pubKey string, theJWT []byte) error {
+	timeout := time.Duration(c.config.Timeout) * time.Millisecond
+	nc, err := c.connect()
+	if err != nil {
+		return fmt.Errorf("error connecting to the canary: %v", err)
+	}
+	msg, err := nc.Request(canaryUpdateRequest, theJWT, timeout)
+	if err != nil {
+		return fmt.Errorf("canary update request failed: %v", err)
+	}
+	resp := claimUpdateResponse{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return fmt.Errorf("bad canary update response: %v", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("canary refused the JWT: %s", resp.Error.Description)
+	}
+	args := strings.Fields(c.config.Validate)
+	if len(args) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"CANARY_ACCOUNT="+pubKey,
+		"CANARY_JWT="+string(theJWT),
+		"CANARY_SERVERS="+strings.Join(c.config.Servers, ","))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		output := strings.TrimSpace(string(out))
+		if len(output) > 200 {
+			output = output[:200] + "..."
+		}
+		return fmt.Errorf("canary validation %q failed: %v %s", c.config.Validate, err, output)
+	}
+	return nil
+}
+
+// check validates the JWT, if it fails the JWT is held and errCanaryHeld returned. A nil canary accepts everything.
+func (c *canary) check(pubKey string, theJWT []byte) error {
+	if c == nil {
+		return nil
+	}
+	err := c.validate(pubKey, theJWT)
+	if err == nil {
+		c.metrics.inc("canary_checks_total", "result", "passed")
+		return nil
+	}
+	c.metrics.inc("canary_checks_total", "result", "failed")
+	p := &pendingJWT{Account: pubKey, Submitted: time.Now().UTC(), JWT: string(theJWT), Reason: err.Error()}
+	if claim, err := jwt.DecodeAccountClaims(string(theJWT)); err == nil {
+		p.ID, p.Issuer = claim.ID, claim.Issuer
+	}
+	if saveErr := c.held.put(p); saveErr != nil {
+		c.logger.Errorf("%s - unable to save the held JWTs - %v", ShortKey(pubKey), saveErr)
+	}
+	c.logger.Errorf("%s - JWT %s is held - %v", ShortKey(pubKey), p.ID, err)
+	return fmt.Errorf("%w: %v", errCanaryHeld, err)
+}
+
+func (c *canary) stop() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.nc != nil {
+		c.nc.Close()
+		c.nc = nil
+	}
+}
+
+// listCanaryHeld handles GET /admin/v1/canary
+func (server *AccountServer) listCanaryHeld(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if server.jwt.canary == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "the canary is not configured", "", nil, w)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, server.jwt.canary.held.list())
+}
+
+// releaseCanaryHeld handles POST /admin/v1/canary/:pubkey?jti=&force=, storing and announcing the held JWT
+// without validating it again
+func (server *AccountServer) releaseCanaryHeld(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h := &server.jwt
+	if h.canary == nil {
+		h.sendErrorResponse(http.StatusNotFound, "the canary is not configured", "", nil, w)
+		return
+	}
+	account := params.ByName("pubkey")
+	force := strings.ToLower(r.URL.Query().Get("force")) == "true"
+	if failure, err := h.releaseHeld(r.Context(), account, r.URL.Query().Get("jti"), force); err != nil {
+		h.sendErrorResponse(approvalStatus(err), failure, account, err, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// releaseHeld stores the held JWT of the account, checked against the stored JWT like a post, under the
+// write lock of the account. A JWT issued before the stored one is kept unless force is set, one of
+// another operator is dropped.
+func (h *JwtHandler) releaseHeld(ctx context.Context, account string, id string, force bool) (string, error) {
+	unlock := h.writeLocks.lock(account)
+	defer unlock()
+	p, err := h.canary.held.take(account, id)
+	if err == errNoPendingJWT || err == errPendingMismatch {
+		return "no matching held JWT", err
+	} else if err != nil {
+		return "unable to save the held JWTs", err
+	}
+	claim, err := jwt.DecodeAccountClaims(p.JWT)
+	if err != nil {
+		return "the held JWT can't be decoded", err
+	}
+	if err := h.checkAccountOperator(account, claim.Issuer); err != nil {
+		return "the held JWT is dropped", err
+	}
+	if stored := h.staleUpload(force, claim); stored != nil {
+		h.canary.held.restore(p)
+		return fmt.Sprintf("the stored account JWT was issued later, at %s, release with force=true to roll it back",
+			time.Unix(stored.IssuedAt, 0).UTC().Format(time.RFC3339)), errPendingOutdated
+	}
+	if failure, err := h.storeAccount(ctx, p.Account, []byte(p.JWT), nil); err != nil && !notificationPending(err) {
+		h.canary.held.restore(p)
+		return failure, err
+	}
+	h.logger.Noticef("updated JWT for account - %s - %s - released from the canary", ShortKey(p.Account), p.ID)
+	return "", nil
+}
+
+// dropCanaryHeld handles DELETE /admin/v1/canary/:pubkey
+func (server *AccountServer) dropCanaryHeld(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h := &server.jwt
+	if h.canary == nil {
+		h.sendErrorResponse(http.StatusNotFound, "the canary is not configured", "", nil, w)
+		return
+	}
+	account := params.ByName("pubkey")
+	p, err := h.canary.held.take(account, r.URL.Query().Get("jti"))
+	if err != nil {
+		h.sendErrorResponse(approvalStatus(err), "no matching held JWT", account, err, w)
+		return
+	}
+	server.logger.Noticef("%s - JWT %s held by the canary was dropped", ShortKey(account), p.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
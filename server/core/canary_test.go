@@ -0,0 +1,144 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanary(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = "secret"
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// the test nats-server stands in for the canary
+	canaryConfig := conf.CanaryConfig{
+		Servers:         testEnv.Server.config.NATS.Servers,
+		UserCredentials: testEnv.SystemUserCredsFile,
+		Timeout:         2000,
+		Validate:        "true",
+	}
+	canary, err := newCanary(canaryConfig, testEnv.Server.logger, testEnv.Server.metrics)
+	require.NoError(t, err)
+	defer canary.stop()
+	testEnv.Server.jwt.canary = canary
+
+	refuse := int32(0)
+	_, err = testEnv.NC.Subscribe(canaryUpdateRequest, func(msg *nats.Msg) {
+		if atomic.LoadInt32(&refuse) == 1 {
+			msg.Respond([]byte(`{"error": {"code": 400, "description": "bad jwt"}}`))
+			return
+		}
+		msg.Respond([]byte(`{"data": {"code": 200, "message": "jwt updated"}}`))
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(acctJWT)))
+
+	// a failing validation command holds the JWT
+	canary.config.Validate = "false"
+	otherKey, otherJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusAccepted, postJWT(t, testEnv, otherKey, []byte(otherJWT)))
+	_, err = testEnv.Server.JWTStore.LoadAcc(otherKey)
+	require.Error(t, err)
+
+	// so does a JWT refused by the canary
+	canary.config.Validate = ""
+	atomic.StoreInt32(&refuse, 1)
+	thirdKey, thirdJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusAccepted, postJWT(t, testEnv, thirdKey, []byte(thirdJWT)))
+
+	status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/canary", "secret", "")
+	require.Equal(t, http.StatusOK, status)
+	held := []*pendingJWT{}
+	require.NoError(t, json.Unmarshal([]byte(body), &held))
+	require.Len(t, held, 2)
+	for _, p := range held {
+		require.NotEmpty(t, p.Reason)
+	}
+
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/canary/"+otherKey, "secret", "")
+	require.Equal(t, http.StatusOK, status)
+	stored, err := testEnv.Server.JWTStore.LoadAcc(otherKey)
+	require.NoError(t, err)
+	require.Equal(t, otherJWT, stored)
+
+	// a held JWT issued before the stored one isn't released
+	atomic.StoreInt32(&refuse, 0)
+	time.Sleep(1100 * time.Millisecond) // issued at has a resolution of seconds
+	newerJWT, err := jwt.NewAccountClaims(thirdKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, thirdKey, []byte(newerJWT)))
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/canary/"+thirdKey, "secret", "")
+	require.Equal(t, http.StatusConflict, status)
+	require.Len(t, canary.held.list(), 1)
+
+	status, _ = adminRequest(t, testEnv, http.MethodDelete, "/admin/v1/canary/"+thirdKey, "secret", "")
+	require.Equal(t, http.StatusNoContent, status)
+	stored, err = testEnv.Server.JWTStore.LoadAcc(thirdKey)
+	require.NoError(t, err)
+	require.Equal(t, newerJWT, stored)
+	status, _ = adminRequest(t, testEnv, http.MethodDelete, "/admin/v1/canary/"+thirdKey, "secret", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestCanaryHeldFile(t *testing.T) {
+	config := conf.CanaryConfig{Servers: []string{"nats://127.0.0.1:1"}, Timeout: 100, Validate: " "}
+	_, err := newCanary(config, NewNilLogger(), newMetrics())
+	require.Error(t, err)
+
+	config.Validate = ""
+	config.File = filepath.Join(t.TempDir(), "held.json")
+	canary, err := newCanary(config, NewNilLogger(), newMetrics())
+	require.NoError(t, err)
+	pubKey, _, acctJWT := selfSignedAcctJWT(t)
+	require.ErrorIs(t, canary.check(pubKey, acctJWT), errCanaryHeld)
+
+	// held JWTs survive restarts
+	reloaded, err := newCanary(config, NewNilLogger(), newMetrics())
+	require.NoError(t, err)
+	held := reloaded.held.list()
+	require.Len(t, held, 1)
+	require.Equal(t, string(acctJWT), held[0].JWT)
+}
+
+func TestCanaryNotConfigured(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = "secret"
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	require.Nil(t, testEnv.Server.jwt.canary)
+
+	status, _ := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/canary", "secret", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// accountWriteStripes is the number of locks account posts are spread over by public key
+const accountWriteStripes = 64
+
+// accountWriteLocks serialize the If-Match and stale checks and the save of posts for the same account,
+// so two conditional posts can't both pass the check. All methods are safe to call on a nil value.
+type accountWriteLocks struct {
+	stripes [accountWriteStripes]sync.Mutex
+}
+
+// lock locks the stripe of pubKey and returns the unlock function
+func (l *accountWriteLocks) lock(pubKey string) func() {
+	if l == nil {
+		return func() {}
+	}
+	m := &l.stripes[writeStripe(pubKey)]
+	m.Lock()
+	return m.Unlock
+}
+
+// lockAll locks the stripes of every key in order, so two calls can't deadlock, and returns the unlock function
+func (l *accountWriteLocks) lockAll(pubKeys []string) func() {
+	if l == nil {
+		return func() {}
+	}
+	var locked [accountWriteStripes]bool
+	for _, pubKey := range pubKeys {
+		locked[writeStripe(pubKey)] = true
+	}
+	for i := range locked {
+		if locked[i] {
+			l.stripes[i].Lock()
+		}
+	}
+	return func() {
+		for i := range locked {
+			if locked[i] {
+				l.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+func writeStripe(pubKey string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(pubKey))
+	return hash.Sum32() % accountWriteStripes
+}
+
+// etag returns the ETag of a stored JWT, its JTI, or the SHA-256 of the JWT if ETags are hashed
+func (h *JwtHandler) etag(jti string, theJWT string) string {
+	if h.hashETags {
+		hash := sha256.Sum256([]byte(theJWT))
+		return `"` + hex.EncodeToString(hash[:]) + `"`
+	}
+	return `"` + jti + `"`
+}
+
+// ifMatch checks the If-Match header of a post against the ETag of the stored account JWT, it passes
+// if there is no header. * matches any stored JWT. The ETag of the stored JWT is returned, empty if
+// there is none.
+func (h *JwtHandler) ifMatch(header string, pubKey string) (string, bool) {
+	etag := ""
+	if theJWT, claim, found := h.loadAccountJWTWithClaims(pubKey); found {
+		etag = h.etag(claim.ID, theJWT)
+	}
+	if header == "" {
+		return etag, true
+	}
+	if etag == "" {
+		return "", false
+	}
+	for _, m := range strings.Split(header, ",") {
+		// ETags are strong validators, weak ones never match
+		if m = strings.TrimSpace(m); m == "*" || m == etag {
+			return etag, true
+		}
+	}
+	return etag, false
+}
+
+// staleUpload returns the stored claims if stale posts are rejected and they were issued after claim,
+// a post with force=true rolls the account back anyway
+func (h *JwtHandler) staleUpload(force bool, claim *jwt.AccountClaims) *jwt.AccountClaims {
+	if !h.rejectStale || force {
+		return nil
+	}
+	if found, stored := h.loadAccountJWT(claim.Subject); found && stored.IssuedAt > claim.IssuedAt {
+		return stored
+	}
+	return nil
+}
+
+// preconditionFailed rejects a post whose If-Match doesn't match the stored JWT, with the current ETag
+func (h *JwtHandler) preconditionFailed(header http.Header, etag string, shortCode string) (int, error) {
+	if etag != "" {
+		header.Set("Etag", etag)
+	}
+	return h.rejectUpdate(http.StatusPreconditionFailed, "the stored account JWT does not match If-Match", shortCode, nil)
+}
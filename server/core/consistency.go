@@ -0,0 +1,270 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+const accountListRequest = "$SYS.REQ.CLAIMS.LIST"
+
+var checkSeq uint64 // keeps late replies to a previous check out of the current one
+
+// consistencyReport is the result of comparing the store with the nats-server full resolvers
+type consistencyReport struct {
+	Time         time.Time            `json:"time"`
+	Hash         string               `json:"hash"`
+	PackCompared bool                 `json:"pack_compared"` // a resolver answered the pack request
+	PackMatches  bool                 `json:"pack_matches"`
+	Resolvers    []resolverDivergence `json:"resolvers"`
+	Different    []jtiDivergence      `json:"different"`
+}
+
+// resolverDivergence lists the accounts one resolver and this server don't agree on
+type resolverDivergence struct {
+	Name         string   `json:"name"`
+	ID           string   `json:"id"`
+	Accounts     int      `json:"accounts"`
+	MissingHere  []string `json:"missing_here"`  // in the resolver, not in the store
+	MissingThere []string `json:"missing_there"` // in the store, not in the resolver
+}
+
+// jtiDivergence is an account both sides have, with a different JWT
+type jtiDivergence struct {
+	Account string `json:"account"`
+	Here    string `json:"here"`
+	There   string `json:"there"`
+}
+
+// listResponse is the reply of a full resolver to a list request
+type listResponse struct {
+	Server struct {
+		Name string `json:"name"`
+		ID   string `json:"id"`
+	} `json:"server"`
+	Data  []string `json:"data"`
+	Error *struct {
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+func (r *consistencyReport) counts() (missingHere int, missingThere int) {
+	for _, rd := range r.Resolvers {
+		missingHere += len(rd.MissingHere)
+		missingThere += len(rd.MissingThere)
+	}
+	return missingHere, missingThere
+}
+
+// startConsistencyCheck periodically compares the store with the full resolvers, assumes the lock is held
+func (server *AccountServer) startConsistencyCheck(nc *nats.Conn, jwtStore syncableStore) {
+	interval := server.config.Consistency.Interval
+	if interval <= 0 || server.stopConsistency != nil {
+		return
+	}
+	quit := make(chan struct{})
+	server.stopConsistency = quit
+	timeout := time.Duration(server.config.Consistency.Timeout) * time.Millisecond
+	server.metrics.describe("consistency_checks_total", "counter", "Number of consistency checks against the nats-server resolvers")
+	server.metrics.describe("consistency_divergences", "gauge", "Divergences found by the last consistency check, by kind")
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			report, err := server.checkConsistency(nc, jwtStore, timeout)
+			if err != nil {
+				server.logger.Errorf("consistency check error: %v", err)
+				continue
+			}
+			server.recordConsistency(report)
+		}
+	}()
+}
+
+// checkConsistency asks the resolvers for their account lists and, if the pack hash differs, for
+// their JWTs and compares both with the store
+func (server *AccountServer) checkConsistency(nc *nats.Conn, jwtStore syncableStore, timeout time.Duration) (*consistencyReport, error) {
+	pack, err := jwtStore.Pack(-1)
+	if err != nil {
+		return nil, err
+	}
+	ours := map[string]string{}
+	for _, line := range strings.Split(pack, "\n") {
+		if split := strings.Split(line, "|"); len(split) == 2 {
+			ours[split[0]] = split[1]
+		}
+	}
+	hash := jwtStore.Hash()
+	report := &consistencyReport{
+		Time:      time.Now().UTC(),
+		Hash:      fmt.Sprintf("%x", hash[:]),
+		Resolvers: []resolverDivergence{},
+		Different: []jtiDivergence{},
+	}
+
+	lists, err := collectResponses(nc, server.checkInbox, accountListRequest, nil, timeout, func(m *nats.Msg) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range lists {
+		var resp listResponse
+		if err := json.Unmarshal(m.Data, &resp); err != nil || resp.Error != nil {
+			continue
+		}
+		rd := resolverDivergence{Name: resp.Server.Name, ID: resp.Server.ID, Accounts: len(resp.Data),
+			MissingHere: []string{}, MissingThere: []string{}}
+		theirs := map[string]struct{}{}
+		for _, acc := range resp.Data {
+			theirs[acc] = struct{}{}
+			if _, ok := ours[acc]; !ok {
+				rd.MissingHere = append(rd.MissingHere, acc)
+			}
+		}
+		for acc := range ours {
+			if _, ok := theirs[acc]; !ok {
+				rd.MissingThere = append(rd.MissingThere, acc)
+			}
+		}
+		sort.Strings(rd.MissingHere)
+		sort.Strings(rd.MissingThere)
+		report.Resolvers = append(report.Resolvers, rd)
+	}
+
+	// pack requests are answered by a single member of the responder queue, which may be this
+	// server, in which case nothing is compared
+	packs, err := collectResponses(nc, server.checkInbox, server.subjects.pack, hash[:], timeout, func(m *nats.Msg) bool {
+		return len(m.Data) == 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range packs {
+		report.PackCompared = true
+		for _, line := range strings.Split(string(m.Data), "\n") {
+			split := strings.Split(line, "|")
+			if len(split) != 2 {
+				continue
+			}
+			here, ok := ours[split[0]]
+			if !ok || here == split[1] {
+				continue
+			}
+			if d := jtiDiff(split[0], here, split[1]); d != nil {
+				report.Different = append(report.Different, *d)
+			}
+		}
+	}
+	// a matching hash is answered with just the end of stream
+	report.PackMatches = len(packs) == 1 && len(packs[0].Data) == 0
+	sort.Slice(report.Different, func(i, j int) bool { return report.Different[i].Account < report.Different[j].Account })
+	return report, nil
+}
+
+func jtiDiff(account string, here string, there string) *jtiDivergence {
+	ours, err := jwt.DecodeAccountClaims(here)
+	if err != nil {
+		return nil
+	}
+	theirs, err := jwt.DecodeAccountClaims(there)
+	if err != nil {
+		return nil
+	}
+	if ours.ID == theirs.ID {
+		return nil
+	}
+	return &jtiDivergence{Account: account, Here: ours.ID, There: theirs.ID}
+}
+
+// collectResponses sends a request and gathers the replies, on an inbox under prefix, until the timeout
+// or until last returns true
+func collectResponses(nc *nats.Conn, prefix string, subject string, data []byte, timeout time.Duration, last func(*nats.Msg) bool) ([]*nats.Msg, error) {
+	inbox := fmt.Sprintf("%s.%d", prefix, atomic.AddUint64(&checkSeq, 1))
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := nc.PublishRequest(subject, inbox, data); err != nil {
+		return nil, err
+	}
+	var msgs []*nats.Msg
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			return msgs, nil
+		}
+		msgs = append(msgs, m)
+		if last(m) {
+			return msgs, nil
+		}
+	}
+}
+
+// recordConsistency logs a report, updates the metrics and keeps it for the admin API
+func (server *AccountServer) recordConsistency(report *consistencyReport) {
+	missingHere, missingThere := report.counts()
+	server.metrics.inc("consistency_checks_total")
+	server.metrics.set("consistency_divergences", float64(missingHere), "kind", "missing_here")
+	server.metrics.set("consistency_divergences", float64(missingThere), "kind", "missing_there")
+	server.metrics.set("consistency_divergences", float64(len(report.Different)), "kind", "different_jti")
+
+	for _, rd := range report.Resolvers {
+		for _, acc := range rd.MissingHere {
+			server.logger.Warnf("consistency - %s - missing here, present on resolver %s", ShortKey(acc), rd.Name)
+		}
+		for _, acc := range rd.MissingThere {
+			server.logger.Warnf("consistency - %s - missing on resolver %s", ShortKey(acc), rd.Name)
+		}
+	}
+	for _, d := range report.Different {
+		server.logger.Warnf("consistency - %s - jti %s here, %s on a resolver", ShortKey(d.Account), d.Here, d.There)
+	}
+	if missingHere+missingThere+len(report.Different) == 0 {
+		server.logger.Debugf("consistency check found no divergence with %d resolvers", len(report.Resolvers))
+	}
+
+	server.Lock()
+	server.consistency = report
+	server.Unlock()
+}
+
+// getConsistency handles GET /admin/v1/consistency, returning the last consistency report
+func (server *AccountServer) getConsistency(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.Lock()
+	report := server.consistency
+	server.Unlock()
+	if report == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no consistency check has completed", "", nil, w)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsistencyCheck(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Consistency.Interval = 100
+	config.Consistency.Timeout = 250
+	config.SyncInterval = 60000 // keep the store's own pack requests out of the way
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, _ := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/consistency", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 3)
+	var accounts []string
+	for pubKey := range pubKeys {
+		accounts = append(accounts, pubKey)
+	}
+	sort.Strings(accounts)
+	extraKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	extra, err := extraKey.PublicKey()
+	require.NoError(t, err)
+
+	// a resolver that lacks the last account, has one this server doesn't and a different JWT for the first
+	changed := jwt.NewAccountClaims(accounts[0])
+	changed.Name = "changed"
+	changedJWT, err := changed.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	_, err = testEnv.NC.Subscribe(accountListRequest, func(m *nats.Msg) {
+		resp := map[string]interface{}{
+			"server": map[string]string{"name": "resolver", "id": "NRESOLVER"},
+			"data":   []string{accounts[0], accounts[1], extra},
+		}
+		data, _ := json.Marshal(resp)
+		m.Respond(data)
+	})
+	require.NoError(t, err)
+	_, err = testEnv.NC.Subscribe(accountPackRequest, func(m *nats.Msg) {
+		m.Respond([]byte(fmt.Sprintf("%s|%s\n%s|%s", accounts[0], changedJWT, accounts[1], pubKeys[accounts[1]])))
+		m.Respond(nil)
+	})
+	require.NoError(t, err)
+
+	var report consistencyReport
+	require.Eventually(t, func() bool {
+		status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/consistency", testAdminToken, "")
+		if status != http.StatusOK {
+			return false
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &report))
+		return len(report.Resolvers) > 0 && report.PackCompared
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.Len(t, report.Resolvers, 1)
+	require.Equal(t, "resolver", report.Resolvers[0].Name)
+	require.Equal(t, []string{extra}, report.Resolvers[0].MissingHere)
+	require.Equal(t, []string{accounts[2]}, report.Resolvers[0].MissingThere)
+	require.False(t, report.PackMatches)
+	require.Len(t, report.Different, 1)
+	require.Equal(t, accounts[0], report.Different[0].Account)
+	require.Equal(t, changed.ID, report.Different[0].There)
+
+	var out bytes.Buffer
+	testEnv.Server.metrics.write(&out)
+	require.Contains(t, out.String(), `nats_account_server_consistency_divergences{kind="different_jti"} 1`)
+	require.Contains(t, out.String(), `nats_account_server_consistency_divergences{kind="missing_here"} 1`)
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+)
+
+// ConvertReport is the outcome of a store layout conversion
+type ConvertReport struct {
+	Dir      string `json:"dir"`
+	Target   string `json:"target,omitempty"` // empty when the store was converted in place
+	Shard    bool   `json:"shard"`            // the layout converted to
+	Moved    int    `json:"moved"`            // files moved, or copied to the target
+	Kept     int    `json:"kept"`             // files already where the layout puts them
+	Verified int    `json:"verified"`         // JWTs read back from their new path with the same hash
+}
+
+// storeFile is a file of a directory store, a JWT or one renamed with the deleted or quarantined suffix
+type storeFile struct {
+	key    string
+	name   string // the file name, the key with the .jwt extension and the suffix
+	path   string
+	hash   [sha256.Size]byte
+	isJWT  bool // served by the store, not renamed with a suffix
+	target string
+}
+
+// convertSuffixes are the endings of the files moved with a conversion
+var convertSuffixes = []string{"", deletedSuffix, quarantinedSuffix}
+
+// ConvertStore moves the files of the directory store to the layout of the shard setting, in sub
+// directories named after the last two characters of the account key, or all in the store directory.
+// Files in either layout are found, so a store whose shard setting was changed is converted as well.
+// With a target directory the files are copied there instead and the store is left as it is. File
+// times are kept and every JWT is read back afterwards and compared with the hash taken before. The
+// server must not be running.
+func (server *AccountServer) ConvertStore(target string) (*ConvertReport, error) {
+	server.Lock()
+	running, config := server.running, server.config.Store
+	server.Unlock()
+	if running {
+		return nil, errors.New("the store is converted before the server is started")
+	}
+	if config.Type != conf.StoreDir && config.Type != "" {
+		return nil, fmt.Errorf("only directory stores can be converted, not %s stores", config.Type)
+	}
+	if config.Dir == "" {
+		return nil, errors.New("store directory is required")
+	}
+	dir, err := filepath.Abs(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &ConvertReport{Dir: dir, Shard: config.Shard}
+	dest := dir
+	if target != "" {
+		if dest, err = filepath.Abs(target); err != nil {
+			return nil, err
+		}
+		if dest == dir {
+			return nil, errors.New("the target is the store directory, leave it out to convert in place")
+		}
+		if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+			return nil, fmt.Errorf("the target %s is not empty", dest)
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		report.Target = dest
+	}
+
+	files, copies, err := readStoreFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	layout := &dirStore{dir: dest, shard: config.Shard}
+	for _, f := range append(files, copies...) {
+		f.target = filepath.Join(filepath.Dir(layout.pathForKey(f.key)), f.name)
+	}
+	// of a file found in both layouts, the copy already in place is kept
+	byName := map[string]int{}
+	for i, f := range files {
+		byName[f.name] = i
+	}
+	for i, c := range copies {
+		if j := byName[c.name]; c.path == c.target && files[j].path != files[j].target {
+			files[j], copies[i] = c, files[j]
+		}
+	}
+
+	for _, f := range files {
+		if f.target == f.path {
+			report.Kept++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(f.target), 0755); err != nil {
+			return report, err
+		}
+		if target != "" {
+			err = copyStoreFile(f.path, f.target)
+		} else {
+			err = os.Rename(f.path, f.target)
+		}
+		if err != nil {
+			return report, fmt.Errorf("error moving %s: %v", f.path, err)
+		}
+		report.Moved++
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f.target)
+		if err != nil {
+			return report, fmt.Errorf("error verifying %s: %v", f.target, err)
+		}
+		if sha256.Sum256(data) != f.hash {
+			return report, fmt.Errorf("%s doesn't match the hash taken before the conversion", f.target)
+		}
+		if f.isJWT {
+			report.Verified++
+		}
+	}
+	if target == "" {
+		for _, c := range copies {
+			if c.path != c.target {
+				os.Remove(c.path)
+			}
+		}
+		// remove the shard directories left empty, anything else in them stays
+		for _, f := range append(files, copies...) {
+			if filepath.Dir(f.path) != dir {
+				os.Remove(filepath.Dir(f.path))
+			}
+		}
+	}
+	server.logger.Noticef("converted the store at %s to the %s layout, %d files moved", dir, layoutName(config.Shard), report.Moved)
+	return report, nil
+}
+
+func layoutName(shard bool) string {
+	if shard {
+		return "sharded"
+	}
+	return "unsharded"
+}
+
+// readStoreFiles lists the files of a directory store, in the store directory and in shard directories,
+// ordered by path. A file found in both layouts is returned once, its other copies are returned apart.
+// It fails if the copies differ.
+func readStoreFiles(dir string) ([]*storeFile, []*storeFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, nil, err
+	}
+	nested, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		return nil, nil, err
+	}
+	paths = append(paths, nested...)
+	sort.Strings(paths)
+
+	var files, copies []*storeFile
+	seen := map[string]*storeFile{}
+	for _, path := range paths {
+		f := parseStoreFile(dir, path)
+		if f == nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		f.hash = sha256.Sum256(data)
+		if other, ok := seen[f.name]; ok {
+			if other.hash != f.hash {
+				return nil, nil, fmt.Errorf("%s and %s hold different JWTs, remove one of them", other.path, f.path)
+			}
+			copies = append(copies, f)
+			continue
+		}
+		seen[f.name] = f
+		files = append(files, f)
+	}
+	return files, copies, nil
+}
+
+// parseStoreFile returns the store file at path, nil if the file isn't one, or is in a directory
+// other than the store directory or the shard directory of its key
+func parseStoreFile(dir string, path string) *storeFile {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	name := filepath.Base(path)
+	for _, suffix := range convertSuffixes {
+		key := strings.TrimSuffix(name, ".jwt"+suffix)
+		if key+".jwt"+suffix != name || !nkeys.IsValidPublicAccountKey(key) {
+			continue
+		}
+		if parent := filepath.Dir(path); parent != dir && parent != filepath.Join(dir, key[len(key)-2:]) {
+			return nil
+		}
+		return &storeFile{key: key, name: name, path: path, isJWT: suffix == ""}
+	}
+	return nil
+}
+
+// copyStoreFile copies a file with its mode and times
+func copyStoreFile(from string, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(to, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
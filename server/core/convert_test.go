@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertStore(t *testing.T) {
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = dir
+	config.Logging.Custom = NewNilLogger()
+	convert := func(shard bool, target string) (*ConvertReport, error) {
+		config.Store.Shard = shard
+		server := NewAccountServer()
+		require.NoError(t, server.InitializeFromConfig(config))
+		server.logger = server.ConfigureLogger()
+		return server.ConvertStore(target)
+	}
+	sharded := func(root string, pubKey string, suffix string) string {
+		return filepath.Join(root, pubKey[len(pubKey)-2:], pubKey+".jwt"+suffix)
+	}
+
+	// an unsharded store, with a deleted account and a file that isn't a JWT
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	a, aJWT := newAccountJWT(t, operatorKey)
+	b, bJWT := newAccountJWT(t, operatorKey)
+	deleted, deletedJWT := newAccountJWT(t, operatorKey)
+	write := func(path string, data string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	write(filepath.Join(dir, a+".jwt"), aJWT)
+	write(filepath.Join(dir, b+".jwt"), bJWT)
+	write(filepath.Join(dir, deleted+".jwt"+deletedSuffix), deletedJWT)
+	write(filepath.Join(dir, "notes.txt"), "left alone")
+
+	report, err := convert(true, "")
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Moved)
+	require.Equal(t, 2, report.Verified)
+	require.Empty(t, report.Target)
+	for pubKey, theJWT := range map[string]string{a: aJWT, b: bJWT} {
+		data, err := os.ReadFile(sharded(dir, pubKey, ""))
+		require.NoError(t, err)
+		require.Equal(t, theJWT, string(data))
+		info, err := os.Stat(sharded(dir, pubKey, ""))
+		require.NoError(t, err)
+		require.True(t, info.ModTime().Equal(mtime))
+		require.NoFileExists(t, filepath.Join(dir, pubKey+".jwt"))
+	}
+	require.FileExists(t, sharded(dir, deleted, deletedSuffix))
+	require.FileExists(t, filepath.Join(dir, "notes.txt"))
+
+	// a second run finds every file in place
+	report, err = convert(true, "")
+	require.NoError(t, err)
+	require.Zero(t, report.Moved)
+	require.Equal(t, 3, report.Kept)
+
+	// copied to a target, the store is left as it is
+	target := filepath.Join(t.TempDir(), "flat")
+	report, err = convert(false, target)
+	require.NoError(t, err)
+	require.Equal(t, target, report.Target)
+	require.Equal(t, 3, report.Moved)
+	require.FileExists(t, filepath.Join(target, a+".jwt"))
+	require.FileExists(t, sharded(dir, a, ""))
+	info, err := os.Stat(filepath.Join(target, b+".jwt"))
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Equal(mtime))
+	_, err = convert(false, target)
+	require.Error(t, err, "the target is not empty")
+
+	// back in place, the empty shard directories are removed
+	report, err = convert(false, "")
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Moved)
+	require.FileExists(t, filepath.Join(dir, a+".jwt"))
+	require.NoDirExists(t, filepath.Dir(sharded(dir, a, "")))
+
+	// an account in both layouts is kept once, unless the copies differ
+	write(sharded(dir, a, ""), aJWT)
+	report, err = convert(false, "")
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Kept)
+	require.NoFileExists(t, sharded(dir, a, ""))
+	write(sharded(dir, a, ""), bJWT)
+	_, err = convert(false, "")
+	require.Error(t, err)
+
+	config.Store.Type = conf.StoreNone
+	_, err = convert(false, "")
+	require.Error(t, err)
+}
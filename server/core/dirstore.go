@@ -0,0 +1,252 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	txSuffix      = ".tx"
+	deletedSuffix = ".deleted"
+)
+
+// errAccountNotFound is returned when deleting an account the store doesn't hold
+var errAccountNotFound = errors.New("account not found")
+
+// errStoreFull is returned when a new JWT doesn't fit into a limited store with the reject eviction policy
+var errStoreFull = errors.New("the store holds max_jwts JWTs and rejects new ones")
+
+// dirStore is the directory store with support for transactional applies and an optional read cache
+type dirStore struct {
+	*natsserver.DirJWTStore
+	dir   string
+	shard bool
+	cache *jwtCache
+}
+
+func (ds *dirStore) LoadAcc(publicKey string) (string, error) {
+	if theJWT, ok := ds.cache.get(publicKey); ok {
+		return theJWT, nil
+	}
+	version := ds.cache.current()
+	theJWT, err := ds.DirJWTStore.LoadAcc(publicKey)
+	if err == nil {
+		ds.cache.putIfCurrent(publicKey, theJWT, version)
+	}
+	return theJWT, err
+}
+
+func (ds *dirStore) SaveAcc(publicKey string, theJWT string) error {
+	err := ds.DirJWTStore.SaveAcc(publicKey, theJWT)
+	ds.cache.remove(publicKey)
+	return storeFull(err)
+}
+
+func (ds *dirStore) SaveAct(hash string, theJWT string) error {
+	return storeFull(ds.DirJWTStore.SaveAct(hash, theJWT))
+}
+
+// storeFull replaces the error of the nats-server store when it is full, which has no error value to test for
+func storeFull(err error) error {
+	if err != nil && err.Error() == "jwt store is full" {
+		return errStoreFull
+	}
+	return err
+}
+
+// Merge invalidates the cached JWTs of every account in the pack, the store only keeps the newer ones
+func (ds *dirStore) Merge(pack string) error {
+	err := ds.DirJWTStore.Merge(pack)
+	if ds.cache != nil {
+		for _, line := range strings.Split(pack, "\n") {
+			if split := strings.Split(line, "|"); len(split) == 2 {
+				ds.cache.remove(split[0])
+			}
+		}
+	}
+	return err
+}
+
+func (ds *dirStore) Reload() error {
+	ds.cache.clear()
+	return ds.DirJWTStore.Reload()
+}
+
+func (ds *dirStore) Close() {
+	ds.cache.clear()
+	ds.DirJWTStore.Close()
+}
+
+// pathForKey mirrors the file layout of the directory store
+func (ds *dirStore) pathForKey(publicKey string) string {
+	name := publicKey + ".jwt"
+	if ds.shard {
+		return filepath.Join(ds.dir, publicKey[len(publicKey)-2:], name)
+	}
+	return filepath.Join(ds.dir, name)
+}
+
+// keys lists the public keys of the account JWTs in the directory, without reading them
+func (ds *dirStore) keys() ([]string, error) {
+	ds.Lock()
+	defer ds.Unlock()
+	var keys []string
+	err := filepath.WalkDir(ds.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != ds.dir && !ds.shard {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if pubKey := strings.TrimSuffix(d.Name(), ".jwt"); pubKey != d.Name() && nkeys.IsValidPublicAccountKey(pubKey) {
+			keys = append(keys, pubKey)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// sequence keeps the sequence of update responses in a file in the store directory
+func (ds *dirStore) sequence() (sequence, error) {
+	return &fileSequence{path: filepath.Join(ds.dir, sequenceFileName)}, nil
+}
+
+// txEntry is one JWT in a transaction, old is nil if the account is new
+type txEntry struct {
+	path string
+	tmp  string
+	old  []byte
+}
+
+// ApplyAccs writes every JWT to a temporary file, then renames them into place while holding
+// the store lock. If any step fails the files already renamed are restored. The store is
+// reloaded afterwards, which updates its index and calls the change callback.
+func (ds *dirStore) ApplyAccs(jwts map[string]string) error {
+	if ds.IsReadOnly() {
+		return fmt.Errorf("store is read-only")
+	}
+	entries := make([]*txEntry, 0, len(jwts))
+	cleanup := func() {
+		for _, e := range entries {
+			os.Remove(e.tmp)
+		}
+	}
+	for pubKey, theJWT := range jwts {
+		if !nkeys.IsValidPublicAccountKey(pubKey) {
+			cleanup()
+			return fmt.Errorf("%s is not a valid public account key", pubKey)
+		}
+		if theJWT == "" {
+			cleanup()
+			return fmt.Errorf("empty JWT for %s", ShortKey(pubKey))
+		}
+		e := &txEntry{path: ds.pathForKey(pubKey)}
+		e.tmp = e.path + txSuffix
+		if err := os.MkdirAll(filepath.Dir(e.path), 0755); err != nil {
+			cleanup()
+			return err
+		}
+		if err := os.WriteFile(e.tmp, []byte(theJWT), 0644); err != nil {
+			cleanup()
+			return err
+		}
+		entries = append(entries, e)
+	}
+
+	ds.Lock()
+	committed := 0
+	var err error
+	for _, e := range entries {
+		if old, readErr := os.ReadFile(e.path); readErr == nil {
+			e.old = old
+		} else if !os.IsNotExist(readErr) {
+			err = readErr
+			break
+		}
+		if err = os.Rename(e.tmp, e.path); err != nil {
+			break
+		}
+		committed++
+	}
+	if err != nil {
+		for _, e := range entries[:committed] {
+			if e.old == nil {
+				os.Remove(e.path)
+			} else {
+				os.WriteFile(e.path, e.old, 0644)
+			}
+		}
+		cleanup()
+	}
+	ds.Unlock()
+	if err != nil {
+		return fmt.Errorf("transaction rolled back: %v", err)
+	}
+	return ds.Reload()
+}
+
+// DeleteAcc renames the account JWT with a .deleted suffix, so it is no longer served but can be
+// restored by hand, and reloads the store so the index no longer holds it
+func (ds *dirStore) DeleteAcc(publicKey string) error {
+	if err := ds.remove(publicKey); err != nil {
+		return err
+	}
+	return ds.Reload()
+}
+
+// deleteAccs deletes the accounts like DeleteAcc, reloading the store once. Accounts the store doesn't
+// hold are skipped.
+func (ds *dirStore) deleteAccs(publicKeys []string) error {
+	for _, publicKey := range publicKeys {
+		if err := ds.remove(publicKey); err != nil && err != errAccountNotFound {
+			ds.Reload()
+			return err
+		}
+	}
+	return ds.Reload()
+}
+
+// remove renames the account JWT without reloading the store
+func (ds *dirStore) remove(publicKey string) error {
+	if ds.IsReadOnly() {
+		return fmt.Errorf("store is read-only")
+	}
+	if !nkeys.IsValidPublicAccountKey(publicKey) {
+		return fmt.Errorf("%s is not a valid public account key", publicKey)
+	}
+	path := ds.pathForKey(publicKey)
+	ds.Lock()
+	err := os.Rename(path, path+deletedSuffix)
+	ds.Unlock()
+	if os.IsNotExist(err) {
+		return errAccountNotFound
+	} else if err != nil {
+		return err
+	}
+	ds.cache.remove(publicKey)
+	return nil
+}
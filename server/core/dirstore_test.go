@@ -0,0 +1,113 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func newAccountJWT(t *testing.T, signer nkeys.KeyPair) (string, string) {
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(signer)
+	require.NoError(t, err)
+	return pubKey, acctJWT
+}
+
+func TestApplyAccs(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	ds := testEnv.Server.JWTStore.(*dirStore)
+
+	jwts := map[string]string{}
+	for i := 0; i < 3; i++ {
+		pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+		jwts[pubKey] = acctJWT
+	}
+	before := ds.Hash()
+	require.NoError(t, ds.ApplyAccs(jwts))
+	require.NotEqual(t, before, ds.Hash())
+	for pubKey, acctJWT := range jwts {
+		stored, err := ds.LoadAcc(pubKey)
+		require.NoError(t, err)
+		require.Equal(t, acctJWT, stored)
+	}
+}
+
+func TestApplyAccsRollback(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	ds := testEnv.Server.JWTStore.(*dirStore)
+
+	existing, oldJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.NoError(t, ds.SaveAcc(existing, oldJWT))
+	hash := ds.Hash()
+
+	newJWT, err := jwt.NewAccountClaims(existing).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	added, addedJWT := newAccountJWT(t, testEnv.OperatorKey)
+	blocked, blockedJWT := newAccountJWT(t, testEnv.OperatorKey)
+	// a directory in place of the file makes the rename fail
+	require.NoError(t, os.MkdirAll(filepath.Join(ds.pathForKey(blocked), "x"), 0755))
+
+	err = ds.ApplyAccs(map[string]string{existing: newJWT, added: addedJWT, blocked: blockedJWT})
+	require.Error(t, err)
+
+	stored, err := ds.LoadAcc(existing)
+	require.NoError(t, err)
+	require.Equal(t, oldJWT, stored)
+	_, err = ds.LoadAcc(added)
+	require.Error(t, err)
+	require.Equal(t, hash, ds.Hash())
+	leftovers, err := filepath.Glob(filepath.Join(testEnv.Server.config.Store.Dir, "*"+txSuffix))
+	require.NoError(t, err)
+	require.Empty(t, leftovers)
+}
+
+func TestTransactionalMerge(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	other, _ := newAccountJWT(t, testEnv.OperatorKey)
+	pack := fmt.Sprintf("%s|%s\n%s|notajwt\n", pubKey, acctJWT, other)
+
+	packer := testEnv.Server.JWTStore.(store.PackableJWTStore)
+	require.Error(t, testEnv.Server.mergePack(context.Background(), "test", packer, pack))
+	// nothing is applied when a line is invalid
+	_, err = testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+
+	require.NoError(t, testEnv.Server.mergePack(context.Background(), "test", packer, fmt.Sprintf("%s|%s\n", pubKey, acctJWT)))
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, stored)
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/store"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+)
+
+// syncableStore is implemented by stores that can take part in the pack sync with other account servers
+type syncableStore interface {
+	store.JWTStore
+	store.PackableJWTStore
+	Hash() [sha256.Size]byte
+	PackWalk(maxJWTs int, cb func(partialPackMsg string)) error
+}
+
+// dualStore is used while migrating between stores, every write goes to both stores and reads
+// come from the primary with a fallback to the secondary. The primary is authoritative, failed
+// writes to the secondary and reads that differ are reported as divergences.
+type dualStore struct {
+	primary   syncableStore
+	secondary store.JWTStore
+	logger    natsserver.Logger
+	metrics   *metrics
+}
+
+func newDualStore(primary syncableStore, secondary store.JWTStore, logger natsserver.Logger, m *metrics) *dualStore {
+	m.describe("store_divergences_total", "counter", "Number of differences found between the primary and secondary store")
+	return &dualStore{primary: primary, secondary: secondary, logger: logger, metrics: m}
+}
+
+func (ds *dualStore) diverged(op string, key string, format string, args ...interface{}) {
+	ds.metrics.inc("store_divergences_total", "op", op)
+	ds.logger.Warnf("store divergence on %s of %s - %s", op, ShortKey(key), fmt.Sprintf(format, args...))
+}
+
+func (ds *dualStore) LoadAcc(publicKey string) (string, error) {
+	theJWT, err := ds.primary.LoadAcc(publicKey)
+	other, otherErr := ds.secondary.LoadAcc(publicKey)
+	switch {
+	case (err != nil || theJWT == "") && otherErr == nil && other != "":
+		ds.diverged("read", publicKey, "only in the secondary store")
+		return other, nil
+	case err == nil && theJWT != "" && (otherErr != nil || other == ""):
+		ds.diverged("read", publicKey, "missing from the secondary store")
+	case err == nil && otherErr == nil && theJWT != other:
+		ds.diverged("read", publicKey, "stores hold different JWTs")
+	}
+	return theJWT, err
+}
+
+func (ds *dualStore) SaveAcc(publicKey string, theJWT string) error {
+	if err := ds.primary.SaveAcc(publicKey, theJWT); err != nil {
+		return err
+	}
+	if err := ds.secondary.SaveAcc(publicKey, theJWT); err != nil {
+		ds.diverged("write", publicKey, "%v", err)
+	}
+	return nil
+}
+
+func (ds *dualStore) LoadAct(hash string) (string, error) {
+	theJWT, err := ds.primary.(store.JWTActivationStore).LoadAct(hash)
+	if err != nil || theJWT == "" {
+		if acts, ok := ds.secondary.(store.JWTActivationStore); ok {
+			if other, otherErr := acts.LoadAct(hash); otherErr == nil && other != "" {
+				ds.diverged("read", hash, "activation only in the secondary store")
+				return other, nil
+			}
+		}
+	}
+	return theJWT, err
+}
+
+func (ds *dualStore) SaveAct(hash string, theJWT string) error {
+	if err := ds.primary.(store.JWTActivationStore).SaveAct(hash, theJWT); err != nil {
+		return err
+	}
+	acts, ok := ds.secondary.(store.JWTActivationStore)
+	if !ok {
+		ds.diverged("write", hash, "secondary store does not hold activations")
+	} else if err := acts.SaveAct(hash, theJWT); err != nil {
+		ds.diverged("write", hash, "%v", err)
+	}
+	return nil
+}
+
+func (ds *dualStore) IsReadOnly() bool {
+	return ds.primary.IsReadOnly()
+}
+
+func (ds *dualStore) Close() {
+	ds.primary.Close()
+	ds.secondary.Close()
+}
+
+func (ds *dualStore) Pack(maxJWTs int) (string, error) {
+	return ds.primary.Pack(maxJWTs)
+}
+
+func (ds *dualStore) PackWalk(maxJWTs int, cb func(partialPackMsg string)) error {
+	return ds.primary.PackWalk(maxJWTs, cb)
+}
+
+// sequence keeps the sequence of update responses in the primary
+func (ds *dualStore) sequence() (sequence, error) {
+	seqs, ok := ds.primary.(sequenceStore)
+	if !ok {
+		return nil, fmt.Errorf("the primary store can't keep the sequence")
+	}
+	return seqs.sequence()
+}
+
+func (ds *dualStore) Hash() [sha256.Size]byte {
+	return ds.primary.Hash()
+}
+
+func (ds *dualStore) Merge(pack string) error {
+	if err := ds.primary.Merge(pack); err != nil {
+		return err
+	}
+	if packer, ok := ds.secondary.(store.PackableJWTStore); ok {
+		if err := packer.Merge(pack); err != nil {
+			ds.diverged("write", "pack", "%v", err)
+		}
+	}
+	return nil
+}
+
+// keys lists the accounts of the primary, if it can list them without reading the JWTs
+func (ds *dualStore) keys() ([]string, error) {
+	if lister, ok := ds.primary.(keyLister); ok {
+		return lister.keys()
+	}
+	return nil, errKeysNotListed
+}
+
+// DeleteAcc deletes from the primary, then from the secondary
+func (ds *dualStore) DeleteAcc(publicKey string) error {
+	deleter, ok := ds.primary.(store.DeletableJWTStore)
+	if !ok {
+		return fmt.Errorf("store does not support deletes")
+	}
+	if err := deleter.DeleteAcc(publicKey); err != nil {
+		return err
+	}
+	if deleter, ok := ds.secondary.(store.DeletableJWTStore); !ok {
+		ds.diverged("delete", publicKey, "secondary store does not support deletes")
+	} else if err := deleter.DeleteAcc(publicKey); err != nil && err != errAccountNotFound {
+		ds.diverged("delete", publicKey, "%v", err)
+	}
+	return nil
+}
+
+// ApplyAccs applies the JWTs to the primary as one transaction, then copies them to the secondary
+func (ds *dualStore) ApplyAccs(jwts map[string]string) error {
+	tx, ok := ds.primary.(store.TransactionalJWTStore)
+	if !ok {
+		return fmt.Errorf("store does not support transactions")
+	}
+	if err := tx.ApplyAccs(jwts); err != nil {
+		return err
+	}
+	for pubKey, theJWT := range jwts {
+		if err := ds.secondary.SaveAcc(pubKey, theJWT); err != nil {
+			ds.diverged("write", pubKey, "%v", err)
+		}
+	}
+	return nil
+}
+
+// parityReport lists the accounts that differ between the primary and secondary store
+type parityReport struct {
+	Checked       int      `json:"checked"`
+	Missing       []string `json:"missing"`        // in the primary, not in the secondary
+	OnlySecondary []string `json:"only_secondary"` // in the secondary, not in the primary
+	Different     []string `json:"different"`
+}
+
+// parity compares every account in the primary with the secondary, and the reverse if the
+// secondary can be packed
+func (ds *dualStore) parity() (*parityReport, error) {
+	pack, err := ds.primary.Pack(-1)
+	if err != nil {
+		return nil, err
+	}
+	report := &parityReport{Missing: []string{}, OnlySecondary: []string{}, Different: []string{}}
+	seen := map[string]struct{}{}
+	for _, line := range strings.Split(pack, "\n") {
+		split := strings.Split(line, "|")
+		if len(split) != 2 {
+			continue
+		}
+		seen[split[0]] = struct{}{}
+		report.Checked++
+		other, err := ds.secondary.LoadAcc(split[0])
+		if err != nil || other == "" {
+			report.Missing = append(report.Missing, split[0])
+		} else if other != split[1] {
+			report.Different = append(report.Different, split[0])
+		}
+	}
+	if packer, ok := ds.secondary.(store.PackableJWTStore); ok {
+		pack, err := packer.Pack(-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(pack, "\n") {
+			if split := strings.Split(line, "|"); len(split) == 2 {
+				if _, ok := seen[split[0]]; !ok {
+					report.OnlySecondary = append(report.OnlySecondary, split[0])
+				}
+			}
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.OnlySecondary)
+	sort.Strings(report.Different)
+	return report, nil
+}
+
+// getStoreParity handles GET /admin/v1/store/parity
+func (server *AccountServer) getStoreParity(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.Lock()
+	ds, ok := server.JWTStore.(*dualStore)
+	server.Unlock()
+	if !ok {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "dual-write is not enabled", "", nil, w)
+		return
+	}
+	report, err := ds.parity()
+	if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error comparing stores", "", err, w)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDualWriteStore(t *testing.T) {
+	secondary, err := os.MkdirTemp("", "secondary")
+	require.NoError(t, err)
+	defer os.RemoveAll(secondary)
+
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Store.DualWrite.Dir = secondary
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 3)
+	for pubKey, theJWT := range pubKeys {
+		data, err := os.ReadFile(filepath.Join(secondary, pubKey+".jwt"))
+		require.NoError(t, err)
+		require.Equal(t, theJWT, string(data))
+	}
+
+	parity := func() parityReport {
+		status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/store/parity", testAdminToken, "")
+		require.Equal(t, http.StatusOK, status)
+		report := parityReport{}
+		require.NoError(t, json.Unmarshal([]byte(body), &report))
+		return report
+	}
+	report := parity()
+	require.Equal(t, len(pubKeys), report.Checked)
+	require.Empty(t, report.Missing)
+	require.Empty(t, report.OnlySecondary)
+	require.Empty(t, report.Different)
+
+	var removed, moved string
+	for pubKey := range pubKeys {
+		if removed == "" {
+			removed = pubKey
+		} else if moved == "" {
+			moved = pubKey
+		}
+	}
+	require.NoError(t, os.Remove(filepath.Join(secondary, removed+".jwt")))
+	require.NoError(t, os.Remove(filepath.Join(testEnv.Server.config.Store.Dir, moved+".jwt")))
+	require.NoError(t, testEnv.Server.JWTStore.(*dualStore).primary.(interface{ Reload() error }).Reload())
+
+	report = parity()
+	require.Equal(t, []string{removed}, report.Missing)
+	require.Equal(t, []string{moved}, report.OnlySecondary)
+
+	// reads fall back to the secondary
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + moved))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, pubKeys[moved], string(body))
+	require.Equal(t, float64(1), divergences(testEnv, "read"))
+}
+
+func divergences(testEnv *TestSetup, op string) float64 {
+	for _, s := range testEnv.Server.metrics.samples() {
+		if s.Name == "store_divergences_total" && s.Labels == `{op="`+op+`"}` {
+			return s.Value
+		}
+	}
+	return 0
+}
+
+func TestDualWriteSameDir(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	dir, err := os.MkdirTemp("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config.Store.Dir = dir
+	config.Store.DualWrite.Dir = dir
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
+
+func TestDualWriteBackend(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store.DualWrite.Type = "sqltest"
+	config.Store.DSN = t.Name()
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 2)
+	testDriver.Lock()
+	rows := testDriver.tables[t.Name()]
+	require.Len(t, rows, len(pubKeys))
+	for pubKey, theJWT := range pubKeys {
+		require.Equal(t, theJWT, rows[pubKey])
+	}
+	testDriver.Unlock()
+
+	config = conf.DefaultServerConfig()
+	config.Store.DualWrite.Type = "unknown"
+	testEnv, err = SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+)
+
+// NewEmbeddedAccountServer creates an account server that runs in the same process as ns. It logs
+// through ns, unless the config sets a custom logger, and connects to ns in process instead of over
+// TCP. Credentials, notification subjects and the rest still come from config.
+// ns has to be running before the returned server is started, and it is not shut down by Stop.
+func NewEmbeddedAccountServer(ns *natsserver.Server, config *conf.AccountServerConfig) (*AccountServer, error) {
+	if ns == nil {
+		return nil, fmt.Errorf("embedding requires a nats-server")
+	}
+	if config == nil {
+		config = conf.DefaultServerConfig()
+	}
+	if config.Logging.Custom == nil {
+		config.Logging.Custom = ns
+	}
+	if len(config.NATS.Servers) == 0 {
+		// only used in log messages, the connection itself doesn't use the network
+		config.NATS.Servers = []string{ns.ClientURL()}
+	}
+	server := NewAccountServer()
+	server.inProcess = ns
+	if err := server.InitializeFromConfig(config); err != nil {
+		return nil, err
+	}
+	server.logger = server.ConfigureLogger()
+	return server, nil
+}
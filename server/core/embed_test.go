@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	gnatsserver "github.com/nats-io/nats-server/v2/server"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedAccountServer(t *testing.T) {
+	ts := &TestSetup{}
+	defer ts.Cleanup()
+	require.NoError(t, ts.initKeys())
+
+	sysJWT, err := os.ReadFile(ts.SystemAccountJWTFile)
+	require.NoError(t, err)
+	resolver := &gnatsserver.MemAccResolver{}
+	require.NoError(t, resolver.Store(ts.SystemAccountPubKey, string(sysJWT)))
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	opts.TrustedKeys = []string{ts.OperatorPubKey}
+	opts.SystemAccount = ts.SystemAccountPubKey
+	opts.AccountResolver = resolver
+	ns := gnatsd.RunServer(&opts)
+	defer ns.Shutdown()
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = int(atomic.AddUint64(&port, 1))
+	config.OperatorJWTPath = ts.OperatorJWTFile
+	config.SystemAccountJWTPath = ts.SystemAccountJWTFile
+	config.NATS.UserCredentials = ts.SystemUserCredsFile
+	config.Store.Dir = t.TempDir()
+
+	_, err = NewEmbeddedAccountServer(nil, config)
+	require.Error(t, err)
+
+	server, err := NewEmbeddedAccountServer(ns, config)
+	require.NoError(t, err)
+	require.Equal(t, []string{ns.ClientURL()}, config.NATS.Servers)
+	require.NoError(t, server.Start())
+	ts.Server = server
+	require.True(t, server.Logger() == gnatsserver.Logger(ns), "logs through the nats-server")
+
+	require.Eventually(t, server.NATSConnected, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, "pipe", server.getNatsConnection().ConnectedAddr())
+
+	// notifications go out over the in process connection
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(ts.OperatorKey)
+	require.NoError(t, err)
+
+	nc, err := nats.Connect("", nats.InProcessServer(ns), nats.UserCredentials(ts.SystemUserCredsFile))
+	require.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(fmt.Sprintf(accountNotificationFormat, pubKey))
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	resp, err := http.Post(server.URL()+"/jwt/v1/accounts/"+pubKey, "application/jwt", bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	msg, err := sub.NextMsg(2 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, string(msg.Data))
+}
@@ -0,0 +1,605 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	defaultEtcdPrefix  = "/nats-account-server/accounts/"
+	defaultEtcdTimeout = 10 * time.Second
+	etcdPageSize       = 1000
+	etcdMergeRetries   = 3
+	etcdTxnOps         = 128 // the default --max-txn-ops of etcd
+	etcdWatchRetry     = time.Second
+)
+
+func init() {
+	RegisterStoreBackend("etcd", newEtcdStore)
+}
+
+// etcdStore keeps every account JWT under <prefix><pubkey> in an etcd v3 cluster, it speaks the JSON
+// gateway every etcd server serves next to gRPC on its client URLs. Several account servers can share
+// the cluster, Watch reports the JWTs saved by any of them.
+type etcdStore struct {
+	sync.Mutex
+	client    *http.Client
+	watcher   *http.Client // without a timeout, watches are long lived
+	endpoints []string
+	current   int // index of the endpoint that answered last
+	prefix    string
+	username  string
+	password  string
+	token     string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	health    watchHealth
+}
+
+func newEtcdStore(config conf.StoreConfig) (store.JWTStore, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, fmt.Errorf("store type etcd requires endpoints")
+	}
+	es := &etcdStore{
+		prefix:   config.Prefix,
+		username: config.Username,
+		password: config.Password,
+		watcher:  &http.Client{},
+	}
+	for _, e := range config.Endpoints {
+		if !strings.HasPrefix(e, "http://") && !strings.HasPrefix(e, "https://") {
+			return nil, fmt.Errorf("bad store endpoint %q, etcd endpoints are http or https URLs", e)
+		}
+		es.endpoints = append(es.endpoints, strings.TrimSuffix(e, "/"))
+	}
+	if es.prefix == "" {
+		es.prefix = defaultEtcdPrefix
+	}
+	timeout := defaultEtcdTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	es.client = &http.Client{Timeout: timeout}
+	es.ctx, es.cancel = context.WithCancel(context.Background())
+	return es, nil
+}
+
+// etcdInt decodes the 64 bit integers of the gateway, which are sent as strings
+type etcdInt int64
+
+func (i *etcdInt) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*i = etcdInt(n)
+	return err
+}
+
+type etcdKV struct {
+	Key         []byte  `json:"key"` // []byte is base64 in JSON, as the gateway expects
+	Value       []byte  `json:"value"`
+	ModRevision etcdInt `json:"mod_revision"`
+}
+
+type etcdHeader struct {
+	Revision etcdInt `json:"revision"`
+}
+
+type etcdRangeRequest struct {
+	Key            []byte `json:"key"`
+	RangeEnd       []byte `json:"range_end,omitempty"`
+	Limit          int64  `json:"limit,omitempty"`
+	CountOnly      bool   `json:"count_only,omitempty"`
+	KeysOnly       bool   `json:"keys_only,omitempty"`
+	MinModRevision int64  `json:"min_mod_revision,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []etcdKV   `json:"kvs"`
+	More   bool       `json:"more"`
+	Count  etcdInt    `json:"count"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdDeleteRequest struct {
+	Key []byte `json:"key"`
+}
+
+type etcdDeleteResponse struct {
+	Deleted etcdInt `json:"deleted"`
+}
+
+type etcdCompare struct {
+	Key         []byte `json:"key"`
+	Target      string `json:"target"`
+	Result      string `json:"result"`
+	ModRevision int64  `json:"mod_revision"`
+}
+
+type etcdRequestOp struct {
+	RequestPut *etcdPutRequest `json:"request_put,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare,omitempty"`
+	Success []etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// prefixEnd is the range end covering every key starting with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+func (es *etcdStore) key(publicKey string) []byte {
+	return []byte(es.prefix + publicKey)
+}
+
+// request posts to every endpoint in turn, starting with the last that answered
+func (es *etcdStore) request(client *http.Client, ctx context.Context, path string, body []byte) (*http.Response, error) {
+	es.Lock()
+	start, token := es.current, es.token
+	es.Unlock()
+	var lastErr error
+	for i := 0; i < len(es.endpoints); i++ {
+		idx := (start + i) % len(es.endpoints)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, es.endpoints[idx]+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(ContentType, ApplicationJSON)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		es.Lock()
+		es.current = idx
+		es.Unlock()
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// call sends a request to the gateway and decodes the response, authenticating first if needed
+func (es *etcdStore) call(path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := es.request(es.client, es.ctx, path, body)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusOK {
+			if response == nil {
+				return nil
+			}
+			return json.Unmarshal(data, response)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && es.username != "" && attempt == 0 {
+			if err := es.authenticate(); err != nil {
+				return err
+			}
+			continue
+		}
+		failure := struct {
+			Message string `json:"message"`
+		}{}
+		json.Unmarshal(data, &failure)
+		return fmt.Errorf("etcd %s returned %d %s", path, resp.StatusCode, failure.Message)
+	}
+}
+
+// authenticate exchanges the user name and password for a token
+func (es *etcdStore) authenticate() error {
+	body, err := json.Marshal(map[string]string{"name": es.username, "password": es.password})
+	if err != nil {
+		return err
+	}
+	resp, err := es.request(es.client, es.ctx, "/v3/auth/authenticate", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd authentication returned %d", resp.StatusCode)
+	}
+	auth := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return err
+	}
+	es.Lock()
+	es.token = auth.Token
+	es.Unlock()
+	return nil
+}
+
+// get returns the stored JWT and its revision, found is false if there is none
+func (es *etcdStore) get(publicKey string) (string, int64, bool, error) {
+	resp := etcdRangeResponse{}
+	if err := es.call("/v3/kv/range", etcdRangeRequest{Key: es.key(publicKey)}, &resp); err != nil {
+		return "", 0, false, err
+	}
+	if len(resp.KVs) == 0 {
+		return "", 0, false, nil
+	}
+	return string(resp.KVs[0].Value), int64(resp.KVs[0].ModRevision), true, nil
+}
+
+func (es *etcdStore) LoadAcc(publicKey string) (string, error) {
+	theJWT, _, found, err := es.get(publicKey)
+	if err == nil && !found {
+		err = fmt.Errorf("no JWT for %s", ShortKey(publicKey))
+	}
+	return theJWT, err
+}
+
+func (es *etcdStore) SaveAcc(publicKey string, theJWT string) error {
+	return es.call("/v3/kv/put", etcdPutRequest{Key: es.key(publicKey), Value: []byte(theJWT)}, nil)
+}
+
+func (es *etcdStore) DeleteAcc(publicKey string) error {
+	resp := etcdDeleteResponse{}
+	if err := es.call("/v3/kv/deleterange", etcdDeleteRequest{Key: es.key(publicKey)}, &resp); err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return errAccountNotFound
+	}
+	return nil
+}
+
+// ApplyAccs saves the JWTs that are newer than the stored ones. etcd limits a transaction to 128
+// operations by default, so the JWTs are put in chunks of that size, each chunk is all or nothing.
+// Every put compares the mod revision the stored JWT was checked at, a chunk that lost a race with
+// another writer is checked and tried again.
+func (es *etcdStore) ApplyAccs(jwts map[string]string) error {
+	keys := make([]string, 0, len(jwts))
+	for pubKey := range jwts {
+		keys = append(keys, pubKey)
+	}
+	sort.Strings(keys)
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > etcdTxnOps {
+			n = etcdTxnOps
+		}
+		if err := es.applyChunk(keys[:n], jwts); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func (es *etcdStore) applyChunk(keys []string, jwts map[string]string) error {
+	for i := 0; i < etcdMergeRetries; i++ {
+		txn := etcdTxnRequest{}
+		for _, pubKey := range keys {
+			existing, revision, _, err := es.get(pubKey)
+			if err != nil {
+				return err
+			}
+			if newer, err := isNewerJWT(pubKey, existing, jwts[pubKey]); err != nil {
+				return fmt.Errorf("%s: %v", ShortKey(pubKey), err)
+			} else if !newer {
+				continue
+			}
+			txn.Compare = append(txn.Compare, etcdCompare{Key: es.key(pubKey), Target: "MOD", Result: "EQUAL", ModRevision: revision})
+			txn.Success = append(txn.Success, etcdRequestOp{RequestPut: &etcdPutRequest{Key: es.key(pubKey), Value: []byte(jwts[pubKey])}})
+		}
+		if len(txn.Success) == 0 {
+			return nil
+		}
+		resp := etcdTxnResponse{}
+		if err := es.call("/v3/kv/txn", txn, &resp); err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+	}
+	return fmt.Errorf("accounts kept changing while applying %d JWTs", len(keys))
+}
+
+func (es *etcdStore) IsReadOnly() bool {
+	return false
+}
+
+func (es *etcdStore) Close() {
+	es.cancel()
+	es.client.CloseIdleConnections()
+	es.watcher.CloseIdleConnections()
+}
+
+// each calls fn with every stored key and JWT, one page at a time
+func (es *etcdStore) each(fn func(pubKey string, theJWT string) bool) error {
+	return es.scan(false, fn)
+}
+
+// keys lists the stored public keys, without reading the JWTs
+func (es *etcdStore) keys() ([]string, error) {
+	var keys []string
+	err := es.scan(true, func(pubKey string, _ string) bool {
+		keys = append(keys, pubKey)
+		return true
+	})
+	return keys, err
+}
+
+// scan calls fn with every stored key, and JWT unless keysOnly is set, one page at a time
+func (es *etcdStore) scan(keysOnly bool, fn func(pubKey string, theJWT string) bool) error {
+	from := []byte(es.prefix)
+	end := prefixEnd(es.prefix)
+	for {
+		resp := etcdRangeResponse{}
+		if err := es.call("/v3/kv/range", etcdRangeRequest{Key: from, RangeEnd: end, Limit: etcdPageSize, KeysOnly: keysOnly}, &resp); err != nil {
+			return err
+		}
+		for _, kv := range resp.KVs {
+			if !fn(strings.TrimPrefix(string(kv.Key), es.prefix), string(kv.Value)) {
+				return nil
+			}
+		}
+		if !resp.More || len(resp.KVs) == 0 {
+			return nil
+		}
+		from = append(resp.KVs[len(resp.KVs)-1].Key, 0)
+	}
+}
+
+// size is the number of JWTs under the prefix, 0 if it can't be counted
+func (es *etcdStore) size() int {
+	resp := etcdRangeResponse{}
+	if err := es.call("/v3/kv/range", etcdRangeRequest{Key: []byte(es.prefix), RangeEnd: prefixEnd(es.prefix), CountOnly: true}, &resp); err != nil {
+		return 0
+	}
+	return int(resp.Count)
+}
+
+// Pack returns up to maxJWTs unexpired JWTs
+func (es *etcdStore) Pack(maxJWTs int) (string, error) {
+	var pack []string
+	now := time.Now().Unix()
+	err := es.each(func(pubKey string, theJWT string) bool {
+		if len(pack) == maxJWTs {
+			return false
+		}
+		if claim, err := jwt.DecodeGeneric(theJWT); err == nil && claim.Expires > 0 && claim.Expires < now {
+			return true
+		}
+		pack = append(pack, fmt.Sprintf("%s|%s", pubKey, theJWT))
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(pack, "\n"), nil
+}
+
+// Merge saves the JWTs in the pack that are newer than the stored ones. Each JWT is only written if
+// the stored one didn't change since it was compared, so concurrent merges by other servers are safe.
+func (es *etcdStore) Merge(pack string) error {
+	for _, line := range strings.Split(pack, "\n") {
+		if line == "" {
+			continue
+		}
+		split := strings.Split(line, "|")
+		if len(split) != 2 {
+			return fmt.Errorf("line in package didn't contain 2 entries: %q", line)
+		}
+		pubKey, theJWT := split[0], split[1]
+		if !nkeys.IsValidPublicAccountKey(pubKey) {
+			return fmt.Errorf("key to merge is not a valid public account key")
+		}
+		if err := es.mergeOne(pubKey, theJWT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *etcdStore) mergeOne(pubKey string, theJWT string) error {
+	for i := 0; i < etcdMergeRetries; i++ {
+		existing, revision, _, err := es.get(pubKey)
+		if err != nil {
+			return err
+		}
+		if newer, err := isNewerJWT(pubKey, existing, theJWT); err != nil {
+			return err
+		} else if !newer {
+			return nil
+		}
+		// a revision of 0 compares equal only while the key doesn't exist
+		txn := etcdTxnRequest{
+			Compare: []etcdCompare{{Key: es.key(pubKey), Target: "MOD", Result: "EQUAL", ModRevision: revision}},
+			Success: []etcdRequestOp{{RequestPut: &etcdPutRequest{Key: es.key(pubKey), Value: []byte(theJWT)}}},
+		}
+		resp := etcdTxnResponse{}
+		if err := es.call("/v3/kv/txn", txn, &resp); err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+	}
+	return fmt.Errorf("account %s kept changing while merging", ShortKey(pubKey))
+}
+
+type etcdWatchCreate struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end"`
+	StartRevision int64  `json:"start_revision,omitempty"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Header          etcdHeader `json:"header"`
+		Canceled        bool       `json:"canceled"`
+		CompactRevision etcdInt    `json:"compact_revision"` // set if the start revision was compacted
+		Events          []struct {
+			Type string `json:"type"` // PUT is the default and left out
+			KV   etcdKV `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Watch calls changed with the public key of every JWT saved, by this or any other account server,
+// until the store is closed. Watches that fail are restarted from the last revision seen, if etcd
+// compacted that revision away the JWTs changed since are read again.
+func (es *etcdStore) Watch(changed func(publicKey string)) error {
+	resp := etcdRangeResponse{}
+	if err := es.call("/v3/kv/range", etcdRangeRequest{Key: []byte(es.prefix), RangeEnd: prefixEnd(es.prefix), CountOnly: true}, &resp); err != nil {
+		return err
+	}
+	go func() {
+		next := int64(resp.Header.Revision) + 1
+		for {
+			var err error
+			next, err = es.watch(next, changed)
+			if err == errEtcdCompacted {
+				es.health.rescanned()
+				next, err = es.rescan(next, changed)
+			}
+			if es.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				es.health.failed(err)
+				time.Sleep(etcdWatchRetry)
+			}
+		}
+	}()
+	return nil
+}
+
+var errEtcdCompacted = errors.New("etcd compacted the revision to watch from")
+
+func (es *etcdStore) watchState() watchState {
+	return es.health.get()
+}
+
+// rescan calls changed for every JWT modified since the revision and returns the revision to watch from
+func (es *etcdStore) rescan(since int64, changed func(publicKey string)) (int64, error) {
+	from := []byte(es.prefix)
+	end := prefixEnd(es.prefix)
+	next := since
+	for {
+		resp := etcdRangeResponse{}
+		if err := es.call("/v3/kv/range", etcdRangeRequest{Key: from, RangeEnd: end, Limit: etcdPageSize, MinModRevision: since}, &resp); err != nil {
+			return since, err
+		}
+		if rev := int64(resp.Header.Revision) + 1; rev > next {
+			next = rev
+		}
+		for _, kv := range resp.KVs {
+			changed(strings.TrimPrefix(string(kv.Key), es.prefix))
+		}
+		if !resp.More || len(resp.KVs) == 0 {
+			return next, nil
+		}
+		from = append(resp.KVs[len(resp.KVs)-1].Key, 0)
+	}
+}
+
+// watch follows one watch stream and returns the revision to resume from
+func (es *etcdStore) watch(next int64, changed func(publicKey string)) (int64, error) {
+	body, err := json.Marshal(map[string]interface{}{"create_request": etcdWatchCreate{
+		Key: []byte(es.prefix), RangeEnd: prefixEnd(es.prefix), StartRevision: next}})
+	if err != nil {
+		return next, err
+	}
+	resp, err := es.request(es.watcher, es.ctx, "/v3/watch", body)
+	if err != nil {
+		return next, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return next, fmt.Errorf("etcd watch returned %d", resp.StatusCode)
+	}
+	es.health.up()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		w := etcdWatchResponse{}
+		if err := dec.Decode(&w); err != nil {
+			return next, err
+		}
+		if w.Error != nil {
+			return next, errors.New(w.Error.Message)
+		}
+		if w.Result.Canceled && w.Result.CompactRevision > 0 {
+			return next, errEtcdCompacted
+		} else if w.Result.Canceled {
+			return next, errors.New("etcd canceled the watch")
+		}
+		if len(w.Result.Events) > 0 {
+			es.health.event()
+		}
+		for _, e := range w.Result.Events {
+			if e.Type == "" || e.Type == "PUT" {
+				changed(strings.TrimPrefix(string(e.KV.Key), es.prefix))
+			}
+			if rev := int64(e.KV.ModRevision) + 1; rev > next {
+				next = rev
+			}
+		}
+	}
+}
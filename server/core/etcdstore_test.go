@@ -0,0 +1,370 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeEtcdKV struct {
+	value       string
+	modRevision int64
+}
+
+// fakeEtcd serves the part of the etcd JSON gateway the store uses from memory, ranges return one
+// key per page to exercise paging
+type fakeEtcd struct {
+	sync.Mutex
+	revision int64
+	kvs      map[string]fakeEtcdKV
+	watches  []chan map[string]interface{}
+	compact  int64 // watches starting at or before this revision are canceled
+	maxTxn   int   // the most operations in one transaction
+}
+
+// dropWatches ends every open watch stream
+func (f *fakeEtcd) dropWatches() {
+	for _, w := range f.watches {
+		close(w)
+	}
+	f.watches = nil
+}
+
+func (f *fakeEtcd) put(key string, value string) map[string]interface{} {
+	f.revision++
+	f.kvs[key] = fakeEtcdKV{value: value, modRevision: f.revision}
+	event := map[string]interface{}{"kv": map[string]interface{}{
+		"key": []byte(key), "value": []byte(value), "mod_revision": fmt.Sprint(f.revision)}}
+	for _, w := range f.watches {
+		w <- event
+	}
+	return event
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "token" && r.URL.Path != "/v3/auth/authenticate" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&req)
+	field := func(name string, v interface{}) {
+		if data, ok := req[name]; ok {
+			json.Unmarshal(data, v)
+		}
+	}
+	if r.URL.Path == "/v3/watch" {
+		var create etcdWatchCreate
+		field("create_request", &create)
+		events := make(chan map[string]interface{}, 10)
+		f.Lock()
+		compacted := create.StartRevision <= f.compact
+		if !compacted {
+			f.watches = append(f.watches, events)
+		}
+		f.Unlock()
+		if compacted {
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{
+				"canceled": true, "compact_revision": fmt.Sprint(f.compact)}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"events": []interface{}{e}}})
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	var key, rangeEnd []byte
+	field("key", &key)
+	field("range_end", &rangeEnd)
+	resp := map[string]interface{}{"header": map[string]interface{}{"revision": fmt.Sprint(f.revision)}}
+	switch r.URL.Path {
+	case "/v3/auth/authenticate":
+		var name, password string
+		field("name", &name)
+		field("password", &password)
+		if name != "user" || password != "pass" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp["token"] = "token"
+	case "/v3/kv/range":
+		var keys []string
+		var minModRevision int64
+		field("min_mod_revision", &minModRevision)
+		for k, kv := range f.kvs {
+			if kv.modRevision < minModRevision {
+				continue
+			}
+			if k == string(key) || (len(rangeEnd) > 0 && k >= string(key) && k < string(rangeEnd)) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		resp["count"] = fmt.Sprint(len(keys))
+		var countOnly bool
+		field("count_only", &countOnly)
+		if len(keys) > 0 && !countOnly {
+			kv := f.kvs[keys[0]]
+			resp["kvs"] = []interface{}{map[string]interface{}{
+				"key": []byte(keys[0]), "value": []byte(kv.value), "mod_revision": fmt.Sprint(kv.modRevision)}}
+			resp["more"] = len(keys) > 1
+		}
+	case "/v3/kv/put":
+		var value []byte
+		field("value", &value)
+		f.put(string(key), string(value))
+	case "/v3/kv/deleterange":
+		if _, ok := f.kvs[string(key)]; ok {
+			delete(f.kvs, string(key))
+			resp["deleted"] = "1"
+		}
+	case "/v3/kv/txn":
+		var txn etcdTxnRequest
+		json.Unmarshal(mustMarshal(req), &txn)
+		if len(txn.Success) > f.maxTxn {
+			f.maxTxn = len(txn.Success)
+		}
+		for _, c := range txn.Compare {
+			if f.kvs[string(c.Key)].modRevision != c.ModRevision {
+				json.NewEncoder(w).Encode(resp)
+				return
+			}
+		}
+		for _, op := range txn.Success {
+			f.put(string(op.RequestPut.Key), string(op.RequestPut.Value))
+		}
+		resp["succeeded"] = true
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func mustMarshal(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func TestEtcdStore(t *testing.T) {
+	fake := &fakeEtcd{kvs: map[string]fakeEtcdKV{"/other": {value: "x"}}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	config := conf.StoreConfig{Type: "etcd"}
+	_, err := newEtcdStore(config)
+	require.Error(t, err, "endpoints are required")
+	// the first endpoint is down
+	config.Endpoints = []string{"http://127.0.0.1:1", ts.URL}
+	config.Username, config.Password = "user", "pass"
+	s, err := newEtcdStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	es := s.(*etcdStore)
+
+	changed := make(chan string, 10)
+	require.NoError(t, es.Watch(func(pubKey string) { changed <- pubKey }))
+
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	jwts := map[string]string{}
+	for i := 0; i < 3; i++ {
+		pubKey, theJWT := newAccountJWT(t, operatorKey)
+		jwts[pubKey] = theJWT
+	}
+
+	var pack []string
+	for pubKey, theJWT := range jwts {
+		_, err := es.LoadAcc(pubKey)
+		require.Error(t, err)
+		pack = append(pack, pubKey+"|"+theJWT)
+	}
+	require.NoError(t, es.Merge(strings.Join(pack, "\n")))
+	require.Len(t, fake.kvs, 4)
+	require.Equal(t, 3, es.size())
+	for pubKey, theJWT := range jwts {
+		loaded, err := es.LoadAcc(pubKey)
+		require.NoError(t, err)
+		require.Equal(t, theJWT, loaded)
+		require.Equal(t, theJWT, fake.kvs[defaultEtcdPrefix+pubKey].value)
+	}
+	// merging again changes nothing
+	revision := fake.revision
+	require.NoError(t, es.Merge(strings.Join(pack, "\n")))
+	require.Equal(t, revision, fake.revision)
+
+	for range jwts {
+		select {
+		case pubKey := <-changed:
+			require.Contains(t, jwts, pubKey)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no change reported")
+		}
+	}
+
+	packed, err := es.Pack(-1)
+	require.NoError(t, err)
+	require.ElementsMatch(t, pack, strings.Split(packed, "\n"))
+	packed, err = es.Pack(2)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(packed, "\n"), 2)
+
+	for pubKey := range jwts {
+		require.NoError(t, es.DeleteAcc(pubKey))
+		require.Equal(t, errAccountNotFound, es.DeleteAcc(pubKey))
+		break
+	}
+	require.Equal(t, 2, es.size())
+
+	// another server writing to the cluster
+	pubKey, theJWT := newAccountJWT(t, operatorKey)
+	require.NoError(t, es.ApplyAccs(map[string]string{pubKey: theJWT}))
+	select {
+	case changedKey := <-changed:
+		require.Equal(t, pubKey, changedKey)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change reported")
+	}
+
+	es.password, es.token = "wrong", ""
+	_, err = es.Pack(-1)
+	require.Error(t, err)
+}
+
+func TestEtcdApplyAccs(t *testing.T) {
+	fake := &fakeEtcd{kvs: map[string]fakeEtcdKV{}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	s, err := newEtcdStore(conf.StoreConfig{Type: "etcd", Endpoints: []string{ts.URL}, Username: "user", Password: "pass"})
+	require.NoError(t, err)
+	defer s.Close()
+	es := s.(*etcdStore)
+
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	jwts := map[string]string{}
+	for i := 0; i < etcdTxnOps*2+1; i++ {
+		pubKey, theJWT := newAccountJWT(t, operatorKey)
+		jwts[pubKey] = theJWT
+	}
+	require.NoError(t, es.ApplyAccs(jwts))
+	require.Equal(t, len(jwts), es.size())
+	require.Equal(t, etcdTxnOps, fake.maxTxn)
+
+	// a JWT older than the stored one is skipped
+	var pubKey string
+	for pubKey = range jwts {
+		break
+	}
+	time.Sleep(1100 * time.Millisecond) // issued at has a resolution of seconds
+	newerJWT, err := jwt.NewAccountClaims(pubKey).Encode(operatorKey)
+	require.NoError(t, err)
+	require.NoError(t, es.ApplyAccs(map[string]string{pubKey: newerJWT}))
+	revision := fake.revision
+	require.NoError(t, es.ApplyAccs(map[string]string{pubKey: jwts[pubKey]}))
+	require.Equal(t, revision, fake.revision)
+	loaded, err := es.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, newerJWT, loaded)
+}
+
+func TestEtcdWatchRestart(t *testing.T) {
+	fake := &fakeEtcd{kvs: map[string]fakeEtcdKV{}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	s, err := newEtcdStore(conf.StoreConfig{Type: "etcd", Endpoints: []string{ts.URL}, Username: "user", Password: "pass"})
+	require.NoError(t, err)
+	defer s.Close()
+	es := s.(*etcdStore)
+
+	changed := make(chan string, 10)
+	require.NoError(t, es.Watch(func(pubKey string) { changed <- pubKey }))
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	next := func() string {
+		select {
+		case pubKey := <-changed:
+			return pubKey
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change reported")
+			return ""
+		}
+	}
+
+	// the fake doesn't replay events from the start revision
+	require.Eventually(t, func() bool { return es.watchState().Up }, 5*time.Second, 10*time.Millisecond)
+	first, firstJWT := newAccountJWT(t, operatorKey)
+	require.NoError(t, es.SaveAcc(first, firstJWT))
+	require.Equal(t, first, next())
+	state := es.watchState()
+	require.True(t, state.Up)
+	require.False(t, state.LastEvent.IsZero())
+	require.Zero(t, state.Restarts)
+
+	// the watch breaks and the JWT saved meanwhile is compacted out of the history
+	missed, missedJWT := newAccountJWT(t, operatorKey)
+	fake.Lock()
+	fake.dropWatches()
+	fake.put(defaultEtcdPrefix+missed, missedJWT)
+	fake.compact = fake.revision
+	fake.Unlock()
+	require.Equal(t, missed, next())
+
+	third, thirdJWT := newAccountJWT(t, operatorKey)
+	require.Eventually(t, func() bool { return es.watchState().Up }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, es.SaveAcc(third, thirdJWT))
+	require.Equal(t, third, next())
+
+	state = es.watchState()
+	require.True(t, state.Up)
+	require.Equal(t, 1, state.Rescans)
+	require.GreaterOrEqual(t, state.Errors, 1)
+	require.GreaterOrEqual(t, state.Restarts, 1)
+	require.NotEmpty(t, state.LastError)
+	require.Empty(t, changed, "only the missed JWT is read again")
+
+	server := &AccountServer{JWTStore: es}
+	require.Empty(t, server.watchDown())
+	es.health.failed(errors.New("connection refused"))
+	es.health.state.Since = time.Now().Add(-2 * watchDownGrace)
+	require.Contains(t, server.watchDown(), "connection refused")
+}
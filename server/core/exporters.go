@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// statsd packets are kept below the common MTU
+const statsdMaxPacket = 1432
+
+// exporter pushes the metrics registry to an external system
+type exporter interface {
+	push(m *metrics) error
+	close()
+}
+
+// pushGateway replaces the metrics of this server in a prometheus push-gateway
+type pushGateway struct {
+	url    string
+	prefix string
+	client *http.Client
+}
+
+func newPushGateway(config conf.MetricsConfig, prefix string, instance string) *pushGateway {
+	job := config.Job
+	if job == "" {
+		job = defaultServerName
+	}
+	return &pushGateway{
+		url: fmt.Sprintf("%s/metrics/job/%s/instance/%s", strings.TrimSuffix(config.PushGateway, "/"),
+			url.PathEscape(job), url.PathEscape(instance)),
+		prefix: prefix,
+		client: &http.Client{Timeout: time.Duration(config.Interval) * time.Millisecond},
+	}
+}
+
+func (p *pushGateway) push(m *metrics) error {
+	var buf bytes.Buffer
+	m.writeWithPrefix(&buf, p.prefix)
+	req, err := http.NewRequest(http.MethodPut, p.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ContentType, "text/plain; version=0.0.4")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("push-gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *pushGateway) close() {}
+
+// statsd sends gauges as is and counters as the change since the last push. Labels are sent as
+// tags to DogStatsD and appended to the name for plain StatsD.
+type statsd struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+	last      map[string]float64
+}
+
+func newStatsD(config conf.MetricsConfig, prefix string) (*statsd, error) {
+	conn, err := net.Dial("udp", config.StatsD)
+	if err != nil {
+		return nil, err
+	}
+	return &statsd{conn: conn, prefix: prefix, dogstatsd: config.DogStatsD, last: map[string]float64{}}, nil
+}
+
+func (s *statsd) push(m *metrics) error {
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, smp := range m.samples() {
+		line := s.line(smp)
+		if line == "" {
+			continue
+		}
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > statsdMaxPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+func (s *statsd) line(smp metricSample) string {
+	value, kind := smp.Value, "g"
+	if smp.Kind == "counter" {
+		key := smp.Name + smp.Labels
+		value, kind = smp.Value-s.last[key], "c"
+		s.last[key] = smp.Value
+		if value == 0 {
+			return ""
+		}
+	}
+	name := s.prefix + smp.Name
+	var tags []string
+	for i := 0; i+1 < len(smp.LabelPairs); i += 2 {
+		if s.dogstatsd {
+			tags = append(tags, statsdClean(smp.LabelPairs[i])+":"+statsdClean(smp.LabelPairs[i+1]))
+		} else {
+			name += "." + statsdClean(smp.LabelPairs[i+1])
+		}
+	}
+	line := fmt.Sprintf("%s:%v|%s", name, value, kind)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+func (s *statsd) close() {
+	s.conn.Close()
+}
+
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", " ", "_")
+
+func statsdClean(v string) string {
+	return statsdReplacer.Replace(v)
+}
+
+// startExporters creates the configured exporters and pushes on an interval, assumes the lock is held
+func (server *AccountServer) startExporters() error {
+	config := server.config.Metrics
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = metricsPrefix
+	}
+	var exporters []exporter
+	if config.PushGateway != "" {
+		exporters = append(exporters, newPushGateway(config, prefix, server.id))
+	}
+	if config.StatsD != "" {
+		s, err := newStatsD(config, prefix)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, s)
+	}
+	if len(exporters) == 0 {
+		return nil
+	}
+	if config.Interval <= 0 {
+		return fmt.Errorf("metrics push interval must be positive")
+	}
+
+	quit := make(chan struct{})
+	server.stopExporters = quit
+	m := server.metrics
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Interval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				for _, e := range exporters {
+					e.close()
+				}
+				return
+			case <-ticker.C:
+			}
+			for _, e := range exporters {
+				if err := e.push(m); err != nil {
+					server.logger.Debugf("metrics push error: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
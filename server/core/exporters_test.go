@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushGatewayExporter(t *testing.T) {
+	lock := sync.Mutex{}
+	pushed := map[string]string{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := bytes.Buffer{}
+		buf.ReadFrom(r.Body)
+		lock.Lock()
+		pushed[r.Method+" "+r.URL.Path] = buf.String()
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	config := conf.DefaultServerConfig()
+	config.ServerID = "test-instance"
+	config.Metrics.PushGateway = gateway.URL
+	config.Metrics.Job = "accounts"
+	config.Metrics.Interval = 50
+	config.Metrics.Prefix = "nas_"
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	testEnv.Server.metrics.inc("pushed_total")
+
+	key := "PUT /metrics/job/accounts/instance/test-instance"
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return strings.Contains(pushed[key], "nas_pushed_total 1")
+	}, 2*time.Second, 10*time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	require.NotContains(t, pushed[key], metricsPrefix)
+}
+
+func TestStatsDExporter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	read := func() []string {
+		buf := make([]byte, statsdMaxPacket)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	m := newMetrics()
+	m.describe("requests_total", "counter", "")
+	m.add("requests_total", 3, "code", "200")
+	m.set("queue_depth", 2)
+
+	config := conf.MetricsConfig{StatsD: conn.LocalAddr().String()}
+	s, err := newStatsD(config, "nas.")
+	require.NoError(t, err)
+	defer s.close()
+
+	require.NoError(t, s.push(m))
+	require.Equal(t, []string{"nas.queue_depth:2|g", "nas.requests_total.200:3|c"}, read())
+
+	// counters are sent as the change since the last push
+	m.add("requests_total", 2, "code", "200")
+	require.NoError(t, s.push(m))
+	require.Equal(t, []string{"nas.queue_depth:2|g", "nas.requests_total.200:2|c"}, read())
+
+	config.DogStatsD = true
+	d, err := newStatsD(config, "nas.")
+	require.NoError(t, err)
+	defer d.close()
+	require.NoError(t, d.push(m))
+	require.Equal(t, []string{"nas.queue_depth:2|g", "nas.requests_total:5|c|#code:200"}, read())
+}
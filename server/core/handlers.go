@@ -57,8 +57,15 @@ func (h *JwtHandler) GetOperatorJWT(w http.ResponseWriter, r *http.Request, para
 		return
 	}
 
+	// the raw JWT and its decoded JSON are served on the same URL
+	w.Header().Add("Vary", "Accept")
+	if acceptsJSON(r) {
+		h.writeDecodedJSON(w, r, h.operatorSubject, h.operatorJWT)
+		return
+	}
+
 	if decode {
-		h.writeDecodedJWT(w, h.operatorSubject, h.operatorJWT)
+		h.writeDecodedJWT(w, r, h.operatorSubject, h.operatorJWT)
 		return
 	}
 
@@ -67,6 +74,38 @@ func (h *JwtHandler) GetOperatorJWT(w http.ResponseWriter, r *http.Request, para
 	w.Write([]byte(h.operatorJWT))
 }
 
+// operatorInfo describes a configured operator in GET /jwt/v1/operators
+type operatorInfo struct {
+	Subject       string   `json:"subject"`
+	Name          string   `json:"name"`
+	SigningKeys   []string `json:"signing_keys"`
+	SystemAccount string   `json:"system_account,omitempty"`
+	JWT           string   `json:"jwt"`
+}
+
+// GetOperators lists every configured operator, account JWTs signed by any of them are accepted
+func (h *JwtHandler) GetOperators(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	operators := make([]operatorInfo, 0, len(h.operators))
+	for _, op := range h.operators {
+		operators = append(operators, operatorInfo{
+			Subject:       op.claim.Subject,
+			Name:          op.claim.Name,
+			SigningKeys:   append([]string{}, op.claim.SigningKeys...),
+			SystemAccount: op.claim.SystemAccount,
+			JWT:           op.jwt,
+		})
+	}
+	data, err := unescapedIndentedMarshal(operators, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", "", err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 func (h *JwtHandler) writeJWTAsText(w http.ResponseWriter, pubKey string, theJWT string) {
 	w.Header().Add(ContentType, TextPlain)
 	w.WriteHeader(http.StatusOK)
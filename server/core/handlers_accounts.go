@@ -17,63 +17,146 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nats-io/jwt/v2" // only used to decode and validate, not for storage
+	"github.com/nats-io/nats-account-server/server/store"
 	"github.com/nats-io/nkeys"
 )
 
+// loadAccWithSource loads an account JWT along with the source that had it
+func (h *JwtHandler) loadAccWithSource(publicKey string) (string, string, error) {
+	if h.revoked.has(publicKey) {
+		return "", "", errAccountRevoked
+	}
+	if s, ok := h.jwtStore.(accountSource); ok {
+		return s.lookupAcc(publicKey)
+	}
+	theJWT, err := h.jwtStore.LoadAcc(publicKey)
+	return theJWT, lookupStore, err
+}
+
 func (h *JwtHandler) loadAccountJWT(publicKey string) (bool, *jwt.AccountClaims) {
+	_, ac, found := h.loadAccountJWTWithClaims(publicKey)
+	return found, ac
+}
+
+// loadAccountJWTWithClaims is loadAccountJWT for callers that need the stored JWT as well, i.e. for its ETag
+func (h *JwtHandler) loadAccountJWTWithClaims(publicKey string) (string, *jwt.AccountClaims, bool) {
 	theJwt, err := h.jwtStore.LoadAcc(publicKey)
 
 	if err != nil {
-		return false, nil
+		return "", nil, false
 	}
 
 	ac, err := jwt.DecodeAccountClaims(theJwt)
 	if err != nil {
-		return false, nil
+		return "", nil, false
 	}
 
-	return true, ac
+	return theJwt, ac, true
 }
 
 // UpdateAccountJWT is the target of the post request that updates an account JWT
 // Sends a nats notification
 func (h *JwtHandler) UpdateAccountJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	h.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
-	theJWT, err := io.ReadAll(r.Body)
-	defer r.Body.Close()
+	theJWT, ok := h.readBody(w, r, "bad JWT in request", "")
+	if !ok {
+		return
+	}
+	u := &accountUpdate{
+		pubKey:  params.ByName("pubkey"),
+		jwt:     theJWT,
+		ifMatch: r.Header.Get("If-Match"),
+		force:   strings.ToLower(r.URL.Query().Get("force")) == "true",
+		poster:  writeCredential(r),
+		header:  w.Header(),
+	}
+	status, err := h.updateAccount(r.Context(), u)
 	if err != nil {
-		h.sendErrorResponse(http.StatusBadRequest, "bad JWT in request", "", err, w)
+		writeErrorBody(w, status, err.Error())
 		return
 	}
+	if u.message != "" {
+		w.Header().Set(ContentType, TextPlain)
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(u.message))
+}
+
+// accountUpdate is a posted account JWT along with the request headers its checks read. The header
+// and message of the response are filled in by updateAccount.
+type accountUpdate struct {
+	pubKey  string // the account named by the path or subject, empty if there is none
+	jwt     []byte
+	ifMatch string // the If-Match header
+	force   bool   // roll the account back to an older JWT
+	poster  string // the credential of the request, see writeCredential
+
+	header  http.Header // warnings, Retry-After and the ETag
+	message string      // the body of a response that isn't an error
+}
+
+// rejectUpdate logs a rejected update like sendErrorResponse and returns the status with msg as error
+func (h *JwtHandler) rejectUpdate(status int, msg string, account string, err error) (int, error) {
+	h.logError(msg, account, err)
+	return status, errors.New(msg)
+}
 
+// updateAccount runs a posted account JWT through the checks of a POST, signs and stores it, and returns
+// the status of the response. The error is the body of a failed response. Uploads over NATS share it.
+func (h *JwtHandler) updateAccount(ctx context.Context, u *accountUpdate) (int, error) {
+	theJWT := u.jwt
 	claim, err := jwt.DecodeAccountClaims(string(theJWT))
 	if err != nil || claim == nil {
-		h.sendErrorResponse(http.StatusBadRequest, "bad JWT in request", "", err, w)
-		return
+		return h.rejectUpdate(http.StatusBadRequest, "bad JWT in request", "", err)
 	}
 	shortCode := ShortKey(claim.Subject)
 
-	if paramPubKey := params.ByName("pubkey"); paramPubKey != "" && claim.Subject != paramPubKey {
-		h.sendErrorResponse(http.StatusBadRequest, "pub keys don't match", shortCode, err, w)
-		return
+	start := time.Now()
+	sample := &uploadSample{size: len(theJWT)}
+	defer func(account string) {
+		sample.total = time.Since(start)
+		h.uploads.record(account, *sample)
+	}(claim.Subject)
+
+	if u.pubKey != "" && claim.Subject != u.pubKey {
+		return h.rejectUpdate(http.StatusBadRequest, "pub keys don't match", shortCode, err)
 	}
 
 	if !nkeys.IsValidPublicAccountKey(claim.Issuer) && !nkeys.IsValidPublicOperatorKey(claim.Issuer) {
-		h.sendErrorResponse(http.StatusBadRequest, "bad JWT Issuer in request", shortCode, err, w)
-		return
+		return h.rejectUpdate(http.StatusBadRequest, "bad JWT Issuer in request", shortCode, err)
 	}
 
 	if !nkeys.IsValidPublicAccountKey(claim.Subject) {
-		h.sendErrorResponse(http.StatusBadRequest, "bad JWT Subject in request", shortCode, err, w)
-		return
+		return h.rejectUpdate(http.StatusBadRequest, "bad JWT Subject in request", shortCode, err)
+	}
+
+	if h.revoked.has(claim.Subject) {
+		return h.rejectUpdate(http.StatusForbidden, "account is revoked", shortCode, nil)
+	}
+
+	// fail before signing, the check is repeated when saving
+	if etag, ok := h.ifMatch(u.ifMatch, claim.Subject); !ok {
+		return h.preconditionFailed(u.header, etag, shortCode)
+	}
+
+	postedIssuer := claim.Issuer
+	var existingTags jwt.TagList
+	if h.approvals != nil {
+		if found, existingClaim := h.loadAccountJWT(claim.Subject); found {
+			existingTags = existingClaim.Tags
+		}
 	}
 
 	msg := ""
@@ -82,56 +165,74 @@ func (h *JwtHandler) UpdateAccountJWT(w http.ResponseWriter, r *http.Request, pa
 	_, didSign := h.trustedKeys[claim.Issuer]
 	if h.sign != nil && !didSign {
 		found, existingClaim := h.loadAccountJWT(claim.Subject)
+		// fail before signing, the check is repeated for every post
+		if err := checkScopedIssuer(existingClaim, claim); err != nil {
+			return h.rejectUpdate(http.StatusBadRequest, fmt.Sprintf("bad JWT issuer, %v", err), shortCode, nil)
+		}
+
 		if !found && claim.Issuer != claim.Subject {
-			h.sendErrorResponse(http.StatusBadRequest, "bad JWT Issuer/Subject pair in request", shortCode, err, w)
-			return
+			return h.rejectUpdate(http.StatusBadRequest, "bad JWT Issuer/Subject pair in request", shortCode, err)
 		}
 
 		// an issuer must be in the known jwt and on the new one
 		if found && (!existingClaim.DidSign(claim) || !claim.DidSign(claim)) {
-			h.sendErrorResponse(http.StatusBadRequest, "bad JWT issuer is not trusted", shortCode, err, w)
-			return
+			return h.rejectUpdate(http.StatusBadRequest, "bad JWT issuer is not trusted", shortCode, err)
 		}
 
 		// sign self signed account jwt
-		if theJWT, msg, err = h.sign(claim.Subject, theJWT); err != nil {
+		h.signRequested(claim.Subject, string(theJWT))
+		signStart := time.Now()
+		_, signSpan := h.tracer.child(ctx, "sign account", spanClient)
+		signSpan.set("account", claim.Subject)
+		theJWT, msg, err = h.sign(claim.Subject, theJWT)
+		signSpan.finish(err)
+		sample.sign = time.Since(signStart)
+		if err != nil {
+			if err == errSignQueueFull {
+				u.header.Set("Retry-After", "1")
+				return h.rejectUpdate(http.StatusTooManyRequests, "too many pending signing requests, try again later", shortCode, err)
+			}
+			if errors.Is(err, errSignUnavailable) {
+				h.logger.Errorf("%s - %s - %s", shortCode, "error when signing account", err.Error())
+				u.header.Set("Retry-After", h.signers.retryAfter())
+				return http.StatusServiceUnavailable, errors.New(msg)
+			}
 			if msg != "" {
 				h.logger.Errorf("%s - %s - %s", shortCode, "error when signing account", err.Error())
-				http.Error(w, msg, http.StatusInternalServerError)
-			} else {
-				h.sendErrorResponse(http.StatusInternalServerError, msg, shortCode, err, w)
+				return http.StatusInternalServerError, errors.New(msg)
 			}
-			return
+			return h.rejectUpdate(http.StatusInternalServerError, msg, shortCode, err)
 		}
 
 		if theJWT == nil {
 			h.logger.Noticef("%s Initiated JWT signing process for %s", shortCode, claim.ID)
-			w.WriteHeader(http.StatusAccepted)
-			if msg != "" {
-				w.Header().Set(ContentType, TextPlain)
-				w.Write([]byte(msg))
-			}
-			return
+			u.message = msg
+			return http.StatusAccepted, nil
 		}
 		if claim, err = jwt.DecodeAccountClaims(string(theJWT)); err != nil || claim == nil {
-			h.sendErrorResponse(http.StatusBadRequest, "bad JWT returned when signing account jwt", shortCode, err, w)
-			return
+			return h.rejectUpdate(http.StatusBadRequest, "bad JWT returned when signing account jwt", shortCode, err)
 		}
 		shortCode = ShortKey(claim.Subject)
 	}
 
 	if !nkeys.IsValidPublicOperatorKey(claim.Issuer) {
 		if claim.Issuer == claim.Subject {
-			h.sendErrorResponse(http.StatusBadRequest, "Signing service not enabled", claim.Issuer, err, w)
-		} else {
-			h.sendErrorResponse(http.StatusBadRequest, "Bad JWT Issuer in request", claim.Issuer, err, w)
+			return h.rejectUpdate(http.StatusBadRequest, "Signing service not enabled", claim.Issuer, err)
 		}
-		return
+		return h.rejectUpdate(http.StatusBadRequest, "Bad JWT Issuer in request", claim.Issuer, err)
 	}
 
 	if _, didSign := h.trustedKeys[claim.Issuer]; !didSign {
-		h.sendErrorResponse(http.StatusBadRequest, "untrusted issuer in request", claim.Issuer, err, w)
-		return
+		return h.rejectUpdate(http.StatusBadRequest, "untrusted issuer in request", claim.Issuer, err)
+	}
+
+	if violations := scopeViolations(claim); len(violations) > 0 {
+		lines := []string{"The server was unable to update your account JWT. One or more scoped signing keys are invalid."}
+		for _, v := range violations {
+			lines = append(lines, fmt.Sprintf("\t - %s", v))
+		}
+		h.logger.Errorf("attempt to update JWT %s with invalid signing key scopes", shortCode)
+		return http.StatusBadRequest, errors.New(strings.Join(lines, "\n"))
 	}
 
 	vr := &jwt.ValidationResults{}
@@ -144,30 +245,266 @@ func (h *JwtHandler) UpdateAccountJWT(w http.ResponseWriter, r *http.Request, pa
 		for _, vi := range vr.Issues {
 			lines = append(lines, fmt.Sprintf("\t - %s\n", vi.Description))
 		}
-		msg := strings.Join(lines, "\n")
 		h.logger.Errorf("attempt to update JWT %s with blocking validation errors", shortCode)
-		http.Error(w, msg, http.StatusBadRequest)
-		return
+		return http.StatusBadRequest, errors.New(strings.Join(lines, "\n"))
 	}
 
-	if err := h.jwtStore.SaveAcc(claim.Subject, string(theJWT)); err != nil {
-		h.sendErrorResponse(http.StatusInternalServerError, "error saving JWT", shortCode, err, w)
-		return
+	// scoped signing keys can't issue account JWTs
+	_, existingClaim := h.loadAccountJWT(claim.Subject)
+	if err := checkScopedIssuer(existingClaim, claim); err != nil {
+		return h.rejectUpdate(http.StatusBadRequest, fmt.Sprintf("bad JWT issuer, %v", err), shortCode, nil)
+	}
+
+	if rejections, err := h.lintAccount(claim); err != nil {
+		return h.rejectUpdate(http.StatusInternalServerError, "error linting JWT", shortCode, err)
+	} else if len(rejections) > 0 && h.softLimits.warnOnly(softLint) {
+		for _, r := range rejections {
+			h.flagViolation(u.header, softLint, claim.Subject, r)
+		}
+	} else if len(rejections) > 0 {
+		lines := []string{"The server was unable to update your account JWT. One or more lint rules rejected it."}
+		for _, r := range rejections {
+			lines = append(lines, fmt.Sprintf("\t - %s", r))
+		}
+		h.logger.Errorf("attempt to update JWT %s rejected by lint rules", shortCode)
+		return http.StatusBadRequest, errors.New(strings.Join(lines, "\n"))
 	}
 
+	if violations := h.policyViolations(claim); len(violations) > 0 && h.softLimits.warnOnly(softPolicy) {
+		for _, v := range violations {
+			h.flagViolation(u.header, softPolicy, claim.Subject, v)
+		}
+	} else if len(violations) > 0 {
+		lines := []string{"The server was unable to update your account JWT. It exceeds the account policy."}
+		for _, v := range violations {
+			lines = append(lines, fmt.Sprintf("\t - %s", v))
+		}
+		h.logger.Errorf("attempt to update JWT %s rejected by the account policy", shortCode)
+		return http.StatusUnprocessableEntity, errors.New(strings.Join(lines, "\n"))
+	}
+
+	if h.approvals.required(existingTags, claim) && !h.isOperator(postedIssuer) {
+		if err := h.approvals.hold(claim, theJWT, postedIssuer, u); err != nil {
+			return h.rejectUpdate(http.StatusInternalServerError, "unable to hold the JWT for approval", shortCode, err)
+		}
+		h.logger.Noticef("%s - JWT %s is pending approval", shortCode, claim.ID)
+		u.message = fmt.Sprintf("JWT %s for account %s is pending approval\n", claim.ID, claim.Subject)
+		return http.StatusAccepted, nil
+	}
+
+	unlock := h.writeLocks.lock(claim.Subject)
+	defer unlock()
+	if etag, ok := h.ifMatch(u.ifMatch, claim.Subject); !ok {
+		return h.preconditionFailed(u.header, etag, shortCode)
+	}
+	if err := h.checkAccountOperator(claim.Subject, claim.Issuer); err != nil {
+		return h.rejectUpdate(http.StatusForbidden, err.Error(), shortCode, nil)
+	}
+	if stored := h.staleUpload(u.force, claim); stored != nil {
+		h.logger.Errorf("attempt to replace JWT %s with an older one", shortCode)
+		return h.rejectUpdate(http.StatusConflict, fmt.Sprintf("the stored account JWT was issued later, at %s, post with force=true to roll it back",
+			time.Unix(stored.IssuedAt, 0).UTC().Format(time.RFC3339)), shortCode, nil)
+	}
+	if failure, err := h.saveAccount(ctx, claim.Subject, theJWT, sample); errors.Is(err, errCanaryHeld) {
+		u.message = fmt.Sprintf("JWT %s for account %s is held, %v\n", claim.ID, claim.Subject, err)
+		return http.StatusAccepted, nil
+	} else if notificationPending(err) {
+		u.header.Add(warningHeader, err.Error())
+		h.logger.Warnf("updated JWT for account - %s - %s, the notification is pending", shortCode, claim.ID)
+	} else if errors.Is(err, errStoreFull) {
+		return h.rejectUpdate(http.StatusInsufficientStorage, "the store is full, "+err.Error(), shortCode, err)
+	} else if err != nil {
+		return h.rejectUpdate(http.StatusInternalServerError, failure, shortCode, err)
+	} else {
+		h.logger.Noticef("updated JWT for account - %s - %s", shortCode, claim.ID)
+	}
+
+	u.header.Set("Etag", h.etag(claim.ID, string(theJWT)))
+	u.message = msg
+	return http.StatusOK, nil
+}
+
+// saveAccount validates the JWT on the canary, if there is one, then stores it. A JWT that fails
+// validation is held and errCanaryHeld is returned.
+func (h *JwtHandler) saveAccount(ctx context.Context, pubKey string, theJWT []byte, sample *uploadSample) (string, error) {
+	if err := h.canary.check(pubKey, theJWT); err != nil {
+		return "the JWT failed canary validation and is held", err
+	}
+	return h.storeAccount(ctx, pubKey, theJWT, sample)
+}
+
+// storeAccount stores the JWT, mirrors it and notifies the nats-servers, on error the returned string
+// describes the step that failed. The notify time is recorded in sample, if not nil, the store and notify
+// calls are traced if ctx is. If the notification is retried in the background the JWT is stored and
+// errNotificationPending is returned.
+func (h *JwtHandler) storeAccount(ctx context.Context, pubKey string, theJWT []byte, sample *uploadSample) (string, error) {
+	_, saveSpan := h.tracer.child(ctx, "store save account", spanInternal)
+	saveSpan.set("account", pubKey)
+	err := h.jwtStore.SaveAcc(pubKey, string(theJWT))
+	saveSpan.finish(err)
+	if err != nil {
+		return "error saving JWT", err
+	}
+	h.jtis.add(string(theJWT))
+	h.tags.add(string(theJWT))
+	h.mirror.offer(pubKey, theJWT)
+
+	var pending error
 	if h.sendAccountNotification != nil {
-		if err := h.sendAccountNotification(claim.Subject, theJWT); err != nil {
-			h.sendErrorResponse(http.StatusInternalServerError, "error sending notification of change", shortCode, err, w)
-			return
+		notifyStart := time.Now()
+		_, notifySpan := h.tracer.child(ctx, "NATS publish account update", spanClient)
+		notifySpan.set("account", pubKey)
+		err := h.sendAccountNotification(pubKey, theJWT)
+		notifySpan.finish(err)
+		if sample != nil {
+			sample.notify = time.Since(notifyStart)
+		}
+		if notificationPending(err) {
+			pending = err
+		} else if err != nil {
+			return "error sending notification of change", err
 		}
 	}
+	h.refreshSystemAccount(pubKey, string(theJWT))
+	h.accountSaved(pubKey, string(theJWT))
+	return "", pending
+}
 
-	h.logger.Noticef("updated JWT for account - %s - %s", shortCode, claim.ID)
+// resignAccount sends account claims changed by the server through the signing service. The request
+// is signed with a throwaway key, the signing service replaces the issuer. The JWT is nil if the
+// signing service completes the request later, on error the status and failure describe it.
+func (h *JwtHandler) resignAccount(claim *jwt.AccountClaims) ([]byte, *jwt.AccountClaims, int, string, error) {
+	if h.sign == nil {
+		return nil, nil, http.StatusNotImplemented, "signing service not enabled", errors.New("no signing service")
+	}
+	kp, err := nkeys.CreateOperator()
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, "error creating request key", err
+	}
+	request, err := claim.Encode(kp)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, "error encoding account JWT", err
+	}
+	h.signRequested(claim.Subject, request)
+	theJWT, msg, err := h.sign(claim.Subject, []byte(request))
+	if err == errSignQueueFull {
+		return nil, nil, http.StatusTooManyRequests, "too many pending signing requests, try again later", err
+	} else if errors.Is(err, errSignUnavailable) {
+		return nil, nil, http.StatusServiceUnavailable, msg, err
+	} else if err != nil {
+		if msg == "" {
+			msg = "error signing account JWT"
+		}
+		return nil, nil, http.StatusBadGateway, msg, err
+	} else if theJWT == nil {
+		return nil, nil, 0, "", nil
+	}
+	signed, err := jwt.DecodeAccountClaims(string(theJWT))
+	if err != nil || signed.Subject != claim.Subject {
+		if err == nil {
+			err = errors.New("subject changed")
+		}
+		return nil, nil, http.StatusBadGateway, "bad JWT returned when signing account jwt", err
+	}
+	if _, ok := h.trustedKeys[signed.Issuer]; !ok {
+		return nil, nil, http.StatusBadGateway, "signing service returned an untrusted issuer", errors.New(signed.Issuer)
+	}
+	return theJWT, signed, 0, "", nil
+}
+
+// DeleteAccountJWT removes an account JWT from the store. The body is a generic JWT signed by the operator
+// or one of its signing keys, with the account in its accounts list, the same proof the nats-server
+// full resolver expects on $SYS.REQ.CLAIMS.DELETE
+func (h *JwtHandler) DeleteAccountJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.logger.Tracef("%s: %s %s", r.RemoteAddr, r.Method, r.URL.String())
+	pubKey := params.ByName("pubkey")
+	shortCode := ShortKey(pubKey)
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		h.sendErrorResponse(http.StatusBadRequest, "bad account public key", shortCode, nil, w)
+		return
+	}
+
+	proof, ok := h.readBody(w, r, "bad delete proof in request", shortCode)
+	if !ok {
+		return
+	}
+	if status, failure := h.checkDeleteProof(pubKey, proof); status != 0 {
+		h.sendErrorResponse(status, failure, shortCode, nil, w)
+		return
+	}
+	if h.isSystemAccount(pubKey) {
+		h.sendErrorResponse(http.StatusBadRequest, "the system account can't be deleted", shortCode, nil, w)
+		return
+	}
+
+	if status, failure, err := h.deleteAccount(pubKey, proof); status != 0 {
+		h.sendErrorResponse(status, failure, shortCode, err, w)
+		return
+	}
+	h.logger.Noticef("deleted JWT for account - %s", shortCode)
 	w.WriteHeader(http.StatusOK)
-	if msg != "" {
-		w.Header().Set(ContentType, TextPlain)
-		w.Write([]byte(msg))
+}
+
+// deleteAccount removes the account JWT from the store, publishes the delete proof, if there is one, so
+// the nats-server full resolvers drop the account, and runs the hooks. A status of 0 means the account
+// was deleted, otherwise the status and the failure are returned.
+func (h *JwtHandler) deleteAccount(pubKey string, proof []byte) (int, string, error) {
+	deleter, ok := h.jwtStore.(store.DeletableJWTStore)
+	if !ok {
+		return http.StatusNotImplemented, "store does not support deletes", nil
+	}
+	if err := deleter.DeleteAcc(pubKey); err == errAccountNotFound {
+		return http.StatusNotFound, "no matching account JWT", err
+	} else if err != nil {
+		return http.StatusInternalServerError, "error deleting JWT", err
+	}
+
+	if len(proof) > 0 && h.sendDeleteNotification != nil {
+		if err := h.sendDeleteNotification(pubKey, proof); err != nil {
+			return http.StatusInternalServerError, "error sending notification of delete", err
+		}
+	}
+
+	h.accountDeleted(pubKey)
+	return 0, "", nil
+}
+
+// checkDeleteProof validates the delete proof for the account, a status of 0 means the proof is good,
+// otherwise the status and the failure are returned
+func (h *JwtHandler) checkDeleteProof(pubKey string, proof []byte) (int, string) {
+	claim, err := jwt.DecodeGeneric(string(proof))
+	if err != nil || claim == nil {
+		return http.StatusBadRequest, "bad delete proof in request"
+	}
+	vr := jwt.CreateValidationResults()
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		return http.StatusBadRequest, "delete proof failed validation"
+	}
+	if _, trusted := h.trustedKeys[claim.Issuer]; !trusted || claim.Subject != claim.Issuer {
+		return http.StatusForbidden, "delete proof is not signed by the operator"
+	}
+	if err := h.checkAccountOperator(pubKey, claim.Issuer); err != nil {
+		return http.StatusForbidden, "delete proof is signed by another operator than the account"
 	}
+	if !proofLists(claim, "accounts", pubKey) {
+		return http.StatusBadRequest, "delete proof does not list the account"
+	}
+	return 0, ""
+}
+
+// proofLists returns true if the list under field in the proof holds key
+func proofLists(claim *jwt.GenericClaims, field string, key string) bool {
+	list, ok := claim.Data[field].([]interface{})
+	if !ok {
+		return false
+	}
+	for _, entry := range list {
+		if entry == key {
+			return true
+		}
+	}
+	return false
 }
 
 // GetAccountJWT looks up an account JWT by public key and returns it
@@ -177,6 +514,21 @@ func (h *JwtHandler) GetAccountJWT(w http.ResponseWriter, r *http.Request, param
 	pubKey := params.ByName("pubkey")
 	shortCode := ShortKey(pubKey)
 
+	if keys := r.URL.Query().Get("keys"); pubKey == "" && keys != "" {
+		h.getAccountJWTs(w, r, strings.Split(keys, ","))
+		return
+	}
+
+	if tags := r.URL.Query()["tag"]; pubKey == "" && len(tags) > 0 {
+		h.accountsByTag(w, r, tags)
+		return
+	}
+
+	if pubKey == "" && strings.ToLower(r.URL.Query().Get("list")) == "true" {
+		h.listAccounts(w, r)
+		return
+	}
+
 	if pubKey == "" {
 		h.logger.Tracef("server sent resolver check")
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -193,30 +545,38 @@ func (h *JwtHandler) GetAccountJWT(w http.ResponseWriter, r *http.Request, param
 		return
 	}
 
-	check := strings.ToLower(r.URL.Query().Get("check")) == "true"
+	check := h.checkExpiration(r)
 	notify := strings.ToLower(r.URL.Query().Get("notify")) == "true" //TODO not done in ngs
 	decode := strings.ToLower(r.URL.Query().Get("decode")) == "true"
 	text := strings.ToLower(r.URL.Query().Get("text")) == "true"
 
-	theJWT, err := h.jwtStore.LoadAcc(pubKey)
+	_, loadSpan := h.tracer.child(r.Context(), "store load account", spanInternal)
+	loadSpan.set("account", pubKey)
+	theJWT, source, err := h.loadAccWithSource(pubKey)
+	loadSpan.set("source", source)
+	loadSpan.finish(nil)
 
 	if err != nil {
-		if pubKey == h.sysAccSubject && h.sysAccJWT != "" {
-			theJWT = h.sysAccJWT
+		if sysSubject, sysJWT := h.systemAccount(); pubKey == sysSubject && sysJWT != "" {
+			theJWT, source = sysJWT, lookupConfig
 			h.logger.Tracef("returning system JWT from configuration")
 		} else {
 			h.sendErrorResponse(http.StatusNotFound, "no matching account JWT", shortCode, err, w)
 			return
 		}
 	}
+	w.Header().Set(accountSourceHeader, source)
 
 	if text {
 		h.writeJWTAsText(w, pubKey, theJWT)
 		return
 	}
 
-	if decode {
-		h.writeDecodedJWT(w, pubKey, theJWT)
+	// the raw JWT and its decoded JSON are served on the same URL, with the same checks and headers
+	w.Header().Add("Vary", "Accept")
+	asJSON := acceptsJSON(r)
+	if decode && !asJSON {
+		h.writeDecodedJWT(w, r, pubKey, theJWT)
 		return
 	}
 
@@ -227,19 +587,17 @@ func (h *JwtHandler) GetAccountJWT(w http.ResponseWriter, r *http.Request, param
 		return
 	}
 
-	if check {
-		now := time.Now().UTC().Unix()
-		if decoded.Expires < now && decoded.Expires > 0 {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+	if check && h.expired(decoded) {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
 	// Check for if not modified, and also set etag and cache control
-	e := `"` + decoded.ID + `"`
+	e := h.etag(decoded.ID, theJWT)
 
 	if match := r.Header.Get("If-None-Match"); match != "" {
 		if strings.Contains(match, e) {
+			h.access.served(pubKey, accessHTTP)
 			w.WriteHeader(http.StatusNotModified)
 			return
 		}
@@ -248,12 +606,15 @@ func (h *JwtHandler) GetAccountJWT(w http.ResponseWriter, r *http.Request, param
 	// send notification if requested, even though this is a GET request
 	if notify {
 		h.logger.Tracef("trying to send notification for - %s", shortCode)
-		if err := h.sendAccountNotification(decoded.Subject, []byte(theJWT)); err != nil {
+		if err := h.sendAccountNotification(decoded.Subject, []byte(theJWT)); notificationPending(err) {
+			w.Header().Add(warningHeader, err.Error())
+		} else if err != nil {
 			h.sendErrorResponse(http.StatusInternalServerError, "error sending notification of change", shortCode, err, w)
 			return
 		}
 	}
 
+	h.access.served(pubKey, accessHTTP)
 	w.Header().Set("Etag", e)
 
 	cacheControl := cacheControlForExpiration(pubKey, decoded.Expires)
@@ -262,6 +623,10 @@ func (h *JwtHandler) GetAccountJWT(w http.ResponseWriter, r *http.Request, param
 		w.Header().Set("Cache-Control", cacheControl)
 	}
 
+	if asJSON {
+		h.writeDecodedJSON(w, r, pubKey, theJWT)
+		return
+	}
 	w.Header().Add(ContentType, ApplicationJWT)
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte(theJWT))
@@ -272,3 +637,216 @@ func (h *JwtHandler) GetAccountJWT(w http.ResponseWriter, r *http.Request, param
 		h.logger.Tracef("returning JWT for - %s", shortCode)
 	}
 }
+
+// limits for GET /jwt/v1/accounts?keys=
+const (
+	maxKeysPerFetch  = 256
+	fetchConcurrency = 8
+)
+
+// page sizes for GET /jwt/v1/accounts?list=true
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listedAccount is one entry of an account listing, expires is 0 if the JWT doesn't expire
+type listedAccount struct {
+	PubKey  string `json:"pubkey"`
+	Name    string `json:"name"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+// accountList is one page of the stored accounts, ordered by public key
+type accountList struct {
+	Total    int             `json:"total"`
+	Offset   int             `json:"offset"`
+	Limit    int             `json:"limit"`
+	Accounts []listedAccount `json:"accounts"`
+}
+
+// accountFetch is the response to a multi-account fetch
+type accountFetch struct {
+	Accounts map[string]string `json:"accounts"` // pubkey -> jwt
+	Missing  []string          `json:"missing"`
+}
+
+// errKeysNotListed is returned by accountKeys for stores that can neither list their keys nor be packed
+var errKeysNotListed = errors.New("store does not support listing accounts")
+
+// keyLister is implemented by stores that can list the public keys they hold without reading the JWTs
+type keyLister interface {
+	keys() ([]string, error)
+}
+
+// accountKeys returns the ordered public keys of the accounts in the store. Stores that can't list their
+// keys are packed, activations and anything else that isn't an account is left out.
+func accountKeys(st store.JWTStore) ([]string, error) {
+	var stored []string
+	err := errKeysNotListed
+	if lister, ok := st.(keyLister); ok {
+		stored, err = lister.keys()
+	}
+	if err == errKeysNotListed {
+		packer, ok := st.(store.PackableJWTStore)
+		if !ok {
+			return nil, errKeysNotListed
+		}
+		pack, err := packer.Pack(-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(pack, "\n") {
+			if split := strings.SplitN(line, "|", 2); len(split) == 2 {
+				stored = append(stored, split[0])
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(stored))
+	for _, k := range stored {
+		if nkeys.IsValidPublicAccountKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// listAccounts handles GET /jwt/v1/accounts?list=true&offset=&limit=, returning a page of the stored accounts
+func (h *JwtHandler) listAccounts(w http.ResponseWriter, r *http.Request) {
+	page := accountList{Limit: defaultListLimit, Accounts: []listedAccount{}}
+	for param, value := range map[string]*int{"offset": &page.Offset, "limit": &page.Limit} {
+		if v := r.URL.Query().Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				h.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("bad %s parameter %q", param, v), "", err, w)
+				return
+			}
+			*value = n
+		}
+	}
+	if page.Limit == 0 || page.Limit > maxListLimit {
+		h.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), "", nil, w)
+		return
+	}
+	stored, err := accountKeys(h.jwtStore)
+	if err == errKeysNotListed {
+		h.sendErrorResponse(http.StatusNotImplemented, "listing isn't supported by the store", "", nil, w)
+		return
+	} else if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error listing JWTs", "", err, w)
+		return
+	}
+	keys := make([]string, 0, len(stored))
+	for _, k := range stored {
+		if !h.revoked.has(k) {
+			keys = append(keys, k)
+		}
+	}
+	page.Total = len(keys)
+	if page.Offset < len(keys) {
+		keys = keys[page.Offset:]
+	} else {
+		keys = nil
+	}
+	if len(keys) > page.Limit {
+		keys = keys[:page.Limit]
+	}
+	// only the JWTs of the page are read
+	for _, k := range keys {
+		entry := listedAccount{PubKey: k}
+		if theJWT, err := h.jwtStore.LoadAcc(k); err == nil {
+			if claim, err := jwt.DecodeAccountClaims(theJWT); err == nil {
+				entry.Name = h.privacy.name(claim.Name)
+				entry.Expires = claim.Expires
+			}
+		}
+		page.Accounts = append(page.Accounts, entry)
+	}
+	h.logger.Tracef("listing %d of %d accounts from %d", len(page.Accounts), page.Total, page.Offset)
+
+	data, err := unescapedIndentedMarshal(page, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", "", err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// getAccountJWTs handles GET /jwt/v1/accounts?keys=K1,K2, loading the accounts concurrently and
+// returning them in one JSON response
+func (h *JwtHandler) getAccountJWTs(w http.ResponseWriter, r *http.Request, keys []string) {
+	unique := make([]string, 0, len(keys))
+	seen := map[string]struct{}{}
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if _, ok := seen[k]; ok || k == "" {
+			continue
+		}
+		if !nkeys.IsValidPublicAccountKey(k) {
+			h.sendErrorResponse(http.StatusBadRequest, "keys must be account public keys", k, nil, w)
+			return
+		}
+		seen[k] = struct{}{}
+		unique = append(unique, k)
+	}
+	if len(unique) > maxKeysPerFetch {
+		h.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("at most %d keys can be fetched at once", maxKeysPerFetch), "", nil, w)
+		return
+	}
+	check := h.checkExpiration(r)
+
+	jwts := make([]string, len(unique))
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < fetchConcurrency && i < len(unique); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				theJWT, _, err := h.loadAccWithSource(unique[idx])
+				if sysSubject, sysJWT := h.systemAccount(); err != nil && unique[idx] == sysSubject {
+					theJWT, err = sysJWT, nil
+				}
+				if err != nil || theJWT == "" {
+					continue
+				}
+				if check {
+					if decoded, err := jwt.DecodeAccountClaims(theJWT); err != nil || h.expired(decoded) {
+						continue
+					}
+				}
+				jwts[idx] = theJWT
+			}
+		}()
+	}
+	for i := range unique {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	resp := accountFetch{Accounts: map[string]string{}, Missing: []string{}}
+	for i, k := range unique {
+		if jwts[i] == "" {
+			resp.Missing = append(resp.Missing, k)
+		} else {
+			resp.Accounts[k] = jwts[i]
+			h.access.served(k, accessHTTP)
+		}
+	}
+	h.logger.Tracef("returning %d of %d requested JWTs", len(resp.Accounts), len(unique))
+
+	data, err := unescapedIndentedMarshal(resp, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", "", err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
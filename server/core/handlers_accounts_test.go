@@ -18,17 +18,23 @@ package core
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/nats-io/jwt/v2"
 	jwtv1 "github.com/nats-io/jwt/v2/v1compat"
 	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
 	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
@@ -593,6 +599,168 @@ func TestSignAccountMultiple(t *testing.T) {
 	upload(pubKey, selfSignAccount(t, key, "3"))
 }
 
+func TestSignAccountScopedSigningKey(t *testing.T) {
+	cfg := conf.DefaultServerConfig()
+	cfg.SignRequestSubject = "foo"
+	testEnv, err := SetupTestServer(cfg, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, err = testEnv.NC.Subscribe("foo", func(msg *nats.Msg) {
+		claim, err := jwt.DecodeAccountClaims(string(msg.Data))
+		require.NoError(t, err)
+		token, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		msg.Respond([]byte(token))
+	})
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	scopedKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	scopedPub, err := scopedKey.PublicKey()
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+	post := func(account *jwt.AccountClaims, signer nkeys.KeyPair) (int, string) {
+		token, err := account.Encode(signer)
+		require.NoError(t, err)
+		resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(token)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	scope := jwt.NewUserScope()
+	scope.Key = scopedPub
+	scope.Role = "publisher"
+	scope.Template.Pub.Allow.Add("foo.>")
+	account := jwt.NewAccountClaims(pubKey)
+	account.SigningKeys.AddScopedSigner(scope)
+	status, _ := post(account, accountKey)
+	require.Equal(t, http.StatusOK, status)
+
+	// the scoped key may only issue users
+	account.Tags.Add("scoped")
+	status, body := post(account, scopedKey)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, "scoped signing key")
+	require.Contains(t, body, "role publisher")
+
+	// scope templates are validated
+	scope.Template.Pub.Allow.Add("foo bar")
+	status, body = post(account, accountKey)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, "scoped signing key")
+	require.Contains(t, body, "foo bar")
+}
+
+func TestScopedIssuerWithoutSigningService(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// a stored JWT, synced from elsewhere, scopes the key of the operator
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	account, err := jwt.DecodeAccountClaims(acctJWT)
+	require.NoError(t, err)
+	scope := jwt.NewUserScope()
+	scope.Key = testEnv.OperatorPubKey
+	account.SigningKeys.AddScopedSigner(scope)
+	stored, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(pubKey, stored))
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, string(body), "scoped signing key")
+}
+
+func TestSignAccountQueueFull(t *testing.T) {
+	cfg := conf.DefaultServerConfig()
+	cfg.SignRequestSubject = "foo"
+	cfg.SignConcurrency = 1
+	cfg.SignQueueDepth = 0
+	cfg.SignRequestTimeout = 5000
+	testEnv, err := SetupTestServer(cfg, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	received := make(chan struct{})
+	release := make(chan struct{})
+	_, err = testEnv.NC.Subscribe("foo", func(msg *nats.Msg) {
+		received <- struct{}{}
+		<-release
+		claim, err := jwt.DecodeAccountClaims(string(msg.Data))
+		require.NoError(t, err)
+		token, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		msg.Respond([]byte(token))
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	post := func() int {
+		pubKey, _, acctJWT := selfSignedAcctJWT(t)
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer(acctJWT))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	first := make(chan int)
+	go func() { first <- post() }()
+	<-received
+
+	// the only slot is taken and nothing may wait for it
+	require.Equal(t, http.StatusTooManyRequests, post())
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-first)
+
+	var buf bytes.Buffer
+	testEnv.Server.metrics.write(&buf)
+	require.Contains(t, buf.String(), "nats_account_server_sign_rejected_total 1")
+	require.Contains(t, buf.String(), "nats_account_server_sign_queue_depth 0")
+}
+
+func TestSignQueueTimeout(t *testing.T) {
+	limiter := newSignLimiter(1, 1, 50, nil)
+	release := make(chan struct{})
+	sign := limiter.wrap(func(pubKey string, theJWT []byte) ([]byte, string, error) {
+		<-release
+		return theJWT, "", nil
+	})
+	done := make(chan error)
+	go func() {
+		_, _, err := sign("A", []byte("a"))
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&limiter.inFlight) == 1 }, time.Second, time.Millisecond)
+
+	// the queue has room, the wait for the slot gives up
+	start := time.Now()
+	_, _, err := sign("B", []byte("b"))
+	require.ErrorIs(t, err, errSignQueueFull)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Zero(t, atomic.LoadInt64(&limiter.queued))
+
+	close(release)
+	require.NoError(t, <-done)
+	theJWT, _, err := sign("C", []byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, "c", string(theJWT))
+}
+
 func TestSignAccountDelayed(t *testing.T) {
 	cfg := conf.DefaultServerConfig()
 	cfg.SignRequestSubject = "foo"
@@ -805,3 +973,470 @@ func TestCacheHeader(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, http.StatusNotModified, resp.StatusCode)
 }
+
+func TestUpdateAccountIfMatch(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+
+	post := func(name string, ifMatch string) *http.Response {
+		account := jwt.NewAccountClaims(pubKey)
+		account.Name = name
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(acctJWT))
+		require.NoError(t, err)
+		if ifMatch != "" {
+			request.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := testEnv.HTTP.Do(request)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// nothing is stored yet
+	require.Equal(t, http.StatusPreconditionFailed, post("first", "*").StatusCode)
+	resp := post("first", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	first := resp.Header.Get("Etag")
+	require.NotEmpty(t, first)
+
+	resp = post("second", first)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	second := resp.Header.Get("Etag")
+	require.NotEqual(t, first, second)
+
+	// a writer that read the first JWT lost the race
+	resp = post("third", `"other", `+first)
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	require.Equal(t, second, resp.Header.Get("Etag"))
+	require.Equal(t, http.StatusPreconditionFailed, post("third", "W/"+second).StatusCode)
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	claim, err := jwt.DecodeAccountClaims(stored)
+	require.NoError(t, err)
+	require.Equal(t, "second", claim.Name)
+
+	require.Equal(t, http.StatusOK, post("third", "*").StatusCode)
+}
+
+func TestHashedETags(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.ETags = "fifo"
+	badEnv, err := SetupTestServer(config, false, false)
+	badEnv.Cleanup()
+	require.Error(t, err)
+
+	config.ETags = conf.ETagHash
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	hash := sha256.Sum256([]byte(acctJWT))
+	etag := `"` + hex.EncodeToString(hash[:]) + `"`
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, etag, resp.Header.Get("Etag"))
+
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, etag, resp.Header.Get("Etag"))
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	request.Header.Set("If-None-Match", etag)
+	resp, err = testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// the JTI no longer matches, the hash does
+	claim, err := jwt.DecodeAccountClaims(acctJWT)
+	require.NoError(t, err)
+	request, err = http.NewRequest(http.MethodPost, url, bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	request.Header.Set("If-Match", `"`+claim.ID+`"`)
+	resp, err = testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	require.Equal(t, etag, resp.Header.Get("Etag"))
+
+	request, err = http.NewRequest(http.MethodPost, url, bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	request.Header.Set("If-Match", etag)
+	resp, err = testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the ETag a GET returns is the one If-Match is checked against, for an update as well
+	claim.Name = "updated"
+	updated, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	request, err = http.NewRequest(http.MethodPost, url, bytes.NewBufferString(updated))
+	require.NoError(t, err)
+	request.Header.Set("If-Match", resp.Header.Get("Etag"))
+	resp, err = testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	posted := resp.Header.Get("Etag")
+	require.NotEqual(t, etag, posted)
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, posted, resp.Header.Get("Etag"))
+}
+
+func TestUpdateAccountRejectsStale(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	encode := func(name string) string {
+		account := jwt.NewAccountClaims(pubKey)
+		account.Name = name
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		return acctJWT
+	}
+	older := encode("older")
+	time.Sleep(1100 * time.Millisecond)
+	newer := encode("newer")
+
+	post := func(theJWT string, query string) int {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey+query), "application/jwt", bytes.NewBufferString(theJWT))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	stored := func() string {
+		theJWT, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+		require.NoError(t, err)
+		return theJWT
+	}
+
+	require.Equal(t, http.StatusOK, post(newer, ""))
+	require.Equal(t, http.StatusConflict, post(older, ""))
+	require.Equal(t, newer, stored())
+	// the same JWT can be posted again
+	require.Equal(t, http.StatusOK, post(newer, ""))
+
+	require.Equal(t, http.StatusOK, post(older, "?force=true"))
+	require.Equal(t, older, stored())
+
+	testEnv.Server.jwt.rejectStale = false
+	require.Equal(t, http.StatusOK, post(newer, ""))
+	require.Equal(t, http.StatusOK, post(older, ""))
+}
+
+func TestFetchMultipleAccounts(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 5)
+	missingKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	missing, err := missingKey.PublicKey()
+	require.NoError(t, err)
+
+	keys := []string{missing, testEnv.SystemAccountPubKey}
+	for pubKey := range pubKeys {
+		keys = append(keys, pubKey)
+	}
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts?keys=" + strings.Join(keys, ",")))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	fetched := accountFetch{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&fetched))
+	require.Equal(t, []string{missing}, fetched.Missing)
+	require.Len(t, fetched.Accounts, len(pubKeys)+1)
+	for pubKey, theJWT := range pubKeys {
+		require.Equal(t, theJWT, fetched.Accounts[pubKey])
+	}
+	require.NotEmpty(t, fetched.Accounts[testEnv.SystemAccountPubKey])
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts?keys=" + missing + ",bad"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestListAccounts(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 5)
+	// other JWTs share the directory with the accounts, they aren't listed
+	require.NoError(t, testEnv.Server.JWTStore.(store.JWTActivationStore).SaveAct(testEnv.OperatorPubKey, "activation"))
+	list := func(query string) (int, accountList) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts?list=true" + query))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		page := accountList{}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+		}
+		return resp.StatusCode, page
+	}
+
+	var listed []string
+	for offset := 0; ; offset += 2 {
+		status, page := list(fmt.Sprintf("&offset=%d&limit=2", offset))
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, len(pubKeys), page.Total)
+		require.Equal(t, offset, page.Offset)
+		require.Equal(t, 2, page.Limit)
+		if len(page.Accounts) == 0 {
+			break
+		}
+		require.True(t, len(page.Accounts) <= 2)
+		for _, a := range page.Accounts {
+			require.Contains(t, pubKeys, a.PubKey)
+			listed = append(listed, a.PubKey)
+		}
+	}
+	require.Len(t, listed, len(pubKeys))
+	require.True(t, sort.StringsAreSorted(listed))
+
+	status, page := list("")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, defaultListLimit, page.Limit)
+	require.Len(t, page.Accounts, len(pubKeys))
+
+	status, _ = list("&limit=0")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = list("&offset=-1")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = list(fmt.Sprintf("&limit=%d", maxListLimit+1))
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestDeleteAccountJWT(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 2)
+	var pubKey string
+	for k := range pubKeys {
+		pubKey = k
+		break
+	}
+
+	notifications := make(chan *nats.Msg, 1)
+	_, err = testEnv.NC.ChanSubscribe(fmt.Sprintf(accountDeleteFormat, pubKey), notifications)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	proof := func(signer nkeys.KeyPair, accounts ...string) []byte {
+		issuer, err := signer.PublicKey()
+		require.NoError(t, err)
+		claim := jwt.NewGenericClaims(issuer)
+		claim.Data["accounts"] = accounts
+		theJWT, err := claim.Encode(signer)
+		require.NoError(t, err)
+		return []byte(theJWT)
+	}
+	del := func(key string, body []byte) int {
+		request, err := http.NewRequest(http.MethodDelete, testEnv.URLForPath("/jwt/v1/accounts/"+key), bytes.NewReader(body))
+		require.NoError(t, err)
+		resp, err := testEnv.HTTP.Do(request)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, del(pubKey, []byte("not a jwt")))
+	require.Equal(t, http.StatusForbidden, del(pubKey, proof(accountKey, pubKey)))
+	require.Equal(t, http.StatusBadRequest, del(pubKey, proof(testEnv.OperatorKey, testEnv.SystemAccountPubKey)))
+	require.Equal(t, http.StatusBadRequest, del(testEnv.SystemAccountPubKey, proof(testEnv.OperatorKey, testEnv.SystemAccountPubKey)))
+
+	body := proof(testEnv.OperatorKey, pubKey)
+	require.Equal(t, http.StatusOK, del(pubKey, body))
+	select {
+	case msg := <-notifications:
+		require.Equal(t, string(body), string(msg.Data))
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delete notification")
+	}
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotEqual(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, http.StatusNotFound, del(pubKey, body))
+}
+
+func TestOversizedJWTPost(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.MaxBodySize = 4096
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Less(t, len(theJWT), 4096)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+
+	// the body isn't read past the limit
+	big := bytes.Repeat([]byte("a"), 4097)
+	require.Equal(t, http.StatusRequestEntityTooLarge, postJWT(t, testEnv, pubKey, big))
+
+	// the stored JWT is untouched
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, theJWT, string(body))
+}
+
+func TestEnforcedExpiration(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Expiration = conf.ExpirationConfig{Enforce: true, Grace: 60000}
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// saved behind the handler, which refuses expired JWTs
+	saveExpiring := func(expires time.Time) string {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		account := jwt.NewAccountClaims(pubKey)
+		account.Expires = expires.Unix()
+		theJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.NoError(t, testEnv.Server.JWTStore.(*dirStore).SaveAcc(pubKey, theJWT))
+		return pubKey
+	}
+	expired := saveExpiring(time.Now().Add(-2 * time.Minute))
+	inGrace := saveExpiring(time.Now().Add(-10 * time.Second))
+
+	get := func(path string) int {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath(path))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusNotFound, get("/jwt/v1/accounts/"+expired))
+	require.Equal(t, http.StatusOK, get("/jwt/v1/accounts/"+expired+"?check=false"))
+	require.Equal(t, http.StatusOK, get("/jwt/v1/accounts/"+inGrace))
+	require.Equal(t, http.StatusOK, get("/jwt/v1/accounts/"+inGrace+"?check=true"))
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts?keys=" + expired + "," + inGrace))
+	require.NoError(t, err)
+	var fetched accountFetch
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&fetched))
+	resp.Body.Close()
+	require.Equal(t, []string{expired}, fetched.Missing)
+	require.Contains(t, fetched.Accounts, inGrace)
+
+	// lookups for expired accounts go unanswered
+	lookup := func(pubKey string) error {
+		_, err := testEnv.NC.Request(fmt.Sprintf(accountLookupRequest, pubKey), nil, 250*time.Millisecond)
+		return err
+	}
+	require.Error(t, lookup(expired))
+	require.NoError(t, lookup(inGrace))
+}
+
+func TestDecodedJSON(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+
+	get := func(path string, accept string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, testEnv.URLForPath(path), nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		resp, err := testEnv.HTTP.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp, body
+	}
+
+	resp, body := get("/jwt/v1/accounts/"+pubKey, "text/html, application/json;q=0.9")
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+	require.Contains(t, resp.Header.Values("Vary"), "Accept")
+	var decoded decodedJWT
+	require.NoError(t, json.Unmarshal(body, &decoded))
+	require.Equal(t, "JWT", decoded.Header.Type)
+	require.Equal(t, pubKey, decoded.Claims["sub"])
+	require.Equal(t, "account", decoded.Claims["nats"].(map[string]interface{})["type"])
+	require.Equal(t, strings.Split(theJWT, ".")[2], decoded.Signature)
+
+	resp, body = get("/jwt/v1/accounts/"+pubKey, "application/json;q=0")
+	require.Equal(t, ApplicationJWT, resp.Header.Get(ContentType))
+	require.Equal(t, theJWT, string(body))
+
+	_, body = get("/jwt/v1/operator", ApplicationJSON)
+	decoded = decodedJWT{}
+	require.NoError(t, json.Unmarshal(body, &decoded))
+	require.Equal(t, "operator", decoded.Claims["nats"].(map[string]interface{})["type"])
+
+	// conditional GETs and the expiration check apply to the JSON as well
+	etag := resp.Header.Get("Etag")
+	require.NotEmpty(t, etag)
+	req, err := http.NewRequest(http.MethodGet, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", ApplicationJSON)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = testEnv.HTTP.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	expiredKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	expiredPub, err := expiredKey.PublicKey()
+	require.NoError(t, err)
+	expired := jwt.NewAccountClaims(expiredPub)
+	expired.Expires = time.Now().Unix() - 1000
+	expiredJWT, err := expired.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(expiredPub, expiredJWT))
+	req, err = http.NewRequest(http.MethodGet, testEnv.URLForPath("/jwt/v1/accounts/"+expiredPub+"?check=true"), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", ApplicationJSON)
+	resp, err = testEnv.HTTP.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -17,8 +17,11 @@
 package core
 
 import (
-	"io"
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/nats-io/nats-account-server/server/store"
@@ -36,10 +39,8 @@ func (h *JwtHandler) UpdateActivationJWT(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	theJWT, err := io.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		h.sendErrorResponse(http.StatusBadRequest, "bad activation JWT in request", "", err, w)
+	theJWT, ok := h.readBody(w, r, "bad activation JWT in request", "")
+	if !ok {
 		return
 	}
 
@@ -60,25 +61,46 @@ func (h *JwtHandler) UpdateActivationJWT(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	hash, err := claim.HashID()
-
-	if err != nil {
+	if _, err := activationHashers[currentActivationHash].hash(claim); err != nil {
 		h.sendErrorResponse(http.StatusBadRequest, "bad activation hash in request", claim.Issuer, err, w)
 		return
 	}
 
-	if err := actStore.SaveAct(hash, string(theJWT)); err != nil {
+	if h.verifyActivations {
+		if problems := h.activationChainProblems(claim); len(problems) > 0 {
+			lines := []string{"The server was unable to store your activation JWT. Its chain doesn't check out."}
+			for _, p := range problems {
+				lines = append(lines, fmt.Sprintf("\t - %s", p))
+			}
+			h.logger.Errorf("activation JWT %s-%s rejected, %s", ShortKey(claim.Issuer), ShortKey(claim.Subject), strings.Join(problems, ", "))
+			http.Error(w, strings.Join(lines, "\n"), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	_, saveSpan := h.tracer.child(r.Context(), "store save activation", spanInternal)
+	hash, err := h.saveActivation(claim, string(theJWT), actStore.SaveAct)
+	saveSpan.set("activation", hash)
+	saveSpan.finish(err)
+	if errors.Is(err, errStoreFull) {
+		h.sendErrorResponse(http.StatusInsufficientStorage, "the store is full, "+err.Error(), claim.Issuer, err, w)
+		return
+	} else if err != nil {
 		h.sendErrorResponse(http.StatusInternalServerError, "error saving activation JWT", claim.Issuer, err, w)
 		return
 	}
 
 	if h.sendActivationNotification != nil {
-		if err := h.sendActivationNotification(hash, claim.Issuer, theJWT); err != nil {
+		if err := h.sendActivationNotification(hash, claim.Issuer, claim.Subject, theJWT); notificationPending(err) {
+			w.Header().Add(warningHeader, err.Error())
+		} else if err != nil {
 			h.sendErrorResponse(http.StatusInternalServerError, "error saving activation JWT", claim.Issuer, err, w)
 			return
 		}
 	}
 
+	h.activationSaved(hash, string(theJWT))
+
 	// hash insures that exports has len > 0
 	h.logger.Noticef("updated activation JWT - %s-%s - %q",
 		ShortKey(claim.Issuer), ShortKey(claim.Subject), claim.ImportSubject)
@@ -100,7 +122,7 @@ func (h *JwtHandler) GetActivationJWT(w http.ResponseWriter, r *http.Request, pa
 	text := strings.ToLower(r.URL.Query().Get("text")) == "true"
 	notify := strings.ToLower(r.URL.Query().Get("notify")) == "true"
 
-	theJWT, err := actStore.LoadAct(hash)
+	theJWT, version, err := h.loadActivation(hash, actStore.LoadAct)
 
 	if err != nil {
 		h.logger.Errorf("unable to find requested activation JWT for %s - %s", hash, err.Error())
@@ -113,8 +135,11 @@ func (h *JwtHandler) GetActivationJWT(w http.ResponseWriter, r *http.Request, pa
 		return
 	}
 
-	if decode {
-		h.writeDecodedJWT(w, hash, theJWT)
+	// the raw JWT and its decoded JSON are served on the same URL, with the same checks and headers
+	w.Header().Add("Vary", "Accept")
+	asJSON := acceptsJSON(r)
+	if decode && !asJSON {
+		h.writeDecodedJWT(w, r, hash, theJWT)
 		return
 	}
 
@@ -126,7 +151,7 @@ func (h *JwtHandler) GetActivationJWT(w http.ResponseWriter, r *http.Request, pa
 	}
 
 	// Check for if not modified, and also set etag and cache control
-	e := `"` + decoded.ID + `"`
+	e := h.etag(decoded.ID, theJWT)
 
 	if match := r.Header.Get("If-None-Match"); match != "" {
 		if strings.Contains(match, e) {
@@ -138,13 +163,16 @@ func (h *JwtHandler) GetActivationJWT(w http.ResponseWriter, r *http.Request, pa
 	// send notification if requested, even though this is a GET request
 	if notify {
 		h.logger.Tracef("trying to send notification for - %s", shortCode)
-		if err := h.sendActivationNotification(hash, decoded.Issuer, []byte(theJWT)); err != nil {
+		if err := h.sendActivationNotification(hash, decoded.Issuer, decoded.Subject, []byte(theJWT)); notificationPending(err) {
+			w.Header().Add(warningHeader, err.Error())
+		} else if err != nil {
 			h.sendErrorResponse(http.StatusInternalServerError, "error sending notification of change", shortCode, err, w)
 			return
 		}
 	}
 
 	w.Header().Set("Etag", e)
+	w.Header().Set(activationHashVersionHeader, strconv.Itoa(version))
 
 	cacheControl := cacheControlForExpiration(hash, decoded.Expires)
 
@@ -152,6 +180,10 @@ func (h *JwtHandler) GetActivationJWT(w http.ResponseWriter, r *http.Request, pa
 		w.Header().Set("Cache-Control", cacheControl)
 	}
 
+	if asJSON {
+		h.writeDecodedJSON(w, r, hash, theJWT)
+		return
+	}
 	w.Header().Add(ContentType, ApplicationJWT)
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte(theJWT))
@@ -162,3 +194,227 @@ func (h *JwtHandler) GetActivationJWT(w http.ResponseWriter, r *http.Request, pa
 		h.logger.Tracef("returning JWT for - %s", shortCode)
 	}
 }
+
+// listedActivation describes a stored activation without the JWT, which is loaded by its hash
+type listedActivation struct {
+	Hash          string `json:"hash"`
+	Issuer        string `json:"issuer"`  // the exporting account
+	Subject       string `json:"subject"` // the account the import is granted to
+	ImportSubject string `json:"import_subject"`
+	Expires       int64  `json:"expires,omitempty"`
+}
+
+type activationList struct {
+	Account     string             `json:"account"`
+	Activations []listedActivation `json:"activations"`
+}
+
+// ListAccountActivations handles GET /jwt/v1/accounts/:pubkey/activations, listing the stored activations
+// issued by or granted to the account. Activations stored under several hash versions are listed once,
+// with the hash of the current version.
+func (h *JwtHandler) ListAccountActivations(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pubKey := params.ByName("pubkey")
+	shortCode := ShortKey(pubKey)
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		h.sendErrorResponse(http.StatusBadRequest, "bad account public key", shortCode, nil, w)
+		return
+	}
+	packer, ok := h.jwtStore.(store.PackableJWTStore)
+	if !ok {
+		h.sendErrorResponse(http.StatusNotImplemented, "listing isn't supported by the store", shortCode, nil, w)
+		return
+	}
+	pack, err := packer.Pack(-1)
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error listing JWTs", shortCode, err, w)
+		return
+	}
+
+	list := activationList{Account: pubKey, Activations: []listedActivation{}}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(pack, "\n") {
+		split := strings.SplitN(line, "|", 2)
+		if len(split) != 2 || nkeys.IsValidPublicAccountKey(split[0]) {
+			continue
+		}
+		claim, err := jwt.DecodeActivationClaims(split[1])
+		if err != nil {
+			continue
+		}
+		issuer := claim.Issuer
+		if claim.IssuerAccount != "" {
+			issuer = claim.IssuerAccount
+		}
+		if issuer != pubKey && claim.Subject != pubKey {
+			continue
+		}
+		hash, err := activationHashers[h.activationHashes()[0]].hash(claim)
+		if err != nil || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		list.Activations = append(list.Activations, listedActivation{
+			Hash:          hash,
+			Issuer:        issuer,
+			Subject:       claim.Subject,
+			ImportSubject: string(claim.ImportSubject),
+			Expires:       claim.Expires,
+		})
+	}
+	sort.Slice(list.Activations, func(i, j int) bool {
+		return list.Activations[i].Hash < list.Activations[j].Hash
+	})
+	h.logger.Tracef("listing %d activations of %s", len(list.Activations), shortCode)
+
+	data, err := unescapedIndentedMarshal(list, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", shortCode, err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// DeleteActivationJWT handles DELETE /jwt/v1/activations/:hash, removing the activation under the hash of
+// every configured version. The body is a generic JWT, signed by the exporting account or one of its
+// signing keys with itself as the subject, listing the hash under activations.
+func (h *JwtHandler) DeleteActivationJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.logger.Tracef("%s: %s %s", r.RemoteAddr, r.Method, r.URL.String())
+	hash := params.ByName("hash")
+	shortCode := ShortKey(hash)
+
+	proof, ok := h.readBody(w, r, "bad delete proof in request", shortCode)
+	if !ok {
+		return
+	}
+	claim, status, failure := h.removeActivation(hash, proof)
+	if status != 0 {
+		h.sendErrorResponse(status, failure, shortCode, nil, w)
+		return
+	}
+
+	current, _ := activationHashers[h.activationHashes()[0]].hash(claim)
+	if h.sendActivationDelete != nil {
+		if err := h.sendActivationDelete(current, activationExporter(claim), claim.Subject, proof); notificationPending(err) {
+			w.Header().Add(warningHeader, err.Error())
+		} else if err != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "error sending notification of delete", shortCode, err, w)
+			return
+		}
+	}
+
+	h.activationDeleted(current)
+	h.logger.Noticef("deleted activation JWT - %s-%s - %q",
+		ShortKey(claim.Issuer), ShortKey(claim.Subject), claim.ImportSubject)
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeActivation checks the delete proof against the activation stored under hash and removes it under
+// every configured version, the removed activation is returned, or the status and the reason it isn't
+func (h *JwtHandler) removeActivation(hash string, proof []byte) (*jwt.ActivationClaims, int, string) {
+	theJWT, _, err := h.loadActivation(hash, activationLoader(h.jwtStore))
+	if err != nil {
+		return nil, http.StatusNotFound, "no matching activation JWT"
+	}
+	claim, err := jwt.DecodeActivationClaims(theJWT)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "error loading JWT"
+	}
+	if status, failure := h.checkActivationDeleteProof(claim, hash, proof); status != 0 {
+		return nil, status, failure
+	}
+	for _, v := range h.activationHashes() {
+		versioned, err := activationHashers[v].hash(claim)
+		if err != nil {
+			return nil, http.StatusInternalServerError, "error hashing activation JWT"
+		}
+		if err := deleteActivationKey(h.jwtStore, activationKey(v, versioned)); err != nil && err != errAccountNotFound {
+			return nil, http.StatusInternalServerError, fmt.Sprintf("error deleting JWT, %v", err)
+		}
+	}
+	return claim, 0, ""
+}
+
+// checkActivationDeleteProof validates the delete proof for an activation, a status of 0 means the proof
+// is good, otherwise the status and the failure are returned
+func (h *JwtHandler) checkActivationDeleteProof(activation *jwt.ActivationClaims, hash string, proof []byte) (int, string) {
+	claim, err := jwt.DecodeGeneric(string(proof))
+	if err != nil || claim == nil {
+		return http.StatusBadRequest, "bad delete proof in request"
+	}
+	vr := jwt.CreateValidationResults()
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		return http.StatusBadRequest, "delete proof failed validation"
+	}
+	exporter := activationExporter(activation)
+	if claim.Subject != claim.Issuer {
+		return http.StatusForbidden, "delete proof is not signed by the exporting account"
+	}
+	if claim.Issuer != exporter {
+		found, account := h.loadAccountJWT(exporter)
+		if !found || !account.SigningKeys.Contains(claim.Issuer) {
+			return http.StatusForbidden, "delete proof is not signed by the exporting account"
+		}
+	}
+	if !proofLists(claim, "activations", hash) {
+		return http.StatusBadRequest, "delete proof does not list the activation"
+	}
+	return 0, ""
+}
+
+// activationExporter returns the account that issued the activation, directly or through a signing key
+func activationExporter(claim *jwt.ActivationClaims) string {
+	if claim.IssuerAccount != "" {
+		return claim.IssuerAccount
+	}
+	return claim.Issuer
+}
+
+// activationChainProblems checks an activation against the store, the exporting account has to be
+// stored, be the issuer or hold it as a signing key and export the subject with the type claimed, the
+// importing account has to be stored as well
+func (h *JwtHandler) activationChainProblems(claim *jwt.ActivationClaims) []string {
+	var problems []string
+	exporter := activationExporter(claim)
+	if ok, account := h.loadAccountJWT(exporter); !ok || h.revoked.has(exporter) {
+		problems = append(problems, fmt.Sprintf("issuer account %s is not stored", exporter))
+	} else {
+		if claim.Issuer != exporter && !account.SigningKeys.Contains(claim.Issuer) {
+			problems = append(problems, fmt.Sprintf("%s is not a signing key of account %s", claim.Issuer, exporter))
+		}
+		exported := false
+		for _, e := range account.Exports {
+			if e.Type == claim.ImportType && claim.ImportSubject.IsContainedIn(e.Subject) {
+				exported = true
+				break
+			}
+		}
+		if !exported {
+			problems = append(problems, fmt.Sprintf("account %s has no %s export of %q", exporter, claim.ImportType, claim.ImportSubject))
+		}
+	}
+	if ok, _ := h.loadAccountJWT(claim.Subject); !ok || h.revoked.has(claim.Subject) {
+		problems = append(problems, fmt.Sprintf("subject account %s is not stored", claim.Subject))
+	}
+	return problems
+}
+
+// activationLoader returns the function activations are loaded with, stores without activation support
+// keep them under their key like accounts
+func activationLoader(s store.JWTStore) func(key string) (string, error) {
+	if actStore, ok := s.(store.JWTActivationStore); ok {
+		return actStore.LoadAct
+	}
+	return s.LoadAcc
+}
+
+// deleteActivationKey removes one stored activation key, activations are deleted like accounts
+func deleteActivationKey(s store.JWTStore, key string) error {
+	deleter, ok := s.(store.DeletableJWTStore)
+	if !ok {
+		return errors.New("store does not support deletes")
+	}
+	return deleter.DeleteAcc(key)
+}
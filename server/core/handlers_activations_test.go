@@ -18,12 +18,17 @@ package core
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
 	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
 )
@@ -33,13 +38,14 @@ func TestUploadActivationsAreNotSupported(t *testing.T) {
 	require.NoError(t, err)
 	defer testEnv.Cleanup()
 
+	// activations can only be deleted
 	getURL := testEnv.URLForPath("/jwt/v1/activations/foo")
 	resp, err := testEnv.HTTP.Get(getURL)
 	require.NoError(t, err)
-	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
 
 	postURL := testEnv.URLForPath("/jwt/v1/activations")
-	_, err = testEnv.HTTP.Post(postURL, "application/json", bytes.NewBuffer([]byte{}))
+	resp, err = testEnv.HTTP.Post(postURL, "application/json", bytes.NewBuffer([]byte{}))
 	require.NoError(t, err)
 	require.Equal(t, http.StatusNotFound, resp.StatusCode)
 }
@@ -105,3 +111,245 @@ func TestInvalidJWTType(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, resp.StatusCode == http.StatusOK)
 }
+
+func TestListAccountActivations(t *testing.T) {
+	activationHashers[2] = activationHasher{Version: 2, Algorithm: "test", hash: func(claim *jwt.ActivationClaims) (string, error) {
+		hash, err := hashActivationV1(claim)
+		return strings.ToLower(hash), err
+	}}
+	defer delete(activationHashers, 2)
+
+	config := conf.DefaultServerConfig()
+	config.Store = conf.StoreConfig{Type: "sqltest", DSN: "TestListAccountActivations"}
+	config.ActivationHashVersions = []int{2, 1}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 1)
+	exporterKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	exporter, err := exporterKey.PublicKey()
+	require.NoError(t, err)
+	importerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := importerKey.PublicKey()
+	require.NoError(t, err)
+
+	// activations reach the store through notifications
+	for _, subject := range []string{"svc.a", "svc.b"} {
+		claim := jwt.NewActivationClaims(importer)
+		claim.ImportSubject = jwt.Subject(subject)
+		claim.Expires = 2000000000
+		theJWT, err := claim.Encode(exporterKey)
+		require.NoError(t, err)
+		_, err = testEnv.Server.jwt.saveActivation(claim, theJWT, testEnv.Server.JWTStore.SaveAcc)
+		require.NoError(t, err)
+	}
+
+	list := func(pubKey string) (int, activationList) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s/activations", pubKey)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var l activationList
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&l))
+		}
+		return resp.StatusCode, l
+	}
+
+	status, issued := list(exporter)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, issued.Activations, 2, "listed once although stored under two hash versions")
+	status, granted := list(importer)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, issued.Activations, granted.Activations)
+	subjects := []string{issued.Activations[0].ImportSubject, issued.Activations[1].ImportSubject}
+	require.ElementsMatch(t, []string{"svc.a", "svc.b"}, subjects)
+	for _, a := range issued.Activations {
+		require.Equal(t, exporter, a.Issuer)
+		require.Equal(t, importer, a.Subject)
+		require.Equal(t, int64(2000000000), a.Expires)
+		theJWT, err := testEnv.Server.JWTStore.LoadAcc(activationKey(2, a.Hash))
+		require.NoError(t, err)
+		require.NotEmpty(t, theJWT)
+	}
+
+	for pubKey := range pubKeys {
+		status, l := list(pubKey)
+		require.Equal(t, http.StatusOK, status)
+		require.Empty(t, l.Activations)
+	}
+	status, _ = list("foo")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestDeleteActivation(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store = conf.StoreConfig{Type: "sqltest", DSN: "TestDeleteActivation"}
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	exporterKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	exporter, err := exporterKey.PublicKey()
+	require.NoError(t, err)
+	signingKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	signingPub, err := signingKey.PublicKey()
+	require.NoError(t, err)
+	importerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := importerKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(exporter)
+	account.SigningKeys.Add(signingPub)
+	accountJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, exporter, []byte(accountJWT)))
+
+	saveActivation := func(subject string) string {
+		claim := jwt.NewActivationClaims(importer)
+		claim.ImportSubject = jwt.Subject(subject)
+		theJWT, err := claim.Encode(exporterKey)
+		require.NoError(t, err)
+		claim, err = jwt.DecodeActivationClaims(theJWT)
+		require.NoError(t, err)
+		hash, err := testEnv.Server.jwt.saveActivation(claim, theJWT, testEnv.Server.JWTStore.SaveAcc)
+		require.NoError(t, err)
+		return hash
+	}
+	proof := func(signer nkeys.KeyPair, hashes ...string) []byte {
+		issuer, err := signer.PublicKey()
+		require.NoError(t, err)
+		claim := jwt.NewGenericClaims(issuer)
+		claim.Data["activations"] = hashes
+		theJWT, err := claim.Encode(signer)
+		require.NoError(t, err)
+		return []byte(theJWT)
+	}
+	del := func(hash string, body []byte) int {
+		req, err := http.NewRequest(http.MethodDelete, testEnv.URLForPath("/jwt/v1/activations/"+hash), bytes.NewReader(body))
+		require.NoError(t, err)
+		resp, err := testEnv.HTTP.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	notifications, err := testEnv.NC.SubscribeSync(fmt.Sprintf(activationDeleteFormat, exporter, "*"))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	hash := saveActivation("svc.a")
+	require.Equal(t, http.StatusBadRequest, del(hash, []byte("not a jwt")))
+	require.Equal(t, http.StatusForbidden, del(hash, proof(importerKey, hash)))
+	require.Equal(t, http.StatusBadRequest, del(hash, proof(exporterKey, "other")))
+	_, err = testEnv.Server.JWTStore.LoadAcc(hash)
+	require.NoError(t, err)
+
+	signed := proof(signingKey, hash)
+	require.Equal(t, http.StatusOK, del(hash, signed))
+	msg, err := notifications.NextMsg(2 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf(activationDeleteFormat, exporter, hash), msg.Subject)
+	require.Equal(t, signed, msg.Data)
+	_, err = testEnv.Server.JWTStore.LoadAcc(hash)
+	require.Error(t, err)
+	require.Equal(t, http.StatusNotFound, del(hash, signed))
+
+	// activations deleted by other account servers are removed too
+	other := saveActivation("svc.b")
+	require.NoError(t, testEnv.NC.Publish(fmt.Sprintf(activationDeleteFormat, exporter, other), proof(exporterKey, other)))
+	require.Eventually(t, func() bool {
+		_, err := testEnv.Server.JWTStore.LoadAcc(other)
+		return err != nil
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+// actStore keeps activations like accounts
+type actStore struct {
+	store.JWTStore
+}
+
+func (s *actStore) LoadAct(hash string) (string, error) {
+	return s.LoadAcc(hash)
+}
+
+func (s *actStore) SaveAct(hash string, theJWT string) error {
+	return s.SaveAcc(hash, theJWT)
+}
+
+func TestVerifyActivations(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store = conf.StoreConfig{Type: "sqltest", DSN: "TestVerifyActivations"}
+	config.VerifyActivations = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	exporterKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	exporter, err := exporterKey.PublicKey()
+	require.NoError(t, err)
+	signingKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	signingPub, err := signingKey.PublicKey()
+	require.NoError(t, err)
+	importer, importerJWT := newAccountJWT(t, testEnv.OperatorKey)
+	strangerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(exporter)
+	account.SigningKeys.Add(signingPub)
+	account.Exports.Add(&jwt.Export{Subject: "svc.>", Type: jwt.Service, TokenReq: true})
+	accountJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	// the activation route isn't served, the handler is called directly on a store that keeps activations
+	testEnv.Server.JWTStore = &actStore{testEnv.Server.JWTStore}
+	post := func(subject string, kind jwt.ExportType, signer nkeys.KeyPair) (int, string) {
+		claim := jwt.NewActivationClaims(importer)
+		claim.ImportSubject = jwt.Subject(subject)
+		claim.ImportType = kind
+		if signer == signingKey {
+			claim.IssuerAccount = exporter
+		}
+		theJWT, err := claim.Encode(signer)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/jwt/v1/activations", strings.NewReader(theJWT))
+		testEnv.Server.jwt.UpdateActivationJWT(w, r, nil)
+		return w.Code, w.Body.String()
+	}
+
+	status, body := post("svc.a", jwt.Service, exporterKey)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	require.Contains(t, body, "issuer account "+exporter+" is not stored")
+	require.Contains(t, body, "subject account "+importer+" is not stored")
+
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, exporter, []byte(accountJWT)))
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, importer, []byte(importerJWT)))
+
+	status, body = post("svc.a", jwt.Stream, exporterKey)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	require.Contains(t, body, "has no stream export of \"svc.a\"")
+	status, body = post("other", jwt.Service, exporterKey)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	require.Contains(t, body, "has no service export of \"other\"")
+
+	status, body = post("svc.a", jwt.Service, strangerKey)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	require.Contains(t, body, "not stored")
+
+	status, _ = post("svc.a", jwt.Service, exporterKey)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = post("svc.b.c", jwt.Service, signingKey)
+	require.Equal(t, http.StatusOK, status)
+
+	testEnv.Server.jwt.verifyActivations = false
+	status, _ = post("other", jwt.Service, exporterKey)
+	require.Equal(t, http.StatusOK, status)
+}
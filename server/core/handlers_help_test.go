@@ -17,11 +17,14 @@
 package core
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 	"testing"
 
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-account-server/server/conf"
 	"github.com/stretchr/testify/require"
 )
@@ -52,6 +55,21 @@ func TestHealthZTLS(t *testing.T) {
 	require.True(t, resp.StatusCode == http.StatusOK)
 }
 
+func TestVersion(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/version"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	info := BuildInfo{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	require.Equal(t, Build(), info)
+	require.Equal(t, version, info.Version)
+}
+
 func TestJWTHelp(t *testing.T) {
 	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
 	defer testEnv.Cleanup()
@@ -127,6 +145,78 @@ func TestOperatorJWT(t *testing.T) {
 	require.True(t, strings.Contains(operator, `"alg": "ed25519-nkey"`)) // header prefix doesn't change
 }
 
+func TestMultipleOperators(t *testing.T) {
+	_, otherPub, otherKey := CreateOperatorKey(t)
+	_, signingPub, signingKey := CreateOperatorKey(t)
+	other := jwt.NewOperatorClaims(otherPub)
+	other.Name = "hosted"
+	other.SigningKeys.Add(signingPub)
+	otherJWT, err := other.Encode(otherKey)
+	require.NoError(t, err)
+	file, err := os.CreateTemp("", "operator")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(otherJWT)
+	require.NoError(t, err)
+	file.Close()
+
+	config := conf.DefaultServerConfig()
+	config.OperatorJWTPaths = []string{file.Name()}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/operators"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var operators []operatorInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&operators))
+	require.Len(t, operators, 2)
+	require.Equal(t, testEnv.OperatorPubKey, operators[0].Subject)
+	require.Equal(t, otherPub, operators[1].Subject)
+	require.Equal(t, "hosted", operators[1].Name)
+	require.Equal(t, []string{signingPub}, operators[1].SigningKeys)
+	require.Equal(t, otherJWT, operators[1].JWT)
+
+	// accounts of either operator can be posted, signed by the operator or a signing key
+	pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+	pubKey, theJWT = newAccountJWT(t, otherKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+	pubKey, theJWT = newAccountJWT(t, signingKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+
+	// the accounts of one operator can't be replaced or deleted by another
+	pubKey, theJWT = newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+	takeover, err := jwt.NewAccountClaims(pubKey).Encode(signingKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, postJWT(t, testEnv, pubKey, []byte(takeover)))
+	proof := jwt.NewGenericClaims(otherPub)
+	proof.Data["accounts"] = []string{pubKey}
+	proofJWT, err := proof.Encode(otherKey)
+	require.NoError(t, err)
+	status, _ := testEnv.Server.jwt.checkDeleteProof(pubKey, []byte(proofJWT))
+	require.Equal(t, http.StatusForbidden, status)
+	_, _, unknownKey := CreateOperatorKey(t)
+	pubKey, theJWT = newAccountJWT(t, unknownKey)
+	require.Equal(t, http.StatusBadRequest, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+
+	// the /jwt/v1/operator endpoint still returns the first operator
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/operator"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, testEnv.Server.jwt.operatorJWT, string(body))
+
+	// an operator can't be configured twice
+	testEnv.Server.Stop()
+	config.OperatorJWTPaths = append(config.OperatorJWTPaths, file.Name())
+	require.Error(t, testEnv.Server.Start())
+}
+
 func TestOperatorJWTV1(t *testing.T) {
 	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
 	defer testEnv.Cleanup()
@@ -17,7 +17,11 @@
 package core
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -26,8 +30,12 @@ import (
 	"github.com/nats-io/nats-account-server/server/store"
 )
 
+// packHashHeader carries the hash of the store a pack was taken from, send it back as since to skip
+// the transfer while the store is unchanged
+const packHashHeader = "Account-Server-Pack-Hash"
+
 // PackJWTs the JWTS and return
-// takes a parameter for max
+// takes a parameter for max and since, the JWTs are streamed one per line
 func (h *JwtHandler) PackJWTs(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	h.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
 	max := h.packLimit
@@ -52,15 +60,89 @@ func (h *JwtHandler) PackJWTs(w http.ResponseWriter, r *http.Request, params htt
 		return
 	}
 
+	walker, ok := packWalker(h.jwtStore)
+	if !ok {
+		h.sendPack(w, r, packer, max)
+		return
+	}
+
+	// the hash covers the whole store, a zero hash means the store doesn't keep one
+	if hash := walker.Hash(); hash != ([sha256.Size]byte{}) {
+		hashStr := hex.EncodeToString(hash[:])
+		w.Header().Set(packHashHeader, hashStr)
+		if since := strings.ToLower(r.URL.Query().Get("since")); since == hashStr {
+			h.logger.Tracef("JWT Pack matches since=%s", since)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if r.Context().Err() != nil {
+		h.sendErrorResponse(http.StatusServiceUnavailable, "server is stopping", "", nil, w)
+		return
+	}
+
+	out, done := packWriter(w, r)
+	w.WriteHeader(http.StatusOK)
+
+	// the walk can't be stopped, once the limit is reached or the client is gone the rest is skipped
+	sent := 0
+	var werr error
+	err := walker.PackWalk(1, func(line string) {
+		if werr != nil || (max >= 0 && sent >= max) || r.Context().Err() != nil {
+			return
+		}
+		if sent > 0 {
+			line = "\n" + line
+		}
+		if _, werr = io.WriteString(out, line); werr == nil {
+			sent++
+		}
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = r.Context().Err()
+	}
+	if err == nil {
+		err = done()
+	}
+	if err != nil {
+		// the status is gone, abort the response so the client doesn't take the partial pack as complete
+		h.logger.Errorf("error streaming JWT Pack after %d JWTs - %s", sent, err.Error())
+		panic(http.ErrAbortHandler)
+	}
+	h.logger.Tracef("returned JWT Pack of %d JWTs", sent)
+}
+
+// packWalker returns the store a pack can be streamed from, looking through the server wrapping the store
+func packWalker(s store.JWTStore) (syncableStore, bool) {
+	if wrapper, ok := s.(interface{ syncable() (syncableStore, bool) }); ok {
+		return wrapper.syncable()
+	}
+	walker, ok := s.(syncableStore)
+	return walker, ok
+}
+
+// sendPack writes the pack of a store that can't be walked in one piece
+func (h *JwtHandler) sendPack(w http.ResponseWriter, r *http.Request, packer store.PackableJWTStore, max int) {
 	pack, err := packer.Pack(max)
 	if err != nil {
 		h.sendErrorResponse(http.StatusInternalServerError, "error packing JWTs", "", err, w)
 		return
 	}
+	if r.Context().Err() != nil {
+		// the server is stopping or the client went away, the primary sync of a replica retries a 503
+		h.sendErrorResponse(http.StatusServiceUnavailable, "server is stopping", "", nil, w)
+		return
+	}
 
-	w.Header().Add(ContentType, TextPlain)
+	out, done := packWriter(w, r)
 	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte(pack))
+	_, err = io.WriteString(out, pack)
+	if err == nil {
+		err = done()
+	}
 
 	if err != nil {
 		h.logger.Errorf("error writing JWT Pack - %s", err.Error())
@@ -68,3 +150,29 @@ func (h *JwtHandler) PackJWTs(w http.ResponseWriter, r *http.Request, params htt
 		h.logger.Tracef("returning JWT Pack")
 	}
 }
+
+// packWriter sets the headers of a pack response and returns the writer for the body, gzipped if the
+// client accepts it, done flushes it
+func packWriter(w http.ResponseWriter, r *http.Request) (io.Writer, func() error) {
+	w.Header().Add(ContentType, TextPlain)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() error { return nil }
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	return gz, gz.Close
+}
+
+// acceptsGzip is true if the Accept-Encoding header of the request lists gzip without a q of 0
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.ToLower(strings.TrimSpace(name)) != "gzip" {
+			continue
+		}
+		q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
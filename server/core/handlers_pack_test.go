@@ -18,6 +18,7 @@ package core
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"net"
@@ -152,6 +153,86 @@ func TestPackJWTsWithMax(t *testing.T) {
 	}
 }
 
+func TestPackJWTsStreaming(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	pubKeys := initAndPostNAccounts(t, testEnv, 100)
+
+	get := func(query string, gzipped bool) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, testEnv.URLForPath("/jwt/v1/pack"+query), nil)
+		require.NoError(t, err)
+		if gzipped {
+			// set by hand, so the client doesn't decompress the body
+			req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+		} else {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		resp, err := testEnv.HTTP.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("", true)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	hash := resp.Header.Get(packHashHeader)
+	require.Len(t, hash, 64)
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	resp.Body.Close()
+	lines := strings.Split(string(body), "\n")
+	require.Len(t, lines, len(pubKeys))
+	for _, line := range lines {
+		s := strings.Split(line, "|")
+		require.Len(t, s, 2)
+		require.Equal(t, pubKeys[s[0]], s[1])
+	}
+
+	resp = get("?max=5", false)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Len(t, strings.Split(string(body), "\n"), 5)
+
+	// nothing is sent while the store has the same hash
+	resp = get("?since="+strings.ToUpper(hash), true)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Equal(t, hash, resp.Header.Get(packHashHeader))
+
+	initAndPostNAccounts(t, testEnv, 1)
+	resp = get("?since="+hash, false)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, hash, resp.Header.Get(packHashHeader))
+	require.Len(t, strings.Split(string(body), "\n"), len(pubKeys)+1)
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, accepted := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, GZIP":     true,
+		"gzip;q=0":          false,
+		"gzip; q=0.5, br":   true,
+		"br, gzip ; q=0.00": false,
+		"x-gzip":            false,
+	} {
+		r, err := http.NewRequest(http.MethodGet, "/jwt/v1/pack", nil)
+		require.NoError(t, err)
+		r.Header.Set("Accept-Encoding", header)
+		require.Equal(t, accepted, acceptsGzip(r), header)
+	}
+}
+
 func TestReplicatedInit(t *testing.T) {
 	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
 	defer testEnv.Cleanup()
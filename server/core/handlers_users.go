@@ -0,0 +1,240 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+)
+
+// userNotification publishes a stored user JWT
+type userNotification func(account string, pubKey string, theJWT []byte) error
+
+// newUserStore opens the store of user JWTs, nil if users aren't kept
+func newUserStore(config conf.UserStoreConfig) (*natsserver.DirJWTStore, error) {
+	if config.Dir == "" {
+		return nil, nil
+	}
+	return natsserver.NewDirJWTStore(config.Dir, config.Shard, true)
+}
+
+// userAccount returns the account that issued the user, directly or through one of its signing keys
+func userAccount(claim *jwt.UserClaims) string {
+	if claim.IssuerAccount != "" {
+		return claim.IssuerAccount
+	}
+	return claim.Issuer
+}
+
+// checkUserJWT validates a posted user JWT against the stored JWT of its account, returning the status
+// and the reason it is rejected, 0 if it is accepted
+func (h *JwtHandler) checkUserJWT(claim *jwt.UserClaims) (int, string) {
+	account := userAccount(claim)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return http.StatusBadRequest, "user JWT is not issued by an account"
+	}
+	found, accountClaim := h.loadAccountJWT(account)
+	if !found || h.revoked.has(account) {
+		return http.StatusNotFound, "the account of the user is not stored"
+	}
+	if !accountClaim.DidSign(claim) {
+		return http.StatusForbidden, "user JWT is not signed by the account or one of its signing keys"
+	}
+	if scope, ok := accountClaim.SigningKeys.GetScope(claim.Issuer); ok && scope != nil {
+		if err := scope.ValidateScopedSigner(claim); err != nil {
+			return http.StatusBadRequest, fmt.Sprintf("user JWT doesn't fit the scoped signing key, %v", err)
+		}
+	}
+	if accountClaim.IsClaimRevoked(claim) {
+		return http.StatusForbidden, "user JWT is revoked by the account"
+	}
+	vr := jwt.CreateValidationResults()
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		var issues []string
+		for _, i := range vr.Issues {
+			if i.Blocking || i.TimeCheck {
+				issues = append(issues, i.Description)
+			}
+		}
+		return http.StatusBadRequest, strings.Join(issues, ", ")
+	}
+	return 0, ""
+}
+
+// UpdateUserJWT handles POST /jwt/v1/users/:pubkey, storing a user JWT issued by a stored account
+func (h *JwtHandler) UpdateUserJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	pubKey := params.ByName("pubkey")
+	shortCode := ShortKey(pubKey)
+
+	theJWT, ok := h.readBody(w, r, "bad user JWT in request", shortCode)
+	if !ok {
+		return
+	}
+	claim, err := jwt.DecodeUserClaims(string(theJWT))
+	if err != nil || claim == nil {
+		h.sendErrorResponse(http.StatusBadRequest, "bad user JWT in request", shortCode, err, w)
+		return
+	}
+	if claim.Subject != pubKey || !nkeys.IsValidPublicUserKey(pubKey) {
+		h.sendErrorResponse(http.StatusBadRequest, "pub keys don't match", shortCode, nil, w)
+		return
+	}
+	account := userAccount(claim)
+	if !h.allowWrite(w, account) {
+		return
+	}
+	if h.authorizeWrite != nil {
+		if err := h.authorizeWrite(r, account); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			h.sendErrorResponse(http.StatusUnauthorized, "write not authorized", account, err, w)
+			return
+		}
+	}
+	if status, reason := h.checkUserJWT(claim); status != 0 {
+		h.sendErrorResponse(status, reason, shortCode, nil, w)
+		return
+	}
+
+	if err := h.users.SaveAcc(pubKey, string(theJWT)); err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error saving user JWT", shortCode, err, w)
+		return
+	}
+	if h.sendUserNotification != nil {
+		if err := h.sendUserNotification(account, pubKey, theJWT); notificationPending(err) {
+			w.Header().Add(warningHeader, err.Error())
+		} else if err != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "user JWT saved, error sending notification of change", shortCode, err, w)
+			return
+		}
+	}
+
+	h.logger.Noticef("updated user JWT - %s of %s", shortCode, ShortKey(account))
+	w.Header().Set("Etag", h.etag(claim.ID, string(theJWT)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetUserJWT handles GET /jwt/v1/users/:pubkey, the text and decode parameters work like they do for accounts
+func (h *JwtHandler) GetUserJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	pubKey := params.ByName("pubkey")
+	shortCode := ShortKey(pubKey)
+
+	theJWT, err := h.users.LoadAcc(pubKey)
+	if err != nil {
+		h.sendErrorResponse(http.StatusNotFound, "no matching user JWT", shortCode, nil, w)
+		return
+	}
+	if strings.ToLower(r.URL.Query().Get("text")) == "true" {
+		h.writeJWTAsText(w, pubKey, theJWT)
+		return
+	}
+	if strings.ToLower(r.URL.Query().Get("decode")) == "true" {
+		h.writeDecodedJWT(w, r, pubKey, theJWT)
+		return
+	}
+	claim, err := jwt.DecodeUserClaims(theJWT)
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error loading JWT", shortCode, err, w)
+		return
+	}
+	e := h.etag(claim.ID, theJWT)
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, e) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Etag", e)
+	w.Header().Add(ContentType, ApplicationJWT)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(theJWT)); err != nil {
+		h.logger.Errorf("error writing user JWT for %s - %s", shortCode, err.Error())
+	}
+}
+
+// listedUser describes a stored user JWT
+type listedUser struct {
+	PubKey  string `json:"pubkey"`
+	Name    string `json:"name"`
+	Issuer  string `json:"issuer"` // the account or the signing key that issued the user
+	Expires int64  `json:"expires,omitempty"`
+	Revoked bool   `json:"revoked"` // by the stored account JWT
+}
+
+type userList struct {
+	Account string       `json:"account"`
+	Users   []listedUser `json:"users"`
+}
+
+// ListAccountUsers handles GET /jwt/v1/accounts/:pubkey/users, listing the stored users issued by the
+// account, ordered by public key
+func (h *JwtHandler) ListAccountUsers(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	account := params.ByName("pubkey")
+	pack, err := h.users.Pack(-1)
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error listing user JWTs", ShortKey(account), err, w)
+		return
+	}
+	_, accountClaim := h.loadAccountJWT(account)
+	list := userList{Account: account, Users: []listedUser{}}
+	for _, line := range strings.Split(pack, "\n") {
+		split := strings.SplitN(line, "|", 2)
+		if len(split) != 2 {
+			continue
+		}
+		claim, err := jwt.DecodeUserClaims(split[1])
+		if err != nil || userAccount(claim) != account {
+			continue
+		}
+		list.Users = append(list.Users, listedUser{
+			PubKey:  claim.Subject,
+			Name:    h.privacy.name(claim.Name),
+			Issuer:  claim.Issuer,
+			Expires: claim.Expires,
+			Revoked: accountClaim != nil && accountClaim.IsClaimRevoked(claim),
+		})
+	}
+	sort.Slice(list.Users, func(i, j int) bool {
+		return list.Users[i].PubKey < list.Users[j].PubKey
+	})
+
+	data, err := unescapedIndentedMarshal(list, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", "", err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// sendUserNotification publishes a stored user JWT on the user update subject
+func (server *AccountServer) sendUserNotification(account string, pubKey string, theJWT []byte) error {
+	if server.nats == nil && server.notifyQueue == nil {
+		server.logger.Noticef("skipping user notification for %s, no NATS configured", ShortKey(pubKey))
+		return nil
+	}
+	return server.notifyCurrent(server.nats, fmt.Sprintf(server.subjects.userUpdate, account, pubKey), theJWT, storedAccount(server.jwt.users, pubKey))
+}
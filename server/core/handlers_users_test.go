@@ -0,0 +1,168 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserJWTs(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Users.Dir = t.TempDir()
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// the account has a plain and a scoped signing key
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	account, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	signingKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	signingPub, err := signingKey.PublicKey()
+	require.NoError(t, err)
+	scopedKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	scopedPub, err := scopedKey.PublicKey()
+	require.NoError(t, err)
+	accountClaim := jwt.NewAccountClaims(account)
+	accountClaim.SigningKeys.Add(signingPub)
+	scope := jwt.NewUserScope()
+	scope.Key = scopedPub
+	scope.Template.Pub.Allow.Add("orders.>")
+	accountClaim.SigningKeys.AddScopedSigner(scope)
+	accountJWT, err := accountClaim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, account, []byte(accountJWT)))
+
+	newUser := func(signer nkeys.KeyPair, issuerAccount string, edit func(*jwt.UserClaims)) (string, string) {
+		userKey, err := nkeys.CreateUser()
+		require.NoError(t, err)
+		pubKey, err := userKey.PublicKey()
+		require.NoError(t, err)
+		claim := jwt.NewUserClaims(pubKey)
+		claim.Name = "user"
+		claim.IssuerAccount = issuerAccount
+		if edit != nil {
+			edit(claim)
+		}
+		theJWT, err := claim.Encode(signer)
+		require.NoError(t, err)
+		return pubKey, theJWT
+	}
+	post := func(pubKey string, theJWT string) (int, string) {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/users/"+pubKey), "application/jwt", strings.NewReader(theJWT))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	sub, err := testEnv.NC.SubscribeSync(fmt.Sprintf(userNotificationFormat, account, "*"))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	direct, directJWT := newUser(accountKey, "", nil)
+	status, body := post(direct, directJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	m, err := sub.NextMsg(2 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf(userNotificationFormat, account, direct), m.Subject)
+	require.Equal(t, directJWT, string(m.Data))
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/users/" + direct))
+	require.NoError(t, err)
+	stored, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, directJWT, string(stored))
+	require.NotEmpty(t, resp.Header.Get("Etag"))
+
+	signed, signedJWT := newUser(signingKey, account, nil)
+	status, body = post(signed, signedJWT)
+	require.Equal(t, http.StatusOK, status, body)
+
+	// users of a scoped signing key get their permissions from the scope
+	scoped, scopedJWT := newUser(scopedKey, account, func(c *jwt.UserClaims) {
+		c.SetScoped(true)
+	})
+	status, body = post(scoped, scopedJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	withPerms, withPermsJWT := newUser(scopedKey, account, func(c *jwt.UserClaims) {
+		c.Pub.Allow.Add(">")
+	})
+	status, body = post(withPerms, withPermsJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, "scoped signing key")
+
+	stranger, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	unknown, unknownJWT := newUser(stranger, account, nil)
+	status, _ = post(unknown, unknownJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	orphan, orphanJWT := newUser(stranger, "", nil)
+	status, _ = post(orphan, orphanJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = post(signed, directJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	expired, expiredJWT := newUser(accountKey, "", func(c *jwt.UserClaims) {
+		c.Expires = time.Now().Add(-time.Hour).Unix()
+	})
+	status, _ = post(expired, expiredJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/users/" + unknown))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + account + "/users"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var list userList
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	require.Equal(t, account, list.Account)
+	listed := map[string]string{}
+	for _, u := range list.Users {
+		listed[u.PubKey] = u.Issuer
+	}
+	require.Equal(t, map[string]string{direct: account, signed: signingPub, scoped: scopedPub}, listed)
+}
+
+func TestUserJWTsOff(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	require.Nil(t, testEnv.Server.jwt.users)
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/users/UABC"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
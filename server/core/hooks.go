@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"time"
+)
+
+// slowHook is the hook latency above which a warning is logged
+const slowHook = time.Second
+
+// Hooks are callbacks for programs embedding the account server, any of them can be nil. They are called
+// synchronously on the request that caused them, so they should return quickly. A panic in a hook is
+// logged and counted, it doesn't fail the request.
+type Hooks struct {
+	// OnAccountSaved is called once an account JWT posted or migrated to this server is stored
+	OnAccountSaved func(pubKey string, theJWT string)
+	// OnAccountDeleted is called once an account is deleted
+	OnAccountDeleted func(pubKey string)
+	// OnActivationSaved is called once an activation posted to this server is stored, under its current hash
+	OnActivationSaved func(hash string, theJWT string)
+	// OnActivationDeleted is called once an activation is deleted, with its current hash
+	OnActivationDeleted func(hash string)
+	// OnSignRequested is called before a self signed account JWT is sent to the signing service
+	OnSignRequested func(pubKey string, theJWT string)
+}
+
+// RegisterHooks adds hooks, every registered hook is called in the order they were added
+func (h *JwtHandler) RegisterHooks(hooks Hooks) {
+	h.hooks = append(h.hooks, hooks)
+}
+
+// RegisterHooks adds hooks to the handler of the server, it has to be called before Start
+func (server *AccountServer) RegisterHooks(hooks Hooks) {
+	server.Lock()
+	defer server.Unlock()
+	server.hooks = append(server.hooks, hooks)
+}
+
+func (server *AccountServer) describeHooks() {
+	server.metrics.describe("hook_calls_total", "counter", "Number of embedder hook calls by hook")
+	server.metrics.describe("hook_duration_seconds_total", "counter", "Time spent in embedder hooks by hook")
+	server.metrics.describe("hook_panics_total", "counter", "Number of embedder hook calls that panicked by hook")
+}
+
+func (h *JwtHandler) accountSaved(pubKey string, theJWT string) {
+	for _, hooks := range h.hooks {
+		if fn := hooks.OnAccountSaved; fn != nil {
+			h.runHook("account_saved", func() { fn(pubKey, theJWT) })
+		}
+	}
+}
+
+func (h *JwtHandler) accountDeleted(pubKey string) {
+	for _, hooks := range h.hooks {
+		if fn := hooks.OnAccountDeleted; fn != nil {
+			h.runHook("account_deleted", func() { fn(pubKey) })
+		}
+	}
+}
+
+func (h *JwtHandler) activationSaved(hash string, theJWT string) {
+	for _, hooks := range h.hooks {
+		if fn := hooks.OnActivationSaved; fn != nil {
+			h.runHook("activation_saved", func() { fn(hash, theJWT) })
+		}
+	}
+}
+
+func (h *JwtHandler) activationDeleted(hash string) {
+	for _, hooks := range h.hooks {
+		if fn := hooks.OnActivationDeleted; fn != nil {
+			h.runHook("activation_deleted", func() { fn(hash) })
+		}
+	}
+}
+
+func (h *JwtHandler) signRequested(pubKey string, theJWT string) {
+	for _, hooks := range h.hooks {
+		if fn := hooks.OnSignRequested; fn != nil {
+			h.runHook("sign_requested", func() { fn(pubKey, theJWT) })
+		}
+	}
+}
+
+// runHook calls the hook, recovering from a panic in it, and records how long it took
+func (h *JwtHandler) runHook(name string, fn func()) {
+	start := time.Now()
+	defer func() {
+		took := time.Since(start)
+		if r := recover(); r != nil {
+			h.logger.Errorf("%s hook panicked - %v", name, r)
+			h.metrics.inc("hook_panics_total", "hook", name)
+		}
+		if took > slowHook {
+			h.logger.Warnf("%s hook took %v", name, took)
+		}
+		h.metrics.inc("hook_calls_total", "hook", name)
+		h.metrics.add("hook_duration_seconds_total", took.Seconds(), "hook", name)
+	}()
+	fn()
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooksAreHandedOverOnStart(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = dir
+	config.HTTP.Port = 0
+	server := NewAccountServer()
+	server.RegisterHooks(Hooks{OnAccountSaved: func(string, string) {}})
+	require.NoError(t, server.InitializeFromConfig(config))
+	require.NoError(t, server.Start())
+	defer server.Stop()
+	require.Len(t, server.jwt.hooks, 1)
+}
+
+func TestHooks(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	var lock sync.Mutex
+	var calls []string
+	record := func(call string) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, call)
+	}
+	testEnv.Server.jwt.RegisterHooks(Hooks{
+		OnAccountSaved: func(pubKey string, theJWT string) {
+			record("saved " + pubKey)
+			panic("hook failure")
+		},
+		OnAccountDeleted: func(pubKey string) { record("deleted " + pubKey) },
+	})
+	testEnv.Server.jwt.RegisterHooks(Hooks{
+		OnAccountSaved: func(pubKey string, theJWT string) { record("saved again " + pubKey) },
+	})
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 1)
+	var pubKey string
+	for k := range pubKeys {
+		pubKey = k
+	}
+	require.Equal(t, []string{"saved " + pubKey, "saved again " + pubKey}, calls, "a panic doesn't stop the next hook")
+
+	claim := jwt.NewGenericClaims(testEnv.OperatorPubKey)
+	claim.Data["accounts"] = []string{pubKey}
+	proof, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodDelete, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), strings.NewReader(proof))
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "deleted "+pubKey, calls[2])
+
+	var buf bytes.Buffer
+	testEnv.Server.metrics.write(&buf)
+	require.Contains(t, buf.String(), `hook_calls_total{hook="account_saved"} 2`)
+	require.Contains(t, buf.String(), `hook_panics_total{hook="account_saved"} 1`)
+	require.Contains(t, buf.String(), `hook_duration_seconds_total{hook="account_deleted"}`)
+}
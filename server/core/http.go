@@ -18,15 +18,19 @@ package core
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-account-server/server/conf"
 	"github.com/rs/cors"
 )
@@ -36,14 +40,22 @@ func (server *AccountServer) startHTTP() error {
 
 	config := server.config.HTTP
 
+	proxies, err := newTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	router, err := server.wrapMiddlewares(server.buildRouter())
+	if err != nil {
+		return err
+	}
+
 	err = server.createHTTPListener(config)
 	if err != nil {
 		server.logger.Errorf("error creating listener: %v", err)
 		return err
 	}
 
-	router := server.buildRouter()
-
 	xrs := cors.New(cors.Options{
 		AllowOriginFunc: func(orig string) bool {
 			return true
@@ -54,27 +66,41 @@ func (server *AccountServer) startHTTP() error {
 		AllowCredentials: false,
 	})
 
+	stats := &httpCounters{}
 	httpServer := &http.Server{
-		Handler:      xrs.Handler(router),
+		Handler:      proxies.forwardedFor(stats.count(xrs.Handler(server.tracer.traceHTTP(router)))),
 		ReadTimeout:  time.Duration(config.ReadTimeout) * time.Millisecond,
 		WriteTimeout: time.Duration(config.WriteTimeout) * time.Millisecond,
+		// requests see the server stop, so long running handlers can give up before the shutdown timeout
+		BaseContext: func(net.Listener) context.Context { return server.context() },
 	}
 
 	server.http = httpServer
+	server.httpStats = stats
 
+	// the caller holds the lock, the goroutine takes it since a restart replaces the server and listener
+	listener, logger := server.listener, server.logger
 	go func() {
-		if err := server.http.Serve(server.listener); err != nil {
+		if err := httpServer.Serve(listener); err != nil {
 			if err != http.ErrServerClosed {
-				if server.logger != nil {
-					server.logger.Errorf("error attempting to serve requests: %v", err)
+				if logger != nil {
+					logger.Errorf("error attempting to serve requests: %v", err)
 				}
 				go server.Stop()
 			}
-			server.http = nil
+			server.Lock()
+			if server.http == httpServer {
+				server.http = nil
+			}
+			server.Unlock()
 		}
 	}()
 
-	server.logger.Noticef("%s listening on port %d\n", server.protocol, server.port)
+	if server.socket != "" {
+		server.logger.Noticef("%s listening on unix socket %s", server.protocol, server.socket)
+	} else {
+		server.logger.Noticef("%s listening on port %d\n", server.protocol, server.port)
+	}
 
 	return nil
 }
@@ -102,46 +128,80 @@ func (server *AccountServer) stopHTTP() {
 }
 
 func (server *AccountServer) createHTTPListener(config conf.HTTPConfig) error {
-	var listen net.Listener
-
 	hp := net.JoinHostPort(config.Host, fmt.Sprintf("%d", config.Port))
 	tlsConf := config.TLS
 
-	if tlsConf.Cert == "" {
-		listen, err := net.Listen("tcp", hp)
-		if err != nil {
+	var tlsConfig *tls.Config
+	if tlsConf.Cert != "" {
+		var err error
+		if tlsConfig, err = server.makeTLSConfig(tlsConf); err != nil {
 			return err
 		}
-		server.protocol = "http"
-		server.port = listen.Addr().(*net.TCPAddr).Port
-		server.hostPort = hp
-		if strings.HasPrefix(hp, ":") {
-			server.hostPort = fmt.Sprintf("127.0.0.1:%d", server.port)
+		if tlsConfig == nil {
+			return fmt.Errorf("TLS requires both a cert and a key")
 		}
-		server.listener = listen
-		return nil
 	}
 
-	tlsConfig, err := server.makeTLSConfig(tlsConf)
-	if err != nil {
-		return err
+	var listen net.Listener
+	var err error
+	switch {
+	case config.Socket != "" && config.Systemd:
+		return errors.New("http socket and systemd can't both be set")
+	case config.Socket != "":
+		listen, err = listenUnix(config.Socket, config.SocketMode)
+	case config.Systemd:
+		listen, err = systemdListener()
+	default:
+		listen, err = listenTCP(hp, config)
 	}
-
-	listen, err = tls.Listen("tcp", hp, tlsConfig)
 	if err != nil {
 		return err
 	}
 
-	server.protocol = "https"
-	server.port = listen.Addr().(*net.TCPAddr).Port
+	server.protocol = "http"
+	if tlsConfig != nil {
+		listen = tls.NewListener(listen, tlsConfig)
+		server.protocol = "https"
+	}
+	server.port = 0
+	server.socket = ""
 	server.hostPort = hp
-	if strings.HasPrefix(hp, ":") {
-		server.hostPort = fmt.Sprintf("127.0.0.1:%d", server.port)
+	switch addr := listen.Addr().(type) {
+	case *net.TCPAddr:
+		server.port = addr.Port
+		if config.Systemd {
+			server.hostPort = addr.String()
+		}
+		if strings.HasPrefix(server.hostPort, ":") {
+			server.hostPort = fmt.Sprintf("127.0.0.1:%d", server.port)
+		}
+	case *net.UnixAddr:
+		server.socket = addr.Name
+		server.hostPort = ""
 	}
 	server.listener = listen
 	return nil
 }
 
+// listenTCP creates a tcp listener with the socket options from the http config
+func listenTCP(hp string, config conf.HTTPConfig) (net.Listener, error) {
+	lc := net.ListenConfig{
+		KeepAlive: time.Duration(config.KeepAlive) * time.Millisecond,
+		Control:   socketControl(config),
+	}
+	listen, err := lc.Listen(context.Background(), "tcp", hp)
+	if err != nil {
+		return nil, err
+	}
+	if config.Backlog > 0 {
+		if err := setBacklog(listen, config.Backlog); err != nil {
+			listen.Close()
+			return nil, err
+		}
+	}
+	return listen, nil
+}
+
 func (server *AccountServer) makeTLSConfig(tlsConf conf.TLSConf) (*tls.Config, error) {
 	if tlsConf.Cert == "" || tlsConf.Key == "" {
 		server.logger.Noticef("TLS is not configured")
@@ -162,15 +222,127 @@ func (server *AccountServer) makeTLSConfig(tlsConf conf.TLSConf) (*tls.Config, e
 		ClientAuth:               tls.NoClientCert,
 		PreferServerCipherSuites: true,
 	}
+	if tlsConf.ClientCA != "" {
+		pem, err := os.ReadFile(tlsConf.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA %s", tlsConf.ClientCA)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if tlsConf.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if tlsConf.RequireClientCert {
+		return nil, errors.New("requiring client certificates needs a client CA")
+	}
 	return &config, nil
 }
 
 func (server *AccountServer) buildRouter() *httprouter.Router {
 	r := httprouter.New()
 	server.jwt.InitRouter(r)
+	server.initTenantRouters(r)
+	server.initAdminRouter(r)
+	server.initProvisioningRouter(r)
+	r.GET("/metrics", server.metrics.serveMetrics)
+	r.GET("/version", server.getVersion)
+	r.GET("/statsz", server.getStatsz)
+	r.GET("/statusz", server.getStatusz)
+	r.GET("/signz", server.getSignz)
+	r.GET("/readyz", server.getReadyz)
+	if server.jwt.jtis != nil {
+		r.GET("/jwt/v1/jti/:id", server.getJWTByJTI)
+	}
 	r.GET("/healthz", func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
 		w.WriteHeader(http.StatusOK)
 	})
 	return r
 }
+
+const defaultWriteAuthMaxAge = 5 * time.Minute
+
+// authorizeWrite checks the client certificate and the Authorization header of a request changing the
+// account pubKey. Writes are open unless client certificates, tokens or signed authorizations are
+// configured. A signed authorization is a JWT with the account as subject, issued by the operator, the
+// account or one of its signing keys
+func (server *AccountServer) authorizeWrite(r *http.Request, pubKey string) error {
+	return server.authorizeWriteTo(&server.jwt, r, pubKey)
+}
+
+// authorizeWriteTo checks a write to the accounts of h, whose operators sign the authorizations
+func (server *AccountServer) authorizeWriteTo(h *JwtHandler, r *http.Request, pubKey string) error {
+	auth := server.config.HTTP.Auth
+	if len(auth.Tokens) == 0 && !auth.Signed && len(auth.ClientCerts) == 0 {
+		return nil
+	}
+	if name, ok := writerCertName(r, auth.ClientCerts); ok {
+		server.logger.Tracef("%s: write authorized by client certificate %s", r.RemoteAddr, name)
+		return nil
+	}
+	if len(auth.Tokens) == 0 && !auth.Signed {
+		return errors.New("no client certificate allowed to write")
+	}
+	header := r.Header.Get("Authorization")
+	bearer := strings.TrimPrefix(header, "Bearer ")
+	if header == "" || bearer == header {
+		return errors.New("missing bearer token")
+	}
+	for _, token := range auth.Tokens {
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	if !auth.Signed {
+		return errors.New("unknown bearer token")
+	}
+
+	claim, err := jwt.DecodeGeneric(bearer)
+	if err != nil {
+		return fmt.Errorf("bad authorization JWT: %v", err)
+	}
+	vr := jwt.CreateValidationResults()
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		return errors.New("authorization JWT failed validation")
+	}
+	maxAge := defaultWriteAuthMaxAge
+	if auth.MaxAge > 0 {
+		maxAge = time.Duration(auth.MaxAge) * time.Millisecond
+	}
+	if time.Since(time.Unix(claim.IssuedAt, 0)) > maxAge {
+		return errors.New("authorization JWT is too old")
+	}
+	if claim.Subject != pubKey {
+		return errors.New("authorization JWT is for a different account")
+	}
+	if _, trusted := h.trustedKeys[claim.Issuer]; trusted || claim.Issuer == pubKey {
+		return nil
+	}
+	if found, existing := h.loadAccountJWT(pubKey); found && existing.SigningKeys.Contains(claim.Issuer) {
+		return nil
+	}
+	return errors.New("authorization JWT is not signed by the operator or the account")
+}
+
+// writerCertName returns the name of the verified client certificate if it is one of allowed, the common
+// name and the DNS and email SANs are checked
+func writerCertName(r *http.Request, allowed []string) (string, bool) {
+	if len(allowed) == 0 || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, name := range names {
+		for _, a := range allowed {
+			if name != "" && name == a {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
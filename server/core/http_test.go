@@ -17,10 +17,30 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
 )
 
@@ -82,3 +102,300 @@ func TestBadTLSConfigOnStart(t *testing.T) {
 	defer testEnv.Cleanup()
 	require.Error(t, err)
 }
+
+func TestListenSocketOptions(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.KeepAlive = 1000
+	config.HTTP.Backlog = 16
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/healthz"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("reuse port is not supported on windows")
+	}
+	config := conf.DefaultServerConfig()
+	config.HTTP.ReusePort = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// a second server can bind the same port
+	config2 := testEnv.CreateReplicaConfig("")
+	config2.Primary = ""
+	config2.HTTP.Port = testEnv.Server.port
+	config2.HTTP.ReusePort = true
+	config2.Store.Dir, err = os.MkdirTemp(os.TempDir(), "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(config2.Store.Dir)
+
+	second := NewAccountServer()
+	require.NoError(t, second.InitializeFromConfig(config2))
+	require.NoError(t, second.Start())
+	defer second.Stop()
+	require.Equal(t, testEnv.Server.port, second.port)
+
+	// without the option binding fails
+	config3 := testEnv.CreateReplicaConfig(config2.Store.Dir)
+	config3.Primary = ""
+	config3.HTTP.Port = testEnv.Server.port
+	third := NewAccountServer()
+	require.NoError(t, third.InitializeFromConfig(config3))
+	require.Error(t, third.Start())
+	third.Stop()
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes of unix sockets are not supported on windows")
+	}
+	dir, err := os.MkdirTemp("", "sock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "account-server.sock")
+
+	// a socket left behind is replaced, other files are not
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Socket = path
+	config.HTTP.SocketMode = "0660"
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	require.Equal(t, path, testEnv.Server.socket)
+	require.Equal(t, 0, testEnv.Server.port)
+	require.Equal(t, "http+unix://"+url.PathEscape(path), testEnv.Server.URL())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	testEnv.Server.Stop()
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "the socket is removed on stop")
+	require.NoError(t, os.WriteFile(path, []byte("not a socket"), 0600))
+	require.Error(t, testEnv.Server.Start())
+	testEnv.Server.Stop()
+
+	_, err = listenUnix(filepath.Join(dir, "other.sock"), "rw")
+	require.Error(t, err)
+	config.HTTP.Systemd = true
+	require.Error(t, testEnv.Server.Start())
+	testEnv.Server.Stop()
+}
+
+func TestSystemdListener(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	_, err := systemdListener()
+	require.Error(t, err)
+	t.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	_, err = systemdListener()
+	require.Error(t, err)
+	require.Empty(t, os.Getenv("LISTEN_FDS"), "the variables are unset")
+}
+
+func TestWriteAuthorization(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.Auth = conf.WriteAuthConfig{Tokens: []string{"s3cret"}, Signed: true}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	post := func(authorization string) int {
+		req, err := http.NewRequest(http.MethodPost, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), strings.NewReader(acctJWT))
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := testEnv.HTTP.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	signed := func(subject string, signer nkeys.KeyPair) string {
+		theJWT, err := jwt.NewGenericClaims(subject).Encode(signer)
+		require.NoError(t, err)
+		return "Bearer " + theJWT
+	}
+
+	otherKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	other, err := otherKey.PublicKey()
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusUnauthorized, post(""))
+	require.Equal(t, http.StatusUnauthorized, post("Bearer wrong"))
+	require.Equal(t, http.StatusUnauthorized, post("s3cret"))
+	require.Equal(t, http.StatusUnauthorized, post(signed(pubKey, otherKey)))
+	require.Equal(t, http.StatusUnauthorized, post(signed(other, testEnv.OperatorKey)))
+	require.Equal(t, http.StatusOK, post("Bearer s3cret"))
+	require.Equal(t, http.StatusOK, post(signed(pubKey, testEnv.OperatorKey)))
+	require.Equal(t, http.StatusOK, post(signed(pubKey, accountKey)))
+
+	// reads stay open
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// authorizations expire after max_age, iat only has a resolution of a second
+	testEnv.Server.config.HTTP.Auth.MaxAge = 1
+	time.Sleep(time.Second)
+	require.Equal(t, http.StatusUnauthorized, post(signed(pubKey, testEnv.OperatorKey)))
+	require.Equal(t, http.StatusOK, post("Bearer s3cret"))
+}
+
+// testClientCerts writes a CA to dir, returning its file and a client certificate issued by it for each name
+func testClientCerts(t *testing.T, dir string, names ...string) (string, map[string]tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caFile := filepath.Join(dir, "client-ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600))
+
+	certs := map[string]tls.Certificate{}
+	for i, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		certs[name] = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return caFile, certs
+}
+
+func TestClientCertWriteAuth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "clientcerts")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clientCA, certs := testClientCerts(t, dir, "ci.example.com", "laptop.example.com")
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.TLS.ClientCA = clientCA
+	config.HTTP.Auth.ClientCerts = []string{"ci.example.com"}
+	testEnv, err := SetupTestServer(config, true, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	client := func(cert string) *http.Client {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		if c, ok := certs[cert]; ok {
+			tr.TLSClientConfig.Certificates = []tls.Certificate{c}
+		}
+		return &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	}
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	post := func(c *http.Client) int {
+		resp, err := c.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBufferString(acctJWT))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusUnauthorized, post(client("")))
+	require.Equal(t, http.StatusUnauthorized, post(client("laptop.example.com")))
+	require.Equal(t, http.StatusOK, post(client("ci.example.com")))
+
+	// reads don't need a certificate, unless it is required
+	resp, err := client("").Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	testEnv.Server.Stop()
+	testEnv.Server.config.HTTP.TLS.RequireClientCert = true
+	require.NoError(t, testEnv.Server.Start())
+	_, err = client("").Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.Error(t, err)
+	resp, err = client("laptop.example.com").Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRequireClientCertWithoutCA(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.TLS.RequireClientCert = true
+	testEnv, err := SetupTestServer(config, true, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	_, err := newTrustedProxies([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+	_, err = newTrustedProxies([]string{"lb.example.com"})
+	require.Error(t, err)
+
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+	request := func(remote string, headers ...string) *http.Request {
+		r, err := http.NewRequest(http.MethodGet, "/healthz", nil)
+		require.NoError(t, err)
+		r.RemoteAddr = remote
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Add(headers[i], headers[i+1])
+		}
+		return r
+	}
+
+	// untrusted peers can't change their address
+	require.Equal(t, "1.2.3.4:5000", proxies.clientAddr(request("1.2.3.4:5000", "X-Forwarded-For", "5.6.7.8")))
+	// the last address that isn't a proxy is the client, addresses to the left of it can be spoofed
+	require.Equal(t, "5.6.7.8", proxies.clientAddr(request("10.1.1.1:5000", "X-Forwarded-For", "9.9.9.9, 5.6.7.8, 10.2.2.2")))
+	require.Equal(t, "5.6.7.8", proxies.clientAddr(request("192.168.1.1:5000", "X-Forwarded-For", "9.9.9.9", "X-Forwarded-For", "5.6.7.8")))
+	require.Equal(t, "10.3.3.3", proxies.clientAddr(request("10.1.1.1:5000", "X-Forwarded-For", "10.3.3.3")))
+	require.Equal(t, "5.6.7.8", proxies.clientAddr(request("10.1.1.1:5000", "X-Real-IP", "5.6.7.8")))
+	require.Equal(t, "10.1.1.1:5000", proxies.clientAddr(request("10.1.1.1:5000", "X-Forwarded-For", "garbage")))
+	require.Equal(t, "10.1.1.1:5000", proxies.clientAddr(request("10.1.1.1:5000")))
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.TrustedProxies = []string{"not an address"}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
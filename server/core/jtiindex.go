@@ -0,0 +1,168 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// jtiIndex maps the JTI of every account JWT saved, merged or snapshotted to its account. Entries are
+// never removed, a lookup checks that the account still holds the JWT. All methods are safe to call on
+// a nil index.
+type jtiIndex struct {
+	sync.RWMutex
+	accounts map[string]string
+}
+
+// newJTIIndex returns nil if the index is off
+func newJTIIndex(enabled bool, m *metrics) *jtiIndex {
+	if !enabled {
+		return nil
+	}
+	x := &jtiIndex{accounts: map[string]string{}}
+	m.gaugeFunc("jti_index_entries", "Number of JTIs in the JTI index", func() float64 {
+		return float64(x.len())
+	})
+	return x
+}
+
+// add indexes an account JWT, anything else is ignored
+func (x *jtiIndex) add(theJWT string) {
+	if x == nil {
+		return
+	}
+	claim, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil || claim.ID == "" {
+		return
+	}
+	x.Lock()
+	defer x.Unlock()
+	x.accounts[claim.ID] = claim.Subject
+}
+
+// addPack indexes every JWT of a pack, pubkey|jwt lines
+func (x *jtiIndex) addPack(pack string) {
+	if x == nil {
+		return
+	}
+	for _, line := range strings.Split(pack, "\n") {
+		if split := strings.SplitN(line, "|", 2); len(split) == 2 {
+			x.add(split[1])
+		}
+	}
+}
+
+func (x *jtiIndex) account(jti string) (string, bool) {
+	if x == nil {
+		return "", false
+	}
+	x.RLock()
+	defer x.RUnlock()
+	pubKey, ok := x.accounts[jti]
+	return pubKey, ok
+}
+
+func (x *jtiIndex) len() int {
+	if x == nil {
+		return 0
+	}
+	x.RLock()
+	defer x.RUnlock()
+	return len(x.accounts)
+}
+
+// initJTIIndex indexes the JWTs in the store and in the snapshots, later saves are added as they happen
+func (server *AccountServer) initJTIIndex() error {
+	server.jwt.jtis = newJTIIndex(server.config.JTIIndex, server.metrics)
+	x := server.jwt.jtis
+	if x == nil {
+		return nil
+	}
+	if packer, ok := server.JWTStore.(store.PackableJWTStore); ok {
+		pack, err := packer.Pack(-1)
+		if err != nil {
+			return err
+		}
+		x.addPack(pack)
+	}
+	for _, snap := range server.snapshots.history() {
+		for _, theJWT := range snap.JWTs {
+			x.add(theJWT)
+		}
+	}
+	server.logger.Noticef("indexed %d JTIs", x.len())
+	return nil
+}
+
+// jtiLookup is the response of GET /jwt/v1/jti/:id
+type jtiLookup struct {
+	JTI      string `json:"jti"`
+	Account  string `json:"account"`
+	Current  bool   `json:"current"`            // the store holds this JWT
+	Snapshot string `json:"snapshot,omitempty"` // the snapshot holding it, if it was replaced
+	JWT      string `json:"jwt"`
+}
+
+// getJWTByJTI handles GET /jwt/v1/jti/:id?history=true, returning the account JWT with the JTI. Only the
+// JWT currently stored is returned, unless history is set, then the snapshots are searched too, newest first.
+// The JWTs of revoked accounts are not returned.
+func (server *AccountServer) getJWTByJTI(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	jti := params.ByName("id")
+	history := strings.ToLower(r.URL.Query().Get("history")) == "true"
+	pubKey, ok := server.jwt.jtis.account(jti)
+	if !ok || server.jwt.revoked.has(pubKey) {
+		// revoked accounts are not served, as by the account lookup
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no account JWT with this JTI", "", nil, w)
+		return
+	}
+	result := jtiLookup{JTI: jti, Account: pubKey}
+	if theJWT, err := server.JWTStore.LoadAcc(pubKey); err == nil && jtiOf(theJWT) == jti {
+		result.Current = true
+		result.JWT = theJWT
+	} else if history {
+		for _, snap := range server.snapshots.history() {
+			if theJWT := snap.JWTs[pubKey]; jtiOf(theJWT) == jti {
+				result.Snapshot = snap.Name
+				result.JWT = theJWT
+				break
+			}
+		}
+	}
+	if result.JWT == "" {
+		msg := "the account no longer holds the JWT with this JTI"
+		if !history {
+			msg += ", set history=true to search the snapshots"
+		}
+		server.jwt.sendErrorResponse(http.StatusNotFound, msg, ShortKey(pubKey), nil, w)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, result)
+}
+
+func jtiOf(theJWT string) string {
+	claim, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil {
+		return ""
+	}
+	return claim.ID
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJTIIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "snapshots")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := conf.DefaultServerConfig()
+	config.JTIIndex = true
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Admin.SnapshotDir = dir
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	get := func(jti string, query string) (int, jtiLookup) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/jti/" + jti + query))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var l jtiLookup
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&l))
+		}
+		return resp.StatusCode, l
+	}
+
+	pubKey, original := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(original)))
+	claim, err := jwt.DecodeAccountClaims(original)
+	require.NoError(t, err)
+	jti := claim.ID
+	status, l := get(jti, "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, jtiLookup{JTI: jti, Account: pubKey, Current: true, JWT: original}, l)
+
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/snapshots", testAdminToken, `{"name": "v1"}`)
+	require.Equal(t, http.StatusCreated, status)
+
+	// a replaced JWT is only found in the snapshots
+	time.Sleep(1100 * time.Millisecond)
+	claim.Name = "changed"
+	changed, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(changed)))
+	status, l = get(claim.ID, "")
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, l.Current)
+
+	status, _ = get(jti, "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, l = get(jti, "?history=true")
+	require.Equal(t, http.StatusOK, status)
+	require.False(t, l.Current)
+	require.Equal(t, "v1", l.Snapshot)
+	require.Equal(t, original, l.JWT)
+
+	status, _ = get("nope", "?history=true")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// the index is rebuilt from the store and the snapshots on start
+	testEnv.Server.Stop()
+	require.NoError(t, testEnv.Server.Start())
+	status, _ = get(jti, "?history=true")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = get(claim.ID, "")
+	require.Equal(t, http.StatusOK, status)
+
+	// revoked accounts are not served
+	status, _ = adminRequest(t, testEnv, http.MethodPut, "/admin/v1/revoked/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = get(claim.ID, "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = get(jti, "?history=true")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestJTIIndexOff(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	require.Nil(t, testEnv.Server.jwt.jtis)
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/jti/foo"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
 	"github.com/nats-io/nats-account-server/server/store"
 	natsserver "github.com/nats-io/nats-server/v2/server"
 )
@@ -25,30 +29,70 @@ type accountSignup func(pubKey string, theJWT []byte) (jwt []byte, msg string, e
 type accountNotification func(pubKey string, theJWT []byte) error
 
 // callback to notify if an activation has changed
-type activationNotification func(hash string, account string, theJWT []byte) error
+type activationNotification func(hash string, account string, target string, theJWT []byte) error
 
 type JwtHandler struct {
 	logger natsserver.Logger
 
 	packLimit int
 	jwtStore  store.JWTStore
+	users     *natsserver.DirJWTStore // user JWTs, nil unless they are kept
 
 	operatorSubject string
 	operatorJWT     string
-	trustedKeys     map[string]struct{} // operator subject and signing keys
+	operators       []trustedOperator   // every configured operator, the first is operatorSubject
+	trustedKeys     map[string]struct{} // subjects and signing keys of every operator
+	keyOperators    map[string]string   // the operator subject of every trusted key
+	sysAccLock      sync.RWMutex        // guards the system account, which is replaced at runtime
 	sysAccSubject   string
 	sysAccJWT       string
 
 	sign                       accountSignup
+	signers                    *signService // health of the signing service subjects, nil without one
 	sendAccountNotification    accountNotification
 	sendActivationNotification activationNotification
+	sendDeleteNotification     accountNotification                 // called with the delete proof once an account is deleted
+	deleteProof                func(pubKey string) ([]byte, error) // signs delete proofs with the local signer, nil without one
+	sendActivationDelete       activationNotification              // called with the delete proof once an activation is deleted
+	sendUserNotification       userNotification
+
+	linter  *linter
+	policy  *accountPolicy // limits of pushed account JWTs, nil if there are none
+	metrics *metrics
+	mirror  *mirror
+
+	approvals *approvals
+	canary    *canary          // validates JWTs before they are stored, nil if not configured
+	revoked   *revokedAccounts // accounts no longer served, checked on every load
+
+	softLimits         *softLimits  // rejections that are only flagged for now, nil if everything is enforced
+	activationVersions []int        // activation hash versions activations are stored under, the first is current
+	uploads            *uploadStats // recent posts per account
+	access             *accessStats // lookups per account
+
+	privacy *privacy                 // hides sensitive claim fields
+	isAdmin func(*http.Request) bool // true if the request carries the admin token
+
+	authorizeWrite    func(r *http.Request, pubKey string) error // nil if the request may change the account
+	writes            *writeLimiter                              // limits the posts per second
+	writeLocks        *accountWriteLocks                         // serialize conditional posts per account
+	rejectStale       bool                                       // refuse posts issued before the stored JWT
+	hashETags         bool                                       // ETags are the SHA-256 of the stored JWT, not its JTI
+	expiration        conf.ExpirationConfig                      // whether expired accounts are hidden by default
+	verifyActivations bool                                       // check activations against the accounts in the store before saving them
+	maxBody           int64                                      // bytes read from a posted body, 0 is defaultMaxBody
+
+	hooks  []Hooks   // registered by embedders
+	jtis   *jtiIndex // account JWTs by JTI, nil if they aren't indexed
+	tags   *tagIndex // accounts by tag, nil if they aren't indexed
+	tracer *tracer   // records spans of store, signing and notification calls, nil unless tracing
 }
 
 func NewJwtHandler(logger natsserver.Logger) JwtHandler {
 	if logger == nil {
 		logger = &NilLogger{}
 	}
-	return JwtHandler{logger: logger}
+	return JwtHandler{logger: logger, writeLocks: &accountWriteLocks{}}
 }
 
 // Initialize JwtHandler which exposes http handler on top of a jwtStore
@@ -78,29 +122,18 @@ func (h *JwtHandler) Initialize(opJWT []byte, sysAccJWT []byte, jwtStore store.J
 		h.sysAccJWT = string(sysAccJWT)
 		h.sysAccSubject = accClaim.Subject
 
-		h.logger.Noticef("System Account: %s", accClaim.Name)
+		h.logger.Noticef("System Account: %s", h.privacy.name(accClaim.Name))
 		h.logger.Noticef("System Account Name: %s", accClaim.Subject)
 	}
 
 	if len(opJWT) > 0 {
-		operatorJWT, err := jwt.DecodeOperatorClaims(string(opJWT))
+		operatorJWT, err := h.addOperator(opJWT)
 		if err != nil {
 			return err
 		}
-
-		keys := make(map[string]struct{})
-		keys[operatorJWT.Subject] = struct{}{}
-		for _, k := range operatorJWT.SigningKeys {
-			keys[k] = struct{}{}
-		}
-
 		h.operatorSubject = operatorJWT.Subject
-		h.trustedKeys = keys
 		h.operatorJWT = string(opJWT)
 
-		h.logger.Noticef("Operator: %s", operatorJWT.Subject)
-		h.logger.Noticef("Operator Name: %s", operatorJWT.Name)
-
 		if h.sysAccSubject != "" && operatorJWT.SystemAccount != "" && h.sysAccSubject != operatorJWT.SystemAccount {
 			return fmt.Errorf("the Operator System Account %s differs from configured System Account %s",
 				h.sysAccSubject, operatorJWT.SystemAccount)
@@ -111,27 +144,108 @@ func (h *JwtHandler) Initialize(opJWT []byte, sysAccJWT []byte, jwtStore store.J
 	return nil
 }
 
+// trustedOperator is a configured operator JWT
+type trustedOperator struct {
+	claim *jwt.OperatorClaims
+	jwt   string
+}
+
+// addOperator trusts the subject and signing keys of another operator
+func (h *JwtHandler) addOperator(opJWT []byte) (*jwt.OperatorClaims, error) {
+	operatorJWT, err := jwt.DecodeOperatorClaims(string(opJWT))
+	if err != nil {
+		return nil, err
+	}
+	if h.isOperator(operatorJWT.Subject) {
+		return nil, fmt.Errorf("operator %s is configured more than once", operatorJWT.Subject)
+	}
+	if h.trustedKeys == nil {
+		h.trustedKeys = make(map[string]struct{})
+		h.keyOperators = make(map[string]string)
+	}
+	h.trustedKeys[operatorJWT.Subject] = struct{}{}
+	h.keyOperators[operatorJWT.Subject] = operatorJWT.Subject
+	for _, k := range operatorJWT.SigningKeys {
+		if other, ok := h.keyOperators[k]; ok {
+			return nil, fmt.Errorf("signing key %s belongs to operator %s as well", k, other)
+		}
+		h.trustedKeys[k] = struct{}{}
+		h.keyOperators[k] = operatorJWT.Subject
+	}
+	h.operators = append(h.operators, trustedOperator{claim: operatorJWT, jwt: string(opJWT)})
+
+	h.logger.Noticef("Operator: %s", operatorJWT.Subject)
+	h.logger.Noticef("Operator Name: %s", operatorJWT.Name)
+	return operatorJWT, nil
+}
+
+// errOtherOperator rejects a write or delete by one operator of an account issued by another
+var errOtherOperator = errors.New("the account belongs to another operator")
+
+// checkAccountOperator returns errOtherOperator if the stored JWT of the account was issued by another
+// operator than issuer, so one operator can't replace or delete the accounts of another. Accounts
+// without a stored JWT, or whose issuer is no longer trusted, can be written by any operator.
+func (h *JwtHandler) checkAccountOperator(pubKey string, issuer string) error {
+	if len(h.operators) < 2 {
+		return nil
+	}
+	found, stored := h.loadAccountJWT(pubKey)
+	if !found {
+		return nil
+	}
+	if owner, ok := h.keyOperators[stored.Issuer]; ok && owner != h.keyOperators[issuer] {
+		return errOtherOperator
+	}
+	return nil
+}
+
+// isOperator returns true if the key is the subject of a configured operator, not one of its signing keys
+func (h *JwtHandler) isOperator(key string) bool {
+	for _, op := range h.operators {
+		if op.claim.Subject == key {
+			return true
+		}
+	}
+	return false
+}
+
 // BuildRouter initializes the http.Router with default router setup
 func (h *JwtHandler) InitRouter(r *httprouter.Router) {
 	if r == nil {
 		return
 	}
 	r.GET("/jwt/v1/help", h.JWTHelp)
+	r.GET("/jwt/v1/info", h.GetInfo)
 
 	if h.operatorJWT != "" {
 		r.GET("/jwt/v1/operator", h.GetOperatorJWT)
+		r.GET("/jwt/v1/operators", h.GetOperators)
 	}
 
 	// replicas and readonly stores cannot accept post requests
 	// replicas use a writable store, thus the extra check
 	if !h.jwtStore.IsReadOnly() {
-		r.POST("/jwt/v1/accounts/:pubkey", h.UpdateAccountJWT)
+		r.POST("/jwt/v1/accounts/:pubkey", h.requireWriteAuth(h.UpdateAccountJWT))
+		r.POST("/jwt/v1/migrations", h.ApplyMigration)
+		if _, ok := h.jwtStore.(store.DeletableJWTStore); ok {
+			r.DELETE("/jwt/v1/accounts/:pubkey", h.DeleteAccountJWT)
+			r.DELETE("/jwt/v1/activations/:hash", h.DeleteActivationJWT)
+		}
 		// activations are not supported
 		//r.POST("/jwt/v1/activations", h.UpdateActivationJWT)
+		if h.users != nil {
+			r.POST("/jwt/v1/users/:pubkey", h.UpdateUserJWT)
+		}
+	}
+
+	if h.users != nil {
+		r.GET("/jwt/v1/users/:pubkey", h.GetUserJWT)
+		r.GET("/jwt/v1/accounts/:pubkey/users", h.ListAccountUsers)
 	}
 
 	if _, ok := h.jwtStore.(store.PackableJWTStore); ok {
 		r.GET("/jwt/v1/pack", h.PackJWTs)
+		r.GET("/jwt/v1/accounts/:pubkey/activations", h.ListAccountActivations)
 	}
 
 	r.GET("/jwt/v1/accounts/:pubkey", h.GetAccountJWT)
@@ -142,8 +256,63 @@ func (h *JwtHandler) InitRouter(r *httprouter.Router) {
 	//r.GET("/jwt/v1/activations/:hash", h.GetActivationJWT)
 }
 
+// requireWriteAuth calls next only if the request is authorized to change the account in the path
+func (h *JwtHandler) requireWriteAuth(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if status, err := h.writeAllowed(w.Header(), r, params.ByName("pubkey")); err != nil {
+			writeErrorBody(w, status, err.Error())
+			return
+		}
+		next(w, r, params)
+	}
+}
+
+// writeAllowed applies the write limit and the write authorization of r to a write of pubKey, soft
+// limit warnings and the headers of a rejection are added to header
+func (h *JwtHandler) writeAllowed(header http.Header, r *http.Request, pubKey string) (int, error) {
+	if status, err := h.writeLimited(header, pubKey); err != nil {
+		return status, err
+	}
+	if h.authorizeWrite != nil {
+		if err := h.authorizeWrite(r, pubKey); err != nil {
+			header.Set("WWW-Authenticate", "Bearer")
+			return h.rejectUpdate(http.StatusUnauthorized, "write not authorized", pubKey, err)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// writeLimited takes a token from the write limiter, returning 429 if there is none
+func (h *JwtHandler) writeLimited(header http.Header, pubKey string) (int, error) {
+	if h.writes.allow() {
+		return http.StatusOK, nil
+	}
+	if h.softLimits.warnOnly(softWriteRate) {
+		h.flagViolation(header, softWriteRate, pubKey, "too many posts")
+		return http.StatusOK, nil
+	}
+	header.Set("Retry-After", "1")
+	return h.rejectUpdate(http.StatusTooManyRequests, "too many posts, try again later", pubKey, nil)
+}
+
+// allowWrite takes a token from the write limiter, responding with a 429 if there is none
+func (h *JwtHandler) allowWrite(w http.ResponseWriter, pubKey string) bool {
+	if status, err := h.writeLimited(w.Header(), pubKey); err != nil {
+		writeErrorBody(w, status, err.Error())
+		return false
+	}
+	return true
+}
+
 // trace and respond with message
 func (h *JwtHandler) sendErrorResponse(httpStatus int, msg string, account string, err error, w http.ResponseWriter) error {
+	h.logError(msg, account, err)
+	writeErrorBody(w, httpStatus, msg)
+	return err
+}
+
+// logError logs msg and err, prefixed with the short key of account
+func (h *JwtHandler) logError(msg string, account string, err error) {
 	account = ShortKey(account)
 	if err != nil {
 		if account != "" {
@@ -158,11 +327,47 @@ func (h *JwtHandler) sendErrorResponse(httpStatus int, msg string, account strin
 			h.logger.Errorf("%s", msg)
 		}
 	}
+}
 
+// writeErrorBody responds with the status and msg as plain text
+func writeErrorBody(w http.ResponseWriter, httpStatus int, msg string) {
 	w.Header().Set(ContentType, TextPlain)
 	w.WriteHeader(httpStatus)
 	fmt.Fprintln(w, msg)
-	return err
+}
+
+// defaultMaxBody limits the body of posts when http.max_body_size isn't set, JWTs are a few KB
+const defaultMaxBody = 256 << 10
+
+// bodyLimit returns the most bytes read from the body of a post
+func (h *JwtHandler) bodyLimit() int64 {
+	if h.maxBody > 0 {
+		return h.maxBody
+	}
+	return defaultMaxBody
+}
+
+// readBody reads the body of a post up to the body limit, on failure the error response is sent, 413
+// if the body is too large and 400 with msg otherwise
+func (h *JwtHandler) readBody(w http.ResponseWriter, r *http.Request, msg string, account string) ([]byte, bool) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.bodyLimit()))
+	if err != nil {
+		h.sendBodyError(w, err, msg, account)
+		return nil, false
+	}
+	return body, true
+}
+
+// sendBodyError sends 413 if err comes from reading past the limit of an http.MaxBytesReader, and 400
+// with msg otherwise
+func (h *JwtHandler) sendBodyError(w http.ResponseWriter, err error, msg string, account string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.sendErrorResponse(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), account, nil, w)
+		return
+	}
+	h.sendErrorResponse(http.StatusBadRequest, msg, account, err, w)
 }
 
 // unescapedIndentedMarshal handle indention for decoded JWTs
@@ -179,37 +384,98 @@ func unescapedIndentedMarshal(v interface{}, prefix, indent string) ([]byte, err
 	return buf.Bytes(), nil
 }
 
-func (h *JwtHandler) writeDecodedJWT(w http.ResponseWriter, pubKey string, theJWT string) {
+// decodedJWT is the JSON document served for a JWT to requests that accept application/json
+type decodedJWT struct {
+	Header    jwt.Header             `json:"header"`
+	Claims    map[string]interface{} `json:"claims"`
+	Signature string                 `json:"signature"` // base64 url encoded, as in the JWT
+}
+
+// acceptsJSON is true if the Accept header of the request lists application/json without a q of 0
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(accept), ";")
+		if strings.ToLower(strings.TrimSpace(name)) != ApplicationJSON {
+			continue
+		}
+		q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// decodeJWT splits a JWT into its decoded header and claims, sensitive account claim fields are hidden
+// unless the request carries the admin token, on failure the error response is sent
+func (h *JwtHandler) decodeJWT(w http.ResponseWriter, r *http.Request, pubKey string, theJWT string) (*decodedJWT, bool) {
 	parts := strings.Split(theJWT, ".")
+	if len(parts) != 3 {
+		h.sendErrorResponse(http.StatusInternalServerError, "error decoding account claim", pubKey, errors.New("expected 3 JWT sections"), w)
+		return nil, false
+	}
 	head := parts[0]
 	claimSection := parts[1]
 	sig := parts[2]
 	headerString, err := base64.RawURLEncoding.DecodeString(head)
 	if err != nil {
 		h.sendErrorResponse(http.StatusInternalServerError, "error decoding account claim header", pubKey, err, w)
-		return
+		return nil, false
 	}
 	header := jwt.Header{}
 	if err := json.Unmarshal(headerString, &header); err != nil {
 		h.sendErrorResponse(http.StatusInternalServerError, "error unmarshalling account claim header", pubKey, err, w)
-		return
-	}
-
-	headerJSON, err := unescapedIndentedMarshal(header, "", "    ")
-	if err != nil {
-		h.sendErrorResponse(http.StatusInternalServerError, "error marshalling account claim header", pubKey, err, w)
-		return
+		return nil, false
 	}
 
 	claimString, err := base64.RawURLEncoding.DecodeString(claimSection)
 	if err != nil {
 		h.sendErrorResponse(http.StatusInternalServerError, "error decoding account claim", pubKey, err, w)
-		return
+		return nil, false
 	}
 	claim := map[string]interface{}{}
 	err = json.Unmarshal(claimString, &claim)
 	if err != nil {
 		h.sendErrorResponse(http.StatusInternalServerError, "error decoding account claim", pubKey, err, w)
+		return nil, false
+	}
+
+	if nats, ok := claim["nats"].(map[string]interface{}); ok && nats["type"] == string(jwt.AccountClaim) &&
+		(h.isAdmin == nil || !h.isAdmin(r)) {
+		if err := h.privacy.hide(claim); err != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "error sealing account claim", pubKey, err, w)
+			return nil, false
+		}
+	}
+	return &decodedJWT{Header: header, Claims: claim, Signature: sig}, true
+}
+
+// writeDecodedJSON writes the header, claims and signature of the JWT as a JSON document
+func (h *JwtHandler) writeDecodedJSON(w http.ResponseWriter, r *http.Request, pubKey string, theJWT string) {
+	decoded, ok := h.decodeJWT(w, r, pubKey, theJWT)
+	if !ok {
+		return
+	}
+	data, err := unescapedIndentedMarshal(decoded, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", pubKey, err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// writeDecodedJWT writes the decoded header and claims, sensitive account claim fields are hidden
+// unless the request carries the admin token
+func (h *JwtHandler) writeDecodedJWT(w http.ResponseWriter, r *http.Request, pubKey string, theJWT string) {
+	decoded, ok := h.decodeJWT(w, r, pubKey, theJWT)
+	if !ok {
+		return
+	}
+	header, claim, sig := decoded.Header, decoded.Claims, decoded.Signature
+
+	headerJSON, err := unescapedIndentedMarshal(header, "", "    ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error marshalling account claim header", pubKey, err, w)
 		return
 	}
 
@@ -221,8 +487,8 @@ func (h *JwtHandler) writeDecodedJWT(w http.ResponseWriter, pubKey string, theJW
 
 	var subErr error
 
-	r := regexp.MustCompile(`"token":.*?"(.*?)",`)
-	claimJSON = r.ReplaceAllFunc(claimJSON, func(m []byte) []byte {
+	re := regexp.MustCompile(`"token":.*?"(.*?)",`)
+	claimJSON = re.ReplaceAllFunc(claimJSON, func(m []byte) []byte {
 		if subErr != nil {
 			return []byte(fmt.Sprintf(`"token": <bad token - %s>,`, subErr.Error()))
 		}
@@ -255,8 +521,8 @@ func (h *JwtHandler) writeDecodedJWT(w http.ResponseWriter, pubKey string, theJW
 		return
 	}
 
-	r = regexp.MustCompile(`"iat":.*?(\d?),`)
-	claimJSON = r.ReplaceAllFunc(claimJSON, func(m []byte) []byte {
+	re = regexp.MustCompile(`"iat":.*?(\d?),`)
+	claimJSON = re.ReplaceAllFunc(claimJSON, func(m []byte) []byte {
 		if subErr != nil {
 			return []byte(fmt.Sprintf(`"iat": <parse error - %s>,`, subErr.Error()))
 		}
@@ -278,8 +544,8 @@ func (h *JwtHandler) writeDecodedJWT(w http.ResponseWriter, pubKey string, theJW
 		return []byte(decoded)
 	})
 
-	r = regexp.MustCompile(`"exp":.*?(\d?),`)
-	claimJSON = r.ReplaceAllFunc(claimJSON, func(m []byte) []byte {
+	re = regexp.MustCompile(`"exp":.*?(\d?),`)
+	claimJSON = re.ReplaceAllFunc(claimJSON, func(m []byte) []byte {
 		if subErr != nil {
 			return []byte(fmt.Sprintf(`"exp": <parse error - %s>,`, subErr.Error()))
 		}
@@ -325,9 +591,33 @@ func (h *JwtHandler) writeDecodedJWT(w http.ResponseWriter, pubKey string, theJW
 	}
 }
 
+// staleWindow is how long clients may use a JWT past its max-age, while revalidating or if that fails
+const staleWindow = time.Hour
+
+// checkExpiration returns true if expired accounts are hidden from the request, check=true or check=false
+// in the query override the configured default
+func (h *JwtHandler) checkExpiration(r *http.Request) bool {
+	switch strings.ToLower(r.URL.Query().Get("check")) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return h.expiration.Enforce
+}
+
+// expired returns true if the account expired longer ago than the grace window
+func (h *JwtHandler) expired(claim *jwt.AccountClaims) bool {
+	if claim.Expires <= 0 {
+		return false
+	}
+	grace := time.Duration(h.expiration.Grace) * time.Millisecond
+	return time.Now().After(time.Unix(claim.Expires, 0).Add(grace))
+}
+
 func cacheControlForExpiration(pubKey string, expires int64) string {
 	now := time.Now().UTC()
 	maxAge := int64(time.Unix(expires, 0).Sub(now).Seconds())
-	stale := int64(60 * 60) // One hour
+	stale := int64(staleWindow.Seconds())
 	return fmt.Sprintf("max-age=%d, stale-while-revalidate=%d, stale-if-error=%d", maxAge, stale, stale)
 }
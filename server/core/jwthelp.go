@@ -30,11 +30,16 @@ Returns this page.
 
 If the server is configured with an operator JWT path, this URL will return the Operator JWT loaded at startup to find the trusted keys.
 
+## GET /jwt/v1/operators
+
+Lists every configured operator as JSON, with its subject, name, signing keys, system account and JWT. Account JWTs signed by any of them are accepted.
+
 ## GET /jwt/v1/accounts/<pubkey>
 
 Retrieve an account JWT by the public key. The result is either an error or the encoded JWT.
 
-The response contains cache control headers, and uses the JTI as the ETag.
+The response contains cache control headers, and uses the JTI as the ETag, or the SHA-256 of the JWT
+with etags set to hash.
 
 The response has content type application/jwt and may cause a download in a browser.
 
@@ -46,11 +51,15 @@ A status 404 is returned if the JWT is not found.
 
 Four optional query parameters are supported:
 
-  * check - can be set to "true" which will tell the server to return 404 if the JWT is expired
+  * check - can be set to "true" which will tell the server to return 404 if the JWT is expired, or to "false"
+    to skip the check when the server enforces expiration
   * text - can be set to "true" to change the content type to text/plain
   * decode - can be set to "true" to display the JSON for the JWT header and body
   * noticy - can be set to "true" to trigger a notification event if NATS is configured
 
+With an Accept: application/json header the decoded header, claims and signature are returned as
+a JSON document, on this path as well as for activations and the operator.
+
 ## POST /jwt/v1/accounts/<pubkey> (optional)
 
 Update, or store, an account JWT. The JWT Subject should match the pubkey.
@@ -63,6 +72,34 @@ cases a status 500 may be returned if there was an issue saving the JWT.
 If the JWT is self signed and the account server is enabled to do so, the JWT may be signed.
 Optionally a status of 202 can be returned, signifying that signing happens out of band.
 
+The response uses the JTI of the stored JWT, or its SHA-256, as the ETag. A status 412 is returned if the
+request contains an If-Match header that doesn't match the ETag of the stored JWT.
+
+A status 409 is returned if the stored JWT was issued later than the posted one, unless the query parameter
+force is set to "true".
+
+## POST /jwt/v1/migrations (optional)
+
+Store several account JWTs, all or nothing. The body is {"jwts": ["<jwt>", ...]}, every JWT must be
+signed by the operator and is validated before any is stored. The JWTs are notified in order.
+
+A status 400 lists the rejected JWTs. The optional query parameter dry_run=true only validates them.
+
+## GET /jwt/v1/jti/<jti> (optional)
+
+Retrieve an account JWT by its JTI, when jti_index is enabled. The response is JSON with the account,
+the JWT and whether it is current. With the query parameter history=true the snapshots are searched too.
+
+## GET /jwt/v1/pack
+
+Stream the account JWTs in the store, one <pubkey>|<jwt> per line. The body is gzipped if the client
+accepts it. The Account-Server-Pack-Hash header holds the hash of the store.
+
+Two optional query parameters are supported:
+
+  * max - the maximum number of JWTs to return
+  * since - a hash from a previous response, a status 304 is returned if the store still has that hash
+
 ## GET /jwt/v1/activations/<hash>
 
 Retrieve an activation token by its hash.
@@ -78,10 +115,30 @@ Three optional query parameters are supported:
   * decode - can be set to "true" to display the JSON for the JWT header and body
   * notify - can be set to "true" to trigger a notification event if NATS is configured
 
-The response contains cache control headers, and uses the JTI as the ETag.
+The response contains cache control headers, and uses the JTI as the ETag, or the SHA-256 of the JWT
+with etags set to hash.
 
 A 304 is returned if the request contains the appropriate If-None-Match header.
 
+## GET /jwt/v1/accounts/<pubkey>/activations (optional)
+
+List the stored activations issued by or granted to the account, with their hash, issuer, subject,
+import subject and expiry. Each activation is listed once, with the hash of the current version.
+
+## POST /jwt/v1/users/<pubkey> (optional)
+
+Post a user JWT, signed by a stored account or one of its signing keys. Users of scoped signing keys
+can't carry their own permissions. Returns 404 if the account isn't stored, 403 if the user isn't
+signed by the account or is revoked, 400 for invalid users.
+
+## GET /jwt/v1/users/<pubkey> (optional)
+
+Retrieve a stored user JWT, supports the text and decode parameters and If-None-Match.
+
+## GET /jwt/v1/accounts/<pubkey>/users (optional)
+
+List the stored users of the account, with their name, issuer, expiry and whether they are revoked.
+
 ## POST /jwt/v1/activations
 
 Post a new activation token a JWT.
@@ -92,7 +149,17 @@ Activation tokens are stored by their hash, so two tokens with the same hash wil
 however this should only happen if the accounts and subjects match which requires either the
 same export or a matching one.
 
+With verifyactivations set the token is checked against the store first: the exporting account, the
+issuer or the account of its signing key, has to be stored and export the subject with the type of the
+token, and the importing account has to be stored as well. Otherwise a status 422 lists every problem.
+
 A status 400 is returned if there is a problem with the JWT or saving it. In rare
 cases a status 500 may be returned if there was an issue saving the JWT. Otherwise
 a status 200 is returned.
+
+## DELETE /jwt/v1/activations/<hash> (optional)
+
+Remove a stored activation. The body is a generic JWT signed by the exporting account, or one of its
+signing keys, with itself as the subject and the hash in the activations list of its data. The proof
+is published on $SYS.ACCOUNT.<exporter>.CLAIMS.DEACTIVATE.<hash>.
 `
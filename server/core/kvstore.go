@@ -0,0 +1,331 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	defaultKVBucket  = "account_jwts"
+	defaultKVTimeout = 10 * time.Second
+	kvMergeRetries   = 3
+)
+
+func init() {
+	RegisterStoreBackend("kv", newKVStore)
+}
+
+// kvStore keeps every account JWT under its public key in a JetStream key value bucket, so the account
+// server itself is stateless. It has its own connection, the store is opened before the server connects
+// to NATS. Several account servers can share the bucket, Watch reports the JWTs saved by any of them.
+type kvStore struct {
+	nc       *nats.Conn
+	kv       nats.KeyValue
+	replicas int
+	watcher  nats.KeyWatcher
+	health   watchHealth
+}
+
+func newKVStore(config conf.StoreConfig) (store.JWTStore, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, fmt.Errorf("store type kv requires endpoints")
+	}
+	if config.Replicas < 0 {
+		return nil, fmt.Errorf("store replicas can't be negative")
+	}
+	bucket := config.Bucket
+	if bucket == "" {
+		bucket = defaultKVBucket
+	}
+	timeout := defaultKVTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	ks := &kvStore{}
+	options := []nats.Option{
+		nats.Name("nats-account-server store"),
+		nats.Timeout(timeout),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err == nil {
+				err = errors.New("disconnected")
+			}
+			ks.health.failed(err)
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			ks.health.up()
+		}),
+	}
+	if config.Credentials != "" {
+		options = append(options, nats.UserCredentials(config.Credentials))
+	}
+	if config.Username != "" {
+		options = append(options, nats.UserInfo(config.Username, config.Password))
+	}
+	nc, err := nats.Connect(strings.Join(config.Endpoints, ","), options...)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the kv store, %v", err)
+	}
+	js, err := nc.JetStream(nats.MaxWait(timeout))
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	replicas := config.Replicas
+	if replicas == 0 {
+		replicas = 1
+	}
+	kv, err := openKVBucket(js, bucket, "account JWTs of the nats-account-server", replicas)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	ks.nc, ks.kv, ks.replicas = nc, kv, replicas
+	return ks, nil
+}
+
+// openKVBucket opens the bucket, it is created with the replicas if it doesn't exist
+func openKVBucket(js nats.JetStreamContext, bucket string, description string, replicas int) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: description,
+			History:     1,
+			Replicas:    replicas,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening kv bucket %s, %v", bucket, err)
+	}
+	return kv, nil
+}
+
+// sequence keeps the sequence of update responses in the bucket <bucket>_sequence, next to the JWTs
+func (ks *kvStore) sequence() (sequence, error) {
+	js, err := ks.nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := openKVBucket(js, ks.kv.Bucket()+"_sequence", "update response sequence of the nats-account-server", ks.replicas)
+	if err != nil {
+		return nil, err
+	}
+	return &kvSequence{kv: kv}, nil
+}
+
+func (ks *kvStore) LoadAcc(publicKey string) (string, error) {
+	e, err := ks.kv.Get(publicKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return "", fmt.Errorf("no JWT for %s", ShortKey(publicKey))
+	} else if err != nil {
+		return "", err
+	}
+	return string(e.Value()), nil
+}
+
+func (ks *kvStore) SaveAcc(publicKey string, theJWT string) error {
+	_, err := ks.kv.Put(publicKey, []byte(theJWT))
+	return err
+}
+
+// DeleteAcc purges the key, a delete would keep the JWT as history
+func (ks *kvStore) DeleteAcc(publicKey string) error {
+	if _, err := ks.kv.Get(publicKey); errors.Is(err, nats.ErrKeyNotFound) {
+		return errAccountNotFound
+	} else if err != nil {
+		return err
+	}
+	return ks.kv.Purge(publicKey)
+}
+
+func (ks *kvStore) IsReadOnly() bool {
+	return false
+}
+
+// Close closes the connection first, stopping a watch while disconnected waits for the consumer delete
+// to time out
+func (ks *kvStore) Close() {
+	ks.nc.Close()
+	if ks.watcher != nil {
+		ks.watcher.Stop()
+	}
+}
+
+// each calls fn with every stored key and JWT, read from a watch that ends once it caught up
+func (ks *kvStore) each(fn func(pubKey string, theJWT string) bool) error {
+	w, err := ks.kv.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+	for e := range w.Updates() {
+		if e == nil {
+			return nil
+		}
+		if !fn(e.Key(), string(e.Value())) {
+			return nil
+		}
+	}
+	return errors.New("kv watch stopped while listing")
+}
+
+// keys lists the keys of the bucket without reading the JWTs
+func (ks *kvStore) keys() ([]string, error) {
+	lister, err := ks.kv.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer lister.Stop()
+	var keys []string
+	for k := range lister.Keys() {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// size is the number of JWTs in the bucket, 0 if it can't be counted. The bucket status counts purge
+// markers too, so the keys are listed.
+func (ks *kvStore) size() int {
+	lister, err := ks.kv.ListKeys()
+	if err != nil {
+		return 0
+	}
+	defer lister.Stop()
+	count := 0
+	for range lister.Keys() {
+		count++
+	}
+	return count
+}
+
+// Pack returns up to maxJWTs unexpired JWTs
+func (ks *kvStore) Pack(maxJWTs int) (string, error) {
+	var pack []string
+	now := time.Now().Unix()
+	err := ks.each(func(pubKey string, theJWT string) bool {
+		if len(pack) == maxJWTs {
+			return false
+		}
+		if claim, err := jwt.DecodeGeneric(theJWT); err == nil && claim.Expires > 0 && claim.Expires < now {
+			return true
+		}
+		pack = append(pack, fmt.Sprintf("%s|%s", pubKey, theJWT))
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(pack, "\n"), nil
+}
+
+// Merge saves the JWTs in the pack that are newer than the stored ones. Each JWT is only written if
+// the stored one didn't change since it was compared, so concurrent merges by other servers are safe.
+func (ks *kvStore) Merge(pack string) error {
+	for _, line := range strings.Split(pack, "\n") {
+		if line == "" {
+			continue
+		}
+		split := strings.Split(line, "|")
+		if len(split) != 2 {
+			return fmt.Errorf("line in package didn't contain 2 entries: %q", line)
+		}
+		pubKey, theJWT := split[0], split[1]
+		if !nkeys.IsValidPublicAccountKey(pubKey) {
+			return fmt.Errorf("key to merge is not a valid public account key")
+		}
+		if err := ks.mergeOne(pubKey, theJWT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ks *kvStore) mergeOne(pubKey string, theJWT string) error {
+	for i := 0; i < kvMergeRetries; i++ {
+		existing := ""
+		var revision uint64
+		e, err := ks.kv.Get(pubKey)
+		if err == nil {
+			existing, revision = string(e.Value()), e.Revision()
+		} else if !errors.Is(err, nats.ErrKeyNotFound) {
+			return err
+		}
+		if newer, err := isNewerJWT(pubKey, existing, theJWT); err != nil {
+			return err
+		} else if !newer {
+			return nil
+		}
+		// create also takes the place of a purged key
+		if revision == 0 {
+			_, err = ks.kv.Create(pubKey, []byte(theJWT))
+		} else {
+			_, err = ks.kv.Update(pubKey, []byte(theJWT), revision)
+		}
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, nats.ErrKeyExists) {
+			return err
+		}
+	}
+	return fmt.Errorf("account %s kept changing while merging", ShortKey(pubKey))
+}
+
+// Watch calls changed with the public key of every JWT saved, by this or any other account server,
+// until the store is closed. The watch follows reconnects of the store connection on its own, JWTs
+// saved while it was disconnected are delivered once it is back.
+func (ks *kvStore) Watch(changed func(publicKey string)) error {
+	w, err := ks.kv.WatchAll(nats.UpdatesOnly(), nats.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	ks.watcher = w
+	ks.health.up()
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				continue
+			}
+			ks.health.event()
+			changed(e.Key())
+		}
+	}()
+	return nil
+}
+
+func (ks *kvStore) watchState() watchState {
+	return ks.health.get()
+}
+
+// check reads the bucket status, the bucket isn't written
+func (ks *kvStore) check(ctx context.Context) error {
+	if !ks.nc.IsConnected() {
+		return fmt.Errorf("not connected to NATS, %s", ks.nc.Status())
+	}
+	_, err := ks.kv.Status()
+	return err
+}
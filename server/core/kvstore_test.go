@@ -0,0 +1,134 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore(t *testing.T) {
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	ns := gnatsd.RunServer(&opts)
+	defer ns.Shutdown()
+
+	_, err := newKVStore(conf.StoreConfig{Type: "kv"})
+	require.Error(t, err, "endpoints are required")
+
+	config := conf.StoreConfig{Type: "kv", Endpoints: []string{ns.ClientURL()}, Bucket: "accounts"}
+	s, err := newKVStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	ks := s.(*kvStore)
+	require.NoError(t, ks.check(context.Background()))
+
+	// the sequence is kept next to the bucket and shared by everyone opening it
+	seqs := make([]sequence, 2)
+	for i := range seqs {
+		seqs[i], err = ks.sequence()
+		require.NoError(t, err)
+	}
+	for i := int64(1); i <= 4; i++ {
+		seq, err := seqs[i%2].next()
+		require.NoError(t, err)
+		require.Equal(t, i, seq)
+	}
+
+	changed := make(chan string, 10)
+	require.NoError(t, ks.Watch(func(pubKey string) { changed <- pubKey }))
+	next := func() string {
+		select {
+		case pubKey := <-changed:
+			return pubKey
+		case <-time.After(2 * time.Second):
+			t.Fatal("no change reported")
+			return ""
+		}
+	}
+
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	jwts := map[string]string{}
+	var pack []string
+	for i := 0; i < 3; i++ {
+		pubKey, theJWT := newAccountJWT(t, operatorKey)
+		jwts[pubKey] = theJWT
+		_, err := ks.LoadAcc(pubKey)
+		require.Error(t, err)
+		pack = append(pack, pubKey+"|"+theJWT)
+	}
+	require.NoError(t, ks.Merge(strings.Join(pack, "\n")))
+	require.Equal(t, 3, ks.size())
+	for pubKey, theJWT := range jwts {
+		loaded, err := ks.LoadAcc(pubKey)
+		require.NoError(t, err)
+		require.Equal(t, theJWT, loaded)
+	}
+	for range jwts {
+		require.Contains(t, jwts, next())
+	}
+	// merging again changes nothing
+	require.NoError(t, ks.Merge(strings.Join(pack, "\n")))
+	require.Empty(t, changed)
+
+	packed, err := ks.Pack(-1)
+	require.NoError(t, err)
+	require.ElementsMatch(t, pack, strings.Split(packed, "\n"))
+	packed, err = ks.Pack(2)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(packed, "\n"), 2)
+
+	var deleted string
+	for pubKey := range jwts {
+		deleted = pubKey
+		break
+	}
+	require.NoError(t, ks.DeleteAcc(deleted))
+	require.Equal(t, errAccountNotFound, ks.DeleteAcc(deleted))
+	require.Equal(t, 2, ks.size())
+	// a purged account can be merged again
+	require.NoError(t, ks.Merge(deleted+"|"+jwts[deleted]))
+	require.Equal(t, deleted, next())
+
+	// another server sharing the bucket
+	other, err := newKVStore(config)
+	require.NoError(t, err)
+	defer other.Close()
+	pubKey, theJWT := newAccountJWT(t, operatorKey)
+	require.NoError(t, other.SaveAcc(pubKey, theJWT))
+	require.Equal(t, pubKey, next())
+	loaded, err := ks.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, theJWT, loaded)
+
+	state := ks.watchState()
+	require.True(t, state.Up)
+	require.False(t, state.LastEvent.IsZero())
+
+	ns.Shutdown()
+	require.Eventually(t, func() bool { return !ks.watchState().Up }, 5*time.Second, 10*time.Millisecond)
+	require.Error(t, ks.check(context.Background()))
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+const (
+	lintWarn   = "warn"
+	lintReject = "reject"
+)
+
+type lintRule struct {
+	conf.LintRule
+	path  []string
+	re    *regexp.Regexp
+	limit float64
+}
+
+// lintHit describes a rule that matched a JWT
+type lintHit struct {
+	Rule     string
+	Severity string
+	Message  string
+	Field    string
+	Redacted string // the message without the value, for sensitive fields
+}
+
+// linter evaluates the configured lint rules against account claims
+type linter struct {
+	rules []lintRule
+}
+
+// newLinter validates and compiles the rules, returns nil if there are no rules
+func newLinter(rules []conf.LintRule) (*linter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	l := &linter{}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if r.Field == "" {
+			return nil, fmt.Errorf("lint rule %q requires a field", r.Name)
+		}
+		switch r.Severity {
+		case "":
+			r.Severity = lintReject
+		case lintWarn, lintReject:
+		default:
+			return nil, fmt.Errorf("lint rule %q has unknown severity %q, use warn or reject", r.Name, r.Severity)
+		}
+		rule := lintRule{LintRule: r, path: strings.Split(r.Field, ".")}
+		switch r.Op {
+		case "match", "not_match":
+			re, err := regexp.Compile(r.Value)
+			if err != nil {
+				return nil, fmt.Errorf("lint rule %q has a bad expression: %v", r.Name, err)
+			}
+			rule.re = re
+		case "max", "min":
+			limit, err := strconv.ParseFloat(r.Value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("lint rule %q requires a numeric value: %v", r.Name, err)
+			}
+			rule.limit = limit
+		case "deny":
+		default:
+			return nil, fmt.Errorf("lint rule %q has unknown op %q, use match, not_match, deny, max or min", r.Name, r.Op)
+		}
+		l.rules = append(l.rules, rule)
+	}
+	return l, nil
+}
+
+// check returns the rules hit by the claims, a nil linter never reports hits
+func (l *linter) check(claim *jwt.AccountClaims) ([]lintHit, error) {
+	if l == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var hits []lintHit
+	for _, r := range l.rules {
+		for _, v := range lintValues(doc, r.path) {
+			if r.violatedBy(v) {
+				hits = append(hits, lintHit{Rule: r.Name, Severity: r.Severity, Message: r.message(v),
+					Field: r.Field, Redacted: r.message(redacted)})
+				break
+			}
+		}
+	}
+	return hits, nil
+}
+
+func (r *lintRule) violatedBy(v interface{}) bool {
+	switch r.Op {
+	case "match":
+		return !r.re.MatchString(fmt.Sprint(v))
+	case "not_match":
+		return r.re.MatchString(fmt.Sprint(v))
+	case "deny":
+		return fmt.Sprint(v) == r.Value
+	case "max", "min":
+		n, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		if r.Op == "max" {
+			return n > r.limit
+		}
+		return n < r.limit
+	}
+	return false
+}
+
+func (r *lintRule) message(v interface{}) string {
+	if r.Message != "" {
+		return fmt.Sprintf("%s: %s", r.Name, r.Message)
+	}
+	switch r.Op {
+	case "match":
+		return fmt.Sprintf("%s: %s %q must match %q", r.Name, r.Field, fmt.Sprint(v), r.Value)
+	case "not_match":
+		return fmt.Sprintf("%s: %s %q must not match %q", r.Name, r.Field, fmt.Sprint(v), r.Value)
+	case "deny":
+		return fmt.Sprintf("%s: %s must not be %q", r.Name, r.Field, r.Value)
+	case "max":
+		return fmt.Sprintf("%s: %s %v exceeds %s", r.Name, r.Field, v, r.Value)
+	default:
+		return fmt.Sprintf("%s: %s %v is below %s", r.Name, r.Field, v, r.Value)
+	}
+}
+
+// lintValues collects the values at path, arrays along the way are flattened
+func lintValues(v interface{}, path []string) []interface{} {
+	if arr, ok := v.([]interface{}); ok {
+		var values []interface{}
+		for _, e := range arr {
+			values = append(values, lintValues(e, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		if v == nil {
+			return nil
+		}
+		return []interface{}{v}
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	child, ok := m[path[0]]
+	if !ok {
+		return nil
+	}
+	return lintValues(child, path[1:])
+}
+
+// lintAccount logs and counts lint hits, returns the messages for rules that reject the JWT
+func (h *JwtHandler) lintAccount(claim *jwt.AccountClaims) ([]string, error) {
+	hits, err := h.linter.check(claim)
+	if err != nil {
+		return nil, err
+	}
+	var rejections []string
+	for _, hit := range hits {
+		h.metrics.inc("lint_rule_hits_total", "rule", hit.Rule, "severity", hit.Severity)
+		if hit.Severity == lintWarn {
+			msg := hit.Message
+			if h.privacy.sensitive(hit.Field) {
+				msg = hit.Redacted
+			}
+			h.logger.Warnf("%s - lint warning - %s", ShortKey(claim.Subject), msg)
+		} else {
+			rejections = append(rejections, hit.Message)
+		}
+	}
+	return rejections, nil
+}
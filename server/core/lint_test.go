@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBadLintRules(t *testing.T) {
+	_, err := newLinter([]conf.LintRule{{Name: "a", Op: "deny", Value: ">"}})
+	require.Error(t, err)
+	_, err = newLinter([]conf.LintRule{{Name: "a", Field: "name", Op: "match", Value: "("}})
+	require.Error(t, err)
+	_, err = newLinter([]conf.LintRule{{Name: "a", Field: "name", Op: "max", Value: "abc"}})
+	require.Error(t, err)
+	_, err = newLinter([]conf.LintRule{{Name: "a", Field: "name", Op: "equal", Value: "abc"}})
+	require.Error(t, err)
+	_, err = newLinter([]conf.LintRule{{Name: "a", Field: "name", Op: "deny", Value: "abc", Severity: "fatal"}})
+	require.Error(t, err)
+
+	l, err := newLinter(nil)
+	require.NoError(t, err)
+	require.Nil(t, l)
+	hits, err := l.check(jwt.NewAccountClaims("A"))
+	require.NoError(t, err)
+	require.Empty(t, hits)
+}
+
+func TestLintRules(t *testing.T) {
+	l, err := newLinter([]conf.LintRule{
+		{Name: "no-gt", Field: "nats.exports.subject", Op: "deny", Value: ">"},
+		{Name: "name", Field: "name", Op: "match", Value: "^[a-z0-9-]+$", Severity: lintWarn},
+		{Name: "js-mem", Field: "nats.limits.mem_storage", Op: "max", Value: "1073741824"},
+	})
+	require.NoError(t, err)
+
+	_, pub, _ := CreateAccountKey(t)
+	claim := jwt.NewAccountClaims(pub)
+	claim.Name = "team-a"
+	claim.Exports.Add(&jwt.Export{Subject: "foo.>", Type: jwt.Stream})
+	hits, err := l.check(claim)
+	require.NoError(t, err)
+	require.Empty(t, hits)
+
+	claim.Name = "Team A"
+	claim.Exports.Add(&jwt.Export{Subject: ">", Type: jwt.Service})
+	claim.Limits.MemoryStorage = 2 * 1024 * 1024 * 1024
+	hits, err = l.check(claim)
+	require.NoError(t, err)
+	require.Len(t, hits, 3)
+	require.Equal(t, "no-gt", hits[0].Rule)
+	require.Equal(t, lintReject, hits[0].Severity)
+	require.Equal(t, "name", hits[1].Rule)
+	require.Equal(t, lintWarn, hits[1].Severity)
+	require.Equal(t, "js-mem", hits[2].Rule)
+}
+
+func TestLintOnPost(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Lint = []conf.LintRule{
+		{Name: "no-gt", Field: "nats.exports.subject", Op: "deny", Value: ">", Message: "exports must not use >"},
+		{Name: "name", Field: "name", Op: "match", Value: "^[a-z0-9-]+$", Severity: lintWarn},
+	}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.Name = "Not Linted"
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	account.Exports.Add(&jwt.Export{Subject: ">", Type: jwt.Stream})
+	acctJWT, err = account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "exports must not use >")
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/metrics"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	metrics := string(body)
+	require.True(t, strings.Contains(metrics, `nats_account_server_lint_rule_hits_total{rule="name",severity="warn"} 2`))
+	require.True(t, strings.Contains(metrics, `nats_account_server_lint_rule_hits_total{rule="no-gt",severity="reject"} 1`))
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdFirstFD is the first file descriptor systemd passes to an activated service
+const systemdFirstFD = 3
+
+// listenUnix listens on a unix socket, a socket file left by a previous run is removed first. The
+// mode is octal, like 0660, and is applied once the socket exists.
+func listenUnix(path string, mode string) (net.Listener, error) {
+	var perm uint64
+	if mode != "" {
+		var err error
+		if perm, err = strconv.ParseUint(mode, 8, 32); err != nil || perm > 0777 {
+			return nil, fmt.Errorf("bad http socket_mode %q, use an octal mode like 0660", mode)
+		}
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listen, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+			listen.Close()
+			return nil, err
+		}
+	}
+	return listen, nil
+}
+
+// systemdListener returns the socket passed by systemd socket activation, the unit has to pass exactly
+// one. The variables systemd sets are unset, so processes started by the server don't pick them up.
+func systemdListener() (net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no socket was passed by systemd, LISTEN_PID is not set for this process")
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds != 1 {
+		return nil, fmt.Errorf("systemd has to pass exactly one socket, LISTEN_FDS is %q", os.Getenv("LISTEN_FDS"))
+	}
+	f := os.NewFile(uintptr(systemdFirstFD), "systemd socket")
+	defer f.Close()
+	listen, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("the socket passed by systemd can't be used, %v", err)
+	}
+	return listen, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/signer"
+	"github.com/nats-io/nkeys"
+)
+
+// localSigner signs account JWTs with an operator signing key held by the server, or by a key
+// management service it has access to, for deployments without a signing service
+type localSigner struct {
+	kp     nkeys.KeyPair
+	pubKey string
+}
+
+// newLocalSigner returns nil if no signing key is configured, posts have to be authorized to use one
+func newLocalSigner(config *conf.AccountServerConfig) (*localSigner, error) {
+	if config.SigningKey == "" {
+		return nil, nil
+	}
+	if config.SignRequestSubject != "" {
+		return nil, errors.New("signingkey and signrequestsubject can't both be set")
+	}
+	// the server signs self-signed JWTs of new accounts as well, so anyone who can post could mint accounts
+	if !config.HTTP.Auth.Enabled() {
+		return nil, errors.New("signingkey requires http auth, set tokens, signed or client_certs")
+	}
+	s, err := signer.Open(config.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	return &localSigner{kp: signer.KeyPair(s), pubKey: s.PublicKey()}, nil
+}
+
+// sign is the accountSignup of the local signer, the claims were validated by the caller, only the
+// issuer and signature change
+func (s *localSigner) sign(pubKey string, theJWT []byte) ([]byte, string, error) {
+	claim, err := jwt.DecodeAccountClaims(string(theJWT))
+	if err != nil {
+		return nil, "", err
+	}
+	if claim.Subject != pubKey {
+		return nil, "", fmt.Errorf("account %s doesn't match the JWT", ShortKey(pubKey))
+	}
+	// a key management service that can't be reached is treated like an unavailable signing service
+	signed, err := claim.Encode(s.kp)
+	if err != nil {
+		return nil, "Signing key unavailable, try again later.", fmt.Errorf("%w: %v", errSignUnavailable, err)
+	}
+	return []byte(signed), "", nil
+}
+
+// deleteProof signs the proof the nats-server full resolvers require to drop an account the server
+// deletes itself, the signing key is its issuer and subject
+func (s *localSigner) deleteProof(pubKey string) ([]byte, error) {
+	claim := jwt.NewGenericClaims(s.pubKey)
+	claim.Data["accounts"] = []string{pubKey}
+	proof, err := claim.Encode(s.kp)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(proof), nil
+}
+
+// checkLocalSigner makes sure the operators trust the signing key, otherwise every JWT it signs would
+// be rejected by the nats-servers
+func (h *JwtHandler) checkLocalSigner(s *localSigner) error {
+	if s == nil {
+		return nil
+	}
+	if _, ok := h.trustedKeys[s.pubKey]; !ok {
+		return fmt.Errorf("signing key %s is not a key of the operator", ShortKey(s.pubKey))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSeed(t *testing.T, kp nkeys.KeyPair, mode os.FileMode) string {
+	seed, err := kp.Seed()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "signing.nk")
+	require.NoError(t, os.WriteFile(path, seed, mode))
+	require.NoError(t, os.Chmod(path, mode))
+	return path
+}
+
+func TestLocalSigner(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	config := testEnv.Server.config
+
+	restart := func(signingKey string) error {
+		testEnv.Server.Stop()
+		config.SigningKey = signingKey
+		return testEnv.Server.Start()
+	}
+
+	// the key has to be an operator key the operator trusts
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	require.Error(t, restart(writeSeed(t, accountKey, 0600)))
+	otherOperator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	require.Error(t, restart(writeSeed(t, otherOperator, 0600)))
+	if runtime.GOOS != "windows" {
+		require.Error(t, restart(writeSeed(t, testEnv.OperatorKey, 0644)), "readable by others")
+	}
+	config.SignRequestSubject = "sign"
+	require.Error(t, restart(writeSeed(t, testEnv.OperatorKey, 0600)))
+	config.SignRequestSubject = ""
+	require.Error(t, restart(writeSeed(t, testEnv.OperatorKey, 0600)), "posts are not authorized")
+	config.HTTP.Auth.Tokens = []string{"writer"}
+
+	require.NoError(t, restart(writeSeed(t, testEnv.OperatorKey, 0600)))
+	pubKey, _, selfSigned := selfSignedAcctJWT(t)
+	require.Equal(t, http.StatusUnauthorized, postJWT(t, testEnv, pubKey, selfSigned))
+	status, body := adminRequest(t, testEnv, http.MethodPost, "/jwt/v1/accounts/"+pubKey, "writer", string(selfSigned))
+	require.Equal(t, http.StatusOK, status, body)
+
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	claim, err := jwt.DecodeAccountClaims(stored)
+	require.NoError(t, err)
+	require.Equal(t, testEnv.OperatorPubKey, claim.Issuer)
+	require.Equal(t, pubKey, claim.Subject)
+	require.Equal(t, jwt.TagList{"tag"}, claim.Tags)
+
+	// accounts the server deletes itself get a proof the resolvers accept
+	proof, err := testEnv.Server.jwt.deleteProof(pubKey)
+	require.NoError(t, err)
+	status, _ = testEnv.Server.jwt.checkDeleteProof(pubKey, proof)
+	require.Zero(t, status)
+}
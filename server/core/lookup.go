@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sources an account JWT can be looked up from
+const (
+	lookupStore   = "store"
+	lookupNATS    = "nats"
+	lookupPrimary = "primary"
+	lookupNone    = "none"
+	lookupConfig  = "config" // the system account from the configuration, only used by the handler
+	lookupCache   = "cache"  // the in-memory cache of a pass-through store, or the store in cache mode
+)
+
+// accountSourceHeader tells clients which source satisfied an account lookup
+const accountSourceHeader = "Account-Server-Source"
+
+var defaultLookupChain = []string{lookupStore, lookupNATS}
+
+// accountSource is implemented by stores that can report where a JWT was found
+type accountSource interface {
+	lookupAcc(publicKey string) (theJWT string, source string, err error)
+}
+
+// lookupChain validates the configured lookup order, none ends the chain
+func lookupChain(sources []string, primary string) ([]string, error) {
+	if len(sources) == 0 {
+		return defaultLookupChain, nil
+	}
+	var chain []string
+	for _, s := range sources {
+		s = strings.ToLower(s)
+		if s == "primary-http" {
+			s = lookupPrimary
+		}
+		switch s {
+		case lookupNone:
+			return chain, nil
+		case lookupPrimary:
+			if primary == "" {
+				return nil, fmt.Errorf("lookup source %q requires a primary", s)
+			}
+		case lookupStore, lookupNATS:
+		default:
+			return nil, fmt.Errorf("unknown lookup source %q, use store, nats, primary-http or none", s)
+		}
+		chain = append(chain, s)
+	}
+	return chain, nil
+}
+
+// lookupAcc tries each source in the configured chain until one has the account
+func (server *AccountServer) lookupAcc(publicKey string) (string, string, error) {
+	err := fmt.Errorf("no lookup source configured")
+	if server.readThrough != nil {
+		return server.cachedLookup(publicKey)
+	}
+	for _, source := range server.lookup {
+		var theJWT string
+		theJWT, err = server.lookupFrom(source, publicKey)
+		if err == nil && theJWT != "" {
+			server.logger.Tracef("lookup of %s - satisfied by %s", ShortKey(publicKey), source)
+			return theJWT, source, nil
+		}
+		server.logger.Tracef("lookup of %s - not found in %s", ShortKey(publicKey), source)
+	}
+	if err == nil {
+		err = fmt.Errorf("account not found")
+	}
+	return "", "", err
+}
+
+// lookupFrom asks a single source of the chain for the account
+func (server *AccountServer) lookupFrom(source string, publicKey string) (string, error) {
+	switch source {
+	case lookupStore:
+		return server.JWTStore.LoadAcc(publicKey)
+	case lookupNATS:
+		return server.natsLookup(publicKey)
+	case lookupPrimary:
+		return server.primaryLookup(publicKey)
+	}
+	return "", fmt.Errorf("unknown lookup source %q", source)
+}
+
+func (server *AccountServer) natsLookup(publicKey string) (string, error) {
+	nc := server.getNatsConnection()
+	if nc == nil {
+		return "", fmt.Errorf("not connected to NATS")
+	}
+	msg, err := nc.Request(fmt.Sprintf(server.subjects.accountLookup, publicKey), nil,
+		time.Duration(server.config.SignRequestTimeout)*time.Millisecond)
+	if err != nil {
+		return "", err
+	}
+	return string(msg.Data), nil
+}
+
+// primaryLookup asks each primary in turn, returning the first JWT found
+func (server *AccountServer) primaryLookup(publicKey string) (string, error) {
+	err := fmt.Errorf("no primary configured")
+	for _, c := range server.primaryCandidates(context.Background(), "/jwt/v1/accounts/"+publicKey) {
+		var theJWT string
+		if theJWT, err = primaryGet(c.client, c.url); err == nil {
+			return theJWT, nil
+		}
+	}
+	return "", err
+}
+
+func primaryGet(client *http.Client, url string) (string, error) {
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("primary returned status %q", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupChainConfig(t *testing.T) {
+	chain, err := lookupChain(nil, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{lookupStore, lookupNATS}, chain)
+
+	chain, err = lookupChain([]string{"Store", "primary-http", "none", "nats"}, "http://localhost:9090")
+	require.NoError(t, err)
+	require.Equal(t, []string{lookupStore, lookupPrimary}, chain)
+
+	_, err = lookupChain([]string{"store", "primary"}, "")
+	require.Error(t, err)
+
+	_, err = lookupChain([]string{"disk"}, "")
+	require.Error(t, err)
+}
+
+func TestLookupFromPrimary(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 1)
+
+	get := func(server *AccountServer, pubKey string) (int, string, string) {
+		resp, err := testEnv.HTTP.Get(fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", server.protocol, server.hostPort, pubKey))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get(accountSourceHeader), string(body)
+	}
+
+	for pubKey, theJWT := range pubKeys {
+		status, source, body := get(testEnv.Server, pubKey)
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, lookupStore, source)
+		require.Equal(t, theJWT, body)
+	}
+
+	dir, err := os.MkdirTemp("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := testEnv.CreateReplicaConfig(dir)
+	config.MaxReplicationPack = 0 // don't sync, so the replica has to look accounts up
+	config.Lookup = []string{"store", "primary-http"}
+	replica := NewAccountServer()
+	require.NoError(t, replica.InitializeFromConfig(config))
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	for pubKey, theJWT := range pubKeys {
+		status, source, body := get(replica, pubKey)
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, lookupPrimary, source)
+		require.Equal(t, theJWT, body)
+	}
+
+	status, _, _ := get(replica, testEnv.OperatorPubKey)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// the primary serves the system account from its configuration
+	status, source, _ := get(testEnv.Server, testEnv.SystemAccountPubKey)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, lookupConfig, source)
+	status, source, _ = get(replica, testEnv.SystemAccountPubKey)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, lookupPrimary, source)
+}
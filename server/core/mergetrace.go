@@ -0,0 +1,215 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// merge decisions, mirroring the checks done by the directory store when merging
+const (
+	mergeAccepted        = "accepted"
+	mergeUnchanged       = "unchanged"
+	mergeSkippedOlder    = "skipped-older"
+	mergeRejectedInvalid = "rejected-invalid"
+)
+
+// mergeDecision records what happened to one account in a pack
+type mergeDecision struct {
+	Account  string `json:"account"`
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// mergeCycle holds the decisions of one sync with a primary or peer
+type mergeCycle struct {
+	Source    string          `json:"source"`
+	Started   time.Time       `json:"started"`
+	Finished  time.Time       `json:"finished"`
+	Counts    map[string]int  `json:"counts"`
+	Decisions []mergeDecision `json:"decisions"`
+}
+
+// mergeTracer keeps the decisions for the current and last completed sync cycle
+type mergeTracer struct {
+	sync.Mutex
+	current *mergeCycle
+	last    *mergeCycle
+}
+
+func (t *mergeTracer) record(source string, d mergeDecision) {
+	t.Lock()
+	defer t.Unlock()
+	if t.current == nil {
+		t.current = &mergeCycle{Source: source, Started: time.Now().UTC(), Counts: map[string]int{}}
+	}
+	t.current.Counts[d.Decision]++
+	t.current.Decisions = append(t.current.Decisions, d)
+}
+
+// end completes the current cycle, if any decisions were recorded
+func (t *mergeTracer) end() *mergeCycle {
+	t.Lock()
+	defer t.Unlock()
+	if t.current == nil {
+		return nil
+	}
+	t.current.Finished = time.Now().UTC()
+	t.last, t.current = t.current, nil
+	return t.last
+}
+
+func (t *mergeTracer) lastCycle() *mergeCycle {
+	t.Lock()
+	defer t.Unlock()
+	return t.last
+}
+
+// mergePack merges the pack into the store. Every line is checked first, so an invalid line
+// leaves the store untouched. Each account is then merged on its own while holding its write
+// lock, the store only keeps JWTs newer than its own, so a post that lands during a merge is
+// never rolled back. With merge tracing enabled every line is classified and logged before it
+// is handed to the store. Merging stops between lines once ctx is canceled.
+func (server *AccountServer) mergePack(ctx context.Context, source string, packer store.PackableJWTStore, pack string) error {
+	lines := []string{}
+	for _, line := range strings.Split(pack, "\n") {
+		if line == "" {
+			continue
+		}
+		if d := checkMergeLine(line); d.Decision == mergeRejectedInvalid {
+			server.traceMerge(source, d)
+			return fmt.Errorf("merge of %s rejected: %s", ShortKey(d.Account), d.Reason)
+		}
+		lines = append(lines, line)
+	}
+	for _, line := range lines {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := server.mergeLine(source, packer, line); err != nil {
+			return err
+		}
+	}
+	server.jwt.jtis.addPack(pack)
+	server.jwt.tags.addPack(pack)
+	return nil
+}
+
+// mergeLine merges one checked line while holding the write lock of its account
+func (server *AccountServer) mergeLine(source string, packer store.PackableJWTStore, line string) error {
+	pubKey := strings.SplitN(line, "|", 2)[0]
+	unlock := server.jwt.writeLocks.lock(pubKey)
+	defer unlock()
+	if server.merges != nil {
+		d := server.classifyMerge(line)
+		server.traceMerge(source, d)
+		if d.Decision != mergeAccepted {
+			return nil
+		}
+	}
+	return packer.Merge(line)
+}
+
+// traceMerge logs and records a decision, if merge tracing is enabled
+func (server *AccountServer) traceMerge(source string, d mergeDecision) {
+	if server.merges == nil {
+		return
+	}
+	server.logger.Debugf("merge from %s - %s - %s %s", source, ShortKey(d.Account), d.Decision, d.Reason)
+	server.merges.record(source, d)
+}
+
+// endMergeCycle closes the current sync cycle and logs its counts
+func (server *AccountServer) endMergeCycle() {
+	if server.merges == nil {
+		return
+	}
+	if c := server.merges.end(); c != nil {
+		server.logger.Debugf("merge from %s finished - %d accepted, %d unchanged, %d skipped-older, %d rejected-invalid",
+			c.Source, c.Counts[mergeAccepted], c.Counts[mergeUnchanged], c.Counts[mergeSkippedOlder], c.Counts[mergeRejectedInvalid])
+	}
+}
+
+// checkMergeLine rejects a line that isn't a valid account JWT filed under its own key, the
+// decision of a valid line is left empty
+func checkMergeLine(line string) mergeDecision {
+	split := strings.Split(line, "|")
+	if len(split) != 2 {
+		return mergeDecision{Decision: mergeRejectedInvalid, Reason: "line doesn't contain 2 entries"}
+	}
+	d := mergeDecision{Account: split[0]}
+	if !nkeys.IsValidPublicAccountKey(d.Account) {
+		d.Decision, d.Reason = mergeRejectedInvalid, "not a valid public account key"
+	} else if newJWT, err := jwt.DecodeGeneric(split[1]); err != nil {
+		d.Decision, d.Reason = mergeRejectedInvalid, err.Error()
+	} else if newJWT.Subject != d.Account {
+		d.Decision, d.Reason = mergeRejectedInvalid, "jwt subject doesn't match the public key"
+	}
+	return d
+}
+
+// classifyMerge compares a checked line with the stored JWT, the caller holds the write lock of the account
+func (server *AccountServer) classifyMerge(line string) mergeDecision {
+	split := strings.Split(line, "|")
+	d := mergeDecision{Account: split[0]}
+	newJWT, err := jwt.DecodeGeneric(split[1])
+	if err != nil {
+		d.Decision, d.Reason = mergeRejectedInvalid, err.Error()
+		return d
+	}
+	existing, err := server.JWTStore.LoadAcc(d.Account)
+	if err != nil || existing == "" {
+		d.Decision, d.Reason = mergeAccepted, "new account"
+		return d
+	}
+	existingJWT, err := jwt.DecodeGeneric(existing)
+	switch {
+	case err != nil:
+		d.Decision, d.Reason = mergeAccepted, "replaces undecodable JWT"
+	case existingJWT.ID == newJWT.ID:
+		d.Decision = mergeUnchanged
+	case existingJWT.IssuedAt > newJWT.IssuedAt:
+		d.Decision = mergeSkippedOlder
+		d.Reason = fmt.Sprintf("issued at %d, have %d", newJWT.IssuedAt, existingJWT.IssuedAt)
+	default:
+		d.Decision = mergeAccepted
+	}
+	return d
+}
+
+// getLastMerge handles GET /admin/v1/merges/last
+func (server *AccountServer) getLastMerge(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if server.merges == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "merge tracing is not enabled", "", nil, w)
+		return
+	}
+	c := server.merges.lastCycle()
+	if c == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no merge has completed", "", nil, w)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, c)
+}
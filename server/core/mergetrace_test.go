@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeTrace(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.TraceMerges = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, _ := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/merges/last", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	encode := func(pubKey string) string {
+		token, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		return token
+	}
+	newKey := func() string {
+		kp, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := kp.PublicKey()
+		require.NoError(t, err)
+		return pubKey
+	}
+
+	fresh, same, older := newKey(), newKey(), newKey()
+	sameJWT := encode(same)
+	olderJWT := encode(older)
+	time.Sleep(1100 * time.Millisecond) // issued at has a resolution of seconds
+	newerJWT := encode(older)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(same, sameJWT))
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(older, newerJWT))
+
+	packer := testEnv.Server.JWTStore.(store.PackableJWTStore)
+	pack := fmt.Sprintf("%s|%s\n%s|%s\n%s|%s\n", fresh, encode(fresh), same, sameJWT, older, olderJWT)
+	require.NoError(t, testEnv.Server.mergePack(context.Background(), "test", packer, pack))
+	require.Error(t, testEnv.Server.mergePack(context.Background(), "test", packer, "bad|line\n"))
+	testEnv.Server.endMergeCycle()
+
+	stored, err := testEnv.Server.JWTStore.LoadAcc(older)
+	require.NoError(t, err)
+	require.Equal(t, newerJWT, stored)
+	_, err = testEnv.Server.JWTStore.LoadAcc(fresh)
+	require.NoError(t, err)
+
+	status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/merges/last", testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	cycle := mergeCycle{}
+	require.NoError(t, json.Unmarshal([]byte(body), &cycle))
+	require.Equal(t, "test", cycle.Source)
+	require.Equal(t, map[string]int{
+		mergeAccepted:        1,
+		mergeUnchanged:       1,
+		mergeSkippedOlder:    1,
+		mergeRejectedInvalid: 1,
+	}, cycle.Counts)
+	require.Len(t, cycle.Decisions, 4)
+	require.Equal(t, fresh, cycle.Decisions[0].Account)
+	require.Equal(t, mergeSkippedOlder, cycle.Decisions[2].Decision)
+}
+
+func TestMergeStopsWhenCanceled(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	packer := testEnv.Server.JWTStore.(store.PackableJWTStore)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, testEnv.Server.mergePack(ctx, "test", packer, fmt.Sprintf("%s|%s\n", pubKey, acctJWT)))
+	theJWT, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+	require.Empty(t, theJWT)
+}
+
+func TestMergeChecksPackFirst(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKey, olderJWT := newAccountJWT(t, testEnv.OperatorKey)
+	time.Sleep(1100 * time.Millisecond) // issued at has a resolution of seconds
+	newerJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	added, addedJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(pubKey, newerJWT))
+
+	packer := testEnv.Server.JWTStore.(store.PackableJWTStore)
+	pack := fmt.Sprintf("%s|%s\nbad|line\n", added, addedJWT)
+	require.Error(t, testEnv.Server.mergePack(context.Background(), "test", packer, pack))
+	_, err = testEnv.Server.JWTStore.LoadAcc(added)
+	require.Error(t, err)
+
+	pack = fmt.Sprintf("%s|%s\n%s|%s\n", added, addedJWT, pubKey, olderJWT)
+	require.NoError(t, testEnv.Server.mergePack(context.Background(), "test", packer, pack))
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, newerJWT, stored)
+	packed, err := packer.Pack(-1)
+	require.NoError(t, err)
+	require.Contains(t, packed, added)
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const metricsPrefix = "nats_account_server_"
+
+// metrics is a minimal registry of counters and gauges, exposed in the prometheus text format.
+// All methods are safe to call on a nil registry.
+type metrics struct {
+	sync.Mutex
+	help     map[string]string
+	kinds    map[string]string
+	values   map[string]map[string]*metricValue // name -> rendered labels -> value
+	gaugeFns map[string]func() float64
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+}
+
+// metricSample is a single value of a metric, with its labels as name/value pairs and rendered
+type metricSample struct {
+	Name       string
+	Kind       string
+	Labels     string
+	LabelPairs []string
+	Value      float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		help:     map[string]string{},
+		kinds:    map[string]string{},
+		values:   map[string]map[string]*metricValue{},
+		gaugeFns: map[string]func() float64{},
+	}
+}
+
+// describe registers the type and help text of a metric
+func (m *metrics) describe(name string, kind string, help string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.kinds[name] = kind
+	m.help[name] = help
+}
+
+// gaugeFunc registers a gauge whose value is computed when collected
+func (m *metrics) gaugeFunc(name string, help string, fn func() float64) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.kinds[name] = "gauge"
+	m.help[name] = help
+	m.gaugeFns[name] = fn
+}
+
+// inc adds one to a counter, labels are passed as name/value pairs
+func (m *metrics) inc(name string, labels ...string) {
+	m.add(name, 1, labels...)
+}
+
+func (m *metrics) add(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.valueFor(name, "counter", labels).value += v
+}
+
+func (m *metrics) set(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.valueFor(name, "gauge", labels).value = v
+}
+
+// assumes the lock is held, kind is used for metrics that were not described
+func (m *metrics) valueFor(name string, kind string, labels []string) *metricValue {
+	vals, ok := m.values[name]
+	if !ok {
+		vals = map[string]*metricValue{}
+		m.values[name] = vals
+		if _, ok := m.kinds[name]; !ok {
+			m.kinds[name] = kind
+		}
+	}
+	rendered := renderLabels(labels)
+	val, ok := vals[rendered]
+	if !ok {
+		val = &metricValue{labels: append([]string(nil), labels...)}
+		vals[rendered] = val
+	}
+	return val
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// samples returns the current value of all metrics sorted by name
+func (m *metrics) samples() []metricSample {
+	if m == nil {
+		return nil
+	}
+	m.Lock()
+	fns := map[string]func() float64{}
+	for name, fn := range m.gaugeFns {
+		fns[name] = fn
+	}
+	var samples []metricSample
+	for name, vals := range m.values {
+		for labels, v := range vals {
+			samples = append(samples, metricSample{Name: name, Kind: m.kinds[name], Labels: labels, LabelPairs: v.labels, Value: v.value})
+		}
+	}
+	m.Unlock()
+	// gauge functions may call back into the server, so don't hold the lock
+	for name, fn := range fns {
+		samples = append(samples, metricSample{Name: name, Kind: "gauge", Value: fn()})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Name == samples[j].Name {
+			return samples[i].Labels < samples[j].Labels
+		}
+		return samples[i].Name < samples[j].Name
+	})
+	return samples
+}
+
+// write renders all metrics in the prometheus text format
+func (m *metrics) write(w io.Writer) {
+	m.writeWithPrefix(w, metricsPrefix)
+}
+
+// writeWithPrefix renders all metrics in the prometheus text format, with prefix in front of each name
+func (m *metrics) writeWithPrefix(w io.Writer, prefix string) {
+	last := ""
+	for _, s := range m.samples() {
+		if s.Name != last {
+			m.Lock()
+			help := m.help[s.Name]
+			m.Unlock()
+			if help != "" {
+				fmt.Fprintf(w, "# HELP %s%s %s\n", prefix, s.Name, help)
+			}
+			fmt.Fprintf(w, "# TYPE %s%s %s\n", prefix, s.Name, s.Kind)
+			last = s.Name
+		}
+		fmt.Fprintf(w, "%s%s%s %v\n", prefix, s.Name, s.Labels, s.Value)
+	}
+}
+
+// serveMetrics handles get requests for the metrics endpoint
+func (m *metrics) serveMetrics(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set(ContentType, "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	m.write(w)
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsText(t *testing.T) {
+	m := newMetrics()
+	m.describe("requests_total", "counter", "Number of requests")
+	m.inc("requests_total", "code", "200")
+	m.inc("requests_total", "code", "200")
+	m.inc("requests_total", "code", "404")
+	m.set("queue_depth", 3)
+	m.gaugeFunc("uptime_seconds", "Uptime", func() float64 { return 10 })
+
+	buf := bytes.NewBuffer(nil)
+	m.write(buf)
+	require.Equal(t, `# TYPE nats_account_server_queue_depth gauge
+nats_account_server_queue_depth 3
+# HELP nats_account_server_requests_total Number of requests
+# TYPE nats_account_server_requests_total counter
+nats_account_server_requests_total{code="200"} 2
+nats_account_server_requests_total{code="404"} 1
+# HELP nats_account_server_uptime_seconds Uptime
+# TYPE nats_account_server_uptime_seconds gauge
+nats_account_server_uptime_seconds 10
+`, buf.String())
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *metrics
+	m.inc("a")
+	m.set("b", 1)
+	m.describe("a", "counter", "")
+	m.gaugeFunc("c", "", func() float64 { return 0 })
+	require.Nil(t, m.samples())
+}
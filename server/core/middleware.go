@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Middleware wraps the HTTP handler of the server, it can look at or change requests before next sees
+// them and responses before the client does
+type Middleware func(next http.Handler) http.Handler
+
+// names of the built in middlewares
+const (
+	MiddlewareRequestID = "request_id"
+	MiddlewareAccessLog = "access_log"
+)
+
+// requestIDHeader carries the request ID, one sent by the client or a proxy is kept
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the request IDs taken from clients, longer ones are replaced
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+var (
+	middlewaresLock sync.Mutex
+	middlewares     = map[string]Middleware{}
+)
+
+// RegisterMiddleware makes a middleware selectable with http.middlewares in the configuration, registering
+// a name twice or one of the built in names is an error
+func RegisterMiddleware(name string, mw Middleware) error {
+	if name == "" || mw == nil {
+		return fmt.Errorf("middlewares require a name and a function")
+	}
+	if name == MiddlewareRequestID || name == MiddlewareAccessLog {
+		return fmt.Errorf("middleware %q is built in", name)
+	}
+	middlewaresLock.Lock()
+	defer middlewaresLock.Unlock()
+	if _, ok := middlewares[name]; ok {
+		return fmt.Errorf("middleware %q is already registered", name)
+	}
+	middlewares[name] = mw
+	return nil
+}
+
+// UseMiddleware adds middlewares around every route of the server, inside the configured ones and in the
+// order they were added. It has to be called before Start.
+func (server *AccountServer) UseMiddleware(mw ...Middleware) {
+	server.Lock()
+	defer server.Unlock()
+	server.middlewares = append(server.middlewares, mw...)
+}
+
+// RequestID returns the ID the request_id middleware gave the request, empty if it isn't used
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// middleware returns the built in or registered middleware with name
+func (server *AccountServer) middleware(name string) (Middleware, error) {
+	switch name {
+	case MiddlewareRequestID:
+		return requestID, nil
+	case MiddlewareAccessLog:
+		return server.accessLog, nil
+	}
+	middlewaresLock.Lock()
+	defer middlewaresLock.Unlock()
+	if mw, ok := middlewares[name]; ok {
+		return mw, nil
+	}
+	return nil, fmt.Errorf("unknown middleware %q", name)
+}
+
+// wrapMiddlewares wraps next with the configured middlewares and then those added with UseMiddleware
+func (server *AccountServer) wrapMiddlewares(next http.Handler) (http.Handler, error) {
+	chain := []Middleware{}
+	for _, name := range server.config.HTTP.Middlewares {
+		mw, err := server.middleware(name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, mw)
+	}
+	chain = append(chain, server.middlewares...)
+	for i := len(chain) - 1; i >= 0; i-- {
+		next = chain[i](next)
+	}
+	return next, nil
+}
+
+// requestID keeps the X-Request-ID of the request or creates one, and returns it with the response
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err == nil {
+				id = hex.EncodeToString(b)
+			}
+		}
+		r.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// accessLog logs every request with its status and how long it took
+func (server *AccountServer) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		line := fmt.Sprintf("%s %s %s %d %v", r.RemoteAddr, r.Method, r.URL.RequestURI(), sw.status, time.Since(start))
+		if id := RequestID(r); id != "" {
+			line += " " + id
+		}
+		server.logger.Noticef("%s", line)
+	})
+}
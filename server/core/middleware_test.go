@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddlewares(t *testing.T) {
+	require.Error(t, RegisterMiddleware(MiddlewareAccessLog, requestID))
+	require.NoError(t, RegisterMiddleware("test_header", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Test", "configured")
+			next.ServeHTTP(w, r)
+		})
+	}))
+	defer func() {
+		middlewaresLock.Lock()
+		defer middlewaresLock.Unlock()
+		delete(middlewares, "test_header")
+	}()
+	require.Error(t, RegisterMiddleware("test_header", requestID))
+
+	recorder := &recordingLogger{}
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = t.TempDir()
+	config.HTTP.Port = 0
+	config.HTTP.Middlewares = []string{MiddlewareRequestID, MiddlewareAccessLog, "test_header"}
+	config.Logging.Custom = recorder
+	server := NewAccountServer()
+	var seen []string
+	server.UseMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// added in code, inside the configured middlewares
+			seen = append(seen, RequestID(r)+" "+w.Header().Get("X-Test"))
+			if r.Header.Get("Authorization") != "Bearer embedder" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	require.NoError(t, server.InitializeFromConfig(config))
+	server.logger = server.ConfigureLogger()
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	get := func(id string, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/healthz", server.port), nil)
+		require.NoError(t, err)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("client-id", "embedder")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "client-id", resp.Header.Get(requestIDHeader))
+	require.Equal(t, "configured", resp.Header.Get("X-Test"))
+
+	resp = get("", "other")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	generated := resp.Header.Get(requestIDHeader)
+	require.Len(t, generated, 32)
+	require.Equal(t, []string{"client-id configured", generated + " configured"}, seen)
+
+	log := recorder.output()
+	require.Contains(t, log, "GET /healthz 200 ")
+	require.True(t, strings.Contains(log, "GET /healthz 401 ") && strings.Contains(log, generated), log)
+
+	// unknown names keep the server from starting
+	config.HTTP.Middlewares = []string{"missing"}
+	failed := NewAccountServer()
+	require.NoError(t, failed.InitializeFromConfig(config))
+	require.Error(t, failed.Start())
+	failed.Stop()
+}
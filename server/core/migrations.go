@@ -0,0 +1,272 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// maxMigrationJWTs limits the size of a migration manifest
+const maxMigrationJWTs = 10000
+
+// maxMigrationBodies is the size of a migration manifest in units of the body limit of a single post
+const maxMigrationBodies = 256
+
+// migrationManifest is the body of POST /jwt/v1/migrations, the JWTs are notified in this order
+type migrationManifest struct {
+	JWTs []string `json:"jwts"`
+}
+
+// migratedAccount is one account changed by a migration
+type migratedAccount struct {
+	Account  string `json:"account"`
+	JTI      string `json:"jti"`
+	Previous string `json:"previous,omitempty"` // jti of the replaced JWT, empty for a new account
+}
+
+type migrationResult struct {
+	DryRun   bool              `json:"dry_run"`
+	Applied  bool              `json:"applied"`
+	Accounts []migratedAccount `json:"accounts"`
+}
+
+// migrationEntry is a validated JWT of the manifest
+type migrationEntry struct {
+	claim    *jwt.AccountClaims
+	jwt      string
+	previous string // the stored JWT, empty if there is none
+}
+
+// checkMigrationJWT validates one JWT of a manifest the way a post does, except that it has to be
+// signed by the operator, returning why it is rejected. The entry is nil if the JWT can't be decoded.
+func (h *JwtHandler) checkMigrationJWT(w http.ResponseWriter, r *http.Request, theJWT string) (*migrationEntry, string) {
+	claim, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil || claim == nil || !nkeys.IsValidPublicAccountKey(claim.Subject) {
+		return nil, "bad account JWT"
+	}
+	e := &migrationEntry{claim: claim, jwt: theJWT}
+	if _, trusted := h.trustedKeys[claim.Issuer]; !trusted {
+		return e, "not signed by the operator or one of its signing keys"
+	}
+	if h.revoked.has(claim.Subject) {
+		return e, "account is revoked"
+	}
+	if h.authorizeWrite != nil {
+		if err := h.authorizeWrite(r, claim.Subject); err != nil {
+			return e, fmt.Sprintf("write not authorized, %v", err)
+		}
+	}
+	if violations := scopeViolations(claim); len(violations) > 0 {
+		return e, strings.Join(violations, ", ")
+	}
+	vr := &jwt.ValidationResults{}
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		var issues []string
+		for _, err := range vr.Errors() {
+			issues = append(issues, err.Error())
+		}
+		return e, strings.Join(issues, ", ")
+	}
+	rejections, err := h.lintAccount(claim)
+	if err != nil {
+		return e, fmt.Sprintf("error linting JWT, %v", err)
+	} else if len(rejections) > 0 && h.softLimits.warnOnly(softLint) {
+		for _, reason := range rejections {
+			h.flagViolation(w.Header(), softLint, claim.Subject, reason)
+		}
+	} else if len(rejections) > 0 {
+		return e, strings.Join(rejections, ", ")
+	}
+	if violations := h.policyViolations(claim); len(violations) > 0 && h.softLimits.warnOnly(softPolicy) {
+		for _, v := range violations {
+			h.flagViolation(w.Header(), softPolicy, claim.Subject, v)
+		}
+	} else if len(violations) > 0 {
+		return e, strings.Join(violations, ", ")
+	}
+	return e, ""
+}
+
+// checkMigrationStored checks a JWT of a manifest against the stored JWT of its account, returning why
+// it is rejected. The caller holds the write lock of the account until the JWT is stored.
+func (h *JwtHandler) checkMigrationStored(e *migrationEntry) string {
+	claim := e.claim
+	if err := h.checkAccountOperator(claim.Subject, claim.Issuer); err != nil {
+		return err.Error()
+	}
+	var existingTags jwt.TagList
+	if previous, err := h.jwtStore.LoadAcc(claim.Subject); err == nil && previous != "" {
+		e.previous = previous
+		if existing, err := jwt.DecodeAccountClaims(previous); err == nil {
+			if existing.IssuedAt > claim.IssuedAt {
+				return "older than the stored JWT"
+			}
+			existingTags = existing.Tags
+		}
+	}
+	// JWTs that need a second party are not migrated around the approval
+	if h.approvals.required(existingTags, claim) && !h.isOperator(claim.Issuer) {
+		return "requires approval, post it on its own"
+	}
+	return ""
+}
+
+// applyMigration stores every JWT, all or nothing. Transactional stores apply them at once, other
+// stores get one JWT at a time and the JWTs already saved are restored if one fails.
+func (h *JwtHandler) applyMigration(entries []*migrationEntry) error {
+	if tx, ok := h.jwtStore.(store.TransactionalJWTStore); ok {
+		jwts := make(map[string]string, len(entries))
+		for _, e := range entries {
+			jwts[e.claim.Subject] = e.jwt
+		}
+		return tx.ApplyAccs(jwts)
+	}
+	for i, e := range entries {
+		err := h.jwtStore.SaveAcc(e.claim.Subject, e.jwt)
+		if err == nil {
+			continue
+		}
+		deleter, canDelete := h.jwtStore.(store.DeletableJWTStore)
+		for _, done := range entries[:i] {
+			var rollbackErr error
+			if done.previous != "" {
+				rollbackErr = h.jwtStore.SaveAcc(done.claim.Subject, done.previous)
+			} else if canDelete {
+				rollbackErr = deleter.DeleteAcc(done.claim.Subject)
+			} else {
+				rollbackErr = fmt.Errorf("store does not support deletes")
+			}
+			if rollbackErr != nil {
+				h.logger.Errorf("%s - migration rollback failed - %v", ShortKey(done.claim.Subject), rollbackErr)
+			}
+		}
+		return fmt.Errorf("saving %s: %v", ShortKey(e.claim.Subject), err)
+	}
+	return nil
+}
+
+// ApplyMigration handles POST /jwt/v1/migrations?dry_run=true, which validates every JWT of the
+// manifest before storing any of them. With dry_run nothing is stored.
+func (h *JwtHandler) ApplyMigration(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	var manifest migrationManifest
+	defer r.Body.Close()
+	// a manifest holds many JWTs, each of them may take up the body limit of a single post
+	limit := h.bodyLimit() * maxMigrationBodies
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(&manifest); err != nil {
+		h.sendBodyError(w, err, "bad migration manifest", "")
+		return
+	}
+	if len(manifest.JWTs) == 0 || len(manifest.JWTs) > maxMigrationJWTs {
+		h.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("a migration holds between 1 and %d JWTs", maxMigrationJWTs), "", nil, w)
+		return
+	}
+	if !h.allowWrite(w, "") {
+		return
+	}
+
+	checked := make([]*migrationEntry, len(manifest.JWTs))
+	reasons := make([]string, len(manifest.JWTs))
+	seen := map[string]bool{}
+	subjects := []string{}
+	for i, theJWT := range manifest.JWTs {
+		checked[i], reasons[i] = h.checkMigrationJWT(w, r, theJWT)
+		if reasons[i] == "" && seen[checked[i].claim.Subject] {
+			reasons[i] = "account is in the manifest more than once"
+		} else if reasons[i] == "" {
+			seen[checked[i].claim.Subject] = true
+			subjects = append(subjects, checked[i].claim.Subject)
+		}
+	}
+	// the stored JWTs are checked and replaced while holding the write locks of the accounts
+	unlock := h.writeLocks.lockAll(subjects)
+	defer unlock()
+	entries := make([]*migrationEntry, 0, len(subjects))
+	var rejections []string
+	for i, e := range checked {
+		if reasons[i] == "" {
+			reasons[i] = h.checkMigrationStored(e)
+		}
+		if reasons[i] != "" {
+			account := fmt.Sprintf("#%d", i)
+			if e != nil {
+				account = e.claim.Subject
+			}
+			rejections = append(rejections, fmt.Sprintf("\t - %s: %s", account, reasons[i]))
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(rejections) > 0 {
+		lines := append([]string{"The server was unable to apply the migration. One or more JWTs were rejected."}, rejections...)
+		h.logger.Errorf("migration of %d accounts rejected", len(manifest.JWTs))
+		http.Error(w, strings.Join(lines, "\n"), http.StatusBadRequest)
+		return
+	}
+
+	result := migrationResult{DryRun: strings.ToLower(r.URL.Query().Get("dry_run")) == "true"}
+	for _, e := range entries {
+		m := migratedAccount{Account: e.claim.Subject, JTI: e.claim.ID}
+		if previous, err := jwt.DecodeAccountClaims(e.previous); err == nil {
+			m.Previous = previous.ID
+		}
+		result.Accounts = append(result.Accounts, m)
+	}
+	if !result.DryRun {
+		if err := h.applyMigration(entries); err != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "error storing the migration, no JWT was changed", "", err, w)
+			return
+		}
+		result.Applied = true
+		h.logger.Noticef("migrated %d accounts", len(entries))
+		// every account is announced and indexed even if a notification fails, the first failure is reported
+		failed := ""
+		var notifyErr error
+		for _, e := range entries {
+			h.jtis.add(e.jwt)
+			h.tags.add(e.jwt)
+			h.mirror.offer(e.claim.Subject, []byte(e.jwt))
+			if h.sendAccountNotification != nil {
+				if err := h.sendAccountNotification(e.claim.Subject, []byte(e.jwt)); err != nil && !notificationPending(err) && notifyErr == nil {
+					failed, notifyErr = e.claim.Subject, err
+				}
+			}
+			h.refreshSystemAccount(e.claim.Subject, e.jwt)
+			h.accountSaved(e.claim.Subject, e.jwt)
+		}
+		if notifyErr != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "migration stored, error sending notification of change", failed, notifyErr, w)
+			return
+		}
+	}
+	data, err := unescapedIndentedMarshal(result, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", "", err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
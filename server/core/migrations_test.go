@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func postMigration(t *testing.T, testEnv *TestSetup, query string, jwts ...string) (int, string) {
+	data, err := json.Marshal(migrationManifest{JWTs: jwts})
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/migrations"+query), ApplicationJSON, strings.NewReader(string(data)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestMigration(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	existing, existingJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, existing, []byte(existingJWT)))
+	// migrated JWTs have to be issued later than the stored ones
+	time.Sleep(1100 * time.Millisecond)
+	claim, err := jwt.DecodeAccountClaims(existingJWT)
+	require.NoError(t, err)
+	claim.Name = "resigned"
+	resigned, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	added, addedJWT := newAccountJWT(t, testEnv.OperatorKey)
+
+	// a self-signed JWT fails the whole migration
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	selfSigned, err := jwt.NewAccountClaims(pubKey).Encode(accountKey)
+	require.NoError(t, err)
+	status, body := postMigration(t, testEnv, "", resigned, selfSigned)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, pubKey+": not signed by the operator")
+	status, _ = postMigration(t, testEnv, "", resigned, resigned)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, body = postMigration(t, testEnv, "?dry_run=true", resigned, addedJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	var result migrationResult
+	require.NoError(t, json.Unmarshal([]byte(body), &result))
+	require.True(t, result.DryRun)
+	require.False(t, result.Applied)
+	require.Len(t, result.Accounts, 2)
+	require.Equal(t, claim.ID, result.Accounts[0].JTI)
+	require.NotEmpty(t, result.Accounts[0].Previous)
+	require.Empty(t, result.Accounts[1].Previous)
+	stored, err := testEnv.Server.JWTStore.LoadAcc(existing)
+	require.NoError(t, err)
+	require.Equal(t, existingJWT, stored)
+
+	notified := make(chan string, 2)
+	sub, err := testEnv.NC.Subscribe(strings.Replace(accountNotificationFormat, "%s", "*", -1), func(m *nats.Msg) {
+		notified <- string(m.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, testEnv.NC.Flush())
+
+	status, body = postMigration(t, testEnv, "", resigned, addedJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &result))
+	require.True(t, result.Applied)
+	for _, want := range []string{resigned, addedJWT} {
+		select {
+		case got := <-notified:
+			require.Equal(t, want, got)
+		case <-time.After(2 * time.Second):
+			t.Fatal("missing notification")
+		}
+	}
+	stored, err = testEnv.Server.JWTStore.LoadAcc(added)
+	require.NoError(t, err)
+	require.Equal(t, addedJWT, stored)
+
+	// the stored JWT is now newer
+	status, body = postMigration(t, testEnv, "", existingJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, "older than the stored JWT")
+}
+
+// failingStore is a memory store whose save fails once, after failAt saves succeeded
+type failingStore struct {
+	jwts   map[string]string
+	saves  int
+	failAt int
+}
+
+func (s *failingStore) LoadAcc(publicKey string) (string, error) {
+	if theJWT, ok := s.jwts[publicKey]; ok {
+		return theJWT, nil
+	}
+	return "", errors.New("not found")
+}
+
+func (s *failingStore) SaveAcc(publicKey string, theJWT string) error {
+	if s.saves == s.failAt {
+		s.failAt = -1
+		return errors.New("disk full")
+	}
+	s.saves++
+	s.jwts[publicKey] = theJWT
+	return nil
+}
+
+func (s *failingStore) DeleteAcc(publicKey string) error {
+	delete(s.jwts, publicKey)
+	return nil
+}
+
+func (s *failingStore) IsReadOnly() bool { return false }
+func (s *failingStore) Close()           {}
+
+func TestMigrationRollback(t *testing.T) {
+	s := &failingStore{jwts: map[string]string{"A": "old"}, failAt: 2}
+	h := &JwtHandler{jwtStore: s, logger: NewNilLogger()}
+	var entries []*migrationEntry
+	for _, k := range []string{"A", "B", "C"} {
+		e := &migrationEntry{claim: jwt.NewAccountClaims(k), jwt: fmt.Sprintf("new-%s", k), previous: s.jwts[k]}
+		entries = append(entries, e)
+	}
+	require.Error(t, h.applyMigration(entries))
+	require.Equal(t, map[string]string{"A": "old"}, s.jwts)
+}
+
+func TestMigrationNotifiesEveryAccount(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.JTIIndex = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	first, firstJWT := newAccountJWT(t, testEnv.OperatorKey)
+	second, secondJWT := newAccountJWT(t, testEnv.OperatorKey)
+	notified := []string{}
+	testEnv.Server.jwt.sendAccountNotification = func(pubKey string, theJWT []byte) error {
+		notified = append(notified, pubKey)
+		if pubKey == first {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	status, body := postMigration(t, testEnv, "", firstJWT, secondJWT)
+	require.Equal(t, http.StatusInternalServerError, status)
+	require.Contains(t, body, "error sending notification of change")
+	require.Equal(t, []string{first, second}, notified)
+	for _, theJWT := range []string{firstJWT, secondJWT} {
+		_, ok := testEnv.Server.jwt.jtis.account(jtiOf(theJWT))
+		require.True(t, ok)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+)
+
+const mirrorQueueSize = 1024
+
+type mirrorRequest struct {
+	pubKey string
+	theJWT []byte
+}
+
+// mirror forwards a sample of accepted account JWTs to another account server in the background
+type mirror struct {
+	url     string
+	percent int
+	client  *http.Client
+	queue   chan mirrorRequest
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	logger  natsserver.Logger
+	metrics *metrics
+}
+
+// newMirror returns nil if mirroring is not configured
+func newMirror(config conf.MirrorConfig, logger natsserver.Logger, m *metrics) (*mirror, error) {
+	if config.URL == "" {
+		return nil, nil
+	}
+	if config.Percent < 0 || config.Percent > 100 {
+		return nil, fmt.Errorf("mirror percent must be between 0 and 100")
+	}
+	m.describe("mirror_requests_total", "counter", "Number of account JWTs forwarded to the mirror, by result")
+	mr := &mirror{
+		url:     strings.TrimSuffix(config.URL, "/"),
+		percent: config.Percent,
+		client:  &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond},
+		queue:   make(chan mirrorRequest, mirrorQueueSize),
+		quit:    make(chan struct{}),
+		logger:  logger,
+		metrics: m,
+	}
+	mr.wg.Add(1)
+	go mr.run()
+	return mr, nil
+}
+
+// offer queues the JWT for mirroring if it is part of the sample, it never blocks
+func (mr *mirror) offer(pubKey string, theJWT []byte) {
+	if mr == nil || mr.percent == 0 || rand.Intn(100) >= mr.percent {
+		return
+	}
+	select {
+	case mr.queue <- mirrorRequest{pubKey: pubKey, theJWT: theJWT}:
+	default:
+		mr.metrics.inc("mirror_requests_total", "result", "dropped")
+	}
+}
+
+func (mr *mirror) run() {
+	defer mr.wg.Done()
+	for {
+		select {
+		case <-mr.quit:
+			return
+		case req := <-mr.queue:
+			mr.forward(req)
+		}
+	}
+}
+
+func (mr *mirror) forward(req mirrorRequest) {
+	url := fmt.Sprintf("%s/jwt/v1/accounts/%s", mr.url, req.pubKey)
+	resp, err := mr.client.Post(url, ApplicationJWT, bytes.NewReader(req.theJWT))
+	if err != nil {
+		mr.metrics.inc("mirror_requests_total", "result", "error")
+		mr.logger.Debugf("%s - mirror error - %v", ShortKey(req.pubKey), err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		mr.metrics.inc("mirror_requests_total", "result", "rejected")
+		mr.logger.Debugf("%s - mirror returned %s", ShortKey(req.pubKey), resp.Status)
+		return
+	}
+	mr.metrics.inc("mirror_requests_total", "result", "ok")
+}
+
+// stop ends mirroring, queued JWTs are dropped
+func (mr *mirror) stop() {
+	if mr == nil {
+		return
+	}
+	close(mr.quit)
+	mr.wg.Wait()
+}
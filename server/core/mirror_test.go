@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorPosts(t *testing.T) {
+	lock := sync.Mutex{}
+	mirrored := map[string]string{}
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := bytes.Buffer{}
+		buf.ReadFrom(r.Body)
+		lock.Lock()
+		mirrored[r.URL.Path] = buf.String()
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer staging.Close()
+
+	config := conf.DefaultServerConfig()
+	config.Mirror.URL = staging.URL
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 3)
+
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(mirrored) == len(pubKeys)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	for pubKey, theJWT := range pubKeys {
+		require.Equal(t, theJWT, mirrored["/jwt/v1/accounts/"+pubKey])
+	}
+
+	var buf bytes.Buffer
+	testEnv.Server.metrics.write(&buf)
+	require.Contains(t, buf.String(), `nats_account_server_mirror_requests_total{result="ok"} 3`)
+}
+
+func TestMirrorSample(t *testing.T) {
+	mr := &mirror{percent: 0, queue: make(chan mirrorRequest, 1)}
+	mr.offer("A", nil)
+	require.Len(t, mr.queue, 0)
+
+	mr.percent = 100
+	mr.offer("A", nil)
+	require.Len(t, mr.queue, 1)
+
+	// a full queue drops instead of blocking the post
+	mr.offer("B", nil)
+	require.Len(t, mr.queue, 1)
+
+	_, err := newMirror(conf.MirrorConfig{URL: "http://localhost", Percent: 101}, nil, nil)
+	require.Error(t, err)
+}
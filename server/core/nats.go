@@ -17,7 +17,6 @@
 package core
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,18 +27,37 @@ import (
 	"time"
 
 	"github.com/nats-io/jwt/v2" // only used to decode
+	"github.com/nats-io/nats-account-server/server/conf"
 	"github.com/nats-io/nats-account-server/server/store"
-	natsserver "github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 const (
 	accountPackRequest           = "$SYS.REQ.CLAIMS.PACK"
 	accountLookupRequest         = "$SYS.REQ.ACCOUNT.%s.CLAIMS.LOOKUP"
 	accountNotificationFormat    = "$SYS.ACCOUNT.%s.CLAIMS.UPDATE"
+	accountNativeUpdateFormat    = "$SYS.REQ.ACCOUNT.%s.CLAIMS.UPDATE"
+	accountDeleteFormat          = "$SYS.ACCOUNT.%s.CLAIMS.DELETE"
+	accountNativeDelete          = "$SYS.REQ.CLAIMS.DELETE"
+	accountClaimsUpdate          = "$SYS.REQ.CLAIMS.UPDATE"
 	activationNotificationFormat = "$SYS.ACCOUNT.%s.CLAIMS.ACTIVATE.%s"
+	activationTargetFormat       = "$SYS.ACCOUNT.%s.CLAIMS.ACTIVATE_TARGET.%s.%s" // issuer, target, hash
+	activationDeleteFormat       = "$SYS.ACCOUNT.%s.CLAIMS.DEACTIVATE.%s"         // issuer, hash
+	userNotificationFormat       = "$SYS.ACCOUNT.%s.USER.%s.UPDATE"               // account, user
+	heartbeatFormat              = "$SYS.ACCOUNT_SERVER.%s.HEARTBEAT"
 )
 
+// headers added to notifications so consumers can attribute them to an account server
+const (
+	serverNameHeader    = "Account-Server-Name"
+	serverIDHeader      = "Account-Server-ID"
+	serverClusterHeader = "Account-Server-Cluster"
+	targetAccountHeader = "Account-Server-Target"
+)
+
+const defaultServerName = "nats-account-server"
+
 func (server *AccountServer) natsError(nc *nats.Conn, sub *nats.Subscription, err error) {
 	server.logger.Warnf("nats error %s", err.Error())
 }
@@ -53,6 +71,10 @@ func (server *AccountServer) natsDisconnected(nc *nats.Conn) {
 
 func (server *AccountServer) natsReconnected(nc *nats.Conn) {
 	server.logger.Warnf("nats reconnected")
+	server.Lock()
+	q := server.notifyQueue
+	server.Unlock()
+	go server.replayNotifications(nc, q)
 }
 
 func (server *AccountServer) natsClosed(nc *nats.Conn) {
@@ -70,6 +92,48 @@ func (server *AccountServer) natsDiscoveredServers(nc *nats.Conn) {
 	server.logger.Debugf("known servers: %v\n", nc.Servers())
 }
 
+// natsAuthOptions returns the options authenticating the NATS connection, it fails if more than one way
+// is configured or the nkey seed can't be read
+func natsAuthOptions(config conf.NATSConfig) ([]nats.Option, error) {
+	var options []nats.Option
+	if config.UserCredentials != "" {
+		options = append(options, nats.UserCredentials(config.UserCredentials))
+	}
+	if config.Nkey != "" {
+		kp, err := nkeys.FromSeed([]byte(config.Nkey))
+		if err != nil {
+			return nil, fmt.Errorf("bad NATS nkey seed: %v", err)
+		}
+		pubKey, err := kp.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("bad NATS nkey seed: %v", err)
+		}
+		if !nkeys.IsValidPublicUserKey(pubKey) {
+			return nil, errors.New("the NATS nkey seed is not the seed of a user")
+		}
+		options = append(options, nats.Nkey(pubKey, kp.Sign))
+	}
+	if config.NkeySeedFile != "" {
+		option, err := nats.NkeyOptionFromSeed(config.NkeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the NATS nkey seed file: %v", err)
+		}
+		options = append(options, option)
+	}
+	if config.User != "" {
+		options = append(options, nats.UserInfo(config.User, config.Password))
+	} else if config.Password != "" {
+		return nil, errors.New("a NATS password requires a user")
+	}
+	if config.Token != "" {
+		options = append(options, nats.Token(config.Token))
+	}
+	if len(options) > 1 {
+		return nil, errors.New("configure only one of NATS user credentials, nkey, nkey seed file, user and token")
+	}
+	return options, nil
+}
+
 // assumes the lock is held by the caller
 func (server *AccountServer) connectToNATS() error {
 	if !server.running {
@@ -105,8 +169,10 @@ func (server *AccountServer) connectToNATS() error {
 		options = append(options, nats.ClientCert(config.TLS.Cert, config.TLS.Key))
 	}
 
-	if config.UserCredentials != "" {
-		options = append(options, nats.UserCredentials(config.UserCredentials))
+	options = append(options, server.natsAuth...)
+
+	if server.inProcess != nil {
+		options = append(options, nats.InProcessServer(server.inProcess))
 	}
 
 	nc, err := nats.Connect(strings.Join(config.Servers, ","),
@@ -117,84 +183,125 @@ func (server *AccountServer) connectToNATS() error {
 		reconnectWait := config.ReconnectWait
 		server.logger.Errorf("failed to connect to NATS %v: %v", config.Servers, err)
 		server.logger.Errorf("will try to connect again in %d milliseconds", reconnectWait)
-		server.natsTimer = time.NewTimer(time.Duration(reconnectWait) * time.Millisecond)
+		timer := time.NewTimer(time.Duration(reconnectWait) * time.Millisecond)
+		server.natsTimer = timer
 		go func() {
-			<-server.natsTimer.C
+			<-timer.C
 
-			server.natsTimer = nil
-			if server.checkRunning() {
-				server.Lock()
-				server.connectToNATS()
-				server.Unlock()
+			server.Lock()
+			defer server.Unlock()
+			if server.natsTimer == timer {
+				server.natsTimer = nil
 			}
+			server.connectToNATS() // returns right away once stopped
 		}()
 		return nil // we will retry, don't stop server running
 	}
 
 	server.logger.Noticef("connected to NATS for account and activation notifications")
+	if n := server.config.Notifications; !n.Legacy && !n.Native {
+		server.logger.Warnf("all account notification subjects are disabled")
+	}
+
+	var subject string
+	if server.config.NATSUpdates.Ignore {
+		server.logger.Noticef("ignoring account and activation updates sent over NATS")
+	} else {
+		nc.Subscribe(wildcard(server.subjects.accountUpdate), server.tracer.traceNATS("NATS account update", server.handleAccountNotification))
+		nc.Subscribe(wildcard(server.subjects.activationUpdate), server.tracer.traceNATS("NATS activation update", server.handleActivationNotification))
+		nc.Subscribe(wildcard(server.subjects.activationDelete), server.tracer.traceNATS("NATS activation delete", server.handleActivationDelete))
+
+		if server.config.NATSUpdates.Uploads && !nc.HeadersSupported() {
+			// the notifications of this server would come back as uploads without the header telling them apart
+			server.logger.Errorf("not answering uploads, the NATS connection doesn't support headers")
+		} else if server.config.NATSUpdates.Uploads {
+			subject = strings.Replace(accountNativeUpdateFormat, "%s", "*", -1)
+			nc.QueueSubscribe(subject, uploadQueue, server.handleAccountUpload)
+		}
+		if server.config.NATSUpdates.Resolver {
+			nc.QueueSubscribe(accountClaimsUpdate, uploadQueue, server.handleClaimsUpdate)
+			nc.Subscribe(accountNativeDelete, server.tracer.traceNATS("NATS claims delete", server.handleClaimsDelete))
+		}
+	}
 
-	subject := strings.Replace(accountNotificationFormat, "%s", "*", -1)
-	nc.Subscribe(subject, server.handleAccountNotification)
+	if server.config.NATSUpdates.Resolver {
+		nc.Subscribe(accountListRequest, server.tracer.traceNATS("NATS claims list", server.handleClaimsList))
+	}
 
-	subject = strings.Replace(activationNotificationFormat, "%s", "*", -1)
-	nc.Subscribe(subject, server.handleActivationNotification)
+	if server.config.Approval.Required {
+		nc.Subscribe(approvalRequest, server.tracer.traceNATS("NATS approval", server.handleApproval))
+	}
+
+	if server.config.AcceptOverrides {
+		nc.Subscribe(configOverrideRequest, server.tracer.traceNATS("NATS config override", server.handleConfigOverride))
+	}
 
 	server.nats = nc
+	server.startHeartbeat(nc)
+	go server.replayNotifications(nc, server.notifyQueue)
 
-	jwtStore, isDirStore := server.JWTStore.(*natsserver.DirJWTStore)
-	if server.JWTStore.IsReadOnly() || !isDirStore {
+	jwtStore, isSyncable := server.JWTStore.(syncableStore)
+	if server.JWTStore.IsReadOnly() || !isSyncable {
 		return nil
 	}
 
-	subject = strings.Replace(accountLookupRequest, "%s", "*", -1)
-	nc.Subscribe(subject, server.handleAccountLookup)
+	ctx := server.context()
+	nc.Subscribe(wildcard(server.subjects.accountLookup), server.tracer.traceNATS("NATS account lookup", server.handleAccountLookup))
+	nc.Subscribe(resyncRequest, server.tracer.traceNATS("NATS resync", server.handleResync))
 	// respond to pack requests with one or more pack messages
 	// an empty message signifies the end of the response responder
-	packSub, _ := nc.QueueSubscribe(accountPackRequest, "responder", func(m *nats.Msg) {
-		theirHash := m.Data
-		ourHash := jwtStore.Hash()
-		if bytes.Equal(theirHash, ourHash[:]) {
-			m.Respond(nil)
-			server.logger.Debugf("pack request matches")
-		} else if err := jwtStore.PackWalk(1, func(partialPackMsg string) {
-			m.Respond([]byte(partialPackMsg))
-		}); err != nil {
-			// let them timeout
-			server.logger.Errorf("pack request error: %v", err)
-		} else {
-			server.logger.Debugf("pack request hash %x - finished responding with hash %x")
-			m.Respond(nil)
+	packSub, _ := nc.QueueSubscribe(server.subjects.pack, "responder", func(m *nats.Msg) {
+		if strings.HasPrefix(m.Reply, server.checkInbox) {
+			// our own consistency check, leave it to the resolvers
+			return
 		}
+		server.respondPack(ctx, jwtStore, m)
 	})
 	// embed pack responses into store
 	packRespIb := nats.NewInbox()
+	stats := &syncStats{}
+	server.syncStats = stats
 	packRespSub, _ := nc.Subscribe(packRespIb, func(msg *nats.Msg) {
 		if len(msg.Data) == 0 { // end of response stream
+			server.endMergeCycle()
+			if since, warn := stats.finished(server.syncDivergence()); warn {
+				server.logger.Warnf("the store differs from the other account servers since %s", since.Format(time.RFC3339))
+			}
 			return
-		} else if err := jwtStore.Merge(string(msg.Data)); err != nil {
+		}
+		err := server.mergePack(ctx, "nats", jwtStore, string(msg.Data))
+		stats.merged(err)
+		if err != nil {
 			server.logger.Errorf("Merging resulted in error: %v", err)
 		} else {
 			server.logger.Debugf("Embedded pack message")
 		}
 	})
-	// periodically send out pack message
+	// periodically send out pack message, the timer is reset with a new jitter every time
 	quit := make(chan struct{})
+	timer := time.NewTimer(server.syncPeriod())
+	server.syncTimer = timer
 	go func() {
-		ticker := time.NewTicker(time.Duration(config.ReconnectWait) * time.Millisecond)
 		for {
 			select {
 			case <-quit:
-				ticker.Stop()
+				timer.Stop()
 				return
-			case <-ticker.C:
+			case <-timer.C:
 			}
 			ourHash := jwtStore.Hash()
 			server.logger.Debugf("Checking store state: %x", ourHash)
-			if err := nc.PublishRequest(accountPackRequest, packRespIb, ourHash[:]); err != nil {
+			if err := nc.PublishMsg(server.packRequest(nc, jwtStore, ourHash, packRespIb)); err != nil {
 				server.logger.Errorf("pack request error: %v", err)
+			} else {
+				stats.requested()
 			}
+			server.Lock()
+			timer.Reset(server.syncPeriod())
+			server.Unlock()
 		}
 	}()
+	server.startConsistencyCheck(nc, jwtStore)
 	server.shutdownNats = func() {
 		close(quit)
 		if packSub != nil {
@@ -216,22 +323,26 @@ func (server *AccountServer) connectToNATS() error {
 }
 
 func (server *AccountServer) handleAccountLookup(msg *nats.Msg) {
-	account := strings.TrimPrefix(msg.Subject, "$SYS.REQ.ACCOUNT.")
-	account = strings.TrimSuffix(account, ".CLAIMS.LOOKUP")
-	if len(account) == len(msg.Subject) || len(account) == 0 {
+	account := server.subjects.lookupAccount(msg.Subject)
+	if account == "" {
 		server.logger.Errorf("lookup %s failed parsing", msg.Subject)
 		return
 	} else if len(msg.Reply) == 0 {
 		server.logger.Tracef("lookup is not a request")
 		return
 	}
-	if theJWT, err := server.JWTStore.LoadAcc(account); err != nil {
+	if server.jwt.revoked.has(account) {
+		server.logger.Tracef("lookup of account %s - revoked", account)
+	} else if theJWT, err := server.JWTStore.LoadAcc(account); err != nil {
 		server.logger.Errorf("lookup of account %s - failed %v", account, err)
 		return
 	} else if theJWT == "" {
 		server.logger.Tracef("lookup of account %s - not found", account)
+	} else if claim, err := jwt.DecodeAccountClaims(theJWT); server.jwt.expiration.Enforce && err == nil && server.jwt.expired(claim) {
+		server.logger.Tracef("lookup of account %s - expired", account)
 	} else {
 		server.logger.Tracef("lookup of account %s - respond %d bytes", account, len(theJWT))
+		server.jwt.access.served(account, accessNATS)
 		msg.Respond([]byte(theJWT))
 	}
 }
@@ -248,49 +359,212 @@ func (server *AccountServer) sendAccountNotification(pubKey string, theJWT []byt
 		return nil
 	}
 
-	if server.nats == nil {
+	if server.nats == nil && server.notifyQueue == nil {
 		server.logger.Noticef("skipping notification for %s, no NATS configured", ShortKey(pubKey))
 		return nil
 	}
 
-	subject := fmt.Sprintf(accountNotificationFormat, pubKey)
-	return server.nats.Publish(subject, theJWT)
+	var pending error
+	for _, subject := range server.accountUpdateSubjects(pubKey) {
+		if err := server.notifyCurrent(server.nats, subject, theJWT, storedAccount(server.JWTStore, pubKey)); notificationPending(err) {
+			pending = err
+		} else if err != nil {
+			return err
+		}
+	}
+	return pending
 }
 
-func (server *AccountServer) respondToUpdate(msg *nats.Msg, acc string, message string, err error) {
+// sendDeleteNotification publishes the delete proof for an account, the nats-server full resolvers
+// receive it as a delete request, so it is sent without headers
+func (server *AccountServer) sendDeleteNotification(pubKey string, proof []byte) error {
+	if server.nats == nil {
+		server.logger.Noticef("skipping delete notification for %s, no NATS configured", ShortKey(pubKey))
+		return nil
+	}
+	if server.config.Notifications.Legacy {
+		if err := server.publishNotification(server.nats, fmt.Sprintf(accountDeleteFormat, pubKey), proof); err != nil {
+			return err
+		}
+	}
+	if server.config.Notifications.Native {
+		return server.nats.Publish(accountNativeDelete, proof)
+	}
+	return nil
+}
+
+// accountUpdateSubjects returns the subjects for all enabled notification schemes
+func (server *AccountServer) accountUpdateSubjects(pubKey string) []string {
+	var subjects []string
+	if server.config.Notifications.Legacy {
+		subjects = append(subjects, fmt.Sprintf(server.subjects.accountUpdate, pubKey))
+	}
+	if server.config.Notifications.Native {
+		subjects = append(subjects, fmt.Sprintf(accountNativeUpdateFormat, pubKey))
+	}
+	return subjects
+}
+
+// publishNotification sends data with headers identifying this server, if the connected server supports headers,
+// extra headers are passed as name/value pairs
+func (server *AccountServer) publishNotification(nc *nats.Conn, subject string, data []byte, headers ...string) error {
+	if !nc.HeadersSupported() {
+		return server.published(nc.Publish(subject, data))
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set(serverNameHeader, server.serverName())
+	msg.Header.Set(serverIDHeader, server.id)
+	if server.config.ClusterName != "" {
+		msg.Header.Set(serverClusterHeader, server.config.ClusterName)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i+1] != "" {
+			msg.Header.Set(headers[i], headers[i+1])
+		}
+	}
+	return server.published(nc.PublishMsg(msg))
+}
+
+// published records the time of a notification if err is nil, and returns err
+func (server *AccountServer) published(err error) error {
 	if err == nil {
-		server.logger.Debugf("%s - %s", message, acc)
-	} else {
-		server.logger.Errorf("%s - %s - %s", message, acc, err)
+		server.lastNotified.Store(time.Now().UnixNano())
 	}
-	if msg.Reply == "" {
-		return
+	return err
+}
+
+func (server *AccountServer) serverName() string {
+	if server.config != nil && server.config.ServerName != "" {
+		return server.config.ServerName
 	}
+	return defaultServerName
+}
+
+// serverInfo describes this server in update responses and heartbeats, assumes the lock is held
+func (server *AccountServer) serverInfo() map[string]interface{} {
 	host, _ := os.Hostname()
-	server.Lock() // ties seqNo increment and send together
-	server.respSeqNo++
-	defer server.Unlock()
-	response := map[string]interface{}{"server": map[string]interface{}{
-		"name": "nats-account-server",
+	info := map[string]interface{}{
+		"name": server.serverName(),
 		"host": host,
 		"ver":  version,
 		"seq":  server.respSeqNo,
 		"id":   server.id,
 		"time": time.Now(),
-	}}
-	if err == nil {
-		response["data"] = map[string]interface{}{
-			"code":    http.StatusOK,
-			"account": acc,
-			"message": message,
+	}
+	if server.config.ClusterName != "" {
+		info["cluster"] = server.config.ClusterName
+	}
+	if gitCommit != "" {
+		info["commit"] = gitCommit
+	}
+	if buildDate != "" {
+		info["build"] = buildDate
+	}
+	return info
+}
+
+// startHeartbeat periodically publishes the server info, assumes the lock is held
+func (server *AccountServer) startHeartbeat(nc *nats.Conn) {
+	interval := server.config.HeartbeatInterval
+	if interval <= 0 || server.stopHeartbeat != nil {
+		return
+	}
+	quit := make(chan struct{})
+	server.stopHeartbeat = quit
+	subject := fmt.Sprintf(heartbeatFormat, server.id)
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			server.Lock()
+			heartbeat := map[string]interface{}{
+				"server": server.serverInfo(),
+				"start":  server.startTime,
+			}
+			server.Unlock()
+			if m, err := json.Marshal(heartbeat); err != nil {
+				server.logger.Errorf("Marshaling error: %v", err)
+			} else if err := nc.Publish(subject, m); err != nil {
+				server.logger.Debugf("heartbeat error: %v", err)
+			}
 		}
-	} else {
-		response["error"] = map[string]interface{}{
-			"code":        http.StatusInternalServerError,
-			"account":     acc,
-			"description": fmt.Sprintf("%s - %v", message, err),
+	}()
+}
+
+// responseInfo returns the server info of a response with the next sequence. A shared sequence is
+// incremented without holding the lock, as it waits for the other servers. If it can't be incremented
+// the seq is left out, rather than one another server may have used already, and the response is sent
+// anyway since the update it answers is saved.
+func (server *AccountServer) responseInfo() map[string]interface{} {
+	server.Lock()
+	shared := server.sequence
+	server.Unlock()
+	var seq int64
+	var err error
+	if shared != nil {
+		if seq, err = shared.next(); err != nil {
+			server.logger.Errorf("unable to increment the shared sequence - %v", err)
 		}
 	}
+	server.Lock()
+	defer server.Unlock()
+	switch {
+	case shared == nil:
+		server.respSeqNo++
+		seq = server.respSeqNo
+	case err == nil && seq > server.respSeqNo:
+		server.respSeqNo = seq
+	}
+	info := server.serverInfo()
+	info["seq"] = seq
+	if err != nil {
+		delete(info, "seq")
+	}
+	return info
+}
+
+func (server *AccountServer) respondToUpdate(msg *nats.Msg, acc string, message string, err error) {
+	code := http.StatusOK
+	if err != nil {
+		code = http.StatusInternalServerError
+	}
+	server.respondToUpdateWithCode(msg, acc, code, message, err)
+}
+
+// respondToUpdateWithCode responds with data if err is nil, with an error otherwise
+func (server *AccountServer) respondToUpdateWithCode(msg *nats.Msg, acc string, code int, message string, err error) {
+	switch {
+	case err == nil && acc == "":
+		server.logger.Debugf("%s", message)
+	case err == nil:
+		server.logger.Debugf("%s - %s", message, acc)
+	case acc == "":
+		server.logger.Errorf("%s - %s", message, err)
+	default:
+		server.logger.Errorf("%s - %s - %s", message, acc, err)
+	}
+	if msg.Reply == "" {
+		return
+	}
+	response := map[string]interface{}{"server": server.responseInfo()}
+	// requests about several accounts, like deletes, leave the account out as the nats-server does
+	result := map[string]interface{}{"code": code}
+	if acc != "" {
+		result["account"] = acc
+	}
+	if err == nil {
+		result["message"] = message
+		response["data"] = result
+	} else {
+		result["description"] = fmt.Sprintf("%s - %v", message, err)
+		response["error"] = result
+	}
 	if m, err := json.MarshalIndent(response, "", "  "); err != nil {
 		server.logger.Errorf("Marshaling error: %v", err)
 	} else {
@@ -307,25 +581,57 @@ func (server *AccountServer) handleAccountNotification(msg *nats.Msg) {
 		return
 	} else {
 		pubKey := claim.Subject
-		if jwtStore := server.JWTStore; jwtStore == nil {
+		if !server.updateIssuerAllowed(claim.Issuer) {
+			server.respondToUpdate(msg, pubKey, "rejected jwt update",
+				fmt.Errorf("issuer %s is not allowed to send updates over NATS", ShortKey(claim.Issuer)))
+		} else if server.jwt.revoked.has(pubKey) {
+			server.respondToUpdate(msg, pubKey, "rejected jwt update", errAccountRevoked)
+		} else if jwtStore := server.JWTStore; jwtStore == nil {
 			server.respondToUpdate(msg, pubKey, "received error when saving jwt",
 				errors.New("store not set"))
-		} else if err = jwtStore.SaveAcc(pubKey, theJWT); err != nil {
+		} else if err = server.SaveAcc(pubKey, theJWT); err != nil {
 			server.respondToUpdate(msg, pubKey, "received error when saving jwt", err)
 		} else {
+			server.jwt.refreshSystemAccount(pubKey, theJWT)
 			server.respondToUpdate(msg, pubKey, "Updated jwt", nil)
 		}
 	}
 }
 
-func (server *AccountServer) sendActivationNotification(hash string, account string, theJWT []byte) error {
-	if server.nats == nil {
+// updateIssuerAllowed checks the issuer of an account JWT received over NATS against the allow-list
+func (server *AccountServer) updateIssuerAllowed(issuer string) bool {
+	allowed := server.config.NATSUpdates.AllowedIssuers
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, k := range allowed {
+		if k == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+// sendActivationNotification publishes an activation issued by account, target is the importing account
+func (server *AccountServer) sendActivationNotification(hash string, account string, target string, theJWT []byte) error {
+	if server.nats == nil && server.notifyQueue == nil {
 		server.logger.Noticef("skipping activation notification for %s, no NATS configured", ShortKey(hash))
 		return nil
 	}
 
-	subject := fmt.Sprintf(activationNotificationFormat, account, hash)
-	return server.nats.Publish(subject, theJWT)
+	current := storedActivation(&server.jwt, hash)
+	subject := fmt.Sprintf(server.subjects.activationUpdate, account, hash)
+	pending := server.notifyCurrent(server.nats, subject, theJWT, current, targetAccountHeader, target)
+	if pending != nil && !notificationPending(pending) {
+		return pending
+	}
+	if server.config.Notifications.ActivationTarget && target != "" {
+		subject = fmt.Sprintf(server.subjects.activationTarget, account, target, hash)
+		if err := server.notifyCurrent(server.nats, subject, theJWT, current, targetAccountHeader, target); err != nil {
+			return err
+		}
+	}
+	return pending
 }
 
 func (server *AccountServer) handleActivationNotification(msg *nats.Msg) {
@@ -337,55 +643,70 @@ func (server *AccountServer) handleActivationNotification(msg *nats.Msg) {
 		return
 	}
 
-	hash, err := claim.HashID()
-	if err != nil {
-		server.logger.Errorf("unable to calculate hash id from activation token in notification")
-		return
+	if hash, err := server.jwt.saveActivation(claim, theJWT, server.JWTStore.SaveAcc); err != nil {
+		server.logger.Errorf("unable to save activation token in notification, %s - %v", hash, err)
 	}
+}
 
-	err = server.JWTStore.SaveAcc(hash, theJWT)
-	if err != nil {
-		server.logger.Errorf("unable to save activation token in notification, %s", hash)
-		return
+// sendActivationDelete publishes the delete proof of an activation issued by account, target is the
+// importing account
+func (server *AccountServer) sendActivationDelete(hash string, account string, target string, proof []byte) error {
+	if server.nats == nil && server.notifyQueue == nil {
+		server.logger.Noticef("skipping activation delete notification for %s, no NATS configured", ShortKey(hash))
+		return nil
 	}
+	return server.notify(server.nats, fmt.Sprintf(server.subjects.activationDelete, account, hash), proof, targetAccountHeader, target)
 }
 
-func (server *AccountServer) accountSignatureRequest(pubKey string, theJWT []byte) (theJwt []byte, msg string, err error) {
-	to := time.Duration(server.config.SignRequestTimeout) * time.Millisecond
-	if msg, err := server.getNatsConnection().Request(server.config.SignRequestSubject, theJWT, to); err != nil {
-		if err == nats.ErrInvalidConnection {
-			return nil, "Failure during signature request. nats-server unavailable.", err
-		} else if err == nats.ErrTimeout {
-			return nil, "Failure during signature request. signing service unavailable.", err
-		} else {
-			return nil, "Failure during signature request. Try again at a later time. Error: " + err.Error(), err
+// handleActivationDelete removes the activations listed in a delete proof published by another account
+// server, the proof is checked like it is for a DELETE
+func (server *AccountServer) handleActivationDelete(msg *nats.Msg) {
+	h := &server.jwt
+	claim, err := jwt.DecodeGeneric(string(msg.Data))
+	if err != nil {
+		return
+	}
+	hashes, _ := claim.Data["activations"].([]interface{})
+	for _, entry := range hashes {
+		hash, ok := entry.(string)
+		if !ok {
+			continue
+		}
+		if _, status, failure := h.removeActivation(hash, msg.Data); status != 0 && status != http.StatusNotFound {
+			server.logger.Errorf("unable to delete activation in notification, %s - %s", ShortKey(hash), failure)
 		}
-	} else if _, err := jwt.DecodeAccountClaims(string(msg.Data)); err != nil {
-		return nil, string(msg.Data), nil // body is
-	} else {
-		return msg.Data, "", nil
 	}
 }
 
-// Wrap store with a nats layer, so lookups can be forwarded
+// Wrap store with the configured lookup chain, so lookups can be forwarded
 func (server *AccountServer) LoadAcc(publicKey string) (string, error) {
-	if s, error := server.JWTStore.LoadAcc(publicKey); error == nil {
-		return s, nil
-	} else if msg, err := server.getNatsConnection().Request(
-		fmt.Sprintf(accountLookupRequest, publicKey), nil,
-		time.Duration(server.config.SignRequestTimeout)*time.Millisecond); err != nil {
-		return "", err
-	} else {
-		return string(msg.Data), nil
-	}
+	theJWT, _, err := server.lookupAcc(publicKey)
+	return theJWT, err
 }
 
+// LoadAct finds the activation under the hash of any configured version
 func (server *AccountServer) LoadAct(hash string) (string, error) {
-	return server.JWTStore.(store.JWTActivationStore).LoadAct(hash)
+	theJWT, _, err := server.jwt.loadActivation(hash, activationLoader(server.JWTStore))
+	return theJWT, err
 }
 
+// SaveAct stores the activation under the hash of every configured version, hash is the one the caller computed
 func (server *AccountServer) SaveAct(hash string, theJWT string) error {
-	return server.JWTStore.(store.JWTActivationStore).SaveAct(hash, theJWT)
+	actStore := server.JWTStore.(store.JWTActivationStore)
+	claim, err := jwt.DecodeActivationClaims(theJWT)
+	if err != nil {
+		return actStore.SaveAct(hash, theJWT)
+	}
+	_, err = server.jwt.saveActivation(claim, theJWT, actStore.SaveAct)
+	return err
+}
+
+func (server *AccountServer) DeleteAcc(publicKey string) error {
+	deleter, ok := server.JWTStore.(store.DeletableJWTStore)
+	if !ok {
+		return fmt.Errorf("store does not support deletes")
+	}
+	return deleter.DeleteAcc(publicKey)
 }
 
 func (server *AccountServer) Pack(maxJWTs int) (string, error) {
@@ -395,3 +716,9 @@ func (server *AccountServer) Pack(maxJWTs int) (string, error) {
 func (server *AccountServer) Merge(pack string) error {
 	return server.JWTStore.(store.PackableJWTStore).Merge(pack)
 }
+
+// syncable returns the wrapped store if it takes part in the pack sync, so packs can be streamed from it
+func (server *AccountServer) syncable() (syncableStore, bool) {
+	s, ok := server.JWTStore.(syncableStore)
+	return s, ok
+}
@@ -17,7 +17,9 @@
 package core
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -28,10 +30,9 @@ import (
 	"testing"
 	"time"
 
+	gnatsserver "github.com/nats-io/nats-server/v2/server"
 	gnatsd "github.com/nats-io/nats-server/v2/test"
 
-	natsserver "github.com/nats-io/nats-server/v2/server"
-
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-account-server/server/conf"
 	"github.com/nats-io/nats-account-server/server/store"
@@ -239,7 +240,7 @@ func TestActivationNotifyWithoutNatsOK(t *testing.T) {
 	hash, err := act.HashID()
 	require.NoError(t, err)
 
-	err = server.sendActivationNotification(hash, acctPubKey, []byte(actJWT))
+	err = server.sendActivationNotification(hash, acctPubKey, acct2PubKey, []byte(actJWT))
 	require.NoError(t, err)
 }
 
@@ -330,7 +331,7 @@ func TestLookup(t *testing.T) {
 	received = false
 	lock.Unlock()
 
-	err = testEnv.Server.JWTStore.(*natsserver.DirJWTStore).SaveAcc(acctPubKey, jwt)
+	err = testEnv.Server.JWTStore.(*dirStore).SaveAcc(acctPubKey, jwt)
 	require.NoError(t, err)
 
 	resp, err = testEnv.HTTP.Get(url)
@@ -361,7 +362,7 @@ func TestPack(t *testing.T) {
 	require.NoError(t, err)
 	jwtHash := sha256.Sum256([]byte(jwt))
 
-	err = testEnv.Server.JWTStore.(*natsserver.DirJWTStore).SaveAcc(acctPubKey, jwt)
+	err = testEnv.Server.JWTStore.(*dirStore).SaveAcc(acctPubKey, jwt)
 	require.NoError(t, err)
 
 	respChan := make(chan *nats.Msg, 10)
@@ -428,11 +429,11 @@ func TestFullDirNatsResolver(t *testing.T) {
 	require.NoError(t, err)
 
 	// store jwt in account server
-	err = testEnv.Server.JWTStore.(*natsserver.DirJWTStore).SaveAcc(acctPubKey1, accJwt1)
+	err = testEnv.Server.JWTStore.(*dirStore).SaveAcc(acctPubKey1, accJwt1)
 	require.NoError(t, err)
 	sysAccJwt, err := os.ReadFile(testEnv.SystemAccountJWTFile)
 	require.NoError(t, err)
-	err = testEnv.Server.JWTStore.(*natsserver.DirJWTStore).SaveAcc(testEnv.SystemAccountPubKey, string(sysAccJwt))
+	err = testEnv.Server.JWTStore.(*dirStore).SaveAcc(testEnv.SystemAccountPubKey, string(sysAccJwt))
 	require.NoError(t, err)
 
 	dirA, err := os.MkdirTemp(os.TempDir(), "srv-a")
@@ -459,7 +460,7 @@ func TestFullDirNatsResolver(t *testing.T) {
 	require.FileExists(t, fmt.Sprintf("%s%c%s.jwt", dirA, os.PathSeparator, testEnv.SystemAccountPubKey))
 	require.FileExists(t, fmt.Sprintf("%s%c%s.jwt", dirA, os.PathSeparator, acctPubKey1))
 	// check if the account server contains the files stored in the account server
-	j, err := testEnv.Server.JWTStore.(*natsserver.DirJWTStore).LoadAcc(acctPubKey2)
+	j, err := testEnv.Server.JWTStore.(*dirStore).LoadAcc(acctPubKey2)
 	require.NoError(t, err)
 	require.Equal(t, j, accJwt2)
 }
@@ -486,11 +487,11 @@ func TestCacheDirNatsResolver(t *testing.T) {
 	require.NoError(t, err)
 
 	// store jwt in account server
-	err = testEnv.Server.JWTStore.(*natsserver.DirJWTStore).SaveAcc(acctPubKey1, accJwt1)
+	err = testEnv.Server.JWTStore.(*dirStore).SaveAcc(acctPubKey1, accJwt1)
 	require.NoError(t, err)
 	sysAccJwt, err := os.ReadFile(testEnv.SystemAccountJWTFile)
 	require.NoError(t, err)
-	err = testEnv.Server.JWTStore.(*natsserver.DirJWTStore).SaveAcc(testEnv.SystemAccountPubKey, string(sysAccJwt))
+	err = testEnv.Server.JWTStore.(*dirStore).SaveAcc(testEnv.SystemAccountPubKey, string(sysAccJwt))
 	require.NoError(t, err)
 
 	port := atomic.LoadUint64(&port) - 1
@@ -527,3 +528,544 @@ func TestCacheDirNatsResolver(t *testing.T) {
 	nc.Close()
 	require.FileExists(t, fmt.Sprintf("%s%c%s.jwt", dirA, os.PathSeparator, acctPubKey1))
 }
+
+func TestUpdateResponseIdentity(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.ServerName = "as-east"
+	config.ServerID = "as-east-1"
+	config.ClusterName = "east"
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	// the nats-server responds to the update as well, so look for ours
+	ib := testEnv.NC.NewRespInbox()
+	sub, err := testEnv.NC.SubscribeSync(ib)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.PublishRequest(fmt.Sprintf(accountNotificationFormat, pubKey), ib, []byte(acctJWT)))
+
+	var info map[string]interface{}
+	for i := 0; i < 2 && info == nil; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+		resp := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(msg.Data, &resp))
+		if srv, ok := resp["server"].(map[string]interface{}); ok && srv["name"] == "as-east" {
+			info = srv
+		}
+	}
+	require.NotNil(t, info)
+	require.Equal(t, "as-east-1", info["id"])
+	require.Equal(t, "east", info["cluster"])
+}
+
+func TestNotificationHeaders(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.ServerName = "as-west"
+	config.ClusterName = "west"
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	sub, err := testEnv.NC.SubscribeSync(fmt.Sprintf(accountNotificationFormat, pubKey))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	require.NoError(t, testEnv.Server.sendAccountNotification(pubKey, []byte(acctJWT)))
+
+	msg, err := sub.NextMsg(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, string(msg.Data))
+	require.Equal(t, "as-west", msg.Header.Get(serverNameHeader))
+	require.Equal(t, testEnv.Server.id, msg.Header.Get(serverIDHeader))
+	require.Equal(t, "west", msg.Header.Get(serverClusterHeader))
+}
+
+func TestDualStackNotifications(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Notifications.Native = true
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	legacy, err := testEnv.NC.SubscribeSync(fmt.Sprintf(accountNotificationFormat, pubKey))
+	require.NoError(t, err)
+	native, err := testEnv.NC.SubscribeSync(fmt.Sprintf(accountNativeUpdateFormat, pubKey))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	require.NoError(t, testEnv.Server.sendAccountNotification(pubKey, []byte(acctJWT)))
+
+	msg, err := legacy.NextMsg(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, string(msg.Data))
+	msg, err = native.NextMsg(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, string(msg.Data))
+
+	// turning off the legacy scheme only publishes on the native subject
+	testEnv.Server.config.Notifications.Legacy = false
+	require.NoError(t, testEnv.Server.sendAccountNotification(pubKey, []byte(acctJWT)))
+
+	_, err = native.NextMsg(time.Second)
+	require.NoError(t, err)
+	_, err = legacy.NextMsg(100 * time.Millisecond)
+	require.Error(t, err)
+}
+
+func TestActivationTargetNotification(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Notifications.ActivationTarget = true
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	issuerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	issuer, err := issuerKey.PublicKey()
+	require.NoError(t, err)
+	targetKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	target, err := targetKey.PublicKey()
+	require.NoError(t, err)
+
+	act := jwt.NewActivationClaims(target)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "times.*"
+	actJWT, err := act.Encode(issuerKey)
+	require.NoError(t, err)
+	hash, err := act.HashID()
+	require.NoError(t, err)
+
+	legacy, err := testEnv.NC.SubscribeSync(fmt.Sprintf(activationNotificationFormat, issuer, hash))
+	require.NoError(t, err)
+	byTarget, err := testEnv.NC.SubscribeSync(fmt.Sprintf(activationTargetFormat, "*", target, "*"))
+	require.NoError(t, err)
+	all, err := testEnv.NC.SubscribeSync("$SYS.ACCOUNT.*.CLAIMS.ACTIVATE.>")
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	require.NoError(t, testEnv.Server.sendActivationNotification(hash, issuer, target, []byte(actJWT)))
+
+	for _, sub := range []*nats.Subscription{legacy, byTarget, all} {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, actJWT, string(msg.Data))
+		require.Equal(t, target, msg.Header.Get(targetAccountHeader))
+	}
+	_, err = all.NextMsg(100 * time.Millisecond)
+	require.Error(t, err, "the targeted activation isn't sent under ACTIVATE")
+}
+
+func TestHeartbeat(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.ServerID = "as-hb"
+	config.ClusterName = "hb"
+	config.HeartbeatInterval = 50
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	sub, err := testEnv.NC.SubscribeSync(fmt.Sprintf(heartbeatFormat, "as-hb"))
+	require.NoError(t, err)
+
+	msg, err := sub.NextMsg(2 * time.Second)
+	require.NoError(t, err)
+	heartbeat := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(msg.Data, &heartbeat))
+	info := heartbeat["server"].(map[string]interface{})
+	require.Equal(t, "as-hb", info["id"])
+	require.Equal(t, "hb", info["cluster"])
+	require.Equal(t, defaultServerName, info["name"])
+}
+
+// sendUpdate publishes an account JWT on the update subject and returns the account server's response
+func sendUpdate(t *testing.T, testEnv *TestSetup, pubKey string, acctJWT string) map[string]interface{} {
+	ib := testEnv.NC.NewRespInbox()
+	sub, err := testEnv.NC.SubscribeSync(ib)
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, testEnv.NC.PublishRequest(fmt.Sprintf(accountNotificationFormat, pubKey), ib, []byte(acctJWT)))
+	// the nats-server responds to the update as well, so look for ours
+	for i := 0; i < 2; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+		resp := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(msg.Data, &resp))
+		if srv, ok := resp["server"].(map[string]interface{}); ok && srv["name"] == defaultServerName {
+			return resp
+		}
+	}
+	return nil
+}
+
+func TestNATSUpdateAllowedIssuers(t *testing.T) {
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	config := conf.DefaultServerConfig()
+	config.NATSUpdates.AllowedIssuers = []string{pubKey}
+	testEnv, err := SetupTestServer(config, false, false)
+	testEnv.Cleanup()
+	require.Error(t, err)
+
+	allowedKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	allowed, err := allowedKey.PublicKey()
+	require.NoError(t, err)
+
+	config = conf.DefaultServerConfig()
+	config.NATSUpdates.AllowedIssuers = []string{allowed}
+	testEnv, err = SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// the operator is trusted, but not in the allow-list
+	rejected, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp := sendUpdate(t, testEnv, pubKey, rejected)
+	require.NotNil(t, resp["error"])
+	_, err = testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+
+	accepted, err := jwt.NewAccountClaims(pubKey).Encode(allowedKey)
+	require.NoError(t, err)
+	resp = sendUpdate(t, testEnv, pubKey, accepted)
+	require.NotNil(t, resp["data"])
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, accepted, stored)
+}
+
+func TestIgnoreNATSUpdates(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.NATSUpdates.Ignore = true
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	ib := testEnv.NC.NewRespInbox()
+	sub, err := testEnv.NC.SubscribeSync(ib)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.PublishRequest(fmt.Sprintf(accountNotificationFormat, pubKey), ib, []byte(acctJWT)))
+	require.NoError(t, testEnv.NC.Flush())
+	// only the nats-server answers
+	for {
+		msg, err := sub.NextMsg(250 * time.Millisecond)
+		if err != nil {
+			break
+		}
+		require.NotContains(t, string(msg.Data), defaultServerName)
+	}
+	_, err = testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+}
+
+func TestPackResponderLimits(t *testing.T) {
+	require.Equal(t, "_INBOX.abc", packSource("_INBOX.abc.1"))
+	require.Equal(t, "_INBOX.abc", packSource("_INBOX.abc"))
+	_, err := newPackGuard(conf.PackResponderConfig{MaxBytes: -1}, newMetrics())
+	require.Error(t, err)
+
+	config := conf.DefaultServerConfig()
+	config.SyncInterval = 60000 // the server's own pack requests would count as well
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	testEnv.Server.packs, err = newPackGuard(conf.PackResponderConfig{RequestsPerMinute: 1, MaxChunks: 1}, testEnv.Server.metrics)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+		require.NoError(t, testEnv.Server.JWTStore.SaveAcc(pubKey, theJWT))
+	}
+
+	respChan := make(chan *nats.Msg, 10)
+	request := func(ib string) {
+		sub, err := testEnv.NC.ChanSubscribe(ib, respChan)
+		require.NoError(t, err)
+		t.Cleanup(func() { sub.Unsubscribe() })
+		require.NoError(t, testEnv.NC.PublishRequest(accountPackRequest, ib, nil))
+	}
+	noResponse := func() {
+		select {
+		case m := <-respChan:
+			t.Fatalf("unexpected response %q", m.Data)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+
+	// the response is cut short after one of the two JWTs, without the end of the stream
+	first := testEnv.NC.NewRespInbox()
+	request(first)
+	m := <-respChan
+	require.NotEmpty(t, m.Data)
+	noResponse()
+
+	// further requests this minute are dropped, whatever inbox they use
+	second := nats.NewInbox() + ".1"
+	request(second)
+	noResponse()
+
+	var buf bytes.Buffer
+	testEnv.Server.metrics.write(&buf)
+	require.Contains(t, buf.String(), fmt.Sprintf(`pack_requests_total{source="%s",result="truncated"} 1`, packSource(first)))
+	require.Contains(t, buf.String(), fmt.Sprintf(`pack_requests_total{source="%s",result="limited"} 1`, packSource(second)))
+}
+
+func TestNATSUploads(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.NATSUpdates.Uploads = true
+	config.Policy.MaxConnections = 10
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	upload := func(pubKey string, acctJWT string) map[string]interface{} {
+		ib := testEnv.NC.NewRespInbox()
+		sub, err := testEnv.NC.SubscribeSync(ib)
+		require.NoError(t, err)
+		defer sub.Unsubscribe()
+		require.NoError(t, testEnv.NC.PublishRequest(fmt.Sprintf(accountNativeUpdateFormat, pubKey), ib, []byte(acctJWT)))
+		// the nats-server responds to the upload as well, so look for ours
+		for i := 0; i < 2; i++ {
+			msg, err := sub.NextMsg(time.Second)
+			require.NoError(t, err)
+			resp := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal(msg.Data, &resp))
+			if srv, ok := resp["server"].(map[string]interface{}); ok && srv["name"] == defaultServerName {
+				return resp
+			}
+		}
+		return nil
+	}
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	// the policy applies, unlike on the notification subject
+	resp := upload(pubKey, acctJWT)
+	require.NotNil(t, resp)
+	failure, ok := resp["error"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, float64(http.StatusUnprocessableEntity), failure["code"])
+	require.Contains(t, failure["description"], "max connections is unlimited")
+	_, err = testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+
+	// self signed JWTs need the signing service
+	selfSigned, err := account.Encode(accountKey)
+	require.NoError(t, err)
+	resp = upload(pubKey, selfSigned)
+	failure, ok = resp["error"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, float64(http.StatusBadRequest), failure["code"])
+
+	account.Limits.Conn = 5
+	acctJWT, err = account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp = upload(pubKey, acctJWT)
+	data, ok := resp["data"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, float64(http.StatusOK), data["code"])
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, stored)
+
+	// the stored JWT coming back without the server header, like a notification on a connection without
+	// headers, isn't stored or announced again
+	notifications, err := testEnv.NC.SubscribeSync(fmt.Sprintf(accountNotificationFormat, pubKey))
+	require.NoError(t, err)
+	defer notifications.Unsubscribe()
+	resp = upload(pubKey, acctJWT)
+	data, ok = resp["data"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, float64(http.StatusOK), data["code"])
+	require.Equal(t, "jwt unchanged", data["message"])
+	_, err = notifications.NextMsg(200 * time.Millisecond)
+	require.ErrorIs(t, err, nats.ErrTimeout)
+}
+
+func TestNATSResolverRequests(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.NATSUpdates.Resolver = true
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	request := func(subject string, data []byte) map[string]interface{} {
+		ib := testEnv.NC.NewRespInbox()
+		sub, err := testEnv.NC.SubscribeSync(ib)
+		require.NoError(t, err)
+		defer sub.Unsubscribe()
+		require.NoError(t, testEnv.NC.PublishRequest(subject, ib, data))
+		// skip responses of the nats-server
+		for {
+			msg, err := sub.NextMsg(time.Second)
+			require.NoError(t, err)
+			resp := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal(msg.Data, &resp))
+			if srv, ok := resp["server"].(map[string]interface{}); ok && srv["name"] == defaultServerName {
+				return resp
+			}
+		}
+	}
+	list := func() []interface{} {
+		ids, ok := request(accountListRequest, nil)["data"].([]interface{})
+		require.True(t, ok)
+		return ids
+	}
+	proof := func(signer nkeys.KeyPair, accounts ...string) []byte {
+		issuer, err := signer.PublicKey()
+		require.NoError(t, err)
+		claim := jwt.NewGenericClaims(issuer)
+		claim.Data["accounts"] = accounts
+		theJWT, err := claim.Encode(signer)
+		require.NoError(t, err)
+		return []byte(theJWT)
+	}
+
+	before := len(list())
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	// updates carry the account in the JWT
+	resp := request(accountClaimsUpdate, []byte(acctJWT))
+	data, ok := resp["data"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, float64(http.StatusOK), data["code"])
+	require.Equal(t, pubKey, data["account"])
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, stored)
+	resp = request(accountClaimsUpdate, []byte("not a jwt"))
+	failure, ok := resp["error"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, float64(http.StatusBadRequest), failure["code"])
+
+	ids := list()
+	require.Len(t, ids, before+1)
+	require.Contains(t, ids, pubKey)
+
+	// only the operator can delete, and not the system account
+	resp = request(accountNativeDelete, proof(accountKey, pubKey))
+	failure, ok = resp["error"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, float64(http.StatusForbidden), failure["code"])
+	require.NotContains(t, failure, "account")
+	resp = request(accountNativeDelete, proof(testEnv.OperatorKey, pubKey, testEnv.SystemAccountPubKey))
+	failure, ok = resp["error"].(map[string]interface{})
+	require.True(t, ok)
+	require.Contains(t, failure["description"], "not allowed to delete system account")
+	_, err = testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+
+	// accounts that are not stored count as deleted
+	otherKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	otherPubKey, err := otherKey.PublicKey()
+	require.NoError(t, err)
+	resp = request(accountNativeDelete, proof(testEnv.OperatorKey, pubKey, otherPubKey))
+	data, ok = resp["data"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, "deleted 2 accounts", data["message"])
+	_, err = testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+	require.NotContains(t, list(), pubKey)
+}
+
+func TestNATSAuthOptions(t *testing.T) {
+	userKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	userPub, err := userKey.PublicKey()
+	require.NoError(t, err)
+	seed, err := userKey.Seed()
+	require.NoError(t, err)
+	seedFile := t.TempDir() + "/user.nk"
+	require.NoError(t, os.WriteFile(seedFile, seed, 0600))
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	opts.Users = []*gnatsserver.User{{Username: "account-server", Password: "secret"}}
+	opts.Nkeys = []*gnatsserver.NkeyUser{{Nkey: userPub}}
+	ns := gnatsd.RunServer(&opts)
+	defer ns.Shutdown()
+
+	connect := func(config conf.NATSConfig) error {
+		options, err := natsAuthOptions(config)
+		require.NoError(t, err)
+		nc, err := nats.Connect(ns.ClientURL(), options...)
+		if err == nil {
+			nc.Close()
+		}
+		return err
+	}
+	require.NoError(t, connect(conf.NATSConfig{User: "account-server", Password: "secret"}))
+	require.Error(t, connect(conf.NATSConfig{User: "account-server", Password: "wrong"}))
+	require.NoError(t, connect(conf.NATSConfig{Nkey: string(seed)}))
+	require.NoError(t, connect(conf.NATSConfig{NkeySeedFile: seedFile}))
+	require.Error(t, connect(conf.NATSConfig{}))
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	accountSeed, err := accountKey.Seed()
+	require.NoError(t, err)
+	for _, bad := range []conf.NATSConfig{
+		{User: "account-server", Token: "token"},
+		{UserCredentials: "user.creds", NkeySeedFile: seedFile},
+		{Password: "secret"},
+		{Nkey: "not a seed"},
+		{Nkey: string(accountSeed)},
+		{NkeySeedFile: seedFile + ".missing"},
+	} {
+		_, err := natsAuthOptions(bad)
+		require.Error(t, err, "%+v", bad)
+	}
+
+	config := conf.DefaultServerConfig()
+	config.NATS.User = "account-server"
+	config.NATS.Token = "token"
+	config.Store.Dir = t.TempDir()
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	require.Error(t, server.Start())
+	server.Stop()
+}
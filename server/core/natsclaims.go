@@ -0,0 +1,152 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// handleClaimsUpdate answers $SYS.REQ.CLAIMS.UPDATE, where the account is taken from the JWT rather
+// than the subject, with the checks of an upload
+func (server *AccountServer) handleClaimsUpdate(msg *nats.Msg) {
+	claim, err := jwt.DecodeAccountClaims(string(msg.Data))
+	if err != nil {
+		server.respondToUpdateWithCode(msg, "n/a", http.StatusBadRequest, "jwt update resulted in error", err)
+		return
+	}
+	server.upload(msg, claim.Subject)
+}
+
+// handleClaimsDelete answers $SYS.REQ.CLAIMS.DELETE like the nats-server full resolver, the request is
+// a generic JWT signed by the operator, or one of its signing keys, listing the accounts to delete.
+// Accounts that are not in the store count as deleted. The resolvers receive the request themselves,
+// so only the legacy delete notification is sent.
+func (server *AccountServer) handleClaimsDelete(msg *nats.Msg) {
+	h := &server.jwt
+	claim, err := jwt.DecodeGeneric(string(msg.Data))
+	if err != nil {
+		server.respondToUpdateWithCode(msg, "", http.StatusBadRequest, "delete accounts request failed", err)
+		return
+	}
+	failed := fmt.Sprintf("delete accounts request by %s failed", claim.Subject)
+	accounts, code, err := h.deleteRequestAccounts(claim)
+	if err != nil {
+		server.respondToUpdateWithCode(msg, "", code, failed, err)
+		return
+	}
+	deleter, ok := h.jwtStore.(store.DeletableJWTStore)
+	if !ok || h.jwtStore.IsReadOnly() {
+		server.respondToUpdateWithCode(msg, "", http.StatusNotImplemented, failed, errors.New("store does not support deletes"))
+		return
+	}
+
+	deleted := 0
+	var failures []string
+	for _, pubKey := range accounts {
+		if err := deleter.DeleteAcc(pubKey); err == errAccountNotFound {
+			deleted++
+		} else if err != nil {
+			failures = append(failures, fmt.Sprintf("%s - %v", pubKey, err))
+		} else {
+			deleted++
+			if server.config.Notifications.Legacy && server.nats != nil {
+				if err := server.publishNotification(server.nats, fmt.Sprintf(accountDeleteFormat, pubKey), msg.Data); err != nil {
+					server.logger.Errorf("error sending notification of delete - %s - %v", ShortKey(pubKey), err)
+				}
+			}
+			h.accountDeleted(pubKey)
+			h.logger.Noticef("deleted JWT for account - %s", ShortKey(pubKey))
+		}
+	}
+	if len(failures) == 0 {
+		server.respondToUpdateWithCode(msg, "", http.StatusOK, fmt.Sprintf("deleted %d accounts", deleted), nil)
+	} else {
+		server.respondToUpdateWithCode(msg, "", http.StatusInternalServerError,
+			fmt.Sprintf("deleted %d accounts, failed for %d", deleted, len(failures)), errors.New(strings.Join(failures, "\n")))
+	}
+}
+
+// deleteRequestAccounts checks a delete request and returns the accounts it lists, or the status and
+// the reason it is refused
+func (h *JwtHandler) deleteRequestAccounts(claim *jwt.GenericClaims) ([]string, int, error) {
+	vr := jwt.CreateValidationResults()
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		return nil, http.StatusBadRequest, errors.New("failed validation")
+	}
+	if claim.Subject != claim.Issuer {
+		return nil, http.StatusForbidden, errors.New("not self signed")
+	}
+	if _, trusted := h.trustedKeys[claim.Issuer]; !trusted {
+		return nil, http.StatusForbidden, errors.New("not trusted")
+	}
+	list, ok := claim.Data["accounts"].([]interface{})
+	if !ok {
+		return nil, http.StatusBadRequest, errors.New("malformed request")
+	}
+	accounts := make([]string, 0, len(list))
+	for _, entry := range list {
+		pubKey, ok := entry.(string)
+		if !ok || !nkeys.IsValidPublicAccountKey(pubKey) {
+			return nil, http.StatusBadRequest, errors.New("malformed request")
+		}
+		if h.isSystemAccount(pubKey) {
+			return nil, http.StatusBadRequest, errors.New("not allowed to delete system account")
+		}
+		if err := h.checkAccountOperator(pubKey, claim.Issuer); err != nil {
+			return nil, http.StatusForbidden, fmt.Errorf("%s - %v", pubKey, err)
+		}
+		accounts = append(accounts, pubKey)
+	}
+	return accounts, 0, nil
+}
+
+// handleClaimsList answers $SYS.REQ.CLAIMS.LIST with the public keys of the stored accounts, revoked
+// accounts are left out as they are from lookups. The consistency check of this server is not answered.
+func (server *AccountServer) handleClaimsList(msg *nats.Msg) {
+	if msg.Reply == "" || strings.HasPrefix(msg.Reply, server.checkInbox) {
+		return
+	}
+	keys, err := accountKeys(server.JWTStore)
+	if err != nil {
+		// let them time out, as the nats-server does when it can't list
+		server.logger.Errorf("list request error: %v", err)
+		return
+	}
+	ids := []string{}
+	for _, k := range keys {
+		if !server.jwt.revoked.has(k) {
+			ids = append(ids, k)
+		}
+	}
+
+	response := map[string]interface{}{"server": server.responseInfo(), "data": ids}
+	if m, err := json.Marshal(response); err != nil {
+		server.logger.Errorf("Marshaling error: %v", err)
+	} else {
+		server.logger.Debugf("list request responded with %d account ids", len(ids))
+		msg.Respond(m)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// uploadQueue is the queue group of the upload subscription, so one account server answers each upload
+const uploadQueue = "account_server"
+
+// handleAccountUpload answers uploads on $SYS.REQ.ACCOUNT.<pubkey>.CLAIMS.UPDATE like a POST to
+// /jwt/v1/accounts/<pubkey>: the write limit, authorization, signing, validation, lint and policy checks
+// all apply. Authorization and If-Match headers on the message are passed on. The response has the
+// format of the other update responses, with the HTTP status as code.
+func (server *AccountServer) handleAccountUpload(msg *nats.Msg) {
+	pubKey := strings.TrimPrefix(msg.Subject, "$SYS.REQ.ACCOUNT.")
+	pubKey = strings.TrimSuffix(pubKey, ".CLAIMS.UPDATE")
+	server.upload(msg, pubKey)
+}
+
+// upload runs the account JWT in msg through the checks of a POST for pubKey and responds with the
+// outcome. A JWT the store holds already is not saved and announced again, so a notification that
+// comes back to the server without its header isn't handled as an upload in a loop.
+func (server *AccountServer) upload(msg *nats.Msg, pubKey string) {
+	if msg.Header.Get(serverIDHeader) != "" {
+		// a notification from another account server, it ran the checks already
+		return
+	}
+	h := &server.jwt
+	if stored, err := h.jwtStore.LoadAcc(pubKey); err == nil && stored == string(msg.Data) {
+		server.respondToUpdateWithCode(msg, pubKey, http.StatusOK, "jwt unchanged", nil)
+		return
+	}
+	ctx, s := h.tracer.start(context.Background(), "NATS account upload", spanConsumer, msg.Header.Get(traceparentHeader))
+	s.set("messaging.system", "nats")
+	s.set("messaging.destination", msg.Subject)
+	s.set("account", pubKey)
+	// the write authorization reads the request, it carries the authorization header of the message
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/jwt/v1/accounts/"+pubKey, nil)
+	if err != nil {
+		s.finish(err)
+		server.respondToUpdateWithCode(msg, pubKey, http.StatusBadRequest, "rejected jwt upload", err)
+		return
+	}
+	r.RemoteAddr = "nats"
+	if v := msg.Header.Get("Authorization"); v != "" {
+		r.Header.Set("Authorization", v)
+	}
+	u := &accountUpdate{pubKey: pubKey, jwt: msg.Data, ifMatch: msg.Header.Get("If-Match"), header: http.Header{}}
+	status, err := h.writeAllowed(u.header, r, pubKey)
+	if err == nil {
+		status, err = h.updateAccount(ctx, u)
+	}
+	s.set("status_code", status)
+	s.finish(nil)
+
+	switch {
+	case err != nil:
+		server.respondToUpdateWithCode(msg, pubKey, status, "rejected jwt upload", errors.New(strings.TrimSpace(err.Error())))
+	case status == http.StatusOK && u.message == "":
+		server.respondToUpdateWithCode(msg, pubKey, status, "Updated jwt", nil)
+	default:
+		server.respondToUpdateWithCode(msg, pubKey, status, strings.TrimSpace(u.message), nil)
+	}
+}
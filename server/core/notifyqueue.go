@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+)
+
+// queuedNotification is a notification waiting for NATS, headers are the extra name/value pairs
+type queuedNotification struct {
+	Subject string    `json:"subject"`
+	Data    string    `json:"data"`
+	Headers []string  `json:"headers,omitempty"`
+	Queued  time.Time `json:"queued"`
+}
+
+// notificationQueue holds the notifications that couldn't be published, in order, and writes them to
+// its file on every change, so they survive a restart. A notification replaces a queued one on the same
+// subject, only the latest JWT of an account matters to the resolvers.
+type notificationQueue struct {
+	sync.Mutex
+	path    string
+	max     int
+	entries []queuedNotification
+	metrics *metrics
+}
+
+// newNotificationQueue returns nil if no file is configured, notifications left in the file are loaded
+func newNotificationQueue(config conf.NotificationQueueConfig, m *metrics) (*notificationQueue, error) {
+	if config.File == "" {
+		return nil, nil
+	}
+	if config.MaxEntries <= 0 {
+		return nil, fmt.Errorf("notification queue max entries must be positive")
+	}
+	q := &notificationQueue{path: config.File, max: config.MaxEntries, metrics: m}
+	data, err := os.ReadFile(config.File)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &q.entries); err != nil {
+			return nil, fmt.Errorf("error reading notification queue %s: %v", config.File, err)
+		}
+	}
+	m.describe("notifications_queued_total", "counter", "Number of notifications queued while NATS was down")
+	m.describe("notifications_replayed_total", "counter", "Number of queued notifications published once NATS was back")
+	m.describe("notifications_dropped_total", "counter", "Number of queued notifications dropped because the queue was full")
+	m.gaugeFunc("notification_queue_entries", "Number of notifications waiting for NATS", func() float64 {
+		return float64(q.size())
+	})
+	return q, nil
+}
+
+func (q *notificationQueue) size() int {
+	if q == nil {
+		return 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	return len(q.entries)
+}
+
+// push queues a notification, dropping the oldest one if the queue is full
+func (q *notificationQueue) push(subject string, data []byte, headers ...string) error {
+	q.Lock()
+	defer q.Unlock()
+	for i, e := range q.entries {
+		if e.Subject == subject {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+	q.entries = append(q.entries, queuedNotification{Subject: subject, Data: string(data), Headers: headers, Queued: time.Now().UTC()})
+	q.metrics.inc("notifications_queued_total")
+	if drop := len(q.entries) - q.max; drop > 0 {
+		q.entries = q.entries[drop:]
+		q.metrics.add("notifications_dropped_total", float64(drop))
+	}
+	return q.save()
+}
+
+// drain publishes the queued notifications in order, until one fails, and keeps the rest
+func (q *notificationQueue) drain(publish func(n queuedNotification) error) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+	sent := 0
+	var err error
+	for _, n := range q.entries {
+		if err = publish(n); err != nil {
+			break
+		}
+		sent++
+	}
+	if sent == 0 {
+		return 0, err
+	}
+	q.entries = q.entries[sent:]
+	q.metrics.add("notifications_replayed_total", float64(sent))
+	if saveErr := q.save(); err == nil {
+		err = saveErr
+	}
+	return sent, err
+}
+
+// save writes the queue to its file, assumes the lock is held
+func (q *notificationQueue) save() error {
+	if len(q.entries) == 0 {
+		if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(q.entries)
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// notify publishes a notification whose data doesn't change, see notifyCurrent
+func (server *AccountServer) notify(nc *nats.Conn, subject string, data []byte, headers ...string) error {
+	return server.notifyCurrent(nc, subject, data, nil, headers...)
+}
+
+// notifyCurrent publishes a notification, or queues it while NATS is down. Once anything is queued later
+// notifications are queued behind it, so they reach the resolvers in order. Without a queue a failed
+// notification is retried, if configured, with the data current loads by then, and errNotificationPending
+// is returned. A published notification drops the retry pending on its subject.
+func (server *AccountServer) notifyCurrent(nc *nats.Conn, subject string, data []byte, current func() ([]byte, error), headers ...string) error {
+	q := server.notifyQueue
+	if q == nil {
+		err := server.publishNotification(nc, subject, data, headers...)
+		if err == nil {
+			server.notifyRetry.done(subject)
+		} else if server.notifyRetry != nil {
+			server.logger.Warnf("retrying notification on %s, publishing failed - %v", subject, err)
+			server.notifyRetry.schedule(subject, data, current, headers...)
+			return errNotificationPending
+		}
+		return err
+	}
+	connected := nc != nil && nc.IsConnected()
+	if connected && q.size() == 0 {
+		err := server.publishNotification(nc, subject, data, headers...)
+		if err == nil {
+			return nil
+		}
+		server.logger.Warnf("queueing notification on %s, publishing failed - %v", subject, err)
+	}
+	if err := q.push(subject, data, headers...); err != nil {
+		return fmt.Errorf("error queueing notification, %v", err)
+	}
+	if connected {
+		server.replayNotifications(nc, q)
+	}
+	return nil
+}
+
+// replayNotifications publishes the queued notifications, called once NATS is connected. The queue is passed
+// in since a restart replaces it while a replay may still run
+func (server *AccountServer) replayNotifications(nc *nats.Conn, q *notificationQueue) {
+	if q == nil || nc == nil || !nc.IsConnected() {
+		return
+	}
+	sent, err := q.drain(func(n queuedNotification) error {
+		return server.publishNotification(nc, n.Subject, []byte(n.Data), n.Headers...)
+	})
+	if sent > 0 {
+		server.logger.Noticef("published %d queued notifications", sent)
+	}
+	if err != nil {
+		server.logger.Errorf("error publishing queued notifications, %d left - %v", q.size(), err)
+	}
+}
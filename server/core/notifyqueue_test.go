@@ -0,0 +1,120 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	gnatsserver "github.com/nats-io/nats-server/v2/server"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotificationQueue(t *testing.T) {
+	config := conf.NotificationQueueConfig{File: filepath.Join(t.TempDir(), "queue.json"), MaxEntries: 2}
+	q, err := newNotificationQueue(config, newMetrics())
+	require.NoError(t, err)
+
+	require.NoError(t, q.push("a", []byte("1")))
+	require.NoError(t, q.push("b", []byte("2"), targetAccountHeader, "T"))
+	require.NoError(t, q.push("a", []byte("3")))
+	require.Equal(t, 2, q.size())
+	// full, the oldest is dropped
+	require.NoError(t, q.push("c", []byte("4")))
+	require.Equal(t, 2, q.size())
+
+	loaded, err := newNotificationQueue(config, newMetrics())
+	require.NoError(t, err)
+	var sent []string
+	n, err := loaded.drain(func(n queuedNotification) error {
+		if n.Subject == "c" {
+			return errors.New("down again")
+		}
+		sent = append(sent, n.Subject+"="+n.Data)
+		return nil
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, []string{"a=3"}, sent)
+	require.Equal(t, 1, loaded.size())
+
+	n, err = loaded.drain(func(n queuedNotification) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	_, err = os.Stat(config.File)
+	require.True(t, os.IsNotExist(err), "an empty queue has no file")
+
+	q, err = newNotificationQueue(conf.NotificationQueueConfig{}, newMetrics())
+	require.NoError(t, err)
+	require.Nil(t, q)
+	_, err = newNotificationQueue(conf.NotificationQueueConfig{File: config.File}, newMetrics())
+	require.Error(t, err)
+}
+
+func TestNotificationsQueuedWhileNATSIsDown(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.NotificationQueue.File = filepath.Join(t.TempDir(), "queue.json")
+	config.NATS.ReconnectWait = 2000
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// reconnects well before the account server, so the replay isn't missed
+	natsPort := testEnv.GNATSD.Addr().(*net.TCPAddr).Port
+	nc, err := nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", natsPort), nats.UserCredentials(testEnv.SystemUserCredsFile),
+		nats.ReconnectWait(10*time.Millisecond), nats.ReconnectJitter(0, 0), nats.MaxReconnects(-1))
+	require.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(wildcard(accountNotificationFormat))
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	testEnv.GNATSD.Shutdown()
+	require.Eventually(t, func() bool {
+		return !testEnv.Server.getNatsConnection().IsConnected()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+	require.Equal(t, 1, testEnv.Server.notifyQueue.size())
+	_, err = os.Stat(config.NotificationQueue.File)
+	require.NoError(t, err)
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = natsPort
+	opts.TrustedKeys = []string{testEnv.OperatorPubKey}
+	opts.SystemAccount = testEnv.SystemAccountPubKey
+	opts.AccountResolver, err = gnatsserver.NewURLAccResolver(testEnv.URLForPath("/jwt/v1/accounts/"))
+	require.NoError(t, err)
+	testEnv.GNATSD = gnatsd.RunServer(&opts)
+
+	msg, err := sub.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf(accountNotificationFormat, pubKey), msg.Subject)
+	require.Equal(t, theJWT, string(msg.Data))
+	require.Zero(t, testEnv.Server.notifyQueue.size())
+	_, err = os.Stat(config.NotificationQueue.File)
+	require.True(t, os.IsNotExist(err))
+}
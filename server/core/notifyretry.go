@@ -0,0 +1,198 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+)
+
+// errNotificationPending is returned when publishing a notification failed and it is retried in the
+// background, the JWT itself was stored
+var errNotificationPending = errors.New("the notification is pending, publishing it failed and is retried")
+
+// notificationPending is true if err only means that the notification is retried later
+func notificationPending(err error) bool {
+	return errors.Is(err, errNotificationPending)
+}
+
+// retriedNotification is a notification waiting for its next attempt
+type retriedNotification struct {
+	data     []byte
+	current  func() ([]byte, error) // loads the data to publish again, nil publishes data
+	headers  []string
+	attempts int
+	backoff  time.Duration
+	timer    *time.Timer
+}
+
+// notificationRetry publishes failed notifications again, with a backoff doubled after each attempt. A
+// notification replaces a pending one on the same subject and one published on it drops the retry, only
+// the latest JWT of an account matters to the resolvers. Retries send the JWT stored by then, not the
+// one that failed.
+type notificationRetry struct {
+	sync.Mutex
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	pending    map[string]*retriedNotification
+	publish    func(subject string, data []byte, headers ...string) error
+	logger     natsserver.Logger
+	metrics    *metrics
+}
+
+// newNotificationRetry returns nil if retrying is off
+func newNotificationRetry(config conf.NotificationRetryConfig, publish func(subject string, data []byte, headers ...string) error,
+	logger natsserver.Logger, m *metrics) (*notificationRetry, error) {
+	if config.Attempts == 0 {
+		return nil, nil
+	}
+	if config.Attempts < 0 || config.Backoff <= 0 || config.MaxBackoff < config.Backoff {
+		return nil, fmt.Errorf("notification retry needs positive attempts and backoff, and a max_backoff no shorter than the backoff")
+	}
+	r := &notificationRetry{
+		attempts:   config.Attempts,
+		backoff:    time.Duration(config.Backoff) * time.Millisecond,
+		maxBackoff: time.Duration(config.MaxBackoff) * time.Millisecond,
+		pending:    map[string]*retriedNotification{},
+		publish:    publish,
+		logger:     logger,
+		metrics:    m,
+	}
+	m.describe("notification_retries_total", "counter", "Number of attempts to publish a failed notification again")
+	m.describe("notification_retries_dropped_total", "counter", "Number of failed notifications dropped after their last retry")
+	m.gaugeFunc("notification_retries_pending", "Number of failed notifications waiting to be published again", func() float64 {
+		return float64(r.size())
+	})
+	return r, nil
+}
+
+func (r *notificationRetry) size() int {
+	if r == nil {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	return len(r.pending)
+}
+
+// schedule retries a notification after the first backoff, replacing the one pending on the subject.
+// current loads the data of the retry, nil publishes data again.
+func (r *notificationRetry) schedule(subject string, data []byte, current func() ([]byte, error), headers ...string) {
+	r.Lock()
+	defer r.Unlock()
+	if old, ok := r.pending[subject]; ok {
+		old.timer.Stop()
+	}
+	n := &retriedNotification{data: data, current: current, headers: headers, backoff: r.backoff}
+	n.timer = time.AfterFunc(n.backoff, func() { r.retry(subject, n) })
+	r.pending[subject] = n
+}
+
+// retry publishes a pending notification, and schedules the next attempt if it fails again
+func (r *notificationRetry) retry(subject string, n *retriedNotification) {
+	r.Lock()
+	defer r.Unlock()
+	if r.pending[subject] != n {
+		return // replaced, published or stopped
+	}
+	data := n.data
+	if n.current != nil {
+		latest, err := n.current()
+		if err != nil || len(latest) == 0 {
+			delete(r.pending, subject)
+			r.logger.Noticef("dropping the notification on %s, what it announced is no longer stored - %v", subject, err)
+			return
+		}
+		data = latest
+	}
+	n.attempts++
+	r.metrics.inc("notification_retries_total")
+	err := r.publish(subject, data, n.headers...)
+	if err == nil {
+		delete(r.pending, subject)
+		r.logger.Noticef("published the notification on %s after %d retries", subject, n.attempts)
+		return
+	}
+	if n.attempts >= r.attempts {
+		delete(r.pending, subject)
+		r.metrics.inc("notification_retries_dropped_total")
+		r.logger.Errorf("dropping the notification on %s after %d retries - %v", subject, n.attempts, err)
+		return
+	}
+	if n.backoff *= 2; n.backoff > r.maxBackoff {
+		n.backoff = r.maxBackoff
+	}
+	r.logger.Warnf("retry %d of the notification on %s failed, next in %v - %v", n.attempts, subject, n.backoff, err)
+	n.timer = time.AfterFunc(n.backoff, func() { r.retry(subject, n) })
+}
+
+// done drops the retry pending on subject, a notification was published on it since
+func (r *notificationRetry) done(subject string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if n, ok := r.pending[subject]; ok {
+		n.timer.Stop()
+		delete(r.pending, subject)
+	}
+}
+
+// stop drops the pending notifications
+func (r *notificationRetry) stop() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	for subject, n := range r.pending {
+		n.timer.Stop()
+		delete(r.pending, subject)
+	}
+}
+
+// storedAccount returns the loader of the account JWT a retried notification sends
+func storedAccount(jwtStore store.JWTStore, pubKey string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		theJWT, err := jwtStore.LoadAcc(pubKey)
+		return []byte(theJWT), err
+	}
+}
+
+// storedActivation returns the loader of the activation a retried notification sends
+func storedActivation(h *JwtHandler, hash string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		theJWT, _, err := h.loadActivation(hash, activationLoader(h.jwtStore))
+		return []byte(theJWT), err
+	}
+}
+
+// republish publishes a notification again on the current NATS connection
+func (server *AccountServer) republish(subject string, data []byte, headers ...string) error {
+	nc := server.getNatsConnection()
+	if nc == nil {
+		return errors.New("not connected to NATS")
+	}
+	return server.publishNotification(nc, subject, data, headers...)
+}
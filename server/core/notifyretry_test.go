@@ -0,0 +1,168 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotificationRetry(t *testing.T) {
+	var lock sync.Mutex
+	var sent []string
+	failures := map[string]int{"a": 2, "b": 10}
+	publish := func(subject string, data []byte, headers ...string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures[subject] > 0 {
+			failures[subject]--
+			return errors.New("down")
+		}
+		sent = append(sent, subject+"="+string(data))
+		return nil
+	}
+	config := conf.NotificationRetryConfig{Attempts: 3, Backoff: 5, MaxBackoff: 10}
+	r, err := newNotificationRetry(config, publish, NewNilLogger(), newMetrics())
+	require.NoError(t, err)
+
+	r.schedule("a", []byte("1"), nil)
+	r.schedule("a", []byte("2"), nil)
+	r.schedule("b", []byte("3"), nil)
+	require.Equal(t, 2, r.size())
+	require.Eventually(t, func() bool { return r.size() == 0 }, 2*time.Second, 5*time.Millisecond)
+	lock.Lock()
+	require.Equal(t, []string{"a=2"}, sent, "the latest on a subject is published, b is dropped after 3 retries")
+	require.Equal(t, 7, failures["b"])
+	lock.Unlock()
+
+	// a retry sends the data current by then, and a notification published on the subject drops it
+	r.schedule("d", []byte("5"), func() ([]byte, error) { return []byte("6"), nil })
+	r.schedule("e", []byte("7"), nil)
+	r.done("e")
+	require.Eventually(t, func() bool { return r.size() == 0 }, 2*time.Second, 5*time.Millisecond)
+	lock.Lock()
+	require.Equal(t, []string{"a=2", "d=6"}, sent)
+	lock.Unlock()
+
+	r.schedule("c", []byte("4"), nil)
+	r.stop()
+	require.Zero(t, r.size())
+
+	r, err = newNotificationRetry(conf.NotificationRetryConfig{}, publish, NewNilLogger(), newMetrics())
+	require.NoError(t, err)
+	require.Nil(t, r)
+	_, err = newNotificationRetry(conf.NotificationRetryConfig{Attempts: 3, Backoff: 100, MaxBackoff: 10}, publish, NewNilLogger(), newMetrics())
+	require.Error(t, err)
+}
+
+func TestNotificationPendingOnPost(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.NotificationRetry = conf.NotificationRetryConfig{Attempts: 2, Backoff: 10, MaxBackoff: 10}
+	config.HTTP.MaxBodySize = 4 << 20
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// larger than the max payload of the nats-server, publishing it fails
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	account := jwt.NewAccountClaims(pubKey)
+	for i := 0; i < 2000; i++ {
+		account.Exports.Add(&jwt.Export{Subject: jwt.Subject(fmt.Sprintf("svc.%d.%s", i, strings.Repeat("x", 600))), Type: jwt.Service})
+	}
+	theJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBufferString(theJWT))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []string{errNotificationPending.Error()}, resp.Header.Values(warningHeader))
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, theJWT, stored)
+	require.Eventually(t, func() bool { return testEnv.Server.notifyRetry.size() == 0 }, 2*time.Second, 10*time.Millisecond)
+
+	smallKey, smallJWT := newAccountJWT(t, testEnv.OperatorKey)
+	resp, err = testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+smallKey), "application/json", bytes.NewBufferString(smallJWT))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Values(warningHeader))
+}
+
+func TestNotificationRetryDroppedByNewerUpdate(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.NotificationRetry = conf.NotificationRetryConfig{Attempts: 5, Backoff: 200, MaxBackoff: 200}
+	config.HTTP.MaxBodySize = 4 << 20
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	notifications, err := testEnv.NC.SubscribeSync(fmt.Sprintf(accountNotificationFormat, pubKey))
+	require.NoError(t, err)
+	defer notifications.Unsubscribe()
+	post := func(theJWT string) {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBufferString(theJWT))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// larger than the max payload, publishing the first JWT fails and is retried
+	account := jwt.NewAccountClaims(pubKey)
+	for i := 0; i < 2000; i++ {
+		account.Exports.Add(&jwt.Export{Subject: jwt.Subject(fmt.Sprintf("svc.%d.%s", i, strings.Repeat("x", 600))), Type: jwt.Service})
+	}
+	largeJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	post(largeJWT)
+	require.Equal(t, 1, testEnv.Server.notifyRetry.size())
+
+	// the newer JWT is published and the retry of the older one dropped
+	newerJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	post(newerJWT)
+	require.Zero(t, testEnv.Server.notifyRetry.size())
+
+	// the store watch may announce the newer JWT again, past the backoff the last one is still the newer
+	var last string
+	for {
+		msg, err := notifications.NextMsg(600 * time.Millisecond)
+		if err != nil {
+			break
+		}
+		last = string(msg.Data)
+	}
+	require.Equal(t, newerJWT, last)
+}
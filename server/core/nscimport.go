@@ -0,0 +1,180 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// NSCSkipped is an account of the nsc store that was not imported
+type NSCSkipped struct {
+	Account string `json:"account,omitempty"`
+	Name    string `json:"name,omitempty"`
+	File    string `json:"file"`
+	Reason  string `json:"reason"`
+}
+
+// NSCImportReport is the summary of an nsc migration
+type NSCImportReport struct {
+	Operator string       `json:"operator"`
+	Imported []string     `json:"imported"`
+	Skipped  []NSCSkipped `json:"skipped"`
+}
+
+// MigrateNSC imports the account JWTs of an nsc operator directory, <nsc store>/<operator>, into the
+// configured store. The nsc store itself may be given if it holds a single operator. Every account has to
+// be signed by a configured operator, or by the nsc operator if none is configured, and pass validation.
+// Accounts the store already holds are only replaced by newer JWTs. The server must not be running.
+func (server *AccountServer) MigrateNSC(dir string) (*NSCImportReport, error) {
+	server.Lock()
+	running := server.running
+	server.Unlock()
+	if running {
+		return nil, errors.New("nsc stores are imported before the server is started")
+	}
+	opDir, err := nscOperatorDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	opJWT, err := os.ReadFile(filepath.Join(opDir, filepath.Base(opDir)+".jwt"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the nsc operator: %v", err)
+	}
+	operator, err := jwt.DecodeOperatorClaims(strings.TrimSpace(string(opJWT)))
+	if err != nil {
+		return nil, fmt.Errorf("bad nsc operator JWT: %v", err)
+	}
+
+	// the server isn't started, the privacy settings hide names in the report and the log all the same
+	privacy, err := newPrivacy(server.config.Privacy)
+	if err != nil {
+		return nil, err
+	}
+	jwtStore, trusted, err := server.openStoreOffline()
+	if err != nil {
+		return nil, err
+	}
+	defer jwtStore.Close()
+	if jwtStore.IsReadOnly() {
+		return nil, errors.New("store is read-only")
+	}
+	if len(trusted) == 0 {
+		trusted = map[string]struct{}{operator.Subject: {}}
+		for _, k := range operator.SigningKeys {
+			trusted[k] = struct{}{}
+		}
+	} else if _, ok := trusted[operator.Subject]; !ok {
+		server.logger.Warnf("nsc operator %s is not configured, only accounts signed by a configured operator are imported", privacy.name(operator.Name))
+	}
+
+	files, err := filepath.Glob(filepath.Join(opDir, "accounts", "*", "*.jwt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	report := &NSCImportReport{Operator: operator.Subject, Imported: []string{}, Skipped: []NSCSkipped{}}
+	for _, file := range files {
+		if strings.TrimSuffix(filepath.Base(file), ".jwt") != filepath.Base(filepath.Dir(file)) {
+			continue // not the account JWT of the directory
+		}
+		skip := NSCSkipped{File: file}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return report, err
+		}
+		theJWT := strings.TrimSpace(string(data))
+		claim, reason := nscAccount(theJWT, trusted, jwtStore)
+		if claim != nil {
+			skip.Account, skip.Name = claim.Subject, privacy.name(claim.Name)
+		}
+		if reason != "" {
+			skip.Reason = reason
+			report.Skipped = append(report.Skipped, skip)
+			server.logger.Noticef("skipped nsc account %s - %s", file, reason)
+			continue
+		}
+		if err := jwtStore.SaveAcc(claim.Subject, theJWT); err != nil {
+			return report, fmt.Errorf("error importing account %s: %v", claim.Subject, err)
+		}
+		report.Imported = append(report.Imported, claim.Subject)
+		server.logger.Noticef("imported nsc account %s - %s", ShortKey(claim.Subject), privacy.name(claim.Name))
+	}
+	return report, nil
+}
+
+// nscOperatorDir returns dir if it is an nsc operator directory, or the only operator directory in it
+func nscOperatorDir(dir string) (string, error) {
+	isOperator := func(d string) bool {
+		_, err := os.Stat(filepath.Join(d, filepath.Base(d)+".jwt"))
+		return err == nil
+	}
+	dir = filepath.Clean(dir)
+	if isOperator(dir) {
+		return dir, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, e := range entries {
+		if e.IsDir() && isOperator(filepath.Join(dir, e.Name())) {
+			found = append(found, filepath.Join(dir, e.Name()))
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%s is not an nsc operator directory", dir)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("%s holds several operators, pick one of %s", dir, strings.Join(found, ", "))
+	}
+}
+
+// nscAccount decodes and checks an account JWT of the nsc store, the reason is empty if it can be imported
+func nscAccount(theJWT string, trusted map[string]struct{}, jwtStore store.JWTStore) (*jwt.AccountClaims, string) {
+	claim, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil {
+		return nil, fmt.Sprintf("bad account JWT - %v", err)
+	}
+	if _, ok := trusted[claim.Issuer]; !ok {
+		return claim, "not signed by the operator"
+	}
+	vr := jwt.CreateValidationResults()
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		var failures []string
+		for _, err := range vr.Errors() {
+			failures = append(failures, err.Error())
+		}
+		return claim, fmt.Sprintf("failed validation - %s", strings.Join(failures, ", "))
+	}
+	if stored, err := jwtStore.LoadAcc(claim.Subject); err == nil && stored != "" {
+		if old, err := jwt.DecodeAccountClaims(stored); err == nil && old.IssuedAt >= claim.IssuedAt {
+			return claim, "the store holds the same or a newer JWT"
+		}
+	}
+	return claim, ""
+}
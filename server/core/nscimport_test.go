@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateNSC(t *testing.T) {
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	operatorPubKey, err := operatorKey.PublicKey()
+	require.NoError(t, err)
+	opJWT, err := jwt.NewOperatorClaims(operatorPubKey).Encode(operatorKey)
+	require.NoError(t, err)
+
+	// <nsc store>/<operator>/accounts/<account>/<account>.jwt, users are left alone
+	nscStore := t.TempDir()
+	opDir := filepath.Join(nscStore, "op")
+	writeNSC := func(path string, data string) {
+		path = filepath.Join(opDir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+	}
+	writeNSC("op.jwt", opJWT)
+	good, goodJWT := newAccountJWT(t, operatorKey)
+	writeNSC("accounts/A/A.jwt", goodJWT)
+	otherOperator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	foreign, foreignJWT := newAccountJWT(t, otherOperator)
+	writeNSC("accounts/B/B.jwt", foreignJWT)
+	writeNSC("accounts/C/C.jwt", "not a jwt")
+	_, userJWT := newAccountJWT(t, operatorKey)
+	writeNSC("accounts/A/users/U.jwt", userJWT)
+
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = t.TempDir()
+	config.Logging.Custom = NewNilLogger()
+	migrate := func(dir string) (*NSCImportReport, error) {
+		server := NewAccountServer()
+		require.NoError(t, server.InitializeFromConfig(config))
+		server.logger = server.ConfigureLogger()
+		return server.MigrateNSC(dir)
+	}
+
+	_, err = migrate(t.TempDir())
+	require.Error(t, err, "not an nsc store")
+
+	// the nsc store holds a single operator, so it can be given as well
+	report, err := migrate(nscStore)
+	require.NoError(t, err)
+	require.Equal(t, operatorPubKey, report.Operator)
+	require.Equal(t, []string{good}, report.Imported)
+	require.Len(t, report.Skipped, 2)
+	require.Equal(t, foreign, report.Skipped[0].Account)
+	require.Equal(t, "not signed by the operator", report.Skipped[0].Reason)
+	require.Equal(t, filepath.Join(opDir, "accounts", "C", "C.jwt"), report.Skipped[1].File)
+
+	stored, err := os.ReadFile(filepath.Join(config.Store.Dir, good+".jwt"))
+	require.NoError(t, err)
+	require.Equal(t, goodJWT, string(stored))
+
+	// a second run finds the accounts in the store, their names are hidden like in the log
+	config.Privacy.Fields = []string{"name"}
+	report, err = migrate(opDir)
+	require.NoError(t, err)
+	require.Empty(t, report.Imported)
+	require.Len(t, report.Skipped, 3)
+	require.Equal(t, good, report.Skipped[0].Account)
+	require.Equal(t, redacted, report.Skipped[0].Name)
+	config.Privacy.Fields = nil
+
+	// with a configured operator the accounts have to be signed by it
+	opFile := filepath.Join(t.TempDir(), "other.jwt")
+	otherPubKey, err := otherOperator.PublicKey()
+	require.NoError(t, err)
+	otherJWT, err := jwt.NewOperatorClaims(otherPubKey).Encode(otherOperator)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(opFile, []byte(otherJWT), 0644))
+	config.OperatorJWTPath = opFile
+	report, err = migrate(opDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{foreign}, report.Imported)
+
+	// a running server is not changed behind its back
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	_, err = testEnv.Server.MigrateNSC(opDir)
+	require.Error(t, err)
+}
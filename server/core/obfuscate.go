@@ -0,0 +1,93 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+)
+
+// keyPattern matches public nkeys and the 12 character prefixes logged by ShortKey, seeds start with S
+// and are matched as well
+var keyPattern = regexp.MustCompile(`\b[ACNOSUVX][A-Z2-7]{11,57}\b`)
+
+// obfuscatedPrefix is the part of a key left in the log, enough to tell the key type and correlate
+const obfuscatedPrefix = 4
+
+// keyObfuscators are the modes of LogConfig.ObfuscateKeys. Only the first 12 characters are used, so
+// a full key and its ShortKey come out the same.
+var keyObfuscators = map[string]func(string) string{
+	"hash": func(key string) string {
+		sum := sha256.Sum256([]byte(ShortKey(key)))
+		return key[:obfuscatedPrefix] + "#" + hex.EncodeToString(sum[:4])
+	},
+	"redact": func(key string) string {
+		return key[:obfuscatedPrefix] + "***"
+	},
+}
+
+// keyObfuscator returns the function applied to the keys in log lines, or nil if they are logged as is
+func keyObfuscator(opts conf.LogConfig) (func(string) string, error) {
+	if opts.KeyObfuscator != nil {
+		return opts.KeyObfuscator, nil
+	}
+	if opts.ObfuscateKeys == "" {
+		return nil, nil
+	}
+	if f, ok := keyObfuscators[opts.ObfuscateKeys]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown key obfuscation %q, use hash or redact", opts.ObfuscateKeys)
+}
+
+// keyLogger rewrites the nkeys in every line before passing it on
+type keyLogger struct {
+	natsserver.Logger
+	obfuscate func(string) string
+}
+
+func (l *keyLogger) line(format string, v []interface{}) string {
+	return keyPattern.ReplaceAllStringFunc(fmt.Sprintf(format, v...), l.obfuscate)
+}
+
+func (l *keyLogger) Noticef(format string, v ...interface{}) {
+	l.Logger.Noticef("%s", l.line(format, v))
+}
+
+func (l *keyLogger) Warnf(format string, v ...interface{}) {
+	l.Logger.Warnf("%s", l.line(format, v))
+}
+
+func (l *keyLogger) Fatalf(format string, v ...interface{}) {
+	l.Logger.Fatalf("%s", l.line(format, v))
+}
+
+func (l *keyLogger) Errorf(format string, v ...interface{}) {
+	l.Logger.Errorf("%s", l.line(format, v))
+}
+
+func (l *keyLogger) Debugf(format string, v ...interface{}) {
+	l.Logger.Debugf("%s", l.line(format, v))
+}
+
+func (l *keyLogger) Tracef(format string, v ...interface{}) {
+	l.Logger.Tracef("%s", l.line(format, v))
+}
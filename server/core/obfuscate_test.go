@@ -0,0 +1,80 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingLogger struct {
+	NilLogger
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Noticef(format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Errorf(format string, v ...interface{}) {
+	l.Noticef(format, v...)
+}
+
+func (l *recordingLogger) output() string {
+	l.Lock()
+	defer l.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+func TestObfuscateKeys(t *testing.T) {
+	const key = "ADTQS7ZCFVJNW5736GOYGB2ESOIYSOOYJ5CWQ7VK5KFTCDM7YAHHDK5S"
+	hash := keyObfuscators["hash"]
+	require.Equal(t, hash(key), hash(ShortKey(key)))
+	require.True(t, strings.HasPrefix(hash(key), "ADTQ#"))
+	require.NotEqual(t, hash(key), hash("ADTQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"))
+
+	// both the key and its short form are replaced the same way
+	for mode, expected := range map[string][2]string{
+		"":       {ShortKey(key), key},
+		"redact": {"ADTQ***", "ADTQ***"},
+		"hash":   {hash(key), hash(key)},
+	} {
+		recorder := &recordingLogger{}
+		server := NewAccountServer()
+		server.config = conf.DefaultServerConfig()
+		server.config.Logging.Custom = recorder
+		server.config.Logging.ObfuscateKeys = mode
+		logger := server.ConfigureLogger()
+		logger.Noticef("updated JWT for account - %s - %s", ShortKey(key), "jti")
+		logger.Errorf("error saving %s - NATS_ACCOUNT_SERVER", key)
+		require.Equal(t, fmt.Sprintf("updated JWT for account - %s - jti\nerror saving %s - NATS_ACCOUNT_SERVER", expected[0], expected[1]),
+			recorder.output(), mode)
+	}
+
+	config := conf.DefaultServerConfig()
+	config.Logging.ObfuscateKeys = "rot13"
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+)
+
+const configOverrideRequest = "$SYS.REQ.ACCOUNT_SERVER.CONFIG"
+
+const (
+	logInfo int32 = iota
+	logDebug
+	logTrace
+)
+
+var logLevels = map[string]int32{"info": logInfo, "debug": logDebug, "trace": logTrace}
+
+// configOverrides are the settings that can be changed on running servers, unset fields are left alone
+type configOverrides struct {
+	LogLevel     string   `json:"log_level,omitempty"`     // info, debug or trace
+	WriteRate    *int     `json:"write_rate,omitempty"`    // account JWT posts per second, 0 is unlimited
+	SyncInterval *int     `json:"sync_interval,omitempty"` // milliseconds between pack requests
+	LameDuck     *bool    `json:"lame_duck,omitempty"`     // report not ready, so the server can be drained
+	Servers      []string `json:"servers,omitempty"`       // names or ids of the servers to change, all if empty
+}
+
+func (o *configOverrides) validate() error {
+	if _, ok := logLevels[o.LogLevel]; o.LogLevel != "" && !ok {
+		return fmt.Errorf("unknown log level %q, use info, debug or trace", o.LogLevel)
+	}
+	if o.WriteRate != nil && *o.WriteRate < 0 {
+		return errors.New("write rate can't be negative")
+	}
+	if o.SyncInterval != nil && *o.SyncInterval <= 0 {
+		return errors.New("sync interval must be positive")
+	}
+	return nil
+}
+
+func (o *configOverrides) targets(name string, id string) bool {
+	if len(o.Servers) == 0 {
+		return true
+	}
+	for _, s := range o.Servers {
+		if s == id || (name != "" && s == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// levelLogger drops debug and trace lines above the current level, the wrapped logger has to log
+// both for the level to be raised at runtime
+type levelLogger struct {
+	natsserver.Logger
+	level int32
+}
+
+func newLevelLogger(logger natsserver.Logger, debug bool, trace bool) *levelLogger {
+	l := &levelLogger{Logger: logger}
+	if trace {
+		l.level = logTrace
+	} else if debug {
+		l.level = logDebug
+	}
+	return l
+}
+
+func (l *levelLogger) setLevel(level int32) {
+	atomic.StoreInt32(&l.level, level)
+}
+
+func (l *levelLogger) Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&l.level) >= logDebug {
+		l.Logger.Debugf(format, v...)
+	}
+}
+
+func (l *levelLogger) Tracef(format string, v ...interface{}) {
+	if atomic.LoadInt32(&l.level) >= logTrace {
+		l.Logger.Tracef(format, v...)
+	}
+}
+
+// writeLimiter is a token bucket shared by all account JWT posts, holding up to a second of posts
+type writeLimiter struct {
+	sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+func newWriteLimiter(rate int) *writeLimiter {
+	return &writeLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (l *writeLimiter) setRate(rate int) {
+	l.Lock()
+	defer l.Unlock()
+	l.rate = rate
+	l.tokens = float64(rate)
+	l.last = time.Now()
+}
+
+// allow takes a token, a nil limiter or a rate of 0 allows everything
+func (l *writeLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// handleConfigOverride accepts a generic JWT, signed by the operator or one of its signing keys, whose
+// data holds the settings to change. Only overrides issued after the last applied one are accepted.
+func (server *AccountServer) handleConfigOverride(msg *nats.Msg) {
+	respond := func(failure string, err error) {
+		if msg.Reply == "" {
+			return
+		}
+		resp := map[string]interface{}{"server": server.serverName(), "id": server.id, "applied": err == nil}
+		if err != nil {
+			resp["error"] = fmt.Sprintf("%s - %v", failure, err)
+		}
+		if data, err := json.Marshal(resp); err == nil {
+			msg.Respond(data)
+		}
+	}
+	claim, err := jwt.DecodeGeneric(string(msg.Data))
+	if err != nil {
+		respond("bad override", err)
+		return
+	}
+	if _, ok := server.jwt.trustedKeys[claim.Issuer]; !ok {
+		respond("bad override", errors.New("override is not signed by the operator"))
+		return
+	}
+	vr := &jwt.ValidationResults{}
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		respond("bad override", errors.New("override failed validation"))
+		return
+	}
+	// type and version are filled in by the jwt library
+	settings := map[string]interface{}{}
+	for k, v := range claim.Data {
+		if k != "type" && k != "version" {
+			settings[k] = v
+		}
+	}
+	overrides := &configOverrides{}
+	data, err := json.Marshal(settings)
+	if err == nil {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(overrides)
+	}
+	if err == nil {
+		err = overrides.validate()
+	}
+	if err != nil {
+		respond("bad override", err)
+		return
+	}
+	if !overrides.targets(server.serverName(), server.id) {
+		return
+	}
+	if err := server.applyOverrides(claim.ID, claim.IssuedAt, overrides); err != nil {
+		server.logger.Errorf("config override %s refused - %v", claim.ID, err)
+		respond("override refused", err)
+		return
+	}
+	server.logger.Noticef("applied config override %s issued by %s", claim.ID, ShortKey(claim.Issuer))
+	respond("", nil)
+}
+
+// overrideStats describes the settings changed by overrides, reported in /varz
+type overrideStats struct {
+	ID           string    `json:"id"` // of the last override applied
+	IssuedAt     time.Time `json:"issued_at"`
+	LogLevel     string    `json:"log_level,omitempty"`
+	WriteRate    *int      `json:"write_rate,omitempty"`
+	SyncInterval *int      `json:"sync_interval,omitempty"`
+	LameDuck     bool      `json:"lame_duck"`
+}
+
+// overrideMark identifies the last override applied, only strictly newer ones are accepted
+type overrideMark struct {
+	ID       string `json:"id"`
+	IssuedAt int64  `json:"iat"`
+}
+
+// loadOverrideMark reads the last applied override from the file, a missing file has none
+func loadOverrideMark(path string) (overrideMark, error) {
+	mark := overrideMark{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return mark, nil
+	} else if err != nil {
+		return mark, err
+	}
+	err = json.Unmarshal(data, &mark)
+	return mark, err
+}
+
+// saveOverrideMark writes the last applied override to the file
+func saveOverrideMark(path string, mark overrideMark) error {
+	data, err := json.Marshal(mark)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (server *AccountServer) applyOverrides(id string, issuedAt int64, o *configOverrides) error {
+	server.Lock()
+	defer server.Unlock()
+	// the jti of generic claims doesn't cover the data, so overrides are ordered by issue time alone
+	if issuedAt <= server.lastOverride.IssuedAt {
+		return fmt.Errorf("not issued after the last override applied, %s", server.lastOverride.ID)
+	}
+	if o.LogLevel != "" && server.levels == nil {
+		return errors.New("log level can't be changed, the logger was not configured by the server")
+	}
+	// the override is recorded before it is applied, so it can't be replayed once the server restarts
+	mark := overrideMark{ID: id, IssuedAt: issuedAt}
+	if server.config.OverridesFile != "" {
+		if err := saveOverrideMark(server.config.OverridesFile, mark); err != nil {
+			return fmt.Errorf("error saving the overrides file: %v", err)
+		}
+	}
+	server.lastOverride = mark
+	applied := overrideStats{}
+	if server.overrides != nil {
+		applied = *server.overrides
+	}
+	if o.LogLevel != "" {
+		server.levels.setLevel(logLevels[o.LogLevel])
+		applied.LogLevel = o.LogLevel
+	}
+	if o.WriteRate != nil {
+		server.jwt.writes.setRate(*o.WriteRate)
+		applied.WriteRate = o.WriteRate
+	}
+	if o.SyncInterval != nil {
+		server.syncInterval = time.Duration(*o.SyncInterval) * time.Millisecond
+		if server.syncTimer != nil {
+			server.syncTimer.Reset(server.syncPeriod())
+		}
+		applied.SyncInterval = o.SyncInterval
+	}
+	if o.LameDuck != nil {
+		server.lameDuck = *o.LameDuck
+		applied.LameDuck = *o.LameDuck
+	}
+	applied.ID = id
+	applied.IssuedAt = time.Unix(issuedAt, 0).UTC()
+	server.overrides = &applied
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigOverrides(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.AcceptOverrides = true
+	config.ServerName = "as-1"
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	testEnv.Server.logger = testEnv.Server.ConfigureLogger()
+
+	var last string
+	send := func(token string) (map[string]interface{}, error) {
+		msg, err := testEnv.NC.Request(configOverrideRequest, []byte(token), 500*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		resp := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(msg.Data, &resp))
+		return resp, nil
+	}
+	override := func(signer nkeys.KeyPair, data map[string]interface{}) (map[string]interface{}, error) {
+		claim := jwt.NewGenericClaims(testEnv.OperatorPubKey)
+		claim.Data = data
+		token, err := claim.Encode(signer)
+		require.NoError(t, err)
+		last = token
+		return send(token)
+	}
+	readyz := func() int {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/readyz"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	otherKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	resp, err := override(otherKey, map[string]interface{}{"lame_duck": true})
+	require.NoError(t, err)
+	require.Equal(t, false, resp["applied"])
+	resp, err = override(testEnv.OperatorKey, map[string]interface{}{"lame_ducks": true})
+	require.NoError(t, err)
+	require.Equal(t, false, resp["applied"])
+	require.Contains(t, resp["error"], "lame_ducks")
+	resp, err = override(testEnv.OperatorKey, map[string]interface{}{"log_level": "loud"})
+	require.NoError(t, err)
+	require.Equal(t, false, resp["applied"])
+	require.Equal(t, http.StatusOK, readyz())
+
+	// overrides for other servers are ignored
+	_, err = override(testEnv.OperatorKey, map[string]interface{}{"lame_duck": true, "servers": []string{"as-2"}})
+	require.Error(t, err)
+
+	resp, err = override(testEnv.OperatorKey, map[string]interface{}{
+		"log_level":     "trace",
+		"write_rate":    1,
+		"sync_interval": 500,
+		"lame_duck":     true,
+		"servers":       []string{"as-1"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, true, resp["applied"], resp["error"])
+	require.Equal(t, "as-1", resp["server"])
+	require.Equal(t, logTrace, testEnv.Server.levels.level)
+	require.Equal(t, http.StatusServiceUnavailable, readyz())
+
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(acctJWT)))
+	require.Equal(t, http.StatusTooManyRequests, postJWT(t, testEnv, pubKey, []byte(acctJWT)))
+
+	v := getVarz(t, testEnv)
+	require.NotNil(t, v.Overrides)
+	require.Equal(t, "trace", v.Overrides.LogLevel)
+	require.Equal(t, 500, *v.Overrides.SyncInterval)
+	require.True(t, v.Overrides.LameDuck)
+
+	// an override has to be issued after the last one applied
+	resp, err = send(last)
+	require.NoError(t, err)
+	require.Equal(t, false, resp["applied"])
+	resp, err = override(testEnv.OperatorKey, map[string]interface{}{"lame_duck": false, "write_rate": 0})
+	require.NoError(t, err)
+	require.Equal(t, false, resp["applied"])
+	time.Sleep(1100 * time.Millisecond) // issued at has a resolution of seconds
+	resp, err = override(testEnv.OperatorKey, map[string]interface{}{"lame_duck": false, "write_rate": 0})
+	require.NoError(t, err)
+	require.Equal(t, true, resp["applied"], resp["error"])
+	require.Equal(t, http.StatusOK, readyz())
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(acctJWT)))
+	require.Equal(t, logTrace, testEnv.Server.levels.level)
+}
+
+func TestConfigOverridesFile(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.AcceptOverrides = true
+	config.OverridesFile = filepath.Join(t.TempDir(), "overrides.json")
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	lameDuck := true
+	issuedAt := time.Now().Unix()
+	require.NoError(t, testEnv.Server.applyOverrides("first", issuedAt, &configOverrides{LameDuck: &lameDuck}))
+	require.Error(t, testEnv.Server.applyOverrides("again", issuedAt, &configOverrides{LameDuck: &lameDuck}))
+
+	// the override can't be replayed once the server restarts
+	testEnv.Server.Stop()
+	require.NoError(t, testEnv.Server.Start())
+	require.Equal(t, "first", testEnv.Server.lastOverride.ID)
+	require.Error(t, testEnv.Server.applyOverrides("first", issuedAt, &configOverrides{LameDuck: &lameDuck}))
+	require.NoError(t, testEnv.Server.applyOverrides("second", issuedAt+1, &configOverrides{LameDuck: &lameDuck}))
+}
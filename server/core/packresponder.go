@@ -0,0 +1,158 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+)
+
+// maxPackSources limits the requesters that get their own metric label, later ones are counted as other
+const maxPackSources = 100
+
+// packGuard limits the pack requests answered and the size of the responses. Requesters pick their reply
+// inbox, so it only tells them apart in the metrics, the limit counts the requests of all of them.
+type packGuard struct {
+	sync.Mutex
+	config  conf.PackResponderConfig
+	window  time.Time // start of the current minute
+	count   int       // requests in the current minute
+	sources map[string]bool
+	metrics *metrics
+}
+
+func newPackGuard(config conf.PackResponderConfig, m *metrics) (*packGuard, error) {
+	if config.RequestsPerMinute < 0 || config.MaxBytes < 0 || config.MaxChunks < 0 || config.Timeout < 0 {
+		return nil, errors.New("pack responder limits can't be negative")
+	}
+	m.describe("pack_requests_total", "counter", "Number of pack requests by requester and result, matched, sent, truncated, limited or error")
+	m.describe("pack_response_bytes_total", "counter", "Bytes sent in response to pack requests by requester")
+	return &packGuard{config: config, sources: map[string]bool{}, metrics: m}, nil
+}
+
+// packSource returns the requester of a pack request
+func packSource(reply string) string {
+	if tokens := strings.Split(reply, "."); len(tokens) > 2 {
+		return strings.Join(tokens[:len(tokens)-1], ".")
+	}
+	return reply
+}
+
+// label returns the metric label of the requester
+func (g *packGuard) label(source string) string {
+	g.Lock()
+	defer g.Unlock()
+	if !g.sources[source] && len(g.sources) >= maxPackSources {
+		return "other"
+	}
+	g.sources[source] = true
+	return source
+}
+
+// allow counts the request, false if too many were made this minute
+func (g *packGuard) allow(now time.Time) bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.config.RequestsPerMinute == 0 {
+		return true
+	}
+	if now.Sub(g.window) >= time.Minute {
+		g.window = now
+		g.count = 0
+	}
+	if g.count >= g.config.RequestsPerMinute {
+		return false
+	}
+	g.count++
+	return true
+}
+
+// respondPack answers a pack request with the JWTs the requester is missing, one message per JWT and an
+// empty message at the end. If the request holds the hashes of the requester's shards, only the JWTs of
+// the shards that differ are sent. The walk can't be stopped, once the server stops or a limit is reached the
+// rest of it is skipped and the empty message isn't sent, so the requester doesn't take it for the whole pack.
+func (server *AccountServer) respondPack(ctx context.Context, jwtStore syncableStore, m *nats.Msg) {
+	g := server.packs
+	source := packSource(m.Reply)
+	label := g.label(source)
+	start := time.Now()
+	if !g.allow(start) {
+		// let them timeout
+		g.metrics.inc("pack_requests_total", "source", label, "result", "limited")
+		server.logger.Warnf("pack request from %s dropped, more than %d requests this minute", source, g.config.RequestsPerMinute)
+		return
+	}
+	ourHash := jwtStore.Hash()
+	if bytes.Equal(m.Data, ourHash[:]) {
+		m.Respond(nil)
+		g.metrics.inc("pack_requests_total", "source", label, "result", "matched")
+		server.logger.Debugf("pack request matches")
+		return
+	}
+	shards := server.packFilter(jwtStore, ourHash, m)
+	var deadline time.Time
+	if g.config.Timeout > 0 {
+		deadline = start.Add(time.Duration(g.config.Timeout) * time.Millisecond)
+	}
+	sent, chunks := 0, 0
+	truncated := ""
+	err := jwtStore.PackWalk(1, func(partialPackMsg string) {
+		if ctx.Err() != nil || truncated != "" {
+			return
+		}
+		if key, _, _ := strings.Cut(partialPackMsg, "|"); shards != nil && !shards[packShard(key)] {
+			return
+		}
+		switch {
+		case g.config.MaxChunks > 0 && chunks >= g.config.MaxChunks:
+			truncated = "max_chunks"
+		case g.config.MaxBytes > 0 && sent+len(partialPackMsg) > g.config.MaxBytes:
+			truncated = "max_bytes"
+		case !deadline.IsZero() && time.Now().After(deadline):
+			truncated = "timeout"
+		default:
+			m.Respond([]byte(partialPackMsg))
+			sent += len(partialPackMsg)
+			chunks++
+		}
+	})
+	g.metrics.add("pack_response_bytes_total", float64(sent), "source", label)
+	if err != nil {
+		// let them timeout
+		g.metrics.inc("pack_requests_total", "source", label, "result", "error")
+		server.logger.Errorf("pack request error: %v", err)
+		return
+	} else if ctx.Err() != nil {
+		server.logger.Debugf("pack request interrupted by shutdown")
+		return
+	}
+	if truncated != "" {
+		// without the end of the stream the requester doesn't count the sync as complete
+		g.metrics.inc("pack_requests_total", "source", label, "result", "truncated")
+		server.logger.Warnf("pack response to %s cut short by %s after %d messages and %d bytes", source, truncated, chunks, sent)
+		return
+	}
+	g.metrics.inc("pack_requests_total", "source", label, "result", "sent")
+	server.logger.Debugf("pack request from %s - finished responding with %d messages", source, chunks)
+	m.Respond(nil)
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// packShardsHeader carries the hashes of the shards of the requester's store with a pack request, the
+// responder only sends the JWTs of the shards that differ. The nats-server resolvers don't send it and
+// ignore it, they exchange the whole store as before.
+const packShardsHeader = "Account-Server-Pack-Shards"
+
+// packShardKeys are the last characters of public keys, each shard holds the keys ending in one of them
+// and a last shard holds any other key
+const packShardKeys = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// shardHashes are the hashes of the JWTs in each shard, every JWT hash xor-ed in like the store hash
+type shardHashes [len(packShardKeys) + 1][sha256.Size]byte
+
+// packShard returns the shard of a key
+func packShard(key string) int {
+	if key != "" {
+		if i := strings.IndexByte(packShardKeys, key[len(key)-1]); i >= 0 {
+			return i
+		}
+	}
+	return len(packShardKeys)
+}
+
+// add hashes the JWTs of a pack message, key|jwt lines, into their shards
+func (s *shardHashes) add(partialPackMsg string) {
+	for _, line := range strings.Split(partialPackMsg, "\n") {
+		split := strings.SplitN(line, "|", 2)
+		if len(split) != 2 {
+			continue
+		}
+		hash := sha256.Sum256([]byte(split[1]))
+		shard := &s[packShard(split[0])]
+		for i := range shard {
+			shard[i] ^= hash[i]
+		}
+	}
+}
+
+// encode returns the hashes in hex, separated by commas
+func (s *shardHashes) encode() string {
+	hashes := make([]string, len(s))
+	for i := range s {
+		hashes[i] = hex.EncodeToString(s[i][:])
+	}
+	return strings.Join(hashes, ",")
+}
+
+func decodeShardHashes(header string) (*shardHashes, error) {
+	s := &shardHashes{}
+	hashes := strings.Split(header, ",")
+	if len(hashes) != len(s) {
+		return nil, fmt.Errorf("expected %d shard hashes, got %d", len(s), len(hashes))
+	}
+	for i, h := range hashes {
+		if n, err := hex.Decode(s[i][:], []byte(h)); err != nil || n != sha256.Size {
+			return nil, fmt.Errorf("bad hash of shard %d", i)
+		}
+	}
+	return s, nil
+}
+
+// differ returns the shards whose hashes are not the same and their number
+func (s *shardHashes) differ(other *shardHashes) ([len(packShardKeys) + 1]bool, int) {
+	var differ [len(packShardKeys) + 1]bool
+	count := 0
+	for i := range s {
+		if s[i] != other[i] {
+			differ[i] = true
+			count++
+		}
+	}
+	return differ, count
+}
+
+// shardHashCache keeps the shard hashes of the store along with the store hash they were taken at, the
+// store is only walked again once its hash changes
+type shardHashCache struct {
+	sync.Mutex
+	storeHash [sha256.Size]byte
+	hashes    *shardHashes
+}
+
+// get returns the shard hashes of the store at storeHash, taken before the call
+func (c *shardHashCache) get(jwtStore syncableStore, storeHash [sha256.Size]byte) (*shardHashes, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.hashes != nil && c.storeHash == storeHash {
+		return c.hashes, nil
+	}
+	hashes := &shardHashes{}
+	if err := jwtStore.PackWalk(1, hashes.add); err != nil {
+		return nil, err
+	}
+	// a change made during the walk changes the store hash, so it isn't hidden behind the cache
+	c.storeHash, c.hashes = storeHash, hashes
+	return hashes, nil
+}
+
+// packRequest returns the pack request of the sync, with the store hash and, if the connection supports
+// headers, the hashes of the shards
+func (server *AccountServer) packRequest(nc *nats.Conn, jwtStore syncableStore, storeHash [sha256.Size]byte, reply string) *nats.Msg {
+	msg := &nats.Msg{Subject: server.subjects.pack, Reply: reply, Data: storeHash[:]}
+	if !nc.HeadersSupported() {
+		return msg
+	}
+	hashes, err := server.packShards.get(jwtStore, storeHash)
+	if err != nil {
+		server.logger.Warnf("requesting the whole store, error hashing its shards: %v", err)
+		return msg
+	}
+	msg.Header = nats.Header{}
+	msg.Header.Set(packShardsHeader, hashes.encode())
+	return msg
+}
+
+// packFilter returns the shards to answer a pack request with, nil for all of them
+func (server *AccountServer) packFilter(jwtStore syncableStore, storeHash [sha256.Size]byte, m *nats.Msg) *[len(packShardKeys) + 1]bool {
+	header := m.Header.Get(packShardsHeader)
+	if header == "" {
+		return nil
+	}
+	theirs, err := decodeShardHashes(header)
+	if err != nil {
+		server.logger.Warnf("answering with the whole store, bad %s header: %v", packShardsHeader, err)
+		return nil
+	}
+	ours, err := server.packShards.get(jwtStore, storeHash)
+	if err != nil {
+		server.logger.Errorf("answering with the whole store, error hashing its shards: %v", err)
+		return nil
+	}
+	differ, count := ours.differ(theirs)
+	server.logger.Debugf("pack request - %d of %d shards differ", count, len(differ))
+	return &differ
+}
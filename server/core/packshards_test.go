@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardHashes(t *testing.T) {
+	require.Equal(t, 0, packShard("AAA"))
+	require.Equal(t, len(packShardKeys)-1, packShard("AA7"))
+	require.Equal(t, len(packShardKeys), packShard("aa"))
+	require.Equal(t, len(packShardKeys), packShard(""))
+
+	a, b := &shardHashes{}, &shardHashes{}
+	a.add("KEYA|one\nKEYB|two")
+	b.add("KEYB|two")
+	differ, count := a.differ(b)
+	require.Equal(t, 1, count)
+	require.True(t, differ[packShard("KEYA")])
+
+	// the hashes of a shard don't depend on the order of its JWTs
+	b.add("KEYA|one")
+	_, count = a.differ(b)
+	require.Zero(t, count)
+
+	decoded, err := decodeShardHashes(a.encode())
+	require.NoError(t, err)
+	require.Equal(t, a, decoded)
+	_, err = decodeShardHashes("00,11")
+	require.Error(t, err)
+	_, err = decodeShardHashes(strings.Repeat("zz,", len(packShardKeys)) + "zz")
+	require.Error(t, err)
+}
+
+func TestPackShards(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// accounts in different shards
+	jwts := map[string]string{}
+	for len(jwts) < 3 {
+		pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+		shardTaken := false
+		for key := range jwts {
+			shardTaken = shardTaken || packShard(key) == packShard(pubKey)
+		}
+		if !shardTaken {
+			require.NoError(t, testEnv.Server.JWTStore.SaveAcc(pubKey, theJWT))
+			jwts[pubKey] = theJWT
+		}
+	}
+	jwtStore := testEnv.Server.JWTStore.(syncableStore)
+	hashes, err := testEnv.Server.packShards.get(jwtStore, jwtStore.Hash())
+	require.NoError(t, err)
+
+	// the requester holds all but one of the accounts
+	theirs := &shardHashes{}
+	var missing string
+	for pubKey, theJWT := range jwts {
+		if missing == "" {
+			missing = pubKey
+			continue
+		}
+		theirs.add(pubKey + "|" + theJWT)
+	}
+	request := func(header string) []string {
+		ib := testEnv.NC.NewRespInbox()
+		sub, err := testEnv.NC.SubscribeSync(ib)
+		require.NoError(t, err)
+		defer sub.Unsubscribe()
+		msg := nats.NewMsg(accountPackRequest)
+		msg.Reply = ib
+		msg.Data = []byte("a different store")
+		if header != "" {
+			msg.Header.Set(packShardsHeader, header)
+		}
+		require.NoError(t, testEnv.NC.PublishMsg(msg))
+		var keys []string
+		for {
+			m, err := sub.NextMsg(time.Second)
+			require.NoError(t, err)
+			if len(m.Data) == 0 {
+				return keys
+			}
+			keys = append(keys, strings.SplitN(string(m.Data), "|", 2)[0])
+		}
+	}
+	require.Equal(t, []string{missing}, request(theirs.encode()))
+	require.Empty(t, request(hashes.encode()))
+	// without the header, or with a bad one, the whole store is sent
+	require.Len(t, request(""), 3)
+	require.Len(t, request("bad"), 3)
+
+	// the cached hashes are replaced once the store changes
+	pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(pubKey, theJWT))
+	changed, err := testEnv.Server.packShards.get(jwtStore, jwtStore.Hash())
+	require.NoError(t, err)
+	_, count := changed.differ(hashes)
+	require.Equal(t, 1, count)
+
+	// the sync requests carry the shard hashes
+	msg := testEnv.Server.packRequest(testEnv.NC, jwtStore, jwtStore.Hash(), "reply")
+	require.Equal(t, changed.encode(), msg.Header.Get(packShardsHeader))
+}
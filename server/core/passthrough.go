@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// passThroughStore keeps nothing on disk, accounts are looked up over NATS and cached in memory
+// for a while, saved JWTs only go to the cache and are announced by the caller
+type passThroughStore struct {
+	sync.Mutex
+	lookup func(publicKey string) (string, error)
+	ttl    time.Duration
+	cache  map[string]cachedJWT
+}
+
+type cachedJWT struct {
+	jwt     string
+	expires time.Time
+}
+
+func newPassThroughStore(lookup func(publicKey string) (string, error), ttl time.Duration) *passThroughStore {
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return &passThroughStore{
+		lookup: lookup,
+		ttl:    ttl,
+		cache:  map[string]cachedJWT{},
+	}
+}
+
+// lookupAcc returns the cached JWT or asks NATS for it, reporting which one answered
+func (ps *passThroughStore) lookupAcc(publicKey string) (string, string, error) {
+	ps.Lock()
+	c, ok := ps.cache[publicKey]
+	if ok && time.Now().After(c.expires) {
+		delete(ps.cache, publicKey)
+		ok = false
+	}
+	ps.Unlock()
+	if ok {
+		return c.jwt, lookupCache, nil
+	}
+	theJWT, err := ps.lookup(publicKey)
+	if err != nil || theJWT == "" {
+		return "", "", err
+	}
+	ps.SaveAcc(publicKey, theJWT)
+	return theJWT, lookupNATS, nil
+}
+
+func (ps *passThroughStore) LoadAcc(publicKey string) (string, error) {
+	theJWT, _, err := ps.lookupAcc(publicKey)
+	return theJWT, err
+}
+
+func (ps *passThroughStore) SaveAcc(publicKey string, theJWT string) error {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.cache[publicKey] = cachedJWT{jwt: theJWT, expires: time.Now().Add(ps.ttl)}
+	return nil
+}
+
+func (ps *passThroughStore) size() int {
+	ps.Lock()
+	defer ps.Unlock()
+	return len(ps.cache)
+}
+
+func (ps *passThroughStore) IsReadOnly() bool {
+	return false
+}
+
+func (ps *passThroughStore) Close() {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.cache = map[string]cachedJWT{}
+}
+
+// DeleteAcc only drops the cached JWT, the resolvers remove the account when they get the delete notification
+func (ps *passThroughStore) DeleteAcc(publicKey string) error {
+	ps.Lock()
+	defer ps.Unlock()
+	delete(ps.cache, publicKey)
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassThroughStore(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store.Type = conf.StoreNone
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	_, ok := testEnv.Server.JWTStore.(*passThroughStore)
+	require.True(t, ok)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	// a resolver answering lookups
+	var lookups int32
+	_, err = testEnv.NC.Subscribe(fmt.Sprintf(accountLookupRequest, pubKey), func(m *nats.Msg) {
+		atomic.AddInt32(&lookups, 1)
+		m.Respond([]byte(acctJWT))
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	get := func() (int, string, string) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get(accountSourceHeader), string(body)
+	}
+	status, source, body := get()
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, lookupNATS, source)
+	require.Equal(t, acctJWT, body)
+
+	status, source, _ = get()
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, lookupCache, source)
+	require.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+
+	// posts are announced
+	updates, err := testEnv.NC.SubscribeSync(fmt.Sprintf(accountNotificationFormat, pubKey))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+	claims := jwt.NewAccountClaims(pubKey)
+	claims.Name = "updated"
+	updated, err := claims.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey)), "application/json", bytes.NewBufferString(updated))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	msg, err := updates.NextMsg(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, updated, string(msg.Data))
+
+	// there is nothing to pack
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	status, varz := adminRequest(t, testEnv, http.MethodGet, "/varz", testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, strings.Contains(varz, `"type": "none"`), varz)
+}
+
+func TestPassThroughStoreRequiresNATS(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store.Type = conf.StoreNone
+	config.Logging.Custom = NewNilLogger()
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	err := server.Start()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "requires NATS")
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// accountPolicy checks pushed account claims against the limits of the operator
+type accountPolicy struct {
+	conf.AccountPolicyConfig
+	exportTypes map[string]bool // nil if every type is allowed
+}
+
+// newAccountPolicy returns nil if no limit is configured
+func newAccountPolicy(config conf.AccountPolicyConfig) (*accountPolicy, error) {
+	p := &accountPolicy{AccountPolicyConfig: config}
+	for _, max := range []int64{config.MaxConnections, config.MaxLeafNodes, config.MaxSubscriptions,
+		config.MaxPayload, config.MaxData, config.MaxImports, config.MaxExports} {
+		if max < 0 {
+			return nil, errors.New("policy limits can't be negative")
+		}
+	}
+	for _, t := range config.ExportTypes {
+		t = strings.ToLower(t)
+		if t != jwt.Stream.String() && t != jwt.Service.String() {
+			return nil, fmt.Errorf("unknown policy export type %q, use stream or service", t)
+		}
+		if p.exportTypes == nil {
+			p.exportTypes = map[string]bool{}
+		}
+		p.exportTypes[t] = true
+	}
+	if config.MaxConnections == 0 && config.MaxLeafNodes == 0 && config.MaxSubscriptions == 0 &&
+		config.MaxPayload == 0 && config.MaxData == 0 && config.MaxImports == 0 && config.MaxExports == 0 &&
+		p.exportTypes == nil && !config.DenyJetStream && !config.DenyBearer {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// violations lists every way the claims exceed the policy, a nil policy allows everything
+func (p *accountPolicy) violations(claim *jwt.AccountClaims) []string {
+	if p == nil {
+		return nil
+	}
+	var found []string
+	limit := func(name string, value int64, max int64) {
+		switch {
+		case max == 0:
+		case value < 0:
+			found = append(found, fmt.Sprintf("%s is unlimited, the policy allows at most %d", name, max))
+		case value > max:
+			found = append(found, fmt.Sprintf("%s is %d, the policy allows at most %d", name, value, max))
+		}
+	}
+	limits := claim.Limits
+	limit("max connections", limits.Conn, p.MaxConnections)
+	limit("max leafnodes", limits.LeafNodeConn, p.MaxLeafNodes)
+	limit("max subscriptions", limits.Subs, p.MaxSubscriptions)
+	limit("max payload", limits.Payload, p.MaxPayload)
+	limit("max data", limits.Data, p.MaxData)
+	limit("max imports", limits.Imports, p.MaxImports)
+	limit("max exports", limits.Exports, p.MaxExports)
+	if p.exportTypes != nil {
+		for _, e := range claim.Exports {
+			if !p.exportTypes[e.Type.String()] {
+				found = append(found, fmt.Sprintf("export %q is a %s, the policy doesn't allow them", e.Subject, e.Type))
+			}
+		}
+	}
+	if p.DenyJetStream && limits.IsJSEnabled() {
+		found = append(found, "JetStream is enabled, the policy denies it")
+	}
+	if p.DenyBearer && !limits.DisallowBearer {
+		found = append(found, "bearer user JWTs are allowed, the policy requires disallow_bearer")
+	}
+	return found
+}
+
+// policyViolations checks the claims against the policy, the system account is exempt
+func (h *JwtHandler) policyViolations(claim *jwt.AccountClaims) []string {
+	if h.isSystemAccount(claim.Subject) {
+		return nil
+	}
+	return h.policy.violations(claim)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBadPolicy(t *testing.T) {
+	_, err := newAccountPolicy(conf.AccountPolicyConfig{MaxConnections: -1})
+	require.Error(t, err)
+	_, err = newAccountPolicy(conf.AccountPolicyConfig{ExportTypes: []string{"queue"}})
+	require.Error(t, err)
+	p, err := newAccountPolicy(conf.AccountPolicyConfig{})
+	require.NoError(t, err)
+	require.Nil(t, p)
+	require.Empty(t, p.violations(jwt.NewAccountClaims("A")))
+}
+
+func TestPolicyViolations(t *testing.T) {
+	p, err := newAccountPolicy(conf.AccountPolicyConfig{
+		MaxConnections: 10,
+		MaxLeafNodes:   2,
+		ExportTypes:    []string{"Stream"},
+		DenyJetStream:  true,
+	})
+	require.NoError(t, err)
+
+	claim := jwt.NewAccountClaims("A")
+	claim.Limits.Conn = 5
+	claim.Limits.LeafNodeConn = 0
+	require.Empty(t, p.violations(claim))
+
+	claim.Limits.Conn = -1
+	claim.Limits.LeafNodeConn = 3
+	claim.Limits.JetStreamLimits.DiskStorage = 1024
+	claim.Exports.Add(&jwt.Export{Subject: "svc", Type: jwt.Service})
+	require.Equal(t, []string{
+		"max connections is unlimited, the policy allows at most 10",
+		"max leafnodes is 3, the policy allows at most 2",
+		`export "svc" is a service, the policy doesn't allow them`,
+		"JetStream is enabled, the policy denies it",
+	}, p.violations(claim))
+}
+
+func TestPolicyOnPost(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Policy = conf.AccountPolicyConfig{MaxConnections: 10, DenyBearer: true}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Contains(t, string(body), "max connections is unlimited, the policy allows at most 10")
+	require.Contains(t, string(body), "bearer user JWTs are allowed")
+
+	account.Limits.Conn = 10
+	account.Limits.DisallowBearer = true
+	acctJWT, err = account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the system account is exempt
+	testEnv.Server.jwt.sysAccSubject = pubKey
+	account.Limits.Conn = -1
+	acctJWT, err = account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
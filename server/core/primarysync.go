@@ -0,0 +1,316 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// backoff between attempts to get the initial pack from a busy primary
+const (
+	primaryRetryMin = 250 * time.Millisecond
+	primaryRetryMax = 30 * time.Second
+)
+
+// primaryCandidate is one place to ask for the pack. When the host name of a primary is resolved, addr
+// is the address connected to while the URL, and so the Host header and TLS, keep the host name.
+type primaryCandidate struct {
+	url    string
+	addr   string
+	client *http.Client
+}
+
+// primaries returns Primary followed by the other configured primaries, in the order they are tried
+func (server *AccountServer) primaries() []string {
+	var primaries []string
+	for _, p := range append([]string{server.config.Primary}, server.config.Primaries...) {
+		if p = strings.TrimSuffix(strings.TrimSpace(p), "/"); p != "" {
+			primaries = append(primaries, p)
+		}
+	}
+	return primaries
+}
+
+// primaryCandidates returns a candidate for path on every primary, or on every address of every
+// primary with ResolvePrimaries. A host name that doesn't resolve is left to the HTTP client.
+func (server *AccountServer) primaryCandidates(ctx context.Context, path string) []primaryCandidate {
+	timeout := time.Duration(server.config.ReplicationTimeout) * time.Millisecond
+	var candidates []primaryCandidate
+	for _, primary := range server.primaries() {
+		addrs := []string{""}
+		if server.config.ResolvePrimaries {
+			if resolved, err := resolvePrimary(ctx, primary); err != nil {
+				server.logger.Debugf("unable to resolve primary %s, %v", primary, err)
+			} else {
+				addrs = resolved
+			}
+		}
+		for _, addr := range addrs {
+			transport := &http.Transport{
+				MaxIdleConnsPerHost: 1,
+			}
+			if addr != "" {
+				dialer := &net.Dialer{}
+				dialAddr := addr
+				transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, dialAddr)
+				}
+			}
+			candidates = append(candidates, primaryCandidate{
+				url:    primary + path,
+				addr:   addr,
+				client: &http.Client{Transport: transport, Timeout: timeout},
+			})
+		}
+	}
+	return candidates
+}
+
+// resolvePrimary returns host:port for every address the host name of the primary resolves to, an
+// IP address is dialed as is
+func resolvePrimary(ctx context.Context, primary string) ([]string, error) {
+	u, err := url.Parse(primary)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("no host in %q", primary)
+	}
+	if net.ParseIP(host) != nil {
+		return []string{""}, nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs, nil
+}
+
+// fetchFromPrimaries asks each candidate for the pack in turn and returns the first one received.
+// Retry is true if any candidate may succeed later, wait is the shortest delay one of them asked for.
+func (server *AccountServer) fetchFromPrimaries(ctx context.Context, candidates []primaryCandidate) (pack string, retry bool, wait time.Duration, err error) {
+	if len(candidates) == 0 {
+		return "", false, 0, fmt.Errorf("no primary configured")
+	}
+	for _, c := range candidates {
+		body, again, next, ferr := server.fetchPrimaryPack(ctx, c.client, c.url)
+		c.client.CloseIdleConnections()
+		if ferr == nil {
+			return body, false, 0, nil
+		} else if ctx.Err() != nil {
+			return "", false, 0, ferr
+		}
+		where := c.url
+		if c.addr != "" {
+			where = fmt.Sprintf("%s at %s", c.url, c.addr)
+		}
+		server.logger.Debugf("unable to get the pack from primary %s, %v", where, ferr)
+		err = fmt.Errorf("%s: %v", where, ferr)
+		if again {
+			retry = true
+			if next > 0 && (wait == 0 || next < wait) {
+				wait = next
+			}
+		}
+	}
+	return "", retry, wait, err
+}
+
+// fetchPrimaryPack gets a pack from the primary, retry is true if the primary may succeed later,
+// in which case wait is the delay the primary asked for, if any
+func (server *AccountServer) fetchPrimaryPack(ctx context.Context, client *http.Client, url string) (pack string, retry bool, wait time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", false, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		server.metrics.inc("primary_sync_attempts_total", "result", "error")
+		return "", true, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		// the primary has the JWTs we have
+		server.metrics.inc("primary_sync_attempts_total", "result", "matched")
+		return "", false, 0, nil
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		server.metrics.inc("primary_sync_attempts_total", "result", "busy")
+		return "", true, retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("server returned status %q", resp.Status)
+	default:
+		server.metrics.inc("primary_sync_attempts_total", "result", "error")
+		return "", false, 0, fmt.Errorf("server returned status %q", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		server.metrics.inc("primary_sync_attempts_total", "result", "error")
+		return "", true, 0, err
+	}
+	server.metrics.inc("primary_sync_attempts_total", "result", "ok")
+	return string(body), false, 0, nil
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an http date
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// retryPrimarySync keeps asking the primaries for the initial pack, with exponential backoff or the
+// delay a primary asked for, until it succeeds, the deadline passes or the server stops. Past the
+// deadline it keeps trying every ReplicationRetryInterval if one is set. The server is degraded until
+// the sync succeeds or it settles for what is on disk.
+func (server *AccountServer) retryPrimarySync(ctx context.Context, path string, packer store.PackableJWTStore,
+	wait time.Duration, deadline time.Time) {
+	interval := time.Duration(server.config.ReplicationRetryInterval) * time.Millisecond
+	backoff := primaryRetryMin
+	pastDeadline := false
+	for {
+		if wait < backoff {
+			wait = backoff
+		}
+		if !pastDeadline && time.Now().Add(wait).After(deadline) {
+			if interval <= 0 {
+				server.logger.Errorf("giving up on the initial sync with the primary, will use what is on disk")
+				server.setDegraded("")
+				return
+			}
+			server.logger.Noticef("the initial sync with the primary is past its deadline, will retry every %v", interval)
+			pastDeadline = true
+			backoff = interval
+			if wait < backoff {
+				wait = backoff
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		pack, retry, next, err := server.fetchFromPrimaries(ctx, server.primaryCandidates(ctx, path))
+		if ctx.Err() != nil {
+			return
+		} else if err == nil {
+			err = server.mergePack(ctx, "primary", packer, pack)
+			server.endMergeCycle()
+			if err != nil {
+				server.logger.Errorf("unable to merge the pack from the primary, %v, will use what is on disk", err)
+				server.setDegraded("")
+				return
+			}
+			server.logger.Noticef("initialized from primary")
+			server.setDegraded("")
+			return
+		}
+		if !retry {
+			server.logger.Errorf("unable to initialize from primary, %v, will use what is on disk", err)
+			server.setDegraded("")
+			return
+		}
+		server.logger.Debugf("primary is not available, %v", err)
+		wait = next
+		if pastDeadline {
+			continue
+		}
+		if backoff *= 2; backoff > primaryRetryMax {
+			backoff = primaryRetryMax
+		}
+	}
+}
+
+// setDegraded records why the server isn't ready, an empty reason marks it ready
+func (server *AccountServer) setDegraded(reason string) {
+	server.Lock()
+	defer server.Unlock()
+	server.degraded = reason
+}
+
+func (server *AccountServer) degradedReason() string {
+	server.Lock()
+	defer server.Unlock()
+	return server.degraded
+}
+
+func (server *AccountServer) inLameDuck() bool {
+	server.Lock()
+	defer server.Unlock()
+	return server.lameDuck
+}
+
+// getReadyz handles GET /readyz?deep=true, returning a 503 while the server is degraded. The deep
+// check also verifies the store, the NATS connection and the operator JWT.
+func (server *AccountServer) getReadyz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	var checks map[string]readinessCheck
+	reason := ""
+	if strings.ToLower(r.URL.Query().Get("deep")) == "true" {
+		checks, reason = server.deepReadiness(r.Context())
+	}
+	if reason == "" {
+		reason = server.degradedReason()
+	}
+	if server.inLameDuck() && reason == "" {
+		reason = "lame duck mode"
+	}
+	if reason == "" {
+		reason = server.watchDown()
+	}
+	status := http.StatusOK
+	resp := map[string]interface{}{"ready": reason == ""}
+	if state, ok := server.storeWatch(); ok {
+		resp["store_watch"] = state
+	}
+	if checks != nil {
+		resp["checks"] = checks
+	}
+	if reason != "" {
+		status = http.StatusServiceUnavailable
+		resp["reason"] = reason
+	}
+	server.writeJSON(w, status, resp)
+}
@@ -0,0 +1,362 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryAfter(t *testing.T) {
+	require.Equal(t, time.Duration(0), retryAfter(""))
+	require.Equal(t, time.Duration(0), retryAfter("soon"))
+	require.Equal(t, 3*time.Second, retryAfter("3"))
+	wait := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	require.True(t, wait > 50*time.Second && wait <= time.Minute, wait)
+}
+
+func TestInitializeFromBusyPrimary(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	pubKeys := initAndPostNAccounts(t, testEnv, 5)
+
+	// the primary is busy for the first few requests, held until the test lets it through
+	var calls int32
+	release := make(chan struct{})
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case 2:
+			<-release
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath(r.URL.RequestURI()))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer busy.Close()
+
+	tempDir, err := os.MkdirTemp(os.TempDir(), "prefix")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testEnv.CreateReplicaConfig(tempDir)
+	config.Primary = busy.URL
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	readyz := func() (int, string) {
+		resp, err := testEnv.HTTP.Get(fmt.Sprintf("%s://%s/readyz", replica.protocol, replica.hostPort))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := readyz()
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Contains(t, body, `"ready": false`)
+
+	var out bytes.Buffer
+	replica.metrics.write(&out)
+	require.Contains(t, out.String(), "nats_account_server_degraded 1")
+
+	close(release)
+	require.Eventually(t, func() bool {
+		status, _ := readyz()
+		return status == http.StatusOK
+	}, 10*time.Second, 50*time.Millisecond)
+
+	for pubKey, jwt := range pubKeys {
+		theJWT, err := replica.JWTStore.LoadAcc(pubKey)
+		require.NoError(t, err)
+		require.Equal(t, jwt, theJWT)
+	}
+
+	out.Reset()
+	replica.metrics.write(&out)
+	metrics := out.String()
+	require.Contains(t, metrics, "nats_account_server_degraded 0")
+	require.Contains(t, metrics, `nats_account_server_primary_sync_attempts_total{result="busy"} 2`)
+	require.Contains(t, metrics, `nats_account_server_primary_sync_attempts_total{result="ok"} 1`)
+}
+
+func TestInitializeFromPrimaryGivesUp(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	var calls int32
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+
+	tempDir, err := os.MkdirTemp(os.TempDir(), "prefix")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testEnv.CreateReplicaConfig(tempDir)
+	config.Primary = busy.URL
+	config.ReplicationRetryDeadline = 1000
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	// 250ms, 500ms then the next wait would pass the deadline
+	time.Sleep(1500 * time.Millisecond)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	// the replica settled for what is on disk
+	require.Empty(t, replica.degradedReason())
+}
+
+func TestStopInterruptsPrimarySync(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// the primary never answers, the replication timeout would keep Start waiting for a minute
+	stuck := make(chan struct{})
+	defer close(stuck)
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stuck:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hung.Close()
+
+	tempDir, err := os.MkdirTemp(os.TempDir(), "prefix")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testEnv.CreateReplicaConfig(tempDir)
+	config.Primary = hung.URL
+	config.ReplicationTimeout = 60000
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	started := make(chan error, 1)
+	go func() {
+		started <- replica.Start()
+	}()
+	time.Sleep(250 * time.Millisecond)
+
+	stopped := time.Now()
+	replica.Stop()
+	select {
+	case err := <-started:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Stop")
+	}
+	require.True(t, time.Since(stopped) < 5*time.Second)
+}
+
+func TestInitializeFromSecondPrimary(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	pubKeys := initAndPostNAccounts(t, testEnv, 3)
+
+	// nothing listens on the first primary any more
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tempDir, err := os.MkdirTemp(os.TempDir(), "prefix")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testEnv.CreateReplicaConfig(tempDir)
+	config.Primary = down.URL
+	config.Primaries = []string{testEnv.URLForPath("/")}
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	require.Empty(t, replica.degradedReason())
+	for pubKey, jwt := range pubKeys {
+		theJWT, err := replica.JWTStore.LoadAcc(pubKey)
+		require.NoError(t, err)
+		require.Equal(t, jwt, theJWT)
+	}
+
+	var out bytes.Buffer
+	replica.metrics.write(&out)
+	require.Contains(t, out.String(), `nats_account_server_primary_sync_attempts_total{result="error"} 1`)
+	require.Contains(t, out.String(), `nats_account_server_primary_sync_attempts_total{result="ok"} 1`)
+}
+
+func TestInitializeFromPrimaryFailing(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	config := testEnv.CreateReplicaConfig(t.TempDir())
+	config.Primary = failing.URL
+	config.ReplicationRetryDeadline = 1000
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	// a primary that won't succeed later isn't waited for
+	require.Empty(t, replica.degradedReason())
+}
+
+func TestInitializeFromPrimaryRetryInterval(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	pubKeys := initAndPostNAccounts(t, testEnv, 3)
+
+	// both primaries are down until the second one is brought up, well past the deadline
+	var up int32
+	var calls [2]int32
+	primary := func(i int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls[i], 1)
+			if i == 0 || atomic.LoadInt32(&up) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			resp, err := testEnv.HTTP.Get(testEnv.URLForPath(r.URL.RequestURI()))
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}))
+	}
+	first, second := primary(0), primary(1)
+	defer first.Close()
+	defer second.Close()
+
+	tempDir, err := os.MkdirTemp(os.TempDir(), "prefix")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testEnv.CreateReplicaConfig(tempDir)
+	config.Primary = first.URL
+	config.Primaries = []string{second.URL}
+	config.ReplicationRetryDeadline = 300
+	config.ReplicationRetryInterval = 200
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	time.Sleep(time.Second)
+	require.NotEmpty(t, replica.degradedReason())
+	// every round asks the primaries in order
+	require.InDelta(t, atomic.LoadInt32(&calls[0]), atomic.LoadInt32(&calls[1]), 1)
+	require.True(t, atomic.LoadInt32(&calls[0]) >= 3, atomic.LoadInt32(&calls[0]))
+
+	atomic.StoreInt32(&up, 1)
+	require.Eventually(t, func() bool {
+		return replica.degradedReason() == ""
+	}, 5*time.Second, 50*time.Millisecond)
+	for pubKey, jwt := range pubKeys {
+		theJWT, err := replica.JWTStore.LoadAcc(pubKey)
+		require.NoError(t, err)
+		require.Equal(t, jwt, theJWT)
+	}
+}
+
+func TestPrimaryCandidates(t *testing.T) {
+	server := NewAccountServer()
+	server.config = conf.DefaultServerConfig()
+	server.config.Primary = "http://localhost:9090/"
+	server.config.Primaries = []string{"", "https://127.0.0.1"}
+
+	candidates := server.primaryCandidates(context.Background(), "/jwt/v1/pack")
+	require.Len(t, candidates, 2)
+	require.Equal(t, "http://localhost:9090/jwt/v1/pack", candidates[0].url)
+	require.Empty(t, candidates[0].addr)
+	require.Equal(t, "https://127.0.0.1/jwt/v1/pack", candidates[1].url)
+
+	// the host name is kept in the URL, each address is dialed in turn
+	server.config.ResolvePrimaries = true
+	candidates = server.primaryCandidates(context.Background(), "/jwt/v1/pack")
+	require.True(t, len(candidates) >= 2, candidates)
+	addrs := []string{}
+	for _, c := range candidates[:len(candidates)-1] {
+		require.Equal(t, "http://localhost:9090/jwt/v1/pack", c.url)
+		addrs = append(addrs, c.addr)
+	}
+	require.Contains(t, addrs, "127.0.0.1:9090")
+	last := candidates[len(candidates)-1]
+	require.Equal(t, "https://127.0.0.1/jwt/v1/pack", last.url)
+	require.Empty(t, last.addr)
+}
+
+func TestInitializeFromUnchangedPrimary(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	initAndPostNAccounts(t, testEnv, 3)
+
+	tempDir, err := os.MkdirTemp(os.TempDir(), "prefix")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	start := func() string {
+		replica := NewAccountServer()
+		replica.InitializeFromConfig(testEnv.CreateReplicaConfig(tempDir))
+		require.NoError(t, replica.Start())
+		defer replica.Stop()
+		var out bytes.Buffer
+		replica.metrics.write(&out)
+		return out.String()
+	}
+
+	require.Contains(t, start(), `nats_account_server_primary_sync_attempts_total{result="ok"} 1`)
+	// the replica restarts with the JWTs of the primary, the pack isn't sent again
+	require.Contains(t, start(), `nats_account_server_primary_sync_attempts_total{result="matched"} 1`)
+}
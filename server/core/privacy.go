@@ -0,0 +1,215 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+const (
+	redacted     = "[redacted]"
+	sealedPrefix = "sealed:v1:"
+)
+
+// privacy hides sensitive claim fields, like account names or tags, from callers without an
+// admin credential and from the logs. With a key the fields are sealed instead, so they can be
+// recovered by whoever holds the key. All methods are safe to call on a nil privacy.
+type privacy struct {
+	fields map[string][]string // dotted path -> split path
+	key    []byte              // optional key encryption key, 32 bytes
+}
+
+// newPrivacy returns nil if no field is sensitive
+func newPrivacy(config conf.PrivacyConfig) (*privacy, error) {
+	if len(config.Fields) == 0 {
+		if config.KeyFile != "" {
+			return nil, fmt.Errorf("privacy key file is set without any fields")
+		}
+		return nil, nil
+	}
+	p := &privacy{fields: map[string][]string{}}
+	for _, f := range config.Fields {
+		if f == "" {
+			return nil, fmt.Errorf("privacy fields can't be empty")
+		}
+		p.fields[f] = strings.Split(f, ".")
+	}
+	if config.KeyFile != "" {
+		data, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if p.key, err = hex.DecodeString(strings.TrimSpace(string(data))); err != nil || len(p.key) != 32 {
+			return nil, fmt.Errorf("privacy key file must hold a 32 byte key in hex")
+		}
+	}
+	return p, nil
+}
+
+// sensitive returns true if the dotted claim path is hidden
+func (p *privacy) sensitive(field string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.fields[field]
+	return ok
+}
+
+// name is used when logging a claim name
+func (p *privacy) name(name string) string {
+	if p.sensitive("name") {
+		return redacted
+	}
+	return name
+}
+
+// hide replaces the sensitive fields of a decoded claim document, sealing them if there is a key
+func (p *privacy) hide(doc interface{}) error {
+	if p == nil {
+		return nil
+	}
+	var err error
+	for _, path := range p.fields {
+		replaceValues(doc, path, func(v interface{}) interface{} {
+			if p.key == nil {
+				return redacted
+			}
+			sealed, sealErr := p.seal(v)
+			if sealErr != nil {
+				err = sealErr
+				return redacted
+			}
+			return sealed
+		})
+	}
+	return err
+}
+
+// replaceValues replaces the values at path, arrays along the way are walked like the lint rules do
+func replaceValues(v interface{}, path []string, replace func(interface{}) interface{}) {
+	if arr, ok := v.([]interface{}); ok {
+		for _, e := range arr {
+			replaceValues(e, path, replace)
+		}
+		return
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok || len(path) == 0 {
+		return
+	}
+	child, ok := m[path[0]]
+	if !ok || child == nil {
+		return
+	}
+	if len(path) == 1 {
+		m[path[0]] = replace(child)
+		return
+	}
+	replaceValues(child, path[1:], replace)
+}
+
+// seal encrypts the json of v with a fresh data key, which is itself encrypted with the key
+func (p *privacy) seal(v interface{}) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := gcmSeal(p.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := gcmSeal(dataKey, plain)
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(wrapped) + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open reverses seal
+func (p *privacy) open(s string) (interface{}, error) {
+	if p == nil || p.key == nil {
+		return nil, fmt.Errorf("no privacy key")
+	}
+	parts := strings.Split(strings.TrimPrefix(s, sealedPrefix), ".")
+	if !strings.HasPrefix(s, sealedPrefix) || len(parts) != 2 {
+		return nil, fmt.Errorf("not a sealed value")
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := gcmOpen(p.key, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcmOpen(dataKey, sealed)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(plain, &v)
+	return v, err
+}
+
+// gcmSeal returns the nonce followed by the AES-GCM cipher text
+func gcmSeal(key []byte, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func gcmOpen(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed value is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
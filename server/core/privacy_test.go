@@ -0,0 +1,100 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrivacySealAndOpen(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "privacy.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(hex.EncodeToString(bytes.Repeat([]byte{7}, 32))), 0600))
+	p, err := newPrivacy(conf.PrivacyConfig{Fields: []string{"name", "nats.tags"}, KeyFile: keyFile})
+	require.NoError(t, err)
+
+	doc := map[string]interface{}{
+		"name": "acme",
+		"nats": map[string]interface{}{"tags": []interface{}{"gold"}, "type": "account"},
+	}
+	require.NoError(t, p.hide(doc))
+	sealed, ok := doc["name"].(string)
+	require.True(t, ok)
+	require.NotContains(t, sealed, "acme")
+	name, err := p.open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, "acme", name)
+	tags, err := p.open(doc["nats"].(map[string]interface{})["tags"].(string))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"gold"}, tags)
+
+	_, err = newPrivacy(conf.PrivacyConfig{Fields: []string{"name"}, KeyFile: filepath.Join(t.TempDir(), "missing")})
+	require.Error(t, err)
+	p, err = newPrivacy(conf.PrivacyConfig{})
+	require.NoError(t, err)
+	require.Nil(t, p)
+}
+
+func TestPrivacyDecodeRedaction(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = "secret"
+	config.Privacy.Fields = []string{"name", "nats.tags"}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	claims := jwt.NewAccountClaims(pubKey)
+	claims.Name = "acme-secret-name"
+	claims.Tags.Add("vip-customer")
+	acctJWT, err := claims.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	path := fmt.Sprintf("/jwt/v1/accounts/%s?decode=true", pubKey)
+	status, body := adminRequest(t, testEnv, http.MethodGet, path, "", "")
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, body, "acme-secret-name")
+	require.NotContains(t, body, "vip-customer")
+	require.Regexp(t, regexp.MustCompile(`"name": "\[redacted\]"`), body)
+
+	status, body = adminRequest(t, testEnv, http.MethodGet, path, "wrong", "")
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, body, "acme-secret-name")
+
+	status, body = adminRequest(t, testEnv, http.MethodGet, path, "secret", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "acme-secret-name")
+	require.Contains(t, body, "vip-customer")
+}
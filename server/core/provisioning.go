@@ -0,0 +1,410 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	accountSchema   = "urn:nats:params:scim:schemas:core:2.0:Account"
+	accountResource = "Account"
+	accountsPath    = "/provisioning/v1/Accounts"
+)
+
+// provisionedAccount maps the id used by the identity management system to the account
+type provisionedAccount struct {
+	ExternalID string    `json:"externalId"`
+	PubKey     string    `json:"id"`
+	Created    time.Time `json:"created"`
+	Modified   time.Time `json:"lastModified"`
+}
+
+// provisioningIndex holds the provisioned accounts by external id. Requests hold the lock while
+// they run, so two requests for the same external id can't interleave.
+type provisioningIndex struct {
+	sync.Mutex
+	path     string
+	accounts map[string]provisionedAccount
+}
+
+// loadProvisioningIndex reads the index from path, a missing file is an empty index
+func loadProvisioningIndex(path string) (*provisioningIndex, error) {
+	x := &provisioningIndex{path: path, accounts: map[string]provisionedAccount{}}
+	if path == "" {
+		return x, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return x, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var accounts []provisionedAccount
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, err
+	}
+	for _, a := range accounts {
+		x.accounts[a.ExternalID] = a
+	}
+	return x, nil
+}
+
+// save writes the index, assumes the lock is held
+func (x *provisioningIndex) save() error {
+	if x.path == "" {
+		return nil
+	}
+	accounts := make([]provisionedAccount, 0, len(x.accounts))
+	for _, a := range x.accounts {
+		accounts = append(accounts, a)
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, x.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// put adds or replaces an account and saves the index, assumes the lock is held
+func (x *provisioningIndex) put(a provisionedAccount) error {
+	previous, existed := x.accounts[a.ExternalID]
+	x.accounts[a.ExternalID] = a
+	if err := x.save(); err != nil {
+		if existed {
+			x.accounts[a.ExternalID] = previous
+		} else {
+			delete(x.accounts, a.ExternalID)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove drops an account and saves the index, assumes the lock is held
+func (x *provisioningIndex) remove(externalID string) error {
+	previous := x.accounts[externalID]
+	delete(x.accounts, externalID)
+	if err := x.save(); err != nil {
+		x.accounts[externalID] = previous
+		return err
+	}
+	return nil
+}
+
+// resourceMeta is the SCIM meta attribute
+type resourceMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// accountResourceBody is the SCIM style representation of an account, the id is the account public key
+type accountResourceBody struct {
+	Schemas     []string      `json:"schemas"`
+	ID          string        `json:"id,omitempty"`
+	ExternalID  string        `json:"externalId"`
+	DisplayName string        `json:"displayName,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	Seed        string        `json:"seed,omitempty"`    // only returned when the account is created
+	Pending     bool          `json:"pending,omitempty"` // the signing service hasn't returned the JWT yet
+	Meta        *resourceMeta `json:"meta,omitempty"`
+}
+
+func (a provisionedAccount) resource(claim *jwt.AccountClaims) *accountResourceBody {
+	body := &accountResourceBody{
+		Schemas:    []string{accountSchema},
+		ID:         a.PubKey,
+		ExternalID: a.ExternalID,
+		Pending:    claim == nil,
+		Meta: &resourceMeta{
+			ResourceType: accountResource,
+			Created:      a.Created,
+			LastModified: a.Modified,
+			Location:     accountsPath + "/" + a.ExternalID,
+		},
+	}
+	if claim != nil {
+		body.DisplayName = claim.Name
+		body.Tags = claim.Tags
+	}
+	return body
+}
+
+// readAccountResource decodes the request body, on failure the error response is sent
+func (server *AccountServer) readAccountResource(w http.ResponseWriter, r *http.Request) *accountResourceBody {
+	body := &accountResourceBody{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, server.jwt.bodyLimit())).Decode(body); err != nil {
+		server.jwt.sendBodyError(w, err, "bad account resource", "")
+		return nil
+	}
+	return body
+}
+
+// storeProvisioned signs the claims and runs them through the checks of a POST before they are saved,
+// returns false if the error response was sent. ifMatch is the ETag of the JWT the claims were read
+// from, if any, so a JWT stored in the meantime isn't replaced. The JWT is nil if the signing service
+// completes the request later or the JWT is held.
+func (server *AccountServer) storeProvisioned(w http.ResponseWriter, claim *jwt.AccountClaims, ifMatch string) (*jwt.AccountClaims, bool) {
+	h := &server.jwt
+	shortCode := ShortKey(claim.Subject)
+	theJWT, signed, status, failure, err := h.resignAccount(claim)
+	if err != nil {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		h.sendErrorResponse(status, failure, shortCode, err, w)
+		return nil, false
+	}
+	if theJWT == nil {
+		h.logger.Noticef("%s Initiated JWT signing process for a provisioned account", shortCode)
+		return nil, true
+	}
+	u := &accountUpdate{pubKey: claim.Subject, jwt: theJWT, ifMatch: ifMatch, header: w.Header()}
+	status, err = h.updateAccount(context.Background(), u)
+	if err != nil {
+		writeErrorBody(w, status, err.Error())
+		return nil, false
+	}
+	if status == http.StatusAccepted {
+		return nil, true
+	}
+	return signed, true
+}
+
+// lookupProvisioned finds the account for the external id in the path, on failure the error response is sent
+func (server *AccountServer) lookupProvisioned(w http.ResponseWriter, params httprouter.Params) (provisionedAccount, bool) {
+	a, ok := server.provisioning.accounts[params.ByName("id")]
+	if !ok {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no account with this external id", "", nil, w)
+	}
+	return a, ok
+}
+
+// createProvisioned handles POST /provisioning/v1/Accounts. A new account key is created, the claims are
+// signed by the signing service and the seed is returned, it isn't kept by the server.
+func (server *AccountServer) createProvisioned(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	body := server.readAccountResource(w, r)
+	if body == nil {
+		return
+	}
+	if body.ExternalID == "" {
+		server.jwt.sendErrorResponse(http.StatusBadRequest, "externalId is required", "", nil, w)
+		return
+	}
+	server.provisioning.Lock()
+	defer server.provisioning.Unlock()
+	if _, ok := server.provisioning.accounts[body.ExternalID]; ok {
+		server.jwt.sendErrorResponse(http.StatusConflict, "an account with this external id exists", "", nil, w)
+		return
+	}
+
+	kp, err := nkeys.CreateAccount()
+	if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error creating account key", "", err, w)
+		return
+	}
+	pubKey, _ := kp.PublicKey()
+	seed, _ := kp.Seed()
+	claim := jwt.NewAccountClaims(pubKey)
+	claim.Name = body.DisplayName
+	if claim.Name == "" {
+		claim.Name = body.ExternalID
+	}
+	claim.Tags.Add(body.Tags...)
+	signed, ok := server.storeProvisioned(w, claim, "")
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	a := provisionedAccount{ExternalID: body.ExternalID, PubKey: pubKey, Created: now, Modified: now}
+	if err := server.provisioning.put(a); err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error saving the provisioning index", pubKey, err, w)
+		return
+	}
+	server.logger.Noticef("provisioned account %s for external id %q", ShortKey(pubKey), a.ExternalID)
+	resource := a.resource(signed)
+	resource.Seed = string(seed)
+	status := http.StatusCreated
+	if signed == nil {
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Location", resource.Meta.Location)
+	server.writeJSON(w, status, resource)
+}
+
+// getProvisioned handles GET /provisioning/v1/Accounts/:id
+func (server *AccountServer) getProvisioned(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.provisioning.Lock()
+	a, ok := server.lookupProvisioned(w, params)
+	server.provisioning.Unlock()
+	if !ok {
+		return
+	}
+	_, claim := server.jwt.loadAccountJWT(a.PubKey)
+	server.writeJSON(w, http.StatusOK, a.resource(claim))
+}
+
+// updateProvisioned handles PUT /provisioning/v1/Accounts/:id, replacing the name and tags of the account
+func (server *AccountServer) updateProvisioned(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	body := server.readAccountResource(w, r)
+	if body == nil {
+		return
+	}
+	server.provisioning.Lock()
+	defer server.provisioning.Unlock()
+	a, ok := server.lookupProvisioned(w, params)
+	if !ok {
+		return
+	}
+	if body.ExternalID != "" && body.ExternalID != a.ExternalID {
+		server.jwt.sendErrorResponse(http.StatusBadRequest, "externalId can't be changed", a.PubKey, nil, w)
+		return
+	}
+	stored, claim, found := server.jwt.loadAccountJWTWithClaims(a.PubKey)
+	if !found {
+		server.jwt.sendErrorResponse(http.StatusConflict, "the account JWT is not stored yet", a.PubKey, nil, w)
+		return
+	}
+	etag := server.jwt.etag(claim.ID, stored)
+	if body.DisplayName != "" {
+		claim.Name = body.DisplayName
+	}
+	claim.Tags = nil
+	claim.Tags.Add(body.Tags...)
+	signed, ok := server.storeProvisioned(w, claim, etag)
+	if !ok {
+		return
+	}
+	a.Modified = time.Now().UTC()
+	if err := server.provisioning.put(a); err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error saving the provisioning index", a.PubKey, err, w)
+		return
+	}
+	status := http.StatusOK
+	if signed == nil {
+		status = http.StatusAccepted
+	}
+	server.writeJSON(w, status, a.resource(signed))
+}
+
+// deleteProvisioned handles DELETE /provisioning/v1/Accounts/:id. All users of the account are revoked,
+// so the nats-servers disconnect them, before the account is removed from the store and the index. The
+// optional body is the operator signed delete proof, which is published so the nats-server full resolvers
+// drop the account. Without one the server signs the proof with its own signing key, if it has one.
+func (server *AccountServer) deleteProvisioned(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h := &server.jwt
+	proof, ok := h.readBody(w, r, "bad delete proof in request", "")
+	if !ok {
+		return
+	}
+	server.provisioning.Lock()
+	defer server.provisioning.Unlock()
+	a, ok := server.lookupProvisioned(w, params)
+	if !ok {
+		return
+	}
+	if len(proof) > 0 {
+		if status, failure := h.checkDeleteProof(a.PubKey, proof); status != 0 {
+			h.sendErrorResponse(status, failure, a.PubKey, nil, w)
+			return
+		}
+	} else if h.deleteProof != nil {
+		var err error
+		if proof, err = h.deleteProof(a.PubKey); err != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "error signing the delete proof", a.PubKey, err, w)
+			return
+		}
+	}
+	if stored, claim, found := h.loadAccountJWTWithClaims(a.PubKey); found {
+		etag := h.etag(claim.ID, stored)
+		claim.RevokeAt(jwt.All, time.Now())
+		if signed, ok := server.storeProvisioned(w, claim, etag); !ok {
+			return
+		} else if signed == nil {
+			h.sendErrorResponse(http.StatusConflict, "the JWT revoking the users isn't stored yet", a.PubKey, nil, w)
+			return
+		}
+		if status, failure, err := h.deleteAccount(a.PubKey, proof); status != 0 && status != http.StatusNotFound && status != http.StatusNotImplemented {
+			h.sendErrorResponse(status, failure, a.PubKey, err, w)
+			return
+		}
+	}
+	if err := server.provisioning.remove(a.ExternalID); err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error saving the provisioning index", a.PubKey, err, w)
+		return
+	}
+	server.logger.Noticef("deprovisioned account %s for external id %q", ShortKey(a.PubKey), a.ExternalID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// initProvisioningRouter adds the provisioning routes if provisioning is enabled
+func (server *AccountServer) initProvisioningRouter(r *httprouter.Router) {
+	if server.provisioning == nil {
+		return
+	}
+	auth := func(next httprouter.Handle) httprouter.Handle {
+		return server.tokenAuth(server.config.Provisioning.Token, "provisioning token required", next)
+	}
+	r.POST(accountsPath, auth(server.createProvisioned))
+	r.GET(accountsPath+"/:id", auth(server.getProvisioned))
+	r.PUT(accountsPath+"/:id", auth(server.updateProvisioned))
+	r.DELETE(accountsPath+"/:id", auth(server.deleteProvisioned))
+}
+
+// initProvisioning loads the index if provisioning is enabled, which requires a token, assumes the lock is held
+func (server *AccountServer) initProvisioning() error {
+	server.provisioning = nil
+	config := server.config.Provisioning
+	if !config.Enabled {
+		return nil
+	}
+	if config.Token == "" {
+		return errors.New("provisioning requires a token, set the provisioning token")
+	}
+	if server.config.SignRequestSubject == "" && server.config.SigningKey == "" {
+		return errors.New("provisioning requires a signing service or key, set signrequestsubject or signingkey")
+	}
+	if server.JWTStore.IsReadOnly() {
+		return errors.New("provisioning requires a writable store")
+	}
+	index, err := loadProvisioningIndex(config.Index)
+	if err != nil {
+		return err
+	}
+	server.provisioning = index
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisioningRequiresSigning(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Provisioning.Enabled = true
+	config.Provisioning.Token = "idp"
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
+
+func TestProvisioningRequiresToken(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.SignRequestSubject = "sign"
+	config.Provisioning.Enabled = true
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
+
+func TestProvisioning(t *testing.T) {
+	index := filepath.Join(t.TempDir(), "provisioning.json")
+	config := conf.DefaultServerConfig()
+	config.SignRequestSubject = "sign"
+	config.Provisioning.Enabled = true
+	config.Provisioning.Token = "idp"
+	config.Provisioning.Index = index
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, err = testEnv.NC.Subscribe("sign", func(msg *nats.Msg) {
+		claim, err := jwt.DecodeAccountClaims(string(msg.Data))
+		require.NoError(t, err)
+		token, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		msg.Respond([]byte(token))
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	request := func(method string, path string, body string) (int, *accountResourceBody) {
+		status, data := adminRequest(t, testEnv, method, accountsPath+path, "idp", body)
+		resource := &accountResourceBody{}
+		if status == http.StatusOK || status == http.StatusCreated {
+			require.NoError(t, json.Unmarshal([]byte(data), resource))
+		}
+		return status, resource
+	}
+
+	status, _ := adminRequest(t, testEnv, http.MethodPost, accountsPath, "", `{"externalId": "team-a"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = request(http.MethodPost, "", `{"displayName": "Team A"}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, created := request(http.MethodPost, "", `{"externalId": "team-a", "displayName": "Team A", "tags": ["prod"]}`)
+	require.Equal(t, http.StatusCreated, status)
+	require.Equal(t, "team-a", created.ExternalID)
+	require.Equal(t, "Team A", created.DisplayName)
+	require.Equal(t, []string{"prod"}, created.Tags)
+	kp, err := nkeys.FromSeed([]byte(created.Seed))
+	require.NoError(t, err)
+	pubKey, err := kp.PublicKey()
+	require.NoError(t, err)
+	require.Equal(t, pubKey, created.ID)
+
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	claim, err := jwt.DecodeAccountClaims(stored)
+	require.NoError(t, err)
+	require.Equal(t, testEnv.OperatorPubKey, claim.Issuer)
+	require.Equal(t, "Team A", claim.Name)
+
+	status, _ = request(http.MethodPost, "", `{"externalId": "team-a"}`)
+	require.Equal(t, http.StatusConflict, status)
+
+	status, resource := request(http.MethodGet, "/team-a", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, pubKey, resource.ID)
+	require.Empty(t, resource.Seed)
+
+	status, resource = request(http.MethodPut, "/team-a", `{"displayName": "Team Alpha", "tags": ["staging"]}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "Team Alpha", resource.DisplayName)
+	require.Equal(t, []string{"staging"}, resource.Tags)
+	status, _ = request(http.MethodPut, "/team-a", `{"externalId": "team-b"}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// the mapping survives restarts
+	reloaded, err := loadProvisioningIndex(index)
+	require.NoError(t, err)
+	require.Equal(t, pubKey, reloaded.accounts["team-a"].PubKey)
+
+	// the delete proof is published, so the nats-server resolvers drop the account
+	notifications := make(chan *nats.Msg, 1)
+	_, err = testEnv.NC.ChanSubscribe(fmt.Sprintf(accountDeleteFormat, pubKey), notifications)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+	deleteProof := jwt.NewGenericClaims(testEnv.OperatorPubKey)
+	deleteProof.Data["accounts"] = []string{pubKey}
+	proof, err := deleteProof.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	status, _ = request(http.MethodDelete, "/team-a", "not a proof")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = request(http.MethodDelete, "/team-a", proof)
+	require.Equal(t, http.StatusNoContent, status)
+	select {
+	case msg := <-notifications:
+		require.Equal(t, proof, string(msg.Data))
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delete notification")
+	}
+	_, err = testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.Error(t, err)
+	status, _ = request(http.MethodGet, "/team-a", "")
+	require.Equal(t, http.StatusNotFound, status)
+	reloaded, err = loadProvisioningIndex(index)
+	require.NoError(t, err)
+	require.Empty(t, reloaded.accounts)
+}
+
+func TestProvisioningChecksPolicy(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.SignRequestSubject = "sign"
+	config.Provisioning.Enabled = true
+	config.Provisioning.Token = "idp"
+	config.Policy.MaxConnections = 10
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, err = testEnv.NC.Subscribe("sign", func(msg *nats.Msg) {
+		claim, err := jwt.DecodeAccountClaims(string(msg.Data))
+		require.NoError(t, err)
+		token, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		msg.Respond([]byte(token))
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	// provisioned accounts go through the checks of a post, new claims don't limit connections
+	status, body := adminRequest(t, testEnv, http.MethodPost, accountsPath, "idp", `{"externalId": "team-a"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	require.Contains(t, body, "account policy")
+	status, _ = adminRequest(t, testEnv, http.MethodGet, accountsPath+"/team-a", "idp", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the load balancers and proxies allowed to tell the client address
+type trustedProxies []*net.IPNet
+
+// newTrustedProxies parses addresses and CIDR ranges
+func newTrustedProxies(list []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, p := range list {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy %q: %v", p, err)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) trusted(ip net.IP) bool {
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client behind trusted proxies, X-Forwarded-For is read from the
+// right, the first address that isn't a trusted proxy is the client, X-Real-IP is used without it.
+// Requests that don't come from a trusted proxy keep their address.
+func (p trustedProxies) clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !p.trusted(ip) {
+		return r.RemoteAddr
+	}
+	var forwarded []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(h, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(addr))
+		}
+	}
+	client := ""
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(forwarded[i])
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !p.trusted(ip) {
+			break
+		}
+	}
+	if client == "" {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			client = ip.String()
+		}
+	}
+	if client == "" {
+		return r.RemoteAddr
+	}
+	return client
+}
+
+// forwardedFor replaces the address of requests from trusted proxies with the address of the client, so
+// it shows up in logs. Without trusted proxies next is returned as is.
+func (p trustedProxies) forwardedFor(next http.Handler) http.Handler {
+	if len(p) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = p.clientAddr(r)
+		next.ServeHTTP(w, r)
+	})
+}
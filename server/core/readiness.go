@@ -0,0 +1,158 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// readinessTimeout bounds the store check of a deep readiness check
+const readinessTimeout = 5 * time.Second
+
+// readinessProbeKey is looked up, and written in a rolled back transaction, to check a store
+const readinessProbeKey = "readyz-probe"
+
+// storeChecker is implemented by stores that can check they are readable, and writable unless they are
+// read only, without changing their content
+type storeChecker interface {
+	check(ctx context.Context) error
+}
+
+// check lists the directory and creates and removes a temporary file in it
+func (ds *dirStore) check(ctx context.Context) error {
+	if _, err := os.ReadDir(ds.dir); err != nil {
+		return err
+	}
+	if ds.IsReadOnly() {
+		return nil
+	}
+	f, err := os.CreateTemp(ds.dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// check reads a row and writes one in a transaction that is rolled back
+func (ss *sqlStore) check(ctx context.Context) error {
+	var theJWT string
+	if err := ss.db.QueryRowContext(ctx, ss.load, readinessProbeKey).Scan(&theJWT); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, ss.save, readinessProbeKey, "")
+	return err
+}
+
+// check checks both stores
+func (ds *dualStore) check(ctx context.Context) error {
+	for name, s := range map[string]interface{}{"primary": ds.primary, "secondary": ds.secondary} {
+		if c, ok := s.(storeChecker); ok {
+			if err := c.check(ctx); err != nil {
+				return fmt.Errorf("%s store, %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readinessCheck is the outcome of one dependency in a deep readiness check
+type readinessCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// deepReadiness checks the store, the NATS connection, the operator JWT and the initial sync with the
+// primary, returning the outcome of each and the reason of the first failure, empty if all passed
+func (server *AccountServer) deepReadiness(ctx context.Context) (map[string]readinessCheck, string) {
+	checks := map[string]readinessCheck{}
+	reason := ""
+	fail := func(name string, detail string) {
+		checks[name] = readinessCheck{Detail: detail}
+		if reason == "" {
+			reason = fmt.Sprintf("%s: %s", name, detail)
+		}
+	}
+
+	server.Lock()
+	jwtStore := server.JWTStore
+	natsConfigured := len(server.config.NATS.Servers) > 0
+	nc := server.nats
+	operatorPaths := server.operatorPaths()
+	operatorJWT := server.jwt.operatorJWT
+	primaries := server.primaries()
+	degraded := server.degraded
+	server.Unlock()
+
+	if jwtStore == nil {
+		fail("store", "no store")
+	} else if c, ok := jwtStore.(storeChecker); ok {
+		ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		defer cancel()
+		if err := c.check(ctx); err != nil {
+			fail("store", err.Error())
+		} else if jwtStore.IsReadOnly() {
+			checks["store"] = readinessCheck{OK: true, Detail: "readable, read only"}
+		} else {
+			checks["store"] = readinessCheck{OK: true, Detail: "readable and writable"}
+		}
+	} else {
+		checks["store"] = readinessCheck{OK: true, Detail: "not checked"}
+	}
+
+	switch {
+	case !natsConfigured:
+		checks["nats"] = readinessCheck{OK: true, Detail: "not configured"}
+	case nc == nil || nc.Status() != nats.CONNECTED:
+		status := nats.DISCONNECTED
+		if nc != nil {
+			status = nc.Status()
+		}
+		fail("nats", status.String())
+	default:
+		checks["nats"] = readinessCheck{OK: true, Detail: nc.ConnectedUrlRedacted()}
+	}
+
+	switch {
+	case len(operatorPaths) == 0:
+		checks["operator"] = readinessCheck{OK: true, Detail: "not configured"}
+	case operatorJWT == "":
+		fail("operator", "operator JWT not loaded")
+	default:
+		checks["operator"] = readinessCheck{OK: true}
+	}
+
+	switch {
+	case len(primaries) == 0:
+		checks["primary_sync"] = readinessCheck{OK: true, Detail: "not configured"}
+	case degraded != "":
+		fail("primary_sync", degraded)
+	default:
+		checks["primary_sync"] = readinessCheck{OK: true}
+	}
+	return checks, reason
+}
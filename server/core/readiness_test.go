@@ -0,0 +1,90 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+type readyzResponse struct {
+	Ready  bool                      `json:"ready"`
+	Reason string                    `json:"reason"`
+	Checks map[string]readinessCheck `json:"checks"`
+}
+
+func getReadyz(t *testing.T, testEnv *TestSetup, query string) (int, readyzResponse) {
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/readyz" + query))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var r readyzResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+	return resp.StatusCode, r
+}
+
+func TestDeepReadiness(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, r := getReadyz(t, testEnv, "")
+	require.Equal(t, http.StatusOK, status)
+	require.Nil(t, r.Checks)
+
+	status, r = getReadyz(t, testEnv, "?deep=true")
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, r.Ready)
+	require.Equal(t, readinessCheck{OK: true, Detail: "readable and writable"}, r.Checks["store"])
+	require.True(t, r.Checks["nats"].OK)
+	require.Equal(t, readinessCheck{OK: true}, r.Checks["operator"])
+	require.Equal(t, readinessCheck{OK: true, Detail: "not configured"}, r.Checks["primary_sync"])
+
+	// a lost NATS connection only fails the deep check
+	testEnv.GNATSD.Shutdown()
+	require.Eventually(t, func() bool {
+		return !testEnv.Server.getNatsConnection().IsConnected()
+	}, 5*time.Second, 10*time.Millisecond)
+	status, _ = getReadyz(t, testEnv, "")
+	require.Equal(t, http.StatusOK, status)
+	status, r = getReadyz(t, testEnv, "?deep=true")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.False(t, r.Ready)
+	require.Equal(t, "nats: RECONNECTING", r.Reason)
+	require.False(t, r.Checks["nats"].OK)
+
+	require.NoError(t, os.RemoveAll(testEnv.Server.config.Store.Dir))
+	_, r = getReadyz(t, testEnv, "?deep=true")
+	require.False(t, r.Checks["store"].OK)
+	require.Contains(t, r.Reason, "store: ")
+}
+
+func TestDeepReadinessSQLStore(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store = conf.StoreConfig{Type: "sqltest", DSN: "TestDeepReadinessSQLStore"}
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, r := getReadyz(t, testEnv, "?deep=true")
+	require.Equal(t, http.StatusOK, status, r.Reason)
+	require.Equal(t, readinessCheck{OK: true, Detail: "readable and writable"}, r.Checks["store"])
+}
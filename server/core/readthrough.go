@@ -0,0 +1,288 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// readThroughCache tracks when each JWT of a cache mode server was fetched from the upstream and which
+// were used last, the JWTs themselves are kept in the store. All methods are safe to call on a nil cache.
+type readThroughCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*list.Element
+	order   *list.List      // most recently used at the front
+	pending map[string]bool // accounts being revalidated
+	now     func() time.Time
+	metrics *metrics
+}
+
+type readThroughEntry struct {
+	key     string
+	fetched time.Time
+}
+
+// newReadThroughCache returns nil if cache mode is off
+func newReadThroughCache(config conf.ReadThroughConfig, m *metrics) (*readThroughCache, error) {
+	if config.TTL < 0 || config.MaxEntries < 0 {
+		return nil, errors.New("cache ttl and max_entries can't be negative")
+	}
+	if config.TTL == 0 {
+		return nil, nil
+	}
+	c := &readThroughCache{
+		ttl:     time.Duration(config.TTL) * time.Millisecond,
+		max:     config.MaxEntries,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		pending: map[string]bool{},
+		now:     time.Now,
+		metrics: m,
+	}
+	m.describe("cache_lookups_total", "counter", "Number of cache mode lookups by result, fresh, stale, miss or error")
+	m.gaugeFunc("cache_entries", "Number of JWTs fetched from the upstream in cache mode", func() float64 {
+		return float64(c.len())
+	})
+	return c, nil
+}
+
+// age returns how long ago the account was fetched, false if it wasn't, i.e. it was on disk at startup
+func (c *readThroughCache) age(key string) (time.Duration, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	c.order.MoveToFront(e)
+	return c.now().Sub(e.Value.(*readThroughEntry).fetched), true
+}
+
+// fetched marks the account as fresh and returns the accounts evicted to stay within max entries. Once
+// there are more, a tenth of max entries is evicted at once, so stores that reload on deletes don't do
+// so on every miss.
+func (c *readThroughCache) fetched(key string) []string {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*readThroughEntry).fetched = c.now()
+		c.order.MoveToFront(e)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(&readThroughEntry{key: key, fetched: c.now()})
+	var evicted []string
+	if c.max == 0 || c.order.Len() <= c.max {
+		return nil
+	}
+	for c.order.Len() > c.max-c.max/10 {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*readThroughEntry).key)
+		evicted = append(evicted, oldest.Value.(*readThroughEntry).key)
+	}
+	return evicted
+}
+
+// revalidating returns false if the account is already being revalidated, otherwise done has to be called
+func (c *readThroughCache) revalidating(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.pending[key] {
+		return false
+	}
+	c.pending[key] = true
+	return true
+}
+
+func (c *readThroughCache) done(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.pending, key)
+}
+
+func (c *readThroughCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+// initReadThrough enables cache mode, which needs an upstream in the lookup chain
+func (server *AccountServer) initReadThrough() error {
+	c, err := newReadThroughCache(server.config.Cache, server.metrics)
+	if err != nil || c == nil {
+		server.readThrough = nil
+		return err
+	}
+	if len(server.upstreams()) == 0 || (len(server.config.NATS.Servers) == 0 && len(server.config.Lookup) == 0) {
+		return errors.New("cache mode requires NATS servers or primary-http in the lookup chain")
+	}
+	if _, ok := server.JWTStore.(*passThroughStore); ok {
+		return errors.New("cache mode requires a store, store type none has its own cache_ttl")
+	}
+	if _, ok := server.JWTStore.(store.DeletableJWTStore); !ok && c.max > 0 {
+		return errors.New("cache max_entries requires a store that supports deletes")
+	}
+	server.logger.Noticef("cache mode, JWTs are fetched from %v and served for %v", server.upstreams(), c.ttl)
+	server.readThrough = c
+	return nil
+}
+
+// upstreams are the sources of the lookup chain other than the store
+func (server *AccountServer) upstreams() []string {
+	var sources []string
+	for _, s := range server.lookup {
+		if s != lookupStore {
+			sources = append(sources, s)
+		}
+	}
+	return sources
+}
+
+// cachedLookup serves an account from the store while it is fresh. Up to the stale window past the ttl
+// it is still served and revalidated in the background, after that, or if the store doesn't have it,
+// the upstream is asked first.
+func (server *AccountServer) cachedLookup(publicKey string) (string, string, error) {
+	c := server.readThrough
+	theJWT, err := server.JWTStore.LoadAcc(publicKey)
+	if err == nil && theJWT != "" {
+		age, ok := c.age(publicKey)
+		if ok && age < c.ttl {
+			c.metrics.inc("cache_lookups_total", "result", "fresh")
+			return theJWT, lookupCache, nil
+		}
+		if !ok || age < c.ttl+staleWindow {
+			c.metrics.inc("cache_lookups_total", "result", "stale")
+			server.revalidate(publicKey)
+			return theJWT, lookupCache, nil
+		}
+	}
+	fetched, source, err := server.fetchUpstream(publicKey)
+	if err != nil && theJWT != "" {
+		// a stale JWT beats none while the upstream can't be reached
+		server.logger.Debugf("serving stale %s - %v", ShortKey(publicKey), err)
+		c.metrics.inc("cache_lookups_total", "result", "stale")
+		return theJWT, lookupCache, nil
+	} else if err != nil {
+		c.metrics.inc("cache_lookups_total", "result", "error")
+		return "", "", err
+	}
+	c.metrics.inc("cache_lookups_total", "result", "miss")
+	return fetched, source, nil
+}
+
+// revalidate fetches the account from the upstream in the background, once at a time
+func (server *AccountServer) revalidate(publicKey string) {
+	c := server.readThrough
+	if !c.revalidating(publicKey) {
+		return
+	}
+	go func() {
+		defer c.done(publicKey)
+		if server.context().Err() != nil {
+			return
+		}
+		if _, _, err := server.fetchUpstream(publicKey); err != nil {
+			server.logger.Debugf("revalidating %s - %v", ShortKey(publicKey), err)
+		}
+	}()
+}
+
+// fetchUpstream asks each upstream for the account and keeps the first answer in the store, unless the
+// store holds a newer JWT, which is returned instead
+func (server *AccountServer) fetchUpstream(publicKey string) (string, string, error) {
+	err := fmt.Errorf("account not found")
+	for _, source := range server.upstreams() {
+		var theJWT string
+		if theJWT, err = server.lookupFrom(source, publicKey); err != nil || theJWT == "" {
+			continue
+		}
+		if theJWT, err = server.saveFetched(publicKey, theJWT); err != nil {
+			return "", "", err
+		}
+		server.logger.Tracef("lookup of %s - fetched from %s", ShortKey(publicKey), source)
+		return theJWT, source, nil
+	}
+	return "", "", err
+}
+
+// saveFetched stores a JWT fetched from the upstream if it is newer than the stored one, under the write
+// lock of the account, and returns the JWT the store holds. Either is fresh from now on.
+func (server *AccountServer) saveFetched(publicKey string, theJWT string) (string, error) {
+	unlock := server.jwt.writeLocks.lock(publicKey)
+	defer unlock()
+	existing, _ := server.JWTStore.LoadAcc(publicKey)
+	newer, err := isNewerJWT(publicKey, existing, theJWT)
+	if err != nil {
+		return "", err
+	}
+	if !newer {
+		server.evict(server.readThrough.fetched(publicKey))
+		return existing, nil
+	}
+	return theJWT, server.SaveAcc(publicKey, theJWT)
+}
+
+// SaveAcc stores and indexes the JWT, in cache mode it is fresh from now on and may evict others
+func (server *AccountServer) SaveAcc(publicKey string, theJWT string) error {
+	if err := server.JWTStore.SaveAcc(publicKey, theJWT); err != nil {
+		return err
+	}
+	server.jwt.jtis.add(theJWT)
+	server.jwt.tags.add(theJWT)
+	server.evict(server.readThrough.fetched(publicKey))
+	return nil
+}
+
+// batchDeleter is implemented by stores that delete several accounts for less than one at a time
+type batchDeleter interface {
+	deleteAccs(publicKeys []string) error
+}
+
+// evict deletes the accounts evicted from the cache from the store
+func (server *AccountServer) evict(evicted []string) {
+	if len(evicted) == 0 {
+		return
+	}
+	if batch, ok := server.JWTStore.(batchDeleter); ok {
+		if err := batch.deleteAccs(evicted); err != nil {
+			server.logger.Warnf("unable to evict %d accounts from the cache - %v", len(evicted), err)
+		}
+		return
+	}
+	for _, pubKey := range evicted {
+		if err := server.JWTStore.(store.DeletableJWTStore).DeleteAcc(pubKey); err != nil {
+			server.logger.Warnf("%s - unable to evict from the cache - %v", ShortKey(pubKey), err)
+		}
+	}
+}
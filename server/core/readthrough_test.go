@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadThroughConfig(t *testing.T) {
+	c, err := newReadThroughCache(conf.ReadThroughConfig{}, newMetrics())
+	require.NoError(t, err)
+	require.Nil(t, c)
+	_, err = newReadThroughCache(conf.ReadThroughConfig{TTL: -1}, newMetrics())
+	require.Error(t, err)
+
+	dir, err := os.MkdirTemp("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = dir
+	config.Cache.TTL = 1000
+	server := NewAccountServer()
+	require.NoError(t, server.InitializeFromConfig(config))
+	require.Error(t, server.Start(), "there is no upstream")
+	server.Stop()
+}
+
+func TestReadThrough(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	pubKeys := initAndPostNAccounts(t, testEnv, 3)
+
+	dir, err := os.MkdirTemp("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := testEnv.CreateReplicaConfig(dir)
+	config.Lookup = []string{"store", "primary-http"}
+	config.Cache = conf.ReadThroughConfig{TTL: 60000, MaxEntries: 2}
+	cache := NewAccountServer()
+	require.NoError(t, cache.InitializeFromConfig(config))
+	require.NoError(t, cache.Start())
+	defer cache.Stop()
+
+	get := func(pubKey string) (int, string, string) {
+		resp, err := testEnv.HTTP.Get(fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", cache.protocol, cache.hostPort, pubKey))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get(accountSourceHeader), string(body)
+	}
+
+	var order []string
+	for pubKey := range pubKeys {
+		order = append(order, pubKey)
+	}
+	// the initial pack is skipped, accounts are fetched when requested
+	_, err = cache.JWTStore.LoadAcc(order[0])
+	require.Error(t, err)
+	status, source, body := get(order[0])
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, lookupPrimary, source)
+	require.Equal(t, pubKeys[order[0]], body)
+	status, source, _ = get(order[0])
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, lookupCache, source)
+
+	// the least recently used account is evicted from the store
+	get(order[1])
+	get(order[2])
+	require.Equal(t, 2, cache.readThrough.len())
+	_, err = cache.JWTStore.LoadAcc(order[0])
+	require.Error(t, err)
+
+	// a changed JWT is only fetched once the cached one is stale, which is served while revalidating
+	claim := jwt.NewAccountClaims(order[2])
+	claim.Name = "changed"
+	changed, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, order[2], []byte(changed)))
+	_, _, body = get(order[2])
+	require.Equal(t, pubKeys[order[2]], body)
+
+	// revalidations read the clock in the background, it is swapped under the cache lock
+	setNow := func(now time.Time) {
+		cache.readThrough.Lock()
+		defer cache.readThrough.Unlock()
+		cache.readThrough.now = func() time.Time { return now }
+	}
+	start := time.Now()
+	setNow(start.Add(2 * time.Minute))
+	_, source, body = get(order[2])
+	require.Equal(t, lookupCache, source)
+	require.Equal(t, pubKeys[order[2]], body)
+	require.Eventually(t, func() bool {
+		theJWT, err := cache.JWTStore.LoadAcc(order[2])
+		return err == nil && theJWT == changed
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// past the stale window the upstream is asked first, a newer JWT in the store is kept
+	time.Sleep(1100 * time.Millisecond) // issued at has a resolution of seconds
+	claim = jwt.NewAccountClaims(order[1])
+	claim.Name = "newer"
+	newer, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, cache.JWTStore.SaveAcc(order[1], newer))
+	setNow(start.Add(2*time.Minute + staleWindow + time.Hour))
+	_, source, body = get(order[1])
+	require.Equal(t, lookupPrimary, source)
+	require.Equal(t, newer, body)
+	theJWT, err := cache.JWTStore.LoadAcc(order[1])
+	require.NoError(t, err)
+	require.Equal(t, newer, theJWT)
+
+	status, _, _ = get(testEnv.OperatorPubKey)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// without the upstream, stale JWTs are still served
+	testEnv.Server.Stop()
+	setNow(start.Add(4*time.Minute + 2*staleWindow + 2*time.Hour))
+	status, source, body = get(order[2])
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, lookupCache, source)
+	require.Equal(t, changed, body)
+}
+
+func TestReadThroughEvictions(t *testing.T) {
+	c, err := newReadThroughCache(conf.ReadThroughConfig{TTL: 1000, MaxEntries: 20}, newMetrics())
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.Empty(t, c.fetched(fmt.Sprintf("A%d", i)))
+	}
+	// a tenth is evicted at once, least recently used first
+	c.age("A0")
+	require.Equal(t, []string{"A1", "A2", "A3"}, c.fetched("A20"))
+	require.Equal(t, 18, c.len())
+	require.Empty(t, c.fetched("A21"))
+}
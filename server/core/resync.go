@@ -0,0 +1,128 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats.go"
+)
+
+const resyncRequest = "$SYS.REQ.ACCOUNT_SERVER.RESYNC"
+
+var errResyncUnavailable = errors.New("resync requires a NATS connection and a writable store that can be packed")
+
+// resyncResult reports a forced sync with the peer full resolvers
+type resyncResult struct {
+	Server   string         `json:"server"`
+	ID       string         `json:"id"`
+	Time     time.Time      `json:"time"`
+	Packs    int            `json:"packs"`              // pack messages received, 0 if nobody answered
+	Matched  bool           `json:"matched"`            // a peer had the same pack hash, nothing was sent
+	Counts   map[string]int `json:"counts"`             // merge decisions for the received JWTs
+	Merged   int            `json:"merged"`             // JWTs stored
+	Error    string         `json:"error,omitempty"`    // merging stopped at this error
+	Duration string         `json:"duration,omitempty"` // from the request to the last pack
+}
+
+// resync publishes a pack request right away, rather than waiting for the sync interval, and merges the
+// responses. The request goes out on the check inbox, so this server doesn't answer itself.
+func (server *AccountServer) resync() (*resyncResult, error) {
+	nc := server.getNatsConnection()
+	jwtStore, isSyncable := server.JWTStore.(syncableStore)
+	if nc == nil || !isSyncable || server.JWTStore.IsReadOnly() {
+		return nil, errResyncUnavailable
+	}
+	start := time.Now()
+	hash := jwtStore.Hash()
+	timeout := time.Duration(server.config.Consistency.Timeout) * time.Millisecond
+	packs, err := collectResponses(nc, server.checkInbox, server.subjects.pack, hash[:], timeout, func(m *nats.Msg) bool {
+		return len(m.Data) == 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &resyncResult{
+		Server: server.serverName(),
+		ID:     server.id,
+		Time:   start.UTC(),
+		Packs:  len(packs),
+		// a matching hash is answered with just the end of stream
+		Matched: len(packs) == 1 && len(packs[0].Data) == 0,
+		Counts:  map[string]int{},
+	}
+	for _, m := range packs {
+		if len(m.Data) == 0 {
+			continue
+		}
+		accepted := 0
+		for _, line := range strings.Split(string(m.Data), "\n") {
+			if line == "" {
+				continue
+			}
+			d := server.classifyMerge(line)
+			result.Counts[d.Decision]++
+			if d.Decision == mergeAccepted {
+				accepted++
+			}
+		}
+		if err := server.mergePack(server.context(), "resync", jwtStore, string(m.Data)); err != nil {
+			result.Error = err.Error()
+			break
+		}
+		result.Merged += accepted
+	}
+	server.endMergeCycle()
+	result.Duration = time.Since(start).String()
+	server.metrics.inc("resyncs_total")
+	server.logger.Noticef("resync merged %d JWTs from %d pack messages", result.Merged, result.Packs)
+	return result, nil
+}
+
+// postResync handles POST /admin/v1/resync
+func (server *AccountServer) postResync(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	result, err := server.resync()
+	if err == errResyncUnavailable {
+		server.jwt.sendErrorResponse(http.StatusServiceUnavailable, err.Error(), "", nil, w)
+		return
+	} else if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error requesting packs", "", err, w)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, result)
+}
+
+// handleResync answers requests on $SYS.REQ.ACCOUNT_SERVER.RESYNC, every server resyncs and replies
+// with its result
+func (server *AccountServer) handleResync(msg *nats.Msg) {
+	result, err := server.resync()
+	if err != nil {
+		result = &resyncResult{Server: server.serverName(), ID: server.id, Time: time.Now().UTC(),
+			Error: fmt.Sprintf("resync failed - %v", err)}
+	}
+	if msg.Reply == "" {
+		return
+	}
+	if data, err := json.Marshal(result); err == nil {
+		msg.Respond(data)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResync(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Consistency.Timeout = 250
+	config.SyncInterval = 60000 // keep the store's own pack requests out of the way
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	first, firstJWT := newAccountJWT(t, testEnv.OperatorKey)
+	second, secondJWT := newAccountJWT(t, testEnv.OperatorKey)
+	_, err = testEnv.NC.Subscribe(accountPackRequest, func(m *nats.Msg) {
+		m.Respond([]byte(fmt.Sprintf("%s|%s\n%s|%s", first, firstJWT, second, secondJWT)))
+		m.Respond(nil)
+	})
+	require.NoError(t, err)
+
+	status, body := adminRequest(t, testEnv, http.MethodPost, "/admin/v1/resync", testAdminToken, "")
+	require.Equal(t, http.StatusOK, status, body)
+	var result resyncResult
+	require.NoError(t, json.Unmarshal([]byte(body), &result))
+	require.Equal(t, 2, result.Packs)
+	require.False(t, result.Matched)
+	require.Equal(t, 2, result.Merged)
+	require.Equal(t, 2, result.Counts[mergeAccepted])
+	theJWT, err := testEnv.Server.JWTStore.LoadAcc(second)
+	require.NoError(t, err)
+	require.Equal(t, secondJWT, theJWT)
+
+	// the same pack again merges nothing, over NATS
+	msg, err := testEnv.NC.Request(resyncRequest, nil, 2*time.Second)
+	require.NoError(t, err)
+	result = resyncResult{}
+	require.NoError(t, json.Unmarshal(msg.Data, &result))
+	require.Empty(t, result.Error)
+	require.Equal(t, testEnv.Server.id, result.ID)
+	require.Equal(t, 0, result.Merged)
+	require.Equal(t, 2, result.Counts[mergeUnchanged])
+}
+
+func TestResyncWithoutNATS(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, _ := adminRequest(t, testEnv, http.MethodPost, "/admin/v1/resync", testAdminToken, "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+)
+
+const (
+	revokedByWildcard = "wildcard" // the all users entry revokes at least as much
+	revokedAndExpired = "expired"  // every user JWT the entry revokes is past the window
+)
+
+// revocationEntry is one revocation that can be dropped from an account JWT
+type revocationEntry struct {
+	Key       string `json:"key"`
+	RevokedAt int64  `json:"revoked_at"`
+	Reason    string `json:"reason"`
+}
+
+// revocationAdvice describes how the revocation list of an account JWT can be compacted
+type revocationAdvice struct {
+	Account     string             `json:"account"`
+	JTI         string             `json:"jti"`
+	WindowMS    int64              `json:"window_ms"`
+	Total       int                `json:"total"`
+	Removable   []revocationEntry  `json:"removable"`
+	Revocations jwt.RevocationList `json:"revocations"` // the suggested compacted list
+	BytesSaved  int                `json:"bytes_saved"` // approximate, before encoding
+	Applied     bool               `json:"applied"`
+}
+
+// compactRevocations returns the entries of revocations that no longer revoke a valid user JWT
+// at now, users are assumed to expire within window, a zero window only drops entries covered by
+// the wildcard entry
+func compactRevocations(revocations jwt.RevocationList, window time.Duration, now time.Time) []revocationEntry {
+	removable := []revocationEntry{}
+	all, hasAll := revocations[jwt.All]
+	for key, at := range revocations {
+		switch {
+		case window > 0 && time.Unix(at, 0).Add(window).Before(now):
+			removable = append(removable, revocationEntry{Key: key, RevokedAt: at, Reason: revokedAndExpired})
+		case key != jwt.All && hasAll && all >= at:
+			removable = append(removable, revocationEntry{Key: key, RevokedAt: at, Reason: revokedByWildcard})
+		}
+	}
+	sort.Slice(removable, func(i, j int) bool {
+		return removable[i].Key < removable[j].Key
+	})
+	return removable
+}
+
+func (server *AccountServer) adviseRevocations(claim *jwt.AccountClaims, window time.Duration) *revocationAdvice {
+	advice := &revocationAdvice{
+		Account:     claim.Subject,
+		JTI:         claim.ID,
+		WindowMS:    int64(window / time.Millisecond),
+		Total:       len(claim.Revocations),
+		Removable:   compactRevocations(claim.Revocations, window, time.Now()),
+		Revocations: jwt.RevocationList{},
+	}
+	for key, at := range claim.Revocations {
+		advice.Revocations[key] = at
+	}
+	for _, e := range advice.Removable {
+		delete(advice.Revocations, e.Key)
+	}
+	before, _ := json.Marshal(claim.Revocations)
+	after, _ := json.Marshal(advice.Revocations)
+	advice.BytesSaved = len(before) - len(after)
+	return advice
+}
+
+// revocationWindow is the window query parameter in milliseconds, or the configured window
+func (server *AccountServer) revocationWindow(r *http.Request) (time.Duration, error) {
+	ms := int64(server.config.Admin.RevocationWindow)
+	if window := r.URL.Query().Get("window"); window != "" {
+		var err error
+		if ms, err = strconv.ParseInt(window, 10, 64); err != nil || ms < 0 {
+			return 0, fmt.Errorf("bad window %q", window)
+		}
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// loadRevocationAdvice handles the parts common to getting and applying the advice, on failure
+// the error response is sent and nil is returned
+func (server *AccountServer) loadRevocationAdvice(w http.ResponseWriter, r *http.Request, account string) (*jwt.AccountClaims, *revocationAdvice) {
+	window, err := server.revocationWindow(r)
+	if err != nil {
+		server.jwt.sendErrorResponse(http.StatusBadRequest, "window must be a number of milliseconds", "", err, w)
+		return nil, nil
+	}
+	found, claim := server.jwt.loadAccountJWT(account)
+	if !found {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no account JWT", ShortKey(account), nil, w)
+		return nil, nil
+	}
+	return claim, server.adviseRevocations(claim, window)
+}
+
+// getRevocations handles GET /admin/v1/revocations/:pubkey, returning the suggested compaction
+func (server *AccountServer) getRevocations(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if _, advice := server.loadRevocationAdvice(w, r, params.ByName("pubkey")); advice != nil {
+		server.writeJSON(w, http.StatusOK, advice)
+	}
+}
+
+// applyRevocations handles POST /admin/v1/revocations/:pubkey. The compacted claims are sent through
+// the signing service, the same way self signed account JWTs are, and the signed JWT is stored.
+func (server *AccountServer) applyRevocations(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h := &server.jwt
+	account := params.ByName("pubkey")
+	shortCode := ShortKey(account)
+	if h.sign == nil {
+		h.sendErrorResponse(http.StatusNotImplemented, "signing service not enabled", shortCode, nil, w)
+		return
+	}
+	claim, advice := server.loadRevocationAdvice(w, r, account)
+	if advice == nil {
+		return
+	}
+	if len(advice.Removable) == 0 {
+		server.writeJSON(w, http.StatusOK, advice)
+		return
+	}
+
+	claim.Revocations = advice.Revocations
+	theJWT, signed, status, failure, err := h.resignAccount(claim)
+	if err != nil {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		h.sendErrorResponse(status, failure, shortCode, err, w)
+		return
+	}
+	if theJWT == nil {
+		h.logger.Noticef("%s Initiated JWT signing process for compacted revocations", shortCode)
+		server.writeJSON(w, http.StatusAccepted, advice)
+		return
+	}
+	if failure, err := h.saveAccount(r.Context(), account, theJWT, nil); err != nil && !notificationPending(err) {
+		h.sendErrorResponse(http.StatusInternalServerError, failure, shortCode, err, w)
+		return
+	}
+	h.logger.Noticef("compacted %d revocations for account - %s - %s", len(advice.Removable), shortCode, signed.ID)
+	advice.JTI = signed.ID
+	advice.Applied = true
+	server.writeJSON(w, http.StatusOK, advice)
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func userKey(t *testing.T) string {
+	kp, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	pubKey, err := kp.PublicKey()
+	require.NoError(t, err)
+	return pubKey
+}
+
+func TestRevocationCompaction(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Admin.RevocationWindow = int(time.Hour / time.Millisecond)
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	now := time.Now()
+	expired, covered, kept := userKey(t), userKey(t), userKey(t)
+	claim := jwt.NewAccountClaims(pubKey)
+	claim.RevokeAt(jwt.All, now.Add(-30*time.Minute))
+	claim.RevokeAt(expired, now.Add(-2*time.Hour))
+	claim.RevokeAt(covered, now.Add(-40*time.Minute))
+	claim.RevokeAt(kept, now.Add(-5*time.Minute))
+	acctJWT, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(acctJWT)))
+
+	status, _ := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/revocations/"+pubKey+"?window=soon", testAdminToken, "")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = adminRequest(t, testEnv, http.MethodGet, "/admin/v1/revocations/"+userKey(t), testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/revocations/"+pubKey+"?window=0", testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	advice := revocationAdvice{}
+	require.NoError(t, json.Unmarshal([]byte(body), &advice))
+	require.Equal(t, 4, advice.Total)
+	require.Len(t, advice.Removable, 2)
+	require.Len(t, advice.Revocations, 2)
+	for _, e := range advice.Removable {
+		require.Equal(t, revokedByWildcard, e.Reason)
+	}
+
+	status, body = adminRequest(t, testEnv, http.MethodGet, "/admin/v1/revocations/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	advice = revocationAdvice{}
+	require.NoError(t, json.Unmarshal([]byte(body), &advice))
+	require.Equal(t, int64(3600000), advice.WindowMS)
+	require.Len(t, advice.Removable, 2)
+	reasons := map[string]string{}
+	for _, e := range advice.Removable {
+		reasons[e.Key] = e.Reason
+	}
+	require.Equal(t, map[string]string{expired: revokedAndExpired, covered: revokedByWildcard}, reasons)
+	require.Contains(t, advice.Revocations, kept)
+	require.Contains(t, advice.Revocations, jwt.All)
+	require.True(t, advice.BytesSaved > 0)
+	require.False(t, advice.Applied)
+
+	// applying needs the signing service
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/revocations/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusNotImplemented, status)
+}
+
+func TestRevocationCompactionApply(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.SignRequestSubject = "sign"
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, err = testEnv.NC.Subscribe("sign", func(msg *nats.Msg) {
+		claim, err := jwt.DecodeAccountClaims(string(msg.Data))
+		require.NoError(t, err)
+		token, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		msg.Respond([]byte(token))
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	kept := userKey(t)
+	claim := jwt.NewAccountClaims(pubKey)
+	claim.RevokeAt(jwt.All, time.Now().Add(-time.Minute))
+	claim.RevokeAt(userKey(t), time.Now().Add(-time.Hour))
+	claim.RevokeAt(kept, time.Now())
+	acctJWT, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(acctJWT)))
+
+	status, body := adminRequest(t, testEnv, http.MethodPost, "/admin/v1/revocations/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	advice := revocationAdvice{}
+	require.NoError(t, json.Unmarshal([]byte(body), &advice))
+	require.True(t, advice.Applied)
+	require.Len(t, advice.Removable, 1)
+
+	stored, err := testEnv.Server.JWTStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	compacted, err := jwt.DecodeAccountClaims(stored)
+	require.NoError(t, err)
+	require.Equal(t, testEnv.OperatorPubKey, compacted.Issuer)
+	require.Equal(t, advice.JTI, compacted.ID)
+	require.Len(t, compacted.Revocations, 2)
+	require.Contains(t, compacted.Revocations, kept)
+
+	// nothing left to compact
+	status, body = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/revocations/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	advice = revocationAdvice{}
+	require.NoError(t, json.Unmarshal([]byte(body), &advice))
+	require.False(t, advice.Applied)
+	require.Empty(t, advice.Removable)
+}
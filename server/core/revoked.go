@@ -0,0 +1,237 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+)
+
+var errAccountRevoked = errors.New("account is revoked")
+
+// revokedAccount is an account that is no longer served
+type revokedAccount struct {
+	Account    string    `json:"account"`
+	RevokedAt  time.Time `json:"revoked_at"`
+	Reason     string    `json:"reason,omitempty"`
+	Configured bool      `json:"configured,omitempty"` // revoked by the configuration, it can't be lifted on the API
+	Notified   bool      `json:"notified"`             // a delete notification was published
+}
+
+// revokedAccounts holds the accounts revoked by the configuration and on the admin API, only the
+// latter are saved to the file
+type revokedAccounts struct {
+	sync.RWMutex
+	path     string
+	accounts map[string]revokedAccount
+}
+
+// loadRevokedAccounts reads the revoked accounts from the configuration and the file, a missing file is empty
+func loadRevokedAccounts(config conf.RevokedAccountsConfig) (*revokedAccounts, error) {
+	x := &revokedAccounts{path: config.File, accounts: map[string]revokedAccount{}}
+	if config.File != "" {
+		data, err := os.ReadFile(config.File)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		} else if err == nil {
+			var accounts []revokedAccount
+			if err := json.Unmarshal(data, &accounts); err != nil {
+				return nil, fmt.Errorf("error reading revoked accounts %s: %v", config.File, err)
+			}
+			for _, a := range accounts {
+				x.accounts[a.Account] = a
+			}
+		}
+	}
+	now := time.Now().UTC()
+	for _, k := range config.Accounts {
+		if !nkeys.IsValidPublicAccountKey(k) {
+			return nil, fmt.Errorf("revoked account %q is not an account public key", k)
+		}
+		a, ok := x.accounts[k]
+		if !ok {
+			a = revokedAccount{Account: k, RevokedAt: now}
+		}
+		a.Configured = true
+		x.accounts[k] = a
+	}
+	return x, nil
+}
+
+// has returns true if the account is revoked, a nil list holds nothing
+func (x *revokedAccounts) has(pubKey string) bool {
+	if x == nil {
+		return false
+	}
+	x.RLock()
+	defer x.RUnlock()
+	_, ok := x.accounts[pubKey]
+	return ok
+}
+
+// save writes the accounts revoked on the API, assumes the lock is held
+func (x *revokedAccounts) save() error {
+	if x.path == "" {
+		return nil
+	}
+	accounts := []revokedAccount{}
+	for _, a := range x.accounts {
+		if !a.Configured {
+			accounts = append(accounts, a)
+		}
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, x.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// add revokes the account, or updates the entry if it is revoked already
+func (x *revokedAccounts) add(a revokedAccount) (revokedAccount, error) {
+	x.Lock()
+	defer x.Unlock()
+	old, existed := x.accounts[a.Account]
+	if existed {
+		a.RevokedAt = old.RevokedAt
+		a.Configured = old.Configured
+		a.Notified = a.Notified || old.Notified
+		if a.Reason == "" {
+			a.Reason = old.Reason
+		}
+	}
+	x.accounts[a.Account] = a
+	if err := x.save(); err != nil {
+		if existed {
+			x.accounts[a.Account] = old
+		} else {
+			delete(x.accounts, a.Account)
+		}
+		return a, err
+	}
+	return a, nil
+}
+
+// remove lifts the revocation, accounts revoked by the configuration stay revoked
+func (x *revokedAccounts) remove(pubKey string) (int, error) {
+	x.Lock()
+	defer x.Unlock()
+	a, ok := x.accounts[pubKey]
+	if !ok {
+		return http.StatusNotFound, errors.New("account is not revoked")
+	} else if a.Configured {
+		return http.StatusConflict, errors.New("account is revoked by the configuration")
+	}
+	delete(x.accounts, pubKey)
+	if err := x.save(); err != nil {
+		x.accounts[pubKey] = a
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+func (x *revokedAccounts) list() []revokedAccount {
+	x.RLock()
+	defer x.RUnlock()
+	accounts := make([]revokedAccount, 0, len(x.accounts))
+	for _, a := range x.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Account < accounts[j].Account
+	})
+	return accounts
+}
+
+// listRevoked handles GET /admin/v1/revoked
+func (server *AccountServer) listRevoked(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.writeJSON(w, http.StatusOK, server.jwt.revoked.list())
+}
+
+// revokeAccount handles PUT /admin/v1/revoked/:pubkey?reason=<reason>. The optional body is the
+// operator signed delete proof, it is published so the nats-server full resolvers drop the account.
+func (server *AccountServer) revokeAccount(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h := &server.jwt
+	pubKey := params.ByName("pubkey")
+	shortCode := ShortKey(pubKey)
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		h.sendErrorResponse(http.StatusBadRequest, "bad account public key", shortCode, nil, w)
+		return
+	}
+	if h.isSystemAccount(pubKey) {
+		h.sendErrorResponse(http.StatusBadRequest, "the system account can't be revoked", shortCode, nil, w)
+		return
+	}
+	proof, ok := h.readBody(w, r, "bad delete proof in request", shortCode)
+	if !ok {
+		return
+	}
+	if len(proof) > 0 {
+		if status, failure := h.checkDeleteProof(pubKey, proof); status != 0 {
+			h.sendErrorResponse(status, failure, shortCode, nil, w)
+			return
+		}
+	}
+
+	a, err := h.revoked.add(revokedAccount{Account: pubKey, RevokedAt: time.Now().UTC(), Reason: r.URL.Query().Get("reason")})
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error saving revoked accounts", shortCode, err, w)
+		return
+	}
+	server.logger.Noticef("%s - account revoked", shortCode)
+
+	if len(proof) > 0 && h.sendDeleteNotification != nil {
+		if err := h.sendDeleteNotification(pubKey, proof); err != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "error sending notification of delete", shortCode, err, w)
+			return
+		}
+		a.Notified = true
+		if a, err = h.revoked.add(a); err != nil {
+			server.logger.Errorf("%s - error saving revoked accounts - %v", shortCode, err)
+		}
+	}
+	server.writeJSON(w, http.StatusOK, a)
+}
+
+// unrevokeAccount handles DELETE /admin/v1/revoked/:pubkey, the resolvers only get the account back
+// when its JWT is posted again
+func (server *AccountServer) unrevokeAccount(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pubKey := params.ByName("pubkey")
+	if status, err := server.jwt.revoked.remove(pubKey); err != nil {
+		server.jwt.sendErrorResponse(status, err.Error(), ShortKey(pubKey), nil, w)
+		return
+	}
+	server.logger.Noticef("%s - account revocation lifted", ShortKey(pubKey))
+	w.WriteHeader(http.StatusOK)
+}
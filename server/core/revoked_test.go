@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevokedAccounts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "revoked.json")
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = "secret"
+	config.Revoked.File = file
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKey, acctJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(acctJWT)))
+	get := func() int {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, get())
+
+	notifications := make(chan *nats.Msg, 1)
+	_, err = testEnv.NC.ChanSubscribe(fmt.Sprintf(accountDeleteFormat, pubKey), notifications)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	claim := jwt.NewGenericClaims(testEnv.OperatorPubKey)
+	claim.Data["accounts"] = []string{pubKey}
+	proof, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	status, _ := adminRequest(t, testEnv, http.MethodPut, "/admin/v1/revoked/"+testEnv.SystemAccountPubKey, "secret", "")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, body := adminRequest(t, testEnv, http.MethodPut, "/admin/v1/revoked/"+pubKey+"?reason=leaked", "secret", proof)
+	require.Equal(t, http.StatusOK, status)
+	revoked := revokedAccount{}
+	require.NoError(t, json.Unmarshal([]byte(body), &revoked))
+	require.Equal(t, "leaked", revoked.Reason)
+	require.True(t, revoked.Notified)
+	select {
+	case msg := <-notifications:
+		require.Equal(t, proof, string(msg.Data))
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delete notification")
+	}
+
+	require.Equal(t, http.StatusNotFound, get())
+	require.Equal(t, http.StatusForbidden, postJWT(t, testEnv, pubKey, []byte(acctJWT)))
+	_, err = testEnv.NC.Request(fmt.Sprintf(accountLookupRequest, pubKey), nil, 250*time.Millisecond)
+	require.Error(t, err)
+
+	// the revocation survives restarts
+	reloaded, err := loadRevokedAccounts(conf.RevokedAccountsConfig{File: file})
+	require.NoError(t, err)
+	require.True(t, reloaded.has(pubKey))
+
+	status, _ = adminRequest(t, testEnv, http.MethodDelete, "/admin/v1/revoked/"+pubKey, "secret", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusOK, get())
+	status, _ = adminRequest(t, testEnv, http.MethodDelete, "/admin/v1/revoked/"+pubKey, "secret", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestRevokedAccountsFromConfig(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Revoked.Accounts = []string{"not a key"}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	config = conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Revoked.Accounts = []string{pubKey}
+	testEnv, err = SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(pubKey, acctJWT))
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	status, _ := adminRequest(t, testEnv, http.MethodDelete, "/admin/v1/revoked/"+pubKey, testAdminToken, "")
+	require.Equal(t, http.StatusConflict, status)
+}
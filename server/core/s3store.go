@@ -0,0 +1,296 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/internal/awsv4"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	defaultS3Region  = "us-east-1"
+	defaultS3Timeout = 10 * time.Second
+)
+
+func init() {
+	RegisterStoreBackend("s3", newS3Store)
+}
+
+// s3Store keeps every account JWT in an object named <prefix><pubkey>.jwt, it speaks the S3 API
+// signed with AWS signature version 4, which AWS, MinIO and GCS (with HMAC keys) all accept
+type s3Store struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	pathStyle bool
+	now       func() time.Time
+}
+
+func newS3Store(config conf.StoreConfig) (store.JWTStore, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("store type s3 requires a bucket")
+	}
+	ss := &s3Store{
+		bucket:    config.Bucket,
+		prefix:    config.Prefix,
+		region:    config.Region,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		pathStyle: config.PathStyle,
+		now:       time.Now,
+	}
+	if ss.region == "" {
+		ss.region = defaultS3Region
+	}
+	if ss.accessKey == "" && ss.secretKey == "" {
+		ss.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		ss.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	} else {
+		ss.token = "" // the session token belongs to the environment credentials
+	}
+	if ss.accessKey == "" || ss.secretKey == "" {
+		return nil, fmt.Errorf("store type s3 requires an access_key and secret_key")
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", ss.region)
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad store endpoint %q", endpoint)
+	}
+	ss.endpoint = u
+	timeout := defaultS3Timeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	ss.client = &http.Client{Timeout: timeout}
+	return ss, nil
+}
+
+// objectURL returns the URL of the object name, or of the bucket if name is empty
+func (ss *s3Store) objectURL(name string, query url.Values) *url.URL {
+	u := *ss.endpoint
+	if ss.pathStyle {
+		u.Path = u.Path + "/" + ss.bucket + "/" + name
+	} else {
+		u.Host = ss.bucket + "." + u.Host
+		u.Path = u.Path + "/" + name
+	}
+	u.RawPath = awsv4.EscapePath(u.Path) // sent as signed
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return &u
+}
+
+func (ss *s3Store) objectName(publicKey string) string {
+	return ss.prefix + publicKey + ".jwt"
+}
+
+// do sends a signed request and returns the response body if the status is 2xx
+func (ss *s3Store) do(method string, u *url.URL, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	ss.sign(req, body)
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, resp.StatusCode, fmt.Errorf("%s %s returned %d", method, u.Path, resp.StatusCode)
+	}
+	return data, resp.StatusCode, nil
+}
+
+// sign adds the AWS signature version 4 headers, every header already set on req is signed
+func (ss *s3Store) sign(req *http.Request, body []byte) {
+	req.Header.Set("X-Amz-Content-Sha256", awsv4.PayloadHash(body))
+	creds := awsv4.Credentials{AccessKey: ss.accessKey, SecretKey: ss.secretKey, Token: ss.token}
+	awsv4.Sign(req, body, creds, ss.region, "s3", ss.now())
+}
+
+// get returns the stored JWT, found is false if there is none
+func (ss *s3Store) get(publicKey string) (string, bool, error) {
+	data, status, err := ss.do(http.MethodGet, ss.objectURL(ss.objectName(publicKey), nil), nil)
+	if status == http.StatusNotFound {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+func (ss *s3Store) LoadAcc(publicKey string) (string, error) {
+	theJWT, found, err := ss.get(publicKey)
+	if err == nil && !found {
+		err = fmt.Errorf("no JWT for %s", ShortKey(publicKey))
+	}
+	return theJWT, err
+}
+
+func (ss *s3Store) SaveAcc(publicKey string, theJWT string) error {
+	_, _, err := ss.do(http.MethodPut, ss.objectURL(ss.objectName(publicKey), nil), []byte(theJWT))
+	return err
+}
+
+// DeleteAcc checks the object exists first, since S3 reports success for deletes of missing objects
+func (ss *s3Store) DeleteAcc(publicKey string) error {
+	u := ss.objectURL(ss.objectName(publicKey), nil)
+	if _, status, err := ss.do(http.MethodHead, u, nil); status == http.StatusNotFound {
+		return errAccountNotFound
+	} else if err != nil {
+		return err
+	}
+	_, _, err := ss.do(http.MethodDelete, u, nil)
+	return err
+}
+
+func (ss *s3Store) IsReadOnly() bool {
+	return false
+}
+
+func (ss *s3Store) Close() {
+	ss.client.CloseIdleConnections()
+}
+
+// listBucketResult is the part of the ListObjectsV2 response the store uses
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// keys lists the public keys of the stored JWTs, one page of up to 1000 at a time
+func (ss *s3Store) keys() ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {ss.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		data, _, err := ss.do(http.MethodGet, ss.objectURL("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		result := listBucketResult{}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, ss.prefix)
+			if pubKey := strings.TrimSuffix(name, ".jwt"); pubKey != name && !strings.Contains(pubKey, "/") {
+				keys = append(keys, pubKey)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// size is the number of JWTs in the bucket, 0 if it can't be listed
+func (ss *s3Store) size() int {
+	keys, _ := ss.keys()
+	return len(keys)
+}
+
+// Pack returns up to maxJWTs unexpired JWTs
+func (ss *s3Store) Pack(maxJWTs int) (string, error) {
+	keys, err := ss.keys()
+	if err != nil {
+		return "", err
+	}
+	var pack []string
+	now := time.Now().Unix()
+	for _, pubKey := range keys {
+		if len(pack) == maxJWTs {
+			break
+		}
+		theJWT, found, err := ss.get(pubKey)
+		if err != nil {
+			return "", err
+		} else if !found {
+			continue // deleted since it was listed
+		}
+		if claim, err := jwt.DecodeGeneric(theJWT); err == nil && claim.Expires > 0 && claim.Expires < now {
+			continue
+		}
+		pack = append(pack, fmt.Sprintf("%s|%s", pubKey, theJWT))
+	}
+	return strings.Join(pack, "\n"), nil
+}
+
+// Merge saves the JWTs in the pack that are newer than the stored ones, objects are written
+// one at a time, so a failed merge may have saved part of the pack
+func (ss *s3Store) Merge(pack string) error {
+	for _, line := range strings.Split(pack, "\n") {
+		if line == "" {
+			continue
+		}
+		split := strings.Split(line, "|")
+		if len(split) != 2 {
+			return fmt.Errorf("line in package didn't contain 2 entries: %q", line)
+		}
+		pubKey, theJWT := split[0], split[1]
+		if !nkeys.IsValidPublicAccountKey(pubKey) {
+			return fmt.Errorf("key to merge is not a valid public account key")
+		}
+		existing, _, err := ss.get(pubKey)
+		if err != nil {
+			return err
+		}
+		if newer, err := isNewerJWT(pubKey, existing, theJWT); err != nil {
+			return err
+		} else if !newer {
+			continue
+		}
+		if err := ss.SaveAcc(pubKey, theJWT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// scopeName describes a scoped signing key for error messages
+func scopeName(key string, scope jwt.Scope) string {
+	if us, ok := scope.(*jwt.UserScope); ok && us.Role != "" {
+		return fmt.Sprintf("%s (role %s)", ShortKey(key), us.Role)
+	}
+	return ShortKey(key)
+}
+
+// checkScopedIssuer rejects claim if the account, as stored or as posted, defines the key that signed it
+// as a scoped signing key, the scope decides which claims the key may issue
+func checkScopedIssuer(existing *jwt.AccountClaims, claim *jwt.AccountClaims) error {
+	for _, ac := range []*jwt.AccountClaims{existing, claim} {
+		if ac == nil {
+			continue
+		}
+		if scope, ok := ac.SigningKeys.GetScope(claim.Issuer); ok && scope != nil {
+			if err := scope.ValidateScopedSigner(claim); err != nil {
+				return fmt.Errorf("signed by scoped signing key %s, %v", scopeName(claim.Issuer, scope), err)
+			}
+		}
+	}
+	return nil
+}
+
+// scopeViolations validates the scoped signing keys defined by an account, naming the key in each issue
+func scopeViolations(claim *jwt.AccountClaims) []string {
+	var violations []string
+	for key, scope := range claim.SigningKeys {
+		if scope == nil {
+			continue
+		}
+		vr := &jwt.ValidationResults{}
+		scope.Validate(vr)
+		if us, ok := scope.(*jwt.UserScope); ok {
+			us.Template.Pub.Validate(vr, false)
+			us.Template.Sub.Validate(vr, true)
+		}
+		if key != scope.SigningKey() {
+			vr.AddError("scope is registered under a different key")
+		}
+		for _, vi := range vr.Errors() {
+			violations = append(violations, fmt.Sprintf("scoped signing key %s: %s", scopeName(key, scope), vi.Error()))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// seedAccounts saves the configured system account and seed JWTs into the store, so they are
+// served and synced like any other account. Accounts already in the store are only replaced by
+// newer JWTs. Assumes the lock is held, it is released while saving since saves call back into
+// the server.
+func (server *AccountServer) seedAccounts(sysJWT []byte) error {
+	var seeds [][]byte
+	if server.config.SeedSystemAccount {
+		if len(sysJWT) == 0 {
+			return fmt.Errorf("seeding the system account requires a system account JWT path")
+		}
+		seeds = append(seeds, sysJWT)
+	}
+	for _, path := range server.config.SeedAccountJWTPaths {
+		data, err := server.readJWT(path, "seed account")
+		if err != nil {
+			return err
+		}
+		seeds = append(seeds, data)
+	}
+	if len(seeds) == 0 {
+		return nil
+	}
+	if server.JWTStore.IsReadOnly() {
+		server.logger.Noticef("skipping account seeding, the store is read-only")
+		return nil
+	}
+
+	claims := make([]*jwt.AccountClaims, 0, len(seeds))
+	for _, data := range seeds {
+		claim, err := jwt.DecodeAccountClaims(string(data))
+		if err != nil {
+			return fmt.Errorf("bad seed account JWT: %v", err)
+		}
+		if _, ok := server.jwt.trustedKeys[claim.Issuer]; !ok {
+			return fmt.Errorf("seed account %s is not signed by the operator", claim.Subject)
+		}
+		claims = append(claims, claim)
+	}
+
+	jwtStore, privacy, locks := server.JWTStore, server.jwt.privacy, server.jwt.writeLocks
+	server.Unlock()
+	defer server.Lock()
+	for i, claim := range claims {
+		if err := seedAccount(jwtStore, locks, claim, string(seeds[i])); err == errSeedNotNewer {
+			server.logger.Debugf("kept account %s, the stored JWT is as new as the seed", ShortKey(claim.Subject))
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error seeding account %s: %v", claim.Subject, err)
+		}
+		server.logger.Noticef("seeded account %s - %s", ShortKey(claim.Subject), privacy.name(claim.Name))
+	}
+	return nil
+}
+
+var errSeedNotNewer = errors.New("the stored JWT is as new as the seed")
+
+// seedAccount saves the seed if the account is missing or the seed was issued after the stored JWT,
+// holding the write lock of the account so a post can't be overwritten
+func seedAccount(jwtStore store.JWTStore, locks *accountWriteLocks, claim *jwt.AccountClaims, seed string) error {
+	unlock := locks.lock(claim.Subject)
+	defer unlock()
+	if stored, err := jwtStore.LoadAcc(claim.Subject); err == nil && stored != "" {
+		if existing, err := jwt.DecodeGeneric(stored); err == nil && existing.IssuedAt >= claim.IssuedAt {
+			return errSeedNotNewer
+		}
+	}
+	return jwtStore.SaveAcc(claim.Subject, seed)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeedSystemAccount(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.SeedSystemAccount = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	stored, err := testEnv.Server.JWTStore.LoadAcc(testEnv.SystemAccountPubKey)
+	require.NoError(t, err)
+	sysJWT, err := os.ReadFile(testEnv.SystemAccountJWTFile)
+	require.NoError(t, err)
+	require.Equal(t, string(sysJWT), stored)
+}
+
+func TestSeedAccountsMustBeTrusted(t *testing.T) {
+	dir, err := os.MkdirTemp("", "seed")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	otherOperator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(otherOperator)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "acct.jwt")
+	require.NoError(t, os.WriteFile(path, []byte(acctJWT), 0644))
+
+	config := conf.DefaultServerConfig()
+	config.SeedAccountJWTPaths = []string{path}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
+
+func TestSeedOnlyReplacesOlderJWTs(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKey, olderJWT := newAccountJWT(t, testEnv.OperatorKey)
+	time.Sleep(1100 * time.Millisecond) // issued at has a resolution of seconds
+	newerJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	older, err := jwt.DecodeAccountClaims(olderJWT)
+	require.NoError(t, err)
+	newer, err := jwt.DecodeAccountClaims(newerJWT)
+	require.NoError(t, err)
+
+	jwtStore, locks := testEnv.Server.JWTStore, testEnv.Server.jwt.writeLocks
+	require.NoError(t, seedAccount(jwtStore, locks, older, olderJWT))
+	require.NoError(t, seedAccount(jwtStore, locks, newer, newerJWT))
+	require.Equal(t, errSeedNotNewer, seedAccount(jwtStore, locks, newer, newerJWT))
+	require.Equal(t, errSeedNotNewer, seedAccount(jwtStore, locks, older, olderJWT))
+	stored, err := jwtStore.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, newerJWT, stored)
+}
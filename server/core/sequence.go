@@ -0,0 +1,118 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	sequenceKey       = "seq"
+	sequenceFileName  = ".sequence"
+	kvSequenceRetries = 10
+)
+
+// sequence is a durable sequence for update responses, shared by the account servers using it
+type sequence interface {
+	next() (int64, error)
+}
+
+// sequenceStore is implemented by stores that keep the sequence of update responses next to the JWTs,
+// so the account servers sharing the store share the sequence
+type sequenceStore interface {
+	sequence() (sequence, error)
+}
+
+// fileSequence is a durable sequence kept in a file, the file is locked while the
+// sequence is incremented so several account servers can share it
+type fileSequence struct {
+	path string
+}
+
+// next increments the sequence and returns the new value
+func (s *fileSequence) next() (int64, error) {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return 0, err
+	}
+	defer unlockFile(f)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	var seq int64
+	if v := strings.TrimSpace(string(data)); v != "" {
+		if seq, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, fmt.Errorf("sequence file %s is corrupt: %v", s.path, err)
+		}
+	}
+	seq++
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.FormatInt(seq, 10)), 0); err != nil {
+		return 0, err
+	}
+	return seq, f.Sync()
+}
+
+// kvSequence is a durable sequence kept in a JetStream key value bucket, it is incremented with a
+// compare and swap on the revision so several account servers can share it
+type kvSequence struct {
+	kv nats.KeyValue
+}
+
+// next increments the sequence and returns the new value
+func (s *kvSequence) next() (int64, error) {
+	for i := 0; i < kvSequenceRetries; i++ {
+		var seq int64
+		var revision uint64
+		e, err := s.kv.Get(sequenceKey)
+		if err == nil {
+			if seq, err = strconv.ParseInt(string(e.Value()), 10, 64); err != nil {
+				return 0, fmt.Errorf("sequence in bucket %s is corrupt: %v", s.kv.Bucket(), err)
+			}
+			revision = e.Revision()
+		} else if !errors.Is(err, nats.ErrKeyNotFound) {
+			return 0, err
+		}
+		seq++
+		value := []byte(strconv.FormatInt(seq, 10))
+		if revision == 0 {
+			_, err = s.kv.Create(sequenceKey, value)
+		} else {
+			_, err = s.kv.Update(sequenceKey, value, revision)
+		}
+		if err == nil {
+			return seq, nil
+		} else if !errors.Is(err, nats.ErrKeyExists) {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("sequence in bucket %s kept changing", s.kv.Bucket())
+}
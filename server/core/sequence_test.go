@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSequenceShared(t *testing.T) {
+	dir, err := os.MkdirTemp("", "seq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seq")
+
+	// two sequences on the same file stand in for two account servers
+	seqs := []*fileSequence{{path: path}, {path: path}}
+	seen := sync.Map{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(s *fileSequence) {
+			defer wg.Done()
+			v, err := s.next()
+			require.NoError(t, err)
+			_, dup := seen.LoadOrStore(v, true)
+			require.False(t, dup)
+		}(seqs[i%2])
+	}
+	wg.Wait()
+
+	v, err := seqs[0].next()
+	require.NoError(t, err)
+	require.Equal(t, int64(21), v)
+
+	require.NoError(t, os.WriteFile(path, []byte("bad"), 0644))
+	_, err = seqs[1].next()
+	require.Error(t, err)
+}
+
+func TestUpdateResponseSharedSequence(t *testing.T) {
+	dir, err := os.MkdirTemp("", "seq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seq")
+	require.NoError(t, os.WriteFile(path, []byte("41"), 0644))
+
+	config := conf.DefaultServerConfig()
+	config.ServerName = "as-seq"
+	config.SequenceFile = path
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	ib := testEnv.NC.NewRespInbox()
+	sub, err := testEnv.NC.SubscribeSync(ib)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.PublishRequest(fmt.Sprintf(accountNotificationFormat, pubKey), ib, []byte(acctJWT)))
+
+	var info map[string]interface{}
+	for i := 0; i < 2 && info == nil; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+		resp := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(msg.Data, &resp))
+		if srv, ok := resp["server"].(map[string]interface{}); ok && srv["name"] == "as-seq" {
+			info = srv
+		}
+	}
+	require.NotNil(t, info)
+	require.Equal(t, float64(42), info["seq"])
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "42", string(data))
+
+	// a sequence that can't be incremented is left out, the update is saved
+	require.NoError(t, os.WriteFile(path, []byte("bad"), 0644))
+	require.NoError(t, testEnv.NC.PublishRequest(fmt.Sprintf(accountNotificationFormat, pubKey), ib, []byte(acctJWT)))
+	var failed map[string]interface{}
+	for i := 0; i < 2 && failed == nil; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+		resp := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(msg.Data, &resp))
+		if srv, ok := resp["server"].(map[string]interface{}); ok && srv["name"] == "as-seq" {
+			failed = resp
+		}
+	}
+	require.NotNil(t, failed)
+	require.Nil(t, failed["error"])
+	require.NotNil(t, failed["data"])
+	require.NotContains(t, failed["server"], "seq")
+}
+
+func TestStoreSequence(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.SequenceStore = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	for i := int64(1); i <= 2; i++ {
+		require.Equal(t, i, testEnv.Server.responseInfo()["seq"])
+	}
+	data, err := os.ReadFile(filepath.Join(testEnv.Server.config.Store.Dir, sequenceFileName))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(data))
+
+	config = conf.DefaultServerConfig()
+	config.SequenceStore = true
+	config.SequenceFile = filepath.Join(t.TempDir(), "seq")
+	other, err := SetupTestServer(config, false, false)
+	defer other.Cleanup()
+	require.Error(t, err)
+}
@@ -17,15 +17,21 @@
 package core
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jwt/v2" // only used to decode jwt subjects
@@ -37,8 +43,6 @@ import (
 	"github.com/nats-io/nkeys"
 )
 
-const version = "1.0.0"
-
 // AccountServer is the core structure for the server.
 type AccountServer struct {
 	sync.Mutex
@@ -49,20 +53,65 @@ type AccountServer struct {
 	logger natsserver.Logger
 	config *conf.AccountServerConfig
 
-	respSeqNo    int64
-	nats         *nats.Conn
-	natsTimer    *time.Timer
-	shutdownNats func()
-
-	listener net.Listener
-	http     *http.Server
-	protocol string
-	port     int
-	hostPort string
+	respSeqNo       int64
+	lookup          []string
+	readThrough     *readThroughCache // set in cache mode, tracks the JWTs fetched from the upstream
+	sequence        sequence
+	nats            *nats.Conn
+	inProcess       nats.InProcessConnProvider // set when embedded, the nats-server connected to in process
+	natsTimer       *time.Timer
+	shutdownNats    func()
+	stopHeartbeat   chan struct{}
+	stopExporters   chan struct{}
+	stopAccessStats chan struct{}
+	stopSysAccWatch chan struct{}
+	stopConsistency chan struct{}
+	degraded        string // why the server isn't ready, empty when it is
+
+	levels       *levelLogger   // set if the log level can be changed by overrides
+	syncInterval time.Duration  // time between pack requests set by an override, overrides the configured interval
+	syncTimer    *time.Timer    // drives the pack requests while connected
+	syncStats    *syncStats     // pack requests and merges since the server connected, nil if it doesn't sync
+	packShards   shardHashCache // hashes of the shards of the store, sent with pack requests and compared by responders
+	lastNotified atomic.Int64   // unix nanoseconds of the last notification published, 0 if none was
+	lameDuck     bool           // set by an override, the server reports it isn't ready
+	overrides    *overrideStats // settings changed by overrides, nil if none were applied
+	lastOverride overrideMark   // the last override applied, read from the overrides file on start
+
+	listener  net.Listener
+	http      *http.Server
+	httpStats *httpCounters // requests served since the HTTP server started
+	jwtCount  jwtCount      // the number of stored JWTs reported in /varz
+	tracer    *tracer       // exports spans to an OTLP collector, nil unless tracing is configured
+	protocol  string
+	port      int
+	hostPort  string
+	socket    string // the unix socket path when the HTTP server listens on one
 
 	store.JWTStore
-	jwt JwtHandler
-	id  string
+	jwt     JwtHandler
+	id      string
+	metrics *metrics
+
+	snapshots    *snapshotStore
+	merges       *mergeTracer
+	packs        *packGuard         // limits the responses to pack requests over NATS
+	subjects     *natsSubjects      // of notifications and requests, the defaults unless configured
+	natsAuth     []nats.Option      // authenticate the NATS connection
+	notifyQueue  *notificationQueue // notifications waiting for NATS, nil unless configured
+	notifyRetry  *notificationRetry // failed notifications published again, nil unless configured
+	provisioning *provisioningIndex // accounts created by the provisioning API, nil if it is disabled
+	tenants      []*tenant          // stores served under /jwt/v1/<tenant>/, in the order they are configured
+
+	consistency *consistencyReport // the last comparison with the nats-server resolvers
+	checkInbox  string             // prefix of the consistency check inboxes, not answered by this server
+
+	hooks       []Hooks      // embedder hooks, handed to the handler on Start
+	middlewares []Middleware // added by embedders, around every route
+
+	ctxLock sync.Mutex // separate from the server lock, so Stop can cancel a Start in progress
+	ctx     context.Context
+	cancel  context.CancelFunc
 }
 
 // NewAccountServer creates a new account server with a default logger
@@ -70,12 +119,42 @@ func NewAccountServer() *AccountServer {
 	kp, _ := nkeys.CreateServer()
 	pub, _ := kp.PublicKey()
 	ac := &AccountServer{
-		logger: NewNilLogger(),
-		id:     pub,
+		logger:     NewNilLogger(),
+		id:         pub,
+		metrics:    newMetrics(),
+		checkInbox: nats.NewInbox(),
 	}
 	return ac
 }
 
+// context returns the context of the running server, it is canceled by Stop
+func (server *AccountServer) context() context.Context {
+	server.ctxLock.Lock()
+	defer server.ctxLock.Unlock()
+	if server.ctx == nil {
+		server.ctx, server.cancel = context.WithCancel(context.Background())
+	}
+	return server.ctx
+}
+
+// resetContext replaces a context canceled by a previous Stop
+func (server *AccountServer) resetContext() context.Context {
+	server.ctxLock.Lock()
+	defer server.ctxLock.Unlock()
+	if server.ctx == nil || server.ctx.Err() != nil {
+		server.ctx, server.cancel = context.WithCancel(context.Background())
+	}
+	return server.ctx
+}
+
+func (server *AccountServer) cancelContext() {
+	server.ctxLock.Lock()
+	defer server.ctxLock.Unlock()
+	if server.cancel != nil {
+		server.cancel()
+	}
+}
+
 func (server *AccountServer) Config() *conf.AccountServerConfig {
 	return server.config
 }
@@ -83,14 +162,33 @@ func (server *AccountServer) Config() *conf.AccountServerConfig {
 // ConfigureLogger configures the logger for this account server
 func (server *AccountServer) ConfigureLogger() natsserver.Logger {
 	opts := server.config.Logging
-	if opts.Custom != nil {
-		return opts.Custom
-	}
-	if isWindowsService() {
+	if server.config.AcceptOverrides {
+		// log everything and filter, so the level can be raised by an override
+		debug, trace := opts.Debug, opts.Trace
+		opts.Debug, opts.Trace = true, true
+		server.levels = newLevelLogger(server.newLogger(opts), debug, trace)
+		return server.levels
+	}
+	return server.newLogger(opts)
+}
+
+func (server *AccountServer) newLogger(opts conf.LogConfig) natsserver.Logger {
+	logger := opts.Custom
+	if logger == nil && isWindowsService() {
 		srvlogger.SetSyslogName("NatsAccountServer")
-		return srvlogger.NewSysLogger(opts.Debug, opts.Trace)
+		logger = srvlogger.NewSysLogger(opts.Debug, opts.Trace)
+	} else if logger == nil {
+		logger = srvlogger.NewStdLogger(opts.Time, opts.Debug, opts.Trace, opts.Colors, opts.PID)
+	}
+	obfuscate, err := keyObfuscator(opts)
+	if err != nil {
+		// Start refuses the configuration, until then keys are hashed rather than leaked
+		obfuscate = keyObfuscators["hash"]
+	}
+	if obfuscate != nil {
+		return &keyLogger{Logger: logger, obfuscate: obfuscate}
 	}
-	return srvlogger.NewStdLogger(opts.Time, opts.Debug, opts.Trace, opts.Colors, opts.PID)
+	return logger
 }
 
 // Logger hosts a shared logger
@@ -201,11 +299,65 @@ func (server *AccountServer) Start() error {
 
 	server.running = true
 	server.startTime = time.Now()
+	ctx := server.resetContext()
+
+	if server.config.ServerID != "" {
+		server.id = server.config.ServerID
+	}
+	server.sequence = nil
+	if server.config.SequenceFile != "" {
+		if server.config.SequenceStore {
+			return fmt.Errorf("sequencefile and sequencestore can't both be set")
+		}
+		server.sequence = &fileSequence{path: server.config.SequenceFile}
+	}
+	server.lastOverride = overrideMark{}
+	if server.config.AcceptOverrides && server.config.OverridesFile != "" {
+		mark, err := loadOverrideMark(server.config.OverridesFile)
+		if err != nil {
+			return fmt.Errorf("error reading the overrides file: %v", err)
+		}
+		server.lastOverride = mark
+	}
 
-	server.logger.Noticef("starting NATS Account server, version %s", version)
+	build := Build()
+	server.logger.Noticef("starting NATS Account server, version %s", build.Version)
+	if build.GitCommit != "" {
+		server.logger.Noticef("git commit %s", build.GitCommit)
+	}
+	if build.BuildDate != "" {
+		server.logger.Noticef("built on %s", build.BuildDate)
+	}
+	server.logger.Noticef("go version %s", build.GoVersion)
 	server.logger.Noticef("server time is %s", server.startTime.Format(time.UnixDate))
 
+	operatorPaths := server.operatorPaths()
+	if server.config.Strict && len(operatorPaths) == 0 && !server.config.AllowUnverified {
+		return errors.New(StrictError)
+	}
+	if _, err := keyObfuscator(server.config.Logging); err != nil {
+		return err
+	}
+	for _, k := range server.config.NATSUpdates.AllowedIssuers {
+		if !nkeys.IsValidPublicOperatorKey(k) {
+			return fmt.Errorf("allowed issuer %s is not an operator public key", k)
+		}
+	}
+
 	server.jwt = NewJwtHandler(server.logger)
+	privacy, err := newPrivacy(server.config.Privacy)
+	if err != nil {
+		return err
+	}
+	server.jwt.privacy = privacy
+	server.jwt.isAdmin = server.hasAdminToken
+	server.jwt.authorizeWrite = server.authorizeWrite
+	server.jwt.hooks = server.hooks
+	server.describeHooks()
+	if server.tracer, err = newTracer(server.config.Tracing, server.id, server.logger, server.metrics); err != nil {
+		return err
+	}
+	server.jwt.tracer = server.tracer
 
 	store, err := server.createStore()
 	if err != nil {
@@ -213,32 +365,196 @@ func (server *AccountServer) Start() error {
 	} else {
 		server.JWTStore = store
 	}
-	if len(server.config.NATS.Servers) > 0 {
+	if server.config.SequenceStore {
+		seqs, ok := store.(sequenceStore)
+		if !ok {
+			return fmt.Errorf("store type %s can't keep the sequence, use sequencefile", server.config.Store.Type)
+		}
+		if server.sequence, err = seqs.sequence(); err != nil {
+			return fmt.Errorf("error opening the sequence in the store: %v", err)
+		}
+	}
+	if err := server.watchStore(); err != nil {
+		return err
+	}
+	primary := ""
+	if primaries := server.primaries(); len(primaries) > 0 {
+		primary = primaries[0]
+	}
+	if server.lookup, err = lookupChain(server.config.Lookup, primary); err != nil {
+		return err
+	}
+	if err := server.initReadThrough(); err != nil {
+		return err
+	}
+	packLimit := server.config.MaxReplicationPack
+	if _, ok := store.(*passThroughStore); ok {
+		// lookups are done by the store and there is nothing to pack
+		packLimit = 0
+	} else if len(server.config.NATS.Servers) > 0 || len(server.config.Lookup) > 0 {
 		store = server
 	}
+	if server.snapshots, err = loadSnapshots(server.config.Admin.SnapshotDir); err != nil {
+		return err
+	}
+	if err := server.initProvisioning(); err != nil {
+		return err
+	}
+	server.degraded = ""
+	server.metrics.gaugeFunc("degraded", "1 while the server is not ready, for example before the initial sync with the primary", func() float64 {
+		if server.degradedReason() != "" {
+			return 1
+		}
+		return 0
+	})
+	server.metrics.describe("primary_sync_attempts_total", "counter", "Number of requests for the initial pack from the primary")
+	server.metrics.describe("resyncs_total", "counter", "Number of pack requests forced on the admin API or over NATS")
+	if server.packs, err = newPackGuard(server.config.NATS.PackResponder, server.metrics); err != nil {
+		return err
+	}
+	if server.subjects, err = newNATSSubjects(server.config.Subjects); err != nil {
+		return err
+	}
+	if server.natsAuth, err = natsAuthOptions(server.config.NATS); err != nil {
+		return err
+	}
+	if server.jwt.users, err = newUserStore(server.config.Users); err != nil {
+		return err
+	} else if server.jwt.users != nil {
+		server.logger.Noticef("keeping user JWTs at %s", server.config.Users.Dir)
+		server.jwt.sendUserNotification = server.sendUserNotification
+	}
+	if server.notifyQueue, err = newNotificationQueue(server.config.NotificationQueue, server.metrics); err != nil {
+		return err
+	} else if server.notifyQueue != nil && len(server.config.NATS.Servers) == 0 {
+		server.logger.Warnf("notification queue is not used, NATS is not configured")
+		server.notifyQueue = nil
+	}
+	if server.notifyQueue != nil && server.config.NotificationRetry.Attempts != 0 {
+		server.logger.Warnf("notification retry is not used, failed notifications are queued")
+		server.notifyRetry = nil
+	} else if server.notifyRetry, err = newNotificationRetry(server.config.NotificationRetry, server.republish, server.logger, server.metrics); err != nil {
+		return err
+	}
+	server.merges = nil
+	if server.config.TraceMerges {
+		server.merges = &mergeTracer{}
+	}
 	server.Unlock()
-	err = server.initializeFromPrimary()
+	err = server.initializeFromPrimary(ctx)
 	server.Lock()
 	if err != nil {
 		return err
 	}
+	if err := server.initJTIIndex(); err != nil {
+		return err
+	}
+	if err := server.initTagIndex(); err != nil {
+		return err
+	}
 
 	if err := server.connectToNATS(); err != nil {
 		return err
 	}
 
 	var sign accountSignup
-	if server.config.SignRequestSubject != "" {
-		sign = server.accountSignatureRequest
+	signers, err := newSignService(server.config, func(subject string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+		return server.getNatsConnection().Request(subject, data, timeout)
+	}, server.metrics)
+	if err != nil {
+		return err
+	} else if signers != nil {
+		sign = newSignLimiter(server.config.SignConcurrency, server.config.SignQueueDepth, server.config.SignQueueTimeout, server.metrics).wrap(signers.sign)
 	}
-	if opJWT, err := server.readJWT(server.config.OperatorJWTPath, "operator"); err != nil {
+	local, err := newLocalSigner(server.config)
+	if err != nil {
+		return err
+	} else if local != nil {
+		sign = local.sign
+	}
+	var firstOperator string
+	if len(operatorPaths) > 0 {
+		firstOperator = operatorPaths[0]
+	}
+	if opJWT, err := server.readJWT(firstOperator, "operator"); err != nil {
 		return err
 	} else if sysJWT, err := server.readJWT(server.config.SystemAccountJWTPath, "system account"); err != nil {
 		return err
-	} else if err := server.jwt.Initialize(opJWT, sysJWT, store, server.config.MaxReplicationPack, server.sendAccountNotification, server.sendActivationNotification, sign); err != nil {
+	} else if err := server.jwt.Initialize(opJWT, sysJWT, store, packLimit, server.sendAccountNotification, server.sendActivationNotification, sign); err != nil {
+		return err
+	} else if err := server.addOperators(operatorPaths); err != nil {
+		return err
+	} else if err := server.seedAccounts(sysJWT); err != nil {
+		return err
+	} else if err := server.jwt.checkLocalSigner(local); err != nil {
+		return err
+	} else if local != nil {
+		server.logger.Noticef("signing self-signed account JWTs with %s", ShortKey(local.pubKey))
+	}
+
+	server.jwt.metrics = server.metrics
+	server.jwt.signers = signers
+	server.jwt.sendDeleteNotification = server.sendDeleteNotification
+	server.jwt.deleteProof = nil
+	if local != nil {
+		server.jwt.deleteProof = local.deleteProof
+	}
+	server.jwt.sendActivationDelete = server.sendActivationDelete
+	server.jwt.uploads = newUploadStats()
+	server.jwt.writes = newWriteLimiter(server.config.HTTP.WriteRate)
+	server.jwt.maxBody = int64(server.config.HTTP.MaxBodySize)
+	server.jwt.expiration = server.config.Expiration
+	server.jwt.verifyActivations = server.config.VerifyActivations
+	server.jwt.rejectStale = server.config.RejectStale
+	switch server.config.ETags {
+	case conf.ETagJTI, "":
+		server.jwt.hashETags = false
+	case conf.ETagHash:
+		server.jwt.hashETags = true
+	default:
+		return fmt.Errorf("unknown etags %q, use %q or %q", server.config.ETags, conf.ETagJTI, conf.ETagHash)
+	}
+	server.metrics.describe("lint_rule_hits_total", "counter", "Number of pushed JWTs that hit a lint rule")
+	server.metrics.describe("soft_limit_violations_total", "counter", "Number of pushed JWTs let through despite violating a softly enforced limit")
+	if server.jwt.softLimits, err = newSoftLimits(server.config.SoftLimits); err != nil {
+		return err
+	}
+	if server.jwt.linter, err = newLinter(server.config.Lint); err != nil {
+		return err
+	}
+	if server.jwt.policy, err = newAccountPolicy(server.config.Policy); err != nil {
+		return err
+	}
+	if server.jwt.approvals, err = newApprovals(server.config.Approval); err != nil {
+		return err
+	}
+	if server.jwt.activationVersions, err = checkActivationHashes(server.config.ActivationHashVersions); err != nil {
+		return err
+	}
+	if lib := libraryActivationHash(); lib != server.jwt.activationVersions[0] {
+		server.logger.Warnf("the jwt library hashes activations with version %d, activations are stored with version %d", lib, server.jwt.activationVersions[0])
+	}
+	if server.jwt.revoked, err = loadRevokedAccounts(server.config.Revoked); err != nil {
+		return err
+	}
+	if server.jwt.mirror, err = newMirror(server.config.Mirror, server.logger, server.metrics); err != nil {
+		return err
+	}
+	if server.jwt.canary, err = newCanary(server.config.Canary, server.logger, server.metrics); err != nil {
+		return err
+	}
+	if server.jwt.access, err = loadAccessStats(server.config.AccessStats); err != nil {
+		return err
+	}
+	server.startAccessStats()
+	server.startSystemAccountWatch()
+	if err := server.startExporters(); err != nil {
 		return err
 	}
 
+	if err := server.startTenants(); err != nil {
+		return err
+	}
 	if err := server.startHTTP(); err != nil {
 		return err
 	}
@@ -246,10 +562,13 @@ func (server *AccountServer) Start() error {
 	server.logger.Noticef("nats-account-server is running")
 	server.logger.Noticef("configure the nats-server with:")
 
+	if server.socket != "" {
+		server.logger.Noticef("  resolver: URL(<the proxy in front of %s>/jwt/v1/accounts/)", server.socket)
+		return nil
+	}
 	// provide a more accurate resolver URL in the case where the port is self-assigned
-	port := server.listener.Addr().(*net.TCPAddr).Port
 	h, _, _ := net.SplitHostPort(server.hostPort)
-	hp := fmt.Sprintf("%s:%d", h, port)
+	hp := fmt.Sprintf("%s:%d", h, server.port)
 	server.logger.Noticef("  resolver: URL(%s://%s/jwt/v1/accounts/)", server.protocol, hp)
 
 	return nil
@@ -261,6 +580,15 @@ func (server *AccountServer) jwtChangedCallback(pubKey string) {
 		jwtStore := server.JWTStore
 		nc := server.nats
 		server.Unlock()
+		if ds, ok := jwtStore.(*dirStore); ok {
+			ds.cache.remove(pubKey)
+		}
+		if server.jwt.jtis != nil || server.jwt.tags != nil {
+			if theJWT, err := jwtStore.LoadAcc(pubKey); err == nil {
+				server.jwt.jtis.add(theJWT)
+				server.jwt.tags.add(theJWT)
+			}
+		}
 		if nc == nil {
 			return
 		}
@@ -276,20 +604,38 @@ func (server *AccountServer) jwtChangedCallback(pubKey string) {
 			return
 		}
 
-		if err = server.sendAccountNotification(decoded.Subject, []byte(theJWT)); err != nil {
+		if err = server.sendAccountNotification(decoded.Subject, []byte(theJWT)); err != nil && !notificationPending(err) {
 			server.logger.Noticef("error trying to send notification from file change for %s, %s", ShortKey(pubKey), err.Error())
 			return
 		}
 	}
 }
 
+// watchStore sends notifications for the account JWTs saved by other servers sharing the store
+func (server *AccountServer) watchStore() error {
+	w, ok := server.JWTStore.(store.WatchableJWTStore)
+	if !ok {
+		return nil
+	}
+	server.logger.Noticef("watching the store for account JWTs saved by other servers")
+	if err := w.Watch(server.jwtChangedCallback); err != nil {
+		return err
+	}
+	server.describeStoreWatch()
+	return nil
+}
+
 const commonErr = `
 use a dedicated store directory and specify the operator jwt path instead
 synchronize using: nsc push --all --account-jwt-server-url <account-server-host-port>/jwt/v1`
 
 const RoError = `support for read only directory access with file system updates has been removed` + commonErr
 
-const NscError = `support for direct access of the nsc folder has been removed` + commonErr
+const NscError = `support for direct access of the nsc folder has been removed
+import its accounts into the store once with: nats-account-server -c <config file> -migrate-nsc <nsc operator dir>` + commonErr
+
+const StrictError = `no operator JWT is configured, without trusted keys no account JWT can be pushed to this server
+set operatorjwtpath to the operator JWT, or set allow_unverified: true to run without one`
 
 func (server *AccountServer) createStore() (store.JWTStore, error) {
 	config := server.config.Store
@@ -299,12 +645,138 @@ func (server *AccountServer) createStore() (store.JWTStore, error) {
 	if config.ReadOnly {
 		return nil, errors.New(RoError)
 	}
+	if config.Type == conf.StoreNone {
+		return server.createPassThroughStore()
+	}
+	return server.openStore(config, server.jwtChangedCallback)
+}
+
+// openStore opens a store of the configured type, changed is called with the keys the directory store
+// saves, deletes or expires
+func (server *AccountServer) openStore(config conf.StoreConfig, changed func(pubKey string)) (store.JWTStore, error) {
+	switch config.Type {
+	case conf.StoreDir, "":
+	default:
+		backend, ok := storeBackend(config.Type)
+		if !ok {
+			return nil, fmt.Errorf("unknown store type %q, use one of %s", config.Type, strings.Join(storeTypes(), ", "))
+		}
+		server.logger.Noticef("creating a %s store", config.Type)
+		return backend(config)
+	}
 	if config.Dir == "" {
 		return nil, errors.New("store directory is required")
 	}
+	if config.CleanupInterval < 0 {
+		return nil, errors.New("store cleanup_interval can't be negative")
+	}
+	if config.MaxJWTs < 0 {
+		return nil, errors.New("store max_jwts can't be negative")
+	}
+	evict := true
+	switch config.EvictionPolicy {
+	case conf.EvictLRU, "":
+	case conf.EvictReject:
+		evict = false
+	default:
+		return nil, fmt.Errorf("unknown store eviction_policy %q, use %q or %q", config.EvictionPolicy, conf.EvictLRU, conf.EvictReject)
+	}
 	server.logger.Noticef("creating a store with cleanup functions at %s", config.Dir)
-	return natsserver.NewExpiringDirJWTStore(config.Dir, config.Shard, true, natsserver.NoDelete,
-		time.Duration(config.CleanupInterval)*time.Millisecond, 0, false, 0, server.jwtChangedCallback)
+	if config.MaxJWTs > 0 {
+		server.logger.Noticef("store is limited to %d JWTs, eviction policy %s", config.MaxJWTs, server.evictionPolicy())
+	}
+	dirJWTStore, err := natsserver.NewExpiringDirJWTStore(config.Dir, config.Shard, true, natsserver.NoDelete,
+		time.Duration(config.CleanupInterval)*time.Millisecond, int64(config.MaxJWTs), evict, 0, changed)
+	if err != nil {
+		return nil, err
+	}
+	if config.CacheSize < 0 {
+		dirJWTStore.Close()
+		return nil, errors.New("store cache_size can't be negative")
+	}
+	primary := &dirStore{DirJWTStore: dirJWTStore, dir: config.Dir, shard: config.Shard,
+		cache: newJWTCache(config.CacheSize, server.metrics)}
+	dual := config.DualWrite
+	if dual.Type == "" && dual.Dir == "" {
+		return primary, nil
+	}
+	secondary, err := server.openSecondaryStore(config)
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+	return newDualStore(primary, secondary, server.logger, server.metrics), nil
+}
+
+// openSecondaryStore opens the store written alongside the directory store in dual-write mode, a
+// registered backend is opened with the backend options of the store
+func (server *AccountServer) openSecondaryStore(config conf.StoreConfig) (store.JWTStore, error) {
+	dual := config.DualWrite
+	switch dual.Type {
+	case conf.StoreDir, "":
+	case conf.StoreNone:
+		return nil, errors.New("the dual-write store can't be of type none")
+	default:
+		backend, ok := storeBackend(dual.Type)
+		if !ok {
+			return nil, fmt.Errorf("unknown dual-write store type %q, use one of %s", dual.Type, strings.Join(storeTypes(), ", "))
+		}
+		server.logger.Noticef("dual-write mode, also writing to a %s store", dual.Type)
+		backendConfig := config
+		backendConfig.Type = dual.Type
+		backendConfig.DualWrite = conf.DualWriteConfig{}
+		return backend(backendConfig)
+	}
+	if dual.Dir == "" {
+		return nil, errors.New("the dual-write store directory is required")
+	}
+	if filepath.Clean(dual.Dir) == filepath.Clean(config.Dir) {
+		return nil, errors.New("the dual-write store must use a different directory")
+	}
+	server.logger.Noticef("dual-write mode, also writing to the store at %s", dual.Dir)
+	secondary, err := natsserver.NewDirJWTStore(dual.Dir, dual.Shard, true)
+	if err != nil {
+		return nil, err
+	}
+	return &dirStore{DirJWTStore: secondary, dir: dual.Dir, shard: dual.Shard}, nil
+}
+
+// createPassThroughStore creates the store used when the store type is none
+func (server *AccountServer) createPassThroughStore() (store.JWTStore, error) {
+	if len(server.config.NATS.Servers) == 0 {
+		return nil, errors.New("store type none requires NATS servers to look accounts up")
+	}
+	if len(server.primaries()) > 0 {
+		return nil, errors.New("store type none can't be initialized from a primary")
+	}
+	if len(server.config.Lookup) > 0 {
+		server.logger.Warnf("store type none always looks accounts up over NATS, the lookup setting is ignored")
+	}
+	server.logger.Noticef("pass-through mode, no JWTs are stored, lookups and updates go through NATS")
+	return newPassThroughStore(server.natsLookup, time.Duration(server.config.Store.CacheTTL)*time.Millisecond), nil
+}
+
+// operatorPaths returns the configured operator JWT paths, operatorjwtpath first
+func (server *AccountServer) operatorPaths() []string {
+	var paths []string
+	if server.config.OperatorJWTPath != "" {
+		paths = append(paths, server.config.OperatorJWTPath)
+	}
+	return append(paths, server.config.OperatorJWTPaths...)
+}
+
+// addOperators trusts the operators after the first, which the handler was initialized with
+func (server *AccountServer) addOperators(paths []string) error {
+	for i := 1; i < len(paths); i++ {
+		opJWT, err := server.readJWT(paths[i], "operator")
+		if err != nil {
+			return err
+		}
+		if _, err := server.jwt.addOperator(opJWT); err != nil {
+			return fmt.Errorf("operator %s: %v", paths[i], err)
+		}
+	}
+	return nil
 }
 
 func (server *AccountServer) readJWT(opPath string, jwtType string) ([]byte, error) {
@@ -323,6 +795,8 @@ func (server *AccountServer) readJWT(opPath string, jwtType string) ([]byte, err
 
 // Stop the account server
 func (server *AccountServer) Stop() {
+	// interrupt the syncs and pack walks in progress before waiting for the lock, Start may hold it
+	server.cancelContext()
 	server.Lock()
 	defer server.Unlock()
 
@@ -337,6 +811,35 @@ func (server *AccountServer) Stop() {
 	if server.natsTimer != nil {
 		server.natsTimer.Stop()
 	}
+	server.notifyRetry.stop()
+
+	if server.stopHeartbeat != nil {
+		close(server.stopHeartbeat)
+		server.stopHeartbeat = nil
+	}
+
+	if server.stopExporters != nil {
+		close(server.stopExporters)
+		server.stopExporters = nil
+	}
+
+	if server.stopConsistency != nil {
+		close(server.stopConsistency)
+		server.stopConsistency = nil
+	}
+
+	if server.stopSysAccWatch != nil {
+		close(server.stopSysAccWatch)
+		server.stopSysAccWatch = nil
+	}
+
+	if server.stopAccessStats != nil {
+		close(server.stopAccessStats)
+		server.stopAccessStats = nil
+	}
+	if err := server.jwt.access.save(); err != nil {
+		server.logger.Errorf("unable to save access statistics, %v", err)
+	}
 
 	shutdown := server.shutdownNats
 	if shutdown != nil {
@@ -347,18 +850,26 @@ func (server *AccountServer) Stop() {
 	}
 
 	server.stopHTTP()
+	server.tracer.stop()
+	server.tracer = nil
+	server.jwt.mirror.stop()
+	server.jwt.canary.stop()
 
 	if server.JWTStore != nil {
 		server.Close()
 		server.logger.Noticef("closed JWT store")
 	}
+	if server.jwt.users != nil {
+		server.jwt.users.Close()
+	}
+	server.stopTenants()
 	server.jwt = NewJwtHandler(server.logger)
 }
 
 // this functionality is only used to initialize the server from an old server
-func (server *AccountServer) initializeFromPrimary() error {
-	primary := server.config.Primary
-	if primary == "" {
+func (server *AccountServer) initializeFromPrimary(ctx context.Context) error {
+	primaries := server.primaries()
+	if len(primaries) == 0 {
 		return nil
 	}
 	packer, ok := server.JWTStore.(store.PackableJWTStore)
@@ -367,48 +878,78 @@ func (server *AccountServer) initializeFromPrimary() error {
 		return nil
 	}
 
+	if server.readThrough != nil {
+		server.logger.Noticef("skipping initial JWT pack from primary, cache mode fetches JWTs when they are requested")
+		return nil
+	}
+
 	if server.config.MaxReplicationPack == 0 {
 		server.logger.Noticef("skipping initial JWT pack from primary, config has MaxReplicationPack of 0")
 		return nil
 	}
 
-	server.logger.Noticef("grabbing initial JWT pack from primary %s", primary)
+	server.logger.Noticef("grabbing initial JWT pack from primary %s", strings.Join(primaries, ", "))
 
-	primary = strings.TrimSuffix(primary, "/")
-
-	url := fmt.Sprintf("%s/jwt/v1/pack?max=%d", primary, server.config.MaxReplicationPack)
-
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 1,
-		},
-		Timeout: time.Duration(server.config.ReplicationTimeout) * time.Millisecond,
+	path := fmt.Sprintf("/jwt/v1/pack?max=%d", server.config.MaxReplicationPack)
+	if walker, ok := packer.(syncableStore); ok {
+		// a primary holding the same JWTs answers with a 304 instead of the pack
+		if hash := walker.Hash(); hash != ([sha256.Size]byte{}) {
+			path += "&since=" + hex.EncodeToString(hash[:])
+		}
 	}
 
-	resp, err := httpClient.Get(url)
-
-	// if we can't contact the primary, fallback to what we have on disk
-	if err != nil {
-		server.logger.Noticef("unable to initialize from primary, %s, will use what is on disk", err.Error())
-		return nil
-	} else if resp != nil && resp.StatusCode != http.StatusOK {
-		server.logger.Noticef("unable to initialize from primary, server returned status %q, will use what is on disk", resp.Status)
-		return nil
-	} else if resp == nil {
-		server.logger.Noticef("unable to initialize from primary, http call didn't return a response, will use what is on disk")
+	server.setDegraded("the initial sync with the primary has not completed")
+	body, retry, wait, err := server.fetchFromPrimaries(ctx, server.primaryCandidates(ctx, path))
+
+	// if we can't contact any primary, fallback to what we have on disk
+	if ctx.Err() != nil {
+		return errors.New("stopped during the initial sync with the primary")
+	} else if err != nil {
+		deadline := time.Duration(server.config.ReplicationRetryDeadline) * time.Millisecond
+		interval := time.Duration(server.config.ReplicationRetryInterval) * time.Millisecond
+		switch {
+		case !retry || (deadline <= 0 && interval <= 0):
+			server.logger.Noticef("unable to initialize from primary, %s, will use what is on disk", err.Error())
+			server.setDegraded("")
+			return nil
+		case deadline <= 0:
+			server.logger.Noticef("unable to initialize from primary, %s, will use what is on disk and retry every %v", err.Error(), interval)
+		default:
+			server.logger.Noticef("unable to initialize from primary, %s, will use what is on disk and retry for up to %v", err.Error(), deadline)
+		}
+		go server.retryPrimarySync(ctx, path, packer, wait, time.Now().Add(deadline))
 		return nil
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	err = server.mergePack(ctx, "primary", packer, body)
+	server.endMergeCycle()
 	if err != nil {
 		return err
 	}
+	server.setDegraded("")
 
-	if err := packer.Merge(string(body)); err != nil {
-		return err
+	return nil
+}
+
+// URL returns the base URL of the HTTP server, only valid after Start. On a unix socket it is
+// http+unix:// followed by the escaped socket path.
+func (server *AccountServer) URL() string {
+	server.Lock()
+	defer server.Unlock()
+	if server.socket != "" {
+		return fmt.Sprintf("%s+unix://%s", server.protocol, url.PathEscape(server.socket))
+	}
+	host, _, _ := net.SplitHostPort(server.hostPort)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
 	}
+	return fmt.Sprintf("%s://%s", server.protocol, net.JoinHostPort(host, strconv.Itoa(server.port)))
+}
 
-	return nil
+// NATSConnected returns true if the server has a live connection to NATS
+func (server *AccountServer) NATSConnected() bool {
+	nc := server.getNatsConnection()
+	return nc != nil && nc.IsConnected()
 }
 
 func (server *AccountServer) ReadyForConnections(dur time.Duration) bool {
@@ -361,3 +361,28 @@ func TestFlagOverridesConfig(t *testing.T) {
 	require.Equal(t, server.config.Store.Dir, path)
 	require.Equal(t, server.config.HTTP.ReadTimeout, 2000)
 }
+
+func TestStrictStartup(t *testing.T) {
+	path, err := os.MkdirTemp(os.TempDir(), "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+
+	start := func(configString string) error {
+		config := conf.DefaultServerConfig()
+		require.NoError(t, conf.LoadConfigFromString(configString, config, false))
+		config.Store.Dir = path
+		config.HTTP.Port = 0
+		config.Logging.Custom = NewNilLogger()
+		server := NewAccountServer()
+		require.NoError(t, server.InitializeFromConfig(config))
+		err := server.Start()
+		server.Stop()
+		return err
+	}
+
+	require.NoError(t, start(`strict: false`))
+	err = start(`strict: true`)
+	require.Error(t, err)
+	require.Equal(t, StrictError, err.Error())
+	require.NoError(t, start(`strict: true, allow_unverified: true`))
+}
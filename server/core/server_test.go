@@ -272,10 +272,8 @@ func SetupTestServer(config *conf.AccountServerConfig, useTLS bool, enableNats b
 	}
 
 	if useTLS {
-		config.HTTP.TLS = conf.TLSConf{
-			Key:  keyFile,
-			Cert: certFile,
-		}
+		config.HTTP.TLS.Key = keyFile
+		config.HTTP.TLS.Cert = certFile
 		config.NATS.TLS = conf.TLSConf{
 			Root: caFile,
 		}
@@ -24,8 +24,6 @@ import (
 	"testing"
 	"time"
 
-	natsserver "github.com/nats-io/nats-server/v2/server"
-
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-account-server/server/conf"
 	"github.com/stretchr/testify/require"
@@ -70,13 +68,14 @@ func TestServerReloadNotification(t *testing.T) {
 	subject := fmt.Sprintf(accountNotificationFormat, apub)
 	sub, err := testEnv.NC.SubscribeSync(subject)
 	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
 
 	c.Tags.Add("red")
 	cd, err = c.Encode(kp)
 	require.NoError(t, err)
 	store(apub, cd)
 
-	testEnv.Server.JWTStore.(*natsserver.DirJWTStore).Reload()
+	testEnv.Server.JWTStore.(*dirStore).Reload()
 
 	resp, err = testEnv.HTTP.Get(url)
 	require.NoError(t, err)
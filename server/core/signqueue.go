@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// defaultSignQueueTimeout is how long a signing request waits for a free slot if no timeout is configured
+const defaultSignQueueTimeout = 5 * time.Second
+
+// errSignQueueFull is returned when a signing request can't be queued, or waited too long for a slot
+var errSignQueueFull = errors.New("signing queue is full")
+
+// signLimiter bounds the number of concurrent signing requests, requests beyond the limit
+// wait for a free slot as long as the queue has room, up to the timeout
+type signLimiter struct {
+	slots    chan struct{}
+	maxQueue int64
+	timeout  time.Duration
+	queued   int64
+	inFlight int64
+	metrics  *metrics
+}
+
+// newSignLimiter returns nil if concurrency is not limited, timeout is in milliseconds
+func newSignLimiter(concurrency int, queueDepth int, timeout int, m *metrics) *signLimiter {
+	if concurrency <= 0 {
+		return nil
+	}
+	l := &signLimiter{
+		slots:    make(chan struct{}, concurrency),
+		maxQueue: int64(queueDepth),
+		timeout:  time.Duration(timeout) * time.Millisecond,
+		metrics:  m,
+	}
+	if l.timeout <= 0 {
+		l.timeout = defaultSignQueueTimeout
+	}
+	m.gaugeFunc("sign_queue_depth", "Number of signing requests waiting for a free slot", func() float64 {
+		return float64(atomic.LoadInt64(&l.queued))
+	})
+	m.gaugeFunc("sign_in_flight", "Number of signing requests sent to the signing service", func() float64 {
+		return float64(atomic.LoadInt64(&l.inFlight))
+	})
+	m.describe("sign_rejected_total", "counter", "Number of signing requests rejected because the queue was full or the wait for a slot timed out")
+	return l
+}
+
+// wrap returns a signing callback that goes through the limiter, a nil limiter returns sign unchanged
+func (l *signLimiter) wrap(sign accountSignup) accountSignup {
+	if l == nil || sign == nil {
+		return sign
+	}
+	return func(pubKey string, theJWT []byte) ([]byte, string, error) {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if atomic.AddInt64(&l.queued, 1) > l.maxQueue {
+				atomic.AddInt64(&l.queued, -1)
+				l.metrics.inc("sign_rejected_total")
+				return nil, "", errSignQueueFull
+			}
+			timer := time.NewTimer(l.timeout)
+			select {
+			case l.slots <- struct{}{}:
+				timer.Stop()
+				atomic.AddInt64(&l.queued, -1)
+			case <-timer.C:
+				atomic.AddInt64(&l.queued, -1)
+				l.metrics.inc("sign_rejected_total")
+				return nil, "", errSignQueueFull
+			}
+		}
+		atomic.AddInt64(&l.inFlight, 1)
+		defer func() {
+			atomic.AddInt64(&l.inFlight, -1)
+			<-l.slots
+		}()
+		return sign(pubKey, theJWT)
+	}
+}
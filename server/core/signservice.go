@@ -0,0 +1,285 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+)
+
+// errSignUnavailable is returned when no signing service subject answered
+var errSignUnavailable = errors.New("signing service unavailable")
+
+// circuit breaker states of a signing subject
+const (
+	signClosed   = "closed"    // requests are sent
+	signOpen     = "open"      // requests are skipped until the cooldown is over
+	signHalfOpen = "half-open" // the cooldown is over, the next request decides
+)
+
+// signSubject is the health of one signing service subject
+type signSubject struct {
+	subject     string
+	failures    int // consecutive
+	openUntil   time.Time
+	requests    int64
+	errors      int64
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+// signService sends signing requests to the configured subjects in order, retrying each one with
+// backoff. A subject that fails too often in a row is skipped until its cooldown is over, so a flapping
+// signer fails requests fast instead of holding every post for the timeout.
+type signService struct {
+	sync.Mutex
+	subjects  []*signSubject
+	timeout   time.Duration
+	retries   int
+	backoff   time.Duration
+	threshold int // consecutive failures that open the breaker, 0 never opens it
+	cooldown  time.Duration
+	request   func(subject string, data []byte, timeout time.Duration) (*nats.Msg, error)
+	metrics   *metrics
+}
+
+// newSignService returns nil if no signing service is configured
+func newSignService(config *conf.AccountServerConfig, request func(string, []byte, time.Duration) (*nats.Msg, error), m *metrics) (*signService, error) {
+	if config.SignRetries < 0 || config.SignRetryBackoff < 0 || config.SignBreakerFailures < 0 || config.SignBreakerCooldown < 0 {
+		return nil, errors.New("signing service retries, backoff and breaker settings can't be negative")
+	}
+	if config.SignRequestSubject == "" {
+		if len(config.SignFallbackSubjects) > 0 {
+			return nil, errors.New("signfallbacksubjects requires signrequestsubject")
+		}
+		return nil, nil
+	}
+	s := &signService{
+		timeout:   time.Duration(config.SignRequestTimeout) * time.Millisecond,
+		retries:   config.SignRetries,
+		backoff:   time.Duration(config.SignRetryBackoff) * time.Millisecond,
+		threshold: config.SignBreakerFailures,
+		cooldown:  time.Duration(config.SignBreakerCooldown) * time.Millisecond,
+		request:   request,
+		metrics:   m,
+	}
+	for _, subject := range append([]string{config.SignRequestSubject}, config.SignFallbackSubjects...) {
+		if subject == "" {
+			return nil, errors.New("signing service subjects can't be empty")
+		}
+		s.subjects = append(s.subjects, &signSubject{subject: subject})
+	}
+	m.describe("sign_requests_total", "counter", "Number of requests to the signing service by subject and result, ok, error or skipped")
+	m.describe("sign_breaker_open", "gauge", "1 while the circuit breaker of a signing service subject is open")
+	return s, nil
+}
+
+// state returns the breaker state of a subject, assumes the lock is held
+func (s *signService) state(sub *signSubject, now time.Time) string {
+	switch {
+	case s.threshold == 0 || sub.failures < s.threshold:
+		return signClosed
+	case now.Before(sub.openUntil):
+		return signOpen
+	default:
+		return signHalfOpen
+	}
+}
+
+// available reports whether requests may be sent to the subject
+func (s *signService) available(sub *signSubject) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.state(sub, time.Now()) != signOpen
+}
+
+// record updates the health of the subject with the outcome of a request
+func (s *signService) record(sub *signSubject, err error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	sub.requests++
+	if err == nil {
+		sub.failures = 0
+		sub.openUntil = time.Time{}
+		sub.lastSuccess = now
+		s.metrics.inc("sign_requests_total", "subject", sub.subject, "result", "ok")
+		s.metrics.set("sign_breaker_open", 0, "subject", sub.subject)
+		return
+	}
+	sub.errors++
+	sub.failures++
+	sub.lastFailure = now
+	sub.lastError = err.Error()
+	s.metrics.inc("sign_requests_total", "subject", sub.subject, "result", "error")
+	if s.threshold > 0 && sub.failures >= s.threshold {
+		sub.openUntil = now.Add(s.cooldown)
+		s.metrics.set("sign_breaker_open", 1, "subject", sub.subject)
+	}
+}
+
+// retryAfter returns the seconds until a subject can be tried again, at least 1
+func (s *signService) retryAfter() string {
+	if s == nil {
+		return "1"
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	wait := time.Duration(math.MaxInt64)
+	for _, sub := range s.subjects {
+		if s.state(sub, now) != signOpen {
+			return "1"
+		}
+		if d := sub.openUntil.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return strconv.Itoa(int(math.Ceil(math.Max(wait.Seconds(), 1))))
+}
+
+// failureMessage describes a failed request to the poster
+func failureMessage(err error) string {
+	switch err {
+	case nats.ErrInvalidConnection:
+		return "Failure during signature request. nats-server unavailable."
+	case nats.ErrTimeout, nats.ErrNoResponders:
+		return "Failure during signature request. signing service unavailable."
+	}
+	return "Failure during signature request. Try again at a later time. Error: " + err.Error()
+}
+
+// sign is the accountSignup of the signing service. An answer that isn't an account JWT is the signing
+// service's message to the poster, it still counts as a success for the subject.
+func (s *signService) sign(pubKey string, theJWT []byte) ([]byte, string, error) {
+	var lastErr error
+	for _, sub := range s.subjects {
+		if !s.available(sub) {
+			s.metrics.inc("sign_requests_total", "subject", sub.subject, "result", "skipped")
+			continue
+		}
+		wait := s.backoff
+		for attempt := 0; attempt <= s.retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(wait)
+				wait *= 2
+			}
+			msg, err := s.request(sub.subject, theJWT, s.timeout)
+			if err == nats.ErrInvalidConnection {
+				// not the signing service's fault
+				return nil, failureMessage(err), fmt.Errorf("%w: %v", errSignUnavailable, err)
+			}
+			s.record(sub, err)
+			if err == nil {
+				if _, err := jwt.DecodeAccountClaims(string(msg.Data)); err != nil {
+					return nil, string(msg.Data), nil
+				}
+				return msg.Data, "", nil
+			}
+			lastErr = err
+			if !s.available(sub) {
+				break
+			}
+		}
+	}
+	if lastErr == nil {
+		return nil, "Signing service unavailable, try again later.", errSignUnavailable
+	}
+	return nil, failureMessage(lastErr), fmt.Errorf("%w: %v", errSignUnavailable, lastErr)
+}
+
+// signSubjectStatus is the health of a subject in /signz
+type signSubjectStatus struct {
+	Subject             string     `json:"subject"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Requests            int64      `json:"requests"`
+	Errors              int64      `json:"errors"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+type signz struct {
+	Available bool                `json:"available"`
+	Subjects  []signSubjectStatus `json:"subjects"`
+}
+
+// status returns the health of every subject, available if one of them may be tried
+func (s *signService) status() signz {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		t = t.UTC()
+		return &t
+	}
+	var z signz
+	for _, sub := range s.subjects {
+		st := signSubjectStatus{
+			Subject:             sub.subject,
+			State:               s.state(sub, now),
+			ConsecutiveFailures: sub.failures,
+			Requests:            sub.requests,
+			Errors:              sub.errors,
+			LastSuccess:         optional(sub.lastSuccess),
+			LastFailure:         optional(sub.lastFailure),
+			LastError:           sub.lastError,
+		}
+		if st.State == signOpen {
+			st.OpenUntil = optional(sub.openUntil)
+		} else {
+			z.Available = true
+		}
+		z.Subjects = append(z.Subjects, st)
+	}
+	return z
+}
+
+// getSignz handles GET /signz, the status is 503 while every subject's breaker is open and 404 without
+// a signing service
+func (server *AccountServer) getSignz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	server.Lock()
+	s := server.jwt.signers
+	server.Unlock()
+	if s == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "signing service not enabled", "", nil, w)
+		return
+	}
+	z := s.status()
+	status := http.StatusOK
+	if !z.Available {
+		w.Header().Set("Retry-After", s.retryAfter())
+		status = http.StatusServiceUnavailable
+	}
+	server.writeJSON(w, status, z)
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignFallbackAndBreaker(t *testing.T) {
+	cfg := conf.DefaultServerConfig()
+	cfg.SignRequestSubject = "sign.primary"
+	cfg.SignFallbackSubjects = []string{"sign.fallback"}
+	cfg.SignRetries = 1
+	cfg.SignRetryBackoff = 10
+	cfg.SignBreakerFailures = 2
+	cfg.SignBreakerCooldown = 60000
+	testEnv, err := SetupTestServer(cfg, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	signz := func() (int, signz) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/signz"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var z signz
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&z))
+		return resp.StatusCode, z
+	}
+	post := func() *http.Response {
+		pubKey, _, acctJWT := selfSignedAcctJWT(t)
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey)), "application/json", bytes.NewBuffer(acctJWT))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	status, z := signz()
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, z.Available)
+	require.Len(t, z.Subjects, 2)
+
+	// nobody listens on the primary subject, the fallback signs
+	sub, err := testEnv.NC.Subscribe("sign.fallback", func(msg *nats.Msg) {
+		claim, err := jwt.DecodeAccountClaims(string(msg.Data))
+		require.NoError(t, err)
+		token, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		msg.Respond([]byte(token))
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+	require.Equal(t, http.StatusOK, post().StatusCode)
+
+	status, z = signz()
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, signOpen, z.Subjects[0].State, "both attempts failed")
+	require.Equal(t, int64(2), z.Subjects[0].Errors)
+	require.NotNil(t, z.Subjects[0].OpenUntil)
+	require.Equal(t, signClosed, z.Subjects[1].State)
+	require.Equal(t, int64(1), z.Subjects[1].Requests)
+
+	// the open primary is skipped
+	require.Equal(t, http.StatusOK, post().StatusCode)
+	_, z = signz()
+	require.Equal(t, int64(2), z.Subjects[0].Requests)
+	require.Equal(t, int64(2), z.Subjects[1].Requests)
+
+	// without any signer the post fails fast with a 503
+	require.NoError(t, sub.Unsubscribe())
+	require.NoError(t, testEnv.NC.Flush())
+	resp := post()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("Retry-After"))
+	status, z = signz()
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.False(t, z.Available)
+	resp = post()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	_, after := signz()
+	require.Equal(t, z.Subjects[1].Requests, after.Subjects[1].Requests, "open breakers aren't tried")
+}
+
+func TestSignServiceOff(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/signz"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	cfg := conf.DefaultServerConfig()
+	cfg.SignFallbackSubjects = []string{"sign"}
+	_, err = newSignService(cfg, nil, newMetrics())
+	require.Error(t, err)
+}
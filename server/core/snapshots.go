@@ -0,0 +1,264 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+const snapshotExt = ".snapshot"
+
+var snapshotNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// snapshot is an immutable copy of the account JWTs in the store at a point in time
+type snapshot struct {
+	Name    string            `json:"name"`
+	Created time.Time         `json:"created"`
+	JWTs    map[string]string `json:"jwts"`
+}
+
+// snapshotInfo describes a snapshot without its content
+type snapshotInfo struct {
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	Accounts int       `json:"accounts"`
+}
+
+func (s *snapshot) info() snapshotInfo {
+	return snapshotInfo{Name: s.Name, Created: s.Created, Accounts: len(s.JWTs)}
+}
+
+// snapshotStore keeps snapshots by name, persisting them to dir if it is set
+type snapshotStore struct {
+	sync.Mutex
+	dir    string
+	byName map[string]*snapshot
+}
+
+// loadSnapshots reads all snapshots persisted in dir
+func loadSnapshots(dir string) (*snapshotStore, error) {
+	ss := &snapshotStore{dir: dir, byName: map[string]*snapshot{}}
+	if dir == "" {
+		return ss, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+snapshotExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		snap := &snapshot{}
+		if err := json.Unmarshal(data, snap); err != nil {
+			return nil, fmt.Errorf("error reading snapshot %s: %v", f, err)
+		}
+		ss.byName[snap.Name] = snap
+	}
+	return ss, nil
+}
+
+func (ss *snapshotStore) get(name string) *snapshot {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.byName[name]
+}
+
+func (ss *snapshotStore) list() []snapshotInfo {
+	ss.Lock()
+	defer ss.Unlock()
+	infos := make([]snapshotInfo, 0, len(ss.byName))
+	for _, s := range ss.byName {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// history returns the snapshots, newest first
+func (ss *snapshotStore) history() []*snapshot {
+	ss.Lock()
+	defer ss.Unlock()
+	snaps := make([]*snapshot, 0, len(ss.byName))
+	for _, s := range ss.byName {
+		snaps = append(snaps, s)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Created.After(snaps[j].Created)
+	})
+	return snaps
+}
+
+// add stores a new snapshot, existing snapshots are never replaced
+func (ss *snapshotStore) add(snap *snapshot) error {
+	ss.Lock()
+	defer ss.Unlock()
+	if _, ok := ss.byName[snap.Name]; ok {
+		return os.ErrExist
+	}
+	if ss.dir != "" {
+		data, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(ss.dir, snap.Name+snapshotExt)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	ss.byName[snap.Name] = snap
+	return nil
+}
+
+func (ss *snapshotStore) remove(name string) error {
+	ss.Lock()
+	defer ss.Unlock()
+	if _, ok := ss.byName[name]; !ok {
+		return os.ErrNotExist
+	}
+	if ss.dir != "" {
+		if err := os.Remove(filepath.Join(ss.dir, name+snapshotExt)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(ss.byName, name)
+	return nil
+}
+
+// takeSnapshot copies all account JWTs currently in the store
+func (server *AccountServer) takeSnapshot(name string) (*snapshot, error) {
+	packer, ok := server.JWTStore.(store.PackableJWTStore)
+	if !ok {
+		return nil, fmt.Errorf("store does not support snapshots")
+	}
+	pack, err := packer.Pack(-1)
+	if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{Name: name, Created: time.Now().UTC(), JWTs: map[string]string{}}
+	for _, line := range strings.Split(pack, "\n") {
+		if split := strings.Split(line, "|"); len(split) == 2 {
+			snap.JWTs[split[0]] = split[1]
+		}
+	}
+	return snap, nil
+}
+
+// createSnapshot handles POST /admin/v1/snapshots with a body of {"name": "..."}
+func (server *AccountServer) createSnapshot(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	body, ok := server.jwt.readBody(w, r, "bad snapshot request", "")
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		server.jwt.sendErrorResponse(http.StatusBadRequest, "bad snapshot request", "", err, w)
+		return
+	}
+	if !snapshotNameRe.MatchString(req.Name) {
+		server.jwt.sendErrorResponse(http.StatusBadRequest, "snapshot names may only contain letters, digits, '.', '_' and '-'", "", nil, w)
+		return
+	}
+	if server.snapshots.get(req.Name) != nil {
+		server.jwt.sendErrorResponse(http.StatusConflict, "snapshot already exists", "", nil, w)
+		return
+	}
+	snap, err := server.takeSnapshot(req.Name)
+	if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error creating snapshot", "", err, w)
+		return
+	}
+	if err := server.snapshots.add(snap); os.IsExist(err) {
+		server.jwt.sendErrorResponse(http.StatusConflict, "snapshot already exists", "", nil, w)
+		return
+	} else if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error saving snapshot", "", err, w)
+		return
+	}
+	server.logger.Noticef("created snapshot %s with %d accounts", snap.Name, len(snap.JWTs))
+	server.writeJSON(w, http.StatusCreated, snap.info())
+}
+
+// listSnapshots handles GET /admin/v1/snapshots
+func (server *AccountServer) listSnapshots(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.writeJSON(w, http.StatusOK, server.snapshots.list())
+}
+
+// deleteSnapshot handles DELETE /admin/v1/snapshots/:name
+func (server *AccountServer) deleteSnapshot(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	name := params.ByName("name")
+	if err := server.snapshots.remove(name); os.IsNotExist(err) {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no matching snapshot", "", nil, w)
+		return
+	} else if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error deleting snapshot", "", err, w)
+		return
+	}
+	server.logger.Noticef("deleted snapshot %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getSnapshotJWT serves an account JWT from a snapshot, without a pubkey it acts as a resolver test point
+func (server *AccountServer) getSnapshotJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	snap := server.snapshots.get(params.ByName("name"))
+	if snap == nil {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no matching snapshot", "", nil, w)
+		return
+	}
+	pubKey := params.ByName("pubkey")
+	if pubKey == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	theJWT, ok := snap.JWTs[pubKey]
+	if !ok {
+		server.jwt.sendErrorResponse(http.StatusNotFound, "no matching account JWT", pubKey, nil, w)
+		return
+	}
+	if strings.ToLower(r.URL.Query().Get("decode")) == "true" {
+		server.jwt.writeDecodedJWT(w, r, pubKey, theJWT)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJWT)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(theJWT))
+}
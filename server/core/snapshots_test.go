@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotLifecycle(t *testing.T) {
+	dir, err := os.MkdirTemp("", "snapshots")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Admin.SnapshotDir = dir
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	before := initAndPostNAccounts(t, testEnv, 3)
+
+	status, body := adminRequest(t, testEnv, http.MethodPost, "/admin/v1/snapshots", testAdminToken, `{"name": "v1"}`)
+	require.Equal(t, http.StatusCreated, status)
+	info := snapshotInfo{}
+	require.NoError(t, json.Unmarshal([]byte(body), &info))
+	require.Equal(t, "v1", info.Name)
+	require.Equal(t, 3, info.Accounts)
+
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/snapshots", testAdminToken, `{"name": "v1"}`)
+	require.Equal(t, http.StatusConflict, status)
+
+	status, _ = adminRequest(t, testEnv, http.MethodPost, "/admin/v1/snapshots", testAdminToken, `{"name": "../v2"}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// accounts added after the snapshot are not part of it
+	after := initAndPostNAccounts(t, testEnv, 1)
+
+	get := func(name string, pubKey string) (int, string) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath(fmt.Sprintf("/snapshots/%s/jwt/v1/accounts/%s", name, pubKey)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	for pubKey, theJWT := range before {
+		status, body := get("v1", pubKey)
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, theJWT, body)
+	}
+	for pubKey := range after {
+		status, _ := get("v1", pubKey)
+		require.Equal(t, http.StatusNotFound, status)
+	}
+	status, _ = get("v1", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = get("nope", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// snapshots survive a restart
+	testEnv.Server.Stop()
+	require.NoError(t, testEnv.Server.Start())
+
+	status, body = adminRequest(t, testEnv, http.MethodGet, "/admin/v1/snapshots", testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	var infos []snapshotInfo
+	require.NoError(t, json.Unmarshal([]byte(body), &infos))
+	require.Len(t, infos, 1)
+	require.Equal(t, "v1", infos[0].Name)
+
+	status, _ = adminRequest(t, testEnv, http.MethodDelete, "/admin/v1/snapshots/v1", testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, status)
+	status, _ = adminRequest(t, testEnv, http.MethodDelete, "/admin/v1/snapshots/v1", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = get("v1", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"golang.org/x/sys/unix"
+)
+
+// socketControl returns a function that applies socket options before the listener binds
+func socketControl(config conf.HTTPConfig) func(network, address string, c syscall.RawConn) error {
+	if !config.ReusePort {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		if err := c.Control(func(fd uintptr) {
+			opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+// setBacklog calls listen again on the bound socket, which updates the length of the accept queue
+func setBacklog(l net.Listener, backlog int) error {
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("backlog is only supported for tcp listeners")
+	}
+	rc, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	if err := rc.Control(func(fd uintptr) {
+		opErr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+func socketControl(config conf.HTTPConfig) func(network, address string, c syscall.RawConn) error {
+	if !config.ReusePort {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("reuse port is not supported on windows")
+	}
+}
+
+func setBacklog(l net.Listener, backlog int) error {
+	return errors.New("backlog is not supported on windows")
+}
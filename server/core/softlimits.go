@@ -0,0 +1,78 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// Features that can be enforced softly
+const (
+	softLint      = "lint"       // lint rules with the reject severity
+	softWriteRate = "write_rate" // the limit on account JWT posts per second
+	softPolicy    = "policy"     // the account policy limits
+)
+
+// warningHeader carries each soft limit violation that was let through, or a notification that is
+// pending, a response can hold several
+const warningHeader = "Account-Server-Warning"
+
+// softLimits lets pushes that violate a limit or policy through until a deadline, flagging them instead,
+// so operators can find who is affected before enforcing
+type softLimits struct {
+	until    time.Time
+	features map[string]bool
+	now      func() time.Time
+}
+
+// newSoftLimits returns nil if soft enforcement is not configured
+func newSoftLimits(config conf.SoftLimitConfig) (*softLimits, error) {
+	if config.Until == "" {
+		return nil, nil
+	}
+	until, err := time.Parse(time.RFC3339, config.Until)
+	if err != nil {
+		return nil, fmt.Errorf("soft limits require an RFC 3339 until time: %v", err)
+	}
+	s := &softLimits{until: until, features: map[string]bool{}, now: time.Now}
+	for _, f := range config.Features {
+		if f != softLint && f != softWriteRate && f != softPolicy {
+			return nil, fmt.Errorf("unknown soft limit feature %q, use %s, %s or %s", f, softLint, softWriteRate, softPolicy)
+		}
+		s.features[f] = true
+	}
+	if len(s.features) == 0 {
+		s.features[softLint], s.features[softWriteRate], s.features[softPolicy] = true, true, true
+	}
+	return s, nil
+}
+
+// warnOnly returns true if violations of the feature are still only flagged, a nil softLimits enforces everything
+func (s *softLimits) warnOnly(feature string) bool {
+	return s != nil && s.features[feature] && s.now().Before(s.until)
+}
+
+// flagViolation records a violation that was let through in the response headers, the log and the metrics
+func (h *JwtHandler) flagViolation(header http.Header, feature string, account string, message string) {
+	header.Add(warningHeader, fmt.Sprintf("%s: %s, enforced from %s", feature, message,
+		h.softLimits.until.UTC().Format(time.RFC3339)))
+	h.metrics.inc("soft_limit_violations_total", "feature", feature)
+	h.logger.Warnf("%s - %s violation allowed until enforcement - %s", ShortKey(account), feature, message)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSoftLimitConfig(t *testing.T) {
+	s, err := newSoftLimits(conf.SoftLimitConfig{})
+	require.NoError(t, err)
+	require.Nil(t, s)
+	require.False(t, s.warnOnly(softLint))
+	_, err = newSoftLimits(conf.SoftLimitConfig{Until: "next week"})
+	require.Error(t, err)
+	_, err = newSoftLimits(conf.SoftLimitConfig{Until: "2030-01-01T00:00:00Z", Features: []string{"quota"}})
+	require.Error(t, err)
+
+	s, err = newSoftLimits(conf.SoftLimitConfig{Until: "2030-01-01T00:00:00Z", Features: []string{softLint}})
+	require.NoError(t, err)
+	s.now = func() time.Time { return time.Date(2029, 12, 31, 0, 0, 0, 0, time.UTC) }
+	require.True(t, s.warnOnly(softLint))
+	require.False(t, s.warnOnly(softWriteRate))
+	s.now = func() time.Time { return time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC) }
+	require.False(t, s.warnOnly(softLint))
+}
+
+func TestSoftLimits(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Lint = []conf.LintRule{{Name: "named", Field: "name", Op: "match", Value: "^team-"}}
+	config.HTTP.WriteRate = 1
+	config.SoftLimits.Until = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	post := func(name string) (int, []string) {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		claim := jwt.NewAccountClaims(pubKey)
+		claim.Name = name
+		theJWT, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBufferString(theJWT))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Values(warningHeader)
+	}
+
+	status, warnings := post("team-a")
+	require.Equal(t, http.StatusOK, status)
+	require.Empty(t, warnings)
+
+	// the second post in the same second is over the rate, and the name breaks the rule
+	status, warnings = post("other")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, warnings, 2)
+	require.True(t, strings.HasPrefix(warnings[0], "write_rate: too many posts, enforced from "), warnings[0])
+	require.True(t, strings.HasPrefix(warnings[1], "lint: named: name"), warnings[1])
+	var out bytes.Buffer
+	testEnv.Server.metrics.write(&out)
+	require.Contains(t, out.String(), `soft_limit_violations_total{feature="lint"} 1`)
+
+	// once enforced both are refused
+	testEnv.Server.jwt.softLimits.until = time.Now().Add(-time.Second)
+	status, _ = post("other")
+	require.Equal(t, http.StatusTooManyRequests, status)
+	testEnv.Server.jwt.writes.setRate(0)
+	status, _ = post("other")
+	require.Equal(t, http.StatusBadRequest, status)
+}
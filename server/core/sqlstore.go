@@ -0,0 +1,254 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // registers the mysql driver
+	_ "github.com/lib/pq"              // registers the postgres driver
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+const defaultSQLTable = "account_jwts"
+
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqlDialect holds the statements that differ between databases, %s is replaced with the table
+type sqlDialect struct {
+	create string
+	load   string
+	save   string
+	remove string
+}
+
+var (
+	postgresDialect = sqlDialect{
+		create: "CREATE TABLE IF NOT EXISTS %s (pubkey VARCHAR(128) PRIMARY KEY, jwt TEXT NOT NULL)",
+		load:   "SELECT jwt FROM %s WHERE pubkey = $1",
+		save:   "INSERT INTO %s (pubkey, jwt) VALUES ($1, $2) ON CONFLICT (pubkey) DO UPDATE SET jwt = EXCLUDED.jwt",
+		remove: "DELETE FROM %s WHERE pubkey = $1",
+	}
+	mysqlDialect = sqlDialect{
+		create: "CREATE TABLE IF NOT EXISTS %s (pubkey VARCHAR(128) PRIMARY KEY, jwt MEDIUMTEXT NOT NULL)",
+		load:   "SELECT jwt FROM %s WHERE pubkey = ?",
+		save:   "INSERT INTO %s (pubkey, jwt) VALUES (?, ?) ON DUPLICATE KEY UPDATE jwt = VALUES(jwt)",
+		remove: "DELETE FROM %s WHERE pubkey = ?",
+	}
+)
+
+func init() {
+	RegisterStoreBackend("postgres", sqlBackend("postgres", postgresDialect))
+	RegisterStoreBackend("mysql", sqlBackend("mysql", mysqlDialect))
+}
+
+// sqlBackend opens the database with driver and creates the table if it doesn't exist
+func sqlBackend(driver string, dialect sqlDialect) StoreBackend {
+	return func(config conf.StoreConfig) (store.JWTStore, error) {
+		if config.DSN == "" {
+			return nil, fmt.Errorf("store type %s requires a dsn", config.Type)
+		}
+		table := config.Table
+		if table == "" {
+			table = defaultSQLTable
+		}
+		if !sqlTableName.MatchString(table) {
+			return nil, fmt.Errorf("bad store table name %q", table)
+		}
+		db, err := sql.Open(driver, config.DSN)
+		if err != nil {
+			return nil, err
+		}
+		return newSQLStore(db, table, dialect)
+	}
+}
+
+// sqlStore keeps account JWTs in a database table, one row per account
+type sqlStore struct {
+	db    *sql.DB
+	table string
+	sqlDialect
+}
+
+func newSQLStore(db *sql.DB, table string, dialect sqlDialect) (*sqlStore, error) {
+	ss := &sqlStore{db: db, table: table}
+	ss.create = fmt.Sprintf(dialect.create, table)
+	ss.load = fmt.Sprintf(dialect.load, table)
+	ss.save = fmt.Sprintf(dialect.save, table)
+	ss.remove = fmt.Sprintf(dialect.remove, table)
+	if _, err := db.Exec(ss.create); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating table %s: %v", table, err)
+	}
+	return ss, nil
+}
+
+func (ss *sqlStore) LoadAcc(publicKey string) (string, error) {
+	var theJWT string
+	err := ss.db.QueryRow(ss.load, publicKey).Scan(&theJWT)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("no JWT for %s", ShortKey(publicKey))
+	}
+	return theJWT, err
+}
+
+func (ss *sqlStore) SaveAcc(publicKey string, theJWT string) error {
+	_, err := ss.db.Exec(ss.save, publicKey, theJWT)
+	return err
+}
+
+func (ss *sqlStore) DeleteAcc(publicKey string) error {
+	result, err := ss.db.Exec(ss.remove, publicKey)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errAccountNotFound
+	}
+	return nil
+}
+
+func (ss *sqlStore) IsReadOnly() bool {
+	return false
+}
+
+func (ss *sqlStore) Close() {
+	ss.db.Close()
+}
+
+// size is the number of rows in the table
+func (ss *sqlStore) size() int {
+	count := 0
+	ss.db.QueryRow("SELECT COUNT(*) FROM " + ss.table).Scan(&count)
+	return count
+}
+
+// keys lists the public keys in the table, ordered
+func (ss *sqlStore) keys() ([]string, error) {
+	rows, err := ss.db.Query("SELECT pubkey FROM " + ss.table + " ORDER BY pubkey")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var pubKey string
+		if err := rows.Scan(&pubKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, pubKey)
+	}
+	return keys, rows.Err()
+}
+
+// Pack returns up to maxJWTs unexpired JWTs, ordered by public key
+func (ss *sqlStore) Pack(maxJWTs int) (string, error) {
+	rows, err := ss.db.Query("SELECT pubkey, jwt FROM " + ss.table + " ORDER BY pubkey")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var pack []string
+	now := time.Now().Unix()
+	for rows.Next() && len(pack) != maxJWTs {
+		var pubKey, theJWT string
+		if err := rows.Scan(&pubKey, &theJWT); err != nil {
+			return "", err
+		}
+		if claim, err := jwt.DecodeGeneric(theJWT); err == nil && claim.Expires > 0 && claim.Expires < now {
+			continue
+		}
+		pack = append(pack, fmt.Sprintf("%s|%s", pubKey, theJWT))
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(pack, "\n"), nil
+}
+
+// Merge saves the JWTs in the pack that are newer than the stored ones, in one transaction
+func (ss *sqlStore) Merge(pack string) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(pack, "\n") {
+		if line == "" {
+			continue
+		}
+		split := strings.Split(line, "|")
+		if len(split) != 2 {
+			tx.Rollback()
+			return fmt.Errorf("line in package didn't contain 2 entries: %q", line)
+		}
+		pubKey, theJWT := split[0], split[1]
+		if !nkeys.IsValidPublicAccountKey(pubKey) {
+			tx.Rollback()
+			return fmt.Errorf("key to merge is not a valid public account key")
+		}
+		var existing string
+		if err := tx.QueryRow(ss.load, pubKey).Scan(&existing); err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			return err
+		}
+		if newer, err := isNewerJWT(pubKey, existing, theJWT); err != nil {
+			tx.Rollback()
+			return err
+		} else if !newer {
+			continue
+		}
+		if _, err := tx.Exec(ss.save, pubKey, theJWT); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// isNewerJWT applies the rules the directory store uses when merging, theJWT replaces existing
+// unless existing has the same jti or was issued later
+func isNewerJWT(pubKey string, existing string, theJWT string) (bool, error) {
+	newClaim, err := jwt.DecodeGeneric(theJWT)
+	if err != nil {
+		return false, err
+	}
+	if existing == "" {
+		return true, nil
+	}
+	existingClaim, err := jwt.DecodeGeneric(existing)
+	if err != nil {
+		return true, nil // replace what can't be decoded
+	}
+	switch {
+	case existingClaim.ID == newClaim.ID:
+		return false, nil
+	case existingClaim.IssuedAt > newClaim.IssuedAt:
+		return false, nil
+	case newClaim.Subject != pubKey:
+		return false, errors.New("jwt subject nkey and provided nkey do not match")
+	case existingClaim.Subject != newClaim.Subject:
+		return false, errors.New("subject of existing and new jwt do not match")
+	}
+	return true, nil
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// memDriver is a database/sql driver that understands just the statements of the sql store,
+// every dsn is a separate in memory table
+type memDriver struct {
+	sync.Mutex
+	tables map[string]map[string]string
+}
+
+var testDriver = &memDriver{tables: map[string]map[string]string{}}
+
+func init() {
+	sql.Register("sqltest", testDriver)
+	RegisterStoreBackend("sqltest", sqlBackend("sqltest", postgresDialect))
+}
+
+func (d *memDriver) Open(dsn string) (driver.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.tables[dsn] == nil {
+		d.tables[dsn] = map[string]string{}
+	}
+	return &memConn{d: d, rows: d.tables[dsn]}, nil
+}
+
+type memConn struct {
+	d    *memDriver
+	rows map[string]string
+}
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{c: c, query: query}, nil
+}
+func (c *memConn) Close() error              { return nil }
+func (c *memConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *memConn) Commit() error             { return nil }
+func (c *memConn) Rollback() error           { return nil }
+
+type memStmt struct {
+	c     *memConn
+	query string
+}
+
+func (s *memStmt) Close() error  { return nil }
+func (s *memStmt) NumInput() int { return -1 }
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.d.Lock()
+	defer s.c.d.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "CREATE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "INSERT"):
+		s.c.rows[args[0].(string)] = args[1].(string)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "DELETE"):
+		if _, ok := s.c.rows[args[0].(string)]; !ok {
+			return driver.RowsAffected(0), nil
+		}
+		delete(s.c.rows, args[0].(string))
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unsupported statement %q", s.query)
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.d.Lock()
+	defer s.c.d.Unlock()
+	rows := &memRows{}
+	switch {
+	case strings.HasPrefix(s.query, "SELECT jwt"):
+		rows.columns = []string{"jwt"}
+		if theJWT, ok := s.c.rows[args[0].(string)]; ok {
+			rows.values = [][]driver.Value{{theJWT}}
+		}
+	case strings.HasPrefix(s.query, "SELECT COUNT"):
+		rows.columns = []string{"count"}
+		rows.values = [][]driver.Value{{int64(len(s.c.rows))}}
+	case strings.HasPrefix(s.query, "SELECT pubkey FROM"):
+		rows.columns = []string{"pubkey"}
+		for pubKey := range s.c.rows {
+			rows.values = append(rows.values, []driver.Value{pubKey})
+		}
+	case strings.HasPrefix(s.query, "SELECT pubkey, jwt"):
+		rows.columns = []string{"pubkey", "jwt"}
+		for pubKey, theJWT := range s.c.rows {
+			rows.values = append(rows.values, []driver.Value{pubKey, theJWT})
+		}
+		sort.Slice(rows.values, func(i, j int) bool {
+			return rows.values[i][0].(string) < rows.values[j][0].(string)
+		})
+	default:
+		return nil, fmt.Errorf("unsupported query %q", s.query)
+	}
+	return rows, nil
+}
+
+type memRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *memRows) Columns() []string { return r.columns }
+func (r *memRows) Close() error      { return nil }
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestSQLStore(t *testing.T) {
+	config := conf.StoreConfig{Type: "sqltest", DSN: "TestSQLStore"}
+	backend, ok := storeBackend("postgres")
+	require.True(t, ok)
+	_, err := backend(conf.StoreConfig{Type: "postgres"})
+	require.Error(t, err, "dsn is required")
+	backend, _ = storeBackend("sqltest")
+	_, err = backend(conf.StoreConfig{Type: "sqltest", DSN: "x", Table: "jwts; DROP TABLE x"})
+	require.Error(t, err)
+
+	s, err := backend(config)
+	require.NoError(t, err)
+	defer s.Close()
+	ss := s.(*sqlStore)
+
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	_, err = ss.LoadAcc(pubKey)
+	require.Error(t, err)
+
+	claim := jwt.NewAccountClaims(pubKey)
+	older, err := claim.Encode(operatorKey)
+	require.NoError(t, err)
+	claim.Name = "newer"
+	newer, err := claim.Encode(operatorKey)
+	require.NoError(t, err)
+
+	require.NoError(t, ss.SaveAcc(pubKey, older))
+	theJWT, err := ss.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, older, theJWT)
+	require.Equal(t, 1, ss.size())
+
+	require.NoError(t, ss.Merge(pubKey+"|"+newer))
+	theJWT, err = ss.LoadAcc(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, newer, theJWT)
+
+	other, otherJWT := newAccountJWT(t, operatorKey)
+	require.NoError(t, ss.Merge(other+"|"+otherJWT))
+	require.Error(t, ss.Merge("bad|"+otherJWT))
+	require.Error(t, ss.Merge(pubKey+"|"+otherJWT), "subject doesn't match the key")
+
+	pack, err := ss.Pack(-1)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(pack, "\n"), 2)
+	require.Contains(t, pack, pubKey+"|"+newer)
+	pack, err = ss.Pack(1)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(pack, "\n"), 1)
+
+	require.NoError(t, ss.DeleteAcc(pubKey))
+	require.Equal(t, errAccountNotFound, ss.DeleteAcc(pubKey))
+	require.Equal(t, 1, ss.size())
+}
+
+func TestSQLStoreServer(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store = conf.StoreConfig{Type: "sqltest", DSN: "TestSQLStoreServer"}
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 3)
+	for pubKey, theJWT := range pubKeys {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, theJWT, string(body))
+	}
+
+	v := getVarz(t, testEnv)
+	require.Equal(t, "sqltest", v.Store.Type)
+	require.Equal(t, len(pubKeys), v.Store.JWTs)
+
+	require.Error(t, RegisterStoreBackend("sqltest", sqlBackend("sqltest", postgresDialect)))
+	require.Error(t, RegisterStoreBackend(conf.StoreDir, sqlBackend("sqltest", postgresDialect)))
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// httpCounters counts the requests served since the HTTP server started
+type httpCounters struct {
+	requests atomic.Int64
+	inFlight atomic.Int64
+	classes  [6]atomic.Int64 // responses by status class, 1xx to 5xx
+}
+
+// statusWriter remembers the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// count wraps next, counting its requests and responses
+func (c *httpCounters) count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.requests.Add(1)
+		c.inFlight.Add(1)
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			c.inFlight.Add(-1)
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if class := status / 100; class > 0 && class < len(c.classes) {
+				c.classes[class].Add(1)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// httpStatsz are the HTTP requests in statsz
+type httpStatsz struct {
+	Requests  int64            `json:"requests"`
+	InFlight  int64            `json:"in_flight"`
+	Responses map[string]int64 `json:"responses"` // by status class, i.e. 2xx
+}
+
+// dataStats mirrors the message counts of the nats-server statsz
+type dataStats struct {
+	Msgs  uint64 `json:"msgs"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// statsz is the load of the server, shaped like the statsz of the nats-server
+type statsz struct {
+	Server     map[string]interface{} `json:"server"`
+	Now        time.Time              `json:"now"`
+	Uptime     string                 `json:"uptime"`
+	Mem        uint64                 `json:"mem"` // bytes obtained from the OS
+	Cores      int                    `json:"cores"`
+	Goroutines int                    `json:"goroutines"`
+	HTTP       httpStatsz             `json:"http"`
+	Sent       dataStats              `json:"sent"`     // NATS messages published
+	Received   dataStats              `json:"received"` // NATS messages received
+}
+
+// getStatsz handles GET /statsz
+func (server *AccountServer) getStatsz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	server.Lock()
+	s := statsz{
+		Server:     server.serverInfo(),
+		Now:        time.Now().UTC(),
+		Uptime:     time.Since(server.startTime).Round(time.Second).String(),
+		Mem:        mem.Sys,
+		Cores:      runtime.NumCPU(),
+		Goroutines: runtime.NumGoroutine(),
+		HTTP:       httpStatsz{Responses: map[string]int64{}},
+	}
+	nc := server.nats
+	c := server.httpStats
+	server.Unlock()
+	if c != nil {
+		s.HTTP.Requests = c.requests.Load()
+		s.HTTP.InFlight = c.inFlight.Load()
+		for class := 1; class < len(c.classes); class++ {
+			s.HTTP.Responses[fmt.Sprintf("%dxx", class)] = c.classes[class].Load()
+		}
+	}
+	if nc != nil {
+		stats := nc.Stats()
+		s.Sent = dataStats{Msgs: stats.OutMsgs, Bytes: stats.OutBytes}
+		s.Received = dataStats{Msgs: stats.InMsgs, Bytes: stats.InBytes}
+	}
+	server.writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats.go"
+)
+
+// natsHealth is the NATS connection in statusz
+type natsHealth struct {
+	natsStatus
+	ServerName string `json:"server_name,omitempty"`
+	RTT        string `json:"rtt,omitempty"`
+	Pending    int    `json:"pending_bytes"` // buffered while the connection is down
+}
+
+// syncHealth is the pack sync in statusz
+type syncHealth struct {
+	LastSync      *time.Time `json:"last_sync,omitempty"`
+	DivergedSince *time.Time `json:"diverged_since,omitempty"`
+	Diverged      string     `json:"diverged,omitempty"` // how long the store has differed from the other account servers
+}
+
+// statusz is the state of the NATS connection and of the sync with the other account servers
+type statusz struct {
+	Now              time.Time   `json:"now"`
+	NATS             natsHealth  `json:"nats"`
+	Sync             *syncHealth `json:"sync,omitempty"` // set once the server syncs with other account servers
+	LastNotification *time.Time  `json:"last_notification,omitempty"`
+	Warnings         []string    `json:"warnings"`
+}
+
+// optionalTime returns nil for the zero time
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// getStatusz handles GET /statusz
+func (server *AccountServer) getStatusz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	now := time.Now().UTC()
+	s := statusz{Now: now, Warnings: []string{}}
+	server.Lock()
+	s.NATS.natsStatus = server.describeNATS()
+	nc := server.nats
+	var sync *syncStatus
+	if server.syncStats != nil {
+		status := server.syncStats.snapshot()
+		sync = &status
+	}
+	threshold := server.syncDivergence()
+	server.Unlock()
+
+	if nc != nil {
+		s.NATS.ServerName = nc.ConnectedServerName()
+		if pending, err := nc.Buffered(); err == nil {
+			s.NATS.Pending = pending
+		}
+		// the round trip waits on the connection, so it is measured without the lock
+		if nc.IsConnected() {
+			if rtt, err := nc.RTT(); err == nil {
+				s.NATS.RTT = rtt.String()
+			}
+		}
+	}
+	if s.NATS.Configured && s.NATS.Status != nats.CONNECTED.String() {
+		s.Warnings = append(s.Warnings, fmt.Sprintf("NATS is %s", s.NATS.Status))
+	}
+	if sync != nil {
+		s.Sync = &syncHealth{LastSync: optionalTime(sync.LastSync), DivergedSince: optionalTime(sync.DivergedSince)}
+		if !sync.DivergedSince.IsZero() {
+			diverged := now.Sub(sync.DivergedSince)
+			s.Sync.Diverged = diverged.Round(time.Second).String()
+			if threshold > 0 && diverged > threshold {
+				s.Warnings = append(s.Warnings, fmt.Sprintf("the store differs from the other account servers for %s", s.Sync.Diverged))
+			}
+		}
+	}
+	if t := server.lastNotified.Load(); t != 0 {
+		s.LastNotification = optionalTime(time.Unix(0, t).UTC())
+	}
+	server.writeJSON(w, http.StatusOK, s)
+}
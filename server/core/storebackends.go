@@ -0,0 +1,83 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// StoreBackend creates a store from the store configuration, it is called on every start
+type StoreBackend func(config conf.StoreConfig) (store.JWTStore, error)
+
+var (
+	backendsLock  sync.Mutex
+	storeBackends = map[string]StoreBackend{}
+)
+
+// RegisterStoreBackend makes a store type selectable with store.type in the configuration,
+// registering a name twice or one of the built in dir and none types is an error
+func RegisterStoreBackend(name string, backend StoreBackend) error {
+	if name == "" || backend == nil {
+		return fmt.Errorf("store backends require a name and a constructor")
+	}
+	if name == conf.StoreDir || name == conf.StoreNone {
+		return fmt.Errorf("store type %q is built in", name)
+	}
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if _, ok := storeBackends[name]; ok {
+		return fmt.Errorf("store type %q is already registered", name)
+	}
+	storeBackends[name] = backend
+	return nil
+}
+
+// storeBackend returns the backend registered with name
+func storeBackend(name string) (StoreBackend, bool) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backend, ok := storeBackends[name]
+	return backend, ok
+}
+
+// storeTypes lists the built in and registered store types
+func storeTypes() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	types := []string{conf.StoreDir, conf.StoreNone}
+	for name := range storeBackends {
+		types = append(types, name)
+	}
+	sort.Strings(types[2:])
+	return types
+}
+
+// OpenStore creates the store described by the configuration without a running server, for tools and
+// benchmarks. Store type none looks accounts up through the server and can't be opened this way.
+func OpenStore(config conf.StoreConfig) (store.JWTStore, error) {
+	if config.Type == conf.StoreNone {
+		return nil, fmt.Errorf("store type %q requires a running server", config.Type)
+	}
+	server := NewAccountServer()
+	server.config = conf.DefaultServerConfig()
+	server.config.Store = config
+	return server.createStore()
+}
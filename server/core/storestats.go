@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// storeReport is the body of GET /admin/v1/store, taken when it is requested
+type storeReport struct {
+	Type            string `json:"type"`
+	Dir             string `json:"dir,omitempty"`
+	Entries         int    `json:"entries"`
+	Bytes           int64  `json:"bytes"` // of every file in the store directory, 0 for other stores
+	Shard           bool   `json:"shard"`
+	CleanupInterval int    `json:"cleanup_interval"` // milliseconds, 0 is one minute
+	MaxJWTs         int    `json:"max_jwts"`         // 0 is unlimited
+	EvictionPolicy  string `json:"eviction_policy"`
+	Expiring        int    `json:"expiring"` // stored JWTs with an expiration, tracked until it passes
+	Hash            string `json:"hash,omitempty"`
+}
+
+// primaryDirStore returns the directory store behind the server's store, if there is one
+func primaryDirStore(jwtStore store.JWTStore) (*dirStore, bool) {
+	if ds, ok := jwtStore.(*dualStore); ok {
+		jwtStore = ds.primary
+	}
+	dir, ok := jwtStore.(*dirStore)
+	return dir, ok
+}
+
+// walkStoreDir counts the JWT files of the store directory along with the ones that expire, and sums
+// the size of every file in it
+func walkStoreDir(dir string, report *storeReport) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		report.Bytes += info.Size()
+		if !strings.HasSuffix(path, ".jwt") {
+			return nil
+		}
+		report.Entries++
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if claim, err := jwt.DecodeGeneric(string(data)); err == nil && claim.Expires > 0 {
+			report.Expiring++
+		}
+		return nil
+	})
+}
+
+// countPack counts the JWTs of a store without a directory, and the ones that expire
+func countPack(packer store.PackableJWTStore, report *storeReport) error {
+	pack, err := packer.Pack(-1)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(pack, "\n") {
+		_, theJWT, ok := strings.Cut(line, "|")
+		if !ok {
+			continue
+		}
+		report.Entries++
+		if claim, err := jwt.DecodeGeneric(theJWT); err == nil && claim.Expires > 0 {
+			report.Expiring++
+		}
+	}
+	return nil
+}
+
+// getStoreStats handles GET /admin/v1/store, the store is walked for every request
+func (server *AccountServer) getStoreStats(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.Lock()
+	config, jwtStore := server.config.Store, server.JWTStore
+	report := storeReport{
+		Type:           config.Type,
+		MaxJWTs:        config.MaxJWTs,
+		EvictionPolicy: server.evictionPolicy(),
+	}
+	server.Unlock()
+	if report.Type == "" {
+		report.Type = conf.StoreDir
+	}
+	if hashed, ok := jwtStore.(syncableStore); ok {
+		hash := hashed.Hash()
+		report.Hash = hex.EncodeToString(hash[:])
+	}
+
+	var err error
+	if dir, ok := primaryDirStore(jwtStore); ok {
+		report.Dir, report.Shard, report.CleanupInterval = dir.dir, dir.shard, config.CleanupInterval
+		err = walkStoreDir(dir.dir, &report)
+	} else if packer, ok := jwtStore.(store.PackableJWTStore); ok {
+		err = countPack(packer, &report)
+	} else if sized, ok := jwtStore.(sizedStore); ok {
+		report.Entries = sized.size()
+	}
+	if err != nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error reading the store", "", err, w)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, report)
+}
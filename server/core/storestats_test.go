@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreStats(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	config.Store.MaxJWTs = 2
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	stats := func() storeReport {
+		status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/store", testAdminToken, "")
+		require.Equal(t, http.StatusOK, status)
+		report := storeReport{}
+		require.NoError(t, json.Unmarshal([]byte(body), &report))
+		return report
+	}
+	report := stats()
+	require.Equal(t, conf.StoreDir, report.Type)
+	require.Equal(t, testEnv.Server.config.Store.Dir, report.Dir)
+	require.Zero(t, report.Entries)
+	require.Zero(t, report.Bytes)
+	require.Equal(t, 2, report.MaxJWTs)
+	require.Equal(t, conf.EvictLRU, report.EvictionPolicy)
+	empty := report.Hash
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	account := jwt.NewAccountClaims(pubKey)
+	account.Expires = time.Now().Add(time.Hour).Unix()
+	expiringJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(pubKey, expiringJWT))
+
+	otherKey, otherJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(otherKey, otherJWT))
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(otherKey, otherJWT))
+
+	report = stats()
+	require.Equal(t, 2, report.Entries)
+	require.Equal(t, int64(len(expiringJWT)+len(otherJWT)), report.Bytes)
+	require.Equal(t, 1, report.Expiring)
+	require.NotEqual(t, empty, report.Hash)
+
+	// the store is full, the expiring account was used least recently and makes room
+	thirdKey, thirdJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.NoError(t, testEnv.Server.JWTStore.SaveAcc(thirdKey, thirdJWT))
+	report = stats()
+	require.Equal(t, 2, report.Entries)
+	require.Zero(t, report.Expiring)
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// natsSubjects are the configurable subjects, as formats with a %s token in place of each wildcard
+type natsSubjects struct {
+	accountUpdate    string
+	activationUpdate string
+	activationTarget string // the activation format with a token for the target before the hash, see targetFormat
+	accountLookup    string
+	pack             string
+	userUpdate       string
+	activationDelete string
+}
+
+// newNATSSubjects checks the configured subjects, each needs its wildcards and nothing else that can't
+// be published to
+func newNATSSubjects(config conf.SubjectConfig) (*natsSubjects, error) {
+	s := &natsSubjects{
+		accountUpdate:    accountNotificationFormat,
+		activationUpdate: activationNotificationFormat,
+		activationTarget: activationTargetFormat,
+		accountLookup:    accountLookupRequest,
+		pack:             accountPackRequest,
+		userUpdate:       userNotificationFormat,
+		activationDelete: activationDeleteFormat,
+	}
+	var err error
+	if config.AccountUpdate != "" {
+		if s.accountUpdate, err = subjectFormat("account_update", config.AccountUpdate, 1); err != nil {
+			return nil, err
+		}
+	}
+	if config.ActivationUpdate != "" {
+		if s.activationUpdate, err = subjectFormat("activation_update", config.ActivationUpdate, 2); err != nil {
+			return nil, err
+		}
+		s.activationTarget = targetFormat(s.activationUpdate)
+	}
+	if config.AccountLookup != "" {
+		if s.accountLookup, err = subjectFormat("account_lookup", config.AccountLookup, 1); err != nil {
+			return nil, err
+		}
+	}
+	if config.Pack != "" {
+		if s.pack, err = subjectFormat("pack", config.Pack, 0); err != nil {
+			return nil, err
+		}
+	}
+	if config.UserUpdate != "" {
+		if s.userUpdate, err = subjectFormat("user_update", config.UserUpdate, 2); err != nil {
+			return nil, err
+		}
+	}
+	if config.ActivationDelete != "" {
+		if s.activationDelete, err = subjectFormat("activation_delete", config.ActivationDelete, 2); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// subjectFormat turns a subject with wildcards into a format, it has to have exactly the given number
+// of * tokens
+func subjectFormat(option string, subject string, wildcards int) (string, error) {
+	tokens := strings.Split(subject, ".")
+	found := 0
+	for i, t := range tokens {
+		switch {
+		case t == "":
+			return "", fmt.Errorf("subject %s %q has an empty token", option, subject)
+		case t == ">":
+			return "", fmt.Errorf("subject %s %q can't contain >", option, subject)
+		case strings.ContainsAny(t, "% \t\r\n"):
+			return "", fmt.Errorf("subject %s %q contains an invalid character", option, subject)
+		case t == "*":
+			found++
+			tokens[i] = "%s"
+		}
+	}
+	if found != wildcards {
+		return "", fmt.Errorf("subject %s %q needs %d * wildcards, found %d", option, subject, wildcards, found)
+	}
+	return strings.Join(tokens, "."), nil
+}
+
+// targetFormat inserts a token for the target before the hash of an activation format and appends _TARGET,
+// or _target to a lower case one, to the last token that isn't a wildcard, so subscribers to the activation subjects with > don't receive
+// every activation twice. Without such a token the subject starts with a TARGET token instead.
+func targetFormat(format string) string {
+	tokens := strings.Split(format, ".")
+	hash := len(tokens) - 1
+	for tokens[hash] != "%s" {
+		hash--
+	}
+	renamed := false
+	for i := hash - 1; i >= 0 && !renamed; i-- {
+		if renamed = tokens[i] != "%s"; !renamed {
+			continue
+		} else if tokens[i] == strings.ToLower(tokens[i]) {
+			tokens[i] += "_target"
+		} else {
+			tokens[i] += "_TARGET"
+		}
+	}
+	if !renamed {
+		tokens = append([]string{"TARGET"}, tokens...)
+		hash++
+	}
+	tokens = append(tokens[:hash], append([]string{"%s"}, tokens[hash:]...)...)
+	return strings.Join(tokens, ".")
+}
+
+// wildcard returns the subject of a format that matches every subject it can produce
+func wildcard(format string) string {
+	return strings.Replace(format, "%s", "*", -1)
+}
+
+// lookupAccount returns the account a lookup request is for, empty if the subject doesn't match
+func (s *natsSubjects) lookupAccount(subject string) string {
+	format := strings.Split(s.accountLookup, ".")
+	tokens := strings.Split(subject, ".")
+	if len(tokens) != len(format) {
+		return ""
+	}
+	account := ""
+	for i, t := range format {
+		if t == "%s" {
+			account = tokens[i]
+		} else if t != tokens[i] {
+			return ""
+		}
+	}
+	return account
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATSSubjectsValidation(t *testing.T) {
+	s, err := newNATSSubjects(conf.SubjectConfig{})
+	require.NoError(t, err)
+	require.Equal(t, accountNotificationFormat, s.accountUpdate)
+	require.Equal(t, activationTargetFormat, s.activationTarget)
+	require.Equal(t, "ACC", s.lookupAccount("$SYS.REQ.ACCOUNT.ACC.CLAIMS.LOOKUP"))
+	require.Empty(t, s.lookupAccount("$SYS.REQ.ACCOUNT.ACC.CLAIMS.UPDATE"))
+
+	s, err = newNATSSubjects(conf.SubjectConfig{ActivationUpdate: "sys.*.activate.*"})
+	require.NoError(t, err)
+	require.Equal(t, "sys.%s.activate.%s", s.activationUpdate)
+	require.Equal(t, "sys.%s.activate_target.%s.%s", s.activationTarget)
+
+	s, err = newNATSSubjects(conf.SubjectConfig{ActivationUpdate: "*.*.tail"})
+	require.NoError(t, err)
+	require.Equal(t, "TARGET.%s.%s.%s.tail", s.activationTarget)
+
+	for _, bad := range []conf.SubjectConfig{
+		{AccountUpdate: "sys.claims.update"},
+		{AccountUpdate: "sys.*.*.update"},
+		{AccountUpdate: "sys.*.>"},
+		{AccountUpdate: "sys..*"},
+		{AccountUpdate: "sys.%s.update"},
+		{ActivationUpdate: "sys.*.activate"},
+		{AccountLookup: "sys.lookup"},
+		{Pack: "sys.*.pack"},
+	} {
+		_, err := newNATSSubjects(bad)
+		require.Error(t, err, "%+v", bad)
+	}
+}
+
+func TestRemappedSubjects(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Subjects = conf.SubjectConfig{
+		AccountUpdate: "mapped.*.update",
+		AccountLookup: "mapped.lookup.*",
+		Pack:          "mapped.pack",
+	}
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	updates, err := testEnv.NC.SubscribeSync("mapped.*.update")
+	require.NoError(t, err)
+	legacy, err := testEnv.NC.SubscribeSync(wildcard(accountNotificationFormat))
+	require.NoError(t, err)
+	pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+	msg, err := updates.NextMsg(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "mapped."+pubKey+".update", msg.Subject)
+	require.Equal(t, theJWT, string(msg.Data))
+	_, err = legacy.NextMsg(100 * time.Millisecond)
+	require.Error(t, err, "nothing is sent on the default subject")
+
+	msg, err = testEnv.NC.Request("mapped.lookup."+pubKey, nil, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, theJWT, string(msg.Data))
+
+	// a pack request without a hash gets every JWT
+	ib := testEnv.NC.NewRespInbox()
+	packs, err := testEnv.NC.SubscribeSync(ib)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.PublishRequest("mapped.pack", ib, nil))
+	var pack []string
+	for {
+		msg, err = packs.NextMsg(time.Second)
+		require.NoError(t, err)
+		if len(msg.Data) == 0 {
+			break
+		}
+		pack = append(pack, string(msg.Data))
+	}
+	require.Contains(t, pack, pubKey+"|"+theJWT)
+}
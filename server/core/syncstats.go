@@ -0,0 +1,133 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// syncStatus describes the pack sync with the other account servers, reported in /varz
+type syncStatus struct {
+	Interval    int       `json:"interval"` // milliseconds
+	Jitter      int       `json:"jitter"`   // milliseconds
+	LastRequest time.Time `json:"last_request,omitempty"`
+	LastSync    time.Time `json:"last_sync,omitempty"` // the last time a peer finished responding
+	Requests    int64     `json:"requests"`
+	Syncs       int64     `json:"syncs"`
+	Merges      int64     `json:"merges"` // pack messages merged into the store
+	MergeErrors int64     `json:"merge_errors"`
+	// DivergedSince is the first of the syncs in a row the responder sent JWTs in, zero once a sync finds
+	// the store matching
+	DivergedSince time.Time `json:"diverged_since,omitempty"`
+}
+
+// syncStats counts the pack requests sent and the responses merged while connected to NATS
+type syncStats struct {
+	sync.Mutex
+	status   syncStatus
+	received int64 // pack messages received in the current sync
+	warned   bool  // the current divergence was warned about
+}
+
+func (s *syncStats) requested() {
+	s.Lock()
+	defer s.Unlock()
+	s.status.LastRequest = time.Now().UTC()
+	s.status.Requests++
+}
+
+func (s *syncStats) merged(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.received++
+	if err != nil {
+		s.status.MergeErrors++
+	} else {
+		s.status.Merges++
+	}
+}
+
+// finished ends a sync, the store differs from the responder if it sent JWTs. It returns when the store
+// started to differ, and true the first time that is longer ago than threshold, 0 never warns.
+func (s *syncStats) finished(threshold time.Duration) (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now().UTC()
+	s.status.LastSync = now
+	s.status.Syncs++
+	if s.received == 0 {
+		s.status.DivergedSince = time.Time{}
+		s.warned = false
+		return time.Time{}, false
+	}
+	s.received = 0
+	if s.status.DivergedSince.IsZero() {
+		s.status.DivergedSince = now
+	}
+	if threshold <= 0 || s.warned || now.Sub(s.status.DivergedSince) <= threshold {
+		return s.status.DivergedSince, false
+	}
+	s.warned = true
+	return s.status.DivergedSince, true
+}
+
+func (s *syncStats) snapshot() syncStatus {
+	s.Lock()
+	defer s.Unlock()
+	return s.status
+}
+
+// currentSyncInterval is the interval set by an override, the configured interval or the reconnect
+// wait, assumes the lock is held
+func (server *AccountServer) currentSyncInterval() time.Duration {
+	interval := server.syncInterval
+	if interval <= 0 {
+		interval = time.Duration(server.config.SyncInterval) * time.Millisecond
+	}
+	if interval <= 0 {
+		interval = time.Duration(server.config.NATS.ReconnectWait) * time.Millisecond
+	}
+	return interval
+}
+
+// defaultSyncDivergence is how long the store may differ from the other account servers before it is
+// warned about, when syncdivergence isn't set
+const defaultSyncDivergence = 5 * time.Minute
+
+// syncDivergence returns how long the store may differ from the other account servers, 0 if it is never
+// warned about
+func (server *AccountServer) syncDivergence() time.Duration {
+	switch d := server.config.SyncDivergence; {
+	case d < 0:
+		return 0
+	case d == 0:
+		return defaultSyncDivergence
+	default:
+		return time.Duration(d) * time.Millisecond
+	}
+}
+
+// syncPeriod is the time until the next pack request, the interval with the jitter added, assumes the
+// lock is held
+func (server *AccountServer) syncPeriod() time.Duration {
+	interval := server.currentSyncInterval()
+	if jitter := server.config.SyncJitter; jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(jitter))) * time.Millisecond
+	}
+	return interval
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// systemAccount returns the subject and JWT of the system account, either may be empty
+func (h *JwtHandler) systemAccount() (string, string) {
+	h.sysAccLock.RLock()
+	defer h.sysAccLock.RUnlock()
+	return h.sysAccSubject, h.sysAccJWT
+}
+
+// isSystemAccount returns true if pubKey is the system account
+func (h *JwtHandler) isSystemAccount(pubKey string) bool {
+	subject, _ := h.systemAccount()
+	return subject != "" && pubKey == subject
+}
+
+// operatorSystemAccount returns the system account named by the first operator, if any
+func (h *JwtHandler) operatorSystemAccount() string {
+	if len(h.operators) == 0 {
+		return ""
+	}
+	return h.operators[0].claim.SystemAccount
+}
+
+// replaceSystemAccount makes theJWT the system account JWT. It has to be for the current system account,
+// or for the one named by the operator, unless rename is set, and it can't be older than the current
+// JWT. The change is reported with true.
+func (h *JwtHandler) replaceSystemAccount(theJWT string, rename bool) (bool, error) {
+	claim, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil {
+		return false, err
+	}
+	h.sysAccLock.Lock()
+	defer h.sysAccLock.Unlock()
+	if theJWT == h.sysAccJWT {
+		return false, nil
+	}
+	if opSys := h.operatorSystemAccount(); opSys != "" && claim.Subject != opSys {
+		if claim.Subject != h.sysAccSubject {
+			return false, fmt.Errorf("the Operator System Account %s differs from the System Account %s", opSys, claim.Subject)
+		}
+	} else if opSys == "" && claim.Subject != h.sysAccSubject && !rename {
+		return false, fmt.Errorf("%s is not the System Account", claim.Subject)
+	}
+	if claim.Subject == h.sysAccSubject && h.sysAccJWT != "" {
+		if current, err := jwt.DecodeAccountClaims(h.sysAccJWT); err == nil && current.IssuedAt > claim.IssuedAt {
+			return false, fmt.Errorf("older than the current System Account JWT")
+		}
+	}
+	if claim.Subject != h.sysAccSubject {
+		h.logger.Noticef("System Account changed from %s to %s", h.sysAccSubject, claim.Subject)
+	} else {
+		h.logger.Noticef("System Account JWT replaced, jti %s", claim.ID)
+	}
+	h.sysAccSubject = claim.Subject
+	h.sysAccJWT = theJWT
+	return true, nil
+}
+
+// refreshSystemAccount replaces the system account JWT with a JWT saved for the system account, posted
+// or received over NATS, so a rotated system account JWT doesn't require a restart
+func (h *JwtHandler) refreshSystemAccount(pubKey string, theJWT string) {
+	if pubKey == "" || (!h.isSystemAccount(pubKey) && pubKey != h.operatorSystemAccount()) {
+		return
+	}
+	if _, err := h.replaceSystemAccount(theJWT, false); err != nil {
+		h.logger.Warnf("%s - not used as the System Account JWT - %v", ShortKey(pubKey), err)
+	}
+}
+
+// startSystemAccountWatch checks the system account JWT file for changes, assumes the lock is held
+func (server *AccountServer) startSystemAccountWatch() {
+	path := server.config.SystemAccountJWTPath
+	interval := time.Duration(server.config.SystemAccountWatchInterval) * time.Millisecond
+	if path == "" || interval <= 0 {
+		return
+	}
+	quit := make(chan struct{})
+	server.stopSysAccWatch = quit
+	seed := server.config.SeedSystemAccount && !server.JWTStore.IsReadOnly()
+	h := &server.jwt
+	_, current := h.systemAccount()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := bytes.TrimSpace([]byte(current))
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				server.logger.Warnf("unable to read the System Account JWT %s, %v", path, err)
+				continue
+			}
+			data = bytes.TrimSpace(data)
+			if bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+			if changed, err := h.replaceSystemAccount(string(data), true); err != nil {
+				server.logger.Errorf("unable to use the System Account JWT %s, %v", path, err)
+				continue
+			} else if !changed || !seed {
+				continue
+			}
+			claim, _ := jwt.DecodeAccountClaims(string(data))
+			if msg, err := h.storeAccount(context.Background(), claim.Subject, data, nil); err != nil && !notificationPending(err) {
+				server.logger.Errorf("%s - %s - %v", ShortKey(claim.Subject), msg, err)
+			}
+		}
+	}()
+}
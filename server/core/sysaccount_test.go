@@ -0,0 +1,89 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemAccountHotSwap(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.SystemAccountWatchInterval = 20
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	h := &testEnv.Server.jwt
+
+	get := func(pubKey string) string {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(data)
+	}
+	sysJWT := func(name string) string {
+		claim := jwt.NewAccountClaims(testEnv.SystemAccountPubKey)
+		claim.Name = name
+		theJWT, err := claim.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		return theJWT
+	}
+
+	// a new file is picked up without a restart
+	time.Sleep(1100 * time.Millisecond)
+	fromFile := sysJWT("from file")
+	require.NoError(t, os.WriteFile(testEnv.SystemAccountJWTFile, []byte(fromFile+"\n"), 0644))
+	require.Eventually(t, func() bool {
+		_, current := h.systemAccount()
+		return current == fromFile
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, fromFile, get(testEnv.SystemAccountPubKey))
+
+	// so is a posted JWT
+	time.Sleep(1100 * time.Millisecond)
+	posted := sysJWT("posted")
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, testEnv.SystemAccountPubKey, []byte(posted)))
+	subject, current := h.systemAccount()
+	require.Equal(t, testEnv.SystemAccountPubKey, subject)
+	require.Equal(t, posted, current)
+
+	// other accounts and older JWTs don't replace it
+	pubKey, other := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(other)))
+	require.True(t, h.isSystemAccount(testEnv.SystemAccountPubKey))
+	_, err = h.replaceSystemAccount(other, false)
+	require.Error(t, err)
+	_, err = h.replaceSystemAccount(fromFile, false)
+	require.Error(t, err)
+	_, current = h.systemAccount()
+	require.Equal(t, posted, current)
+
+	// the file names a new system account
+	_, err = h.replaceSystemAccount(other, true)
+	require.NoError(t, err)
+	require.True(t, h.isSystemAccount(pubKey))
+	require.False(t, h.isSystemAccount(testEnv.SystemAccountPubKey))
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// tagIndex maps the tags of every account JWT saved or merged to the accounts. A new JWT replaces the
+// tags of its account, deleted accounts are left in the index and skipped by queries, which check the
+// stored JWT. All methods are safe to call on a nil index.
+type tagIndex struct {
+	sync.RWMutex
+	accounts map[string]map[string]struct{} // tag -> pubkeys
+	tags     map[string][]string            // pubkey -> tags
+}
+
+// newTagIndex returns nil if the index is off
+func newTagIndex(enabled bool, m *metrics) *tagIndex {
+	if !enabled {
+		return nil
+	}
+	x := &tagIndex{accounts: map[string]map[string]struct{}{}, tags: map[string][]string{}}
+	m.gaugeFunc("tag_index_tags", "Number of distinct tags in the tag index", func() float64 {
+		return float64(x.len())
+	})
+	return x
+}
+
+// normalizeTag lower cases a tag, the way the jwt library adds them
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// add indexes the tags of an account JWT, anything else is ignored
+func (x *tagIndex) add(theJWT string) {
+	if x == nil {
+		return
+	}
+	claim, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil {
+		return
+	}
+	x.Lock()
+	defer x.Unlock()
+	for _, tag := range x.tags[claim.Subject] {
+		delete(x.accounts[tag], claim.Subject)
+		if len(x.accounts[tag]) == 0 {
+			delete(x.accounts, tag)
+		}
+	}
+	delete(x.tags, claim.Subject)
+	for _, tag := range claim.Tags {
+		if tag = normalizeTag(tag); tag == "" {
+			continue
+		}
+		if x.accounts[tag] == nil {
+			x.accounts[tag] = map[string]struct{}{}
+		}
+		x.accounts[tag][claim.Subject] = struct{}{}
+		x.tags[claim.Subject] = append(x.tags[claim.Subject], tag)
+	}
+}
+
+// addPack indexes every JWT of a pack, pubkey|jwt lines
+func (x *tagIndex) addPack(pack string) {
+	if x == nil {
+		return
+	}
+	for _, line := range strings.Split(pack, "\n") {
+		if split := strings.SplitN(line, "|", 2); len(split) == 2 {
+			x.add(split[1])
+		}
+	}
+}
+
+// tagged returns the accounts indexed with the tag
+func (x *tagIndex) tagged(tag string) []string {
+	x.RLock()
+	defer x.RUnlock()
+	pubKeys := make([]string, 0, len(x.accounts[tag]))
+	for pubKey := range x.accounts[tag] {
+		pubKeys = append(pubKeys, pubKey)
+	}
+	return pubKeys
+}
+
+func (x *tagIndex) len() int {
+	if x == nil {
+		return 0
+	}
+	x.RLock()
+	defer x.RUnlock()
+	return len(x.accounts)
+}
+
+// initTagIndex indexes the JWTs in the store, later saves are added as they happen
+func (server *AccountServer) initTagIndex() error {
+	server.jwt.tags = newTagIndex(server.config.TagIndex, server.metrics)
+	x := server.jwt.tags
+	if x == nil {
+		return nil
+	}
+	if packer, ok := server.JWTStore.(store.PackableJWTStore); ok {
+		pack, err := packer.Pack(-1)
+		if err != nil {
+			return err
+		}
+		x.addPack(pack)
+	}
+	server.logger.Noticef("indexed the tags of %d accounts", len(x.tags))
+	return nil
+}
+
+// taggedAccounts is the response to GET /jwt/v1/accounts?tag=
+type taggedAccounts struct {
+	Tags     []string `json:"tags"`
+	Accounts []string `json:"accounts"`
+}
+
+// hasTags returns true if the account claims hold every tag
+func hasTags(claim *jwt.AccountClaims, tags []string) bool {
+	held := map[string]bool{}
+	for _, tag := range claim.Tags {
+		held[normalizeTag(tag)] = true
+	}
+	for _, tag := range tags {
+		if !held[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// accountsByTag handles GET /jwt/v1/accounts?tag=prod&tag=team-a, returning the public keys of the stored
+// accounts holding every tag, ordered. With the tag index the candidates come from the index and are
+// checked against the store, without it the whole store is read.
+func (h *JwtHandler) accountsByTag(w http.ResponseWriter, r *http.Request, tags []string) {
+	result := taggedAccounts{Tags: []string{}, Accounts: []string{}}
+	for _, tag := range tags {
+		if tag = normalizeTag(tag); tag != "" {
+			result.Tags = append(result.Tags, tag)
+		}
+	}
+	if len(result.Tags) == 0 {
+		h.sendErrorResponse(http.StatusBadRequest, "empty tag parameter", "", nil, w)
+		return
+	}
+
+	if h.tags != nil {
+		for _, pubKey := range h.tags.tagged(result.Tags[0]) {
+			theJWT, err := h.jwtStore.LoadAcc(pubKey)
+			if err != nil {
+				continue
+			}
+			if claim, err := jwt.DecodeAccountClaims(theJWT); err == nil && !h.revoked.has(pubKey) && hasTags(claim, result.Tags) {
+				result.Accounts = append(result.Accounts, pubKey)
+			}
+		}
+	} else {
+		packer, ok := h.jwtStore.(store.PackableJWTStore)
+		if !ok {
+			h.sendErrorResponse(http.StatusNotImplemented, "tag queries aren't supported by the store without tag_index", "", nil, w)
+			return
+		}
+		pack, err := packer.Pack(-1)
+		if err != nil {
+			h.sendErrorResponse(http.StatusInternalServerError, "error reading JWTs", "", err, w)
+			return
+		}
+		for _, line := range strings.Split(pack, "\n") {
+			split := strings.SplitN(line, "|", 2)
+			if len(split) != 2 || h.revoked.has(split[0]) {
+				continue
+			}
+			if claim, err := jwt.DecodeAccountClaims(split[1]); err == nil && hasTags(claim, result.Tags) {
+				result.Accounts = append(result.Accounts, split[0])
+			}
+		}
+	}
+	sort.Strings(result.Accounts)
+	h.logger.Tracef("%d accounts tagged %s", len(result.Accounts), strings.Join(result.Tags, ", "))
+
+	data, err := unescapedIndentedMarshal(result, "", "  ")
+	if err != nil {
+		h.sendErrorResponse(http.StatusInternalServerError, "error encoding response", "", err, w)
+		return
+	}
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
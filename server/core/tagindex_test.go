@@ -0,0 +1,99 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountsByTag(t *testing.T) {
+	for _, indexed := range []bool{true, false} {
+		config := conf.DefaultServerConfig()
+		config.TagIndex = indexed
+		testEnv, err := SetupTestServer(config, false, false)
+		defer testEnv.Cleanup()
+		require.NoError(t, err)
+		require.Equal(t, indexed, testEnv.Server.jwt.tags != nil)
+
+		query := func(q string) (int, taggedAccounts) {
+			resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts?" + q))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			var result taggedAccounts
+			if resp.StatusCode == http.StatusOK {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+			}
+			return resp.StatusCode, result
+		}
+		post := func(tags ...string) (string, *jwt.AccountClaims) {
+			accountKey, err := nkeys.CreateAccount()
+			require.NoError(t, err)
+			pubKey, err := accountKey.PublicKey()
+			require.NoError(t, err)
+			claim := jwt.NewAccountClaims(pubKey)
+			claim.Tags.Add(tags...)
+			theJWT, err := claim.Encode(testEnv.OperatorKey)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, postJWT(t, testEnv, pubKey, []byte(theJWT)))
+			return pubKey, claim
+		}
+
+		prodA, claimA := post("prod", "team:a")
+		prodB, _ := post("PROD", "team:b")
+		post("dev", "team:a")
+
+		status, result := query("tag=Prod")
+		require.Equal(t, http.StatusOK, status)
+		want := []string{prodA, prodB}
+		sort.Strings(want)
+		require.Equal(t, taggedAccounts{Tags: []string{"prod"}, Accounts: want}, result)
+
+		// every tag has to be held
+		_, result = query("tag=prod&tag=team:a")
+		require.Equal(t, []string{prodA}, result.Accounts)
+		_, result = query("tag=missing")
+		require.Empty(t, result.Accounts)
+		status, _ = query("tag=")
+		require.Equal(t, http.StatusBadRequest, status)
+
+		// retagging an account moves it
+		time.Sleep(1100 * time.Millisecond)
+		claimA.Tags = jwt.TagList{}
+		claimA.Tags.Add("staging")
+		theJWT, err := claimA.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, postJWT(t, testEnv, prodA, []byte(theJWT)))
+		_, result = query("tag=prod")
+		require.Equal(t, []string{prodB}, result.Accounts)
+		_, result = query("tag=staging")
+		require.Equal(t, []string{prodA}, result.Accounts)
+
+		// the index is rebuilt from the store on start
+		testEnv.Server.Stop()
+		require.NoError(t, testEnv.Server.Start())
+		_, result = query("tag=staging")
+		require.Equal(t, []string{prodA}, result.Accounts)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// tenantName is what a tenant name may hold, it is used as a path segment and as a subject token
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedTenantNames are the path segments of the account API under /jwt/v1/
+var reservedTenantNames = map[string]bool{
+	"help": true, "info": true, "operator": true, "operators": true, "accounts": true, "migrations": true,
+	"pack": true, "activations": true, "users": true, "jti": true,
+}
+
+// tenant is a store served next to the main one, with its own operator and handler. Tenants take
+// posts over HTTP only, they don't sync, answer lookups or receive updates over NATS.
+type tenant struct {
+	name   string
+	prefix string // put in front of the notification subjects
+	jwt    JwtHandler
+	router *httprouter.Router // the account API of the tenant, without its path segment
+}
+
+// startTenants opens the store of every configured tenant and sets up its handler
+func (server *AccountServer) startTenants() error {
+	server.tenants = nil
+	seen := map[string]bool{}
+	for _, config := range server.config.Tenants {
+		if seen[config.Name] {
+			server.stopTenants()
+			return fmt.Errorf("tenant %q is configured twice", config.Name)
+		}
+		seen[config.Name] = true
+		t, err := server.newTenant(config)
+		if err != nil {
+			server.stopTenants()
+			return fmt.Errorf("tenant %q: %v", config.Name, err)
+		}
+		server.tenants = append(server.tenants, t)
+		server.logger.Noticef("serving tenant %s under /jwt/v1/%s/ for operator %s", t.name, t.name, ShortKey(t.jwt.operatorSubject))
+	}
+	return nil
+}
+
+func (server *AccountServer) newTenant(config conf.TenantConfig) (*tenant, error) {
+	if !tenantName.MatchString(config.Name) {
+		return nil, errors.New("the name may only hold letters, digits, - and _")
+	}
+	if reservedTenantNames[config.Name] {
+		return nil, errors.New("the name is used by the account API")
+	}
+	if config.OperatorJWTPath == "" {
+		return nil, errors.New("an operator JWT is required")
+	}
+	switch {
+	case config.Store.Type == conf.StoreNone:
+		return nil, errors.New("store type none isn't supported for tenants")
+	case config.Store.NSC != "":
+		return nil, errors.New(NscError)
+	case config.Store.ReadOnly:
+		return nil, errors.New(RoError)
+	case config.Store.Dir != "" && filepath.Clean(config.Store.Dir) == filepath.Clean(server.config.Store.Dir):
+		return nil, errors.New("the store directory is used by the main store")
+	}
+	prefix := config.SubjectPrefix
+	if prefix == "" {
+		prefix = config.Name
+	}
+	if _, err := subjectFormat("subject_prefix", prefix, 0); err != nil {
+		return nil, err
+	}
+
+	opJWT, err := server.readJWT(config.OperatorJWTPath, "operator")
+	if err != nil {
+		return nil, err
+	}
+	jwtStore, err := server.openStore(config.Store, nil)
+	if err != nil {
+		return nil, err
+	}
+	t := &tenant{name: config.Name, prefix: prefix, jwt: NewJwtHandler(server.logger)}
+	n := tenantNotifier{server: server, prefix: prefix, jwt: &t.jwt}
+	h := &t.jwt
+	packLimit := 0
+	if _, ok := jwtStore.(store.PackableJWTStore); ok {
+		packLimit = server.config.MaxReplicationPack
+	}
+	if err := h.Initialize(opJWT, nil, jwtStore, packLimit, n.account, n.activation, nil); err != nil {
+		jwtStore.Close()
+		return nil, err
+	}
+	h.privacy = server.jwt.privacy
+	h.isAdmin = server.hasAdminToken
+	h.authorizeWrite = func(r *http.Request, pubKey string) error {
+		return server.authorizeWriteTo(h, r, pubKey)
+	}
+	h.tracer = server.tracer
+	h.metrics = server.metrics
+	h.sendDeleteNotification = n.deleted
+	h.sendActivationDelete = n.activationDeleted
+	h.uploads = newUploadStats()
+	h.writes = newWriteLimiter(server.config.HTTP.WriteRate)
+	h.maxBody = server.jwt.maxBody
+	h.expiration = server.jwt.expiration
+	h.verifyActivations = server.jwt.verifyActivations
+	h.rejectStale = server.config.RejectStale
+	h.hashETags = server.jwt.hashETags
+	h.softLimits = server.jwt.softLimits
+	h.linter = server.jwt.linter
+	h.policy = server.jwt.policy
+	h.activationVersions = server.jwt.activationVersions
+
+	t.router = httprouter.New()
+	h.InitRouter(t.router)
+	return t, nil
+}
+
+// stopTenants closes the stores of the tenants
+func (server *AccountServer) stopTenants() {
+	for _, t := range server.tenants {
+		t.jwt.jwtStore.Close()
+	}
+	server.tenants = nil
+}
+
+// initTenantRouters routes /jwt/v1/<tenant>/ to the account API of each tenant
+func (server *AccountServer) initTenantRouters(r *httprouter.Router) {
+	for _, t := range server.tenants {
+		path := "/jwt/v1/" + t.name + "/*path"
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+			r.Handle(method, path, t.serve)
+		}
+	}
+}
+
+// serve passes the request on to the router of the tenant, with the tenant taken out of the path
+func (t *tenant) serve(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	u := *r.URL
+	u.Path = "/jwt/v1" + params.ByName("path")
+	u.RawPath = ""
+	tr := r.Clone(r.Context())
+	tr.URL = &u
+	t.router.ServeHTTP(w, tr)
+}
+
+// tenantNotifier publishes the notifications of a tenant, on the subjects of the main store behind the
+// prefix of the tenant
+type tenantNotifier struct {
+	server *AccountServer
+	prefix string
+	jwt    *JwtHandler // of the tenant, retried notifications load the JWTs from its store
+}
+
+func (n tenantNotifier) publish(subject string, data []byte, current func() ([]byte, error), headers ...string) error {
+	s := n.server
+	if s.nats == nil && s.notifyQueue == nil {
+		s.logger.Noticef("skipping notification on %s.%s, no NATS configured", n.prefix, subject)
+		return nil
+	}
+	return s.notifyCurrent(s.nats, n.prefix+"."+subject, data, current, headers...)
+}
+
+func (n tenantNotifier) account(pubKey string, theJWT []byte) error {
+	if pubKey == "" {
+		return nil
+	}
+	var pending error
+	for _, subject := range n.server.accountUpdateSubjects(pubKey) {
+		if err := n.publish(subject, theJWT, storedAccount(n.jwt.jwtStore, pubKey)); notificationPending(err) {
+			pending = err
+		} else if err != nil {
+			return err
+		}
+	}
+	return pending
+}
+
+func (n tenantNotifier) activation(hash string, account string, target string, theJWT []byte) error {
+	return n.publish(fmt.Sprintf(n.server.subjects.activationUpdate, account, hash), theJWT, storedActivation(n.jwt, hash),
+		targetAccountHeader, target)
+}
+
+func (n tenantNotifier) deleted(pubKey string, proof []byte) error {
+	if !n.server.config.Notifications.Legacy {
+		return nil
+	}
+	return n.publish(fmt.Sprintf(accountDeleteFormat, pubKey), proof, nil)
+}
+
+func (n tenantNotifier) activationDeleted(hash string, account string, target string, proof []byte) error {
+	return n.publish(fmt.Sprintf(n.server.subjects.activationDelete, account, hash), proof, nil, targetAccountHeader, target)
+}
+
+// tenantNames returns the names of the tenants, in the order they are configured
+func (server *AccountServer) tenantNames() []string {
+	var names []string
+	for _, t := range server.tenants {
+		names = append(names, t.name)
+	}
+	return names
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenants(t *testing.T) {
+	_, tenantPub, tenantKey := CreateOperatorKey(t)
+	operator := jwt.NewOperatorClaims(tenantPub)
+	operator.Name = "acme"
+	operatorJWT, err := operator.Encode(tenantKey)
+	require.NoError(t, err)
+	operatorFile := filepath.Join(t.TempDir(), "acme.jwt")
+	require.NoError(t, os.WriteFile(operatorFile, []byte(operatorJWT), 0600))
+
+	config := conf.DefaultServerConfig()
+	config.Tenants = []conf.TenantConfig{{
+		Name:            "acme",
+		OperatorJWTPath: operatorFile,
+		Store:           conf.StoreConfig{Dir: t.TempDir()},
+	}}
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	get := func(path string) (int, string) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath(path))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	post := func(path string, theJWT string) int {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath(path), "application/json", bytes.NewBufferString(theJWT))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	notifications, err := testEnv.NC.SubscribeSync("acme." + fmt.Sprintf(accountNotificationFormat, "*"))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	// the tenant only trusts its own operator
+	pubKey, theJWT := newAccountJWT(t, tenantKey)
+	require.Equal(t, http.StatusOK, post("/jwt/v1/acme/accounts/"+pubKey, theJWT))
+	msg, err := notifications.NextMsg(2 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "acme."+fmt.Sprintf(accountNotificationFormat, pubKey), msg.Subject)
+	require.Equal(t, theJWT, string(msg.Data))
+	status, body := get("/jwt/v1/acme/accounts/" + pubKey)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, theJWT, body)
+	require.NotEqual(t, http.StatusOK, post("/jwt/v1/accounts/"+pubKey, theJWT))
+
+	mainKey, mainJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.NotEqual(t, http.StatusOK, post("/jwt/v1/acme/accounts/"+mainKey, mainJWT))
+	require.Equal(t, http.StatusOK, post("/jwt/v1/accounts/"+mainKey, mainJWT))
+	status, _ = get("/jwt/v1/acme/accounts/" + mainKey)
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, body = get("/jwt/v1/acme/operator")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, operatorJWT, body)
+	status, _ = get("/jwt/v1/other/accounts/" + pubKey)
+	require.Equal(t, http.StatusNotFound, status)
+
+	testEnv.Server.Lock()
+	require.Equal(t, []string{"acme"}, testEnv.Server.summarizeConfig().Tenants)
+	testEnv.Server.Unlock()
+
+	testEnv.Server.Stop()
+	for _, bad := range []conf.TenantConfig{
+		{Name: "accounts", OperatorJWTPath: operatorFile, Store: conf.StoreConfig{Dir: t.TempDir()}},
+		{Name: "a.b", OperatorJWTPath: operatorFile, Store: conf.StoreConfig{Dir: t.TempDir()}},
+		{Name: "acme", Store: conf.StoreConfig{Dir: t.TempDir()}},
+		{Name: "acme", OperatorJWTPath: operatorFile, Store: conf.StoreConfig{Dir: config.Store.Dir}},
+		{Name: "acme", OperatorJWTPath: operatorFile, Store: conf.StoreConfig{Type: conf.StoreNone}},
+		{Name: "acme", OperatorJWTPath: operatorFile, Store: conf.StoreConfig{Dir: t.TempDir()}, SubjectPrefix: "acme.>"},
+	} {
+		config.Tenants = []conf.TenantConfig{bad}
+		require.Error(t, testEnv.Server.Start(), bad.Name)
+		testEnv.Server.Stop()
+	}
+}
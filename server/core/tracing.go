@@ -0,0 +1,453 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// traceparentHeader carries the W3C trace context on HTTP requests and NATS messages
+const traceparentHeader = "traceparent"
+
+// OTLP span kinds
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+	spanConsumer = 5
+)
+
+// OTLP status codes
+const (
+	statusOK    = 1
+	statusError = 2
+)
+
+// traceExportTimeout bounds a single export to the collector
+const traceExportTimeout = 10 * time.Second
+
+// span is one timed operation of a trace. All methods are safe to call on a nil span, which is what
+// the tracer hands out when tracing is off or the trace isn't sampled.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span started on ctx, nil if there is none
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// set adds an attribute, values are strings, ints or bools
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+// finish ends the span, with an error status if err is not nil, and queues it for export
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.tracer.queue(s)
+}
+
+// tracer batches finished spans and exports them to an OTLP/HTTP collector on an interval.
+// All methods are safe to call on a nil value.
+type tracer struct {
+	sync.Mutex
+	endpoint string
+	headers  http.Header
+	service  string
+	instance string
+	sample   int
+	maxQueue int
+	client   *http.Client
+	logger   natsserver.Logger
+	metrics  *metrics
+	pending  []*span
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// newTracer returns nil if no endpoint is configured
+func newTracer(config conf.TracingConfig, instance string, logger natsserver.Logger, m *metrics) (*tracer, error) {
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(config.Endpoint, "http://") && !strings.HasPrefix(config.Endpoint, "https://") {
+		return nil, fmt.Errorf("tracing endpoint %q is not an http or https URL", config.Endpoint)
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("tracing export interval must be positive")
+	}
+	if config.Sample < 0 || config.Sample > 100 {
+		return nil, fmt.Errorf("tracing sample has to be a percentage")
+	}
+	headers := http.Header{}
+	for _, h := range config.Headers {
+		split := strings.SplitN(h, ":", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			return nil, fmt.Errorf("bad tracing header %q, expected name: value", h)
+		}
+		headers.Add(strings.TrimSpace(split[0]), strings.TrimSpace(split[1]))
+	}
+	service := config.ServiceName
+	if service == "" {
+		service = defaultServerName
+	}
+	m.describe("tracing_spans_exported_total", "counter", "Number of spans sent to the tracing collector")
+	m.describe("tracing_spans_dropped_total", "counter", "Number of spans dropped because the export queue was full or the export failed")
+	t := &tracer{
+		endpoint: config.Endpoint,
+		headers:  headers,
+		service:  service,
+		instance: instance,
+		sample:   config.Sample,
+		maxQueue: config.MaxQueue,
+		client:   &http.Client{Timeout: traceExportTimeout},
+		logger:   logger,
+		metrics:  m,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run(time.Duration(config.Interval) * time.Millisecond)
+	return t, nil
+}
+
+// start begins a span, as a child of the span in ctx or, if there is none, of remote, a traceparent
+// received with the request. A new trace is sampled at the configured rate. The span is nil if it
+// isn't recorded, in which case ctx is returned as is.
+func (t *tracer) start(ctx context.Context, name string, kind int, remote string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else if traceID, parentID, sampled, ok := parseTraceparent(remote); ok {
+		if !sampled {
+			return ctx, nil
+		}
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		if !t.sampled() {
+			return ctx, nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// child begins a span under the span in ctx, it isn't recorded if ctx isn't traced
+func (t *tracer) child(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if spanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return t.start(ctx, name, kind, "")
+}
+
+func (t *tracer) sampled() bool {
+	if t.sample >= 100 {
+		return true
+	}
+	var b [1]byte
+	rand.Read(b[:])
+	return int(b[0])%100 < t.sample
+}
+
+func (t *tracer) queue(s *span) {
+	t.Lock()
+	defer t.Unlock()
+	if t.maxQueue > 0 && len(t.pending) >= t.maxQueue {
+		t.metrics.inc("tracing_spans_dropped_total")
+		return
+	}
+	t.pending = append(t.pending, s)
+}
+
+func (t *tracer) run(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.quit:
+		case <-ticker.C:
+		}
+		if err := t.export(); err != nil {
+			t.logger.Debugf("tracing export error: %v", err)
+		}
+		select {
+		case <-t.quit:
+			return
+		default:
+		}
+	}
+}
+
+// export sends the pending spans, spans that can't be sent are dropped
+func (t *tracer) export() error {
+	t.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	err := t.post(spans)
+	if err != nil {
+		t.metrics.add("tracing_spans_dropped_total", float64(len(spans)))
+	} else {
+		t.metrics.add("tracing_spans_exported_total", float64(len(spans)))
+	}
+	return err
+}
+
+func (t *tracer) post(spans []*span) error {
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set(ContentType, "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("tracing collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// stop exports the remaining spans and ends the export loop
+func (t *tracer) stop() {
+	if t == nil {
+		return
+	}
+	close(t.quit)
+	<-t.done
+}
+
+// the OTLP/HTTP JSON encoding of an export request, ids are hex and 64 bit integers strings
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (t *tracer) request(spans []*span) otlpExport {
+	var zero [8]byte
+	scope := otlpScopeSpans{Scope: otlpScope{Name: defaultServerName, Version: Build().Version}}
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:  otlpStatus{Code: statusOK},
+		}
+		if s.parentID != zero {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: statusError, Message: s.err.Error()}
+		}
+		scope.Spans = append(scope.Spans, o)
+	}
+	resource := otlpResource{Attributes: []otlpAttribute{
+		otlpAttr("service.name", t.service),
+		otlpAttr("service.instance.id", t.instance),
+		otlpAttr("service.version", Build().Version),
+	}}
+	return otlpExport{ResourceSpans: []otlpResourceSpans{{Resource: resource, ScopeSpans: []otlpScopeSpans{scope}}}}
+}
+
+// parseTraceparent reads a version 00 W3C trace context
+func parseTraceparent(tp string) ([16]byte, [8]byte, bool, bool) {
+	var traceID [16]byte
+	var parentID [8]byte
+	split := strings.Split(strings.TrimSpace(tp), "-")
+	if len(split) < 4 || split[0] != "00" || len(split[1]) != 32 || len(split[2]) != 16 || len(split[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(split[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(split[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(split[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// traceHTTP records a server span for every request, continuing the trace of a traceparent header
+func (t *tracer) traceHTTP(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, s := t.start(r.Context(), "HTTP "+r.Method, spanServer, r.Header.Get(traceparentHeader))
+		if s == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.set("http.method", r.Method)
+		s.set("http.target", r.URL.Path)
+		s.set("net.peer.addr", r.RemoteAddr)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		// set by the request_id middleware, which runs inside
+		if id := sw.Header().Get(requestIDHeader); id != "" {
+			s.set("http.request_id", id)
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		s.set("http.status_code", sw.status)
+		var err error
+		if sw.status >= http.StatusInternalServerError {
+			err = fmt.Errorf("status %d", sw.status)
+		}
+		s.finish(err)
+	})
+}
+
+// traceNATS records a consumer span for every message handled by fn, continuing the trace of a
+// traceparent header on the message
+func (t *tracer) traceNATS(name string, fn nats.MsgHandler) nats.MsgHandler {
+	if t == nil {
+		return fn
+	}
+	return func(msg *nats.Msg) {
+		_, s := t.start(context.Background(), name, spanConsumer, msg.Header.Get(traceparentHeader))
+		s.set("messaging.system", "nats")
+		s.set("messaging.destination", msg.Subject)
+		fn(msg)
+		s.finish(nil)
+	}
+}
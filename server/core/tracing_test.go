@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// otlpCollector keeps the spans exported to it by name
+type otlpCollector struct {
+	sync.Mutex
+	spans   map[string]otlpSpan
+	service string
+	auth    string
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	export := otlpExport{}
+	if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.auth = r.Header.Get("Authorization")
+	for _, rs := range export.ResourceSpans {
+		for _, a := range rs.Resource.Attributes {
+			if a.Key == "service.name" {
+				c.service = *a.Value.StringValue
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans[s.Name] = s
+			}
+		}
+	}
+}
+
+func (c *otlpCollector) span(name string) (otlpSpan, bool) {
+	c.Lock()
+	defer c.Unlock()
+	s, ok := c.spans[name]
+	return s, ok
+}
+
+func TestTracing(t *testing.T) {
+	collector := &otlpCollector{spans: map[string]otlpSpan{}}
+	otlp := httptest.NewServer(collector)
+	defer otlp.Close()
+
+	config := conf.DefaultServerConfig()
+	config.Tracing.Endpoint = otlp.URL + "/v1/traces"
+	config.Tracing.Headers = []string{"Authorization: Bearer collector"}
+	config.Tracing.Interval = 50
+	config.HTTP.Middlewares = []string{MiddlewareRequestID}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	post := func(traceparent string) {
+		pubKey, theJWT := newAccountJWT(t, testEnv.OperatorKey)
+		req, err := http.NewRequest(http.MethodPost, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), strings.NewReader(theJWT))
+		require.NoError(t, err)
+		req.Header.Set(traceparentHeader, traceparent)
+		resp, err := testEnv.HTTP.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// the trace of the client is not sampled
+	post("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	time.Sleep(200 * time.Millisecond)
+	_, found := collector.span("HTTP POST")
+	require.False(t, found)
+
+	post("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Eventually(t, func() bool {
+		_, ok := collector.span("NATS publish account update")
+		return ok
+	}, 5*time.Second, 50*time.Millisecond)
+
+	request, _ := collector.span("HTTP POST")
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", request.TraceID)
+	require.Equal(t, "00f067aa0ba902b7", request.ParentSpanID)
+	require.Equal(t, spanServer, request.Kind)
+	attrs := map[string]string{}
+	for _, a := range request.Attributes {
+		if a.Value.StringValue != nil {
+			attrs[a.Key] = *a.Value.StringValue
+		} else if a.Value.IntValue != nil {
+			attrs[a.Key] = *a.Value.IntValue
+		}
+	}
+	require.Equal(t, "200", attrs["http.status_code"])
+	require.Len(t, attrs["http.request_id"], 32)
+
+	for _, name := range []string{"store save account", "NATS publish account update"} {
+		s, ok := collector.span(name)
+		require.True(t, ok, name)
+		require.Equal(t, request.TraceID, s.TraceID, name)
+		require.Equal(t, request.SpanID, s.ParentSpanID, name)
+		require.Equal(t, statusOK, s.Status.Code, name)
+	}
+	collector.Lock()
+	require.Equal(t, defaultServerName, collector.service)
+	require.Equal(t, "Bearer collector", collector.auth)
+	collector.Unlock()
+}
+
+func TestTracingConfig(t *testing.T) {
+	m := newMetrics()
+	tr, err := newTracer(conf.TracingConfig{}, "id", NewNilLogger(), m)
+	require.NoError(t, err)
+	require.Nil(t, tr)
+	_, s := tr.start(context.Background(), "off", spanInternal, "")
+	s.set("ignored", 1)
+	s.finish(nil)
+
+	for _, bad := range []conf.TracingConfig{
+		{Endpoint: "localhost:4318", Interval: 1000},
+		{Endpoint: "http://localhost:4318/v1/traces"},
+		{Endpoint: "http://localhost:4318/v1/traces", Interval: 1000, Sample: 101},
+		{Endpoint: "http://localhost:4318/v1/traces", Interval: 1000, Headers: []string{"no value"}},
+	} {
+		_, err := newTracer(bad, "id", NewNilLogger(), m)
+		require.Error(t, err, bad)
+	}
+
+	_, _, _, ok := parseTraceparent("00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	require.False(t, ok)
+	_, _, _, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.False(t, ok)
+	_, _, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	require.True(t, sampled)
+}
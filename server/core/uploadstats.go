@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	uploadWindow      = 64    // recent uploads kept per account
+	maxUploadAccounts = 10000 // accounts tracked, the least recently updated is dropped beyond this
+	defaultUploadTop  = 10
+)
+
+// uploadSample is one account JWT post, sign and notify are zero if the phase didn't run
+type uploadSample struct {
+	size   int
+	total  time.Duration
+	sign   time.Duration
+	notify time.Duration
+}
+
+// accountUploads is a ring of the most recent uploads for one account
+type accountUploads struct {
+	samples [uploadWindow]uploadSample
+	next    int
+	count   int   // samples in the ring
+	uploads int64 // all uploads since the server started
+	last    time.Time
+}
+
+// uploadStats keeps rolling per account statistics of account JWT posts.
+// All methods are safe to call on a nil value.
+type uploadStats struct {
+	sync.Mutex
+	accounts map[string]*accountUploads
+}
+
+func newUploadStats() *uploadStats {
+	return &uploadStats{accounts: map[string]*accountUploads{}}
+}
+
+func (u *uploadStats) record(account string, s uploadSample) {
+	if u == nil || account == "" {
+		return
+	}
+	u.Lock()
+	defer u.Unlock()
+	acc, ok := u.accounts[account]
+	if !ok {
+		if len(u.accounts) >= maxUploadAccounts {
+			u.dropOldest()
+		}
+		acc = &accountUploads{}
+		u.accounts[account] = acc
+	}
+	acc.samples[acc.next] = s
+	acc.next = (acc.next + 1) % uploadWindow
+	if acc.count < uploadWindow {
+		acc.count++
+	}
+	acc.uploads++
+	acc.last = time.Now()
+}
+
+// dropOldest removes the account with the oldest upload, assumes the lock is held
+func (u *uploadStats) dropOldest() {
+	oldest := ""
+	var when time.Time
+	for account, acc := range u.accounts {
+		if oldest == "" || acc.last.Before(when) {
+			oldest, when = account, acc.last
+		}
+	}
+	delete(u.accounts, oldest)
+}
+
+// uploadDistribution summarizes the recent values of one measurement
+type uploadDistribution struct {
+	P50 float64 `json:"p50"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// uploadSummary describes the recent uploads of one account, durations are in milliseconds
+type uploadSummary struct {
+	Account   string             `json:"account"`
+	Uploads   int64              `json:"uploads"`
+	Window    int                `json:"window"` // number of recent uploads the distributions cover
+	Last      time.Time          `json:"last"`
+	Size      uploadDistribution `json:"size_bytes"`
+	Latency   uploadDistribution `json:"latency_ms"`
+	SignP99   float64            `json:"sign_p99_ms"`
+	NotifyP99 float64            `json:"notify_p99_ms"`
+}
+
+func distribution(values []float64) uploadDistribution {
+	sort.Float64s(values)
+	at := func(q float64) float64 {
+		return values[int(q*float64(len(values)-1)+0.5)]
+	}
+	return uploadDistribution{P50: at(0.5), P99: at(0.99), Max: values[len(values)-1]}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (acc *accountUploads) summary(account string) uploadSummary {
+	sizes := make([]float64, acc.count)
+	latencies := make([]float64, acc.count)
+	signs := make([]float64, acc.count)
+	notifies := make([]float64, acc.count)
+	for i := 0; i < acc.count; i++ {
+		s := acc.samples[i]
+		sizes[i] = float64(s.size)
+		latencies[i] = millis(s.total)
+		signs[i] = millis(s.sign)
+		notifies[i] = millis(s.notify)
+	}
+	return uploadSummary{
+		Account:   account,
+		Uploads:   acc.uploads,
+		Window:    acc.count,
+		Last:      acc.last,
+		Size:      distribution(sizes),
+		Latency:   distribution(latencies),
+		SignP99:   distribution(signs).P99,
+		NotifyP99: distribution(notifies).P99,
+	}
+}
+
+// top returns the n accounts with the highest p99 latency, or p99 size if by is size
+func (u *uploadStats) top(n int, by string) []uploadSummary {
+	if u == nil {
+		return nil
+	}
+	u.Lock()
+	summaries := make([]uploadSummary, 0, len(u.accounts))
+	for account, acc := range u.accounts {
+		summaries = append(summaries, acc.summary(account))
+	}
+	u.Unlock()
+	key := func(s uploadSummary) float64 { return s.Latency.P99 }
+	if by == "size" {
+		key = func(s uploadSummary) float64 { return s.Size.P99 }
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if key(summaries[i]) == key(summaries[j]) {
+			return summaries[i].Account < summaries[j].Account
+		}
+		return key(summaries[i]) > key(summaries[j])
+	})
+	if len(summaries) > n {
+		summaries = summaries[:n]
+	}
+	return summaries
+}
+
+// getUploads handles GET /admin/v1/uploads, top limits the accounts returned and by is latency or size
+func (server *AccountServer) getUploads(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = "latency"
+	} else if by != "latency" && by != "size" {
+		server.jwt.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("bad sort %q, use latency or size", by), "", nil, w)
+		return
+	}
+	n := defaultUploadTop
+	if top := r.URL.Query().Get("top"); top != "" {
+		var err error
+		if n, err = strconv.Atoi(top); err != nil || n <= 0 {
+			server.jwt.sendErrorResponse(http.StatusBadRequest, "top must be a positive number", "", err, w)
+			return
+		}
+	}
+	accounts := server.jwt.uploads.top(n, by)
+	if accounts == nil {
+		accounts = []uploadSummary{}
+	}
+	server.writeJSON(w, http.StatusOK, map[string]interface{}{"by": by, "accounts": accounts})
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadStats(t *testing.T) {
+	var nilStats *uploadStats
+	nilStats.record("A", uploadSample{})
+	require.Nil(t, nilStats.top(1, "size"))
+
+	u := newUploadStats()
+	for i := 1; i <= 100; i++ {
+		u.record("SLOW", uploadSample{size: 10, total: time.Duration(i) * time.Millisecond, notify: time.Millisecond})
+	}
+	u.record("BIG", uploadSample{size: 1 << 20, total: time.Millisecond})
+
+	top := u.top(1, "latency")
+	require.Len(t, top, 1)
+	require.Equal(t, "SLOW", top[0].Account)
+	require.Equal(t, int64(100), top[0].Uploads)
+	require.Equal(t, uploadWindow, top[0].Window)
+	require.Equal(t, float64(100), top[0].Latency.Max)
+	require.Equal(t, float64(69), top[0].Latency.P50, "only the last 64 uploads, 37ms to 100ms, are kept")
+	require.Equal(t, float64(1), top[0].NotifyP99)
+	require.Zero(t, top[0].SignP99)
+
+	top = u.top(10, "size")
+	require.Len(t, top, 2)
+	require.Equal(t, "BIG", top[0].Account)
+	require.Equal(t, float64(1<<20), top[0].Size.P99)
+}
+
+func TestUploadsEndpoint(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	pubKeys := initAndPostNAccounts(t, testEnv, 3)
+
+	status, body := adminRequest(t, testEnv, http.MethodGet, "/admin/v1/uploads?by=size&top=2", testAdminToken, "")
+	require.Equal(t, http.StatusOK, status)
+	result := struct {
+		By       string          `json:"by"`
+		Accounts []uploadSummary `json:"accounts"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &result))
+	require.Equal(t, "size", result.By)
+	require.Len(t, result.Accounts, 2)
+	for _, s := range result.Accounts {
+		require.Contains(t, pubKeys, s.Account)
+		require.Equal(t, int64(1), s.Uploads)
+		require.Equal(t, float64(len(pubKeys[s.Account])), s.Size.Max)
+		require.True(t, s.Latency.Max > 0)
+	}
+
+	status, _ = adminRequest(t, testEnv, http.MethodGet, "/admin/v1/uploads?by=name", testAdminToken, "")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = adminRequest(t, testEnv, http.MethodGet, "/admin/v1/uploads?top=-1", testAdminToken, "")
+	require.Equal(t, http.StatusBadRequest, status)
+}
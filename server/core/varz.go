@@ -0,0 +1,220 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats.go"
+)
+
+// storeStats describes the store and its limits
+type storeStats struct {
+	Type            string `json:"type"`
+	Dir             string `json:"dir,omitempty"`
+	JWTs            int    `json:"jwts"`     // for a store of type none, the cached JWTs
+	MaxJWTs         int    `json:"max_jwts"` // 0 is unlimited
+	EvictionPolicy  string `json:"eviction_policy"`
+	CleanupInterval int    `json:"cleanup_interval"` // milliseconds, 0 is one minute
+}
+
+// natsStatus describes the connection used for notifications and syncing
+type natsStatus struct {
+	Configured   bool   `json:"configured"`
+	Status       string `json:"status"` // the status of the connection, DISCONNECTED while there is none
+	ConnectedURL string `json:"connected_url,omitempty"`
+	ServerID     string `json:"server_id,omitempty"`
+	Reconnects   uint64 `json:"reconnects"`
+}
+
+// configSummary is the part of the configuration that shapes what the server does, the complete
+// configuration is on the admin API
+type configSummary struct {
+	Host            string   `json:"host"`
+	Port            int      `json:"port"`
+	Socket          string   `json:"socket,omitempty"` // the unix socket the HTTP server listens on
+	TLS             bool     `json:"tls"`
+	ClientCerts     bool     `json:"client_certs"` // client certificates are required
+	Operators       int      `json:"operators"`
+	Primary         string   `json:"primary,omitempty"`   // credentials in the URL are redacted
+	Primaries       []string `json:"primaries,omitempty"` // tried in order after primary, redacted like primary
+	Lookup          []string `json:"lookup"`
+	Tenants         []string `json:"tenants,omitempty"` // served under /jwt/v1/<tenant>/
+	Notifications   []string `json:"notifications"`
+	SigningService  bool     `json:"signing_service"`
+	WriteAuth       bool     `json:"write_auth"`
+	Admin           bool     `json:"admin"`
+	Provisioning    bool     `json:"provisioning"`
+	ApprovalsNeeded bool     `json:"approvals"`
+	ReadOnly        bool     `json:"read_only"`
+}
+
+// varz is the general server status
+type varz struct {
+	Server map[string]interface{} `json:"server"`
+	Build  BuildInfo              `json:"build"`
+	Start  time.Time              `json:"start"`
+	Now    time.Time              `json:"now"`
+	Uptime string                 `json:"uptime"`
+	Store  storeStats             `json:"store"`
+	NATS   natsStatus             `json:"nats"`
+	Config configSummary          `json:"config"`
+	Sync   *syncStatus            `json:"sync,omitempty"` // set once the server syncs with other account servers
+
+	Overrides *overrideStats `json:"overrides,omitempty"`
+}
+
+func (server *AccountServer) evictionPolicy() string {
+	if server.config.Store.EvictionPolicy == "" {
+		return conf.EvictLRU
+	}
+	return server.config.Store.EvictionPolicy
+}
+
+// countJWTs counts the JWT files in the store directory, including sharded sub-directories
+func countJWTs(dir string) int {
+	count := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, ".jwt") {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// jwtCountTTL is how long /varz reports the same number of stored JWTs, counting walks the whole store
+const jwtCountTTL = 10 * time.Second
+
+// jwtCount caches the number of stored JWTs
+type jwtCount struct {
+	sync.Mutex
+	count   int
+	counted time.Time
+}
+
+// get returns the cached number, counting again once it is older than jwtCountTTL
+func (c *jwtCount) get(count func() int) int {
+	c.Lock()
+	defer c.Unlock()
+	if c.counted.IsZero() || time.Since(c.counted) >= jwtCountTTL {
+		c.count = count()
+		c.counted = time.Now()
+	}
+	return c.count
+}
+
+// summarizeConfig assumes the lock is held
+func (server *AccountServer) summarizeConfig() configSummary {
+	c := server.config
+	s := configSummary{
+		Host:            c.HTTP.Host,
+		Port:            server.port,
+		Socket:          server.socket,
+		TLS:             server.protocol == "https",
+		ClientCerts:     c.HTTP.TLS.RequireClientCert,
+		Operators:       len(c.OperatorJWTPaths),
+		Primary:         conf.RedactURL(c.Primary),
+		Primaries:       conf.RedactURLs(c.Primaries),
+		Lookup:          append([]string{}, server.lookup...),
+		Tenants:         server.tenantNames(),
+		Notifications:   []string{},
+		SigningService:  c.SignRequestSubject != "" || c.SigningKey != "",
+		WriteAuth:       c.HTTP.Auth.Enabled(),
+		Admin:           c.Admin.Enabled,
+		Provisioning:    c.Provisioning.Enabled,
+		ApprovalsNeeded: c.Approval.Required,
+	}
+	if c.OperatorJWTPath != "" {
+		s.Operators++
+	}
+	if c.Notifications.Legacy {
+		s.Notifications = append(s.Notifications, "legacy")
+	}
+	if c.Notifications.Native {
+		s.Notifications = append(s.Notifications, "native")
+	}
+	if server.JWTStore != nil {
+		s.ReadOnly = server.JWTStore.IsReadOnly()
+	}
+	return s
+}
+
+// describeNATS assumes the lock is held
+func (server *AccountServer) describeNATS() natsStatus {
+	s := natsStatus{Configured: len(server.config.NATS.Servers) > 0, Status: nats.DISCONNECTED.String()}
+	if nc := server.nats; nc != nil {
+		s.Status = nc.Status().String()
+		s.ConnectedURL = nc.ConnectedUrlRedacted()
+		s.ServerID = nc.ConnectedServerId()
+		s.Reconnects = nc.Stats().Reconnects
+	}
+	return s
+}
+
+// sizedStore is implemented by stores that don't keep their JWTs in a directory
+type sizedStore interface {
+	size() int
+}
+
+// getVarz handles GET /varz, served on the admin API
+func (server *AccountServer) getVarz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	server.Lock()
+	v := varz{
+		Server: server.serverInfo(),
+		Build:  Build(),
+		Start:  server.startTime,
+		Now:    time.Now().UTC(),
+		Uptime: time.Since(server.startTime).Round(time.Second).String(),
+		Store: storeStats{
+			Type:            conf.StoreDir,
+			Dir:             server.config.Store.Dir,
+			MaxJWTs:         server.config.Store.MaxJWTs,
+			EvictionPolicy:  server.evictionPolicy(),
+			CleanupInterval: server.config.Store.CleanupInterval,
+		},
+		NATS:      server.describeNATS(),
+		Config:    server.summarizeConfig(),
+		Overrides: server.overrides,
+	}
+	if server.syncStats != nil {
+		status := server.syncStats.snapshot()
+		status.Interval = int(server.currentSyncInterval() / time.Millisecond)
+		status.Jitter = server.config.SyncJitter
+		v.Sync = &status
+	}
+	sized, ok := server.JWTStore.(sizedStore)
+	if ok {
+		v.Store.Type = server.config.Store.Type
+		v.Store.Dir = ""
+	}
+	server.Unlock()
+	v.Store.JWTs = server.jwtCount.get(func() int {
+		if ok {
+			return sized.size()
+		}
+		return countJWTs(v.Store.Dir)
+	})
+	server.writeJSON(w, http.StatusOK, v)
+}
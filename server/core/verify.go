@@ -0,0 +1,254 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// quarantinedSuffix is added to the files of a directory store that failed verification, so they are
+// no longer served but can be inspected
+const quarantinedSuffix = ".quarantined"
+
+// problems found by a store verification, expired JWTs are reported but not quarantined
+const (
+	verifyCorrupt    = "corrupt"    // the JWT can't be decoded or its signature doesn't match
+	verifyMismatched = "mismatched" // the JWT is stored under another account's key
+	verifyForeign    = "foreign"    // the account JWT is not issued by a trusted operator
+	verifyExpired    = "expired"
+)
+
+// VerifyEntry is a JWT in the store that failed verification
+type VerifyEntry struct {
+	Key         string `json:"key"`
+	Problem     string `json:"problem"`
+	Detail      string `json:"detail,omitempty"`
+	File        string `json:"file,omitempty"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+}
+
+// VerifyReport is the outcome of a store verification
+type VerifyReport struct {
+	Time        time.Time      `json:"time"`
+	Checked     int            `json:"checked"`
+	Counts      map[string]int `json:"counts"` // by problem
+	Quarantined int            `json:"quarantined"`
+	Entries     []VerifyEntry  `json:"entries"`
+}
+
+// Problems returns the number of JWTs that are corrupt, mismatched or foreign, expired JWTs don't count
+func (r *VerifyReport) Problems() int {
+	return r.Counts[verifyCorrupt] + r.Counts[verifyMismatched] + r.Counts[verifyForeign]
+}
+
+// VerifyStore decodes every JWT in the store and checks its key, signature, issuer and expiration.
+// With quarantine set, the files of a directory store that are corrupt, mismatched or foreign are
+// renamed with a .quarantined suffix. A server that isn't running opens the store and reads the
+// operators itself, so the store can be checked without serving it.
+func (server *AccountServer) VerifyStore(quarantine bool) (*VerifyReport, error) {
+	server.Lock()
+	running, jwtStore, trusted := server.running, server.JWTStore, server.jwt.trustedKeys
+	server.Unlock()
+	if !running {
+		var err error
+		if jwtStore, trusted, err = server.openStoreOffline(); err != nil {
+			return nil, err
+		}
+		defer jwtStore.Close()
+	}
+	return verifyStore(jwtStore, trusted, quarantine, time.Now())
+}
+
+// openStoreOffline creates the configured store and reads the keys of the configured operators, for
+// commands that work on the store without starting the server. The caller closes the store.
+func (server *AccountServer) openStoreOffline() (store.JWTStore, map[string]struct{}, error) {
+	h := NewJwtHandler(server.logger)
+	for _, path := range server.operatorPaths() {
+		opJWT, err := server.readJWT(path, "operator")
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := h.addOperator(opJWT); err != nil {
+			return nil, nil, fmt.Errorf("operator %s: %v", path, err)
+		}
+	}
+	jwtStore, err := server.createStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	return jwtStore, h.trustedKeys, nil
+}
+
+// verifyStore walks the files of a directory store, or the pack of other stores, and checks every JWT
+func verifyStore(jwtStore store.JWTStore, trusted map[string]struct{}, quarantine bool, now time.Time) (*VerifyReport, error) {
+	report := &VerifyReport{Time: now.UTC(), Counts: map[string]int{}, Entries: []VerifyEntry{}}
+	check := func(key string, theJWT string, file string) bool {
+		report.Checked++
+		problem, detail := verifyJWT(key, theJWT, trusted, now)
+		if problem == "" {
+			return false
+		}
+		report.Counts[problem]++
+		report.Entries = append(report.Entries, VerifyEntry{Key: key, Problem: problem, Detail: detail, File: file})
+		return problem != verifyExpired
+	}
+
+	ds := verifiableDirStore(jwtStore)
+	if ds == nil {
+		if quarantine {
+			return nil, errors.New("only directory stores can quarantine JWTs")
+		}
+		packer, ok := jwtStore.(store.PackableJWTStore)
+		if !ok {
+			return nil, errors.New("store does not support listing its JWTs")
+		}
+		pack, err := packer.Pack(-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(pack, "\n") {
+			if split := strings.SplitN(line, "|", 2); len(split) == 2 {
+				check(split[0], split[1], "")
+			}
+		}
+		return report, nil
+	}
+
+	var bad []string
+	err := filepath.Walk(ds.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".jwt") {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(filepath.Base(path), ".jwt")
+		if check(key, string(data), path) {
+			bad = append(bad, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !quarantine || len(bad) == 0 {
+		return report, nil
+	}
+	if ds.IsReadOnly() {
+		return nil, errors.New("store is read-only")
+	}
+	quarantined := map[string]bool{}
+	ds.Lock()
+	for _, path := range bad {
+		if err = os.Rename(path, path+quarantinedSuffix); err != nil {
+			break
+		}
+		quarantined[path] = true
+	}
+	ds.Unlock()
+	for i, e := range report.Entries {
+		if quarantined[e.File] {
+			report.Entries[i].Quarantined = true
+			report.Quarantined++
+		}
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, ds.Reload()
+}
+
+// verifiableDirStore returns the directory store whose files are checked, the primary in dual-write mode
+func verifiableDirStore(jwtStore store.JWTStore) *dirStore {
+	switch s := jwtStore.(type) {
+	case *dirStore:
+		return s
+	case *dualStore:
+		if ds, ok := s.primary.(*dirStore); ok {
+			return ds
+		}
+	}
+	return nil
+}
+
+// verifyJWT returns the problem of a stored JWT, empty if there is none. Keys that are not account keys
+// hold activations, which are checked for corruption and expiration only.
+func verifyJWT(key string, theJWT string, trusted map[string]struct{}, now time.Time) (string, string) {
+	var claims *jwt.ClaimsData
+	if nkeys.IsValidPublicAccountKey(key) {
+		claim, err := jwt.DecodeAccountClaims(strings.TrimSpace(theJWT))
+		if err != nil {
+			return verifyCorrupt, err.Error()
+		}
+		if claim.Subject != key {
+			return verifyMismatched, fmt.Sprintf("the JWT is for account %s", claim.Subject)
+		}
+		if _, ok := trusted[claim.Issuer]; len(trusted) > 0 && !ok {
+			return verifyForeign, fmt.Sprintf("issuer %s is not a trusted operator key", claim.Issuer)
+		}
+		claims = &claim.ClaimsData
+	} else {
+		claim, err := jwt.DecodeActivationClaims(strings.TrimSpace(theJWT))
+		if err != nil {
+			return verifyCorrupt, err.Error()
+		}
+		claims = &claim.ClaimsData
+	}
+	if claims.Expires > 0 && claims.Expires < now.Unix() {
+		return verifyExpired, fmt.Sprintf("expired at %s", time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	return "", ""
+}
+
+// getVerify handles GET /admin/v1/verify, reporting the problems found in the store
+func (server *AccountServer) getVerify(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.respondVerify(w, false)
+}
+
+// postVerify handles POST /admin/v1/verify, which also quarantines the bad JWTs of a directory store
+func (server *AccountServer) postVerify(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.respondVerify(w, true)
+}
+
+func (server *AccountServer) respondVerify(w http.ResponseWriter, quarantine bool) {
+	report, err := server.VerifyStore(quarantine)
+	if err != nil && report == nil {
+		server.jwt.sendErrorResponse(http.StatusInternalServerError, "error verifying the store", "", err, w)
+		return
+	}
+	if report.Problems() > 0 {
+		server.logger.Warnf("store verification found %d bad JWTs, %d quarantined", report.Problems(), report.Quarantined)
+	}
+	if err != nil {
+		// some files may have been renamed, the report says which
+		server.logger.Errorf("error quarantining JWTs - %v", err)
+		server.writeJSON(w, http.StatusInternalServerError, report)
+		return
+	}
+	server.writeJSON(w, http.StatusOK, report)
+}
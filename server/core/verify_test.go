@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyStore(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Admin.Enabled = true
+	config.Admin.Token = testAdminToken
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	dir := config.Store.Dir
+
+	good, goodJWT := newAccountJWT(t, testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, postJWT(t, testEnv, good, []byte(goodJWT)))
+
+	// files damaged or replaced behind the server's back
+	write := func(pubKey string, data string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, pubKey+".jwt"), []byte(data), 0644))
+	}
+	corrupt, corruptJWT := newAccountJWT(t, testEnv.OperatorKey)
+	write(corrupt, corruptJWT[:len(corruptJWT)-10]+"AAAAAAAAAA")
+	otherOperator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	foreign, foreignJWT := newAccountJWT(t, otherOperator)
+	write(foreign, foreignJWT)
+	mismatched, _ := newAccountJWT(t, testEnv.OperatorKey)
+	_, otherJWT := newAccountJWT(t, testEnv.OperatorKey)
+	write(mismatched, otherJWT)
+	expiredKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	expired, err := expiredKey.PublicKey()
+	require.NoError(t, err)
+	claim := jwt.NewAccountClaims(expired)
+	claim.Expires = time.Now().Add(-time.Hour).Unix()
+	expiredJWT, err := claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	write(expired, expiredJWT)
+
+	verify := func(method string) VerifyReport {
+		status, body := adminRequest(t, testEnv, method, "/admin/v1/verify", testAdminToken, "")
+		require.Equal(t, http.StatusOK, status, body)
+		report := VerifyReport{}
+		require.NoError(t, json.Unmarshal([]byte(body), &report))
+		return report
+	}
+	report := verify(http.MethodGet)
+	require.Equal(t, 5, report.Checked)
+	require.Equal(t, map[string]int{verifyCorrupt: 1, verifyForeign: 1, verifyMismatched: 1, verifyExpired: 1}, report.Counts)
+	require.Equal(t, 3, report.Problems())
+	problems := map[string]string{}
+	for _, e := range report.Entries {
+		problems[e.Key] = e.Problem
+		require.False(t, e.Quarantined)
+	}
+	require.Equal(t, map[string]string{corrupt: verifyCorrupt, foreign: verifyForeign, mismatched: verifyMismatched, expired: verifyExpired}, problems)
+
+	// quarantined files are kept next to the store, expired JWTs stay
+	report = verify(http.MethodPost)
+	require.Equal(t, 3, report.Quarantined)
+	for _, pubKey := range []string{corrupt, foreign, mismatched} {
+		_, err := os.Stat(filepath.Join(dir, pubKey+".jwt"+quarantinedSuffix))
+		require.NoError(t, err)
+		_, err = os.Stat(filepath.Join(dir, pubKey+".jwt"))
+		require.True(t, os.IsNotExist(err))
+	}
+	_, err = os.Stat(filepath.Join(dir, expired+".jwt"))
+	require.NoError(t, err)
+	report = verify(http.MethodGet)
+	require.Equal(t, 2, report.Checked)
+	require.Zero(t, report.Problems())
+
+	// the check runs without starting the server as well
+	write(corrupt, "garbage")
+	testEnv.Server.Stop()
+	server := NewAccountServer()
+	require.NoError(t, server.InitializeFromConfig(config))
+	offline, err := server.VerifyStore(false)
+	require.NoError(t, err)
+	require.Equal(t, 3, offline.Checked)
+	require.Equal(t, 1, offline.Problems())
+	require.Equal(t, 1, offline.Counts[verifyCorrupt])
+}
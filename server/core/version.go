@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// set at build time with
+// -ldflags "-X github.com/nats-io/nats-account-server/server/core.version=... -X ...core.gitCommit=... -X ...core.buildDate=..."
+var (
+	version   = "1.0.0"
+	gitCommit = ""
+	buildDate = ""
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go"`
+}
+
+// Build returns the version and build information of the running binary
+func Build() BuildInfo {
+	return BuildInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func (b BuildInfo) String() string {
+	s := fmt.Sprintf("nats-account-server version %s", b.Version)
+	if b.GitCommit != "" {
+		s += fmt.Sprintf(", commit %s", b.GitCommit)
+	}
+	if b.BuildDate != "" {
+		s += fmt.Sprintf(", built %s", b.BuildDate)
+	}
+	return s + fmt.Sprintf(", %s", b.GoVersion)
+}
+
+// getVersion handles GET /version
+func (server *AccountServer) getVersion(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	server.writeJSON(w, http.StatusOK, Build())
+}
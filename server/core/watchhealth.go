@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// watchDownGrace is how long a store watch can be down, i.e. while it is restarted, before the
+// server reports it isn't ready
+const watchDownGrace = 10 * time.Second
+
+// watchState is the health of a store watch, reported in /readyz
+type watchState struct {
+	Up        bool      `json:"up"`
+	Since     time.Time `json:"since"`                // when the watch last went up or down
+	LastEvent time.Time `json:"last_event,omitempty"` // the last change seen
+	Errors    int       `json:"errors"`
+	Restarts  int       `json:"restarts"`
+	Rescans   int       `json:"rescans"` // restarts that had to read the store again, the changes were no longer kept
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// watchHealth is updated by a store as its watch runs, without it a watch that keeps failing
+// goes unnoticed and the nats-servers stop hearing about JWTs saved by other account servers
+type watchHealth struct {
+	sync.Mutex
+	state   watchState
+	started bool
+}
+
+// watchReporter is implemented by stores whose watch health is tracked
+type watchReporter interface {
+	watchState() watchState
+}
+
+func (w *watchHealth) up() {
+	w.Lock()
+	defer w.Unlock()
+	if w.started {
+		w.state.Restarts++
+	}
+	w.started = true
+	w.state.Up, w.state.Since = true, time.Now().UTC()
+}
+
+func (w *watchHealth) failed(err error) {
+	w.Lock()
+	defer w.Unlock()
+	w.state.Errors++
+	w.state.LastError = err.Error()
+	if w.state.Up {
+		w.state.Up, w.state.Since = false, time.Now().UTC()
+	}
+}
+
+func (w *watchHealth) event() {
+	w.Lock()
+	defer w.Unlock()
+	w.state.LastEvent = time.Now().UTC()
+}
+
+func (w *watchHealth) rescanned() {
+	w.Lock()
+	defer w.Unlock()
+	w.state.Rescans++
+}
+
+func (w *watchHealth) get() watchState {
+	w.Lock()
+	defer w.Unlock()
+	return w.state
+}
+
+// storeWatch returns the health of the store watch, false if the store isn't watched
+func (server *AccountServer) storeWatch() (watchState, bool) {
+	if r, ok := server.JWTStore.(watchReporter); ok {
+		return r.watchState(), true
+	}
+	return watchState{}, false
+}
+
+// watchDown describes a store watch that is down for longer than the grace period, empty if it isn't
+func (server *AccountServer) watchDown() string {
+	state, ok := server.storeWatch()
+	if !ok || state.Up || state.Since.IsZero() || time.Since(state.Since) < watchDownGrace {
+		return ""
+	}
+	return fmt.Sprintf("the store watch is down since %s, %s", state.Since.Format(time.RFC3339), state.LastError)
+}
+
+// describeStoreWatch registers the store watch metrics, if the store is watched
+func (server *AccountServer) describeStoreWatch() {
+	if _, ok := server.storeWatch(); !ok {
+		return
+	}
+	stat := func(fn func(s watchState) float64) func() float64 {
+		return func() float64 {
+			s, _ := server.storeWatch()
+			return fn(s)
+		}
+	}
+	server.metrics.gaugeFunc("store_watch_up", "1 if the store watch is running", stat(func(s watchState) float64 {
+		if s.Up {
+			return 1
+		}
+		return 0
+	}))
+	server.metrics.gaugeFunc("store_watch_last_event_timestamp_seconds", "Unix time of the last change seen by the store watch",
+		stat(func(s watchState) float64 {
+			if s.LastEvent.IsZero() {
+				return 0
+			}
+			return float64(s.LastEvent.Unix())
+		}))
+	server.metrics.gaugeFunc("store_watch_errors", "Number of times the store watch failed", stat(func(s watchState) float64 {
+		return float64(s.Errors)
+	}))
+	server.metrics.gaugeFunc("store_watch_restarts", "Number of times the store watch was restarted", stat(func(s watchState) float64 {
+		return float64(s.Restarts)
+	}))
+}
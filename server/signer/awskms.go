@@ -0,0 +1,163 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/internal/awsv4"
+)
+
+const (
+	kmsTimeout     = 10 * time.Second
+	kmsKeySpec     = "ECC_NIST_EDWARDS25519"
+	kmsAlgorithm   = "ED25519_SHA_512"
+	kmsContentType = "application/x-amz-json-1.1"
+)
+
+// kmsSigner signs with an ed25519 key in AWS KMS, awskms://<key id, alias or ARN>. The credentials are
+// read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, the region from the ARN or
+// AWS_REGION, and AWS_ENDPOINT_URL_KMS replaces the endpoint of the region.
+type kmsSigner struct {
+	client    *http.Client
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	keyID     string
+	pubKey    string
+	now       func() time.Time
+}
+
+func openAWSKMS(ref string) (Signer, error) {
+	if ref == "" {
+		return nil, errors.New("awskms key references require a key id, alias or ARN")
+	}
+	s := &kmsSigner{
+		client:    &http.Client{Timeout: kmsTimeout},
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		keyID:     ref,
+		now:       time.Now,
+	}
+	if parts := strings.Split(ref, ":"); len(parts) > 3 && parts[0] == "arn" {
+		s.region = parts[3]
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("awskms signing keys require AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	s.endpoint = strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL_KMS"), "/")
+	if s.endpoint == "" {
+		s.endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", s.region)
+	}
+	var key struct {
+		KeySpec   string `json:"KeySpec"`
+		PublicKey []byte `json:"PublicKey"` // DER, base64 in JSON
+	}
+	if err := s.call("GetPublicKey", map[string]string{"KeyId": s.keyID}, &key); err != nil {
+		return nil, err
+	}
+	if key.KeySpec != kmsKeySpec {
+		return nil, fmt.Errorf("kms key %s is a %s key, operator keys are %s", s.keyID, key.KeySpec, kmsKeySpec)
+	}
+	pub, err := x509.ParsePKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("bad public key of kms key %s, %v", s.keyID, err)
+	}
+	edPub, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("kms key %s is not an ed25519 key", s.keyID)
+	}
+	if s.pubKey, err = operatorKey(edPub); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *kmsSigner) PublicKey() string {
+	return s.pubKey
+}
+
+func (s *kmsSigner) Sign(data []byte) ([]byte, error) {
+	var signed struct {
+		Signature []byte `json:"Signature"`
+	}
+	err := s.call("Sign", map[string]interface{}{
+		"KeyId":            s.keyID,
+		"Message":          data,
+		"MessageType":      "RAW",
+		"SigningAlgorithm": kmsAlgorithm,
+	}, &signed)
+	if err != nil {
+		return nil, err
+	}
+	return verified(s.pubKey, data, signed.Signature)
+}
+
+// call sends a signed request for an action of the KMS API and decodes the response into v
+func (s *kmsSigner) call(action string, body interface{}, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kmsContentType)
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	s.sign(req, data)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(respData, &failure)
+		return fmt.Errorf("kms %s returned %d %s %s", action, resp.StatusCode, failure.Type, failure.Message)
+	}
+	return json.Unmarshal(respData, v)
+}
+
+// sign adds the AWS signature version 4 headers, every header already set on req is signed
+func (s *kmsSigner) sign(req *http.Request, body []byte) {
+	creds := awsv4.Credentials{AccessKey: s.accessKey, SecretKey: s.secretKey, Token: s.token}
+	awsv4.Sign(req, body, creds, s.region, "kms", s.now())
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signer
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/nats-io/nkeys"
+)
+
+// fileSigner holds a seed read from a file, readable only by its owner
+type fileSigner struct {
+	kp     nkeys.KeyPair
+	pubKey string
+}
+
+func openFile(path string) (Signer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key, %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("signing key %s can be read by others, its mode is %s, use 0600", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key, %v", err)
+	}
+	defer wipe(data)
+	kp, err := nkeys.ParseDecoratedNKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key, %v", err)
+	}
+	pubKey, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return &fileSigner{kp: kp, pubKey: pubKey}, nil
+}
+
+// wipe overwrites a copy of a seed once it is parsed
+func wipe(data []byte) {
+	for i := range data {
+		data[i] = 'x'
+	}
+}
+
+func (s *fileSigner) PublicKey() string {
+	return s.pubKey
+}
+
+func (s *fileSigner) Sign(data []byte) ([]byte, error) {
+	return s.kp.Sign(data)
+}
@@ -0,0 +1,272 @@
+//go:build pkcs11 && cgo
+// +build pkcs11,cgo
+
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signer
+
+/*
+#cgo pkg-config: p11-kit-1
+#cgo LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <p11-kit/pkcs11.h>
+
+// the module's functions are only reachable through the function list, so every call goes through C
+
+static void *load_module(const char *path, CK_FUNCTION_LIST_PTR *f, CK_RV *rv) {
+	void *handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (handle == NULL) {
+		return NULL;
+	}
+	CK_C_GetFunctionList get = (CK_C_GetFunctionList)dlsym(handle, "C_GetFunctionList");
+	if (get == NULL) {
+		*rv = CKR_FUNCTION_NOT_SUPPORTED;
+		return handle;
+	}
+	*rv = get(f);
+	if (*rv != CKR_OK) {
+		return handle;
+	}
+	*rv = (*f)->C_Initialize(NULL);
+	if (*rv == CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		*rv = CKR_OK;
+	}
+	return handle;
+}
+
+static CK_RV slot_list(CK_FUNCTION_LIST_PTR f, CK_SLOT_ID *slots, CK_ULONG *count) {
+	return f->C_GetSlotList(CK_TRUE, slots, count);
+}
+
+static CK_RV token_info(CK_FUNCTION_LIST_PTR f, CK_SLOT_ID slot, CK_TOKEN_INFO *info) {
+	return f->C_GetTokenInfo(slot, info);
+}
+
+static CK_RV open_session(CK_FUNCTION_LIST_PTR f, CK_SLOT_ID slot, CK_UTF8CHAR *pin, CK_ULONG pin_len,
+		CK_SESSION_HANDLE *session) {
+	CK_RV rv = f->C_OpenSession(slot, CKF_SERIAL_SESSION, NULL, NULL, session);
+	if (rv != CKR_OK || pin_len == 0) {
+		return rv;
+	}
+	rv = f->C_Login(*session, CKU_USER, pin, pin_len);
+	if (rv == CKR_USER_ALREADY_LOGGED_IN) {
+		rv = CKR_OK;
+	}
+	return rv;
+}
+
+static CK_RV find_key(CK_FUNCTION_LIST_PTR f, CK_SESSION_HANDLE session, CK_OBJECT_CLASS class,
+		CK_UTF8CHAR *label, CK_ULONG label_len, CK_OBJECT_HANDLE *key, CK_ULONG *found) {
+	CK_KEY_TYPE key_type = CKK_EC_EDWARDS;
+	CK_ATTRIBUTE template[] = {
+		{CKA_CLASS, &class, sizeof(class)},
+		{CKA_KEY_TYPE, &key_type, sizeof(key_type)},
+		{CKA_LABEL, label, label_len},
+	};
+	CK_RV rv = f->C_FindObjectsInit(session, template, 3);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	rv = f->C_FindObjects(session, key, 1, found);
+	f->C_FindObjectsFinal(session);
+	return rv;
+}
+
+static CK_RV ec_point(CK_FUNCTION_LIST_PTR f, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key,
+		CK_BYTE *point, CK_ULONG *point_len) {
+	CK_ATTRIBUTE attr = {CKA_EC_POINT, point, *point_len};
+	CK_RV rv = f->C_GetAttributeValue(session, key, &attr, 1);
+	*point_len = attr.ulValueLen;
+	return rv;
+}
+
+static CK_RV sign(CK_FUNCTION_LIST_PTR f, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key,
+		CK_BYTE *data, CK_ULONG data_len, CK_BYTE *sig, CK_ULONG *sig_len) {
+	CK_MECHANISM mechanism = {CKM_EDDSA, NULL, 0};
+	CK_RV rv = f->C_SignInit(session, &mechanism, key);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	return f->C_Sign(session, data, data_len, sig, sig_len);
+}
+*/
+import "C"
+
+import (
+	"crypto/ed25519"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+func init() {
+	Register("pkcs11", openPKCS11)
+}
+
+// pkcs11Signer signs with an ed25519 (CKK_EC_EDWARDS) key of a PKCS#11 module, pkcs11://<key label>. The
+// module is read from PKCS11_MODULE, the token label from PKCS11_TOKEN, defaulting to the first token, and
+// the user PIN from PKCS11_PIN. Sessions aren't safe for concurrent use, signing is serialized.
+type pkcs11Signer struct {
+	sync.Mutex
+	f       C.CK_FUNCTION_LIST_PTR
+	session C.CK_SESSION_HANDLE
+	key     C.CK_OBJECT_HANDLE
+	pubKey  string
+}
+
+func openPKCS11(ref string) (Signer, error) {
+	if ref == "" {
+		return nil, errors.New("pkcs11 key references require a key label")
+	}
+	module := os.Getenv("PKCS11_MODULE")
+	if module == "" {
+		return nil, errors.New("pkcs11 signing keys require PKCS11_MODULE")
+	}
+	cModule := C.CString(module)
+	defer C.free(unsafe.Pointer(cModule))
+	s := &pkcs11Signer{}
+	var rv C.CK_RV
+	if handle := C.load_module(cModule, &s.f, &rv); handle == nil {
+		return nil, fmt.Errorf("error loading pkcs11 module %s, %s", module, C.GoString(C.dlerror()))
+	}
+	if err := ckError("C_Initialize", rv); err != nil {
+		return nil, err
+	}
+	slot, err := s.findToken(os.Getenv("PKCS11_TOKEN"))
+	if err != nil {
+		return nil, err
+	}
+	pin := []byte(os.Getenv("PKCS11_PIN"))
+	if err := ckError("C_OpenSession", C.open_session(s.f, slot, cBytes(pin), C.CK_ULONG(len(pin)), &s.session)); err != nil {
+		return nil, err
+	}
+	pubHandle, err := s.findKey(C.CKO_PUBLIC_KEY, ref)
+	if err != nil {
+		return nil, err
+	}
+	if s.key, err = s.findKey(C.CKO_PRIVATE_KEY, ref); err != nil {
+		return nil, err
+	}
+	point := make([]byte, 128)
+	pointLen := C.CK_ULONG(len(point))
+	if err := ckError("C_GetAttributeValue", C.ec_point(s.f, s.session, pubHandle, cBytes(point), &pointLen)); err != nil {
+		return nil, err
+	}
+	pub, err := edwardsPoint(point[:pointLen])
+	if err != nil {
+		return nil, fmt.Errorf("bad public key of pkcs11 key %s, %v", ref, err)
+	}
+	if s.pubKey, err = operatorKey(pub); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// findToken returns the slot of the token with the label, or of the first token if label is empty
+func (s *pkcs11Signer) findToken(label string) (C.CK_SLOT_ID, error) {
+	var count C.CK_ULONG
+	if err := ckError("C_GetSlotList", C.slot_list(s.f, nil, &count)); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, errors.New("the pkcs11 module has no tokens")
+	}
+	slots := make([]C.CK_SLOT_ID, count)
+	if err := ckError("C_GetSlotList", C.slot_list(s.f, &slots[0], &count)); err != nil {
+		return 0, err
+	}
+	for _, slot := range slots[:count] {
+		if label == "" {
+			return slot, nil
+		}
+		var info C.CK_TOKEN_INFO
+		if C.token_info(s.f, slot, &info) != C.CKR_OK {
+			continue
+		}
+		// labels are padded with blanks to 32 bytes
+		tokenLabel := C.GoBytes(unsafe.Pointer(&info.label[0]), C.int(len(info.label)))
+		if strings.TrimRight(string(tokenLabel), " ") == label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no pkcs11 token is labeled %q", label)
+}
+
+func (s *pkcs11Signer) findKey(class C.CK_OBJECT_CLASS, label string) (C.CK_OBJECT_HANDLE, error) {
+	var key C.CK_OBJECT_HANDLE
+	var found C.CK_ULONG
+	cLabel := []byte(label)
+	if err := ckError("C_FindObjects", C.find_key(s.f, s.session, class, cBytes(cLabel), C.CK_ULONG(len(cLabel)), &key, &found)); err != nil {
+		return 0, err
+	}
+	if found == 0 {
+		kind := "private"
+		if class == C.CKO_PUBLIC_KEY {
+			kind = "public"
+		}
+		return 0, fmt.Errorf("no ed25519 %s key is labeled %q in the pkcs11 token", kind, label)
+	}
+	return key, nil
+}
+
+func (s *pkcs11Signer) PublicKey() string {
+	return s.pubKey
+}
+
+func (s *pkcs11Signer) Sign(data []byte) ([]byte, error) {
+	sig := make([]byte, ed25519.SignatureSize)
+	sigLen := C.CK_ULONG(len(sig))
+	s.Lock()
+	rv := C.sign(s.f, s.session, s.key, cBytes(data), C.CK_ULONG(len(data)), cBytes(sig), &sigLen)
+	s.Unlock()
+	if err := ckError("C_Sign", rv); err != nil {
+		return nil, err
+	}
+	return verified(s.pubKey, data, sig[:sigLen])
+}
+
+// edwardsPoint returns the raw public key of a CKA_EC_POINT, which modules give as a DER octet string
+// or, some of them, as the raw key
+func edwardsPoint(point []byte) ([]byte, error) {
+	if len(point) == ed25519.PublicKeySize {
+		return point, nil
+	}
+	var pub []byte
+	if rest, err := asn1.Unmarshal(point, &pub); err != nil || len(rest) != 0 {
+		return nil, errors.New("the EC point is not a DER octet string")
+	}
+	return pub, nil
+}
+
+// cBytes returns a pointer to the first byte, nil for an empty slice
+func cBytes(b []byte) *C.CK_BYTE {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.CK_BYTE)(unsafe.Pointer(&b[0]))
+}
+
+func ckError(function string, rv C.CK_RV) error {
+	if rv == C.CKR_OK {
+		return nil
+	}
+	return fmt.Errorf("pkcs11 %s failed with 0x%x", function, uint64(rv))
+}
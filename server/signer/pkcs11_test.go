@@ -0,0 +1,53 @@
+//go:build pkcs11 && cgo
+// +build pkcs11,cgo
+
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signer
+
+import (
+	"crypto/ed25519"
+	"encoding/asn1"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// signing needs a token, i.e. SoftHSM, what runs without one is checked here
+func TestPKCS11(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	der, err := asn1.Marshal([]byte(pub))
+	require.NoError(t, err)
+	point, err := edwardsPoint(der)
+	require.NoError(t, err)
+	require.Equal(t, []byte(pub), point)
+	point, err = edwardsPoint(pub)
+	require.NoError(t, err)
+	require.Equal(t, []byte(pub), point)
+	_, err = edwardsPoint([]byte{0x04, 0x02, 0x01})
+	require.Error(t, err)
+
+	_, err = Open("pkcs11://")
+	require.Error(t, err)
+	t.Setenv("PKCS11_MODULE", "")
+	_, err = Open("pkcs11://operator")
+	require.Error(t, err)
+	t.Setenv("PKCS11_MODULE", filepath.Join(t.TempDir(), "missing.so"))
+	_, err = Open("pkcs11://operator")
+	require.ErrorContains(t, err, "error loading pkcs11 module")
+}
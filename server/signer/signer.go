@@ -0,0 +1,164 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package signer signs JWTs with an operator key that may be held outside the account server, by a key
+// management service or a hardware module, so the seed doesn't have to be on the host.
+package signer
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nkeys"
+)
+
+// Signer signs with an operator key
+type Signer interface {
+	// PublicKey returns the public operator nkey
+	PublicKey() string
+	// Sign returns the ed25519 signature of data
+	Sign(data []byte) ([]byte, error)
+}
+
+// Backend opens the key a reference points to, the reference is passed without its scheme
+type Backend func(ref string) (Signer, error)
+
+var (
+	backendsLock sync.Mutex
+	backends     = map[string]Backend{}
+)
+
+func init() {
+	Register("file", openFile)
+	Register("vault", openVault)
+	Register("awskms", openAWSKMS)
+}
+
+// Register makes the scheme usable in key references, i.e. hsm for hsm://<ref>, registering a
+// scheme twice is an error
+func Register(scheme string, backend Backend) error {
+	if scheme == "" || backend == nil {
+		return errors.New("signer backends require a scheme and a constructor")
+	}
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if _, ok := backends[scheme]; ok {
+		return fmt.Errorf("signer scheme %q is already registered", scheme)
+	}
+	backends[scheme] = backend
+	return nil
+}
+
+// Open returns the signer of a key reference, <scheme>://<ref>. A reference without a scheme is a file
+// holding the seed.
+func Open(ref string) (Signer, error) {
+	scheme, rest := "file", ref
+	if i := strings.Index(ref, "://"); i > 0 {
+		scheme, rest = ref[:i], ref[i+3:]
+	}
+	backendsLock.Lock()
+	backend, ok := backends[scheme]
+	backendsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key scheme %q", scheme)
+	}
+	s, err := backend(rest)
+	if err != nil {
+		return nil, err
+	}
+	if !nkeys.IsValidPublicOperatorKey(s.PublicKey()) {
+		return nil, errors.New("signing key is not an operator key")
+	}
+	return s, nil
+}
+
+// operatorKey encodes a raw ed25519 public key as an operator nkey
+func operatorKey(pub []byte) (string, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("public key has %d bytes, expected an ed25519 key", len(pub))
+	}
+	encoded, err := nkeys.Encode(nkeys.PrefixByteOperator, pub)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// verified checks a signature made by a remote key, so a misconfigured key is noticed before the
+// nats-servers reject what it signed
+func verified(pubKey string, data []byte, sig []byte) ([]byte, error) {
+	kp, err := nkeys.FromPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := kp.Verify(data, sig); err != nil {
+		return nil, fmt.Errorf("signature doesn't match the public key %s", pubKey)
+	}
+	return sig, nil
+}
+
+var errNoSeed = errors.New("the signing key seed is not available")
+
+// keyPair lets the jwt library encode with a signer, only the public key and signing are supported
+type keyPair struct {
+	s Signer
+}
+
+// KeyPair returns the signer as an nkeys.KeyPair, to encode claims with
+func KeyPair(s Signer) nkeys.KeyPair {
+	if kp, ok := s.(*fileSigner); ok {
+		return kp.kp
+	}
+	return &keyPair{s: s}
+}
+
+func (k *keyPair) Seed() ([]byte, error) {
+	return nil, errNoSeed
+}
+
+func (k *keyPair) PublicKey() (string, error) {
+	return k.s.PublicKey(), nil
+}
+
+func (k *keyPair) PrivateKey() ([]byte, error) {
+	return nil, errNoSeed
+}
+
+func (k *keyPair) Sign(input []byte) ([]byte, error) {
+	return k.s.Sign(input)
+}
+
+func (k *keyPair) Verify(input []byte, sig []byte) error {
+	_, err := verified(k.s.PublicKey(), input, sig)
+	return err
+}
+
+func (k *keyPair) Wipe() {}
+
+func (k *keyPair) Seal(input []byte, recipient string) ([]byte, error) {
+	return nil, nkeys.ErrInvalidNKeyOperation
+}
+
+func (k *keyPair) SealWithRand(input []byte, recipient string, rr io.Reader) ([]byte, error) {
+	return nil, nkeys.ErrInvalidNKeyOperation
+}
+
+func (k *keyPair) Open(input []byte, sender string) ([]byte, error) {
+	return nil, nkeys.ErrInvalidNKeyOperation
+}
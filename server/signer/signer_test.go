@@ -0,0 +1,251 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signer
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func rawPublicKey(t *testing.T, kp nkeys.KeyPair) ed25519.PublicKey {
+	pubKey, err := kp.PublicKey()
+	require.NoError(t, err)
+	raw, err := nkeys.Decode(nkeys.PrefixByteOperator, []byte(pubKey))
+	require.NoError(t, err)
+	return ed25519.PublicKey(raw)
+}
+
+// encodes an account JWT with the signer and checks the result is signed by the operator
+func requireSigns(t *testing.T, s Signer, operator nkeys.KeyPair) {
+	operatorPubKey, err := operator.PublicKey()
+	require.NoError(t, err)
+	require.Equal(t, operatorPubKey, s.PublicKey())
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	accountPubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	token, err := jwt.NewAccountClaims(accountPubKey).Encode(KeyPair(s))
+	require.NoError(t, err)
+	claim, err := jwt.DecodeAccountClaims(token)
+	require.NoError(t, err)
+	require.Equal(t, operatorPubKey, claim.Issuer)
+}
+
+func TestFileSigner(t *testing.T) {
+	writeSeed := func(kp nkeys.KeyPair, mode os.FileMode) string {
+		seed, err := kp.Seed()
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "signing.nk")
+		require.NoError(t, os.WriteFile(path, seed, mode))
+		require.NoError(t, os.Chmod(path, mode))
+		return path
+	}
+
+	operator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	path := writeSeed(operator, 0600)
+	s, err := Open(path)
+	require.NoError(t, err)
+	requireSigns(t, s, operator)
+	s, err = Open("file://" + path)
+	require.NoError(t, err)
+	requireSigns(t, s, operator)
+
+	if runtime.GOOS != "windows" {
+		_, err = Open(writeSeed(operator, 0644))
+		require.Error(t, err)
+	}
+	account, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	_, err = Open(writeSeed(account, 0600))
+	require.Error(t, err)
+	_, err = Open(filepath.Join(t.TempDir(), "missing.nk"))
+	require.Error(t, err)
+}
+
+func TestRegister(t *testing.T) {
+	_, err := Open("unknown://key")
+	require.Error(t, err)
+	require.Error(t, Register("file", openFile))
+	require.Error(t, Register("", openFile))
+
+	operator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	require.NoError(t, Register("test", func(ref string) (Signer, error) {
+		require.Equal(t, "slot/1", ref)
+		return &keyPairSigner{operator}, nil
+	}))
+	s, err := Open("test://slot/1")
+	require.NoError(t, err)
+	requireSigns(t, s, operator)
+	_, ok := KeyPair(s).(*keyPair)
+	require.True(t, ok)
+	_, err = KeyPair(s).Seed()
+	require.Error(t, err)
+}
+
+// keyPairSigner is a registered backend without access to the seed
+type keyPairSigner struct {
+	kp nkeys.KeyPair
+}
+
+func (s *keyPairSigner) PublicKey() string {
+	pubKey, _ := s.kp.PublicKey()
+	return pubKey
+}
+
+func (s *keyPairSigner) Sign(data []byte) ([]byte, error) {
+	return s.kp.Sign(data)
+}
+
+func TestVaultSigner(t *testing.T) {
+	operator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	keyType := "ed25519"
+	signer := operator
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/keys-mount/keys/operator":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"type":           keyType,
+				"latest_version": 2,
+				"keys": map[string]interface{}{
+					"2": map[string]string{"public_key": base64.StdEncoding.EncodeToString(rawPublicKey(t, operator))},
+				},
+			}})
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/keys-mount/sign/operator":
+			var body struct {
+				Input string `json:"input"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			data, _ := base64.StdEncoding.DecodeString(body.Input)
+			sig, _ := signer.Sign(data)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{
+				"signature": "vault:v2:" + base64.StdEncoding.EncodeToString(sig),
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer server.Close()
+	t.Setenv("VAULT_ADDR", server.URL)
+
+	t.Setenv("VAULT_TOKEN", "")
+	_, err = Open("vault://keys-mount/operator")
+	require.Error(t, err)
+	t.Setenv("VAULT_TOKEN", "wrong")
+	_, err = Open("vault://keys-mount/operator")
+	require.Error(t, err)
+	t.Setenv("VAULT_TOKEN", "token")
+	_, err = Open("vault://keys-mount/missing")
+	require.Error(t, err)
+
+	s, err := Open("vault://keys-mount/operator")
+	require.NoError(t, err)
+	requireSigns(t, s, operator)
+
+	// a signature of another key is caught
+	signer, err = nkeys.CreateOperator()
+	require.NoError(t, err)
+	_, err = s.Sign([]byte("data"))
+	require.Error(t, err)
+
+	keyType = "rsa-2048"
+	_, err = Open("vault://keys-mount/operator")
+	require.Error(t, err)
+}
+
+func TestAWSKMSSigner(t *testing.T) {
+	operator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(rawPublicKey(t, operator))
+	require.NoError(t, err)
+	keySpec := kmsKeySpec
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") || !strings.Contains(auth, "/eu-west-1/kms/aws4_request") ||
+			r.Header.Get("X-Amz-Security-Token") != "session" || r.Header.Get("Content-Type") != kmsContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"IncompleteSignatureException","message":"bad signature"}`))
+			return
+		}
+		var body struct {
+			KeyId            string
+			Message          []byte
+			MessageType      string
+			SigningAlgorithm string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.KeyId != "alias/operator" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"NotFoundException","message":"no such key"}`))
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			json.NewEncoder(w).Encode(map[string]interface{}{"KeySpec": keySpec, "PublicKey": der})
+		case "TrentService.Sign":
+			require.Equal(t, "RAW", body.MessageType)
+			require.Equal(t, kmsAlgorithm, body.SigningAlgorithm)
+			sig, _ := operator.Sign(body.Message)
+			json.NewEncoder(w).Encode(map[string]interface{}{"Signature": sig})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_KMS", server.URL)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	_, err = Open("awskms://alias/operator")
+	require.Error(t, err)
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	_, err = Open("awskms://alias/missing")
+	require.Error(t, err)
+
+	s, err := Open("awskms://alias/operator")
+	require.NoError(t, err)
+	requireSigns(t, s, operator)
+
+	keySpec = "RSA_2048"
+	_, err = Open("awskms://alias/operator")
+	require.Error(t, err)
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVaultAddr  = "https://127.0.0.1:8200"
+	defaultVaultMount = "transit"
+	vaultTimeout      = 10 * time.Second
+)
+
+// vaultSigner signs with an ed25519 key of a Vault transit secrets engine, vault://[mount/]key. The
+// address, token and namespace are read from VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE, as the vault
+// CLI does.
+type vaultSigner struct {
+	client    *http.Client
+	addr      string
+	token     string
+	namespace string
+	mount     string
+	key       string
+	pubKey    string
+}
+
+func openVault(ref string) (Signer, error) {
+	s := &vaultSigner{
+		client:    &http.Client{Timeout: vaultTimeout},
+		addr:      strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		mount:     defaultVaultMount,
+		key:       ref,
+	}
+	if i := strings.LastIndex(ref, "/"); i >= 0 {
+		s.mount, s.key = ref[:i], ref[i+1:]
+	}
+	if s.mount == "" || s.key == "" {
+		return nil, fmt.Errorf("bad vault key reference %q, use vault://[mount/]key", ref)
+	}
+	if s.addr == "" {
+		s.addr = defaultVaultAddr
+	}
+	if s.token == "" {
+		return nil, errors.New("vault signing keys require VAULT_TOKEN")
+	}
+	var key struct {
+		Data struct {
+			Type          string `json:"type"`
+			LatestVersion int    `json:"latest_version"`
+			Keys          map[string]struct {
+				PublicKey string `json:"public_key"`
+			} `json:"keys"`
+		} `json:"data"`
+	}
+	if err := s.call(http.MethodGet, "/keys/"+s.key, nil, &key); err != nil {
+		return nil, err
+	}
+	if key.Data.Type != "ed25519" {
+		return nil, fmt.Errorf("vault key %s is a %s key, operator keys are ed25519", s.key, key.Data.Type)
+	}
+	pub, err := base64.StdEncoding.DecodeString(key.Data.Keys[strconv.Itoa(key.Data.LatestVersion)].PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("bad public key of vault key %s, %v", s.key, err)
+	}
+	if s.pubKey, err = operatorKey(pub); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// call sends a request to the transit mount and decodes the response into v
+func (s *vaultSigner) call(method string, path string, body interface{}, v interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, s.addr+"/v1/"+s.mount+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	if s.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.namespace)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("vault %s returned %d %s", path, resp.StatusCode, strings.Join(failure.Errors, ", "))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *vaultSigner) PublicKey() string {
+	return s.pubKey
+}
+
+// Sign signs with the latest version of the key, signatures are returned as vault:v<version>:<base64>
+func (s *vaultSigner) Sign(data []byte) ([]byte, error) {
+	var signed struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	if err := s.call(http.MethodPost, "/sign/"+s.key, map[string]string{"input": base64.StdEncoding.EncodeToString(data)}, &signed); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(signed.Data.Signature, ":")
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("unexpected vault signature %q", signed.Data.Signature)
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return verified(s.pubKey, data, sig)
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package bench measures the store implementations on reproducible data sets, run it with
+// go test -bench . ./server/store/bench. Stores other than the directory store are added with
+// the BENCH_STORES environment variable, a JSON list of store configurations.
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/core"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// StoresEnv holds additional stores to measure, i.e. [{"type": "etcd", "endpoints": ["http://localhost:2379"]}]
+const StoresEnv = "BENCH_STORES"
+
+// Sizes are the numbers of accounts in the data sets
+var Sizes = []int{100, 1000, 10000}
+
+// Target is a store configuration to measure, the dir of directory stores is filled in for each run
+type Target struct {
+	Name   string
+	Config conf.StoreConfig
+}
+
+// Targets returns the directory store variants and the stores from BENCH_STORES
+func Targets() ([]Target, error) {
+	targets := []Target{
+		{Name: "dir", Config: conf.StoreConfig{Type: conf.StoreDir}},
+		{Name: "dir-sharded", Config: conf.StoreConfig{Type: conf.StoreDir, Shard: true}},
+		{Name: "dir-cached", Config: conf.StoreConfig{Type: conf.StoreDir, CacheSize: 1000}},
+	}
+	env := os.Getenv(StoresEnv)
+	if env == "" {
+		return targets, nil
+	}
+	var extra []conf.StoreConfig
+	if err := json.Unmarshal([]byte(env), &extra); err != nil {
+		return nil, fmt.Errorf("bad %s, expected a JSON list of store configurations: %v", StoresEnv, err)
+	}
+	for _, c := range extra {
+		targets = append(targets, Target{Name: c.Type, Config: c})
+	}
+	return targets, nil
+}
+
+// Open creates the store of the target, directory stores in a new temporary directory
+func (t Target) Open(tb testing.TB) store.JWTStore {
+	tb.Helper()
+	config := t.Config
+	if config.Type == conf.StoreDir {
+		config.Dir = tb.TempDir()
+	}
+	s, err := core.OpenStore(config)
+	if err != nil {
+		tb.Fatalf("opening %s store: %v", t.Name, err)
+	}
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// Dataset is a set of account JWTs and activations signed by one operator
+type Dataset struct {
+	Accounts    []string          // public keys, in the order they were created
+	JWTs        map[string]string // by public key
+	Activations []*jwt.ActivationClaims
+	ActJWTs     []string // the encoded activations
+	Pack        string   // every account in the pack format, pubkey|jwt lines
+	operator    nkeys.KeyPair
+}
+
+// NewDataset creates size accounts, the keys only depend on the size so runs compare the same data
+func NewDataset(size int) (*Dataset, error) {
+	rr := rand.New(rand.NewSource(int64(size)))
+	operator, err := nkeys.CreatePairWithRand(nkeys.PrefixByteOperator, rr)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dataset{JWTs: map[string]string{}, operator: operator}
+	lines := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		account, err := nkeys.CreatePairWithRand(nkeys.PrefixByteAccount, rr)
+		if err != nil {
+			return nil, err
+		}
+		pubKey, _ := account.PublicKey()
+		claim := jwt.NewAccountClaims(pubKey)
+		claim.Name = fmt.Sprintf("account-%d", i)
+		claim.IssuedAt = int64(1600000000 + i)
+		theJWT, err := claim.Encode(operator)
+		if err != nil {
+			return nil, err
+		}
+		d.Accounts = append(d.Accounts, pubKey)
+		d.JWTs[pubKey] = theJWT
+		lines = append(lines, pubKey+"|"+theJWT)
+
+		importer, err := nkeys.CreatePairWithRand(nkeys.PrefixByteAccount, rr)
+		if err != nil {
+			return nil, err
+		}
+		importerKey, _ := importer.PublicKey()
+		activation := jwt.NewActivationClaims(importerKey)
+		activation.ImportSubject = jwt.Subject(fmt.Sprintf("svc.%d.*", i))
+		actJWT, err := activation.Encode(account)
+		if err != nil {
+			return nil, err
+		}
+		d.Activations = append(d.Activations, activation)
+		d.ActJWTs = append(d.ActJWTs, actJWT)
+	}
+	d.Pack = strings.Join(lines, "\n")
+	return d, nil
+}
+
+// Updated returns the accounts re-issued with a later issue time, as merging a newer pack would see them
+func (d *Dataset) Updated() (string, error) {
+	lines := make([]string, 0, len(d.Accounts))
+	for i, pubKey := range d.Accounts {
+		claim := jwt.NewAccountClaims(pubKey)
+		claim.Name = fmt.Sprintf("account-%d-updated", i)
+		claim.IssuedAt = int64(1700000000 + i)
+		theJWT, err := claim.Encode(d.operator)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, pubKey+"|"+theJWT)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Fill saves every account of the data set
+func (d *Dataset) Fill(tb testing.TB, s store.JWTStore) {
+	tb.Helper()
+	for _, pubKey := range d.Accounts {
+		if err := s.SaveAcc(pubKey, d.JWTs[pubKey]); err != nil {
+			tb.Fatalf("saving %s: %v", pubKey, err)
+		}
+	}
+}
+
+// Load reads the accounts of a filled store round robin
+func Load(b *testing.B, s store.JWTStore, d *Dataset) {
+	d.Fill(b, s)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.LoadAcc(d.Accounts[i%len(d.Accounts)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Save writes the accounts round robin, the first pass creates them and later ones overwrite
+func Save(b *testing.B, s store.JWTStore, d *Dataset) {
+	for i := 0; i < b.N; i++ {
+		pubKey := d.Accounts[i%len(d.Accounts)]
+		if err := s.SaveAcc(pubKey, d.JWTs[pubKey]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Pack packs every account of a filled store
+func Pack(b *testing.B, s store.JWTStore, d *Dataset) {
+	packer, ok := s.(store.PackableJWTStore)
+	if !ok {
+		b.Skip("store doesn't pack")
+	}
+	d.Fill(b, s)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := packer.Pack(-1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Merge merges a pack of newer JWTs into a store holding the original ones, which are saved again
+// before each iteration
+func Merge(b *testing.B, s store.JWTStore, d *Dataset) {
+	packer, ok := s.(store.PackableJWTStore)
+	if !ok {
+		b.Skip("store doesn't merge")
+	}
+	updated, err := d.Updated()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		d.Fill(b, s)
+		b.StartTimer()
+		if err := packer.Merge(updated); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Hash computes the hash of an activation and stores the activation under it, as a post does. Stores
+// that can't keep activations, like the directory store, only measure the hash.
+func Hash(b *testing.B, s store.JWTStore, d *Dataset) {
+	actStore, ok := s.(store.JWTActivationStore)
+	if ok {
+		hash, err := d.Activations[0].HashID()
+		ok = err == nil && actStore.SaveAct(hash, d.ActJWTs[0]) == nil
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := i % len(d.Activations)
+		hash, err := d.Activations[n].HashID()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !ok {
+			continue
+		}
+		if err := actStore.SaveAct(hash, d.ActJWTs[n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Ops are the measured operations by name
+var Ops = []struct {
+	Name string
+	Run  func(b *testing.B, s store.JWTStore, d *Dataset)
+}{
+	{"load", Load},
+	{"save", Save},
+	{"pack", Pack},
+	{"merge", Merge},
+	{"hash", Hash},
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// guardEnv selects the regression guard, check compares against the baselines and record rewrites them
+const (
+	guardEnv     = "BENCH_GUARD"
+	toleranceEnv = "BENCH_TOLERANCE" // allowed slowdown factor, 1.5 by default
+	baselineFile = "testdata/baselines.json"
+	guardRuns    = 3
+)
+
+var datasets = map[int]*Dataset{}
+
+func dataset(tb testing.TB, size int) *Dataset {
+	if d, ok := datasets[size]; ok {
+		return d
+	}
+	d, err := NewDataset(size)
+	require.NoError(tb, err)
+	datasets[size] = d
+	return d
+}
+
+func BenchmarkStores(b *testing.B) {
+	targets, err := Targets()
+	require.NoError(b, err)
+	for _, target := range targets {
+		for _, size := range Sizes {
+			for _, op := range Ops {
+				target, size, op := target, size, op
+				b.Run(fmt.Sprintf("%s/%d/%s", target.Name, size, op.Name), func(b *testing.B) {
+					d := dataset(b, size)
+					op.Run(b, target.Open(b), d)
+				})
+			}
+		}
+	}
+}
+
+func TestDataset(t *testing.T) {
+	a, err := NewDataset(10)
+	require.NoError(t, err)
+	b, err := NewDataset(10)
+	require.NoError(t, err)
+	require.Equal(t, a.Accounts, b.Accounts, "data sets are reproducible")
+	require.Len(t, a.JWTs, 10)
+	require.Len(t, a.ActJWTs, 10)
+
+	targets, err := Targets()
+	require.NoError(t, err)
+	s := targets[0].Open(t)
+	a.Fill(t, s)
+	for _, pubKey := range a.Accounts {
+		theJWT, err := s.LoadAcc(pubKey)
+		require.NoError(t, err)
+		require.Equal(t, a.JWTs[pubKey], theJWT)
+	}
+
+	os.Setenv(StoresEnv, `[{"type": "etcd", "endpoints": ["http://localhost:2379"]}]`)
+	defer os.Unsetenv(StoresEnv)
+	targets, err = Targets()
+	require.NoError(t, err)
+	require.Equal(t, "etcd", targets[len(targets)-1].Name)
+	require.Equal(t, []string{"http://localhost:2379"}, targets[len(targets)-1].Config.Endpoints)
+}
+
+// TestRegressionGuard runs the benchmarks of the smaller data sets and fails if the fastest of three
+// runs of one got slower than its baseline by more than the tolerance. Baselines depend on the hardware,
+// record them on the machine the guard runs on with BENCH_GUARD=record.
+func TestRegressionGuard(t *testing.T) {
+	mode := os.Getenv(guardEnv)
+	if mode != "check" && mode != "record" {
+		t.Skipf("set %s to check or record to run the benchmarks", guardEnv)
+	}
+	tolerance := 1.5
+	if v := os.Getenv(toleranceEnv); v != "" {
+		var err error
+		tolerance, err = strconv.ParseFloat(v, 64)
+		require.NoError(t, err)
+	}
+	baselines := map[string]int64{}
+	if mode == "check" {
+		data, err := os.ReadFile(baselineFile)
+		require.NoError(t, err, "record the baselines first")
+		require.NoError(t, json.Unmarshal(data, &baselines))
+	}
+
+	targets, err := Targets()
+	require.NoError(t, err)
+	results := map[string]int64{}
+	for _, target := range targets {
+		for _, size := range Sizes[:2] {
+			for _, op := range Ops {
+				target, op := target, op
+				d := dataset(t, size)
+				name := fmt.Sprintf("%s/%d/%s", target.Name, size, op.Name)
+				// the fastest of a few runs is the least disturbed by other work on the machine
+				for run := 0; run < guardRuns; run++ {
+					r := testing.Benchmark(func(b *testing.B) {
+						op.Run(b, target.Open(b), d)
+					})
+					if r.N == 0 {
+						break // skipped, the store doesn't support the operation
+					}
+					if best, ok := results[name]; !ok || r.NsPerOp() < best {
+						results[name] = r.NsPerOp()
+					}
+				}
+				t.Logf("%s: %d ns/op", name, results[name])
+			}
+		}
+	}
+
+	if mode == "record" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(baselineFile, append(data, '\n'), 0644))
+		return
+	}
+	var names []string
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		baseline, ok := baselines[name]
+		if !ok {
+			t.Logf("%s: no baseline", name)
+			continue
+		}
+		if float64(results[name]) > float64(baseline)*tolerance {
+			t.Errorf("%s: %d ns/op, baseline %d ns/op, more than %.1fx slower", name, results[name], baseline, tolerance)
+		}
+	}
+}
@@ -46,3 +46,23 @@ type PackableJWTStore interface {
 	Pack(maxJWTs int) (string, error)
 	Merge(pack string) error
 }
+
+// TransactionalJWTStore is implemented by stores that can save several account JWTs as
+// one unit, either all of the JWTs are stored or none of them are.
+type TransactionalJWTStore interface {
+	// ApplyAccs saves the JWTs, keyed by public key, all or nothing
+	ApplyAccs(jwts map[string]string) error
+}
+
+// DeletableJWTStore is implemented by stores that can remove an account JWT
+type DeletableJWTStore interface {
+	// DeleteAcc removes the account JWT, it is an error if the store doesn't hold it
+	DeleteAcc(publicKey string) error
+}
+
+// WatchableJWTStore is implemented by stores that several account servers can share, it reports the
+// account JWTs saved by any of them, so every server can notify its nats-servers
+type WatchableJWTStore interface {
+	// Watch calls changed with the public key of every account JWT saved from now on, until the store is closed
+	Watch(changed func(publicKey string)) error
+}
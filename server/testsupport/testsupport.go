@@ -0,0 +1,317 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package testsupport runs an in-process account server, optionally with a nats-server
+// trusting the same operator, for use in integration tests of projects that talk to it.
+package testsupport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/core"
+	gnatsserver "github.com/nats-io/nats-server/v2/server"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// Setup holds the elements of a running test environment
+type Setup struct {
+	GNATSD *gnatsserver.Server
+	NC     *nats.Conn
+	Server *core.AccountServer
+	HTTP   *http.Client
+
+	OperatorKey     nkeys.KeyPair
+	OperatorPubKey  string
+	OperatorJWTFile string
+
+	SystemAccount        nkeys.KeyPair
+	SystemAccountPubKey  string
+	SystemAccountJWTFile string
+
+	SystemUser          nkeys.KeyPair
+	SystemUserPubKey    string
+	SystemUserCredsFile string
+
+	dir string
+}
+
+// Start creates an operator, system account and user, then runs an account server with config.
+// If config is nil the default configuration is used. Ports, paths and logging in config are
+// overwritten. When enableNats is true a nats-server using the account server as its resolver
+// is started and NC is connected to it as the system user.
+func Start(config *conf.AccountServerConfig, enableNats bool) (*Setup, error) {
+	if config == nil {
+		config = conf.DefaultServerConfig()
+	}
+
+	dir, err := os.MkdirTemp("", "account-server-test")
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &Setup{dir: dir}
+	if err := ts.initKeys(); err != nil {
+		ts.Cleanup()
+		return nil, err
+	}
+
+	httpPort, err := freePort()
+	if err != nil {
+		ts.Cleanup()
+		return nil, err
+	}
+	natsPort, err := freePort()
+	if err != nil {
+		ts.Cleanup()
+		return nil, err
+	}
+	natsURL := fmt.Sprintf("nats://127.0.0.1:%d", natsPort)
+
+	config.HTTP.Host = "127.0.0.1"
+	config.HTTP.Port = httpPort
+	config.OperatorJWTPath = ts.OperatorJWTFile
+	config.SystemAccountJWTPath = ts.SystemAccountJWTFile
+	config.Logging.Custom = core.NewNilLogger()
+	config.Store.Dir = filepath.Join(dir, "store")
+
+	if enableNats {
+		config.NATS = conf.NATSConfig{
+			Servers:         []string{natsURL},
+			MaxReconnects:   -1, // keep trying, the account server starts before the nats-server
+			ReconnectWait:   100,
+			UserCredentials: ts.SystemUserCredsFile,
+		}
+	}
+
+	ts.Server = core.NewAccountServer()
+	if err := ts.Server.InitializeFromConfig(config); err != nil {
+		ts.Cleanup()
+		return nil, err
+	}
+	if err := ts.Server.Start(); err != nil {
+		ts.Cleanup()
+		return nil, err
+	}
+
+	ts.HTTP = &http.Client{Timeout: 5 * time.Second}
+
+	if !enableNats {
+		return ts, nil
+	}
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = natsPort
+	opts.TrustedKeys = []string{ts.OperatorPubKey}
+	opts.SystemAccount = ts.SystemAccountPubKey
+
+	resolver, err := gnatsserver.NewURLAccResolver(ts.URLForPath("/jwt/v1/accounts/"))
+	if err != nil {
+		ts.Cleanup()
+		return nil, err
+	}
+	opts.AccountResolver = resolver
+	ts.GNATSD = gnatsd.RunServer(&opts)
+
+	ts.NC, err = nats.Connect(natsURL, nats.UserCredentials(ts.SystemUserCredsFile))
+	if err != nil {
+		ts.Cleanup()
+		return nil, err
+	}
+
+	end := time.Now().Add(5 * time.Second)
+	for !ts.Server.NATSConnected() {
+		if time.Now().After(end) {
+			ts.Cleanup()
+			return nil, fmt.Errorf("account server didn't connect to nats")
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+
+	return ts, nil
+}
+
+// Cleanup stops the servers and removes all generated files
+func (ts *Setup) Cleanup() {
+	if ts.Server != nil {
+		ts.Server.Stop()
+	}
+	if ts.NC != nil {
+		ts.NC.Close()
+	}
+	if ts.GNATSD != nil {
+		ts.GNATSD.Shutdown()
+	}
+	if ts.dir != "" {
+		os.RemoveAll(ts.dir)
+	}
+}
+
+// URLForPath converts a path to a full URL on the account server
+func (ts *Setup) URLForPath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return ts.Server.URL() + path
+}
+
+// CreateAccount creates a new account key and a JWT for it signed by the operator
+func (ts *Setup) CreateAccount() (nkeys.KeyPair, string, error) {
+	return CreateAccount(ts.OperatorKey)
+}
+
+// PostAccount stores the account JWT with the account server
+func (ts *Setup) PostAccount(accountJWT string) error {
+	claims, err := jwt.DecodeAccountClaims(accountJWT)
+	if err != nil {
+		return err
+	}
+	resp, err := ts.HTTP.Post(ts.URLForPath("/jwt/v1/accounts/"+claims.Subject), "application/jwt", strings.NewReader(accountJWT))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("account server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// CreateUserCreds creates a user in the account and writes a creds file for it, the file is
+// removed by Cleanup
+func (ts *Setup) CreateUserCreds(account nkeys.KeyPair) (string, error) {
+	_, creds, err := CreateUser(account)
+	if err != nil {
+		return "", err
+	}
+	return ts.writeFile("user.creds", creds)
+}
+
+// CreateAccount creates a new account key and a JWT for it signed by signer
+func CreateAccount(signer nkeys.KeyPair) (nkeys.KeyPair, string, error) {
+	key, err := nkeys.CreateAccount()
+	if err != nil {
+		return nil, "", err
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := jwt.NewAccountClaims(pub).Encode(signer)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, token, nil
+}
+
+// CreateUser creates a new user in the account, returning the key and the contents of a creds file
+func CreateUser(account nkeys.KeyPair) (nkeys.KeyPair, []byte, error) {
+	key, err := nkeys.CreateUser()
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := jwt.NewUserClaims(pub).Encode(account)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed, err := key.Seed()
+	if err != nil {
+		return nil, nil, err
+	}
+	creds, err := jwt.FormatUserConfig(token, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, creds, nil
+}
+
+func (ts *Setup) initKeys() error {
+	var err error
+	ts.OperatorKey, err = nkeys.CreateOperator()
+	if err != nil {
+		return err
+	}
+	ts.OperatorPubKey, err = ts.OperatorKey.PublicKey()
+	if err != nil {
+		return err
+	}
+	opJWT, err := jwt.NewOperatorClaims(ts.OperatorPubKey).Encode(ts.OperatorKey)
+	if err != nil {
+		return err
+	}
+	if ts.OperatorJWTFile, err = ts.writeFile("operator.jwt", []byte(opJWT)); err != nil {
+		return err
+	}
+
+	var sysJWT string
+	ts.SystemAccount, sysJWT, err = CreateAccount(ts.OperatorKey)
+	if err != nil {
+		return err
+	}
+	ts.SystemAccountPubKey, err = ts.SystemAccount.PublicKey()
+	if err != nil {
+		return err
+	}
+	if ts.SystemAccountJWTFile, err = ts.writeFile("sysacct.jwt", []byte(sysJWT)); err != nil {
+		return err
+	}
+
+	var creds []byte
+	ts.SystemUser, creds, err = CreateUser(ts.SystemAccount)
+	if err != nil {
+		return err
+	}
+	ts.SystemUserPubKey, err = ts.SystemUser.PublicKey()
+	if err != nil {
+		return err
+	}
+	ts.SystemUserCredsFile, err = ts.writeFile("sysuser.creds", creds)
+	return err
+}
+
+func (ts *Setup) writeFile(pattern string, data []byte) (string, error) {
+	file, err := os.CreateTemp(ts.dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
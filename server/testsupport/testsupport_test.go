@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package testsupport
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartWithoutNATS(t *testing.T) {
+	ts, err := Start(nil, false)
+	require.NoError(t, err)
+	defer ts.Cleanup()
+
+	require.Nil(t, ts.NC)
+	require.Nil(t, ts.GNATSD)
+
+	resp, err := ts.HTTP.Get(ts.URLForPath("/jwt/v1/help"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestStartWithNATS(t *testing.T) {
+	ts, err := Start(nil, true)
+	require.NoError(t, err)
+	defer ts.Cleanup()
+
+	acct, acctJWT, err := ts.CreateAccount()
+	require.NoError(t, err)
+	require.NoError(t, ts.PostAccount(acctJWT))
+
+	pubKey, err := acct.PublicKey()
+	require.NoError(t, err)
+	resp, err := ts.HTTP.Get(ts.URLForPath("/jwt/v1/accounts/" + pubKey))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, string(body))
+
+	// the nats-server resolves the account from the account server
+	creds, err := ts.CreateUserCreds(acct)
+	require.NoError(t, err)
+	nc, err := nats.Connect(ts.GNATSD.ClientURL(), nats.UserCredentials(creds), nats.Timeout(2*time.Second))
+	require.NoError(t, err)
+	nc.Close()
+}